@@ -0,0 +1,79 @@
+// Command e2e runs scripted multi-client scenarios against a running server
+// and reports each one as PASS or FAIL with its duration. It exits non-zero
+// if any scenario fails, so it can serve as a smoke test after a deploy:
+//
+//	e2e -url https://happy.example.com
+//	e2e -url http://localhost:3000 -scenarios pair,rpc
+//
+// Every run signs in with fresh keys, so it leaves a few throwaway accounts
+// behind on the target server.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+const defaultTimeout = 30 * time.Second
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout))
+}
+
+func run(args []string, out io.Writer) int {
+	flags := flag.NewFlagSet("e2e", flag.ContinueOnError)
+	flags.SetOutput(out)
+	baseURL := flags.String("url", "http://localhost:3000", "base URL of the server under test")
+	only := flags.String("scenarios", "", "comma-separated scenarios to run (default all: "+strings.Join(scenarioNames(), ",")+")")
+	timeout := flags.Duration("timeout", defaultTimeout, "time limit for each scenario")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	selected, err := selectScenarios(*only)
+	if err != nil {
+		fmt.Fprintf(out, "e2e: %v\n", err)
+		return 2
+	}
+
+	failed := 0
+	start := time.Now()
+	for _, sc := range selected {
+		ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+		began := time.Now()
+		err := sc.run(ctx, newEnv(*baseURL))
+		cancel()
+		elapsed := time.Since(began).Round(time.Millisecond)
+		if err != nil {
+			failed++
+			fmt.Fprintf(out, "FAIL  %-10s %8s  %v\n", sc.name, elapsed, err)
+			continue
+		}
+		fmt.Fprintf(out, "PASS  %-10s %8s\n", sc.name, elapsed)
+	}
+	fmt.Fprintf(out, "%d passed, %d failed in %s\n", len(selected)-failed, failed, time.Since(start).Round(time.Millisecond))
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+func selectScenarios(only string) ([]scenario, error) {
+	if only == "" {
+		return scenarios, nil
+	}
+	var out []scenario
+	for _, name := range strings.Split(only, ",") {
+		sc, ok := findScenario(strings.TrimSpace(name))
+		if !ok {
+			return nil, fmt.Errorf("unknown scenario %q", name)
+		}
+		out = append(out, sc)
+	}
+	return out, nil
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"happy-server-lite/pkg/servertest"
+)
+
+func TestRunAllScenarios(t *testing.T) {
+	srv := servertest.New(t)
+	var out bytes.Buffer
+	if code := run([]string{"-url", srv.URL, "-timeout", "10s"}, &out); code != 0 {
+		t.Fatalf("exit %d:\n%s", code, out.String())
+	}
+	for _, name := range scenarioNames() {
+		if !strings.Contains(out.String(), "PASS  "+name) {
+			t.Fatalf("expected %s to pass:\n%s", name, out.String())
+		}
+	}
+}
+
+func TestRunReportsFailures(t *testing.T) {
+	var out bytes.Buffer
+	if code := run([]string{"-url", "http://127.0.0.1:1", "-scenarios", "pair", "-timeout", "2s"}, &out); code != 1 {
+		t.Fatalf("exit %d, want 1:\n%s", code, out.String())
+	}
+	if !strings.Contains(out.String(), "FAIL  pair") {
+		t.Fatalf("expected pair to fail:\n%s", out.String())
+	}
+	if code := run([]string{"-scenarios", "nope"}, &out); code != 2 {
+		t.Fatalf("exit %d for an unknown scenario, want 2", code)
+	}
+}
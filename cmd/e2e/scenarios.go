@@ -0,0 +1,306 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"happy-server-lite/pkg/client"
+)
+
+// pairPollInterval paces a paired device's polls for its token.
+const pairPollInterval = 100 * time.Millisecond
+
+type scenario struct {
+	name string
+	run  func(ctx context.Context, e *env) error
+}
+
+// scenarios run in this order when none are picked on the command line.
+// Each one signs in on its own so any subset can be run alone.
+var scenarios = []scenario{
+	{"pair", scenarioPair},
+	{"session", scenarioSession},
+	{"messages", scenarioMessages},
+	{"rpc", scenarioRPC},
+	{"replay", scenarioReplay},
+}
+
+func scenarioNames() []string {
+	names := make([]string, len(scenarios))
+	for i, sc := range scenarios {
+		names[i] = sc.name
+	}
+	return names
+}
+
+func findScenario(name string) (scenario, bool) {
+	for _, sc := range scenarios {
+		if sc.name == name {
+			return sc, true
+		}
+	}
+	return scenario{}, false
+}
+
+type env struct {
+	baseURL string
+}
+
+func newEnv(baseURL string) *env {
+	return &env{baseURL: baseURL}
+}
+
+// signIn signs a fresh key in through /v1/auth, creating a new account.
+func (e *env) signIn(ctx context.Context) (*client.Client, error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	c := client.New(e.baseURL)
+	ch, err := c.AuthChallenge(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("auth challenge: %w", err)
+	}
+	nonce, err := base64.StdEncoding.DecodeString(ch.Challenge)
+	if err != nil {
+		return nil, fmt.Errorf("auth challenge: %w", err)
+	}
+	sig := ed25519.Sign(priv, nonce)
+	if _, err := c.Auth(ctx, base64.StdEncoding.EncodeToString(pub), ch.Challenge, base64.StdEncoding.EncodeToString(sig)); err != nil {
+		return nil, fmt.Errorf("auth: %w", err)
+	}
+	return c, nil
+}
+
+// pair signs a first device in and pairs a second one to the same account
+// the way the mobile app does: the new device asks, the first approves, and
+// the new device collects its token on its next poll.
+func (e *env) pair(ctx context.Context) (*client.Client, *client.Client, error) {
+	first, err := e.signIn(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	publicKey := base64.StdEncoding.EncodeToString(pub)
+	second := client.New(e.baseURL)
+	if _, err := second.RequestAuth(ctx, publicKey, true); err != nil {
+		return nil, nil, fmt.Errorf("request auth: %w", err)
+	}
+	if err := first.ApproveAuthRequest(ctx, publicKey, "e2e-response"); err != nil {
+		return nil, nil, fmt.Errorf("approve: %w", err)
+	}
+	for {
+		state, err := second.RequestAuth(ctx, publicKey, true)
+		if err != nil {
+			return nil, nil, fmt.Errorf("poll auth request: %w", err)
+		}
+		if state.State == "authorized" {
+			if state.Token == "" {
+				return nil, nil, errors.New("authorized request carried no token")
+			}
+			second.SetToken(state.Token)
+			return first, second, nil
+		}
+		select {
+		case <-time.After(pairPollInterval):
+		case <-ctx.Done():
+			return nil, nil, fmt.Errorf("waiting for approval: %w", ctx.Err())
+		}
+	}
+}
+
+func scenarioPair(ctx context.Context, e *env) error {
+	first, second, err := e.pair(ctx)
+	if err != nil {
+		return err
+	}
+	a, err := first.Profile(ctx)
+	if err != nil {
+		return fmt.Errorf("profile: %w", err)
+	}
+	b, err := second.Profile(ctx)
+	if err != nil {
+		return fmt.Errorf("paired profile: %w", err)
+	}
+	if a.ID != b.ID {
+		return fmt.Errorf("paired device signed in as %s, want %s", b.ID, a.ID)
+	}
+	return nil
+}
+
+func scenarioSession(ctx context.Context, e *env) error {
+	first, second, err := e.pair(ctx)
+	if err != nil {
+		return err
+	}
+	sess, err := first.CreateSession(ctx, client.CreateSessionRequest{Tag: randomID("tag"), Metadata: "e2e"})
+	if err != nil {
+		return fmt.Errorf("create session: %w", err)
+	}
+	sessions, err := second.ListSessions(ctx)
+	if err != nil {
+		return fmt.Errorf("list sessions: %w", err)
+	}
+	for _, s := range sessions {
+		if s.ID == sess.ID {
+			return nil
+		}
+	}
+	return fmt.Errorf("session %s not listed on the paired device", sess.ID)
+}
+
+func scenarioMessages(ctx context.Context, e *env) error {
+	first, second, err := e.pair(ctx)
+	if err != nil {
+		return err
+	}
+	sess, err := first.CreateSession(ctx, client.CreateSessionRequest{Tag: randomID("tag"), Metadata: "e2e"})
+	if err != nil {
+		return fmt.Errorf("create session: %w", err)
+	}
+	sock, err := second.ConnectSocket(ctx, client.SocketOptions{})
+	if err != nil {
+		return fmt.Errorf("connect: %w", err)
+	}
+	defer sock.Close()
+
+	content := randomID("message")
+	if _, err := first.PostMessage(ctx, sess.ID, content, ""); err != nil {
+		return fmt.Errorf("post message: %w", err)
+	}
+	return waitForMessage(ctx, sock, sess.ID, content)
+}
+
+func scenarioRPC(ctx context.Context, e *env) error {
+	first, second, err := e.pair(ctx)
+	if err != nil {
+		return err
+	}
+	daemon, err := first.ConnectSocket(ctx, client.SocketOptions{})
+	if err != nil {
+		return fmt.Errorf("connect daemon: %w", err)
+	}
+	defer daemon.Close()
+	go drain(daemon)
+
+	method := randomID("e2e") + ":echo"
+	if err := daemon.RegisterRPC(ctx, method, func(params string) string { return "echo:" + params }); err != nil {
+		return fmt.Errorf("register rpc: %w", err)
+	}
+
+	caller, err := second.ConnectSocket(ctx, client.SocketOptions{})
+	if err != nil {
+		return fmt.Errorf("connect caller: %w", err)
+	}
+	defer caller.Close()
+	go drain(caller)
+
+	result, err := caller.CallRPC(ctx, method, "ping")
+	if err != nil {
+		return fmt.Errorf("call rpc: %w", err)
+	}
+	if result != "echo:ping" {
+		return fmt.Errorf("rpc returned %q, want %q", result, "echo:ping")
+	}
+	return nil
+}
+
+// scenarioReplay drops a socket, sends while it is away, and checks that
+// the reconnected device catches up from its last seq and that a retried
+// send is not stored twice.
+func scenarioReplay(ctx context.Context, e *env) error {
+	first, second, err := e.pair(ctx)
+	if err != nil {
+		return err
+	}
+	sess, err := first.CreateSession(ctx, client.CreateSessionRequest{Tag: randomID("tag"), Metadata: "e2e"})
+	if err != nil {
+		return fmt.Errorf("create session: %w", err)
+	}
+	seen, err := first.PostMessage(ctx, sess.ID, randomID("before"), "")
+	if err != nil {
+		return fmt.Errorf("post message: %w", err)
+	}
+
+	sock, err := second.ConnectSocket(ctx, client.SocketOptions{})
+	if err != nil {
+		return fmt.Errorf("connect: %w", err)
+	}
+	sock.Close()
+
+	localID := randomID("local")
+	missed, err := first.PostMessageOnce(ctx, sess.ID, randomID("missed"), "", localID)
+	if err != nil {
+		return fmt.Errorf("post message: %w", err)
+	}
+	retried, err := first.PostMessageOnce(ctx, sess.ID, missed.Content.C, "", localID)
+	if err != nil {
+		return fmt.Errorf("retry message: %w", err)
+	}
+	if retried.ID != missed.ID {
+		return fmt.Errorf("retried send stored as %s, want %s", retried.ID, missed.ID)
+	}
+
+	sock, err = second.ConnectSocket(ctx, client.SocketOptions{})
+	if err != nil {
+		return fmt.Errorf("reconnect: %w", err)
+	}
+	defer sock.Close()
+	msgs, err := second.ListMessages(ctx, sess.ID, seen.Seq, 100)
+	if err != nil {
+		return fmt.Errorf("list messages: %w", err)
+	}
+	if len(msgs) != 1 || msgs[0].ID != missed.ID {
+		return fmt.Errorf("replay after seq %d returned %d messages, want only %s", seen.Seq, len(msgs), missed.ID)
+	}
+	return nil
+}
+
+// waitForMessage reads sock until a new-message update with content arrives
+// for sessionID.
+func waitForMessage(ctx context.Context, sock *client.Socket, sessionID, content string) error {
+	for {
+		select {
+		case ev := <-sock.Events():
+			var update struct {
+				Body struct {
+					T       string         `json:"t"`
+					SID     string         `json:"sid"`
+					Message client.Message `json:"message"`
+				} `json:"body"`
+			}
+			if ev.Name != "update" || ev.Decode(&update) != nil {
+				continue
+			}
+			if update.Body.T == "new-message" && update.Body.SID == sessionID && update.Body.Message.Content.C == content {
+				return nil
+			}
+		case <-sock.Done():
+			return fmt.Errorf("socket closed waiting for message: %v", sock.Err())
+		case <-ctx.Done():
+			return fmt.Errorf("waiting for message: %w", ctx.Err())
+		}
+	}
+}
+
+// drain discards events on a socket a scenario only uses for acks, so the
+// buffer never backs up.
+func drain(sock *client.Socket) {
+	for range sock.Events() {
+	}
+}
+
+func randomID(prefix string) string {
+	b := make([]byte, 6)
+	_, _ = rand.Read(b)
+	return prefix + "-" + hex.EncodeToString(b)
+}
@@ -1,32 +1,48 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
+	"net/http"
+	"os/signal"
+	"syscall"
+	"time"
 
-	"github.com/gin-gonic/gin"
-	"happy-server-lite/internal/auth"
-	"happy-server-lite/internal/config"
-	"happy-server-lite/internal/server"
-	"happy-server-lite/internal/store"
+	"happy-server-lite/pkg/happyserver"
 )
 
+// shutdownTimeout bounds how long in-flight requests may run after a stop
+// signal.
+const shutdownTimeout = 10 * time.Second
+
 func main() {
-	cfg, err := config.LoadConfig()
+	srv, err := happyserver.NewFromEnv()
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	gin.SetMode(cfg.GinMode)
-	st := store.NewWithOptions(store.Options{MachinesStateFile: cfg.MachinesStateFile})
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	errc := make(chan error, 1)
+	go func() { errc <- srv.ListenAndServe() }()
+	log.Printf("listening on %s", fmt.Sprintf(":%d", srv.Port()))
 
-	tokenCfg := auth.TokenConfig{
-		Secret: cfg.MasterSecret,
-		Expiry: cfg.TokenExpiry,
-		Issuer: "happy-server-lite",
+	select {
+	case err := <-errc:
+		log.Fatal(err)
+	case <-ctx.Done():
 	}
 
-	router := server.NewRouter(server.Deps{Store: st, TokenConfig: tokenCfg})
-	log.Printf("listening on %s", fmt.Sprintf(":%d", cfg.Port))
-	log.Fatal(server.Run(cfg, router))
+	log.Printf("shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Printf("shutdown: %v", err)
+	}
+	if err := <-errc; err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Printf("server: %v", err)
+	}
 }
@@ -0,0 +1,117 @@
+package apierror
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+type Code string
+
+const (
+	CodeInvalidRequest  Code = "invalid_request"
+	CodeUnauthorized    Code = "unauthorized"
+	CodeForbidden       Code = "forbidden"
+	CodeNotFound        Code = "not_found"
+	CodeConflict        Code = "conflict"
+	CodeVersionMismatch Code = "version_mismatch"
+	CodeRateLimited     Code = "rate_limited"
+	CodePayloadTooLarge Code = "payload_too_large"
+	CodeUnavailable     Code = "unavailable"
+	CodeInternal        Code = "internal"
+)
+
+// Format selects the shape of error bodies. FormatLegacy keeps the
+// {"error": "<message>"} shape existing clients match on and adds a "code"
+// field next to it; FormatEnvelope nests both under "error".
+type Format string
+
+const (
+	FormatLegacy   Format = "legacy"
+	FormatEnvelope Format = "envelope"
+)
+
+const (
+	FormatHeader     = "X-Error-Format"
+	formatContextKey = "errorFormat"
+)
+
+func ParseFormat(raw string) (Format, bool) {
+	switch Format(raw) {
+	case FormatLegacy, FormatEnvelope:
+		return Format(raw), true
+	default:
+		return "", false
+	}
+}
+
+// Middleware records the error format for the request. Clients can opt in per
+// request with the X-Error-Format header regardless of the server default.
+func Middleware(defaultFormat Format) gin.HandlerFunc {
+	if defaultFormat == "" {
+		defaultFormat = FormatLegacy
+	}
+	return func(c *gin.Context) {
+		format := defaultFormat
+		if f, ok := ParseFormat(c.GetHeader(FormatHeader)); ok {
+			format = f
+		}
+		c.Set(formatContextKey, format)
+		c.Next()
+	}
+}
+
+func FormatFromContext(c *gin.Context) Format {
+	if v, ok := c.Get(formatContextKey); ok {
+		if f, ok := v.(Format); ok {
+			return f
+		}
+	}
+	return FormatLegacy
+}
+
+// Body builds an error body; extra fields (current versions and the like) are
+// merged at the top level in both formats.
+func Body(format Format, code Code, message string, extra gin.H) gin.H {
+	var body gin.H
+	if format == FormatEnvelope {
+		body = gin.H{"success": false, "error": gin.H{"code": code, "message": message}}
+	} else {
+		body = gin.H{"error": message, "code": code}
+	}
+	for k, v := range extra {
+		if k == "error" || k == "code" {
+			continue
+		}
+		body[k] = v
+	}
+	return body
+}
+
+func Respond(c *gin.Context, status int, code Code, message string) {
+	RespondWith(c, status, code, message, nil)
+}
+
+func RespondWith(c *gin.Context, status int, code Code, message string, extra gin.H) {
+	c.JSON(status, Body(FormatFromContext(c), code, message, extra))
+}
+
+func Abort(c *gin.Context, status int, code Code, message string) {
+	Respond(c, status, code, message)
+	c.Abort()
+}
+
+// VersionMismatch keeps the historical 200 + {"success": false,
+// "error": "version-mismatch"} contract in legacy mode.
+func VersionMismatch(c *gin.Context, extra gin.H) {
+	body := gin.H{"success": false}
+	for k, v := range extra {
+		body[k] = v
+	}
+	RespondWith(c, http.StatusOK, CodeVersionMismatch, "version-mismatch", body)
+}
+
+// Socket builds the payload for a Socket.IO "error" event.
+func Socket(code Code, message string) gin.H {
+	return gin.H{"message": message, "code": code}
+}
@@ -0,0 +1,60 @@
+package apierror
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func serve(t *testing.T, defaultFormat Format, header string) map[string]any {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(Middleware(defaultFormat))
+	r.GET("/", func(c *gin.Context) {
+		Respond(c, http.StatusNotFound, CodeNotFound, "Session not found")
+	})
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	if header != "" {
+		req.Header.Set(FormatHeader, header)
+	}
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404, got %d", w.Code)
+	}
+	var body map[string]any
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	return body
+}
+
+func TestRespond_LegacyFormat(t *testing.T) {
+	body := serve(t, FormatLegacy, "")
+	if body["error"] != "Session not found" || body["code"] != "not_found" {
+		t.Fatalf("unexpected legacy body: %v", body)
+	}
+}
+
+func TestRespond_EnvelopeViaHeader(t *testing.T) {
+	body := serve(t, FormatLegacy, "envelope")
+	errObj, ok := body["error"].(map[string]any)
+	if !ok {
+		t.Fatalf("expected error object, got %v", body)
+	}
+	if errObj["code"] != "not_found" || errObj["message"] != "Session not found" || body["success"] != false {
+		t.Fatalf("unexpected envelope body: %v", body)
+	}
+}
+
+func TestBody_VersionMismatchExtraFields(t *testing.T) {
+	body := Body(FormatLegacy, CodeVersionMismatch, "version-mismatch", gin.H{"success": false, "currentVersion": 3})
+	if body["error"] != "version-mismatch" || body["currentVersion"] != 3 || body["success"] != false {
+		t.Fatalf("unexpected body: %v", body)
+	}
+}
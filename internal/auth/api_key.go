@@ -0,0 +1,30 @@
+package auth
+
+import "strings"
+
+// API keys are "hsl_<id>.<secret>": the prefix lets secret scanners spot a
+// leaked key, the id names it in the store and, as with refresh tokens, only
+// a hash of the secret is stored.
+const apiKeyPrefix = "hsl_"
+
+// NewAPIKeySecret returns a random secret and the hash the store keeps.
+func NewAPIKeySecret() (secret, hash string, err error) {
+	return NewRefreshSecret()
+}
+
+func HashAPIKeySecret(secret string) string {
+	return HashRefreshSecret(secret)
+}
+
+func FormatAPIKey(id, secret string) string {
+	return apiKeyPrefix + FormatRefreshToken(id, secret)
+}
+
+// ParseAPIKey splits an API key into its id and secret.
+func ParseAPIKey(key string) (id, secret string, ok bool) {
+	rest, found := strings.CutPrefix(key, apiKeyPrefix)
+	if !found {
+		return "", "", false
+	}
+	return ParseRefreshToken(rest)
+}
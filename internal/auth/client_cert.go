@@ -0,0 +1,31 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+)
+
+// MachineCertID returns the common name of the client certificate r was
+// verified with, which is the machine id a daemon's certificate is issued
+// for; false when r came without a verified certificate.
+func MachineCertID(r *http.Request) (string, bool) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return "", false
+	}
+	cn := r.TLS.VerifiedChains[0][0].Subject.CommonName
+	return cn, cn != ""
+}
+
+type machineCertKey struct{}
+
+// WithMachineCert records the machine id a request's client certificate was
+// issued for, for handlers that only see the request's context.
+func WithMachineCert(ctx context.Context, machineID string) context.Context {
+	return context.WithValue(ctx, machineCertKey{}, machineID)
+}
+
+// MachineCertFromContext returns the machine id set by WithMachineCert.
+func MachineCertFromContext(ctx context.Context) (string, bool) {
+	id, _ := ctx.Value(machineCertKey{}).(string)
+	return id, id != ""
+}
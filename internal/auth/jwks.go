@@ -0,0 +1,41 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/base64"
+	"math/big"
+)
+
+// JWK is the public half of a signing key in JSON Web Key form.
+type JWK struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid,omitempty"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	Curve     string `json:"crv,omitempty"`
+	X         string `json:"x,omitempty"`
+	N         string `json:"n,omitempty"`
+	E         string `json:"e,omitempty"`
+}
+
+// JWKS lists the public keys that verify tokens, the current one first, for
+// services that check tokens without holding a secret. Secrets are never
+// listed, so it is empty unless PrivateKey is set or previous public keys
+// are kept.
+func (cfg TokenConfig) JWKS() []JWK {
+	keys := []JWK{}
+	for _, k := range cfg.verificationKeys() {
+		switch pub := k.PublicKey.(type) {
+		case ed25519.PublicKey:
+			keys = append(keys, JWK{KeyType: "OKP", KeyID: k.ID, Use: "sig", Algorithm: "EdDSA", Curve: "Ed25519", X: b64(pub)})
+		case *rsa.PublicKey:
+			keys = append(keys, JWK{KeyType: "RSA", KeyID: k.ID, Use: "sig", Algorithm: "RS256", N: b64(pub.N.Bytes()), E: b64(big.NewInt(int64(pub.E)).Bytes())})
+		}
+	}
+	return keys
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
@@ -1,25 +1,66 @@
 package auth
 
 import (
+	"context"
+	"crypto"
 	"crypto/rand"
 	"encoding/hex"
 	"errors"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
+	"happy-server-lite/internal/clock"
 )
 
 type Claims struct {
 	UserID string `json:"sub"`
+	// Scope is set on tokens from CreateScopedToken.
+	Scope *Scope `json:"scope,omitempty"`
+	// DeviceID is set on tokens from CreateDeviceToken.
+	DeviceID string `json:"did,omitempty"`
 	jwt.RegisteredClaims
 }
 
 type TokenConfig struct {
 	Secret string
 	Expiry time.Duration
+	// Issuer is the iss of the tokens signed and, when set, the only one
+	// VerifyToken accepts.
 	Issuer string
+	// Audience, when set, is the aud of the bearer tokens signed and the
+	// only one VerifyToken accepts, so servers sharing a key but not an
+	// audience refuse each other's tokens. Tokens signed before it was set
+	// stop verifying. Empty signs tokens without one and refuses any that
+	// have one.
+	Audience string
+	// PrivateKey, when set, signs tokens in place of Secret: an
+	// ed25519.PrivateKey with EdDSA or an *rsa.PrivateKey with RS256, so
+	// other services can verify them with the public key alone. Secret then
+	// only verifies the HS256 tokens signed before the switch.
+	PrivateKey crypto.Signer
+	// KeyID names the signing key in the kid header of the tokens it signs;
+	// empty sends no kid.
+	KeyID string
+	// PreviousKeys are keys rotated out of signing whose tokens still
+	// verify until they expire.
+	PreviousKeys []SigningKey
+	// Revocations, when set, makes VerifyToken reject revoked tokens.
+	Revocations *Revocations
+	// AccountDisabled, when set, makes VerifyToken fail with
+	// ErrAccountDisabled for suspended accounts.
+	AccountDisabled func(ctx context.Context, userID string) bool
+	// DeviceSeen, when set, is told about each use of a token issued to a
+	// device and makes VerifyToken fail with ErrDeviceRevoked when it
+	// reports the device signed out. ClientIPFromContext(ctx) is where the
+	// token was used from.
+	DeviceSeen func(ctx context.Context, userID, deviceID string) bool
+	// Clock dates issued tokens and checks their expiry; nil reads the wall
+	// clock.
+	Clock clock.Clock
 }
 
+var ErrAccountDisabled = errors.New("account disabled")
+
 func DefaultTokenConfig(secret string) TokenConfig {
 	return TokenConfig{
 		Secret: secret,
@@ -29,10 +70,46 @@ func DefaultTokenConfig(secret string) TokenConfig {
 }
 
 func CreateToken(userID string, cfg TokenConfig) (string, error) {
-	if cfg.Secret == "" {
-		return "", errors.New("missing secret")
+	return createToken(userID, nil, "", cfg)
+}
+
+// CreateScopedToken issues a token for userID that only reaches the session
+// or machine named by scope.
+func CreateScopedToken(userID string, scope Scope, cfg TokenConfig) (string, error) {
+	if err := scope.validate(); err != nil {
+		return "", err
+	}
+	return createToken(userID, &scope, "", cfg)
+}
+
+// RenewToken issues a fresh token with the user, scope and device of one
+// that verified, for a new id and a full expiry. The old token stays valid
+// until its own expiry.
+func RenewToken(userID string, scope Scope, deviceID string, cfg TokenConfig) (string, error) {
+	if scope.IsZero() {
+		return createToken(userID, nil, deviceID, cfg)
 	}
-	if userID == "" {
+	if err := scope.validate(); err != nil {
+		return "", err
+	}
+	return createToken(userID, &scope, deviceID, cfg)
+}
+
+func createToken(userID string, scope *Scope, deviceID string, cfg TokenConfig) (string, error) {
+	claims := Claims{UserID: userID, Scope: scope, DeviceID: deviceID}
+	if cfg.Audience != "" {
+		claims.Audience = jwt.ClaimStrings{cfg.Audience}
+	}
+	return signToken(claims, cfg)
+}
+
+// signToken dates, identifies and signs claims. Their Audience is kept.
+func signToken(claims Claims, cfg TokenConfig) (string, error) {
+	method, key, err := cfg.signingMethod()
+	if err != nil {
+		return "", err
+	}
+	if claims.UserID == "" {
 		return "", errors.New("missing userID")
 	}
 	if cfg.Expiry <= 0 {
@@ -44,33 +121,46 @@ func CreateToken(userID string, cfg TokenConfig) (string, error) {
 		return "", err
 	}
 	jti := hex.EncodeToString(jtiBytes)
+	now := clock.Now(cfg.Clock)
 
-	claims := Claims{
-		UserID: userID,
-		RegisteredClaims: jwt.RegisteredClaims{
-			Issuer:    cfg.Issuer,
-			IssuedAt:  jwt.NewNumericDate(time.Now()),
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(cfg.Expiry)),
-			ID:        jti,
-			Subject:   userID,
-		},
+	claims.RegisteredClaims = jwt.RegisteredClaims{
+		Issuer:    cfg.Issuer,
+		IssuedAt:  jwt.NewNumericDate(now),
+		ExpiresAt: jwt.NewNumericDate(now.Add(cfg.Expiry)),
+		ID:        jti,
+		Subject:   claims.UserID,
+		Audience:  claims.Audience,
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString([]byte(cfg.Secret))
+	token := jwt.NewWithClaims(method, claims)
+	if cfg.KeyID != "" {
+		token.Header["kid"] = cfg.KeyID
+	}
+	return token.SignedString(key)
+}
+
+// parserOptions are the checks every token of cfg is held to: its expiry
+// and, when cfg has one, its issuer.
+func (cfg TokenConfig) parserOptions() []jwt.ParserOption {
+	opts := []jwt.ParserOption{jwt.WithTimeFunc(func() time.Time { return clock.Now(cfg.Clock) })}
+	if cfg.Issuer != "" {
+		opts = append(opts, jwt.WithIssuer(cfg.Issuer))
+	}
+	return opts
 }
 
-func VerifyToken(tokenString string, cfg TokenConfig) (*Claims, error) {
-	if cfg.Secret == "" {
+// VerifyToken checks tokenString and returns its claims. ctx bounds the
+// AccountDisabled and DeviceSeen lookups.
+func VerifyToken(ctx context.Context, tokenString string, cfg TokenConfig) (*Claims, error) {
+	if cfg.Secret == "" && cfg.PrivateKey == nil {
 		return nil, errors.New("missing secret")
 	}
 
-	parsed, err := jwt.ParseWithClaims(tokenString, &Claims{}, func(t *jwt.Token) (interface{}, error) {
-		if t.Method != jwt.SigningMethodHS256 {
-			return nil, jwt.ErrSignatureInvalid
-		}
-		return []byte(cfg.Secret), nil
-	})
+	opts := cfg.parserOptions()
+	if cfg.Audience != "" {
+		opts = append(opts, jwt.WithAudience(cfg.Audience))
+	}
+	parsed, err := jwt.ParseWithClaims(tokenString, &Claims{}, cfg.verificationKey, opts...)
 	if err != nil {
 		return nil, err
 	}
@@ -79,5 +169,22 @@ func VerifyToken(tokenString string, cfg TokenConfig) (*Claims, error) {
 	if !ok || !parsed.Valid {
 		return nil, jwt.ErrSignatureInvalid
 	}
+	// Tokens minted for a single purpose, such as OAuth state, are not
+	// bearer tokens: they have an audience of their own.
+	if cfg.Audience == "" && len(claims.Audience) > 0 {
+		return nil, jwt.ErrTokenInvalidAudience
+	}
+	if claims.Scope != nil && claims.Scope.validate() != nil {
+		return nil, ErrInvalidScope
+	}
+	if cfg.Revocations != nil && cfg.Revocations.Revoked(claims) {
+		return nil, ErrTokenRevoked
+	}
+	if cfg.AccountDisabled != nil && cfg.AccountDisabled(ctx, claims.UserID) {
+		return nil, ErrAccountDisabled
+	}
+	if claims.DeviceID != "" && cfg.DeviceSeen != nil && !cfg.DeviceSeen(ctx, claims.UserID, claims.DeviceID) {
+		return nil, ErrDeviceRevoked
+	}
 	return claims, nil
 }
@@ -1,18 +1,24 @@
 package auth
 
 import (
+	"context"
+	"errors"
 	"testing"
 	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"happy-server-lite/internal/clock"
 )
 
 func TestCreateAndVerifyToken(t *testing.T) {
+	ctx := context.Background()
 	cfg := TokenConfig{Secret: "secret", Expiry: time.Hour, Issuer: "test"}
 	tok, err := CreateToken("user-1", cfg)
 	if err != nil {
 		t.Fatalf("CreateToken: %v", err)
 	}
 
-	claims, err := VerifyToken(tok, cfg)
+	claims, err := VerifyToken(ctx, tok, cfg)
 	if err != nil {
 		t.Fatalf("VerifyToken: %v", err)
 	}
@@ -22,18 +28,60 @@ func TestCreateAndVerifyToken(t *testing.T) {
 }
 
 func TestVerifyToken_WrongSecret(t *testing.T) {
+	ctx := context.Background()
 	cfg := TokenConfig{Secret: "secret", Expiry: time.Hour, Issuer: "test"}
 	tok, err := CreateToken("user-1", cfg)
 	if err != nil {
 		t.Fatalf("CreateToken: %v", err)
 	}
 
-	_, err = VerifyToken(tok, TokenConfig{Secret: "wrong", Expiry: time.Hour, Issuer: "test"})
+	_, err = VerifyToken(ctx, tok, TokenConfig{Secret: "wrong", Expiry: time.Hour, Issuer: "test"})
 	if err == nil {
 		t.Fatalf("expected error")
 	}
 }
 
+func TestVerifyToken_IssuerAndAudience(t *testing.T) {
+	ctx := context.Background()
+	cfg := TokenConfig{Secret: "secret", Expiry: time.Hour, Issuer: "server-a", Audience: "https://a.example.com"}
+	tok, err := CreateToken("user-1", cfg)
+	if err != nil {
+		t.Fatalf("CreateToken: %v", err)
+	}
+	claims, err := VerifyToken(ctx, tok, cfg)
+	if err != nil || claims.Issuer != "server-a" || len(claims.Audience) != 1 || claims.Audience[0] != "https://a.example.com" {
+		t.Fatalf("unexpected claims: %+v (%v)", claims, err)
+	}
+
+	otherIssuer := cfg
+	otherIssuer.Issuer = "server-b"
+	if _, err := VerifyToken(ctx, tok, otherIssuer); !errors.Is(err, jwt.ErrTokenInvalidIssuer) {
+		t.Fatalf("expected a token of another issuer to be rejected, got %v", err)
+	}
+	otherAudience := cfg
+	otherAudience.Audience = "https://b.example.com"
+	if _, err := VerifyToken(ctx, tok, otherAudience); !errors.Is(err, jwt.ErrTokenInvalidAudience) {
+		t.Fatalf("expected a token for another audience to be rejected, got %v", err)
+	}
+	noAudience := cfg
+	noAudience.Audience = ""
+	if _, err := VerifyToken(ctx, tok, noAudience); !errors.Is(err, jwt.ErrTokenInvalidAudience) {
+		t.Fatalf("expected a token with an audience to be rejected without one configured, got %v", err)
+	}
+	plain, _ := CreateToken("user-1", noAudience)
+	if _, err := VerifyToken(ctx, plain, cfg); err == nil {
+		t.Fatalf("expected a token without the audience to be rejected")
+	}
+
+	state, _ := CreateStateToken("user-1", "github-connect", time.Minute, cfg)
+	if _, err := VerifyToken(ctx, state, cfg); err == nil {
+		t.Fatalf("expected a state token not to work as a bearer token")
+	}
+	if _, err := VerifyStateToken(ctx, state, "github-connect", otherIssuer); !errors.Is(err, jwt.ErrTokenInvalidIssuer) {
+		t.Fatalf("expected a state token of another issuer to be rejected, got %v", err)
+	}
+}
+
 func TestVerifyToken_Expired(t *testing.T) {
 	cfg := TokenConfig{Secret: "secret", Expiry: -time.Second, Issuer: "test"}
 	_, err := CreateToken("user-1", cfg)
@@ -41,3 +89,87 @@ func TestVerifyToken_Expired(t *testing.T) {
 		t.Fatalf("expected error")
 	}
 }
+
+func TestVerifyToken_ExpiresByClock(t *testing.T) {
+	ctx := context.Background()
+	clk := clock.NewFake(time.Unix(1_700_000_000, 0))
+	cfg := TokenConfig{Secret: "secret", Expiry: time.Hour, Issuer: "test", Clock: clk}
+	tok, err := CreateToken("user-1", cfg)
+	if err != nil {
+		t.Fatalf("CreateToken: %v", err)
+	}
+	claims, err := VerifyToken(ctx, tok, cfg)
+	if err != nil || !claims.IssuedAt.Time.Equal(clk.Now()) {
+		t.Fatalf("expected a token issued at the clock's time, got %+v (%v)", claims, err)
+	}
+
+	clk.Advance(time.Hour + time.Second)
+	if _, err := VerifyToken(ctx, tok, cfg); !errors.Is(err, jwt.ErrTokenExpired) {
+		t.Fatalf("expected the token to expire once the clock passes its expiry, got %v", err)
+	}
+}
+
+func TestCreateScopedToken(t *testing.T) {
+	ctx := context.Background()
+	cfg := TokenConfig{Secret: "secret", Expiry: time.Hour, Issuer: "test"}
+	tok, err := CreateScopedToken("user-1", Scope{SessionID: "s1"}, cfg)
+	if err != nil {
+		t.Fatalf("CreateScopedToken: %v", err)
+	}
+	claims, err := VerifyToken(ctx, tok, cfg)
+	if err != nil || claims.TokenScope() != (Scope{SessionID: "s1"}) {
+		t.Fatalf("expected a session-scoped token, got %+v (%v)", claims, err)
+	}
+
+	plain, _ := CreateToken("user-1", cfg)
+	if claims, err := VerifyToken(ctx, plain, cfg); err != nil || !claims.TokenScope().IsZero() {
+		t.Fatalf("expected an account-wide token, got %+v (%v)", claims, err)
+	}
+	for _, bad := range []Scope{{}, {SessionID: "s1", MachineID: "m1"}} {
+		if _, err := CreateScopedToken("user-1", bad, cfg); !errors.Is(err, ErrInvalidScope) {
+			t.Fatalf("expected %+v to be rejected, got %v", bad, err)
+		}
+	}
+}
+
+func TestRenewToken(t *testing.T) {
+	ctx := context.Background()
+	cfg := TokenConfig{Secret: "secret", Expiry: time.Hour, Issuer: "test"}
+	tok, err := RenewToken("user-1", Scope{MachineID: "m1"}, "d1", cfg)
+	if err != nil {
+		t.Fatalf("RenewToken: %v", err)
+	}
+	claims, err := VerifyToken(ctx, tok, cfg)
+	if err != nil || claims.UserID != "user-1" || claims.TokenScope() != (Scope{MachineID: "m1"}) || claims.DeviceID != "d1" {
+		t.Fatalf("expected the scope and device carried over, got %+v (%v)", claims, err)
+	}
+	if tok, _ := RenewToken("user-1", Scope{}, "", cfg); tok == "" {
+		t.Fatalf("expected an account-wide token to renew")
+	}
+	if _, err := RenewToken("user-1", Scope{SessionID: "s1", MachineID: "m1"}, "", cfg); !errors.Is(err, ErrInvalidScope) {
+		t.Fatalf("expected an invalid scope to be rejected, got %v", err)
+	}
+}
+
+func TestStateToken(t *testing.T) {
+	ctx := context.Background()
+	cfg := TokenConfig{Secret: "secret", Expiry: time.Hour, Issuer: "test"}
+	state, err := CreateStateToken("user-1", "github-connect", time.Minute, cfg)
+	if err != nil {
+		t.Fatalf("CreateStateToken: %v", err)
+	}
+	userID, err := VerifyStateToken(ctx, state, "github-connect", cfg)
+	if err != nil || userID != "user-1" {
+		t.Fatalf("VerifyStateToken: %q %v", userID, err)
+	}
+	if _, err := VerifyStateToken(ctx, state, "other", cfg); err == nil {
+		t.Fatalf("expected a state token for another audience to be rejected")
+	}
+	if _, err := VerifyToken(ctx, state, cfg); err == nil {
+		t.Fatalf("expected a state token not to work as a bearer token")
+	}
+	tok, _ := CreateToken("user-1", cfg)
+	if _, err := VerifyStateToken(ctx, tok, "github-connect", cfg); err == nil {
+		t.Fatalf("expected a bearer token not to work as a state token")
+	}
+}
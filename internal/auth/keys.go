@@ -0,0 +1,179 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// SigningKey is a key retired from signing that still verifies the tokens
+// it signed, which carry its ID in their kid header: a Secret for HS256
+// tokens or a PublicKey for EdDSA and RS256 ones.
+type SigningKey struct {
+	ID        string
+	Secret    string
+	PublicKey crypto.PublicKey
+}
+
+var ErrUnknownKey = errors.New("unknown signing key")
+
+// minRSABits is the smallest RSA key CheckKeys accepts.
+const minRSABits = 2048
+
+// CheckKeys reports a key setup that cannot sign tokens or that VerifyToken
+// could not tell apart: previous keys need distinct ids, none of them the
+// current KeyID, and a current KeyID so that new tokens name their key.
+func (cfg TokenConfig) CheckKeys() error {
+	if cfg.Secret == "" && cfg.PrivateKey == nil {
+		return errors.New("missing secret")
+	}
+	if cfg.PrivateKey != nil {
+		if _, _, err := cfg.signingMethod(); err != nil {
+			return err
+		}
+	}
+	if len(cfg.PreviousKeys) == 0 {
+		return nil
+	}
+	if cfg.KeyID == "" {
+		return errors.New("previous signing keys need a key id for the current key")
+	}
+	seen := map[string]bool{cfg.KeyID: true}
+	for _, k := range cfg.PreviousKeys {
+		if k.ID == "" || (k.Secret == "" && k.PublicKey == nil) {
+			return errors.New("previous signing keys need an id and a secret or public key")
+		}
+		if seen[k.ID] {
+			return fmt.Errorf("duplicate signing key id %q", k.ID)
+		}
+		seen[k.ID] = true
+	}
+	return nil
+}
+
+// signingMethod returns how new tokens are signed and with what.
+func (cfg TokenConfig) signingMethod() (jwt.SigningMethod, any, error) {
+	switch key := cfg.PrivateKey.(type) {
+	case nil:
+		if cfg.Secret == "" {
+			return nil, nil, errors.New("missing secret")
+		}
+		return jwt.SigningMethodHS256, []byte(cfg.Secret), nil
+	case ed25519.PrivateKey:
+		return jwt.SigningMethodEdDSA, key, nil
+	case *rsa.PrivateKey:
+		if key.N.BitLen() < minRSABits {
+			return nil, nil, fmt.Errorf("RSA signing keys need at least %d bits", minRSABits)
+		}
+		return jwt.SigningMethodRS256, key, nil
+	default:
+		return nil, nil, fmt.Errorf("unsupported signing key type %T", key)
+	}
+}
+
+// verificationKeys lists the current key followed by the previous ones.
+func (cfg TokenConfig) verificationKeys() []SigningKey {
+	current := SigningKey{ID: cfg.KeyID, Secret: cfg.Secret}
+	if cfg.PrivateKey != nil {
+		current.PublicKey = cfg.PrivateKey.Public()
+	}
+	return append([]SigningKey{current}, cfg.PreviousKeys...)
+}
+
+// verifies returns what checks a token signed with method by k, or nil when
+// k cannot have signed it.
+func (k SigningKey) verifies(method jwt.SigningMethod) jwt.VerificationKey {
+	switch method {
+	case jwt.SigningMethodHS256:
+		if k.Secret != "" {
+			return []byte(k.Secret)
+		}
+	case jwt.SigningMethodEdDSA:
+		if pub, ok := k.PublicKey.(ed25519.PublicKey); ok {
+			return pub
+		}
+	case jwt.SigningMethodRS256:
+		if pub, ok := k.PublicKey.(*rsa.PublicKey); ok {
+			return pub
+		}
+	}
+	return nil
+}
+
+// verificationKey picks the key for a token by its kid header and signing
+// method. Tokens without a kid predate key ids and may have been signed by
+// any of the keys.
+func (cfg TokenConfig) verificationKey(t *jwt.Token) (interface{}, error) {
+	kid, _ := t.Header["kid"].(string)
+	var set jwt.VerificationKeySet
+	known := kid == ""
+	for _, k := range cfg.verificationKeys() {
+		if kid != "" && k.ID != kid {
+			continue
+		}
+		known = true
+		if key := k.verifies(t.Method); key != nil {
+			set.Keys = append(set.Keys, key)
+		}
+	}
+	switch {
+	case !known:
+		return nil, ErrUnknownKey
+	case len(set.Keys) == 0:
+		return nil, jwt.ErrSignatureInvalid
+	case len(set.Keys) == 1:
+		return set.Keys[0], nil
+	}
+	return set, nil
+}
+
+// ParsePrivateKeyPEM parses an Ed25519 or RSA private key in PKCS #8 PEM,
+// or an RSA key in PKCS #1 PEM, for TokenConfig.PrivateKey.
+func ParsePrivateKeyPEM(data []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+	if block.Type == "RSA PRIVATE KEY" {
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	switch key := key.(type) {
+	case ed25519.PrivateKey:
+		return key, nil
+	case *rsa.PrivateKey:
+		return key, nil
+	default:
+		return nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+}
+
+// ParsePublicKeyPEM parses an Ed25519 or RSA public key in PKIX PEM, for
+// SigningKey.PublicKey.
+func ParsePublicKeyPEM(data []byte) (crypto.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	switch key := key.(type) {
+	case ed25519.PublicKey:
+		return key, nil
+	case *rsa.PublicKey:
+		return key, nil
+	default:
+		return nil, fmt.Errorf("unsupported public key type %T", key)
+	}
+}
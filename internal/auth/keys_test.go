@@ -0,0 +1,163 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestVerifyToken_RotatedKeys(t *testing.T) {
+	ctx := context.Background()
+	legacy := TokenConfig{Secret: "legacy", Expiry: time.Hour, Issuer: "test"}
+	old := TokenConfig{Secret: "old", KeyID: "k1", Expiry: time.Hour, Issuer: "test"}
+	legacyTok, _ := CreateToken("user-1", legacy)
+	oldTok, _ := CreateToken("user-1", old)
+
+	rotated := TokenConfig{
+		Secret:       "new",
+		KeyID:        "k2",
+		PreviousKeys: []SigningKey{{ID: "k1", Secret: "old"}, {ID: "k0", Secret: "legacy"}},
+		Expiry:       time.Hour,
+		Issuer:       "test",
+	}
+	if err := rotated.CheckKeys(); err != nil {
+		t.Fatalf("CheckKeys: %v", err)
+	}
+	newTok, err := CreateToken("user-1", rotated)
+	if err != nil {
+		t.Fatalf("CreateToken: %v", err)
+	}
+	parsed, _, err := jwt.NewParser().ParseUnverified(newTok, &Claims{})
+	if err != nil || parsed.Header["kid"] != "k2" {
+		t.Fatalf("expected the new token to name its key, got %v (%v)", parsed, err)
+	}
+	for name, tok := range map[string]string{"new": newTok, "previous": oldTok, "without kid": legacyTok} {
+		if _, err := VerifyToken(ctx, tok, rotated); err != nil {
+			t.Fatalf("%s token: %v", name, err)
+		}
+	}
+
+	// Dropping the old key from the list ends its tokens.
+	rotated.PreviousKeys = rotated.PreviousKeys[1:]
+	if _, err := VerifyToken(ctx, oldTok, rotated); !errors.Is(err, ErrUnknownKey) {
+		t.Fatalf("expected a token of a retired key to fail, got %v", err)
+	}
+}
+
+func TestTokenConfig_CheckKeys(t *testing.T) {
+	for _, cfg := range []TokenConfig{
+		{Secret: "s", PreviousKeys: []SigningKey{{ID: "k1", Secret: "old"}}},
+		{Secret: "s", KeyID: "k1", PreviousKeys: []SigningKey{{ID: "k1", Secret: "old"}}},
+		{Secret: "s", KeyID: "k2", PreviousKeys: []SigningKey{{Secret: "old"}}},
+	} {
+		if err := cfg.CheckKeys(); err == nil {
+			t.Fatalf("expected %+v to be rejected", cfg)
+		}
+	}
+}
+
+func TestVerifyToken_AsymmetricKeys(t *testing.T) {
+	ctx := context.Background()
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for alg, key := range map[string]crypto.Signer{"EdDSA": edKey, "RS256": rsaKey} {
+		cfg := TokenConfig{PrivateKey: key, KeyID: "k1", Expiry: time.Hour, Issuer: "test"}
+		if err := cfg.CheckKeys(); err != nil {
+			t.Fatalf("%s CheckKeys: %v", alg, err)
+		}
+		tok, err := CreateToken("user-1", cfg)
+		if err != nil {
+			t.Fatalf("%s CreateToken: %v", alg, err)
+		}
+		if _, err := VerifyToken(ctx, tok, cfg); err != nil {
+			t.Fatalf("%s VerifyToken: %v", alg, err)
+		}
+		// Another service needs only the public key.
+		parsed, err := jwt.ParseWithClaims(tok, &Claims{}, func(*jwt.Token) (interface{}, error) { return key.Public(), nil }, jwt.WithValidMethods([]string{alg}))
+		if err != nil || parsed.Claims.(*Claims).UserID != "user-1" {
+			t.Fatalf("%s token did not verify with the public key: %v", alg, err)
+		}
+	}
+}
+
+func TestVerifyToken_AsymmetricKeyKeepsOldSecretTokens(t *testing.T) {
+	ctx := context.Background()
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	oldTok, _ := CreateToken("user-1", TokenConfig{Secret: "old", Expiry: time.Hour, Issuer: "test"})
+	cfg := TokenConfig{Secret: "old", PrivateKey: priv, Expiry: time.Hour, Issuer: "test"}
+	if _, err := VerifyToken(ctx, oldTok, cfg); err != nil {
+		t.Fatalf("expected a token of the old secret to verify: %v", err)
+	}
+
+	// An HS256 token keyed with the public key must not pass for one signed
+	// by the private key.
+	forged, _ := CreateToken("user-1", TokenConfig{Secret: string(pub), Expiry: time.Hour, Issuer: "test"})
+	cfg.Secret = ""
+	if _, err := VerifyToken(ctx, forged, cfg); err == nil {
+		t.Fatal("expected an HS256 token keyed with the public key to be rejected")
+	}
+}
+
+func TestTokenConfig_CheckKeysRejectsWeakRSA(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := (TokenConfig{PrivateKey: key}).CheckKeys(); err == nil {
+		t.Fatal("expected a 1024-bit RSA key to be rejected")
+	}
+}
+
+func TestTokenConfig_JWKS(t *testing.T) {
+	_, cur, _ := ed25519.GenerateKey(rand.Reader)
+	old, _, _ := ed25519.GenerateKey(rand.Reader)
+	cfg := TokenConfig{
+		Secret:       "never listed",
+		PrivateKey:   cur,
+		KeyID:        "k2",
+		PreviousKeys: []SigningKey{{ID: "k1", PublicKey: old}, {ID: "k0", Secret: "legacy"}},
+	}
+	keys := cfg.JWKS()
+	if len(keys) != 2 || keys[0].KeyID != "k2" || keys[1].KeyID != "k1" {
+		t.Fatalf("unexpected keys: %+v", keys)
+	}
+	if keys[0].KeyType != "OKP" || keys[0].Curve != "Ed25519" || keys[0].Algorithm != "EdDSA" || keys[0].X == "" {
+		t.Fatalf("unexpected JWK: %+v", keys[0])
+	}
+	if got := (TokenConfig{Secret: "s"}).JWKS(); len(got) != 0 {
+		t.Fatalf("expected no keys for a secret, got %+v", got)
+	}
+}
+
+func TestParsePrivateKeyPEM(t *testing.T) {
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := ParsePrivateKeyPEM(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+	if err != nil {
+		t.Fatalf("ParsePrivateKeyPEM: %v", err)
+	}
+	if !key.Equal(parsed) {
+		t.Fatal("parsed key differs")
+	}
+	if _, err := ParsePrivateKeyPEM([]byte("not pem")); err == nil {
+		t.Fatal("expected an error for non-PEM input")
+	}
+}
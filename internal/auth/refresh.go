@@ -0,0 +1,41 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+)
+
+// Refresh tokens are opaque to clients: "<id>.<secret>", where the id names
+// the device's grant in the store and only a hash of the secret is stored.
+
+// NewRefreshSecret returns a random secret and the hash the store keeps.
+func NewRefreshSecret() (secret, hash string, err error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	secret = base64.RawURLEncoding.EncodeToString(b)
+	return secret, HashRefreshSecret(secret), nil
+}
+
+func HashRefreshSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func FormatRefreshToken(id, secret string) string {
+	return id + "." + secret
+}
+
+// ParseRefreshToken splits a refresh token into its id and secret. Secrets
+// hold no dots, so the last one separates them.
+func ParseRefreshToken(token string) (id, secret string, ok bool) {
+	i := strings.LastIndexByte(token, '.')
+	if i <= 0 || i == len(token)-1 {
+		return "", "", false
+	}
+	return token[:i], token[i+1:], true
+}
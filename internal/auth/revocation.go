@@ -0,0 +1,119 @@
+package auth
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var ErrTokenRevoked = errors.New("token revoked")
+
+// Revocations rejects tokens before their expiry: single tokens by jti, every
+// token a user was issued up to a cutoff, the tokens scoped to a machine up
+// to a cutoff, and all tokens of locked users. It is kept in memory, so a
+// restart clears it.
+type Revocations struct {
+	mu       sync.RWMutex
+	jtis     map[string]time.Time // jti -> token expiry, dropped once passed
+	users    map[string]time.Time // userID -> tokens issued at or before are revoked
+	machines map[string]machineCutoff
+	locked   map[string]struct{}
+}
+
+// machineCutoff revokes the tokens scoped to a machine issued at or before
+// at, except the one with jti keep.
+type machineCutoff struct {
+	at   time.Time
+	keep string
+}
+
+func NewRevocations() *Revocations {
+	return &Revocations{
+		jtis:     make(map[string]time.Time),
+		users:    make(map[string]time.Time),
+		machines: make(map[string]machineCutoff),
+		locked:   make(map[string]struct{}),
+	}
+}
+
+// RevokeToken rejects the token with jti until expiresAt.
+func (r *Revocations) RevokeToken(jti string, expiresAt time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	for id, exp := range r.jtis {
+		if exp.Before(now) {
+			delete(r.jtis, id)
+		}
+	}
+	r.jtis[jti] = expiresAt
+}
+
+// RevokeUser rejects every token issued to userID at or before at. Token
+// issue times have second precision, so a token issued later within the same
+// second is rejected too.
+func (r *Revocations) RevokeUser(userID string, at time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.users[userID] = at
+}
+
+// RevokeMachine rejects every token scoped to userID's machine issued at or
+// before at, except the one with jti keep: the token replacing them, which
+// is usually issued within the same second. Account-wide tokens are not
+// affected.
+func (r *Revocations) RevokeMachine(userID, machineID string, at time.Time, keep string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.machines[userID+"|"+machineID] = machineCutoff{at: at, keep: keep}
+}
+
+// Lock rejects all of userID's tokens, including ones issued later, until
+// Unlock.
+func (r *Revocations) Lock(userID string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.locked[userID] = struct{}{}
+}
+
+// Unlock reports whether userID was locked.
+func (r *Revocations) Unlock(userID string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.locked[userID]; !ok {
+		return false
+	}
+	delete(r.locked, userID)
+	return true
+}
+
+func (r *Revocations) IsLocked(userID string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	_, ok := r.locked[userID]
+	return ok
+}
+
+func (r *Revocations) Revoked(claims *Claims) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if _, ok := r.locked[claims.UserID]; ok {
+		return true
+	}
+	if _, ok := r.jtis[claims.ID]; ok && claims.ID != "" {
+		return true
+	}
+	if cutoff, ok := r.users[claims.UserID]; ok {
+		if claims.IssuedAt == nil || claims.IssuedAt.Unix() <= cutoff.Unix() {
+			return true
+		}
+	}
+	if machineID := claims.TokenScope().MachineID; machineID != "" {
+		if cutoff, ok := r.machines[claims.UserID+"|"+machineID]; ok && claims.ID != cutoff.keep {
+			if claims.IssuedAt == nil || claims.IssuedAt.Unix() <= cutoff.at.Unix() {
+				return true
+			}
+		}
+	}
+	return false
+}
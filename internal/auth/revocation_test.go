@@ -0,0 +1,72 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestVerifyToken_Revocations(t *testing.T) {
+	ctx := context.Background()
+	rev := NewRevocations()
+	cfg := TokenConfig{Secret: "secret", Expiry: time.Hour, Issuer: "test", Revocations: rev}
+	tok, err := CreateToken("user-1", cfg)
+	if err != nil {
+		t.Fatalf("CreateToken: %v", err)
+	}
+	claims, err := VerifyToken(ctx, tok, cfg)
+	if err != nil {
+		t.Fatalf("VerifyToken: %v", err)
+	}
+
+	rev.RevokeToken(claims.ID, claims.ExpiresAt.Time)
+	if _, err := VerifyToken(ctx, tok, cfg); !errors.Is(err, ErrTokenRevoked) {
+		t.Fatalf("expected revoked jti, got %v", err)
+	}
+
+	other, _ := CreateToken("user-2", cfg)
+	rev.RevokeUser("user-2", time.Now())
+	if _, err := VerifyToken(ctx, other, cfg); !errors.Is(err, ErrTokenRevoked) {
+		t.Fatalf("expected tokens issued before the cutoff to be revoked, got %v", err)
+	}
+	rev.RevokeUser("user-2", time.Now().Add(-time.Hour))
+	if _, err := VerifyToken(ctx, other, cfg); err != nil {
+		t.Fatalf("expected tokens issued after the cutoff to verify, got %v", err)
+	}
+
+	rev.Lock("user-2")
+	if _, err := VerifyToken(ctx, other, cfg); !errors.Is(err, ErrTokenRevoked) {
+		t.Fatalf("expected locked user to be rejected, got %v", err)
+	}
+	if !rev.Unlock("user-2") || rev.Unlock("user-2") {
+		t.Fatalf("expected unlock to report prior state")
+	}
+	if _, err := VerifyToken(ctx, other, cfg); err != nil {
+		t.Fatalf("expected unlocked user to verify, got %v", err)
+	}
+}
+
+func TestVerifyToken_MachineRevocations(t *testing.T) {
+	ctx := context.Background()
+	rev := NewRevocations()
+	cfg := TokenConfig{Secret: "secret", Expiry: time.Hour, Issuer: "test", Revocations: rev}
+	old, _ := CreateScopedToken("user-1", Scope{MachineID: "m1"}, cfg)
+	other, _ := CreateScopedToken("user-1", Scope{MachineID: "m2"}, cfg)
+	account, _ := CreateToken("user-1", cfg)
+	replacement, _ := CreateScopedToken("user-1", Scope{MachineID: "m1"}, cfg)
+	claims, err := VerifyToken(ctx, replacement, cfg)
+	if err != nil {
+		t.Fatalf("VerifyToken: %v", err)
+	}
+
+	rev.RevokeMachine("user-1", "m1", claims.IssuedAt.Time, claims.ID)
+	if _, err := VerifyToken(ctx, old, cfg); !errors.Is(err, ErrTokenRevoked) {
+		t.Fatalf("expected the machine's earlier token to be revoked, got %v", err)
+	}
+	for name, tok := range map[string]string{"replacement": replacement, "other machine": other, "account": account} {
+		if _, err := VerifyToken(ctx, tok, cfg); err != nil {
+			t.Fatalf("expected the %s token to verify, got %v", name, err)
+		}
+	}
+}
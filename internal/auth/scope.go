@@ -0,0 +1,33 @@
+package auth
+
+import "errors"
+
+// Scope confines a token to one session or one machine of its user, so a
+// daemon holding it cannot reach the rest of the account. The zero Scope
+// grants the whole account.
+type Scope struct {
+	SessionID string `json:"sessionId,omitempty"`
+	MachineID string `json:"machineId,omitempty"`
+}
+
+var ErrInvalidScope = errors.New("scope must name exactly one session or machine")
+
+func (s Scope) IsZero() bool {
+	return s == Scope{}
+}
+
+func (s Scope) validate() error {
+	if (s.SessionID == "") == (s.MachineID == "") {
+		return ErrInvalidScope
+	}
+	return nil
+}
+
+// TokenScope returns the scope the token was issued for; the zero Scope for
+// account-wide tokens.
+func (c *Claims) TokenScope() Scope {
+	if c.Scope == nil {
+		return Scope{}
+	}
+	return *c.Scope
+}
@@ -0,0 +1,38 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// CreateStateToken issues a short-lived token naming userID that only
+// VerifyStateToken with the same audience accepts, such as the state of an
+// OAuth redirect that comes back without the user's bearer token.
+func CreateStateToken(userID, audience string, ttl time.Duration, cfg TokenConfig) (string, error) {
+	if audience == "" {
+		return "", errors.New("missing audience")
+	}
+	cfg.Expiry = ttl
+	return signToken(Claims{UserID: userID, RegisteredClaims: jwt.RegisteredClaims{Audience: jwt.ClaimStrings{audience}}}, cfg)
+}
+
+// VerifyStateToken checks a token from CreateStateToken for audience and
+// returns the user it names. Suspended accounts are refused as by
+// VerifyToken.
+func VerifyStateToken(ctx context.Context, tokenString, audience string, cfg TokenConfig) (string, error) {
+	if cfg.Secret == "" && cfg.PrivateKey == nil {
+		return "", errors.New("missing secret")
+	}
+	var claims Claims
+	_, err := jwt.ParseWithClaims(tokenString, &claims, cfg.verificationKey, append(cfg.parserOptions(), jwt.WithAudience(audience))...)
+	if err != nil {
+		return "", err
+	}
+	if cfg.AccountDisabled != nil && cfg.AccountDisabled(ctx, claims.UserID) {
+		return "", ErrAccountDisabled
+	}
+	return claims.UserID, nil
+}
@@ -0,0 +1,121 @@
+// Package authaudit keeps the most recent sign-in attempts, successful or
+// not, so an operator can look into suspicious pairing from the admin API.
+// Entries are kept in memory and lost on restart.
+package authaudit
+
+import "sync"
+
+// Events name the step of signing in an entry records.
+const (
+	// EventSignIn is a signed challenge sent to /v1/auth.
+	EventSignIn = "sign-in"
+	// EventRequest is a device asking to be paired, or polling its request.
+	EventRequest = "request"
+	// EventClaim is a paired device collecting its token.
+	EventClaim = "claim"
+	// EventApprove and EventReject are a signed-in device answering a
+	// pairing request.
+	EventApprove = "approve"
+	EventReject  = "reject"
+	// EventRefresh is a refresh token exchanged for a new access token.
+	EventRefresh = "refresh"
+	// EventScopedToken is a session or machine token minted for a daemon.
+	EventScopedToken = "scoped-token"
+	// EventRenew is a token still valid exchanged for a fresh one.
+	EventRenew = "renew"
+)
+
+const (
+	OutcomeSuccess = "success"
+	OutcomeFailure = "failure"
+
+	defaultCapacity = 1000
+)
+
+type Entry struct {
+	Time    int64  `json:"time"`
+	Event   string `json:"event"`
+	Outcome string `json:"outcome"`
+	IP      string `json:"ip,omitempty"`
+	// PublicKey is the key signing in or asking to be paired.
+	PublicKey string `json:"publicKey,omitempty"`
+	UserID    string `json:"userId,omitempty"`
+	DeviceID  string `json:"deviceId,omitempty"`
+	// Reason says why a failed attempt was turned away.
+	Reason string `json:"reason,omitempty"`
+}
+
+// Filter selects entries; zero fields match everything. Limit keeps only
+// the newest matches.
+type Filter struct {
+	Event     string
+	Outcome   string
+	IP        string
+	PublicKey string
+	UserID    string
+	Since     int64
+	Limit     int
+}
+
+func (f Filter) match(e Entry) bool {
+	return (f.Event == "" || e.Event == f.Event) &&
+		(f.Outcome == "" || e.Outcome == f.Outcome) &&
+		(f.IP == "" || e.IP == f.IP) &&
+		(f.PublicKey == "" || e.PublicKey == f.PublicKey) &&
+		(f.UserID == "" || e.UserID == f.UserID) &&
+		e.Time >= f.Since
+}
+
+type Log struct {
+	mu      sync.RWMutex
+	entries []Entry
+	next    int
+	full    bool
+}
+
+// New returns a log keeping the last capacity entries; zero picks the
+// default. A nil *Log is valid and records nothing.
+func New(capacity int) *Log {
+	if capacity <= 0 {
+		capacity = defaultCapacity
+	}
+	return &Log{entries: make([]Entry, capacity)}
+}
+
+func (l *Log) Record(e Entry) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.entries[l.next] = e
+	l.next = (l.next + 1) % len(l.entries)
+	if l.next == 0 {
+		l.full = true
+	}
+}
+
+// Entries returns the entries matching f, oldest first.
+func (l *Log) Entries(f Filter) []Entry {
+	out := make([]Entry, 0)
+	if l == nil {
+		return out
+	}
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	add := func(entries []Entry) {
+		for _, e := range entries {
+			if f.match(e) {
+				out = append(out, e)
+			}
+		}
+	}
+	if l.full {
+		add(l.entries[l.next:])
+	}
+	add(l.entries[:l.next])
+	if f.Limit > 0 && len(out) > f.Limit {
+		out = out[len(out)-f.Limit:]
+	}
+	return out
+}
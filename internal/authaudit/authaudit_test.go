@@ -0,0 +1,30 @@
+package authaudit
+
+import "testing"
+
+func TestLogFiltersAndWraps(t *testing.T) {
+	l := New(3)
+	l.Record(Entry{Time: 1, Event: EventSignIn, Outcome: OutcomeFailure, IP: "192.0.2.1"})
+	l.Record(Entry{Time: 2, Event: EventSignIn, Outcome: OutcomeSuccess, IP: "192.0.2.1", UserID: "user-1"})
+	l.Record(Entry{Time: 3, Event: EventRequest, Outcome: OutcomeSuccess, IP: "192.0.2.2", PublicKey: "pk"})
+	l.Record(Entry{Time: 4, Event: EventApprove, Outcome: OutcomeFailure, IP: "192.0.2.2", PublicKey: "pk", UserID: "user-1"})
+
+	if entries := l.Entries(Filter{}); len(entries) != 3 || entries[0].Time != 2 || entries[2].Time != 4 {
+		t.Fatalf("expected the last three entries oldest first, got %+v", entries)
+	}
+	if entries := l.Entries(Filter{PublicKey: "pk", Outcome: OutcomeFailure}); len(entries) != 1 || entries[0].Event != EventApprove {
+		t.Fatalf("unexpected filtered entries: %+v", entries)
+	}
+	if entries := l.Entries(Filter{UserID: "user-1", Limit: 1}); len(entries) != 1 || entries[0].Time != 4 {
+		t.Fatalf("expected the limit to keep the newest, got %+v", entries)
+	}
+	if entries := l.Entries(Filter{IP: "192.0.2.2", Since: 4}); len(entries) != 1 || entries[0].Time != 4 {
+		t.Fatalf("unexpected entries since 4: %+v", entries)
+	}
+
+	var nilLog *Log
+	nilLog.Record(Entry{})
+	if entries := nilLog.Entries(Filter{}); len(entries) != 0 {
+		t.Fatalf("expected a nil log to record nothing")
+	}
+}
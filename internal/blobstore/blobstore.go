@@ -0,0 +1,38 @@
+// Package blobstore keeps binary payloads such as attachments out of the JSON
+// store. Keys are slash-separated relative paths chosen by the caller.
+package blobstore
+
+import (
+	"context"
+	"errors"
+	"io"
+	"path"
+	"strings"
+)
+
+var (
+	ErrNotFound   = errors.New("blob not found")
+	ErrInvalidKey = errors.New("invalid blob key")
+
+	errSizeMismatch = errors.New("blob size does not match content")
+)
+
+type BlobStore interface {
+	// Put stores size bytes from r under key, replacing any existing blob.
+	Put(ctx context.Context, key string, r io.Reader, size int64) error
+	// Get returns ErrNotFound when key does not exist.
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// Delete succeeds when key does not exist.
+	Delete(ctx context.Context, key string) error
+}
+
+// validKey rejects keys that could escape the store's root.
+func validKey(key string) error {
+	if key == "" || strings.HasPrefix(key, "/") || strings.Contains(key, "\\") {
+		return ErrInvalidKey
+	}
+	if path.Clean(key) != key || key == "." || strings.HasPrefix(key, "../") || key == ".." {
+		return ErrInvalidKey
+	}
+	return nil
+}
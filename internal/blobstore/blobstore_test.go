@@ -0,0 +1,130 @@
+package blobstore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func roundTrip(t *testing.T, bs BlobStore) {
+	t.Helper()
+	ctx := context.Background()
+
+	if _, err := bs.Get(ctx, "missing/blob"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+
+	data := []byte("encrypted bytes")
+	if err := bs.Put(ctx, "sessions/s1/a b+c.bin", bytes.NewReader(data), int64(len(data))); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	rc, err := bs.Get(ctx, "sessions/s1/a b+c.bin")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	got, _ := io.ReadAll(rc)
+	rc.Close()
+	if !bytes.Equal(got, data) {
+		t.Fatalf("expected %q, got %q", data, got)
+	}
+
+	if err := bs.Delete(ctx, "sessions/s1/a b+c.bin"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if err := bs.Delete(ctx, "sessions/s1/a b+c.bin"); err != nil {
+		t.Fatalf("expected deleting a missing blob to succeed, got %v", err)
+	}
+	if _, err := bs.Get(ctx, "sessions/s1/a b+c.bin"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound after delete, got %v", err)
+	}
+
+	for _, key := range []string{"", "/abs", "../escape", "a/../../b", "a//b"} {
+		if err := bs.Put(ctx, key, strings.NewReader("x"), 1); !errors.Is(err, ErrInvalidKey) {
+			t.Fatalf("expected ErrInvalidKey for %q, got %v", key, err)
+		}
+	}
+}
+
+func TestLocal(t *testing.T) {
+	bs, err := NewLocal(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewLocal: %v", err)
+	}
+	roundTrip(t, bs)
+
+	if err := bs.Put(context.Background(), "short", strings.NewReader("abc"), 5); err == nil {
+		t.Fatalf("expected size mismatch error")
+	}
+}
+
+// fakeS3 is a minimal path-style object server that insists on SigV4 headers.
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	paths   []string
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=AKID/20260102/us-east-1/s3/aws4_request, SignedHeaders=host;x-amz-content-sha256;x-amz-date, Signature=") ||
+		r.Header.Get("X-Amz-Date") != "20260102T030405Z" || r.Header.Get("X-Amz-Content-Sha256") == "" {
+		http.Error(w, "bad signature", http.StatusForbidden)
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.paths = append(f.paths, r.URL.EscapedPath())
+	switch r.Method {
+	case http.MethodPut:
+		data, _ := io.ReadAll(r.Body)
+		f.objects[r.URL.Path] = data
+	case http.MethodGet:
+		data, ok := f.objects[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write(data)
+	case http.MethodDelete:
+		delete(f.objects, r.URL.Path)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func TestS3(t *testing.T) {
+	fake := &fakeS3{objects: make(map[string][]byte)}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	bs, err := NewS3(S3Config{
+		Endpoint:        srv.URL,
+		Region:          "us-east-1",
+		Bucket:          "bucket",
+		AccessKeyID:     "AKID",
+		SecretAccessKey: "secret",
+		Prefix:          "happy/",
+	})
+	if err != nil {
+		t.Fatalf("NewS3: %v", err)
+	}
+	bs.now = func() time.Time { return time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC) }
+	roundTrip(t, bs)
+
+	if fake.paths[1] != "/bucket/happy/sessions/s1/a%20b%2Bc.bin" {
+		t.Fatalf("unexpected escaped path %q", fake.paths[1])
+	}
+}
+
+func TestNewS3RequiresConfig(t *testing.T) {
+	if _, err := NewS3(S3Config{Region: "us-east-1", AccessKeyID: "a", SecretAccessKey: "b"}); err == nil {
+		t.Fatalf("expected error for missing bucket")
+	}
+}
@@ -0,0 +1,26 @@
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFake(t *testing.T) {
+	start := time.UnixMilli(1000)
+	f := NewFake(start)
+	f.Advance(time.Second)
+	if got := Now(f); !got.Equal(start.Add(time.Second)) {
+		t.Fatalf("expected the fake to advance, got %v", got)
+	}
+	f.Set(start)
+	if got := f.Now(); !got.Equal(start) {
+		t.Fatalf("expected the fake to be set back, got %v", got)
+	}
+}
+
+func TestNowFallsBackToSystem(t *testing.T) {
+	before := time.Now()
+	if got := Now(nil); got.Before(before) {
+		t.Fatalf("expected the wall clock, got %v before %v", got, before)
+	}
+}
@@ -1,20 +1,261 @@
 package config
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"net/url"
 	"os"
+	"os/exec"
 	"strconv"
+	"strings"
 	"time"
 )
 
 type Config struct {
-	Port              int
-	MasterSecret      string
-	GinMode           string
-	TLSCertFile       string
-	TLSKeyFile        string
-	TokenExpiry       time.Duration
-	MachinesStateFile string
+	Port               int
+	MasterSecret       string
+	GinMode            string
+	TLSCertFile        string
+	TLSKeyFile         string
+	TokenExpiry        time.Duration
+	MachinesStateFile  string
+	SessionsStateFile  string
+	ArtifactsStateFile string
+	AccountsStateFile  string
+	ErrorFormat        string
+
+	// TLSClientCAFile is a PEM bundle of the CAs that issue machine daemons
+	// client certificates, whose common name is the machine id. Clients
+	// may still come without one; RequireMachineCert refuses daemons that
+	// do.
+	TLSClientCAFile    string
+	RequireMachineCert bool
+
+	// MasterSecretKID names MasterSecret in the kid header of the tokens it
+	// signs. PreviousSecrets are secrets rotated out of signing; tokens they
+	// signed keep verifying by their kid until they expire.
+	MasterSecretKID string
+	PreviousSecrets []SigningKey
+
+	// TokenSigningKeyFile is a PEM Ed25519 or RSA private key that signs
+	// tokens in place of MasterSecret, named by MasterSecretKID, so other
+	// services can verify them from /.well-known/jwks.json. MasterSecret is
+	// then optional and only verifies tokens it signed before.
+	TokenSigningKeyFile string
+
+	// TokenIssuer and TokenAudience are put in the tokens the server signs,
+	// and tokens with another issuer or audience are refused, so servers
+	// sharing a signing key do not accept each other's. Empty TokenIssuer
+	// keeps the default; empty TokenAudience signs tokens without one.
+	TokenIssuer   string
+	TokenAudience string
+
+	// RefreshTokenExpiry enables refresh tokens, valid this long unused;
+	// zero leaves them off.
+	RefreshTokenExpiry time.Duration
+	// AuthAllowClientChallenge lets /v1/auth accept a challenge the client
+	// picked itself, for clients that predate /v1/auth/challenge. Such a
+	// signature can be replayed, so by default only issued challenges sign
+	// in.
+	AuthAllowClientChallenge bool
+	// AuthLockoutAfter is how many bad signatures in a row lock a client
+	// address out of /v1/auth, and turn away further bad signatures for a
+	// public key, for AuthLockout at first and twice as long with each
+	// failure after, up to AuthLockoutMax. Zero disables the lockout; zero
+	// durations pick a minute and an hour.
+	AuthLockoutAfter int
+	AuthLockout      time.Duration
+	AuthLockoutMax   time.Duration
+
+	// MachinesFlushInterval coalesces writes of MachinesStateFile to at most
+	// one per interval; zero writes after every change.
+	MachinesFlushInterval time.Duration
+
+	// StatePartitionDir keeps what the four state files would hold in one
+	// file per account instead, each encrypted with a key derived from
+	// StatePartitionKey for that account. It replaces the state files.
+	StatePartitionDir string
+	StatePartitionKey string
+
+	// MessageJournalDir keeps messages in per-session append-only journals
+	// instead of SessionsStateFile; they are compacted every
+	// JournalCompactInterval (zero picks one hour).
+	MessageJournalDir      string
+	JournalCompactInterval time.Duration
+
+	// HTTPRateLimits overrides the per-IP request limits of the auth, read,
+	// write and socket-upgrade route groups; nil keeps the built-in defaults
+	// and an empty map disables them.
+	HTTPRateLimits map[string]RateLimit
+
+	// SocketEventRateLimits overrides the per-connection Socket.IO event
+	// limits; nil keeps the built-in defaults and an empty map disables them.
+	SocketEventRateLimits          map[string]RateLimit
+	SocketRateLimitDisconnectAfter int
+	// SocketHandshakeTimeout closes sockets that never send the connect
+	// packet; zero keeps the default.
+	SocketHandshakeTimeout time.Duration
+	// SessionStallTimeout flags sessions whose daemon is connected but has
+	// stopped sending session-alive; zero disables it.
+	SessionStallTimeout time.Duration
+	// RPC relay pool bounds; zero keeps the defaults.
+	SocketRPCWorkers    int
+	SocketRPCQueueDepth int
+	// SocketRequireHandshakeToken refuses Socket.IO upgrades that do not
+	// carry a valid token. SocketMaxPendingPerIP caps the connections per IP
+	// still waiting to connect; zero keeps the default and a negative value
+	// removes the cap.
+	SocketRequireHandshakeToken bool
+	SocketMaxPendingPerIP       int
+
+	// Blob size caps enforced by the store; zero keeps the store defaults and
+	// a negative value disables the check.
+	MaxMetadataBytes    int
+	MaxDaemonStateBytes int
+	MaxAgentStateBytes  int
+	MaxSettingsBytes    int
+
+	// Raw /ws transport tuning; zero keeps the handler defaults.
+	WSReadLimitBytes int64
+	WSPongWait       time.Duration
+	WSWriteWait      time.Duration
+
+	// TombstoneRetention keeps deleted session and machine ids visible to
+	// /v1/sync; zero keeps the store default.
+	TombstoneRetention time.Duration
+
+	// AuthRequestTTL is how long an auth request nobody polls or answers is
+	// kept; a background job drops expired ones every
+	// AuthRequestCleanupInterval. Zero picks ten minutes and one minute.
+	AuthRequestTTL             time.Duration
+	AuthRequestCleanupInterval time.Duration
+
+	// MessageRetention and MaxMessagesPerSession bound the messages each
+	// session keeps; a background job prunes them every MessagePruneInterval
+	// (zero picks ten minutes). Zero disables either limit.
+	MessageRetention      time.Duration
+	MaxMessagesPerSession int
+	MessagePruneInterval  time.Duration
+	// SummarizerURL, when set, is asked for a summary artifact of each
+	// session's messages before retention drops them, with SummarizerToken
+	// as its bearer token.
+	SummarizerURL   string
+	SummarizerToken string
+
+	// PurgeGrace is how long deleted sessions and artifacts are kept before
+	// the purge job, run every PurgeInterval, removes them; zero picks 30
+	// days and one hour.
+	PurgeGrace    time.Duration
+	PurgeInterval time.Duration
+
+	// MetricsHistoryInterval is how often connection and traffic metrics
+	// are sampled into the store's history, served at
+	// /v1/admin/metrics/history; zero picks one minute.
+	MetricsHistoryInterval time.Duration
+
+	// MemoryBudgetBytes and MemoryBudgetMessages cap the messages the
+	// in-memory store holds, evicting the oldest once exceeded. Zero disables
+	// either limit.
+	MemoryBudgetBytes    int64
+	MemoryBudgetMessages int
+
+	// LoadShedHeapBytes and LoadShedGoroutines are the live heap and
+	// goroutine counts past which the feed, user search and account export
+	// answer 503. Zero disables either limit.
+	LoadShedHeapBytes  uint64
+	LoadShedGoroutines int
+
+	// BlobStore selects where binary payloads live: "" (none), "local" or
+	// "s3".
+	BlobStore         string
+	BlobDir           string
+	S3Endpoint        string
+	S3Region          string
+	S3Bucket          string
+	S3Prefix          string
+	S3AccessKeyID     string
+	S3SecretAccessKey string
+
+	// PushProvider selects how device notifications are sent: "" (never) or
+	// "expo". ExpoPushURL overrides the Expo endpoint.
+	PushProvider    string
+	ExpoPushURL     string
+	ExpoAccessToken string
+	// PushTemplatesFile is a JSON file of notification text by event type
+	// and locale, overriding the built-in English text.
+	PushTemplatesFile string
+
+	// GitHubClientID and GitHubClientSecret are the OAuth app accounts link
+	// their GitHub user through; unset disables /v1/connect/github.
+	// GitHubRedirectURL is the callback registered with the app, and
+	// GitHubReturnURL where the browser goes once it is done.
+	GitHubClientID     string
+	GitHubClientSecret string
+	GitHubRedirectURL  string
+	GitHubReturnURL    string
+
+	// StoreBackend selects durable storage for the whole store: "" (memory
+	// only), "sqlite", which keeps its database at SQLitePath, "bolt", which
+	// keeps an embedded database in DataDir, "postgres", which keeps all
+	// state in the database at DatabaseURL, or "redis", which keeps all state
+	// on the server at RedisURL.
+	StoreBackend string
+	SQLitePath   string
+	DataDir      string
+	DatabaseURL  string
+	RedisURL     string
+	// RedisKeyPrefix namespaces keys; RedisMaxSessionMessages caps each
+	// session's message list. Zero values pick the store defaults.
+	RedisKeyPrefix          string
+	RedisMaxSessionMessages int
+	// HydratedUsers, with the sqlite store, loads users' sessions, machines
+	// and messages on first access rather than on start and keeps at most
+	// that many users in memory. Zero loads everything on start.
+	HydratedUsers int
+
+	// StateCompression names the codec ("gzip" or "zstd") used for large
+	// state strings in state files and store records; empty disables it.
+	StateCompression         string
+	StateCompressionMinBytes int
+
+	// IDStrategy selects how session, message and update ids are generated:
+	// "" or "uuid" (random UUIDs) or "ulid" (ULIDs, which sort by creation
+	// time).
+	IDStrategy string
+
+	// ServerName, ServerContact and WelcomeText identify the instance at /
+	// and /v1/server-info, so clients can tell which server they are paired
+	// with. Empty values keep the built-in name and welcome text.
+	ServerName    string
+	ServerContact string
+	WelcomeText   string
+
+	// AdminToken is the bearer token for /v1/admin; empty disables it.
+	AdminToken       string
+	DebugTapCapacity int
+	// AuthAuditCapacity is how many sign-in attempts the admin auth log
+	// keeps; zero picks the default.
+	AuthAuditCapacity int
+
+	// ReplicationLogSize keeps the newest changes to the store for warm
+	// standbys to tail; zero serves no standbys. ReplicateFrom starts this
+	// instance as a standby of the primary at that base URL, authenticated
+	// by the primary's admin token ReplicationToken, until it is promoted.
+	ReplicationLogSize int
+	ReplicateFrom      string
+	ReplicationToken   string
+}
+
+type RateLimit struct {
+	Limit  int
+	Window time.Duration
+}
+
+// SigningKey is a token signing secret named by its key id.
+type SigningKey struct {
+	ID     string
+	Secret string
 }
 
 type Env interface {
@@ -34,6 +275,12 @@ func LoadConfigFromEnv(env Env) (Config, error) {
 		Port:        3000,
 		GinMode:     "release",
 		TokenExpiry: 7 * 24 * time.Hour,
+		ErrorFormat: "legacy",
+
+		MachinesFlushInterval:          250 * time.Millisecond,
+		SocketRateLimitDisconnectAfter: 100,
+		SessionStallTimeout:            5 * time.Minute,
+		AuthLockoutAfter:               5,
 	}
 
 	if raw := env.Getenv("PORT"); raw != "" {
@@ -44,10 +291,39 @@ func LoadConfigFromEnv(env Env) (Config, error) {
 		cfg.Port = port
 	}
 
-	cfg.MasterSecret = env.Getenv("MASTER_SECRET")
-	if cfg.MasterSecret == "" {
-		return Config{}, fmt.Errorf("MASTER_SECRET is required")
+	secret, err := loadSecret(env, "MASTER_SECRET")
+	if err != nil {
+		return Config{}, err
+	}
+	cfg.MasterSecret = secret
+	cfg.MasterSecretKID = env.Getenv("MASTER_SECRET_KID")
+	if raw := env.Getenv("PREVIOUS_MASTER_SECRETS"); raw != "" {
+		keys, err := parseSigningKeys(strings.Split(raw, ","))
+		if err != nil {
+			return Config{}, fmt.Errorf("invalid PREVIOUS_MASTER_SECRETS: %w", err)
+		}
+		cfg.PreviousSecrets = keys
 	}
+	if path := env.Getenv("SIGNING_KEYS_FILE"); path != "" {
+		if cfg.MasterSecret != "" || cfg.MasterSecretKID != "" || cfg.PreviousSecrets != nil {
+			return Config{}, fmt.Errorf("SIGNING_KEYS_FILE replaces MASTER_SECRET, MASTER_SECRET_FILE, MASTER_SECRET_KID and PREVIOUS_MASTER_SECRETS")
+		}
+		keys, err := loadSigningKeys(path)
+		if err != nil {
+			return Config{}, fmt.Errorf("invalid SIGNING_KEYS_FILE: %w", err)
+		}
+		cfg.MasterSecretKID, cfg.MasterSecret = keys[0].ID, keys[0].Secret
+		cfg.PreviousSecrets = keys[1:]
+	}
+	cfg.TokenSigningKeyFile = env.Getenv("TOKEN_SIGNING_KEY_FILE")
+	if cfg.MasterSecret == "" && cfg.TokenSigningKeyFile == "" {
+		return Config{}, fmt.Errorf("MASTER_SECRET, MASTER_SECRET_FILE or TOKEN_SIGNING_KEY_FILE is required")
+	}
+	if len(cfg.PreviousSecrets) > 0 && cfg.MasterSecretKID == "" {
+		return Config{}, fmt.Errorf("MASTER_SECRET_KID is required when previous secrets are set")
+	}
+	cfg.TokenIssuer = env.Getenv("TOKEN_ISSUER")
+	cfg.TokenAudience = env.Getenv("TOKEN_AUDIENCE")
 
 	if raw := env.Getenv("GIN_MODE"); raw != "" {
 		cfg.GinMode = raw
@@ -55,8 +331,53 @@ func LoadConfigFromEnv(env Env) (Config, error) {
 
 	cfg.TLSCertFile = env.Getenv("TLS_CERT_FILE")
 	cfg.TLSKeyFile = env.Getenv("TLS_KEY_FILE")
+	cfg.TLSClientCAFile = env.Getenv("TLS_CLIENT_CA_FILE")
+	if cfg.TLSClientCAFile != "" && (cfg.TLSCertFile == "" || cfg.TLSKeyFile == "") {
+		return Config{}, fmt.Errorf("TLS_CLIENT_CA_FILE needs TLS_CERT_FILE and TLS_KEY_FILE")
+	}
+	if raw := env.Getenv("REQUIRE_MACHINE_CERT"); raw != "" {
+		v, err := strconv.ParseBool(raw)
+		if err != nil {
+			return Config{}, fmt.Errorf("invalid REQUIRE_MACHINE_CERT")
+		}
+		cfg.RequireMachineCert = v
+	}
+	if cfg.RequireMachineCert && cfg.TLSClientCAFile == "" {
+		return Config{}, fmt.Errorf("REQUIRE_MACHINE_CERT needs TLS_CLIENT_CA_FILE")
+	}
 
 	cfg.MachinesStateFile = env.Getenv("MACHINES_STATE_FILE")
+	if raw := env.Getenv("MACHINES_STATE_FLUSH_MS"); raw != "" {
+		ms, err := strconv.Atoi(raw)
+		if err != nil || ms < 0 {
+			return Config{}, fmt.Errorf("invalid MACHINES_STATE_FLUSH_MS")
+		}
+		cfg.MachinesFlushInterval = time.Duration(ms) * time.Millisecond
+	}
+	cfg.SessionsStateFile = env.Getenv("SESSIONS_STATE_FILE")
+	cfg.ArtifactsStateFile = env.Getenv("ARTIFACTS_STATE_FILE")
+	cfg.AccountsStateFile = env.Getenv("ACCOUNTS_STATE_FILE")
+	cfg.StatePartitionDir = env.Getenv("STATE_PARTITION_DIR")
+	cfg.StatePartitionKey = env.Getenv("STATE_PARTITION_KEY")
+	if cfg.StatePartitionDir != "" {
+		if cfg.StatePartitionKey == "" {
+			return Config{}, fmt.Errorf("STATE_PARTITION_KEY is required when STATE_PARTITION_DIR is set")
+		}
+		if cfg.MachinesStateFile != "" || cfg.SessionsStateFile != "" || cfg.ArtifactsStateFile != "" || cfg.AccountsStateFile != "" {
+			return Config{}, fmt.Errorf("STATE_PARTITION_DIR replaces the *_STATE_FILE settings")
+		}
+	}
+	cfg.MessageJournalDir = env.Getenv("MESSAGE_JOURNAL_DIR")
+	if cfg.MessageJournalDir != "" && cfg.SessionsStateFile == "" && cfg.StatePartitionDir == "" {
+		return Config{}, fmt.Errorf("SESSIONS_STATE_FILE or STATE_PARTITION_DIR is required when MESSAGE_JOURNAL_DIR is set")
+	}
+	if raw := env.Getenv("JOURNAL_COMPACT_INTERVAL_SECONDS"); raw != "" {
+		seconds, err := strconv.Atoi(raw)
+		if err != nil || seconds <= 0 {
+			return Config{}, fmt.Errorf("invalid JOURNAL_COMPACT_INTERVAL_SECONDS")
+		}
+		cfg.JournalCompactInterval = time.Duration(seconds) * time.Second
+	}
 
 	if raw := env.Getenv("TOKEN_EXPIRY_SECONDS"); raw != "" {
 		seconds, err := strconv.Atoi(raw)
@@ -66,5 +387,538 @@ func LoadConfigFromEnv(env Env) (Config, error) {
 		cfg.TokenExpiry = time.Duration(seconds) * time.Second
 	}
 
+	if raw := env.Getenv("REFRESH_TOKEN_EXPIRY_SECONDS"); raw != "" {
+		seconds, err := strconv.Atoi(raw)
+		if err != nil || seconds < 0 {
+			return Config{}, fmt.Errorf("invalid REFRESH_TOKEN_EXPIRY_SECONDS")
+		}
+		cfg.RefreshTokenExpiry = time.Duration(seconds) * time.Second
+	}
+
+	if raw := env.Getenv("ERROR_FORMAT"); raw != "" {
+		if raw != "legacy" && raw != "envelope" {
+			return Config{}, fmt.Errorf("invalid ERROR_FORMAT")
+		}
+		cfg.ErrorFormat = raw
+	}
+
+	if raw := env.Getenv("HTTP_RATE_LIMITS"); raw != "" {
+		limits, err := parseRateLimits(raw)
+		if err != nil {
+			return Config{}, fmt.Errorf("invalid HTTP_RATE_LIMITS: %w", err)
+		}
+		for group := range limits {
+			if !httpRateLimitGroups[group] {
+				return Config{}, fmt.Errorf("invalid HTTP_RATE_LIMITS: unknown group %q", group)
+			}
+		}
+		cfg.HTTPRateLimits = limits
+	}
+
+	if raw := env.Getenv("SOCKET_EVENT_RATE_LIMITS"); raw != "" {
+		limits, err := parseRateLimits(raw)
+		if err != nil {
+			return Config{}, fmt.Errorf("invalid SOCKET_EVENT_RATE_LIMITS: %w", err)
+		}
+		cfg.SocketEventRateLimits = limits
+	}
+
+	if raw := env.Getenv("SOCKET_RATE_LIMIT_DISCONNECT_AFTER"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 0 {
+			return Config{}, fmt.Errorf("invalid SOCKET_RATE_LIMIT_DISCONNECT_AFTER")
+		}
+		cfg.SocketRateLimitDisconnectAfter = n
+	}
+
+	if raw := env.Getenv("SOCKET_HANDSHAKE_TIMEOUT_SECONDS"); raw != "" {
+		seconds, err := strconv.Atoi(raw)
+		if err != nil || seconds <= 0 {
+			return Config{}, fmt.Errorf("invalid SOCKET_HANDSHAKE_TIMEOUT_SECONDS")
+		}
+		cfg.SocketHandshakeTimeout = time.Duration(seconds) * time.Second
+	}
+
+	for key, dst := range map[string]*int{
+		"SOCKET_RPC_WORKERS":     &cfg.SocketRPCWorkers,
+		"SOCKET_RPC_QUEUE_DEPTH": &cfg.SocketRPCQueueDepth,
+	} {
+		if raw := env.Getenv(key); raw != "" {
+			n, err := strconv.Atoi(raw)
+			if err != nil || n <= 0 {
+				return Config{}, fmt.Errorf("invalid %s", key)
+			}
+			*dst = n
+		}
+	}
+
+	if raw := env.Getenv("SOCKET_REQUIRE_HANDSHAKE_TOKEN"); raw != "" {
+		required, err := strconv.ParseBool(raw)
+		if err != nil {
+			return Config{}, fmt.Errorf("invalid SOCKET_REQUIRE_HANDSHAKE_TOKEN")
+		}
+		cfg.SocketRequireHandshakeToken = required
+	}
+
+	if raw := env.Getenv("AUTH_REQUIRE_CHALLENGE"); raw != "" {
+		required, err := strconv.ParseBool(raw)
+		if err != nil {
+			return Config{}, fmt.Errorf("invalid AUTH_REQUIRE_CHALLENGE")
+		}
+		cfg.AuthAllowClientChallenge = !required
+	}
+	if raw := env.Getenv("AUTH_LOCKOUT_AFTER"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 0 {
+			return Config{}, fmt.Errorf("invalid AUTH_LOCKOUT_AFTER")
+		}
+		cfg.AuthLockoutAfter = n
+	}
+	if raw := env.Getenv("AUTH_LOCKOUT_SECONDS"); raw != "" {
+		seconds, err := strconv.Atoi(raw)
+		if err != nil || seconds <= 0 {
+			return Config{}, fmt.Errorf("invalid AUTH_LOCKOUT_SECONDS")
+		}
+		cfg.AuthLockout = time.Duration(seconds) * time.Second
+	}
+	if raw := env.Getenv("AUTH_LOCKOUT_MAX_SECONDS"); raw != "" {
+		seconds, err := strconv.Atoi(raw)
+		if err != nil || seconds <= 0 {
+			return Config{}, fmt.Errorf("invalid AUTH_LOCKOUT_MAX_SECONDS")
+		}
+		cfg.AuthLockoutMax = time.Duration(seconds) * time.Second
+	}
+
+	if raw := env.Getenv("SOCKET_MAX_PENDING_PER_IP"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil {
+			return Config{}, fmt.Errorf("invalid SOCKET_MAX_PENDING_PER_IP")
+		}
+		cfg.SocketMaxPendingPerIP = n
+	}
+
+	if raw := env.Getenv("SESSION_STALL_TIMEOUT_SECONDS"); raw != "" {
+		seconds, err := strconv.Atoi(raw)
+		if err != nil || seconds < 0 {
+			return Config{}, fmt.Errorf("invalid SESSION_STALL_TIMEOUT_SECONDS")
+		}
+		cfg.SessionStallTimeout = time.Duration(seconds) * time.Second
+	}
+
+	for key, dst := range map[string]*int{
+		"MAX_METADATA_BYTES":     &cfg.MaxMetadataBytes,
+		"MAX_DAEMON_STATE_BYTES": &cfg.MaxDaemonStateBytes,
+		"MAX_AGENT_STATE_BYTES":  &cfg.MaxAgentStateBytes,
+		"MAX_SETTINGS_BYTES":     &cfg.MaxSettingsBytes,
+	} {
+		if raw := env.Getenv(key); raw != "" {
+			n, err := strconv.Atoi(raw)
+			if err != nil {
+				return Config{}, fmt.Errorf("invalid %s", key)
+			}
+			*dst = n
+		}
+	}
+
+	if raw := env.Getenv("WS_READ_LIMIT_BYTES"); raw != "" {
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil || n <= 0 {
+			return Config{}, fmt.Errorf("invalid WS_READ_LIMIT_BYTES")
+		}
+		cfg.WSReadLimitBytes = n
+	}
+
+	for key, dst := range map[string]*time.Duration{
+		"WS_PONG_WAIT_SECONDS":  &cfg.WSPongWait,
+		"WS_WRITE_WAIT_SECONDS": &cfg.WSWriteWait,
+	} {
+		if raw := env.Getenv(key); raw != "" {
+			seconds, err := strconv.Atoi(raw)
+			if err != nil || seconds <= 0 {
+				return Config{}, fmt.Errorf("invalid %s", key)
+			}
+			*dst = time.Duration(seconds) * time.Second
+		}
+	}
+
+	if raw := env.Getenv("TOMBSTONE_RETENTION_HOURS"); raw != "" {
+		hours, err := strconv.Atoi(raw)
+		if err != nil || hours <= 0 {
+			return Config{}, fmt.Errorf("invalid TOMBSTONE_RETENTION_HOURS")
+		}
+		cfg.TombstoneRetention = time.Duration(hours) * time.Hour
+	}
+
+	if raw := env.Getenv("AUTH_REQUEST_TTL_SECONDS"); raw != "" {
+		seconds, err := strconv.Atoi(raw)
+		if err != nil || seconds <= 0 {
+			return Config{}, fmt.Errorf("invalid AUTH_REQUEST_TTL_SECONDS")
+		}
+		cfg.AuthRequestTTL = time.Duration(seconds) * time.Second
+	}
+	if raw := env.Getenv("AUTH_REQUEST_CLEANUP_INTERVAL_SECONDS"); raw != "" {
+		seconds, err := strconv.Atoi(raw)
+		if err != nil || seconds <= 0 {
+			return Config{}, fmt.Errorf("invalid AUTH_REQUEST_CLEANUP_INTERVAL_SECONDS")
+		}
+		cfg.AuthRequestCleanupInterval = time.Duration(seconds) * time.Second
+	}
+
+	if raw := env.Getenv("MESSAGE_RETENTION_DAYS"); raw != "" {
+		days, err := strconv.Atoi(raw)
+		if err != nil || days <= 0 {
+			return Config{}, fmt.Errorf("invalid MESSAGE_RETENTION_DAYS")
+		}
+		cfg.MessageRetention = time.Duration(days) * 24 * time.Hour
+	}
+	if raw := env.Getenv("MAX_MESSAGES_PER_SESSION"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n <= 0 {
+			return Config{}, fmt.Errorf("invalid MAX_MESSAGES_PER_SESSION")
+		}
+		cfg.MaxMessagesPerSession = n
+	}
+	if raw := env.Getenv("MESSAGE_PRUNE_INTERVAL_SECONDS"); raw != "" {
+		seconds, err := strconv.Atoi(raw)
+		if err != nil || seconds <= 0 {
+			return Config{}, fmt.Errorf("invalid MESSAGE_PRUNE_INTERVAL_SECONDS")
+		}
+		cfg.MessagePruneInterval = time.Duration(seconds) * time.Second
+	}
+
+	if raw := env.Getenv("PURGE_GRACE_HOURS"); raw != "" {
+		hours, err := strconv.Atoi(raw)
+		if err != nil || hours <= 0 {
+			return Config{}, fmt.Errorf("invalid PURGE_GRACE_HOURS")
+		}
+		cfg.PurgeGrace = time.Duration(hours) * time.Hour
+	}
+	if raw := env.Getenv("PURGE_INTERVAL_SECONDS"); raw != "" {
+		seconds, err := strconv.Atoi(raw)
+		if err != nil || seconds <= 0 {
+			return Config{}, fmt.Errorf("invalid PURGE_INTERVAL_SECONDS")
+		}
+		cfg.PurgeInterval = time.Duration(seconds) * time.Second
+	}
+	if raw := env.Getenv("METRICS_HISTORY_INTERVAL_SECONDS"); raw != "" {
+		seconds, err := strconv.Atoi(raw)
+		if err != nil || seconds <= 0 {
+			return Config{}, fmt.Errorf("invalid METRICS_HISTORY_INTERVAL_SECONDS")
+		}
+		cfg.MetricsHistoryInterval = time.Duration(seconds) * time.Second
+	}
+
+	if raw := env.Getenv("MEMORY_BUDGET_MB"); raw != "" {
+		mb, err := strconv.Atoi(raw)
+		if err != nil || mb <= 0 {
+			return Config{}, fmt.Errorf("invalid MEMORY_BUDGET_MB")
+		}
+		cfg.MemoryBudgetBytes = int64(mb) << 20
+	}
+	if raw := env.Getenv("MEMORY_BUDGET_MESSAGES"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n <= 0 {
+			return Config{}, fmt.Errorf("invalid MEMORY_BUDGET_MESSAGES")
+		}
+		cfg.MemoryBudgetMessages = n
+	}
+	if raw := env.Getenv("LOAD_SHED_HEAP_MB"); raw != "" {
+		mb, err := strconv.Atoi(raw)
+		if err != nil || mb <= 0 {
+			return Config{}, fmt.Errorf("invalid LOAD_SHED_HEAP_MB")
+		}
+		cfg.LoadShedHeapBytes = uint64(mb) << 20
+	}
+	if raw := env.Getenv("LOAD_SHED_GOROUTINES"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n <= 0 {
+			return Config{}, fmt.Errorf("invalid LOAD_SHED_GOROUTINES")
+		}
+		cfg.LoadShedGoroutines = n
+	}
+
+	cfg.ServerName = env.Getenv("SERVER_NAME")
+	cfg.ServerContact = env.Getenv("SERVER_CONTACT")
+	cfg.WelcomeText = env.Getenv("WELCOME_TEXT")
+
+	cfg.AdminToken = env.Getenv("ADMIN_TOKEN")
+
+	if raw := env.Getenv("DEBUG_TAP_CAPACITY"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n <= 0 {
+			return Config{}, fmt.Errorf("invalid DEBUG_TAP_CAPACITY")
+		}
+		cfg.DebugTapCapacity = n
+	}
+
+	if raw := env.Getenv("AUTH_AUDIT_LOG_SIZE"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n <= 0 {
+			return Config{}, fmt.Errorf("invalid AUTH_AUDIT_LOG_SIZE")
+		}
+		cfg.AuthAuditCapacity = n
+	}
+
+	if raw := env.Getenv("REPLICATION_LOG_SIZE"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n <= 0 {
+			return Config{}, fmt.Errorf("invalid REPLICATION_LOG_SIZE")
+		}
+		cfg.ReplicationLogSize = n
+	}
+	cfg.ReplicateFrom = env.Getenv("REPLICATE_FROM")
+	cfg.ReplicationToken = env.Getenv("REPLICATION_TOKEN")
+	if cfg.ReplicateFrom != "" && cfg.ReplicationToken == "" {
+		return Config{}, fmt.Errorf("REPLICATION_TOKEN is required when REPLICATE_FROM is set")
+	}
+
+	cfg.StateCompression = env.Getenv("STATE_COMPRESSION")
+	switch cfg.StateCompression {
+	case "", "gzip", "zstd":
+	default:
+		return Config{}, fmt.Errorf("invalid STATE_COMPRESSION")
+	}
+	if raw := env.Getenv("STATE_COMPRESSION_MIN_BYTES"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n <= 0 {
+			return Config{}, fmt.Errorf("invalid STATE_COMPRESSION_MIN_BYTES")
+		}
+		cfg.StateCompressionMinBytes = n
+	}
+
+	cfg.IDStrategy = env.Getenv("ID_STRATEGY")
+	switch cfg.IDStrategy {
+	case "", "uuid", "ulid":
+	default:
+		return Config{}, fmt.Errorf("invalid ID_STRATEGY")
+	}
+
+	cfg.StoreBackend = env.Getenv("STORE_BACKEND")
+	switch cfg.StoreBackend {
+	case "", "memory":
+		cfg.StoreBackend = ""
+	case "sqlite":
+		cfg.SQLitePath = env.Getenv("SQLITE_PATH")
+		if cfg.SQLitePath == "" {
+			return Config{}, fmt.Errorf("SQLITE_PATH is required when STORE_BACKEND=sqlite")
+		}
+		if v := env.Getenv("HYDRATED_USERS"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n <= 0 {
+				return Config{}, fmt.Errorf("invalid HYDRATED_USERS")
+			}
+			cfg.HydratedUsers = n
+		}
+	case "bolt":
+		cfg.DataDir = env.Getenv("DATA_DIR")
+		if cfg.DataDir == "" {
+			return Config{}, fmt.Errorf("DATA_DIR is required when STORE_BACKEND=bolt")
+		}
+	case "postgres":
+		cfg.DatabaseURL = env.Getenv("DATABASE_URL")
+		if cfg.DatabaseURL == "" {
+			return Config{}, fmt.Errorf("DATABASE_URL is required when STORE_BACKEND=postgres")
+		}
+	case "redis":
+		cfg.RedisURL = env.Getenv("REDIS_URL")
+		if cfg.RedisURL == "" {
+			return Config{}, fmt.Errorf("REDIS_URL is required when STORE_BACKEND=redis")
+		}
+		cfg.RedisKeyPrefix = env.Getenv("REDIS_KEY_PREFIX")
+		if v := env.Getenv("REDIS_MAX_SESSION_MESSAGES"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n <= 0 {
+				return Config{}, fmt.Errorf("invalid REDIS_MAX_SESSION_MESSAGES")
+			}
+			cfg.RedisMaxSessionMessages = n
+		}
+	default:
+		return Config{}, fmt.Errorf("invalid STORE_BACKEND")
+	}
+
+	cfg.BlobStore = env.Getenv("BLOB_STORE")
+	switch cfg.BlobStore {
+	case "":
+	case "local":
+		cfg.BlobDir = env.Getenv("BLOB_DIR")
+		if cfg.BlobDir == "" {
+			return Config{}, fmt.Errorf("BLOB_DIR is required when BLOB_STORE=local")
+		}
+	case "s3":
+		cfg.S3Endpoint = env.Getenv("S3_ENDPOINT")
+		cfg.S3Region = env.Getenv("S3_REGION")
+		cfg.S3Bucket = env.Getenv("S3_BUCKET")
+		cfg.S3Prefix = env.Getenv("S3_PREFIX")
+		cfg.S3AccessKeyID = env.Getenv("S3_ACCESS_KEY_ID")
+		cfg.S3SecretAccessKey = env.Getenv("S3_SECRET_ACCESS_KEY")
+		if cfg.S3Region == "" || cfg.S3Bucket == "" || cfg.S3AccessKeyID == "" || cfg.S3SecretAccessKey == "" {
+			return Config{}, fmt.Errorf("S3_REGION, S3_BUCKET, S3_ACCESS_KEY_ID and S3_SECRET_ACCESS_KEY are required when BLOB_STORE=s3")
+		}
+	default:
+		return Config{}, fmt.Errorf("invalid BLOB_STORE")
+	}
+
+	cfg.SummarizerURL = env.Getenv("SUMMARIZER_URL")
+	cfg.SummarizerToken = env.Getenv("SUMMARIZER_TOKEN")
+	if cfg.SummarizerURL != "" {
+		if u, err := url.Parse(cfg.SummarizerURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return Config{}, fmt.Errorf("invalid SUMMARIZER_URL")
+		}
+	}
+
+	cfg.PushProvider = env.Getenv("PUSH_PROVIDER")
+	switch cfg.PushProvider {
+	case "":
+	case "expo":
+		cfg.ExpoPushURL = env.Getenv("EXPO_PUSH_URL")
+		cfg.ExpoAccessToken = env.Getenv("EXPO_ACCESS_TOKEN")
+	default:
+		return Config{}, fmt.Errorf("invalid PUSH_PROVIDER")
+	}
+	cfg.PushTemplatesFile = env.Getenv("PUSH_TEMPLATES_FILE")
+
+	cfg.GitHubClientID = env.Getenv("GITHUB_CLIENT_ID")
+	if cfg.GitHubClientID != "" {
+		cfg.GitHubClientSecret = env.Getenv("GITHUB_CLIENT_SECRET")
+		if cfg.GitHubClientSecret == "" {
+			return Config{}, fmt.Errorf("GITHUB_CLIENT_SECRET is required with GITHUB_CLIENT_ID")
+		}
+		cfg.GitHubRedirectURL = env.Getenv("GITHUB_REDIRECT_URL")
+		if u, err := url.Parse(cfg.GitHubRedirectURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return Config{}, fmt.Errorf("invalid GITHUB_REDIRECT_URL")
+		}
+		cfg.GitHubReturnURL = env.Getenv("GITHUB_RETURN_URL")
+		if cfg.GitHubReturnURL != "" {
+			if u, err := url.Parse(cfg.GitHubReturnURL); err != nil || u.Scheme == "" {
+				return Config{}, fmt.Errorf("invalid GITHUB_RETURN_URL")
+			}
+		}
+	}
+
 	return cfg, nil
 }
+
+// secretDecryptTimeout bounds a secret's decrypt command, so a KMS that
+// does not answer fails the start rather than hanging it.
+const secretDecryptTimeout = 30 * time.Second
+
+// loadSecret returns the secret in the environment variable name or, so it
+// stays out of process listings and container inspection, in the file at
+// name_FILE. When name_DECRYPT_COMMAND is set the file is encrypted: the
+// command, such as "age -d -i /run/keys/age.txt" or "sops -d", is run
+// without a shell with the file on stdin and prints the secret. Surrounding
+// whitespace is trimmed from what the file or command holds.
+func loadSecret(env Env, name string) (string, error) {
+	secret := env.Getenv(name)
+	path := env.Getenv(name + "_FILE")
+	command := strings.Fields(env.Getenv(name + "_DECRYPT_COMMAND"))
+	if path == "" {
+		if len(command) > 0 {
+			return "", fmt.Errorf("%s_DECRYPT_COMMAND needs %s_FILE", name, name)
+		}
+		return secret, nil
+	}
+	if secret != "" {
+		return "", fmt.Errorf("%s_FILE replaces %s", name, name)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("invalid %s_FILE: %w", name, err)
+	}
+	if len(command) > 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), secretDecryptTimeout)
+		defer cancel()
+		cmd := exec.CommandContext(ctx, command[0], command[1:]...)
+		cmd.Stdin = bytes.NewReader(data)
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		if data, err = cmd.Output(); err != nil {
+			if msg := strings.TrimSpace(stderr.String()); msg != "" {
+				err = fmt.Errorf("%w: %s", err, msg)
+			}
+			return "", fmt.Errorf("%s_DECRYPT_COMMAND failed: %w", name, err)
+		}
+	}
+	if secret = strings.TrimSpace(string(data)); secret == "" {
+		return "", fmt.Errorf("invalid %s_FILE: empty secret", name)
+	}
+	return secret, nil
+}
+
+// loadSigningKeys reads "kid=secret" lines from path, skipping blank lines
+// and # comments. The first key signs tokens; the rest only verify them, so
+// rotating means adding a new first line and restarting.
+func loadSigningKeys(path string) ([]SigningKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var lines []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+			lines = append(lines, line)
+		}
+	}
+	if len(lines) == 0 {
+		return nil, fmt.Errorf("no keys")
+	}
+	return parseSigningKeys(lines)
+}
+
+// parseSigningKeys parses "kid=secret" pairs, requiring distinct ids.
+func parseSigningKeys(pairs []string) ([]SigningKey, error) {
+	var keys []SigningKey
+	seen := make(map[string]bool)
+	for _, pair := range pairs {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		id, secret, ok := strings.Cut(pair, "=")
+		if !ok || id == "" || secret == "" {
+			return nil, fmt.Errorf("expected kid=secret")
+		}
+		if seen[id] {
+			return nil, fmt.Errorf("duplicate kid %q", id)
+		}
+		seen[id] = true
+		keys = append(keys, SigningKey{ID: id, Secret: secret})
+	}
+	return keys, nil
+}
+
+// httpRateLimitGroups names the route groups HTTP_RATE_LIMITS may set.
+var httpRateLimitGroups = map[string]bool{"auth": true, "read": true, "write": true, "socket-upgrade": true}
+
+// parseRateLimits parses "event=limit/window" pairs such as
+// "message=60/1s,update-state=30/1s". "off" disables all limits.
+func parseRateLimits(raw string) (map[string]RateLimit, error) {
+	limits := make(map[string]RateLimit)
+	if raw == "off" {
+		return limits, nil
+	}
+	for _, part := range strings.Split(raw, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		event, spec, ok := strings.Cut(part, "=")
+		if !ok || event == "" {
+			return nil, fmt.Errorf("missing event in %q", part)
+		}
+		countRaw, windowRaw, ok := strings.Cut(spec, "/")
+		if !ok {
+			return nil, fmt.Errorf("missing window in %q", part)
+		}
+		count, err := strconv.Atoi(countRaw)
+		if err != nil || count <= 0 {
+			return nil, fmt.Errorf("invalid limit in %q", part)
+		}
+		window, err := time.ParseDuration(windowRaw)
+		if err != nil || window <= 0 {
+			return nil, fmt.Errorf("invalid window in %q", part)
+		}
+		limits[event] = RateLimit{Limit: count, Window: window}
+	}
+	return limits, nil
+}
@@ -1,6 +1,14 @@
 package config
 
-import "testing"
+import (
+	"encoding/base64"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
 
 type mapEnv map[string]string
 
@@ -35,3 +43,560 @@ func TestLoadConfigFromEnv_PortOverride(t *testing.T) {
 		t.Fatalf("expected port 1234, got %d", cfg.Port)
 	}
 }
+
+func TestLoadConfigFromEnv_ErrorFormat(t *testing.T) {
+	cfg, err := LoadConfigFromEnv(mapEnv{"MASTER_SECRET": "x"})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if cfg.ErrorFormat != "legacy" {
+		t.Fatalf("expected default error format legacy, got %q", cfg.ErrorFormat)
+	}
+	if _, err := LoadConfigFromEnv(mapEnv{"MASTER_SECRET": "x", "ERROR_FORMAT": "xml"}); err == nil {
+		t.Fatalf("expected error for invalid ERROR_FORMAT")
+	}
+}
+
+func TestLoadConfigFromEnv_HTTPRateLimits(t *testing.T) {
+	cfg, err := LoadConfigFromEnv(mapEnv{"MASTER_SECRET": "x"})
+	if err != nil || cfg.HTTPRateLimits != nil {
+		t.Fatalf("expected default limits, got %v (%v)", cfg.HTTPRateLimits, err)
+	}
+	cfg, err = LoadConfigFromEnv(mapEnv{"MASTER_SECRET": "x", "HTTP_RATE_LIMITS": "auth=5/1m,socket-upgrade=2/10s"})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if got := cfg.HTTPRateLimits["socket-upgrade"]; got.Limit != 2 || got.Window != 10*time.Second {
+		t.Fatalf("unexpected socket-upgrade limit: %+v", got)
+	}
+	if _, err := LoadConfigFromEnv(mapEnv{"MASTER_SECRET": "x", "HTTP_RATE_LIMITS": "uploads=5/1m"}); err == nil {
+		t.Fatalf("expected error for unknown group")
+	}
+}
+
+func TestLoadConfigFromEnv_SocketEventRateLimits(t *testing.T) {
+	cfg, err := LoadConfigFromEnv(mapEnv{"MASTER_SECRET": "x", "SOCKET_EVENT_RATE_LIMITS": "message=5/2s, *=100/1m"})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if got := cfg.SocketEventRateLimits["message"]; got.Limit != 5 || got.Window != 2*time.Second {
+		t.Fatalf("unexpected message limit: %+v", got)
+	}
+	if got := cfg.SocketEventRateLimits["*"]; got.Limit != 100 || got.Window != time.Minute {
+		t.Fatalf("unexpected wildcard limit: %+v", got)
+	}
+
+	cfg, err = LoadConfigFromEnv(mapEnv{"MASTER_SECRET": "x", "SOCKET_EVENT_RATE_LIMITS": "off"})
+	if err != nil || cfg.SocketEventRateLimits == nil || len(cfg.SocketEventRateLimits) != 0 {
+		t.Fatalf("expected empty limits for off, got %v (%v)", cfg.SocketEventRateLimits, err)
+	}
+
+	if _, err := LoadConfigFromEnv(mapEnv{"MASTER_SECRET": "x", "SOCKET_EVENT_RATE_LIMITS": "message=5"}); err == nil {
+		t.Fatalf("expected error for missing window")
+	}
+}
+
+func TestLoadConfigFromEnv_SocketTimeouts(t *testing.T) {
+	cfg, err := LoadConfigFromEnv(mapEnv{"MASTER_SECRET": "x", "SOCKET_HANDSHAKE_TIMEOUT_SECONDS": "5"})
+	if err != nil || cfg.SocketHandshakeTimeout != 5*time.Second {
+		t.Fatalf("expected 5s handshake timeout, got %v (%v)", cfg.SocketHandshakeTimeout, err)
+	}
+	if _, err := LoadConfigFromEnv(mapEnv{"MASTER_SECRET": "x", "SOCKET_HANDSHAKE_TIMEOUT_SECONDS": "-1"}); err == nil {
+		t.Fatalf("expected error for negative handshake timeout")
+	}
+
+	cfg, err = LoadConfigFromEnv(mapEnv{"MASTER_SECRET": "x"})
+	if err != nil || cfg.SessionStallTimeout != 5*time.Minute {
+		t.Fatalf("expected 5m default stall timeout, got %v (%v)", cfg.SessionStallTimeout, err)
+	}
+	cfg, err = LoadConfigFromEnv(mapEnv{"MASTER_SECRET": "x", "SESSION_STALL_TIMEOUT_SECONDS": "0"})
+	if err != nil || cfg.SessionStallTimeout != 0 {
+		t.Fatalf("expected stall detection disabled, got %v (%v)", cfg.SessionStallTimeout, err)
+	}
+}
+
+func TestLoadConfigFromEnv_WebSocketLimits(t *testing.T) {
+	cfg, err := LoadConfigFromEnv(mapEnv{
+		"MASTER_SECRET":         "x",
+		"WS_READ_LIMIT_BYTES":   "4194304",
+		"WS_PONG_WAIT_SECONDS":  "90",
+		"WS_WRITE_WAIT_SECONDS": "15",
+	})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if cfg.WSReadLimitBytes != 4194304 || cfg.WSPongWait != 90*time.Second || cfg.WSWriteWait != 15*time.Second {
+		t.Fatalf("unexpected ws limits: %d %v %v", cfg.WSReadLimitBytes, cfg.WSPongWait, cfg.WSWriteWait)
+	}
+
+	if _, err := LoadConfigFromEnv(mapEnv{"MASTER_SECRET": "x", "WS_PONG_WAIT_SECONDS": "0"}); err == nil {
+		t.Fatalf("expected error for zero pong wait")
+	}
+}
+
+func TestLoadConfigFromEnv_MessageJournal(t *testing.T) {
+	cfg, err := LoadConfigFromEnv(mapEnv{
+		"MASTER_SECRET":                    "x",
+		"SESSIONS_STATE_FILE":              "/tmp/sessions.json",
+		"MESSAGE_JOURNAL_DIR":              "/tmp/journal",
+		"JOURNAL_COMPACT_INTERVAL_SECONDS": "60",
+	})
+	if err != nil || cfg.MessageJournalDir != "/tmp/journal" || cfg.JournalCompactInterval != time.Minute {
+		t.Fatalf("unexpected journal config: %q %v (%v)", cfg.MessageJournalDir, cfg.JournalCompactInterval, err)
+	}
+	if _, err := LoadConfigFromEnv(mapEnv{"MASTER_SECRET": "x", "MESSAGE_JOURNAL_DIR": "/tmp/journal"}); err == nil {
+		t.Fatalf("expected error without SESSIONS_STATE_FILE")
+	}
+	if _, err := LoadConfigFromEnv(mapEnv{"MASTER_SECRET": "x", "JOURNAL_COMPACT_INTERVAL_SECONDS": "0"}); err == nil {
+		t.Fatalf("expected error for zero compact interval")
+	}
+}
+
+func TestLoadConfigFromEnv_StatePartitions(t *testing.T) {
+	cfg, err := LoadConfigFromEnv(mapEnv{
+		"MASTER_SECRET":       "x",
+		"STATE_PARTITION_DIR": "/tmp/partitions",
+		"STATE_PARTITION_KEY": "key",
+		"MESSAGE_JOURNAL_DIR": "/tmp/journal",
+	})
+	if err != nil || cfg.StatePartitionDir != "/tmp/partitions" || cfg.StatePartitionKey != "key" {
+		t.Fatalf("unexpected partition config: %q %q (%v)", cfg.StatePartitionDir, cfg.StatePartitionKey, err)
+	}
+	if _, err := LoadConfigFromEnv(mapEnv{"MASTER_SECRET": "x", "STATE_PARTITION_DIR": "/tmp/partitions"}); err == nil {
+		t.Fatalf("expected error without STATE_PARTITION_KEY")
+	}
+	if _, err := LoadConfigFromEnv(mapEnv{
+		"MASTER_SECRET":       "x",
+		"STATE_PARTITION_DIR": "/tmp/partitions",
+		"STATE_PARTITION_KEY": "key",
+		"SESSIONS_STATE_FILE": "/tmp/sessions.json",
+	}); err == nil {
+		t.Fatalf("expected error with a state file as well")
+	}
+}
+
+func TestLoadConfigFromEnv_RefreshTokenExpiry(t *testing.T) {
+	cfg, err := LoadConfigFromEnv(mapEnv{"MASTER_SECRET": "x"})
+	if err != nil || cfg.RefreshTokenExpiry != 0 {
+		t.Fatalf("expected refresh tokens off by default: %v (%v)", cfg.RefreshTokenExpiry, err)
+	}
+	cfg, err = LoadConfigFromEnv(mapEnv{"MASTER_SECRET": "x", "REFRESH_TOKEN_EXPIRY_SECONDS": "3600"})
+	if err != nil || cfg.RefreshTokenExpiry != time.Hour {
+		t.Fatalf("unexpected refresh token expiry: %v (%v)", cfg.RefreshTokenExpiry, err)
+	}
+	if _, err := LoadConfigFromEnv(mapEnv{"MASTER_SECRET": "x", "REFRESH_TOKEN_EXPIRY_SECONDS": "-1"}); err == nil {
+		t.Fatalf("expected error for a negative expiry")
+	}
+}
+
+func TestLoadConfigFromEnv_MachinesFlushInterval(t *testing.T) {
+	cfg, err := LoadConfigFromEnv(mapEnv{"MASTER_SECRET": "x"})
+	if err != nil || cfg.MachinesFlushInterval != 250*time.Millisecond {
+		t.Fatalf("unexpected default flush interval: %v (%v)", cfg.MachinesFlushInterval, err)
+	}
+	cfg, err = LoadConfigFromEnv(mapEnv{"MASTER_SECRET": "x", "MACHINES_STATE_FLUSH_MS": "0"})
+	if err != nil || cfg.MachinesFlushInterval != 0 {
+		t.Fatalf("expected 0 to disable debouncing: %v (%v)", cfg.MachinesFlushInterval, err)
+	}
+	if _, err := LoadConfigFromEnv(mapEnv{"MASTER_SECRET": "x", "MACHINES_STATE_FLUSH_MS": "-1"}); err == nil {
+		t.Fatalf("expected error for negative flush interval")
+	}
+}
+
+func TestLoadConfigFromEnv_MessageRetention(t *testing.T) {
+	cfg, err := LoadConfigFromEnv(mapEnv{
+		"MASTER_SECRET":                  "x",
+		"MESSAGE_RETENTION_DAYS":         "30",
+		"MAX_MESSAGES_PER_SESSION":       "5000",
+		"MESSAGE_PRUNE_INTERVAL_SECONDS": "120",
+	})
+	if err != nil || cfg.MessageRetention != 30*24*time.Hour || cfg.MaxMessagesPerSession != 5000 || cfg.MessagePruneInterval != 2*time.Minute {
+		t.Fatalf("unexpected retention config: %v %d %v (%v)", cfg.MessageRetention, cfg.MaxMessagesPerSession, cfg.MessagePruneInterval, err)
+	}
+	for _, key := range []string{"MESSAGE_RETENTION_DAYS", "MAX_MESSAGES_PER_SESSION", "MESSAGE_PRUNE_INTERVAL_SECONDS"} {
+		if _, err := LoadConfigFromEnv(mapEnv{"MASTER_SECRET": "x", key: "0"}); err == nil {
+			t.Fatalf("expected error for zero %s", key)
+		}
+	}
+}
+
+func TestLoadConfigFromEnv_Purge(t *testing.T) {
+	cfg, err := LoadConfigFromEnv(mapEnv{"MASTER_SECRET": "x", "PURGE_GRACE_HOURS": "48", "PURGE_INTERVAL_SECONDS": "300"})
+	if err != nil || cfg.PurgeGrace != 48*time.Hour || cfg.PurgeInterval != 5*time.Minute {
+		t.Fatalf("unexpected purge config: %v %v (%v)", cfg.PurgeGrace, cfg.PurgeInterval, err)
+	}
+	if _, err := LoadConfigFromEnv(mapEnv{"MASTER_SECRET": "x", "PURGE_GRACE_HOURS": "-1"}); err == nil {
+		t.Fatalf("expected error for negative grace")
+	}
+}
+
+func TestLoadConfigFromEnv_AuthRequestTTL(t *testing.T) {
+	cfg, err := LoadConfigFromEnv(mapEnv{"MASTER_SECRET": "x", "AUTH_REQUEST_TTL_SECONDS": "300", "AUTH_REQUEST_CLEANUP_INTERVAL_SECONDS": "30"})
+	if err != nil || cfg.AuthRequestTTL != 5*time.Minute || cfg.AuthRequestCleanupInterval != 30*time.Second {
+		t.Fatalf("unexpected auth request config: %v %v (%v)", cfg.AuthRequestTTL, cfg.AuthRequestCleanupInterval, err)
+	}
+	if _, err := LoadConfigFromEnv(mapEnv{"MASTER_SECRET": "x", "AUTH_REQUEST_TTL_SECONDS": "0"}); err == nil {
+		t.Fatalf("expected error for a zero TTL")
+	}
+}
+
+func TestLoadConfigFromEnv_MemoryBudget(t *testing.T) {
+	cfg, err := LoadConfigFromEnv(mapEnv{"MASTER_SECRET": "x", "MEMORY_BUDGET_MB": "256", "MEMORY_BUDGET_MESSAGES": "100000"})
+	if err != nil || cfg.MemoryBudgetBytes != 256<<20 || cfg.MemoryBudgetMessages != 100000 {
+		t.Fatalf("unexpected memory budget: %d %d (%v)", cfg.MemoryBudgetBytes, cfg.MemoryBudgetMessages, err)
+	}
+	for _, key := range []string{"MEMORY_BUDGET_MB", "MEMORY_BUDGET_MESSAGES"} {
+		if _, err := LoadConfigFromEnv(mapEnv{"MASTER_SECRET": "x", key: "0"}); err == nil {
+			t.Fatalf("expected error for zero %s", key)
+		}
+	}
+}
+
+func TestLoadConfigFromEnv_Replication(t *testing.T) {
+	cfg, err := LoadConfigFromEnv(mapEnv{"MASTER_SECRET": "x", "REPLICATION_LOG_SIZE": "5000", "REPLICATE_FROM": "https://primary", "REPLICATION_TOKEN": "t"})
+	if err != nil || cfg.ReplicationLogSize != 5000 || cfg.ReplicateFrom != "https://primary" || cfg.ReplicationToken != "t" {
+		t.Fatalf("unexpected replication config: %d %q %q (%v)", cfg.ReplicationLogSize, cfg.ReplicateFrom, cfg.ReplicationToken, err)
+	}
+	if _, err := LoadConfigFromEnv(mapEnv{"MASTER_SECRET": "x", "REPLICATION_LOG_SIZE": "0"}); err == nil {
+		t.Fatalf("expected error for a zero log size")
+	}
+	if _, err := LoadConfigFromEnv(mapEnv{"MASTER_SECRET": "x", "REPLICATE_FROM": "https://primary"}); err == nil {
+		t.Fatalf("expected error for a standby without a token")
+	}
+}
+
+func TestLoadConfigFromEnv_StateCompression(t *testing.T) {
+	cfg, err := LoadConfigFromEnv(mapEnv{"MASTER_SECRET": "x", "STATE_COMPRESSION": "zstd", "STATE_COMPRESSION_MIN_BYTES": "1024"})
+	if err != nil || cfg.StateCompression != "zstd" || cfg.StateCompressionMinBytes != 1024 {
+		t.Fatalf("unexpected compression: %q %d (%v)", cfg.StateCompression, cfg.StateCompressionMinBytes, err)
+	}
+	if _, err := LoadConfigFromEnv(mapEnv{"MASTER_SECRET": "x", "STATE_COMPRESSION": "lz4"}); err == nil {
+		t.Fatalf("expected error for unknown codec")
+	}
+	if _, err := LoadConfigFromEnv(mapEnv{"MASTER_SECRET": "x", "STATE_COMPRESSION_MIN_BYTES": "0"}); err == nil {
+		t.Fatalf("expected error for zero min bytes")
+	}
+}
+
+func TestLoadConfigFromEnv_IDStrategy(t *testing.T) {
+	cfg, err := LoadConfigFromEnv(mapEnv{"MASTER_SECRET": "x", "ID_STRATEGY": "ulid"})
+	if err != nil || cfg.IDStrategy != "ulid" {
+		t.Fatalf("unexpected id strategy: %q (%v)", cfg.IDStrategy, err)
+	}
+	if _, err := LoadConfigFromEnv(mapEnv{"MASTER_SECRET": "x", "ID_STRATEGY": "snowflake"}); err == nil {
+		t.Fatalf("expected error for unknown strategy")
+	}
+}
+
+func TestLoadConfigFromEnv_StoreBackend(t *testing.T) {
+	cfg, err := LoadConfigFromEnv(mapEnv{"MASTER_SECRET": "x", "STORE_BACKEND": "sqlite", "SQLITE_PATH": "/tmp/happy.db"})
+	if err != nil || cfg.StoreBackend != "sqlite" || cfg.SQLitePath != "/tmp/happy.db" {
+		t.Fatalf("unexpected store backend: %q %q (%v)", cfg.StoreBackend, cfg.SQLitePath, err)
+	}
+	if _, err := LoadConfigFromEnv(mapEnv{"MASTER_SECRET": "x", "STORE_BACKEND": "sqlite"}); err == nil {
+		t.Fatalf("expected error without SQLITE_PATH")
+	}
+	cfg, err = LoadConfigFromEnv(mapEnv{"MASTER_SECRET": "x", "STORE_BACKEND": "sqlite", "SQLITE_PATH": "/tmp/happy.db", "HYDRATED_USERS": "500"})
+	if err != nil || cfg.HydratedUsers != 500 {
+		t.Fatalf("unexpected hydrated users: %d (%v)", cfg.HydratedUsers, err)
+	}
+	if _, err := LoadConfigFromEnv(mapEnv{"MASTER_SECRET": "x", "STORE_BACKEND": "sqlite", "SQLITE_PATH": "/tmp/happy.db", "HYDRATED_USERS": "-1"}); err == nil {
+		t.Fatalf("expected error for negative hydrated users")
+	}
+	cfg, err = LoadConfigFromEnv(mapEnv{"MASTER_SECRET": "x", "STORE_BACKEND": "bolt", "DATA_DIR": "/var/lib/happy"})
+	if err != nil || cfg.StoreBackend != "bolt" || cfg.DataDir != "/var/lib/happy" {
+		t.Fatalf("unexpected store backend: %q %q (%v)", cfg.StoreBackend, cfg.DataDir, err)
+	}
+	if _, err := LoadConfigFromEnv(mapEnv{"MASTER_SECRET": "x", "STORE_BACKEND": "bolt"}); err == nil {
+		t.Fatalf("expected error without DATA_DIR")
+	}
+	cfg, err = LoadConfigFromEnv(mapEnv{"MASTER_SECRET": "x", "STORE_BACKEND": "postgres", "DATABASE_URL": "postgres://db/happy"})
+	if err != nil || cfg.StoreBackend != "postgres" || cfg.DatabaseURL != "postgres://db/happy" {
+		t.Fatalf("unexpected store backend: %q %q (%v)", cfg.StoreBackend, cfg.DatabaseURL, err)
+	}
+	if _, err := LoadConfigFromEnv(mapEnv{"MASTER_SECRET": "x", "STORE_BACKEND": "postgres"}); err == nil {
+		t.Fatalf("expected error without DATABASE_URL")
+	}
+	cfg, err = LoadConfigFromEnv(mapEnv{"MASTER_SECRET": "x", "STORE_BACKEND": "redis", "REDIS_URL": "redis://cache:6379/2", "REDIS_MAX_SESSION_MESSAGES": "500"})
+	if err != nil || cfg.StoreBackend != "redis" || cfg.RedisURL != "redis://cache:6379/2" || cfg.RedisMaxSessionMessages != 500 {
+		t.Fatalf("unexpected store backend: %q %q %d (%v)", cfg.StoreBackend, cfg.RedisURL, cfg.RedisMaxSessionMessages, err)
+	}
+	if _, err := LoadConfigFromEnv(mapEnv{"MASTER_SECRET": "x", "STORE_BACKEND": "redis"}); err == nil {
+		t.Fatalf("expected error without REDIS_URL")
+	}
+	if _, err := LoadConfigFromEnv(mapEnv{"MASTER_SECRET": "x", "STORE_BACKEND": "redis", "REDIS_URL": "redis://cache", "REDIS_MAX_SESSION_MESSAGES": "0"}); err == nil {
+		t.Fatalf("expected error for zero max session messages")
+	}
+	if _, err := LoadConfigFromEnv(mapEnv{"MASTER_SECRET": "x", "STORE_BACKEND": "mysql"}); err == nil {
+		t.Fatalf("expected error for unknown backend")
+	}
+}
+
+func TestLoadConfigFromEnv_BlobStore(t *testing.T) {
+	cfg, err := LoadConfigFromEnv(mapEnv{
+		"MASTER_SECRET":        "x",
+		"BLOB_STORE":           "s3",
+		"S3_REGION":            "us-east-1",
+		"S3_BUCKET":            "happy",
+		"S3_ACCESS_KEY_ID":     "id",
+		"S3_SECRET_ACCESS_KEY": "secret",
+	})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if cfg.BlobStore != "s3" || cfg.S3Bucket != "happy" || cfg.S3Region != "us-east-1" {
+		t.Fatalf("unexpected blob config: %+v", cfg)
+	}
+
+	if _, err := LoadConfigFromEnv(mapEnv{"MASTER_SECRET": "x", "BLOB_STORE": "local"}); err == nil {
+		t.Fatalf("expected error for local store without BLOB_DIR")
+	}
+	if _, err := LoadConfigFromEnv(mapEnv{"MASTER_SECRET": "x", "BLOB_STORE": "gcs"}); err == nil {
+		t.Fatalf("expected error for unknown blob store")
+	}
+}
+
+func TestLoadConfigFromEnv_PushProvider(t *testing.T) {
+	cfg, err := LoadConfigFromEnv(mapEnv{"MASTER_SECRET": "x", "PUSH_PROVIDER": "expo", "EXPO_ACCESS_TOKEN": "tok"})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if cfg.PushProvider != "expo" || cfg.ExpoAccessToken != "tok" {
+		t.Fatalf("unexpected push config: %+v", cfg)
+	}
+
+	if _, err := LoadConfigFromEnv(mapEnv{"MASTER_SECRET": "x", "PUSH_PROVIDER": "fcm"}); err == nil {
+		t.Fatalf("expected error for unknown push provider")
+	}
+}
+
+func TestLoadConfigFromEnv_SocketHandshake(t *testing.T) {
+	cfg, err := LoadConfigFromEnv(mapEnv{"MASTER_SECRET": "x", "SOCKET_REQUIRE_HANDSHAKE_TOKEN": "true", "SOCKET_MAX_PENDING_PER_IP": "-1"})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if !cfg.SocketRequireHandshakeToken || cfg.SocketMaxPendingPerIP != -1 {
+		t.Fatalf("unexpected config: %+v", cfg)
+	}
+	if _, err := LoadConfigFromEnv(mapEnv{"MASTER_SECRET": "x", "SOCKET_REQUIRE_HANDSHAKE_TOKEN": "maybe"}); err == nil {
+		t.Fatalf("expected error for invalid SOCKET_REQUIRE_HANDSHAKE_TOKEN")
+	}
+}
+
+func TestLoadConfigFromEnv_ServerInfo(t *testing.T) {
+	cfg, err := LoadConfigFromEnv(mapEnv{"MASTER_SECRET": "x", "SERVER_NAME": "team", "SERVER_CONTACT": "ops@example.com", "WELCOME_TEXT": "Hi"})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if cfg.ServerName != "team" || cfg.ServerContact != "ops@example.com" || cfg.WelcomeText != "Hi" {
+		t.Fatalf("unexpected server info: %q %q %q", cfg.ServerName, cfg.ServerContact, cfg.WelcomeText)
+	}
+}
+
+func TestLoadConfigFromEnv_SigningKeys(t *testing.T) {
+	cfg, err := LoadConfigFromEnv(mapEnv{"MASTER_SECRET": "new", "MASTER_SECRET_KID": "k2", "PREVIOUS_MASTER_SECRETS": "k1=old, k0=older"})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	want := []SigningKey{{ID: "k1", Secret: "old"}, {ID: "k0", Secret: "older"}}
+	if cfg.MasterSecretKID != "k2" || !reflect.DeepEqual(cfg.PreviousSecrets, want) {
+		t.Fatalf("unexpected keys: %q %+v", cfg.MasterSecretKID, cfg.PreviousSecrets)
+	}
+	for _, env := range []mapEnv{
+		{"MASTER_SECRET": "new", "PREVIOUS_MASTER_SECRETS": "k1=old"},
+		{"MASTER_SECRET": "new", "MASTER_SECRET_KID": "k2", "PREVIOUS_MASTER_SECRETS": "k1"},
+		{"MASTER_SECRET": "new", "MASTER_SECRET_KID": "k2", "PREVIOUS_MASTER_SECRETS": "k1=a,k1=b"},
+	} {
+		if _, err := LoadConfigFromEnv(env); err == nil {
+			t.Fatalf("expected error for %v", env)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "keys")
+	if err := os.WriteFile(path, []byte("# newest first\nk2=new\n\nk1=old\n"), 0o600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	cfg, err = LoadConfigFromEnv(mapEnv{"SIGNING_KEYS_FILE": path})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if cfg.MasterSecret != "new" || cfg.MasterSecretKID != "k2" || !reflect.DeepEqual(cfg.PreviousSecrets, []SigningKey{{ID: "k1", Secret: "old"}}) {
+		t.Fatalf("unexpected keys from file: %q %q %+v", cfg.MasterSecret, cfg.MasterSecretKID, cfg.PreviousSecrets)
+	}
+	if _, err := LoadConfigFromEnv(mapEnv{"SIGNING_KEYS_FILE": path, "MASTER_SECRET": "x"}); err == nil {
+		t.Fatalf("expected SIGNING_KEYS_FILE and MASTER_SECRET together to be rejected")
+	}
+}
+
+func TestLoadConfigFromEnv_TokenSigningKeyFile(t *testing.T) {
+	cfg, err := LoadConfigFromEnv(mapEnv{"TOKEN_SIGNING_KEY_FILE": "/etc/happy/token-key.pem"})
+	if err != nil {
+		t.Fatalf("expected a signing key to stand in for MASTER_SECRET, got %v", err)
+	}
+	if cfg.TokenSigningKeyFile != "/etc/happy/token-key.pem" || cfg.MasterSecret != "" {
+		t.Fatalf("unexpected config: %+v", cfg)
+	}
+}
+
+func TestLoadConfigFromEnv_LoadShedding(t *testing.T) {
+	cfg, err := LoadConfigFromEnv(mapEnv{"MASTER_SECRET": "x", "LOAD_SHED_HEAP_MB": "512", "LOAD_SHED_GOROUTINES": "10000"})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if cfg.LoadShedHeapBytes != 512<<20 || cfg.LoadShedGoroutines != 10000 {
+		t.Fatalf("unexpected limits: %d %d", cfg.LoadShedHeapBytes, cfg.LoadShedGoroutines)
+	}
+	if _, err := LoadConfigFromEnv(mapEnv{"MASTER_SECRET": "x", "LOAD_SHED_HEAP_MB": "0"}); err == nil {
+		t.Fatalf("expected error for a zero heap limit")
+	}
+}
+
+func TestLoadConfigFromEnv_Summarizer(t *testing.T) {
+	cfg, err := LoadConfigFromEnv(mapEnv{"MASTER_SECRET": "x", "SUMMARIZER_URL": "https://summarize.example/v1", "SUMMARIZER_TOKEN": "t"})
+	if err != nil {
+		t.Fatalf("LoadConfigFromEnv: %v", err)
+	}
+	if cfg.SummarizerURL != "https://summarize.example/v1" || cfg.SummarizerToken != "t" {
+		t.Fatalf("unexpected summarizer config: %q %q", cfg.SummarizerURL, cfg.SummarizerToken)
+	}
+	if _, err := LoadConfigFromEnv(mapEnv{"MASTER_SECRET": "x", "SUMMARIZER_URL": "ftp://summarize.example"}); err == nil {
+		t.Fatalf("expected an error for a non-http SUMMARIZER_URL")
+	}
+}
+
+func TestLoadConfigFromEnv_AuthAuditLogSize(t *testing.T) {
+	cfg, err := LoadConfigFromEnv(mapEnv{"MASTER_SECRET": "x", "AUTH_AUDIT_LOG_SIZE": "50"})
+	if err != nil {
+		t.Fatalf("LoadConfigFromEnv: %v", err)
+	}
+	if cfg.AuthAuditCapacity != 50 {
+		t.Fatalf("unexpected auth audit capacity: %d", cfg.AuthAuditCapacity)
+	}
+	if _, err := LoadConfigFromEnv(mapEnv{"MASTER_SECRET": "x", "AUTH_AUDIT_LOG_SIZE": "0"}); err == nil {
+		t.Fatalf("expected an error for a zero AUTH_AUDIT_LOG_SIZE")
+	}
+}
+
+func TestLoadConfigFromEnv_PushTemplatesFile(t *testing.T) {
+	cfg, err := LoadConfigFromEnv(mapEnv{"MASTER_SECRET": "x", "PUSH_TEMPLATES_FILE": "/etc/happy/push.json"})
+	if err != nil {
+		t.Fatalf("LoadConfigFromEnv: %v", err)
+	}
+	if cfg.PushTemplatesFile != "/etc/happy/push.json" {
+		t.Fatalf("unexpected push templates file: %q", cfg.PushTemplatesFile)
+	}
+}
+
+func TestLoadConfigFromEnv_AuthRequireChallenge(t *testing.T) {
+	cfg, err := LoadConfigFromEnv(mapEnv{"MASTER_SECRET": "x"})
+	if err != nil || cfg.AuthAllowClientChallenge {
+		t.Fatalf("expected challenges to be required by default: %+v %v", cfg.AuthAllowClientChallenge, err)
+	}
+	cfg, err = LoadConfigFromEnv(mapEnv{"MASTER_SECRET": "x", "AUTH_REQUIRE_CHALLENGE": "false"})
+	if err != nil || !cfg.AuthAllowClientChallenge {
+		t.Fatalf("expected client challenges to be allowed: %+v %v", cfg.AuthAllowClientChallenge, err)
+	}
+	if _, err := LoadConfigFromEnv(mapEnv{"MASTER_SECRET": "x", "AUTH_REQUIRE_CHALLENGE": "sometimes"}); err == nil {
+		t.Fatalf("expected an error for an invalid AUTH_REQUIRE_CHALLENGE")
+	}
+}
+
+func TestLoadConfigFromEnv_GitHub(t *testing.T) {
+	env := mapEnv{
+		"MASTER_SECRET":        "x",
+		"GITHUB_CLIENT_ID":     "id",
+		"GITHUB_CLIENT_SECRET": "secret",
+		"GITHUB_REDIRECT_URL":  "https://happy.example/v1/connect/github/callback",
+		"GITHUB_RETURN_URL":    "happy://github",
+	}
+	cfg, err := LoadConfigFromEnv(env)
+	if err != nil {
+		t.Fatalf("LoadConfigFromEnv: %v", err)
+	}
+	if cfg.GitHubClientID != "id" || cfg.GitHubClientSecret != "secret" || cfg.GitHubReturnURL != "happy://github" {
+		t.Fatalf("unexpected github config: %+v", cfg)
+	}
+	delete(env, "GITHUB_CLIENT_SECRET")
+	if _, err := LoadConfigFromEnv(env); err == nil {
+		t.Fatalf("expected an error without GITHUB_CLIENT_SECRET")
+	}
+	env["GITHUB_CLIENT_SECRET"] = "secret"
+	env["GITHUB_REDIRECT_URL"] = "/v1/connect/github/callback"
+	if _, err := LoadConfigFromEnv(env); err == nil {
+		t.Fatalf("expected an error for a relative GITHUB_REDIRECT_URL")
+	}
+}
+
+func TestLoadConfigFromEnv_MachineClientCerts(t *testing.T) {
+	tlsEnv := mapEnv{"MASTER_SECRET": "x", "TLS_CERT_FILE": "cert.pem", "TLS_KEY_FILE": "key.pem", "TLS_CLIENT_CA_FILE": "ca.pem", "REQUIRE_MACHINE_CERT": "true"}
+	cfg, err := LoadConfigFromEnv(tlsEnv)
+	if err != nil || cfg.TLSClientCAFile != "ca.pem" || !cfg.RequireMachineCert {
+		t.Fatalf("unexpected client cert config: %q %v (%v)", cfg.TLSClientCAFile, cfg.RequireMachineCert, err)
+	}
+	if _, err := LoadConfigFromEnv(mapEnv{"MASTER_SECRET": "x", "TLS_CLIENT_CA_FILE": "ca.pem"}); err == nil {
+		t.Fatalf("expected error for a client CA without TLS")
+	}
+	if _, err := LoadConfigFromEnv(mapEnv{"MASTER_SECRET": "x", "REQUIRE_MACHINE_CERT": "true"}); err == nil {
+		t.Fatalf("expected error for requiring certificates without a client CA")
+	}
+}
+
+func TestLoadConfigFromEnv_TokenIssuerAndAudience(t *testing.T) {
+	cfg, err := LoadConfigFromEnv(mapEnv{"MASTER_SECRET": "x", "TOKEN_ISSUER": "server-a", "TOKEN_AUDIENCE": "https://a.example.com"})
+	if err != nil || cfg.TokenIssuer != "server-a" || cfg.TokenAudience != "https://a.example.com" {
+		t.Fatalf("unexpected token config: %q %q (%v)", cfg.TokenIssuer, cfg.TokenAudience, err)
+	}
+}
+
+func TestLoadConfigFromEnv_MasterSecretFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "master-secret")
+	if err := os.WriteFile(path, []byte("from-file\n"), 0o600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	cfg, err := LoadConfigFromEnv(mapEnv{"MASTER_SECRET_FILE": path})
+	if err != nil || cfg.MasterSecret != "from-file" {
+		t.Fatalf("unexpected master secret: %q (%v)", cfg.MasterSecret, err)
+	}
+	if _, err := LoadConfigFromEnv(mapEnv{"MASTER_SECRET": "x", "MASTER_SECRET_FILE": path}); err == nil {
+		t.Fatalf("expected error for both MASTER_SECRET and MASTER_SECRET_FILE")
+	}
+	if _, err := LoadConfigFromEnv(mapEnv{"MASTER_SECRET_FILE": filepath.Join(dir, "missing")}); err == nil {
+		t.Fatalf("expected error for a missing file")
+	}
+	if _, err := LoadConfigFromEnv(mapEnv{"MASTER_SECRET": "x", "MASTER_SECRET_DECRYPT_COMMAND": "cat"}); err == nil {
+		t.Fatalf("expected error for a decrypt command without a file")
+	}
+}
+
+func TestLoadConfigFromEnv_MasterSecretDecryptCommand(t *testing.T) {
+	if _, err := exec.LookPath("base64"); err != nil {
+		t.Skip("base64 not installed")
+	}
+	dir := t.TempDir()
+	path := filepath.Join(dir, "master-secret.b64")
+	if err := os.WriteFile(path, []byte(base64.StdEncoding.EncodeToString([]byte("decrypted"))), 0o600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	cfg, err := LoadConfigFromEnv(mapEnv{"MASTER_SECRET_FILE": path, "MASTER_SECRET_DECRYPT_COMMAND": "base64 -d"})
+	if err != nil || cfg.MasterSecret != "decrypted" {
+		t.Fatalf("unexpected master secret: %q (%v)", cfg.MasterSecret, err)
+	}
+	if _, err := LoadConfigFromEnv(mapEnv{"MASTER_SECRET_FILE": path, "MASTER_SECRET_DECRYPT_COMMAND": "false"}); err == nil {
+		t.Fatalf("expected error for a failing decrypt command")
+	}
+}
+
+func TestLoadConfigFromEnv_AuthLockout(t *testing.T) {
+	cfg, err := LoadConfigFromEnv(mapEnv{"MASTER_SECRET": "x"})
+	if err != nil || cfg.AuthLockoutAfter != 5 {
+		t.Fatalf("expected the lockout on by default, got %d (%v)", cfg.AuthLockoutAfter, err)
+	}
+	cfg, err = LoadConfigFromEnv(mapEnv{"MASTER_SECRET": "x", "AUTH_LOCKOUT_AFTER": "0", "AUTH_LOCKOUT_SECONDS": "30", "AUTH_LOCKOUT_MAX_SECONDS": "600"})
+	if err != nil || cfg.AuthLockoutAfter != 0 || cfg.AuthLockout != 30*time.Second || cfg.AuthLockoutMax != 10*time.Minute {
+		t.Fatalf("unexpected lockout config: %+v (%v)", cfg, err)
+	}
+	if _, err := LoadConfigFromEnv(mapEnv{"MASTER_SECRET": "x", "AUTH_LOCKOUT_AFTER": "-1"}); err == nil {
+		t.Fatalf("expected error for a negative AUTH_LOCKOUT_AFTER")
+	}
+}
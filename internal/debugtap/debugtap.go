@@ -0,0 +1,144 @@
+// Package debugtap records recent HTTP requests and socket frames for
+// accounts an operator has explicitly enabled, to debug misbehaving clients
+// against a self-hosted server. Nothing is recorded for other accounts.
+package debugtap
+
+import (
+	"sort"
+	"sync"
+)
+
+const (
+	KindHTTP      = "http"
+	KindSocketIn  = "socket-in"
+	KindSocketOut = "socket-out"
+
+	// MaxBodyBytes caps how much of a body or frame an entry keeps.
+	MaxBodyBytes = 1024
+
+	defaultCapacity = 200
+)
+
+type Entry struct {
+	Time       int64  `json:"time"`
+	Kind       string `json:"kind"`
+	Method     string `json:"method,omitempty"`
+	Path       string `json:"path,omitempty"`
+	Status     int    `json:"status,omitempty"`
+	DurationMs int64  `json:"durationMs,omitempty"`
+	Request    string `json:"request,omitempty"`
+	Response   string `json:"response,omitempty"`
+	ConnID     string `json:"connId,omitempty"`
+	Frame      string `json:"frame,omitempty"`
+	Truncated  bool   `json:"truncated,omitempty"`
+}
+
+type ring struct {
+	entries []Entry
+	next    int
+	full    bool
+}
+
+func (r *ring) add(e Entry) {
+	r.entries[r.next] = e
+	r.next = (r.next + 1) % len(r.entries)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+func (r *ring) list() []Entry {
+	if !r.full {
+		return append([]Entry(nil), r.entries[:r.next]...)
+	}
+	out := make([]Entry, 0, len(r.entries))
+	out = append(out, r.entries[r.next:]...)
+	return append(out, r.entries[:r.next]...)
+}
+
+type Tap struct {
+	capacity int
+
+	mu    sync.RWMutex
+	rings map[string]*ring
+}
+
+// New returns a tap keeping the last capacity entries per enabled user; zero
+// picks the default. A nil *Tap is valid and records nothing.
+func New(capacity int) *Tap {
+	if capacity <= 0 {
+		capacity = defaultCapacity
+	}
+	return &Tap{capacity: capacity, rings: make(map[string]*ring)}
+}
+
+func (t *Tap) Enable(userID string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.rings[userID]; !ok {
+		t.rings[userID] = &ring{entries: make([]Entry, t.capacity)}
+	}
+}
+
+// Disable stops recording for userID and discards what was captured.
+func (t *Tap) Disable(userID string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	_, ok := t.rings[userID]
+	delete(t.rings, userID)
+	return ok
+}
+
+func (t *Tap) Enabled(userID string) bool {
+	if t == nil || userID == "" {
+		return false
+	}
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	_, ok := t.rings[userID]
+	return ok
+}
+
+func (t *Tap) Users() []string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	users := make([]string, 0, len(t.rings))
+	for userID := range t.rings {
+		users = append(users, userID)
+	}
+	sort.Strings(users)
+	return users
+}
+
+// Record appends e for userID, with its credentials redacted, if the tap is
+// enabled for them.
+func (t *Tap) Record(userID string, e Entry) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if r, ok := t.rings[userID]; ok {
+		r.add(redact(e))
+	}
+}
+
+// Entries returns userID's captured entries oldest first, and false when the
+// tap is not enabled for them.
+func (t *Tap) Entries(userID string) ([]Entry, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	r, ok := t.rings[userID]
+	if !ok {
+		return nil, false
+	}
+	return r.list(), true
+}
+
+// Clip shortens s to MaxBodyBytes and reports whether it was cut.
+func Clip(s string) (string, bool) {
+	if len(s) <= MaxBodyBytes {
+		return s, false
+	}
+	return s[:MaxBodyBytes], true
+}
@@ -0,0 +1,67 @@
+package debugtap
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTapRecordsOnlyEnabledUsersAndWraps(t *testing.T) {
+	tap := New(3)
+	tap.Record("user-1", Entry{Path: "/ignored"})
+	if _, ok := tap.Entries("user-1"); ok {
+		t.Fatalf("expected no entries before enable")
+	}
+
+	tap.Enable("user-1")
+	for _, p := range []string{"/a", "/b", "/c", "/d"} {
+		tap.Record("user-1", Entry{Path: p})
+	}
+	tap.Record("user-2", Entry{Path: "/other"})
+
+	entries, ok := tap.Entries("user-1")
+	if !ok || len(entries) != 3 || entries[0].Path != "/b" || entries[2].Path != "/d" {
+		t.Fatalf("expected last three entries oldest first, got %+v", entries)
+	}
+
+	if !tap.Disable("user-1") || tap.Enabled("user-1") {
+		t.Fatalf("expected disable to stop the tap")
+	}
+
+	var nilTap *Tap
+	nilTap.Record("user-1", Entry{})
+	if nilTap.Enabled("user-1") {
+		t.Fatalf("expected nil tap to be disabled")
+	}
+}
+
+func TestClip(t *testing.T) {
+	if s, cut := Clip("short"); s != "short" || cut {
+		t.Fatalf("unexpected clip of short string: %q %v", s, cut)
+	}
+	if s, cut := Clip(strings.Repeat("x", MaxBodyBytes+10)); len(s) != MaxBodyBytes || !cut {
+		t.Fatalf("expected clip to %d bytes, got %d (%v)", MaxBodyBytes, len(s), cut)
+	}
+}
+
+func TestTapRedactsCredentials(t *testing.T) {
+	tap := New(10)
+	tap.Enable("user-1")
+	tap.Record("user-1", Entry{
+		Path:     "/v1/updates?token=secret-1&since=5",
+		Request:  `{"refreshToken": "secret-2", "publicKey": "pk"}`,
+		Response: `{"success":true,"token":"secret-3","key":"secret-4","apiKey":{"id":"k1"}}`,
+	})
+	tap.Record("user-1", Entry{Kind: KindSocketIn, Frame: `40{"token":"secret-5"}`})
+	// A value cut short by Clip is still blanked.
+	tap.Record("user-1", Entry{Response: `{"token":"secret-6`})
+
+	entries, _ := tap.Entries("user-1")
+	for _, e := range entries {
+		if text := e.Path + e.Request + e.Response + e.Frame; strings.Contains(text, "secret-") {
+			t.Fatalf("expected credentials to be redacted: %+v", e)
+		}
+	}
+	if e := entries[0]; e.Path != "/v1/updates?token=[redacted]&since=5" || !strings.Contains(e.Request, `"publicKey": "pk"`) || !strings.Contains(e.Response, `"apiKey":{"id":"k1"}`) {
+		t.Fatalf("expected only the credentials to change: %+v", e)
+	}
+}
@@ -0,0 +1,61 @@
+package debugtap
+
+import (
+	"bytes"
+	"io"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type captureWriter struct {
+	gin.ResponseWriter
+	buf bytes.Buffer
+}
+
+func (w *captureWriter) Write(b []byte) (int, error) {
+	if room := MaxBodyBytes + 1 - w.buf.Len(); room > 0 {
+		if len(b) < room {
+			room = len(b)
+		}
+		w.buf.Write(b[:room])
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Middleware records requests made by tapped users. It must run after the
+// auth middleware so the caller is known; userID extracts it.
+func Middleware(t *Tap, userID func(*gin.Context) (string, bool)) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		uid, ok := userID(c)
+		if !ok || !t.Enabled(uid) {
+			c.Next()
+			return
+		}
+
+		var reqBody []byte
+		if c.Request.Body != nil {
+			reqBody, _ = io.ReadAll(io.LimitReader(c.Request.Body, MaxBodyBytes+1))
+			c.Request.Body = io.NopCloser(io.MultiReader(bytes.NewReader(reqBody), c.Request.Body))
+		}
+		w := &captureWriter{ResponseWriter: c.Writer}
+		c.Writer = w
+
+		start := time.Now()
+		c.Next()
+
+		req, reqCut := Clip(string(reqBody))
+		resp, respCut := Clip(w.buf.String())
+		t.Record(uid, Entry{
+			Time:       start.UnixMilli(),
+			Kind:       KindHTTP,
+			Method:     c.Request.Method,
+			Path:       c.Request.URL.RequestURI(),
+			Status:     c.Writer.Status(),
+			DurationMs: time.Since(start).Milliseconds(),
+			Request:    req,
+			Response:   resp,
+			Truncated:  reqCut || respCut,
+		})
+	}
+}
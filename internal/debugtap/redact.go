@@ -0,0 +1,28 @@
+package debugtap
+
+import "regexp"
+
+// Entries never keep headers, so the Authorization header is not recorded;
+// credentials in bodies, frames and query strings are blanked by redact.
+var (
+	// secretField matches a JSON string field holding a credential: bearer
+	// and refresh tokens, API keys and secrets. A value cut short by Clip
+	// runs to the end of the text.
+	secretField = regexp.MustCompile(`("(?i:token|accessToken|refreshToken|secret|apiKey|key|password)"\s*:\s*)"(?:[^"\\]|\\.)*(?:"|\\?$)`)
+	secretParam = regexp.MustCompile(`([?&](?i:token|accessToken|refreshToken)=)[^&#]*`)
+)
+
+const redacted = "[redacted]"
+
+// redact blanks the credentials in e before it is stored.
+func redact(e Entry) Entry {
+	e.Path = secretParam.ReplaceAllString(e.Path, "${1}"+redacted)
+	e.Request = redactBody(e.Request)
+	e.Response = redactBody(e.Response)
+	e.Frame = redactBody(e.Frame)
+	return e
+}
+
+func redactBody(s string) string {
+	return secretField.ReplaceAllString(s, `${1}"`+redacted+`"`)
+}
@@ -0,0 +1,352 @@
+// Package events defines the "update" and "ephemeral" bodies the server emits.
+// Socket.IO, the raw /ws transport and the tests all build and read them from
+// these types so field names cannot drift between emit sites.
+package events
+
+import "happy-server-lite/internal/model"
+
+// SchemaVersion is the shape of the bodies in this package. Bump it whenever a
+// body changes incompatibly, and keep serving the old shape to connections
+// that negotiated an older version.
+const (
+	SchemaVersion    = 1
+	MinSchemaVersion = 1
+)
+
+// Update body types, sent as the "t" field.
+const (
+	TypeNewMessage    = "new-message"
+	TypeUpdateMessage = "update-message"
+	TypeDeleteMessage = "delete-message"
+	TypeUpdateSession = "update-session"
+	TypeUpdateMachine = "update-machine"
+	TypeDeleteSession = "delete-session"
+	TypeDeleteMachine = "delete-machine"
+	// TypeAnnotateMessage carries all of a message's annotations after one
+	// of them changed.
+	TypeAnnotateMessage = "annotate-message"
+)
+
+// Ephemeral types, sent as the "type" field.
+const (
+	TypeActivity        = "activity"
+	TypeMachineActivity = "machine-activity"
+	TypeUsage           = "usage"
+	TypeSessionStalled  = "session-stalled"
+	TypeServerRestarted = "server-restarted"
+	TypeSessionLock     = "session-lock"
+)
+
+// Update is the envelope of every "update" event; Seq orders updates across
+// the whole server.
+type Update struct {
+	ID        string `json:"id"`
+	Seq       int64  `json:"seq"`
+	CreatedAt int64  `json:"createdAt"`
+	Body      any    `json:"body"`
+	V         int    `json:"v"`
+}
+
+// MessageContent is the opaque, client-encrypted payload of a message.
+type MessageContent struct {
+	T string `json:"t"`
+	C string `json:"c"`
+}
+
+// Message is a session message as updates and REST responses present it.
+type Message struct {
+	ID        string         `json:"id"`
+	Seq       int64          `json:"seq"`
+	Content   MessageContent `json:"content"`
+	Checksum  string         `json:"checksum,omitempty"`
+	LocalID   string         `json:"localId,omitempty"`
+	Deleted   bool           `json:"deleted,omitempty"`
+	CreatedAt int64          `json:"createdAt"`
+	UpdatedAt int64          `json:"updatedAt"`
+	// Annotations maps each key clients set on the message to its value.
+	Annotations map[string]Annotation `json:"annotations,omitempty"`
+}
+
+// Annotation is a client-encrypted value attached to a message.
+type Annotation struct {
+	Version   int    `json:"version"`
+	Value     string `json:"value"`
+	UpdatedAt int64  `json:"updatedAt"`
+}
+
+func MessageFrom(msg model.SessionMessage) Message {
+	return Message{
+		ID:          msg.ID,
+		Seq:         msg.Seq,
+		Content:     MessageContent{T: "encrypted", C: msg.Content},
+		Checksum:    msg.Checksum,
+		LocalID:     msg.LocalID,
+		Deleted:     msg.Deleted,
+		CreatedAt:   msg.CreatedAt,
+		UpdatedAt:   msg.UpdatedAt,
+		Annotations: AnnotationsFrom(msg.Annotations),
+	}
+}
+
+// AnnotationsFrom is nil for a message without annotations.
+func AnnotationsFrom(annotations map[string]model.MessageAnnotation) map[string]Annotation {
+	if len(annotations) == 0 {
+		return nil
+	}
+	out := make(map[string]Annotation, len(annotations))
+	for key, a := range annotations {
+		out[key] = Annotation{Version: a.Version, Value: a.Value, UpdatedAt: a.UpdatedAt}
+	}
+	return out
+}
+
+// Versioned is a metadata, agent state or daemon state value together with
+// the version it was written at.
+type Versioned[T any] struct {
+	Version int `json:"version"`
+	Value   T   `json:"value"`
+}
+
+type NewMessageBody struct {
+	T   string `json:"t"`
+	SID string `json:"sid"`
+	// SessionID repeats SID for raw /ws clients, which have always read it
+	// under this name.
+	SessionID string  `json:"sessionId,omitempty"`
+	Message   Message `json:"message"`
+}
+
+func NewMessage(sessionID string, msg Message) NewMessageBody {
+	return NewMessageBody{T: TypeNewMessage, SID: sessionID, Message: msg}
+}
+
+// UpdateMessageBody carries a message whose content was edited.
+type UpdateMessageBody struct {
+	T       string  `json:"t"`
+	SID     string  `json:"sid"`
+	Message Message `json:"message"`
+}
+
+func MessageUpdated(sessionID string, msg Message) UpdateMessageBody {
+	return UpdateMessageBody{T: TypeUpdateMessage, SID: sessionID, Message: msg}
+}
+
+// DeleteMessageBody names a message that is now a tombstone.
+type DeleteMessageBody struct {
+	T         string `json:"t"`
+	SID       string `json:"sid"`
+	MessageID string `json:"messageId"`
+	Seq       int64  `json:"seq"`
+	UpdatedAt int64  `json:"updatedAt"`
+}
+
+func MessageDeleted(sessionID string, msg Message) DeleteMessageBody {
+	return DeleteMessageBody{T: TypeDeleteMessage, SID: sessionID, MessageID: msg.ID, Seq: msg.Seq, UpdatedAt: msg.UpdatedAt}
+}
+
+// AnnotateMessageBody carries all annotations of a message; keys missing
+// from it were removed.
+type AnnotateMessageBody struct {
+	T           string                `json:"t"`
+	SID         string                `json:"sid"`
+	MessageID   string                `json:"messageId"`
+	Seq         int64                 `json:"seq"`
+	Annotations map[string]Annotation `json:"annotations"`
+}
+
+func MessageAnnotated(sessionID string, msg Message) AnnotateMessageBody {
+	annotations := msg.Annotations
+	if annotations == nil {
+		annotations = map[string]Annotation{}
+	}
+	return AnnotateMessageBody{T: TypeAnnotateMessage, SID: sessionID, MessageID: msg.ID, Seq: msg.Seq, Annotations: annotations}
+}
+
+type UpdateSessionBody struct {
+	T          string              `json:"t"`
+	SID        string              `json:"sid"`
+	Metadata   *Versioned[string]  `json:"metadata,omitempty"`
+	AgentState *Versioned[*string] `json:"agentState,omitempty"`
+}
+
+func SessionMetadataUpdated(sessionID string, version int, metadata string) UpdateSessionBody {
+	return UpdateSessionBody{T: TypeUpdateSession, SID: sessionID, Metadata: &Versioned[string]{version, metadata}}
+}
+
+func SessionAgentStateUpdated(sessionID string, version int, agentState *string) UpdateSessionBody {
+	return UpdateSessionBody{T: TypeUpdateSession, SID: sessionID, AgentState: &Versioned[*string]{version, agentState}}
+}
+
+type UpdateMachineBody struct {
+	T           string              `json:"t"`
+	MachineID   string              `json:"machineId"`
+	Metadata    *Versioned[string]  `json:"metadata,omitempty"`
+	DaemonState *Versioned[*string] `json:"daemonState,omitempty"`
+}
+
+func MachineMetadataUpdated(machineID string, version int, metadata string) UpdateMachineBody {
+	return UpdateMachineBody{T: TypeUpdateMachine, MachineID: machineID, Metadata: &Versioned[string]{version, metadata}}
+}
+
+func MachineDaemonStateUpdated(machineID string, version int, daemonState *string) UpdateMachineBody {
+	return UpdateMachineBody{T: TypeUpdateMachine, MachineID: machineID, DaemonState: &Versioned[*string]{version, daemonState}}
+}
+
+type DeleteSessionBody struct {
+	T   string `json:"t"`
+	SID string `json:"sid"`
+}
+
+func SessionDeleted(sessionID string) DeleteSessionBody {
+	return DeleteSessionBody{T: TypeDeleteSession, SID: sessionID}
+}
+
+type DeleteMachineBody struct {
+	T         string `json:"t"`
+	MachineID string `json:"machineId"`
+}
+
+func MachineDeleted(machineID string) DeleteMachineBody {
+	return DeleteMachineBody{T: TypeDeleteMachine, MachineID: machineID}
+}
+
+// Activity reports whether a session's agent is running and thinking.
+type Activity struct {
+	Type     string `json:"type"`
+	ID       string `json:"id"`
+	Active   bool   `json:"active"`
+	ActiveAt int64  `json:"activeAt"`
+	Thinking bool   `json:"thinking"`
+	V        int    `json:"v"`
+}
+
+func SessionActivity(sessionID string, active bool, activeAt int64, thinking bool) Activity {
+	return Activity{Type: TypeActivity, ID: sessionID, Active: active, ActiveAt: activeAt, Thinking: thinking, V: SchemaVersion}
+}
+
+// MachineActivity reports whether a machine's daemon is connected.
+type MachineActivity struct {
+	Type     string `json:"type"`
+	ID       string `json:"id"`
+	Active   bool   `json:"active"`
+	ActiveAt int64  `json:"activeAt"`
+	V        int    `json:"v"`
+}
+
+func MachineActive(machineID string, active bool, activeAt int64) MachineActivity {
+	return MachineActivity{Type: TypeMachineActivity, ID: machineID, Active: active, ActiveAt: activeAt, V: SchemaVersion}
+}
+
+type UsageTokens struct {
+	Total         float64 `json:"total"`
+	Input         float64 `json:"input"`
+	Output        float64 `json:"output"`
+	CacheCreation float64 `json:"cache_creation"`
+	CacheRead     float64 `json:"cache_read"`
+}
+
+type UsageCost struct {
+	Total  float64 `json:"total"`
+	Input  float64 `json:"input"`
+	Output float64 `json:"output"`
+}
+
+// Usage relays a daemon's token and cost report for a session.
+type Usage struct {
+	Type      string      `json:"type"`
+	ID        string      `json:"id"`
+	Key       string      `json:"key"`
+	Timestamp int64       `json:"timestamp"`
+	Tokens    UsageTokens `json:"tokens"`
+	Cost      UsageCost   `json:"cost"`
+	V         int         `json:"v"`
+}
+
+func UsageReported(sessionID, key string, timestamp int64, tokens UsageTokens, cost UsageCost) Usage {
+	return Usage{Type: TypeUsage, ID: sessionID, Key: key, Timestamp: timestamp, Tokens: tokens, Cost: cost, V: SchemaVersion}
+}
+
+// SessionStalled tells clients a connected daemon stopped sending
+// session-alive.
+type SessionStalled struct {
+	Type        string `json:"type"`
+	ID          string `json:"id"`
+	LastAliveAt int64  `json:"lastAliveAt"`
+	V           int    `json:"v"`
+}
+
+func SessionStalledSince(sessionID string, lastAliveAt int64) SessionStalled {
+	return SessionStalled{Type: TypeSessionStalled, ID: sessionID, LastAliveAt: lastAliveAt, V: SchemaVersion}
+}
+
+// Lock is an advisory session lock as REST responses and acks present it.
+// Token is only ever given to the holder.
+type Lock struct {
+	Name       string `json:"name"`
+	Holder     string `json:"holder"`
+	Token      string `json:"token,omitempty"`
+	AcquiredAt int64  `json:"acquiredAt"`
+	ExpiresAt  int64  `json:"expiresAt"`
+}
+
+func LockFrom(lock model.SessionLock) Lock {
+	return Lock{Name: lock.Name, Holder: lock.Holder, Token: lock.Token, AcquiredAt: lock.AcquiredAt, ExpiresAt: lock.ExpiresAt}
+}
+
+// SessionLock tells a session's clients that a lock was acquired or renewed,
+// with Held set, or released. Locks that lapse are not announced; clients
+// go by ExpiresAt.
+type SessionLock struct {
+	Type      string `json:"type"`
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	Holder    string `json:"holder"`
+	Held      bool   `json:"held"`
+	ExpiresAt int64  `json:"expiresAt"`
+	V         int    `json:"v"`
+}
+
+func SessionLockChanged(lock model.SessionLock, held bool) SessionLock {
+	return SessionLock{Type: TypeSessionLock, ID: lock.SessionID, Name: lock.Name, Holder: lock.Holder, Held: held, ExpiresAt: lock.ExpiresAt, V: SchemaVersion}
+}
+
+// ServerRestart tells a user's clients the server restarted at StartedAt, so
+// updates sent while it was down were lost and they should resync.
+type ServerRestart struct {
+	Type      string `json:"type"`
+	StartedAt int64  `json:"startedAt"`
+	V         int    `json:"v"`
+}
+
+func ServerRestarted(startedAt int64) ServerRestart {
+	return ServerRestart{Type: TypeServerRestarted, StartedAt: startedAt, V: SchemaVersion}
+}
+
+// EventAuthRequest names the event, beside "update" and "ephemeral", that
+// tells a user's clients a new device asked to sign in with the account's
+// key, so one of them can prompt for approval without polling.
+const EventAuthRequest = "auth-request"
+
+type AuthRequestDevice struct {
+	Platform   string `json:"platform"`
+	Hostname   string `json:"hostname"`
+	AppVersion string `json:"appVersion"`
+}
+
+// AuthRequest is the body of EventAuthRequest. Device is what the
+// requesting device reported about itself, if anything.
+type AuthRequest struct {
+	PublicKey  string             `json:"publicKey"`
+	SupportsV2 bool               `json:"supportsV2"`
+	Device     *AuthRequestDevice `json:"device,omitempty"`
+	CreatedAt  int64              `json:"createdAt"`
+	V          int                `json:"v"`
+}
+
+func AuthRequested(req model.AuthRequest) AuthRequest {
+	body := AuthRequest{PublicKey: req.PublicKey, SupportsV2: req.SupportsV2, CreatedAt: req.CreatedAt, V: SchemaVersion}
+	if d := req.Device; d != nil {
+		body.Device = &AuthRequestDevice{Platform: d.Platform, Hostname: d.Hostname, AppVersion: d.AppVersion}
+	}
+	return body
+}
@@ -0,0 +1,50 @@
+package events
+
+import (
+	"encoding/json"
+	"testing"
+
+	"happy-server-lite/internal/model"
+)
+
+func TestBodiesMarshalWireFieldNames(t *testing.T) {
+	state := "state"
+	msg := MessageFrom(model.SessionMessage{ID: "m1", SessionID: "s1", Seq: 3, Content: "c", CreatedAt: 10, UpdatedAt: 11})
+	cases := []struct {
+		name string
+		body any
+		want string
+	}{
+		{"new-message", NewMessage("s1", msg),
+			`{"t":"new-message","sid":"s1","message":{"id":"m1","seq":3,"content":{"t":"encrypted","c":"c"},"createdAt":10,"updatedAt":11}}`},
+		{"annotate-message", MessageAnnotated("s1", MessageFrom(model.SessionMessage{ID: "m1", Seq: 3, Annotations: map[string]model.MessageAnnotation{"bookmarked": {Value: "v", Version: 2, UpdatedAt: 12}}})),
+			`{"t":"annotate-message","sid":"s1","messageId":"m1","seq":3,"annotations":{"bookmarked":{"version":2,"value":"v","updatedAt":12}}}`},
+		{"annotate-message none left", MessageAnnotated("s1", MessageFrom(model.SessionMessage{ID: "m1", Seq: 3})),
+			`{"t":"annotate-message","sid":"s1","messageId":"m1","seq":3,"annotations":{}}`},
+		{"update-session metadata", SessionMetadataUpdated("s1", 2, "meta"),
+			`{"t":"update-session","sid":"s1","metadata":{"version":2,"value":"meta"}}`},
+		{"update-session cleared agent state", SessionAgentStateUpdated("s1", 4, nil),
+			`{"t":"update-session","sid":"s1","agentState":{"version":4,"value":null}}`},
+		{"update-machine daemon state", MachineDaemonStateUpdated("mc", 1, &state),
+			`{"t":"update-machine","machineId":"mc","daemonState":{"version":1,"value":"state"}}`},
+		{"delete-machine", MachineDeleted("mc"),
+			`{"t":"delete-machine","machineId":"mc"}`},
+		{"activity", SessionActivity("s1", true, 5, true),
+			`{"type":"activity","id":"s1","active":true,"activeAt":5,"thinking":true,"v":1}`},
+		{"session-stalled", SessionStalledSince("s1", 7),
+			`{"type":"session-stalled","id":"s1","lastAliveAt":7,"v":1}`},
+		{"session-lock", SessionLockChanged(model.SessionLock{SessionID: "s1", Name: "metadata", Holder: "cli", Token: "secret", ExpiresAt: 8}, true),
+			`{"type":"session-lock","id":"s1","name":"metadata","holder":"cli","held":true,"expiresAt":8,"v":1}`},
+		{"auth-request", AuthRequested(model.AuthRequest{PublicKey: "pk", Device: &model.AuthRequestDevice{Platform: "ios"}, CreatedAt: 9}),
+			`{"publicKey":"pk","supportsV2":false,"device":{"platform":"ios","hostname":"","appVersion":""},"createdAt":9,"v":1}`},
+	}
+	for _, tc := range cases {
+		got, err := json.Marshal(tc.body)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if string(got) != tc.want {
+			t.Fatalf("%s:\n got %s\nwant %s", tc.name, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+// Package github connects accounts to GitHub users through GitHub's OAuth
+// web flow: the user is sent to AuthorizeURL, and the code GitHub returns
+// to the callback is exchanged for the user's public profile.
+package github
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultAuthorizeURL = "https://github.com/login/oauth/authorize"
+	DefaultTokenURL     = "https://github.com/login/oauth/access_token"
+	DefaultAPIURL       = "https://api.github.com"
+)
+
+type Config struct {
+	ClientID     string
+	ClientSecret string
+	// RedirectURL is the callback registered with the OAuth app, the
+	// server's /v1/connect/github/callback.
+	RedirectURL string
+	// AuthorizeURL, TokenURL and APIURL default to GitHub's.
+	AuthorizeURL string
+	TokenURL     string
+	APIURL       string
+	HTTPClient   *http.Client
+}
+
+// User is the public profile of a GitHub user.
+type User struct {
+	ID        int64  `json:"id"`
+	Login     string `json:"login"`
+	Name      string `json:"name"`
+	AvatarURL string `json:"avatar_url"`
+}
+
+type OAuth struct {
+	cfg    Config
+	client *http.Client
+}
+
+func New(cfg Config) *OAuth {
+	if cfg.AuthorizeURL == "" {
+		cfg.AuthorizeURL = DefaultAuthorizeURL
+	}
+	if cfg.TokenURL == "" {
+		cfg.TokenURL = DefaultTokenURL
+	}
+	if cfg.APIURL == "" {
+		cfg.APIURL = DefaultAPIURL
+	}
+	cfg.APIURL = strings.TrimSuffix(cfg.APIURL, "/")
+	client := cfg.HTTPClient
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	return &OAuth{cfg: cfg, client: client}
+}
+
+// AuthorizeURL is where to send the user's browser to approve the link.
+// GitHub hands state back to the callback unchanged.
+func (o *OAuth) AuthorizeURL(state string) string {
+	q := url.Values{
+		"client_id":    {o.cfg.ClientID},
+		"redirect_uri": {o.cfg.RedirectURL},
+		"scope":        {"read:user"},
+		"state":        {state},
+	}
+	sep := "?"
+	if strings.Contains(o.cfg.AuthorizeURL, "?") {
+		sep = "&"
+	}
+	return o.cfg.AuthorizeURL + sep + q.Encode()
+}
+
+// Exchange trades the code GitHub passed to the callback for the profile of
+// the user who approved. The access token is used once and not kept.
+func (o *OAuth) Exchange(ctx context.Context, code string) (User, error) {
+	if code == "" {
+		return User{}, errors.New("github: missing code")
+	}
+	form := url.Values{
+		"client_id":     {o.cfg.ClientID},
+		"client_secret": {o.cfg.ClientSecret},
+		"code":          {code},
+		"redirect_uri":  {o.cfg.RedirectURL},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, o.cfg.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return User{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	var token struct {
+		AccessToken      string `json:"access_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := o.do(req, &token); err != nil {
+		return User{}, err
+	}
+	if token.AccessToken == "" {
+		if token.Error == "" {
+			token.Error = "no access token"
+		}
+		return User{}, fmt.Errorf("github: %s %s", token.Error, token.ErrorDescription)
+	}
+
+	req, err = http.NewRequestWithContext(ctx, http.MethodGet, o.cfg.APIURL+"/user", nil)
+	if err != nil {
+		return User{}, err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("Authorization", "Bearer "+token.AccessToken)
+	var user User
+	if err := o.do(req, &user); err != nil {
+		return User{}, err
+	}
+	if user.ID == 0 || user.Login == "" {
+		return User{}, errors.New("github: incomplete user profile")
+	}
+	return user, nil
+}
+
+func (o *OAuth) do(req *http.Request, out any) error {
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("github: %s %s: %s: %s", req.Method, req.URL.Path, resp.Status, bytes.TrimSpace(body))
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(out)
+}
@@ -0,0 +1,60 @@
+package github
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func newFakeGitHub(t *testing.T) *httptest.Server {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/login/oauth/access_token", func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("client_secret") != "secret" || r.FormValue("code") != "good" {
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": "bad_verification_code"})
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]string{"access_token": "gho_1"})
+	})
+	mux.HandleFunc("/user", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer gho_1" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(User{ID: 42, Login: "octocat", Name: "The Octocat", AvatarURL: "https://avatars/42"})
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestAuthorizeURL(t *testing.T) {
+	o := New(Config{ClientID: "id", RedirectURL: "https://happy.example/v1/connect/github/callback"})
+	u, err := url.Parse(o.AuthorizeURL("st"))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	q := u.Query()
+	if u.Host != "github.com" || q.Get("client_id") != "id" || q.Get("state") != "st" || q.Get("redirect_uri") != "https://happy.example/v1/connect/github/callback" {
+		t.Fatalf("unexpected authorize URL: %s", u)
+	}
+}
+
+func TestExchange(t *testing.T) {
+	srv := newFakeGitHub(t)
+	o := New(Config{ClientID: "id", ClientSecret: "secret", TokenURL: srv.URL + "/login/oauth/access_token", APIURL: srv.URL})
+
+	user, err := o.Exchange(context.Background(), "good")
+	if err != nil {
+		t.Fatalf("Exchange: %v", err)
+	}
+	if user.ID != 42 || user.Login != "octocat" || user.AvatarURL != "https://avatars/42" {
+		t.Fatalf("unexpected user: %+v", user)
+	}
+	if _, err := o.Exchange(context.Background(), "bad"); err == nil {
+		t.Fatal("expected a rejected code to fail")
+	}
+}
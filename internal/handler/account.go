@@ -1,44 +1,87 @@
 package handler
 
 import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"log"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"happy-server-lite/internal/apierror"
+	"happy-server-lite/internal/auth"
+	"happy-server-lite/internal/clock"
+	"happy-server-lite/internal/hub"
 	"happy-server-lite/internal/middleware"
+	"happy-server-lite/internal/socketio"
 	"happy-server-lite/internal/store"
 )
 
 type AccountHandler struct {
-	Store *store.Store
+	Store       store.Storage
+	Sockets     *socketio.Server
+	Hub         *hub.Hub
+	Revocations *auth.Revocations
+	Clock       clock.Clock
 }
 
 func (h *AccountHandler) Profile(c *gin.Context) {
 	userID, ok := middleware.UserIDFromContext(c)
 	if !ok {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid authentication token"})
+		apierror.Respond(c, http.StatusUnauthorized, apierror.CodeUnauthorized, "Invalid authentication token")
 		return
 	}
 
+	ctx := c.Request.Context()
+	var githubUser any
+	connected := []string{}
+	if identity, ok := h.Store.GetGitHubIdentity(ctx, userID); ok {
+		githubUser = githubProfile(identity)
+		connected = append(connected, "github")
+	}
 	c.JSON(http.StatusOK, gin.H{
 		"id":                userID,
-		"timestamp":         time.Now().UnixMilli(),
+		"timestamp":         clock.Now(h.Clock).UnixMilli(),
 		"firstName":         nil,
 		"lastName":          nil,
 		"avatar":            nil,
-		"github":            nil,
-		"connectedServices": []string{},
+		"github":            githubUser,
+		"connectedServices": connected,
+		"devices":           h.devices(ctx, userID),
 	})
 }
 
+// devices summarises what the account has linked and what is online now.
+func (h *AccountHandler) devices(ctx context.Context, userID string) gin.H {
+	activeSessions := 0
+	for _, sess := range h.Store.ListSessions(ctx, userID) {
+		if sess.Active {
+			activeSessions++
+		}
+	}
+	connections := 0
+	if h.Sockets != nil {
+		connections = len(h.Sockets.Connections(userID))
+	}
+	return gin.H{
+		"machines":       len(h.Store.ListMachines(ctx, userID)),
+		"activeSessions": activeSessions,
+		"connections":    connections,
+	}
+}
+
 func (h *AccountHandler) Settings(c *gin.Context) {
+	ctx := c.Request.Context()
 	userID, ok := middleware.UserIDFromContext(c)
 	if !ok {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid authentication token"})
+		apierror.Respond(c, http.StatusUnauthorized, apierror.CodeUnauthorized, "Invalid authentication token")
 		return
 	}
 
-	settings, version := h.Store.GetAccountSettings(userID)
+	settings, version := h.Store.GetAccountSettings(ctx, userID)
 	c.JSON(http.StatusOK, gin.H{"settings": settings, "settingsVersion": version})
 }
 
@@ -48,30 +91,143 @@ type updateSettingsBody struct {
 }
 
 func (h *AccountHandler) UpdateSettings(c *gin.Context) {
+	ctx := c.Request.Context()
 	userID, ok := middleware.UserIDFromContext(c)
 	if !ok {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid authentication token"})
+		apierror.Respond(c, http.StatusUnauthorized, apierror.CodeUnauthorized, "Invalid authentication token")
 		return
 	}
 
 	var body updateSettingsBody
 	if err := c.ShouldBindJSON(&body); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		apierror.Respond(c, http.StatusBadRequest, apierror.CodeInvalidRequest, "Invalid request")
 		return
 	}
 	if body.Settings == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing settings"})
+		apierror.Respond(c, http.StatusBadRequest, apierror.CodeInvalidRequest, "Missing settings")
 		return
 	}
 
-	status, currentVersion, currentSettings := h.Store.UpdateAccountSettings(userID, body.ExpectedVersion, body.Settings, time.Now().UnixMilli())
+	status, currentVersion, currentSettings := h.Store.UpdateAccountSettings(ctx, userID, body.ExpectedVersion, body.Settings, clock.Now(h.Clock).UnixMilli())
 	if status == "success" {
 		c.JSON(http.StatusOK, gin.H{"success": true})
 		return
 	}
 	if status == "version-mismatch" {
-		c.JSON(http.StatusOK, gin.H{"success": false, "error": "version-mismatch", "currentVersion": currentVersion, "currentSettings": currentSettings})
+		apierror.VersionMismatch(c, gin.H{"currentVersion": currentVersion, "currentSettings": currentSettings})
 		return
 	}
-	c.JSON(http.StatusBadRequest, gin.H{"success": false, "error": "error"})
+	if status == "too-large" {
+		apierror.RespondWith(c, http.StatusRequestEntityTooLarge, apierror.CodePayloadTooLarge, "Settings too large", gin.H{"success": false, "size": len(body.Settings), "currentVersion": currentVersion})
+		return
+	}
+	apierror.RespondWith(c, http.StatusBadRequest, apierror.CodeInvalidRequest, "error", gin.H{"success": false})
+}
+
+// Export streams everything stored for the caller as one JSON document or,
+// with ?format=tar, as a tar archive of JSON files.
+func (h *AccountHandler) Export(c *gin.Context) {
+	ctx := c.Request.Context()
+	userID, ok := middleware.UserIDFromContext(c)
+	if !ok {
+		apierror.Respond(c, http.StatusUnauthorized, apierror.CodeUnauthorized, "Invalid authentication token")
+		return
+	}
+
+	format := store.ExportFormat(c.DefaultQuery("format", string(store.ExportJSON)))
+	var contentType string
+	switch format {
+	case store.ExportJSON:
+		contentType = "application/json"
+	case store.ExportTar:
+		contentType = "application/x-tar"
+	default:
+		apierror.Respond(c, http.StatusBadRequest, apierror.CodeInvalidRequest, "Invalid export format")
+		return
+	}
+
+	name := fmt.Sprintf("happy-export-%s.%s", clock.Now(h.Clock).UTC().Format("20060102-150405"), format)
+	c.Header("Content-Type", contentType)
+	c.Header("Content-Disposition", `attachment; filename="`+name+`"`)
+	c.Status(http.StatusOK)
+	if err := h.Store.ExportUser(ctx, userID, c.Writer, format); err != nil {
+		// Headers are already sent; a truncated export fails to parse.
+		log.Printf("account export: %v", err)
+	}
+}
+
+// deleteAccountChallengeMaxAge is how far the time in a deletion challenge
+// may be from now.
+const deleteAccountChallengeMaxAge = 5 * time.Minute
+
+type deleteAccountBody struct {
+	PublicKey string `json:"publicKey"`
+	Challenge string `json:"challenge"`
+	Signature string `json:"signature"`
+}
+
+// checkDeleteAccountChallenge reports whether challengeB64 decodes to
+// "delete-account:<userID>:<unix millis>" for userID and a time close to now,
+// so a signed confirmation cannot be replayed later or for another account.
+func checkDeleteAccountChallenge(challengeB64, userID string, now time.Time) bool {
+	raw, err := base64.StdEncoding.DecodeString(challengeB64)
+	if err != nil {
+		return false
+	}
+	rest, ok := strings.CutPrefix(string(raw), "delete-account:"+userID+":")
+	if !ok {
+		return false
+	}
+	at, err := strconv.ParseInt(rest, 10, 64)
+	if err != nil {
+		return false
+	}
+	age := now.Sub(time.UnixMilli(at))
+	return age <= deleteAccountChallengeMaxAge && age >= -deleteAccountChallengeMaxAge
+}
+
+// Delete removes the caller's account and everything stored for it, then
+// closes their connections. The caller confirms by signing the challenge
+// "delete-account:<userId>:<unix millis>" with the account's key.
+func (h *AccountHandler) Delete(c *gin.Context) {
+	ctx := c.Request.Context()
+	userID, ok := middleware.UserIDFromContext(c)
+	if !ok {
+		apierror.Respond(c, http.StatusUnauthorized, apierror.CodeUnauthorized, "Invalid authentication token")
+		return
+	}
+	var body deleteAccountBody
+	if err := c.ShouldBindJSON(&body); err != nil || body.PublicKey == "" {
+		apierror.Respond(c, http.StatusBadRequest, apierror.CodeInvalidRequest, "Invalid request")
+		return
+	}
+	if !checkDeleteAccountChallenge(body.Challenge, userID, clock.Now(h.Clock)) {
+		apierror.Respond(c, http.StatusBadRequest, apierror.CodeInvalidRequest, "Invalid challenge")
+		return
+	}
+	if err := auth.VerifySignatureDetailed(body.PublicKey, body.Challenge, body.Signature); err != nil {
+		apierror.Respond(c, http.StatusUnauthorized, apierror.CodeUnauthorized, err.Error())
+		return
+	}
+	if acc, ok := h.Store.GetAccount(ctx, body.PublicKey); !ok || acc.ID != userID {
+		apierror.Respond(c, http.StatusForbidden, apierror.CodeForbidden, "Public key does not belong to this account")
+		return
+	}
+
+	removed, ok := h.Store.DeleteAccount(ctx, body.PublicKey)
+	if !ok {
+		apierror.Respond(c, http.StatusNotFound, apierror.CodeNotFound, "Account not found")
+		return
+	}
+	if h.Revocations != nil {
+		h.Revocations.RevokeUser(userID, clock.Now(h.Clock))
+	}
+	disconnected := 0
+	if h.Sockets != nil {
+		disconnected += h.Sockets.DisconnectUser(userID, "Account deleted")
+	}
+	if h.Hub != nil {
+		disconnected += h.Hub.CloseUser(userID)
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true, "deleted": removed, "disconnected": disconnected})
 }
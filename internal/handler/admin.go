@@ -0,0 +1,458 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"happy-server-lite/internal/apierror"
+	"happy-server-lite/internal/auth"
+	"happy-server-lite/internal/authaudit"
+	"happy-server-lite/internal/clock"
+	"happy-server-lite/internal/debugtap"
+	"happy-server-lite/internal/hub"
+	"happy-server-lite/internal/middleware"
+	"happy-server-lite/internal/purge"
+	"happy-server-lite/internal/socketio"
+	"happy-server-lite/internal/store"
+)
+
+// AdminHandler serves operator endpoints under /v1/admin, which sit behind
+// middleware.RequireAdmin rather than user tokens.
+type AdminHandler struct {
+	Store       store.Storage
+	Tap         *debugtap.Tap
+	AuthAudit   *authaudit.Log
+	Sockets     *socketio.Server
+	Hub         *hub.Hub
+	Revocations *auth.Revocations
+	// TokenConfig signs the tokens handed to daemons by the rotate-token
+	// command.
+	TokenConfig auth.TokenConfig
+	// Purge is nil when the store cannot purge deleted records.
+	Purge *purge.Runner
+	// LoadShedder is nil when load shedding is off.
+	LoadShedder *middleware.LoadShedder
+	Clock       clock.Clock
+}
+
+// connectionSortKeys maps the ?sort= values of ListConnections to the
+// counter they order by, busiest first.
+var connectionSortKeys = map[string]func(socketio.ConnectionStats) int64{
+	"messagesIn":  func(s socketio.ConnectionStats) int64 { return s.MessagesIn },
+	"messagesOut": func(s socketio.ConnectionStats) int64 { return s.MessagesOut },
+	"bytesIn":     func(s socketio.ConnectionStats) int64 { return s.BytesIn },
+	"bytesOut":    func(s socketio.ConnectionStats) int64 { return s.BytesOut },
+}
+
+func (h *AdminHandler) ListConnections(c *gin.Context) {
+	conns := h.Sockets.AllConnections(c.Query("userId"))
+	if raw := c.Query("sort"); raw != "" {
+		key, ok := connectionSortKeys[raw]
+		if !ok {
+			apierror.Respond(c, http.StatusBadRequest, apierror.CodeInvalidRequest, "Invalid sort")
+			return
+		}
+		sort.SliceStable(conns, func(i, j int) bool { return key(*conns[i].Stats) > key(*conns[j].Stats) })
+	}
+	c.JSON(http.StatusOK, gin.H{"connections": conns})
+}
+
+// RoomMembers lists the connections an update for the :kind ("user",
+// "session" or "machine") room :id would reach.
+func (h *AdminHandler) RoomMembers(c *gin.Context) {
+	kind, id := c.Param("kind"), c.Param("id")
+	conns, ok := h.Sockets.RoomMembers(kind, id)
+	if !ok {
+		apierror.Respond(c, http.StatusBadRequest, apierror.CodeInvalidRequest, "Invalid room kind")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"kind": kind, "id": id, "connections": conns})
+}
+
+// metricsResponse adds the store's stats, when it keeps them, and the load
+// shedder's to the Socket.IO metrics.
+type metricsResponse struct {
+	socketio.Metrics
+	Store    *store.Stats              `json:"store,omitempty"`
+	LoadShed *middleware.LoadShedStats `json:"loadShed,omitempty"`
+}
+
+func (h *AdminHandler) Metrics(c *gin.Context) {
+	resp := metricsResponse{Metrics: h.Sockets.Metrics()}
+	if reporter, ok := h.Store.(store.StatsReporter); ok {
+		stats := reporter.Stats()
+		resp.Store = &stats
+	}
+	if h.LoadShedder != nil {
+		stats := h.LoadShedder.Stats()
+		resp.LoadShed = &stats
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// MetricsHistory serves the store's metrics history at ?resolution=
+// ("minute", the default, "hour" or "day"), from ?since= in Unix
+// milliseconds when given.
+func (h *AdminHandler) MetricsHistory(c *gin.Context) {
+	rec, ok := h.Store.(store.MetricsRecorder)
+	if !ok {
+		apierror.Respond(c, http.StatusNotImplemented, apierror.CodeInvalidRequest, "Metrics history is not supported by this store backend")
+		return
+	}
+	resolution := c.DefaultQuery("resolution", "minute")
+	var since int64
+	if raw := c.Query("since"); raw != "" {
+		var err error
+		if since, err = strconv.ParseInt(raw, 10, 64); err != nil {
+			apierror.Respond(c, http.StatusBadRequest, apierror.CodeInvalidRequest, "Invalid since")
+			return
+		}
+	}
+	points, err := rec.MetricsHistory(resolution, since)
+	if errors.Is(err, store.ErrUnknownMetricsResolution) {
+		apierror.Respond(c, http.StatusBadRequest, apierror.CodeInvalidRequest, "Invalid resolution")
+		return
+	}
+	if err != nil {
+		apierror.Respond(c, http.StatusInternalServerError, apierror.CodeInternal, "Metrics history failed")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"resolution": resolution, "points": points})
+}
+
+// Stats reports the store's record counts, memory use and persistence
+// health.
+func (h *AdminHandler) Stats(c *gin.Context) {
+	reporter, ok := h.Store.(store.StatsReporter)
+	if !ok {
+		apierror.Respond(c, http.StatusNotImplemented, apierror.CodeInvalidRequest, "Stats are not supported by this store backend")
+		return
+	}
+	c.JSON(http.StatusOK, reporter.Stats())
+}
+
+func (h *AdminHandler) ListDebugTaps(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"users": h.Tap.Users()})
+}
+
+func (h *AdminHandler) EnableDebugTap(c *gin.Context) {
+	h.Tap.Enable(c.Param("userId"))
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
+
+func (h *AdminHandler) DisableDebugTap(c *gin.Context) {
+	if !h.Tap.Disable(c.Param("userId")) {
+		apierror.Respond(c, http.StatusNotFound, apierror.CodeNotFound, "Debug tap not enabled")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
+
+func (h *AdminHandler) DebugTapEntries(c *gin.Context) {
+	userID := c.Param("userId")
+	entries, ok := h.Tap.Entries(userID)
+	if !ok {
+		apierror.Respond(c, http.StatusNotFound, apierror.CodeNotFound, "Debug tap not enabled")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"userId": userID, "entries": entries})
+}
+
+type forceLogoutBody struct {
+	Lock bool `json:"lock"`
+}
+
+// ForceLogout revokes every token issued to the user so far, their
+// refresh tokens, API keys and devices, closes their Socket.IO and /ws
+// connections and, with {"lock": true}, keeps them from signing in again
+// until the account is unlocked.
+func (h *AdminHandler) ForceLogout(c *gin.Context) {
+	ctx := c.Request.Context()
+	var body forceLogoutBody
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&body); err != nil {
+			apierror.Respond(c, http.StatusBadRequest, apierror.CodeInvalidRequest, "Invalid request")
+			return
+		}
+	}
+
+	userID := c.Param("userId")
+	h.Revocations.RevokeUser(userID, clock.Now(h.Clock))
+	refreshTokens := h.Store.DeleteRefreshTokens(ctx, userID)
+	apiKeys := h.Store.DeleteAPIKeys(ctx, userID)
+	devices := h.Store.DeleteDevices(ctx, userID)
+	if body.Lock {
+		h.Revocations.Lock(userID)
+	}
+	disconnected := h.Sockets.DisconnectUser(userID, "Logged out by administrator") + h.Hub.CloseUser(userID)
+	c.JSON(http.StatusOK, gin.H{
+		"success":       true,
+		"disconnected":  disconnected,
+		"refreshTokens": refreshTokens,
+		"apiKeys":       apiKeys,
+		"devices":       devices,
+		"locked":        h.Revocations.IsLocked(userID),
+	})
+}
+
+func (h *AdminHandler) UnlockUser(c *gin.Context) {
+	if !h.Revocations.Unlock(c.Param("userId")) {
+		apierror.Respond(c, http.StatusNotFound, apierror.CodeNotFound, "Account not locked")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
+
+// DisableAccount suspends the user until EnableAccount: their tokens stop
+// working everywhere and their open connections are closed.
+func (h *AdminHandler) DisableAccount(c *gin.Context) {
+	ctx := c.Request.Context()
+	userID := c.Param("userId")
+	h.Store.SetAccountDisabled(ctx, userID, true)
+	disconnected := h.Sockets.DisconnectUser(userID, "Account disabled") + h.Hub.CloseUser(userID)
+	c.JSON(http.StatusOK, gin.H{"success": true, "disconnected": disconnected})
+}
+
+func (h *AdminHandler) EnableAccount(c *gin.Context) {
+	ctx := c.Request.Context()
+	if !h.Store.SetAccountDisabled(ctx, c.Param("userId"), false) {
+		apierror.Respond(c, http.StatusNotFound, apierror.CodeNotFound, "Account not disabled")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
+
+// Backup streams a gzip-compressed snapshot of the whole store.
+func (h *AdminHandler) Backup(c *gin.Context) {
+	archiver, ok := h.Store.(store.Archiver)
+	if !ok {
+		apierror.Respond(c, http.StatusNotImplemented, apierror.CodeInvalidRequest, "Backups are not supported by this store backend")
+		return
+	}
+	name := fmt.Sprintf("happy-backup-%s.jsonl.gz", clock.Now(h.Clock).UTC().Format("20060102-150405"))
+	c.Header("Content-Type", "application/gzip")
+	c.Header("Content-Disposition", `attachment; filename="`+name+`"`)
+	c.Status(http.StatusOK)
+	if err := archiver.Export(c.Writer); err != nil {
+		// Headers are already sent; a truncated archive fails to decompress.
+		log.Printf("admin backup: %v", err)
+	}
+}
+
+// Restore loads a backup produced by Backup into an empty store.
+func (h *AdminHandler) Restore(c *gin.Context) {
+	archiver, ok := h.Store.(store.Archiver)
+	if !ok {
+		apierror.Respond(c, http.StatusNotImplemented, apierror.CodeInvalidRequest, "Backups are not supported by this store backend")
+		return
+	}
+	err := archiver.Import(c.Request.Body)
+	switch {
+	case errors.Is(err, store.ErrStoreNotEmpty):
+		apierror.Respond(c, http.StatusConflict, apierror.CodeConflict, "Store is not empty")
+	case errors.Is(err, store.ErrInvalidBackup):
+		apierror.Respond(c, http.StatusBadRequest, apierror.CodeInvalidRequest, "Invalid backup")
+	case err != nil:
+		log.Printf("admin restore: %v", err)
+		apierror.Respond(c, http.StatusInternalServerError, apierror.CodeInternal, "Restore failed")
+	default:
+		c.JSON(http.StatusOK, gin.H{"success": true})
+	}
+}
+
+// PurgeStats reports what the purge job has removed so far.
+func (h *AdminHandler) PurgeStats(c *gin.Context) {
+	if h.Purge == nil {
+		apierror.Respond(c, http.StatusNotImplemented, apierror.CodeInvalidRequest, "Purging is not supported by this store backend")
+		return
+	}
+	c.JSON(http.StatusOK, h.Purge.Stats())
+}
+
+// RunPurge purges deleted records now instead of waiting for the next run.
+func (h *AdminHandler) RunPurge(c *gin.Context) {
+	ctx := c.Request.Context()
+	if h.Purge == nil {
+		apierror.Respond(c, http.StatusNotImplemented, apierror.CodeInvalidRequest, "Purging is not supported by this store backend")
+		return
+	}
+	removed, err := h.Purge.RunOnce(ctx, clock.Now(h.Clock))
+	if err != nil {
+		log.Printf("admin purge: %v", err)
+		apierror.Respond(c, http.StatusInternalServerError, apierror.CodeInternal, "Purge failed")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"removed": removed})
+}
+
+// Memory reports how much memory the store spends on messages and what its
+// budget has evicted.
+func (h *AdminHandler) Memory(c *gin.Context) {
+	reporter, ok := h.Store.(store.MemoryReporter)
+	if !ok {
+		apierror.Respond(c, http.StatusNotImplemented, apierror.CodeInvalidRequest, "Memory stats are not supported by this store backend")
+		return
+	}
+	c.JSON(http.StatusOK, reporter.MemoryStats())
+}
+
+// defaultDrainWindow spreads a drain's disconnects when the request does not
+// give a window.
+const defaultDrainWindow = 30 * time.Second
+
+type drainBody struct {
+	URL           string `json:"url"`
+	WindowSeconds *int   `json:"windowSeconds"`
+}
+
+// Drain stops new Socket.IO connects and moves the open ones off this
+// instance, pointing them at {"url"} when one is given. Connections are
+// closed over {"windowSeconds"}, 30 by default.
+func (h *AdminHandler) Drain(c *gin.Context) {
+	var body drainBody
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&body); err != nil {
+			apierror.Respond(c, http.StatusBadRequest, apierror.CodeInvalidRequest, "Invalid request")
+			return
+		}
+	}
+	window := defaultDrainWindow
+	if body.WindowSeconds != nil {
+		if *body.WindowSeconds < 0 {
+			apierror.Respond(c, http.StatusBadRequest, apierror.CodeInvalidRequest, "Invalid window")
+			return
+		}
+		window = time.Duration(*body.WindowSeconds) * time.Second
+	}
+	status, ok := h.Sockets.Drain(body.URL, window)
+	if !ok {
+		apierror.Respond(c, http.StatusConflict, apierror.CodeConflict, "Drain already in progress")
+		return
+	}
+	c.JSON(http.StatusAccepted, status)
+}
+
+func (h *AdminHandler) DrainStatus(c *gin.Context) {
+	c.JSON(http.StatusOK, h.Sockets.DrainStatus())
+}
+
+// CancelDrain accepts connections again and leaves the remaining ones open.
+func (h *AdminHandler) CancelDrain(c *gin.Context) {
+	if !h.Sockets.CancelDrain() {
+		apierror.Respond(c, http.StatusNotFound, apierror.CodeNotFound, "No drain in progress")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
+
+// defaultCommandTimeout and maxCommandTimeout bound how long SendCommand
+// waits for daemons to ack.
+const (
+	defaultCommandTimeout = 10 * time.Second
+	maxCommandTimeout     = time.Minute
+)
+
+type machineCommandBody struct {
+	Command        string          `json:"command"`
+	Args           json.RawMessage `json:"args"`
+	TimeoutSeconds *int            `json:"timeoutSeconds"`
+}
+
+// SendCommand sends {"command"} ("re-sync", "rotate-token" or "shutdown")
+// with optional {"args"} to the daemon of the user's machine and answers
+// with each connection's ack, waiting up to {"timeoutSeconds"}, 10 by
+// default. rotate-token carries a new machine-scoped token in args.token;
+// once a daemon acks it, the machine's earlier scoped tokens are revoked.
+func (h *AdminHandler) SendCommand(c *gin.Context) {
+	ctx := c.Request.Context()
+	var body machineCommandBody
+	if err := c.ShouldBindJSON(&body); err != nil || !socketio.ValidMachineCommand(body.Command) {
+		apierror.Respond(c, http.StatusBadRequest, apierror.CodeInvalidRequest, "Invalid command")
+		return
+	}
+	timeout := defaultCommandTimeout
+	if body.TimeoutSeconds != nil {
+		timeout = time.Duration(*body.TimeoutSeconds) * time.Second
+		if timeout <= 0 || timeout > maxCommandTimeout {
+			apierror.Respond(c, http.StatusBadRequest, apierror.CodeInvalidRequest, "Invalid timeout")
+			return
+		}
+	}
+
+	userID, machineID := c.Param("userId"), c.Param("machineId")
+	if _, ok := h.Store.GetMachine(ctx, userID, machineID); !ok {
+		apierror.Respond(c, http.StatusNotFound, apierror.CodeNotFound, "Machine not found")
+		return
+	}
+	var args any = body.Args
+	if len(body.Args) == 0 {
+		args = gin.H{}
+	}
+	var rotated *auth.Claims
+	if body.Command == socketio.CommandRotateToken {
+		token, err := auth.CreateScopedToken(userID, auth.Scope{MachineID: machineID}, h.TokenConfig)
+		if err == nil {
+			rotated, err = auth.VerifyToken(ctx, token, h.TokenConfig)
+		}
+		if err != nil {
+			apierror.Respond(c, http.StatusInternalServerError, apierror.CodeInternal, "Token creation failed")
+			return
+		}
+		args = gin.H{"token": token}
+	}
+
+	result, ok := h.Sockets.SendMachineCommand(ctx, userID, machineID, body.Command, args, timeout)
+	if !ok {
+		apierror.Respond(c, http.StatusConflict, apierror.CodeConflict, "Machine offline")
+		return
+	}
+	// Revoked only once a daemon has the new token, so one that missed it
+	// can still connect with the old.
+	if rotated != nil && h.Revocations != nil && result.Acked() {
+		h.Revocations.RevokeMachine(userID, machineID, rotated.IssuedAt.Time, rotated.ID)
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+// ListCommands lists recently sent commands and their acks, filtered by
+// ?userId= and ?machineId=.
+func (h *AdminHandler) ListCommands(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"commands": h.Sockets.CommandLog(c.Query("userId"), c.Query("machineId"))})
+}
+
+// AuthLog lists recent sign-in attempts oldest first, filtered by ?event=,
+// ?outcome=, ?ip=, ?publicKey=, ?userId= and ?since= (unix ms); ?limit=
+// keeps only the newest.
+func (h *AdminHandler) AuthLog(c *gin.Context) {
+	filter := authaudit.Filter{
+		Event:     c.Query("event"),
+		Outcome:   c.Query("outcome"),
+		IP:        c.Query("ip"),
+		PublicKey: c.Query("publicKey"),
+		UserID:    c.Query("userId"),
+	}
+	if raw := c.Query("since"); raw != "" {
+		since, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			apierror.Respond(c, http.StatusBadRequest, apierror.CodeInvalidRequest, "Invalid since")
+			return
+		}
+		filter.Since = since
+	}
+	if raw := c.Query("limit"); raw != "" {
+		limit, err := strconv.Atoi(raw)
+		if err != nil || limit <= 0 {
+			apierror.Respond(c, http.StatusBadRequest, apierror.CodeInvalidRequest, "Invalid limit")
+			return
+		}
+		filter.Limit = limit
+	}
+	c.JSON(http.StatusOK, gin.H{"entries": h.AuthAudit.Entries(filter)})
+}
@@ -0,0 +1,94 @@
+package handler
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"happy-server-lite/internal/apierror"
+	"happy-server-lite/internal/auth"
+	"happy-server-lite/internal/clock"
+	"happy-server-lite/internal/middleware"
+	"happy-server-lite/internal/model"
+)
+
+const (
+	maxAPIKeyNameLength = 100
+	maxAPIKeysPerUser   = 50
+)
+
+type createAPIKeyBody struct {
+	Name string `json:"name"`
+}
+
+func apiKeyJSON(k model.APIKey) gin.H {
+	return gin.H{
+		"id":         k.ID,
+		"name":       k.Name,
+		"createdAt":  k.CreatedAt,
+		"lastUsedAt": k.LastUsedAt,
+	}
+}
+
+// CreateAPIKey issues a named key for automation, sent as
+// "Authorization: ApiKey <key>". The key is only returned here.
+func (h *AccountHandler) CreateAPIKey(c *gin.Context) {
+	ctx := c.Request.Context()
+	userID, ok := middleware.UserIDFromContext(c)
+	if !ok {
+		apierror.Respond(c, http.StatusUnauthorized, apierror.CodeUnauthorized, "Invalid authentication token")
+		return
+	}
+
+	var body createAPIKeyBody
+	if err := c.ShouldBindJSON(&body); err != nil {
+		apierror.Respond(c, http.StatusBadRequest, apierror.CodeInvalidRequest, "Invalid request")
+		return
+	}
+	name := strings.TrimSpace(body.Name)
+	if name == "" || len(name) > maxAPIKeyNameLength {
+		apierror.Respond(c, http.StatusBadRequest, apierror.CodeInvalidRequest, "Invalid name")
+		return
+	}
+	if len(h.Store.ListAPIKeys(ctx, userID)) >= maxAPIKeysPerUser {
+		apierror.Respond(c, http.StatusConflict, apierror.CodeConflict, "Too many API keys")
+		return
+	}
+
+	secret, hash, err := auth.NewAPIKeySecret()
+	if err != nil {
+		apierror.Respond(c, http.StatusInternalServerError, apierror.CodeInternal, "Key creation failed")
+		return
+	}
+	k := h.Store.CreateAPIKey(ctx, userID, name, hash, clock.Now(h.Clock).UnixMilli())
+	c.JSON(http.StatusOK, gin.H{"success": true, "apiKey": apiKeyJSON(k), "key": auth.FormatAPIKey(k.ID, secret)})
+}
+
+// ListAPIKeys lists the user's keys without their secrets.
+func (h *AccountHandler) ListAPIKeys(c *gin.Context) {
+	userID, ok := middleware.UserIDFromContext(c)
+	if !ok {
+		apierror.Respond(c, http.StatusUnauthorized, apierror.CodeUnauthorized, "Invalid authentication token")
+		return
+	}
+	keys := h.Store.ListAPIKeys(c.Request.Context(), userID)
+	out := make([]gin.H, 0, len(keys))
+	for _, k := range keys {
+		out = append(out, apiKeyJSON(k))
+	}
+	c.JSON(http.StatusOK, gin.H{"apiKeys": out})
+}
+
+// DeleteAPIKey revokes a key; requests bearing it fail from then on.
+func (h *AccountHandler) DeleteAPIKey(c *gin.Context) {
+	userID, ok := middleware.UserIDFromContext(c)
+	if !ok {
+		apierror.Respond(c, http.StatusUnauthorized, apierror.CodeUnauthorized, "Invalid authentication token")
+		return
+	}
+	if !h.Store.DeleteAPIKey(c.Request.Context(), userID, c.Param("id")) {
+		apierror.Respond(c, http.StatusNotFound, apierror.CodeNotFound, "API key not found")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
@@ -1,16 +1,20 @@
 package handler
 
 import (
+	"errors"
 	"net/http"
-	"time"
 
 	"github.com/gin-gonic/gin"
+	"happy-server-lite/internal/apierror"
+	"happy-server-lite/internal/clock"
 	"happy-server-lite/internal/middleware"
+	"happy-server-lite/internal/model"
 	"happy-server-lite/internal/store"
 )
 
 type ArtifactHandler struct {
-	Store *store.Store
+	Store store.Storage
+	Clock clock.Clock
 }
 
 type createArtifactBody struct {
@@ -18,6 +22,8 @@ type createArtifactBody struct {
 	Header           string `json:"header"`
 	Body             string `json:"body"`
 	DataEncryptionKey string `json:"dataEncryptionKey"`
+	HeaderChecksum    string `json:"headerChecksum"`
+	BodyChecksum      string `json:"bodyChecksum"`
 }
 
 type updateArtifactBody struct {
@@ -25,19 +31,33 @@ type updateArtifactBody struct {
 	ExpectedHeaderVersion *int    `json:"expectedHeaderVersion"`
 	Body                 *string `json:"body"`
 	ExpectedBodyVersion   *int    `json:"expectedBodyVersion"`
+	HeaderChecksum        string  `json:"headerChecksum"`
+	BodyChecksum          string  `json:"bodyChecksum"`
+}
+
+// withChecksums adds the stored ciphertext checksums to an artifact response.
+func withChecksums(resp gin.H, a model.Artifact) gin.H {
+	if a.HeaderChecksum != "" {
+		resp["headerChecksum"] = a.HeaderChecksum
+	}
+	if a.BodyChecksum != "" {
+		resp["bodyChecksum"] = a.BodyChecksum
+	}
+	return resp
 }
 
 func (h *ArtifactHandler) List(c *gin.Context) {
+	ctx := c.Request.Context()
 	userID, ok := middleware.UserIDFromContext(c)
 	if !ok {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid authentication token"})
+		apierror.Respond(c, http.StatusUnauthorized, apierror.CodeUnauthorized, "Invalid authentication token")
 		return
 	}
 
-	artifacts := h.Store.ListArtifacts(userID)
+	artifacts := h.Store.ListArtifacts(ctx, userID)
 	resp := make([]gin.H, 0, len(artifacts))
 	for _, a := range artifacts {
-		resp = append(resp, gin.H{
+		item := gin.H{
 			"id":               a.ID,
 			"header":           a.Header,
 			"headerVersion":    a.HeaderVersion,
@@ -45,32 +65,37 @@ func (h *ArtifactHandler) List(c *gin.Context) {
 			"seq":              a.Seq,
 			"createdAt":        a.CreatedAt,
 			"updatedAt":        a.UpdatedAt,
-		})
+		}
+		if a.HeaderChecksum != "" {
+			item["headerChecksum"] = a.HeaderChecksum
+		}
+		resp = append(resp, item)
 	}
 
 	c.JSON(http.StatusOK, resp)
 }
 
 func (h *ArtifactHandler) Get(c *gin.Context) {
+	ctx := c.Request.Context()
 	userID, ok := middleware.UserIDFromContext(c)
 	if !ok {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid authentication token"})
+		apierror.Respond(c, http.StatusUnauthorized, apierror.CodeUnauthorized, "Invalid authentication token")
 		return
 	}
 
 	artifactID := c.Param("id")
 	if artifactID == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid artifact id"})
+		apierror.Respond(c, http.StatusBadRequest, apierror.CodeInvalidRequest, "Invalid artifact id")
 		return
 	}
 
-	a, ok := h.Store.GetArtifact(userID, artifactID)
+	a, ok := h.Store.GetArtifact(ctx, userID, artifactID)
 	if !ok {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Artifact not found"})
+		apierror.Respond(c, http.StatusNotFound, apierror.CodeNotFound, "Artifact not found")
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{
+	c.JSON(http.StatusOK, withChecksums(gin.H{
 		"id":               a.ID,
 		"header":           a.Header,
 		"headerVersion":    a.HeaderVersion,
@@ -80,34 +105,36 @@ func (h *ArtifactHandler) Get(c *gin.Context) {
 		"seq":              a.Seq,
 		"createdAt":        a.CreatedAt,
 		"updatedAt":        a.UpdatedAt,
-	})
+	}, a))
 }
 
 func (h *ArtifactHandler) Create(c *gin.Context) {
+	ctx := c.Request.Context()
 	userID, ok := middleware.UserIDFromContext(c)
 	if !ok {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid authentication token"})
+		apierror.Respond(c, http.StatusUnauthorized, apierror.CodeUnauthorized, "Invalid authentication token")
 		return
 	}
 
 	var body createArtifactBody
 	if err := c.ShouldBindJSON(&body); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		apierror.Respond(c, http.StatusBadRequest, apierror.CodeInvalidRequest, "Invalid request")
 		return
 	}
 
-	now := time.Now().UnixMilli()
-	a, created, err := h.Store.CreateArtifact(userID, body.ID, body.Header, body.Body, body.DataEncryptionKey, now)
+	now := clock.Now(h.Clock).UnixMilli()
+	sums := store.ArtifactChecksums{Header: body.HeaderChecksum, Body: body.BodyChecksum}
+	a, created, err := h.Store.CreateArtifactWithChecksums(ctx, userID, body.ID, body.Header, body.Body, body.DataEncryptionKey, sums, now)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		apierror.Respond(c, http.StatusBadRequest, apierror.CodeInvalidRequest, err.Error())
 		return
 	}
 	if !created {
-		c.JSON(http.StatusConflict, gin.H{"error": "Artifact already exists"})
+		apierror.Respond(c, http.StatusConflict, apierror.CodeConflict, "Artifact already exists")
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{
+	c.JSON(http.StatusOK, withChecksums(gin.H{
 		"id":               a.ID,
 		"header":           a.Header,
 		"headerVersion":    a.HeaderVersion,
@@ -117,32 +144,38 @@ func (h *ArtifactHandler) Create(c *gin.Context) {
 		"seq":              a.Seq,
 		"createdAt":        a.CreatedAt,
 		"updatedAt":        a.UpdatedAt,
-	})
+	}, a))
 }
 
 func (h *ArtifactHandler) Update(c *gin.Context) {
+	ctx := c.Request.Context()
 	userID, ok := middleware.UserIDFromContext(c)
 	if !ok {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid authentication token"})
+		apierror.Respond(c, http.StatusUnauthorized, apierror.CodeUnauthorized, "Invalid authentication token")
 		return
 	}
 
 	artifactID := c.Param("id")
 	if artifactID == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid artifact id"})
+		apierror.Respond(c, http.StatusBadRequest, apierror.CodeInvalidRequest, "Invalid artifact id")
 		return
 	}
 
 	var body updateArtifactBody
 	if err := c.ShouldBindJSON(&body); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		apierror.Respond(c, http.StatusBadRequest, apierror.CodeInvalidRequest, "Invalid request")
 		return
 	}
 
-	now := time.Now().UnixMilli()
-	res, err := h.Store.UpdateArtifact(userID, artifactID, body.Header, body.ExpectedHeaderVersion, body.Body, body.ExpectedBodyVersion, now)
+	now := clock.Now(h.Clock).UnixMilli()
+	sums := store.ArtifactChecksums{Header: body.HeaderChecksum, Body: body.BodyChecksum}
+	res, err := h.Store.UpdateArtifactWithChecksums(ctx, userID, artifactID, body.Header, body.ExpectedHeaderVersion, body.Body, body.ExpectedBodyVersion, sums, now)
+	if errors.Is(err, store.ErrChecksumMismatch) {
+		apierror.Respond(c, http.StatusBadRequest, apierror.CodeInvalidRequest, "Checksum mismatch")
+		return
+	}
 	if err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Artifact not found"})
+		apierror.Respond(c, http.StatusNotFound, apierror.CodeNotFound, "Artifact not found")
 		return
 	}
 	if res.Success {
@@ -157,7 +190,7 @@ func (h *ArtifactHandler) Update(c *gin.Context) {
 		return
 	}
 
-	resp := gin.H{"success": false, "error": "version-mismatch"}
+	resp := gin.H{}
 	if res.CurrentHeaderVersion != nil {
 		resp["currentHeaderVersion"] = *res.CurrentHeaderVersion
 	}
@@ -170,24 +203,25 @@ func (h *ArtifactHandler) Update(c *gin.Context) {
 	if res.CurrentBody != nil {
 		resp["currentBody"] = *res.CurrentBody
 	}
-	c.JSON(http.StatusOK, resp)
+	apierror.VersionMismatch(c, resp)
 }
 
 func (h *ArtifactHandler) Delete(c *gin.Context) {
+	ctx := c.Request.Context()
 	userID, ok := middleware.UserIDFromContext(c)
 	if !ok {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid authentication token"})
+		apierror.Respond(c, http.StatusUnauthorized, apierror.CodeUnauthorized, "Invalid authentication token")
 		return
 	}
 
 	artifactID := c.Param("id")
 	if artifactID == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid artifact id"})
+		apierror.Respond(c, http.StatusBadRequest, apierror.CodeInvalidRequest, "Invalid artifact id")
 		return
 	}
 
-	if !h.Store.DeleteArtifact(userID, artifactID) {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Artifact not found"})
+	if !h.Store.DeleteArtifact(ctx, userID, artifactID) {
+		apierror.Respond(c, http.StatusNotFound, apierror.CodeNotFound, "Artifact not found")
 		return
 	}
 	// client only checks response.ok
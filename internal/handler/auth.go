@@ -5,20 +5,73 @@ import (
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"happy-server-lite/internal/apierror"
 	"happy-server-lite/internal/auth"
+	"happy-server-lite/internal/authaudit"
+	"happy-server-lite/internal/clock"
 	"happy-server-lite/internal/middleware"
+	"happy-server-lite/internal/model"
 	"happy-server-lite/internal/store"
 )
 
 type AuthHandler struct {
-	Store              *store.Store
+	Store              store.Storage
 	TokenConfig        auth.TokenConfig
 	AuthRequestLimiter *middleware.RateLimiter
+	Clock              clock.Clock
+	// RefreshTokenExpiry is how long a refresh token stays valid unused;
+	// zero issues none and disables /v1/auth/refresh.
+	RefreshTokenExpiry time.Duration
+	// AllowClientChallenge lets /v1/auth accept a challenge the client
+	// picked, which can be replayed. Server challenges are single-use either
+	// way.
+	AllowClientChallenge bool
+	// Audit records sign-in attempts; nil records nothing.
+	Audit *authaudit.Log
+	// Lockout turns away /v1/auth from addresses after repeated bad
+	// signatures, and bad signatures for public keys that had many; nil
+	// never does.
+	Lockout *middleware.FailureLimiter
 }
 
+// authChallengeTTL is how long a challenge from /v1/auth/challenge can be
+// signed and sent back.
+const authChallengeTTL = 5 * time.Minute
+
 type authRequestBody struct {
-	PublicKey  string `json:"publicKey"`
-	SupportsV2 bool   `json:"supportsV2"`
+	PublicKey  string             `json:"publicKey"`
+	SupportsV2 bool               `json:"supportsV2"`
+	Device     *authRequestDevice `json:"device"`
+}
+
+// authRequestDevice is what a device asking for access says about itself.
+type authRequestDevice struct {
+	Platform   string `json:"platform"`
+	Hostname   string `json:"hostname"`
+	AppVersion string `json:"appVersion"`
+}
+
+// maxAuthRequestDeviceField caps each device field; they are only shown to
+// the user.
+const maxAuthRequestDeviceField = 256
+
+func (d *authRequestDevice) model() (*model.AuthRequestDevice, bool) {
+	if d == nil {
+		return nil, true
+	}
+	for _, v := range []string{d.Platform, d.Hostname, d.AppVersion} {
+		if len(v) > maxAuthRequestDeviceField {
+			return nil, false
+		}
+	}
+	if d.Platform == "" && d.Hostname == "" && d.AppVersion == "" {
+		return nil, true
+	}
+	return &model.AuthRequestDevice{Platform: d.Platform, Hostname: d.Hostname, AppVersion: d.AppVersion}, true
+}
+
+func authRequestDeviceJSON(d *model.AuthRequestDevice) gin.H {
+	return gin.H{"platform": d.Platform, "hostname": d.Hostname, "appVersion": d.AppVersion}
 }
 
 type authResponseBody struct {
@@ -30,59 +83,156 @@ type authBody struct {
 	PublicKey string `json:"publicKey"`
 	Challenge string `json:"challenge"`
 	Signature string `json:"signature"`
+	// Device labels the device the tokens are issued to.
+	Device *authRequestDevice `json:"device"`
 }
 
 func (h *AuthHandler) Auth(c *gin.Context) {
+	ctx := c.Request.Context()
+	attempt := authaudit.Entry{Event: authaudit.EventSignIn}
 	var body authBody
 	if err := c.ShouldBindJSON(&body); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		h.refuse(c, attempt, http.StatusBadRequest, apierror.CodeInvalidRequest, "Invalid request")
+		return
+	}
+	attempt.PublicKey = body.PublicKey
+	if h.addressLockedOut(c, attempt) {
 		return
 	}
 
 	if err := auth.VerifySignatureDetailed(body.PublicKey, body.Challenge, body.Signature); err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		h.signInFailed(c, attempt, http.StatusUnauthorized, err.Error())
+		return
+	}
+	device, ok := body.Device.model()
+	if !ok {
+		h.refuse(c, attempt, http.StatusBadRequest, apierror.CodeInvalidRequest, "Invalid device")
 		return
 	}
 
-	now := time.Now().UnixMilli()
-	account, _ := h.Store.GetOrCreateAccount(body.PublicKey, now)
-	token, err := auth.CreateToken(account.ID, h.TokenConfig)
+	now := clock.Now(h.Clock).UnixMilli()
+	// The signature is checked first so that a forged one cannot use up
+	// someone else's challenge.
+	if !h.Store.UseAuthChallenge(ctx, body.Challenge, now) && !h.AllowClientChallenge {
+		h.signInFailed(c, attempt, http.StatusUnauthorized, "Invalid challenge")
+		return
+	}
+	account, _ := h.Store.GetOrCreateAccount(ctx, body.PublicKey, now)
+	attempt.UserID = account.ID
+	if h.Store.IsAccountDisabled(ctx, account.ID) {
+		h.refuse(c, attempt, http.StatusForbidden, apierror.CodeForbidden, "Account disabled")
+		return
+	}
+	if h.TokenConfig.Revocations != nil && h.TokenConfig.Revocations.IsLocked(account.ID) {
+		h.refuse(c, attempt, http.StatusForbidden, apierror.CodeForbidden, "Account locked")
+		return
+	}
+	deviceID := h.Store.CreateDevice(ctx, account.ID, device, c.ClientIP(), h.deviceExpiry(now), now).ID
+	token, err := auth.CreateDeviceToken(account.ID, deviceID, h.TokenConfig)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Token creation failed"})
+		h.refuse(c, attempt, http.StatusInternalServerError, apierror.CodeInternal, "Token creation failed")
 		return
 	}
+	refreshToken, err := h.issueRefreshToken(ctx, account.ID, deviceID, device, now)
+	if err != nil {
+		h.refuse(c, attempt, http.StatusInternalServerError, apierror.CodeInternal, "Token creation failed")
+		return
+	}
+
+	attempt.DeviceID = deviceID
+	h.audit(c, attempt)
+	h.signedIn(body.PublicKey)
+
+	resp := gin.H{"success": true, "token": token}
+	if refreshToken != "" {
+		resp["refreshToken"] = refreshToken
+	}
+	c.JSON(http.StatusOK, resp)
+}
 
-	c.JSON(http.StatusOK, gin.H{"success": true, "token": token})
+// Challenge issues a single-use nonce to sign for /v1/auth, so a captured
+// challenge and signature cannot be replayed.
+func (h *AuthHandler) Challenge(c *gin.Context) {
+	challenge, err := auth.NewChallenge()
+	if err != nil {
+		apierror.Respond(c, http.StatusInternalServerError, apierror.CodeInternal, "Challenge creation failed")
+		return
+	}
+	expiresAt := clock.Now(h.Clock).Add(authChallengeTTL).UnixMilli()
+	h.Store.IssueAuthChallenge(c.Request.Context(), challenge, expiresAt)
+	c.JSON(http.StatusOK, gin.H{"challenge": challenge, "expiresAt": expiresAt})
 }
 
 func (h *AuthHandler) Request(c *gin.Context) {
+	ctx := c.Request.Context()
+	attempt := authaudit.Entry{Event: authaudit.EventRequest}
 	var body authRequestBody
 	if err := c.ShouldBindJSON(&body); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		h.refuse(c, attempt, http.StatusBadRequest, apierror.CodeInvalidRequest, "Invalid request")
 		return
 	}
+	attempt.PublicKey = body.PublicKey
 	if body.PublicKey == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid public key"})
+		h.refuse(c, attempt, http.StatusBadRequest, apierror.CodeInvalidRequest, "Invalid public key")
+		return
+	}
+	device, ok := body.Device.model()
+	if !ok {
+		h.refuse(c, attempt, http.StatusBadRequest, apierror.CodeInvalidRequest, "Invalid device")
 		return
 	}
 
 	// Polling should not be rate-limited; only creation is.
-	if _, ok := h.Store.GetAuthRequest(body.PublicKey); !ok {
+	_, exists := h.Store.GetAuthRequest(ctx, body.PublicKey)
+	if !exists {
 		if h.AuthRequestLimiter != nil && !h.AuthRequestLimiter.Allow(c.ClientIP()) {
-			c.JSON(http.StatusTooManyRequests, gin.H{"error": "Rate limit exceeded"})
+			h.refuse(c, attempt, http.StatusTooManyRequests, apierror.CodeRateLimited, "Rate limit exceeded")
 			return
 		}
 	}
 
-	now := time.Now().UnixMilli()
-	req := h.Store.UpsertAuthRequest(body.PublicKey, body.SupportsV2, now)
+	now := clock.Now(h.Clock).UnixMilli()
+	req := h.Store.UpsertAuthRequest(ctx, body.PublicKey, body.SupportsV2, device, now)
+	// Polls are not recorded; only the request that opens a pairing is.
+	if !exists {
+		h.audit(c, attempt)
+	}
 
 	if req.Token != "" {
-		c.JSON(http.StatusOK, gin.H{
+		attempt = authaudit.Entry{Event: authaudit.EventClaim, PublicKey: body.PublicKey, UserID: req.ResponseAccountID, DeviceID: auth.TokenDeviceID(req.Token)}
+		if h.Store.IsAccountDisabled(ctx, req.ResponseAccountID) {
+			h.refuse(c, attempt, http.StatusForbidden, apierror.CodeForbidden, "Account disabled")
+			return
+		}
+		// The token is handed out once; claiming removes the request, so
+		// a later poll starts a new one.
+		req, ok = h.Store.ClaimAuthRequest(ctx, body.PublicKey)
+		if !ok {
+			h.refuse(c, attempt, http.StatusConflict, apierror.CodeConflict, "Auth request already claimed")
+			return
+		}
+		resp := gin.H{
 			"state":      "authorized",
 			"token":      req.Token,
 			"response":   req.Response,
 			"supportsV2": req.SupportsV2,
+		}
+		refreshToken, err := h.issueRefreshToken(ctx, req.ResponseAccountID, auth.TokenDeviceID(req.Token), req.Device, now)
+		if err != nil {
+			h.refuse(c, attempt, http.StatusInternalServerError, apierror.CodeInternal, "Token creation failed")
+			return
+		}
+		if refreshToken != "" {
+			resp["refreshToken"] = refreshToken
+		}
+		h.audit(c, attempt)
+		c.JSON(http.StatusOK, resp)
+		return
+	}
+	if req.Rejected {
+		c.JSON(http.StatusOK, gin.H{
+			"state":      "rejected",
+			"supportsV2": req.SupportsV2,
 		})
 		return
 	}
@@ -94,57 +244,112 @@ func (h *AuthHandler) Request(c *gin.Context) {
 }
 
 func (h *AuthHandler) Response(c *gin.Context) {
+	ctx := c.Request.Context()
+	attempt := authaudit.Entry{Event: authaudit.EventApprove}
+	attempt.UserID, _ = middleware.UserIDFromContext(c)
 	var body authResponseBody
 	if err := c.ShouldBindJSON(&body); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		h.refuse(c, attempt, http.StatusBadRequest, apierror.CodeInvalidRequest, "Invalid request")
 		return
 	}
+	attempt.PublicKey = body.PublicKey
 	if body.PublicKey == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid public key"})
+		h.refuse(c, attempt, http.StatusBadRequest, apierror.CodeInvalidRequest, "Invalid public key")
 		return
 	}
 	if body.Response == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid response"})
+		h.refuse(c, attempt, http.StatusBadRequest, apierror.CodeInvalidRequest, "Invalid response")
 		return
 	}
 
 	userID, ok := middleware.UserIDFromContext(c)
 	if !ok {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid authentication token"})
+		h.refuse(c, attempt, http.StatusUnauthorized, apierror.CodeUnauthorized, "Invalid authentication token")
 		return
 	}
 
-	now := time.Now().UnixMilli()
-	token, err := auth.CreateToken(userID, h.TokenConfig)
+	req, ok := h.Store.GetAuthRequest(ctx, body.PublicKey)
+	if !ok {
+		h.refuse(c, attempt, http.StatusNotFound, apierror.CodeNotFound, "Request not found")
+		return
+	}
+	now := clock.Now(h.Clock).UnixMilli()
+	// The requesting device signs in with its first poll after this; its
+	// address is not known yet.
+	deviceID := h.Store.CreateDevice(ctx, userID, req.Device, "", h.deviceExpiry(now), now).ID
+	attempt.DeviceID = deviceID
+	token, err := auth.CreateDeviceToken(userID, deviceID, h.TokenConfig)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Token creation failed"})
+		h.Store.DeleteDevice(ctx, userID, deviceID)
+		h.refuse(c, attempt, http.StatusInternalServerError, apierror.CodeInternal, "Token creation failed")
 		return
 	}
 
-	_, authorized := h.Store.AuthorizeAuthRequest(body.PublicKey, body.Response, userID, token, now)
+	_, authorized := h.Store.AuthorizeAuthRequest(ctx, body.PublicKey, body.Response, userID, token, now)
 	if !authorized {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Request not found"})
+		h.Store.DeleteDevice(ctx, userID, deviceID)
+		h.refuse(c, attempt, http.StatusNotFound, apierror.CodeNotFound, "Request not found")
+		return
+	}
+
+	h.audit(c, attempt)
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
+
+// Reject declines a pending auth request so the requesting device stops
+// polling and can tell its user. Authorized requests cannot be rejected.
+func (h *AuthHandler) Reject(c *gin.Context) {
+	ctx := c.Request.Context()
+	attempt := authaudit.Entry{Event: authaudit.EventReject}
+	attempt.UserID, _ = middleware.UserIDFromContext(c)
+	var body struct {
+		PublicKey string `json:"publicKey"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		h.refuse(c, attempt, http.StatusBadRequest, apierror.CodeInvalidRequest, "Invalid request")
+		return
+	}
+	attempt.PublicKey = body.PublicKey
+	if body.PublicKey == "" {
+		h.refuse(c, attempt, http.StatusBadRequest, apierror.CodeInvalidRequest, "Invalid public key")
 		return
 	}
 
+	req, ok := h.Store.RejectAuthRequest(ctx, body.PublicKey, clock.Now(h.Clock).UnixMilli())
+	if !ok {
+		h.refuse(c, attempt, http.StatusNotFound, apierror.CodeNotFound, "Request not found")
+		return
+	}
+	if req.Token != "" {
+		h.refuse(c, attempt, http.StatusConflict, apierror.CodeConflict, "Request already authorized")
+		return
+	}
+
+	h.audit(c, attempt)
 	c.JSON(http.StatusOK, gin.H{"success": true})
 }
 
 func (h *AuthHandler) RequestStatus(c *gin.Context) {
+	ctx := c.Request.Context()
 	publicKey := c.Query("publicKey")
 	if publicKey == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid public key"})
+		apierror.Respond(c, http.StatusBadRequest, apierror.CodeInvalidRequest, "Invalid public key")
 		return
 	}
 
-	req, ok := h.Store.GetAuthRequest(publicKey)
+	req, ok := h.Store.GetAuthRequest(ctx, publicKey)
 	if !ok {
 		c.JSON(http.StatusOK, gin.H{"status": "not_found"})
 		return
 	}
-	if req.Token == "" {
-		c.JSON(http.StatusOK, gin.H{"status": "pending", "supportsV2": req.SupportsV2})
-		return
+	resp := gin.H{"status": "authorized", "supportsV2": req.SupportsV2}
+	if req.Rejected {
+		resp["status"] = "rejected"
+	} else if req.Token == "" {
+		resp["status"] = "pending"
+	}
+	if req.Device != nil {
+		resp["device"] = authRequestDeviceJSON(req.Device)
 	}
-	c.JSON(http.StatusOK, gin.H{"status": "authorized", "supportsV2": req.SupportsV2})
+	c.JSON(http.StatusOK, resp)
 }
@@ -0,0 +1,31 @@
+package handler
+
+import (
+	"github.com/gin-gonic/gin"
+	"happy-server-lite/internal/apierror"
+	"happy-server-lite/internal/authaudit"
+	"happy-server-lite/internal/clock"
+)
+
+// audit records an attempt on the sign-in endpoints, dated now and from the
+// request's address.
+func (h *AuthHandler) audit(c *gin.Context, e authaudit.Entry) {
+	if h.Audit == nil {
+		return
+	}
+	e.Time = clock.Now(h.Clock).UnixMilli()
+	e.IP = c.ClientIP()
+	if e.Outcome == "" {
+		e.Outcome = authaudit.OutcomeSuccess
+	}
+	h.Audit.Record(e)
+}
+
+// refuse answers an attempt with an error and records it as failed with the
+// error's message.
+func (h *AuthHandler) refuse(c *gin.Context, e authaudit.Entry, status int, code apierror.Code, msg string) {
+	e.Outcome = authaudit.OutcomeFailure
+	e.Reason = msg
+	h.audit(c, e)
+	apierror.Respond(c, status, code, msg)
+}
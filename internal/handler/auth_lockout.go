@@ -0,0 +1,71 @@
+package handler
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"happy-server-lite/internal/apierror"
+	"happy-server-lite/internal/authaudit"
+)
+
+func lockoutIPKey(c *gin.Context) string { return "ip:" + c.ClientIP() }
+
+func lockoutPublicKey(publicKey string) string { return "public-key:" + publicKey }
+
+// addressLockedOut refuses the attempt, before its signature is checked,
+// while its address is locked out. Public keys are not checked here: anyone
+// can send bad signatures for someone else's key, so a locked key only
+// turns away further bad signatures, never a valid one.
+func (h *AuthHandler) addressLockedOut(c *gin.Context, e authaudit.Entry) bool {
+	if h.Lockout == nil {
+		return false
+	}
+	left, ok := h.Lockout.Locked(lockoutIPKey(c))
+	if !ok {
+		return false
+	}
+	h.refuseLockedOut(c, e, left)
+	return true
+}
+
+// signInFailed counts a bad signature or challenge against the attempt's
+// address and public key, and refuses it: with 429 once either is locked
+// out, so guesses spread over many addresses are still slowed, and with
+// status otherwise.
+func (h *AuthHandler) signInFailed(c *gin.Context, e authaudit.Entry, status int, msg string) {
+	if h.Lockout != nil {
+		keys := []string{lockoutIPKey(c)}
+		if e.PublicKey != "" {
+			keys = append(keys, lockoutPublicKey(e.PublicKey))
+		}
+		var wait time.Duration
+		for _, key := range keys {
+			h.Lockout.Fail(key)
+			if left, ok := h.Lockout.Locked(key); ok {
+				wait = max(wait, left)
+			}
+		}
+		if wait > 0 {
+			h.refuseLockedOut(c, e, wait)
+			return
+		}
+	}
+	h.refuse(c, e, status, apierror.CodeUnauthorized, msg)
+}
+
+func (h *AuthHandler) refuseLockedOut(c *gin.Context, e authaudit.Entry, wait time.Duration) {
+	c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	h.refuse(c, e, http.StatusTooManyRequests, apierror.CodeRateLimited, "Too many failed sign-in attempts")
+}
+
+// signedIn forgets the public key's failures. The address's are kept, so
+// signing in with a key of one's own in between does not reset the count
+// of guesses at another's.
+func (h *AuthHandler) signedIn(publicKey string) {
+	if h.Lockout != nil {
+		h.Lockout.Succeed(lockoutPublicKey(publicKey))
+	}
+}
@@ -0,0 +1,74 @@
+package handler
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"happy-server-lite/internal/push"
+	"happy-server-lite/internal/store"
+)
+
+// authRequestPushTimeout bounds the push sent for a new auth request.
+const authRequestPushTimeout = 10 * time.Second
+
+// AuthRequestPusher notifies the devices of an existing account that a new
+// device asked to sign in with its key, so the request can be approved
+// without the app already open. It subscribes to store.EventAuthRequested.
+type AuthRequestPusher struct {
+	Store store.Storage
+	Push  push.Sender
+	// Templates words the notification in each device's locale; nil uses
+	// push.DefaultTemplates.
+	Templates *push.Templates
+	// Context bounds the lookups and pushes, which outlive the request
+	// that raised the event; cancel it on shutdown. Nil never cancels.
+	Context context.Context
+}
+
+// HandleStoreEvent pushes a "new device wants access" notification to the
+// devices registered by the account for the event's public key, if there is
+// one. Delivery runs in the background.
+func (p *AuthRequestPusher) HandleStoreEvent(ev store.Event) {
+	if ev.Type != store.EventAuthRequested {
+		return
+	}
+	ctx := p.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	account, ok := p.Store.GetAccount(ctx, ev.PublicKey)
+	if !ok {
+		return
+	}
+	tokens := p.Store.ListPushTokens(ctx, account.ID)
+	if len(tokens) == 0 {
+		return
+	}
+	templates := p.Templates
+	if templates == nil {
+		templates = push.DefaultTemplates()
+	}
+	data := map[string]any{"type": push.EventAuthRequest, "publicKey": ev.PublicKey}
+	notifications := make([]push.Notification, 0, len(tokens))
+	for _, pt := range tokens {
+		title, body, err := templates.Render(push.EventAuthRequest, pt.Locale, data)
+		if err != nil {
+			log.Printf("auth request push: %v", err)
+			continue
+		}
+		notifications = append(notifications, push.Notification{
+			To:    pt.Token,
+			Title: title,
+			Body:  body,
+			Data:  data,
+		})
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(ctx, authRequestPushTimeout)
+		defer cancel()
+		if err := p.Push.Send(ctx, notifications); err != nil {
+			log.Printf("auth request push: %v", err)
+		}
+	}()
+}
@@ -0,0 +1,149 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"happy-server-lite/internal/apierror"
+	"happy-server-lite/internal/auth"
+	"happy-server-lite/internal/authaudit"
+	"happy-server-lite/internal/clock"
+	"happy-server-lite/internal/middleware"
+	"happy-server-lite/internal/model"
+	"happy-server-lite/internal/store"
+)
+
+// issueRefreshToken grants device deviceID a refresh token for userID. It
+// returns "" when refresh tokens are disabled.
+func (h *AuthHandler) issueRefreshToken(ctx context.Context, userID, deviceID string, device *model.AuthRequestDevice, nowMillis int64) (string, error) {
+	if h.RefreshTokenExpiry <= 0 {
+		return "", nil
+	}
+	secret, hash, err := auth.NewRefreshSecret()
+	if err != nil {
+		return "", err
+	}
+	rt := h.Store.CreateRefreshToken(ctx, userID, deviceID, device, hash, nowMillis+h.RefreshTokenExpiry.Milliseconds(), nowMillis)
+	return auth.FormatRefreshToken(rt.ID, secret), nil
+}
+
+type refreshBody struct {
+	RefreshToken string `json:"refreshToken"`
+}
+
+// Refresh exchanges a refresh token for a new access token and the next
+// refresh token. Each refresh token works once; presenting one again
+// revokes the device's grant.
+func (h *AuthHandler) Refresh(c *gin.Context) {
+	ctx := c.Request.Context()
+	if h.RefreshTokenExpiry <= 0 {
+		apierror.Respond(c, http.StatusNotFound, apierror.CodeNotFound, "Refresh tokens are disabled")
+		return
+	}
+	attempt := authaudit.Entry{Event: authaudit.EventRefresh}
+	var body refreshBody
+	if err := c.ShouldBindJSON(&body); err != nil {
+		h.refuse(c, attempt, http.StatusBadRequest, apierror.CodeInvalidRequest, "Invalid request")
+		return
+	}
+	id, secret, ok := auth.ParseRefreshToken(body.RefreshToken)
+	if !ok {
+		h.refuse(c, attempt, http.StatusUnauthorized, apierror.CodeUnauthorized, "Invalid refresh token")
+		return
+	}
+	next, nextHash, err := auth.NewRefreshSecret()
+	if err != nil {
+		h.refuse(c, attempt, http.StatusInternalServerError, apierror.CodeInternal, "Token creation failed")
+		return
+	}
+
+	now := clock.Now(h.Clock).UnixMilli()
+	rt, err := h.Store.RotateRefreshToken(ctx, id, auth.HashRefreshSecret(secret), nextHash, now+h.RefreshTokenExpiry.Milliseconds(), now)
+	attempt.UserID, attempt.DeviceID = rt.UserID, rt.DeviceID
+	if errors.Is(err, store.ErrRefreshTokenReused) {
+		h.refuse(c, attempt, http.StatusUnauthorized, apierror.CodeUnauthorized, "Refresh token reused; sign in again")
+		return
+	}
+	if err != nil {
+		h.refuse(c, attempt, http.StatusUnauthorized, apierror.CodeUnauthorized, "Invalid refresh token")
+		return
+	}
+	if h.Store.IsAccountDisabled(ctx, rt.UserID) {
+		h.refuse(c, attempt, http.StatusForbidden, apierror.CodeForbidden, "Account disabled")
+		return
+	}
+	if h.TokenConfig.Revocations != nil && h.TokenConfig.Revocations.IsLocked(rt.UserID) {
+		h.refuse(c, attempt, http.StatusForbidden, apierror.CodeForbidden, "Account locked")
+		return
+	}
+	// Grants made before devices were tracked go on issuing plain tokens.
+	var token string
+	if rt.DeviceID == "" {
+		token, err = auth.CreateToken(rt.UserID, h.TokenConfig)
+	} else {
+		if !h.Store.RenewDevice(ctx, rt.UserID, rt.DeviceID, h.deviceExpiry(now), now) {
+			h.refuse(c, attempt, http.StatusUnauthorized, apierror.CodeUnauthorized, "Device signed out")
+			return
+		}
+		token, err = auth.CreateDeviceToken(rt.UserID, rt.DeviceID, h.TokenConfig)
+	}
+	if err != nil {
+		h.refuse(c, attempt, http.StatusInternalServerError, apierror.CodeInternal, "Token creation failed")
+		return
+	}
+
+	h.audit(c, attempt)
+	c.JSON(http.StatusOK, gin.H{
+		"success":      true,
+		"token":        token,
+		"refreshToken": auth.FormatRefreshToken(rt.ID, next),
+	})
+}
+
+func refreshTokenJSON(rt model.RefreshToken) gin.H {
+	out := gin.H{
+		"id":         rt.ID,
+		"createdAt":  rt.CreatedAt,
+		"lastUsedAt": rt.LastUsedAt,
+		"expiresAt":  rt.ExpiresAt,
+	}
+	if rt.Device != nil {
+		out["device"] = authRequestDeviceJSON(rt.Device)
+	}
+	return out
+}
+
+// ListRefreshTokens lists the devices holding a refresh token for the user.
+// Secrets are never returned.
+func (h *AuthHandler) ListRefreshTokens(c *gin.Context) {
+	ctx := c.Request.Context()
+	userID, ok := middleware.UserIDFromContext(c)
+	if !ok {
+		apierror.Respond(c, http.StatusUnauthorized, apierror.CodeUnauthorized, "Invalid authentication token")
+		return
+	}
+	tokens := h.Store.ListRefreshTokens(ctx, userID, clock.Now(h.Clock).UnixMilli())
+	out := make([]gin.H, 0, len(tokens))
+	for _, rt := range tokens {
+		out = append(out, refreshTokenJSON(rt))
+	}
+	c.JSON(http.StatusOK, gin.H{"refreshTokens": out})
+}
+
+// DeleteRefreshToken revokes one device's refresh token. Access tokens
+// already issued to it stay valid until they expire.
+func (h *AuthHandler) DeleteRefreshToken(c *gin.Context) {
+	ctx := c.Request.Context()
+	userID, ok := middleware.UserIDFromContext(c)
+	if !ok {
+		apierror.Respond(c, http.StatusUnauthorized, apierror.CodeUnauthorized, "Invalid authentication token")
+		return
+	}
+	if !h.Store.DeleteRefreshToken(ctx, userID, c.Param("id")) {
+		apierror.Respond(c, http.StatusNotFound, apierror.CodeNotFound, "Refresh token not found")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
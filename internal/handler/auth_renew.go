@@ -0,0 +1,43 @@
+package handler
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"happy-server-lite/internal/apierror"
+	"happy-server-lite/internal/auth"
+	"happy-server-lite/internal/authaudit"
+	"happy-server-lite/internal/clock"
+	"happy-server-lite/internal/middleware"
+)
+
+// Renew exchanges the caller's token, while it is still valid, for a fresh
+// one with the same user, scope and device, so a daemon that stays
+// connected can keep going past the token's expiry without signing in
+// again. A device token also extends its device.
+func (h *AuthHandler) Renew(c *gin.Context) {
+	ctx := c.Request.Context()
+	attempt := authaudit.Entry{Event: authaudit.EventRenew}
+	userID, ok := middleware.UserIDFromContext(c)
+	if !ok {
+		h.refuse(c, attempt, http.StatusUnauthorized, apierror.CodeUnauthorized, "Invalid authentication token")
+		return
+	}
+	deviceID := middleware.DeviceIDFromContext(c)
+	attempt.UserID, attempt.DeviceID = userID, deviceID
+
+	if deviceID != "" {
+		now := clock.Now(h.Clock).UnixMilli()
+		if !h.Store.RenewDevice(ctx, userID, deviceID, h.deviceExpiry(now), now) {
+			h.refuse(c, attempt, http.StatusUnauthorized, apierror.CodeUnauthorized, "Device signed out")
+			return
+		}
+	}
+	token, err := auth.RenewToken(userID, middleware.ScopeFromContext(c), deviceID, h.TokenConfig)
+	if err != nil {
+		h.refuse(c, attempt, http.StatusInternalServerError, apierror.CodeInternal, "Token creation failed")
+		return
+	}
+	h.audit(c, attempt)
+	c.JSON(http.StatusOK, gin.H{"success": true, "token": token})
+}
@@ -0,0 +1,58 @@
+package handler
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"happy-server-lite/internal/apierror"
+	"happy-server-lite/internal/auth"
+	"happy-server-lite/internal/authaudit"
+	"happy-server-lite/internal/middleware"
+)
+
+type scopedTokenBody struct {
+	SessionID string `json:"sessionId"`
+	MachineID string `json:"machineId"`
+}
+
+// ScopedToken issues a token confined to one of the caller's sessions or
+// machines, for handing to the daemon that runs it. Only account-wide tokens
+// reach this route, so a scoped token cannot mint another.
+func (h *AuthHandler) ScopedToken(c *gin.Context) {
+	ctx := c.Request.Context()
+	attempt := authaudit.Entry{Event: authaudit.EventScopedToken}
+	userID, ok := middleware.UserIDFromContext(c)
+	if !ok {
+		h.refuse(c, attempt, http.StatusUnauthorized, apierror.CodeUnauthorized, "Invalid authentication token")
+		return
+	}
+	attempt.UserID = userID
+
+	var body scopedTokenBody
+	if err := c.ShouldBindJSON(&body); err != nil {
+		h.refuse(c, attempt, http.StatusBadRequest, apierror.CodeInvalidRequest, "Invalid request")
+		return
+	}
+	scope := auth.Scope{SessionID: body.SessionID, MachineID: body.MachineID}
+	if (scope.SessionID == "") == (scope.MachineID == "") {
+		h.refuse(c, attempt, http.StatusBadRequest, apierror.CodeInvalidRequest, "Give exactly one of sessionId and machineId")
+		return
+	}
+	if scope.SessionID != "" {
+		if _, ok := h.Store.GetSession(ctx, userID, scope.SessionID); !ok {
+			h.refuse(c, attempt, http.StatusNotFound, apierror.CodeNotFound, "Session not found")
+			return
+		}
+	} else if _, ok := h.Store.GetMachine(ctx, userID, scope.MachineID); !ok {
+		h.refuse(c, attempt, http.StatusNotFound, apierror.CodeNotFound, "Machine not found")
+		return
+	}
+
+	token, err := auth.CreateScopedToken(userID, scope, h.TokenConfig)
+	if err != nil {
+		h.refuse(c, attempt, http.StatusInternalServerError, apierror.CodeInternal, "Token creation failed")
+		return
+	}
+	h.audit(c, attempt)
+	c.JSON(http.StatusOK, gin.H{"success": true, "token": token, "scope": scope})
+}
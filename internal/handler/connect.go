@@ -0,0 +1,134 @@
+package handler
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"happy-server-lite/internal/apierror"
+	"happy-server-lite/internal/auth"
+	"happy-server-lite/internal/clock"
+	"happy-server-lite/internal/github"
+	"happy-server-lite/internal/middleware"
+	"happy-server-lite/internal/model"
+	"happy-server-lite/internal/store"
+)
+
+const (
+	// githubStateAudience marks the state tokens of the GitHub flow, which
+	// carry the user across GitHub's redirect.
+	githubStateAudience = "github-connect"
+	githubStateTTL      = 10 * time.Minute
+)
+
+// ConnectHandler links accounts to third-party identities. GitHub is the
+// only one so far.
+type ConnectHandler struct {
+	Store       store.Storage
+	GitHub      *github.OAuth
+	TokenConfig auth.TokenConfig
+	// ReturnURL is where the browser is sent once the callback is done,
+	// with github=connected or github=error added to the query; empty
+	// answers the callback with JSON.
+	ReturnURL string
+	Clock     clock.Clock
+}
+
+// GitHubParams starts the flow: it returns the GitHub URL the app opens
+// for the user to approve the link.
+func (h *ConnectHandler) GitHubParams(c *gin.Context) {
+	userID, ok := middleware.UserIDFromContext(c)
+	if !ok {
+		apierror.Respond(c, http.StatusUnauthorized, apierror.CodeUnauthorized, "Invalid authentication token")
+		return
+	}
+	state, err := auth.CreateStateToken(userID, githubStateAudience, githubStateTTL, h.TokenConfig)
+	if err != nil {
+		apierror.Respond(c, http.StatusInternalServerError, apierror.CodeInternal, "Token creation failed")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"url": h.GitHub.AuthorizeURL(state)})
+}
+
+// GitHubCallback is where GitHub sends the browser back. The state names
+// the user who started the flow, as the browser carries no bearer token.
+func (h *ConnectHandler) GitHubCallback(c *gin.Context) {
+	ctx := c.Request.Context()
+	if reason := c.Query("error"); reason != "" {
+		h.githubDone(c, http.StatusBadRequest, apierror.CodeInvalidRequest, reason)
+		return
+	}
+	userID, err := auth.VerifyStateToken(ctx, c.Query("state"), githubStateAudience, h.TokenConfig)
+	if err != nil {
+		h.githubDone(c, http.StatusBadRequest, apierror.CodeInvalidRequest, "Invalid state")
+		return
+	}
+	user, err := h.GitHub.Exchange(ctx, c.Query("code"))
+	if err != nil {
+		log.Printf("github connect: %v", err)
+		h.githubDone(c, http.StatusBadGateway, apierror.CodeUnavailable, "GitHub rejected the code")
+		return
+	}
+	identity := model.GitHubIdentity{
+		ID:        user.ID,
+		Login:     user.Login,
+		Name:      user.Name,
+		AvatarURL: user.AvatarURL,
+		LinkedAt:  clock.Now(h.Clock).UnixMilli(),
+	}
+	if !h.Store.SetGitHubIdentity(ctx, userID, identity) {
+		h.githubDone(c, http.StatusInternalServerError, apierror.CodeInternal, "Could not save the connection")
+		return
+	}
+	if h.ReturnURL != "" {
+		c.Redirect(http.StatusFound, returnURL(h.ReturnURL, url.Values{"github": {"connected"}}))
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true, "github": githubProfile(identity)})
+}
+
+// DisconnectGitHub unlinks the account's GitHub user.
+func (h *ConnectHandler) DisconnectGitHub(c *gin.Context) {
+	userID, ok := middleware.UserIDFromContext(c)
+	if !ok {
+		apierror.Respond(c, http.StatusUnauthorized, apierror.CodeUnauthorized, "Invalid authentication token")
+		return
+	}
+	if !h.Store.DeleteGitHubIdentity(c.Request.Context(), userID) {
+		apierror.Respond(c, http.StatusNotFound, apierror.CodeNotFound, "GitHub is not connected")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
+
+// githubDone ends a failed callback, back at ReturnURL when there is one.
+func (h *ConnectHandler) githubDone(c *gin.Context, status int, code apierror.Code, msg string) {
+	if h.ReturnURL != "" {
+		c.Redirect(http.StatusFound, returnURL(h.ReturnURL, url.Values{"github": {"error"}, "reason": {msg}}))
+		return
+	}
+	apierror.Respond(c, status, code, msg)
+}
+
+func returnURL(base string, q url.Values) string {
+	sep := "?"
+	if strings.Contains(base, "?") {
+		sep = "&"
+	}
+	return base + sep + q.Encode()
+}
+
+// githubProfile is the account's GitHub user as the profile reports it,
+// in GitHub's own field names.
+func githubProfile(identity model.GitHubIdentity) gin.H {
+	return gin.H{
+		"id":         identity.ID,
+		"login":      identity.Login,
+		"name":       identity.Name,
+		"avatar_url": identity.AvatarURL,
+		"linkedAt":   identity.LinkedAt,
+	}
+}
@@ -0,0 +1,38 @@
+package handler
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"happy-server-lite/internal/apierror"
+	"happy-server-lite/internal/middleware"
+	"happy-server-lite/internal/socketio"
+)
+
+type ConnectionsHandler struct {
+	Sockets *socketio.Server
+}
+
+func (h *ConnectionsHandler) List(c *gin.Context) {
+	userID, ok := middleware.UserIDFromContext(c)
+	if !ok {
+		apierror.Respond(c, http.StatusUnauthorized, apierror.CodeUnauthorized, "Invalid authentication token")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"connections": h.Sockets.Connections(userID)})
+}
+
+func (h *ConnectionsHandler) Delete(c *gin.Context) {
+	userID, ok := middleware.UserIDFromContext(c)
+	if !ok {
+		apierror.Respond(c, http.StatusUnauthorized, apierror.CodeUnauthorized, "Invalid authentication token")
+		return
+	}
+
+	if !h.Sockets.Disconnect(userID, c.Param("id")) {
+		apierror.Respond(c, http.StatusNotFound, apierror.CodeNotFound, "Connection not found")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
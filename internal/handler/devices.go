@@ -0,0 +1,75 @@
+package handler
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"happy-server-lite/internal/apierror"
+	"happy-server-lite/internal/clock"
+	"happy-server-lite/internal/middleware"
+	"happy-server-lite/internal/model"
+)
+
+// deviceExpiry is when a device signing in or refreshing at nowMillis stops
+// being listed unless it refreshes again: once both its access token and its
+// refresh grant have run out.
+func (h *AuthHandler) deviceExpiry(nowMillis int64) int64 {
+	return nowMillis + max(h.TokenConfig.Expiry, h.RefreshTokenExpiry).Milliseconds()
+}
+
+func deviceJSON(d model.Device, current bool) gin.H {
+	out := gin.H{
+		"id":         d.ID,
+		"createdAt":  d.CreatedAt,
+		"lastSeenAt": d.LastSeenAt,
+		"expiresAt":  d.ExpiresAt,
+		"current":    current,
+	}
+	if d.LastSeenIP != "" {
+		out["lastSeenIp"] = d.LastSeenIP
+	}
+	if d.Device != nil {
+		out["device"] = authRequestDeviceJSON(d.Device)
+	}
+	return out
+}
+
+// ListDevices lists the devices signed in to the account, marking the one
+// making the request.
+func (h *AccountHandler) ListDevices(c *gin.Context) {
+	userID, ok := middleware.UserIDFromContext(c)
+	if !ok {
+		apierror.Respond(c, http.StatusUnauthorized, apierror.CodeUnauthorized, "Invalid authentication token")
+		return
+	}
+	current := middleware.DeviceIDFromContext(c)
+	devices := h.Store.ListDevices(c.Request.Context(), userID, clock.Now(h.Clock).UnixMilli())
+	out := make([]gin.H, 0, len(devices))
+	for _, d := range devices {
+		out = append(out, deviceJSON(d, d.ID == current))
+	}
+	c.JSON(http.StatusOK, gin.H{"devices": out})
+}
+
+// DeleteDevice signs a device out: its access and refresh tokens stop
+// working and its live connections are closed.
+func (h *AccountHandler) DeleteDevice(c *gin.Context) {
+	userID, ok := middleware.UserIDFromContext(c)
+	if !ok {
+		apierror.Respond(c, http.StatusUnauthorized, apierror.CodeUnauthorized, "Invalid authentication token")
+		return
+	}
+	id := c.Param("id")
+	if !h.Store.DeleteDevice(c.Request.Context(), userID, id) {
+		apierror.Respond(c, http.StatusNotFound, apierror.CodeNotFound, "Device not found")
+		return
+	}
+	disconnected := 0
+	if h.Sockets != nil {
+		disconnected += h.Sockets.DisconnectDevice(userID, id, "Device signed out")
+	}
+	if h.Hub != nil {
+		disconnected += h.Hub.CloseDevice(userID, id)
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true, "disconnected": disconnected})
+}
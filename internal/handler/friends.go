@@ -4,6 +4,7 @@ import (
 	"net/http"
 
 	"github.com/gin-gonic/gin"
+	"happy-server-lite/internal/apierror"
 )
 
 type FriendsHandler struct{}
@@ -19,7 +20,7 @@ func (h *FriendsHandler) Add(c *gin.Context) {
 	}
 	_ = c.ShouldBindJSON(&body)
 	if body.UID == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		apierror.Respond(c, http.StatusBadRequest, apierror.CodeInvalidRequest, "Invalid request")
 		return
 	}
 	c.JSON(http.StatusOK, gin.H{"user": dummyUserProfile(body.UID, "requested")})
@@ -31,7 +32,7 @@ func (h *FriendsHandler) Remove(c *gin.Context) {
 	}
 	_ = c.ShouldBindJSON(&body)
 	if body.UID == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		apierror.Respond(c, http.StatusBadRequest, apierror.CodeInvalidRequest, "Invalid request")
 		return
 	}
 	c.JSON(http.StatusOK, gin.H{"user": dummyUserProfile(body.UID, "none")})
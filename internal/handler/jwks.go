@@ -0,0 +1,19 @@
+package handler
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"happy-server-lite/internal/auth"
+)
+
+// JWKSHandler publishes the public keys that verify tokens so other services
+// can check them without MASTER_SECRET.
+type JWKSHandler struct {
+	TokenConfig auth.TokenConfig
+}
+
+func (h *JWKSHandler) Keys(c *gin.Context) {
+	c.Header("Cache-Control", "public, max-age=300")
+	c.JSON(http.StatusOK, gin.H{"keys": h.TokenConfig.JWKS()})
+}
@@ -1,16 +1,21 @@
 package handler
 
 import (
+	"errors"
 	"net/http"
-	"time"
 
 	"github.com/gin-gonic/gin"
+	"happy-server-lite/internal/apierror"
+	"happy-server-lite/internal/auth"
+	"happy-server-lite/internal/clock"
 	"happy-server-lite/internal/middleware"
+	"happy-server-lite/internal/model"
 	"happy-server-lite/internal/store"
 )
 
 type MachineHandler struct {
-	Store *store.Store
+	Store store.Storage
+	Clock clock.Clock
 }
 
 type upsertMachineBody struct {
@@ -22,15 +27,16 @@ type upsertMachineBody struct {
 }
 
 func (h *MachineHandler) Upsert(c *gin.Context) {
+	ctx := c.Request.Context()
 	userID, ok := middleware.UserIDFromContext(c)
 	if !ok {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid authentication token"})
+		apierror.Respond(c, http.StatusUnauthorized, apierror.CodeUnauthorized, "Invalid authentication token")
 		return
 	}
 
 	var body upsertMachineBody
 	if err := c.ShouldBindJSON(&body); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		apierror.Respond(c, http.StatusBadRequest, apierror.CodeInvalidRequest, "Invalid request")
 		return
 	}
 
@@ -38,52 +44,73 @@ func (h *MachineHandler) Upsert(c *gin.Context) {
 	if machineID == "" {
 		machineID = body.Tag
 	}
+	if scope := middleware.ScopeFromContext(c); !scope.IsZero() && machineID != scope.MachineID {
+		apierror.Respond(c, http.StatusForbidden, apierror.CodeForbidden, "Token is scoped to another resource")
+		return
+	}
+	if certID, ok := auth.MachineCertFromContext(ctx); ok && machineID != certID {
+		apierror.Respond(c, http.StatusForbidden, apierror.CodeForbidden, "Client certificate is for another machine")
+		return
+	}
 
-	now := time.Now().UnixMilli()
-	m, _, err := h.Store.UpsertMachine(userID, machineID, body.Metadata, body.DaemonState, body.DataEncryptionKey, now)
+	now := clock.Now(h.Clock).UnixMilli()
+	m, _, err := h.Store.UpsertMachine(ctx, userID, machineID, body.Metadata, body.DaemonState, body.DataEncryptionKey, now)
+	if errors.Is(err, store.ErrTooLarge) {
+		apierror.Respond(c, http.StatusRequestEntityTooLarge, apierror.CodePayloadTooLarge, err.Error())
+		return
+	}
 	if err != nil {
-		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		apierror.Respond(c, http.StatusForbidden, apierror.CodeForbidden, err.Error())
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"machine": gin.H{
-		"id":                 m.ID,
-		"createdAt":          m.CreatedAt,
-		"updatedAt":          m.UpdatedAt,
-		"seq":                0,
-		"active":             false,
-		"activeAt":           0,
-		"metadata":           m.Metadata,
-		"metadataVersion":    m.MetadataVersion,
-		"daemonState":        m.DaemonState,
-		"daemonStateVersion": m.DaemonStateVersion,
-		"dataEncryptionKey":  m.DataEncryptionKey,
-	}})
+	c.JSON(http.StatusOK, gin.H{"machine": machineJSON(m)})
 }
 
 func (h *MachineHandler) List(c *gin.Context) {
+	ctx := c.Request.Context()
 	userID, ok := middleware.UserIDFromContext(c)
 	if !ok {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid authentication token"})
+		apierror.Respond(c, http.StatusUnauthorized, apierror.CodeUnauthorized, "Invalid authentication token")
 		return
 	}
 
-	machines := h.Store.ListMachines(userID)
+	machines := h.Store.ListMachines(ctx, userID)
 	resp := make([]gin.H, 0, len(machines))
 	for _, m := range machines {
-		resp = append(resp, gin.H{
-			"id":                 m.ID,
-			"createdAt":          m.CreatedAt,
-			"updatedAt":          m.UpdatedAt,
-			"seq":                0,
-			"active":             false,
-			"activeAt":           0,
-			"metadata":           m.Metadata,
-			"metadataVersion":    m.MetadataVersion,
-			"daemonState":        m.DaemonState,
-			"daemonStateVersion": m.DaemonStateVersion,
-			"dataEncryptionKey":  m.DataEncryptionKey,
-		})
+		resp = append(resp, machineJSON(m))
 	}
 	c.JSON(http.StatusOK, resp)
 }
+
+func (h *MachineHandler) Delete(c *gin.Context) {
+	ctx := c.Request.Context()
+	userID, ok := middleware.UserIDFromContext(c)
+	if !ok {
+		apierror.Respond(c, http.StatusUnauthorized, apierror.CodeUnauthorized, "Invalid authentication token")
+		return
+	}
+
+	machineID := c.Param("id")
+	if !h.Store.DeleteMachine(ctx, userID, machineID, clock.Now(h.Clock).UnixMilli()) {
+		apierror.Respond(c, http.StatusNotFound, apierror.CodeNotFound, "Machine not found")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
+
+func machineJSON(m model.Machine) gin.H {
+	return gin.H{
+		"id":                 m.ID,
+		"createdAt":          m.CreatedAt,
+		"updatedAt":          m.UpdatedAt,
+		"seq":                0,
+		"active":             false,
+		"activeAt":           0,
+		"metadata":           m.Metadata,
+		"metadataVersion":    m.MetadataVersion,
+		"daemonState":        m.DaemonState,
+		"daemonStateVersion": m.DaemonStateVersion,
+		"dataEncryptionKey":  m.DataEncryptionKey,
+	}
+}
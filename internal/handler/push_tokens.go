@@ -2,24 +2,95 @@ package handler
 
 import (
 	"net/http"
+	"strings"
 
 	"github.com/gin-gonic/gin"
+	"happy-server-lite/internal/apierror"
+	"happy-server-lite/internal/clock"
+	"happy-server-lite/internal/middleware"
+	"happy-server-lite/internal/model"
+	"happy-server-lite/internal/store"
 )
 
-type PushTokensHandler struct{}
+type PushTokensHandler struct {
+	Store store.Storage
+	Clock clock.Clock
+}
+
+// maxPushLocaleLength bounds the locale a device registers, which is a
+// language tag such as "en" or "zh-Hant-TW".
+const maxPushLocaleLength = 35
+
+func pushTokenJSON(pt model.PushToken) gin.H {
+	out := gin.H{"token": pt.Token, "createdAt": pt.CreatedAt, "updatedAt": pt.UpdatedAt}
+	if pt.Locale != "" {
+		out["locale"] = pt.Locale
+	}
+	return out
+}
+
+// validPushLocale accepts an empty locale or a language tag of letters and
+// digits joined by "-" or "_".
+func validPushLocale(locale string) bool {
+	if len(locale) > maxPushLocaleLength || strings.HasPrefix(locale, "-") || strings.HasPrefix(locale, "_") {
+		return false
+	}
+	for _, r := range locale {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+			return false
+		}
+	}
+	return true
+}
 
 func (h *PushTokensHandler) List(c *gin.Context) {
-	c.JSON(http.StatusOK, gin.H{"tokens": []any{}})
+	ctx := c.Request.Context()
+	userID, ok := middleware.UserIDFromContext(c)
+	if !ok {
+		apierror.Respond(c, http.StatusUnauthorized, apierror.CodeUnauthorized, "Invalid authentication token")
+		return
+	}
+	tokens := h.Store.ListPushTokens(ctx, userID)
+	out := make([]gin.H, 0, len(tokens))
+	for _, pt := range tokens {
+		out = append(out, pushTokenJSON(pt))
+	}
+	c.JSON(http.StatusOK, gin.H{"tokens": out})
 }
 
 func (h *PushTokensHandler) Register(c *gin.Context) {
-	// Minimal compatibility: accept and acknowledge; persistence not required for happy-server-lite.
+	ctx := c.Request.Context()
+	userID, ok := middleware.UserIDFromContext(c)
+	if !ok {
+		apierror.Respond(c, http.StatusUnauthorized, apierror.CodeUnauthorized, "Invalid authentication token")
+		return
+	}
 	var body struct {
-		Token string `json:"token"`
+		Token  string `json:"token"`
+		Locale string `json:"locale"`
 	}
 	_ = c.ShouldBindJSON(&body)
 	if body.Token == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"success": false})
+		apierror.RespondWith(c, http.StatusBadRequest, apierror.CodeInvalidRequest, "Invalid token", gin.H{"success": false})
+		return
+	}
+	if !validPushLocale(body.Locale) {
+		apierror.RespondWith(c, http.StatusBadRequest, apierror.CodeInvalidRequest, "Invalid locale", gin.H{"success": false})
+		return
+	}
+	h.Store.AddPushToken(ctx, userID, body.Token, body.Locale, clock.Now(h.Clock).UnixMilli())
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
+
+func (h *PushTokensHandler) Delete(c *gin.Context) {
+	ctx := c.Request.Context()
+	userID, ok := middleware.UserIDFromContext(c)
+	if !ok {
+		apierror.Respond(c, http.StatusUnauthorized, apierror.CodeUnauthorized, "Invalid authentication token")
+		return
+	}
+	if !h.Store.DeletePushToken(ctx, userID, c.Param("token")) {
+		apierror.Respond(c, http.StatusNotFound, apierror.CodeNotFound, "Push token not found")
 		return
 	}
 	c.JSON(http.StatusOK, gin.H{"success": true})
@@ -0,0 +1,122 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"happy-server-lite/internal/apierror"
+	"happy-server-lite/internal/replication"
+	"happy-server-lite/internal/store"
+)
+
+const (
+	// maxReplicationWait caps how long a changes request waits for a change.
+	maxReplicationWait = 60 * time.Second
+	// replicationBatch is the most changes one response carries.
+	replicationBatch = 1000
+)
+
+// ReplicationHandler serves the /v1/admin/replication endpoints: a primary
+// hands standbys a snapshot and then its changes, and a standby reports how
+// far it has followed and can be promoted.
+type ReplicationHandler struct {
+	Store store.Storage
+	// Log is nil unless this instance keeps a replication log for standbys.
+	Log *store.ReplicationLog
+	// Follower is nil unless this instance started as a standby.
+	Follower *replication.Follower
+}
+
+// Status reports the log this instance keeps and, on a standby, how far it
+// has followed its primary.
+func (h *ReplicationHandler) Status(c *gin.Context) {
+	body := gin.H{"role": replication.RolePrimary}
+	if h.Log != nil {
+		body["log"] = h.Log.Status()
+	}
+	if h.Follower != nil {
+		status := h.Follower.Status()
+		body["role"] = status.Role
+		body["follower"] = status
+	}
+	c.JSON(http.StatusOK, body)
+}
+
+// Snapshot writes a backup of the store, in the format of
+// AdminHandler.Backup, headed by the log position it was taken at.
+func (h *ReplicationHandler) Snapshot(c *gin.Context) {
+	archiver, ok := h.Store.(store.Archiver)
+	if h.Log == nil || !ok {
+		apierror.Respond(c, http.StatusNotImplemented, apierror.CodeInvalidRequest, "Replication is not enabled")
+		return
+	}
+	// The position is read first, so replaying from it covers every change
+	// the snapshot may have missed.
+	c.Header(replication.HeaderLogID, h.Log.ID())
+	c.Header(replication.HeaderLSN, strconv.FormatInt(h.Log.LSN(), 10))
+	c.Header("Content-Type", "application/gzip")
+	c.Status(http.StatusOK)
+	if err := archiver.Export(c.Writer); err != nil {
+		// Headers are already sent; a truncated archive fails to decompress.
+		log.Printf("replication snapshot: %v", err)
+	}
+}
+
+// Changes returns the changes after ?after= in the log named by ?logId=,
+// waiting up to ?wait= seconds for one when there are none yet. It responds
+// 410 when the log restarted or no longer holds them all, telling the
+// standby to load a new snapshot.
+func (h *ReplicationHandler) Changes(c *gin.Context) {
+	if h.Log == nil {
+		apierror.Respond(c, http.StatusNotImplemented, apierror.CodeInvalidRequest, "Replication is not enabled")
+		return
+	}
+	after, err := strconv.ParseInt(c.Query("after"), 10, 64)
+	if err != nil || after < 0 {
+		apierror.Respond(c, http.StatusBadRequest, apierror.CodeInvalidRequest, "Invalid after")
+		return
+	}
+	var wait time.Duration
+	if raw := c.Query("wait"); raw != "" {
+		seconds, err := strconv.Atoi(raw)
+		if err != nil || seconds < 0 {
+			apierror.Respond(c, http.StatusBadRequest, apierror.CodeInvalidRequest, "Invalid wait")
+			return
+		}
+		wait = min(time.Duration(seconds)*time.Second, maxReplicationWait)
+	}
+	if c.Query("logId") != h.Log.ID() {
+		apierror.Respond(c, http.StatusGone, apierror.CodeConflict, "Replication log restarted")
+		return
+	}
+
+	if wait > 0 {
+		ctx, cancel := context.WithTimeout(c.Request.Context(), wait)
+		h.Log.Wait(ctx, after)
+		cancel()
+	}
+	changes, err := h.Log.Since(after, replicationBatch)
+	if errors.Is(err, store.ErrReplicationGap) {
+		apierror.Respond(c, http.StatusGone, apierror.CodeConflict, "Replication log no longer holds these changes")
+		return
+	}
+	c.JSON(http.StatusOK, replication.Changes{LogID: h.Log.ID(), LSN: h.Log.LSN(), Changes: changes})
+}
+
+// Promote stops a standby following its primary and lets it take writes.
+func (h *ReplicationHandler) Promote(c *gin.Context) {
+	if h.Follower == nil {
+		apierror.Respond(c, http.StatusConflict, apierror.CodeConflict, "Not a standby")
+		return
+	}
+	if !h.Follower.Promote() {
+		apierror.Respond(c, http.StatusConflict, apierror.CodeConflict, "Already promoted")
+		return
+	}
+	c.JSON(http.StatusOK, h.Follower.Status())
+}
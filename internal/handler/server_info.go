@@ -0,0 +1,44 @@
+package handler
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	DefaultServerName  = "happy-server-lite"
+	DefaultWelcomeText = "Welcome to Happy Server!"
+)
+
+// ServerInfoHandler tells clients which instance they are talking to. Empty
+// fields fall back to the defaults; an empty Contact is reported as null.
+type ServerInfoHandler struct {
+	Name    string
+	Contact string
+	Welcome string
+}
+
+func (h *ServerInfoHandler) welcome() string {
+	if h.Welcome == "" {
+		return DefaultWelcomeText
+	}
+	return h.Welcome
+}
+
+// Root answers / with the welcome text.
+func (h *ServerInfoHandler) Root(c *gin.Context) {
+	c.String(http.StatusOK, h.welcome())
+}
+
+func (h *ServerInfoHandler) Info(c *gin.Context) {
+	name := h.Name
+	if name == "" {
+		name = DefaultServerName
+	}
+	var contact any
+	if h.Contact != "" {
+		contact = h.Contact
+	}
+	c.JSON(http.StatusOK, gin.H{"name": name, "contact": contact, "welcome": h.welcome()})
+}
@@ -1,17 +1,25 @@
 package handler
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
 	"net/http"
 	"strconv"
-	"time"
 
 	"github.com/gin-gonic/gin"
+	"happy-server-lite/internal/apierror"
+	"happy-server-lite/internal/clock"
+	"happy-server-lite/internal/events"
 	"happy-server-lite/internal/middleware"
+	"happy-server-lite/internal/model"
 	"happy-server-lite/internal/store"
 )
 
 type SessionHandler struct {
-	Store *store.Store
+	Store store.Storage
+	Clock clock.Clock
 }
 
 type createSessionBody struct {
@@ -22,26 +30,69 @@ type createSessionBody struct {
 }
 
 func (h *SessionHandler) GetOrCreate(c *gin.Context) {
+	ctx := c.Request.Context()
 	userID, ok := middleware.UserIDFromContext(c)
 	if !ok {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid authentication token"})
+		apierror.Respond(c, http.StatusUnauthorized, apierror.CodeUnauthorized, "Invalid authentication token")
 		return
 	}
 
 	var body createSessionBody
 	if err := c.ShouldBindJSON(&body); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		apierror.Respond(c, http.StatusBadRequest, apierror.CodeInvalidRequest, "Invalid request")
 		return
 	}
 
-	now := time.Now().UnixMilli()
-	sess, _, err := h.Store.GetOrCreateSession(userID, body.Tag, body.Metadata, body.AgentState, body.DataEncryptionKey, now)
+	now := clock.Now(h.Clock).UnixMilli()
+	sess, _, err := h.Store.GetOrCreateSession(ctx, userID, body.Tag, body.Metadata, body.AgentState, body.DataEncryptionKey, now)
+	if errors.Is(err, store.ErrTooLarge) {
+		apierror.Respond(c, http.StatusRequestEntityTooLarge, apierror.CodePayloadTooLarge, err.Error())
+		return
+	}
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		apierror.Respond(c, http.StatusBadRequest, apierror.CodeInvalidRequest, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"session": sessionJSON(sess)})
+}
+
+func (h *SessionHandler) List(c *gin.Context) {
+	ctx := c.Request.Context()
+	userID, ok := middleware.UserIDFromContext(c)
+	if !ok {
+		apierror.Respond(c, http.StatusUnauthorized, apierror.CodeUnauthorized, "Invalid authentication token")
+		return
+	}
+
+	sessions := h.Store.ListSessions(ctx, userID)
+	resp := make([]gin.H, 0, len(sessions))
+	for _, sess := range sessions {
+		resp = append(resp, sessionJSON(sess))
+	}
+	c.JSON(http.StatusOK, gin.H{"sessions": resp})
+}
+
+// ByTag resolves the caller's session by its tag, so a daemon resuming work
+// can find its session without listing them all.
+func (h *SessionHandler) ByTag(c *gin.Context) {
+	ctx := c.Request.Context()
+	userID, ok := middleware.UserIDFromContext(c)
+	if !ok {
+		apierror.Respond(c, http.StatusUnauthorized, apierror.CodeUnauthorized, "Invalid authentication token")
+		return
+	}
+
+	sess, ok := h.Store.GetSessionByTag(ctx, userID, c.Param("tag"))
+	if !ok {
+		apierror.Respond(c, http.StatusNotFound, apierror.CodeNotFound, "Session not found")
 		return
 	}
+	c.JSON(http.StatusOK, gin.H{"session": sessionJSON(sess)})
+}
 
-	c.JSON(http.StatusOK, gin.H{"session": gin.H{
+func sessionJSON(sess model.Session) gin.H {
+	return gin.H{
 		"id":                sess.ID,
 		"tag":               sess.Tag,
 		"seq":               sess.Seq,
@@ -55,109 +106,354 @@ func (h *SessionHandler) GetOrCreate(c *gin.Context) {
 		"active":            sess.Active,
 		"activeAt":          sess.ActiveAt,
 		"lastMessage":       nil,
-	}})
-}
-
-func (h *SessionHandler) List(c *gin.Context) {
-	userID, ok := middleware.UserIDFromContext(c)
-	if !ok {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid authentication token"})
-		return
 	}
-
-	sessions := h.Store.ListSessions(userID)
-	resp := make([]gin.H, 0, len(sessions))
-	for _, sess := range sessions {
-		resp = append(resp, gin.H{
-			"id":                sess.ID,
-			"tag":               sess.Tag,
-			"seq":               sess.Seq,
-			"createdAt":         sess.CreatedAt,
-			"updatedAt":         sess.UpdatedAt,
-			"metadata":          sess.Metadata,
-			"metadataVersion":   sess.MetadataVersion,
-			"agentState":        sess.AgentState,
-			"agentStateVersion": sess.AgentStateVersion,
-			"dataEncryptionKey": sess.DataEncryptionKey,
-			"active":            sess.Active,
-			"activeAt":          sess.ActiveAt,
-			"lastMessage":       nil,
-		})
-	}
-	c.JSON(http.StatusOK, gin.H{"sessions": resp})
 }
 
 func (h *SessionHandler) Delete(c *gin.Context) {
+	ctx := c.Request.Context()
 	userID, ok := middleware.UserIDFromContext(c)
 	if !ok {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid authentication token"})
+		apierror.Respond(c, http.StatusUnauthorized, apierror.CodeUnauthorized, "Invalid authentication token")
 		return
 	}
 
 	sessionID := c.Param("id")
 	if sessionID == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid session id"})
+		apierror.Respond(c, http.StatusBadRequest, apierror.CodeInvalidRequest, "Invalid session id")
 		return
 	}
 
-	if !h.Store.DeleteSession(userID, sessionID, time.Now().UnixMilli()) {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Session not found"})
+	if !h.Store.DeleteSession(ctx, userID, sessionID, clock.Now(h.Clock).UnixMilli()) {
+		apierror.Respond(c, http.StatusNotFound, apierror.CodeNotFound, "Session not found")
 		return
 	}
 	c.JSON(http.StatusOK, gin.H{"success": true})
 }
 
 func (h *SessionHandler) Messages(c *gin.Context) {
+	ctx := c.Request.Context()
 	userID, ok := middleware.UserIDFromContext(c)
 	if !ok {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid authentication token"})
+		apierror.Respond(c, http.StatusUnauthorized, apierror.CodeUnauthorized, "Invalid authentication token")
 		return
 	}
 
 	sessionID := c.Param("id")
 	if sessionID == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid session id"})
+		apierror.Respond(c, http.StatusBadRequest, apierror.CodeInvalidRequest, "Invalid session id")
 		return
 	}
 
-	after := int64(0)
-	if raw := c.Query("after"); raw != "" {
-		v, err := strconv.ParseInt(raw, 10, 64)
-		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid cursor format"})
-			return
+	q, limit, ok := messageQueryFromRequest(c)
+	if !ok {
+		return
+	}
+	if limit <= 0 {
+		limit = 100
+	}
+
+	// Ask for one more than the page to learn whether another follows.
+	q.Limit = limit + 1
+	msgs, err := h.Store.QueryMessages(ctx, userID, sessionID, q)
+	if err != nil {
+		apierror.Respond(c, http.StatusNotFound, apierror.CodeNotFound, "Session not found")
+		return
+	}
+	hasMore := len(msgs) > limit
+	if hasMore {
+		msgs = msgs[:limit]
+	}
+
+	resp := make([]events.Message, 0, len(msgs))
+	for _, m := range msgs {
+		resp = append(resp, events.MessageFrom(m))
+	}
+	// nextCursor is the seq to pass as after (asc) or before (desc) for the
+	// next page.
+	var nextCursor *int64
+	if hasMore {
+		nextCursor = &msgs[len(msgs)-1].Seq
+	}
+	c.JSON(http.StatusOK, gin.H{"messages": resp, "hasMore": hasMore, "nextCursor": nextCursor})
+}
+
+// messageQueryFromRequest reads the after, before, order and limit query
+// parameters shared by Messages and StreamMessages, responding with 400 and
+// reporting false when one is malformed. limit is zero when not given.
+func messageQueryFromRequest(c *gin.Context) (q store.MessageQuery, limit int, ok bool) {
+	for name, dst := range map[string]*int64{"after": &q.After, "before": &q.Before} {
+		if raw := c.Query(name); raw != "" {
+			v, err := strconv.ParseInt(raw, 10, 64)
+			if err != nil {
+				apierror.Respond(c, http.StatusBadRequest, apierror.CodeInvalidRequest, "Invalid cursor format")
+				return q, 0, false
+			}
+			*dst = v
 		}
-		after = v
+	}
+	switch c.DefaultQuery("order", "asc") {
+	case "asc":
+	case "desc":
+		q.Desc = true
+	default:
+		apierror.Respond(c, http.StatusBadRequest, apierror.CodeInvalidRequest, "Invalid order")
+		return q, 0, false
 	}
 
-	limit := 100
 	if raw := c.Query("limit"); raw != "" {
 		v, err := strconv.Atoi(raw)
 		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid cursor format"})
-			return
+			apierror.Respond(c, http.StatusBadRequest, apierror.CodeInvalidRequest, "Invalid cursor format")
+			return q, 0, false
 		}
 		limit = v
 	}
+	return q, limit, true
+}
+
+// Export downloads one session for archiving outside the app: a tar bundle
+// of session.json and a self-contained index.html viewer by default, or
+// either alone with format=json or format=html.
+func (h *SessionHandler) Export(c *gin.Context) {
+	ctx := c.Request.Context()
+	userID, ok := middleware.UserIDFromContext(c)
+	if !ok {
+		apierror.Respond(c, http.StatusUnauthorized, apierror.CodeUnauthorized, "Invalid authentication token")
+		return
+	}
+
+	format := store.ExportFormat(c.Query("format"))
+	if format == "" {
+		format = store.ExportTar
+	}
+	var contentType string
+	switch format {
+	case store.ExportJSON:
+		contentType = "application/json"
+	case store.ExportHTML:
+		contentType = "text/html; charset=utf-8"
+	case store.ExportTar:
+		contentType = "application/x-tar"
+	default:
+		apierror.Respond(c, http.StatusBadRequest, apierror.CodeInvalidRequest, "Invalid export format")
+		return
+	}
+	sess, ok := h.Store.GetSession(ctx, userID, c.Param("id"))
+	if !ok || sess.Deleted {
+		apierror.Respond(c, http.StatusNotFound, apierror.CodeNotFound, "Session not found")
+		return
+	}
+
+	now := clock.Now(h.Clock)
+	name := fmt.Sprintf("happy-session-%s-%s.%s", sess.ID, now.UTC().Format("20060102-150405"), format)
+	c.Header("Content-Type", contentType)
+	c.Header("Content-Disposition", `attachment; filename="`+name+`"`)
+	c.Status(http.StatusOK)
+	if err := store.ExportSession(ctx, h.Store, userID, sess.ID, c.Writer, format, now); err != nil {
+		// Headers are already sent; a truncated export fails to parse.
+		log.Printf("session export: %v", err)
+	}
+}
+
+// streamFlushEvery is how many messages StreamMessages writes between
+// flushes.
+const streamFlushEvery = 100
+
+// StreamMessages writes the session's messages as NDJSON, one message per
+// line, in the order and bounds Messages takes; without a limit it streams
+// them all. Messages are read a page at a time and written as they are read,
+// so a slow reader holds the next page back instead of the server buffering
+// the whole history.
+func (h *SessionHandler) StreamMessages(c *gin.Context) {
+	ctx := c.Request.Context()
+	userID, ok := middleware.UserIDFromContext(c)
+	if !ok {
+		apierror.Respond(c, http.StatusUnauthorized, apierror.CodeUnauthorized, "Invalid authentication token")
+		return
+	}
 
-	msgs, err := h.Store.ListMessages(userID, sessionID, after, limit)
+	sessionID := c.Param("id")
+	if sessionID == "" {
+		apierror.Respond(c, http.StatusBadRequest, apierror.CodeInvalidRequest, "Invalid session id")
+		return
+	}
+	q, limit, ok := messageQueryFromRequest(c)
+	if !ok {
+		return
+	}
+	q.Limit = max(limit, 0)
+	if _, ok := h.Store.GetSession(ctx, userID, sessionID); !ok {
+		apierror.Respond(c, http.StatusNotFound, apierror.CodeNotFound, "Session not found")
+		return
+	}
+
+	c.Header("Content-Type", "application/x-ndjson")
+	c.Status(http.StatusOK)
+	enc := json.NewEncoder(c.Writer)
+	written := 0
+	err := store.StreamMessages(ctx, h.Store, userID, sessionID, q, func(m model.SessionMessage) error {
+		if err := enc.Encode(events.MessageFrom(m)); err != nil {
+			return err
+		}
+		if written++; written%streamFlushEvery == 0 {
+			c.Writer.Flush()
+		}
+		return nil
+	})
+	if err != nil && c.Request.Context().Err() == nil {
+		// Headers are already sent, so the failure ends the stream as an
+		// error line rather than a status.
+		log.Printf("message stream %s: %v", sessionID, err)
+		_ = enc.Encode(apierror.Body(apierror.FormatFromContext(c), apierror.CodeInternal, "Message stream interrupted", nil))
+	}
+}
+
+type postMessageBody struct {
+	Message  string `json:"message"`
+	Checksum string `json:"checksum"`
+	// LocalID makes retries of the same send return the first message.
+	LocalID string `json:"localId"`
+}
+
+func (h *SessionHandler) PostMessage(c *gin.Context) {
+	ctx := c.Request.Context()
+	userID, ok := middleware.UserIDFromContext(c)
+	if !ok {
+		apierror.Respond(c, http.StatusUnauthorized, apierror.CodeUnauthorized, "Invalid authentication token")
+		return
+	}
+
+	var body postMessageBody
+	if err := c.ShouldBindJSON(&body); err != nil || body.Message == "" {
+		apierror.Respond(c, http.StatusBadRequest, apierror.CodeInvalidRequest, "Invalid request")
+		return
+	}
+
+	msg, _, err := h.Store.AppendMessageOnce(ctx, store.OriginREST, userID, c.Param("id"), body.Message, body.Checksum, body.LocalID, clock.Now(h.Clock).UnixMilli())
+	if errors.Is(err, store.ErrChecksumMismatch) {
+		apierror.Respond(c, http.StatusBadRequest, apierror.CodeInvalidRequest, "Checksum mismatch")
+		return
+	}
 	if err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Session not found"})
+		apierror.Respond(c, http.StatusNotFound, apierror.CodeNotFound, "Session not found")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": events.MessageFrom(msg)})
+}
+
+type updateMessageBody struct {
+	Message  string `json:"message"`
+	Checksum string `json:"checksum"`
+}
+
+// UpdateMessage replaces the content of a message; the new content may carry
+// a checksum as on PostMessage.
+func (h *SessionHandler) UpdateMessage(c *gin.Context) {
+	ctx := c.Request.Context()
+	userID, ok := middleware.UserIDFromContext(c)
+	if !ok {
+		apierror.Respond(c, http.StatusUnauthorized, apierror.CodeUnauthorized, "Invalid authentication token")
 		return
 	}
 
-	resp := make([]gin.H, 0, len(msgs))
-	for _, m := range msgs {
-		resp = append(resp, gin.H{
-			"id":        m.ID,
-			"seq":       m.Seq,
-			"createdAt": m.CreatedAt,
-			"updatedAt": m.UpdatedAt,
-			"content": gin.H{
-				"t": "encrypted",
-				"c": m.Content,
-			},
-		})
-	}
-	c.JSON(http.StatusOK, gin.H{"messages": resp})
+	var body updateMessageBody
+	if err := c.ShouldBindJSON(&body); err != nil || body.Message == "" {
+		apierror.Respond(c, http.StatusBadRequest, apierror.CodeInvalidRequest, "Invalid request")
+		return
+	}
+
+	msg, err := h.Store.UpdateMessageFrom(ctx, store.OriginREST, userID, c.Param("id"), c.Param("messageId"), body.Message, body.Checksum, clock.Now(h.Clock).UnixMilli())
+	if respondMessageEditError(c, err) {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": events.MessageFrom(msg)})
+}
+
+// DeleteMessage leaves a tombstone in place of a message and returns it.
+func (h *SessionHandler) DeleteMessage(c *gin.Context) {
+	ctx := c.Request.Context()
+	userID, ok := middleware.UserIDFromContext(c)
+	if !ok {
+		apierror.Respond(c, http.StatusUnauthorized, apierror.CodeUnauthorized, "Invalid authentication token")
+		return
+	}
+
+	msg, err := h.Store.DeleteMessageFrom(ctx, store.OriginREST, userID, c.Param("id"), c.Param("messageId"), clock.Now(h.Clock).UnixMilli())
+	if respondMessageEditError(c, err) {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": events.MessageFrom(msg)})
+}
+
+type annotateMessageBody struct {
+	// Value is the encrypted annotation; null removes it.
+	Value           *string `json:"value"`
+	ExpectedVersion int     `json:"expectedVersion"`
+}
+
+// AnnotateMessage sets the annotation :key of a message, or removes it when
+// the value is null, if it is at the expected version; 0 expects none.
+func (h *SessionHandler) AnnotateMessage(c *gin.Context) {
+	var body annotateMessageBody
+	if err := c.ShouldBindJSON(&body); err != nil {
+		apierror.Respond(c, http.StatusBadRequest, apierror.CodeInvalidRequest, "Invalid request")
+		return
+	}
+	h.annotateMessage(c, body.ExpectedVersion, body.Value)
+}
+
+// DeleteAnnotation removes the annotation :key of a message if it is at
+// ?expectedVersion.
+func (h *SessionHandler) DeleteAnnotation(c *gin.Context) {
+	expectedVersion, err := strconv.Atoi(c.Query("expectedVersion"))
+	if err != nil {
+		apierror.Respond(c, http.StatusBadRequest, apierror.CodeInvalidRequest, "Invalid expectedVersion")
+		return
+	}
+	h.annotateMessage(c, expectedVersion, nil)
+}
+
+func (h *SessionHandler) annotateMessage(c *gin.Context, expectedVersion int, value *string) {
+	ctx := c.Request.Context()
+	userID, ok := middleware.UserIDFromContext(c)
+	if !ok {
+		apierror.Respond(c, http.StatusUnauthorized, apierror.CodeUnauthorized, "Invalid authentication token")
+		return
+	}
+
+	key := c.Param("key")
+	msg, err := h.Store.AnnotateMessageFrom(ctx, store.OriginREST, userID, c.Param("id"), c.Param("messageId"), key, expectedVersion, value, clock.Now(h.Clock).UnixMilli())
+	switch {
+	case errors.Is(err, store.ErrAnnotationVersionMismatch):
+		current := msg.Annotations[key]
+		resp := gin.H{"currentVersion": current.Version, "currentValue": nil}
+		if current.Version > 0 {
+			resp["currentValue"] = current.Value
+		}
+		apierror.VersionMismatch(c, resp)
+	case errors.Is(err, store.ErrInvalidAnnotationKey):
+		apierror.Respond(c, http.StatusBadRequest, apierror.CodeInvalidRequest, "Invalid annotation key")
+	case errors.Is(err, store.ErrTooManyAnnotations):
+		apierror.Respond(c, http.StatusBadRequest, apierror.CodeInvalidRequest, "Too many annotations")
+	case errors.Is(err, store.ErrTooLarge):
+		apierror.Respond(c, http.StatusRequestEntityTooLarge, apierror.CodePayloadTooLarge, "Annotation too large")
+	case !respondMessageEditError(c, err):
+		c.JSON(http.StatusOK, gin.H{"success": true, "message": events.MessageFrom(msg)})
+	}
+}
+
+// respondMessageEditError writes the response for a failed message edit or
+// delete and reports whether there was one.
+func respondMessageEditError(c *gin.Context, err error) bool {
+	switch {
+	case err == nil:
+		return false
+	case errors.Is(err, store.ErrChecksumMismatch):
+		apierror.Respond(c, http.StatusBadRequest, apierror.CodeInvalidRequest, "Checksum mismatch")
+	case errors.Is(err, store.ErrMessageNotFound):
+		apierror.Respond(c, http.StatusNotFound, apierror.CodeNotFound, "Message not found")
+	default:
+		apierror.Respond(c, http.StatusNotFound, apierror.CodeNotFound, "Session not found")
+	}
+	return true
 }
@@ -0,0 +1,112 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"happy-server-lite/internal/apierror"
+	"happy-server-lite/internal/clock"
+	"happy-server-lite/internal/events"
+	"happy-server-lite/internal/middleware"
+	"happy-server-lite/internal/store"
+)
+
+type sessionLockBody struct {
+	// Holder names the tool taking the lock, for the others to show.
+	Holder string `json:"holder"`
+	// Token is the one acquiring the lock returned; renewing and releasing
+	// need it.
+	Token      string `json:"token"`
+	TTLSeconds int    `json:"ttlSeconds"`
+}
+
+// Locks lists the live advisory locks of a session, without their tokens.
+func (h *SessionHandler) Locks(c *gin.Context) {
+	userID, ok := middleware.UserIDFromContext(c)
+	if !ok {
+		apierror.Respond(c, http.StatusUnauthorized, apierror.CodeUnauthorized, "Invalid authentication token")
+		return
+	}
+	locks, err := h.Store.ListSessionLocks(c.Request.Context(), userID, c.Param("id"), clock.Now(h.Clock).UnixMilli())
+	if errors.Is(err, store.ErrSessionNotFound) {
+		apierror.Respond(c, http.StatusNotFound, apierror.CodeNotFound, "Session not found")
+		return
+	}
+	if err != nil {
+		apierror.Respond(c, http.StatusInternalServerError, apierror.CodeInternal, "Failed to list locks")
+		return
+	}
+	resp := make([]events.Lock, 0, len(locks))
+	for _, lock := range locks {
+		resp = append(resp, events.LockFrom(lock))
+	}
+	c.JSON(http.StatusOK, gin.H{"locks": resp})
+}
+
+// AcquireLock takes the lock :name on a session for ttlSeconds, 30 unless
+// given. A lock someone else holds is a 409 with that lock.
+func (h *SessionHandler) AcquireLock(c *gin.Context) {
+	h.changeLock(c, true, func(userID string, body sessionLockBody, expiresAt, now int64) (any, error) {
+		lock, err := h.Store.AcquireSessionLock(c.Request.Context(), store.OriginREST, userID, c.Param("id"), c.Param("name"), body.Holder, expiresAt, now)
+		return events.LockFrom(lock), err
+	})
+}
+
+// RenewLock extends the lock :name by ttlSeconds from now if the token in
+// the body still holds it.
+func (h *SessionHandler) RenewLock(c *gin.Context) {
+	h.changeLock(c, true, func(userID string, body sessionLockBody, expiresAt, now int64) (any, error) {
+		lock, err := h.Store.RenewSessionLock(c.Request.Context(), store.OriginREST, userID, c.Param("id"), c.Param("name"), body.Token, expiresAt, now)
+		return events.LockFrom(lock), err
+	})
+}
+
+// ReleaseLock frees the lock :name if the token in the body holds it.
+func (h *SessionHandler) ReleaseLock(c *gin.Context) {
+	h.changeLock(c, false, func(userID string, body sessionLockBody, _, now int64) (any, error) {
+		_, err := h.Store.ReleaseSessionLock(c.Request.Context(), store.OriginREST, userID, c.Param("id"), c.Param("name"), body.Token, now)
+		return nil, err
+	})
+}
+
+func (h *SessionHandler) changeLock(c *gin.Context, expires bool, change func(userID string, body sessionLockBody, expiresAt, now int64) (any, error)) {
+	userID, ok := middleware.UserIDFromContext(c)
+	if !ok {
+		apierror.Respond(c, http.StatusUnauthorized, apierror.CodeUnauthorized, "Invalid authentication token")
+		return
+	}
+	var body sessionLockBody
+	if err := c.ShouldBindJSON(&body); err != nil {
+		apierror.Respond(c, http.StatusBadRequest, apierror.CodeInvalidRequest, "Invalid request")
+		return
+	}
+	now := clock.Now(h.Clock).UnixMilli()
+	var expiresAt int64
+	if expires {
+		if expiresAt, ok = store.SessionLockExpiresAt(body.TTLSeconds, now); !ok {
+			apierror.Respond(c, http.StatusBadRequest, apierror.CodeInvalidRequest, "Invalid ttlSeconds")
+			return
+		}
+	}
+
+	lock, err := change(userID, body, expiresAt, now)
+	switch {
+	case err == nil && lock == nil:
+		c.JSON(http.StatusOK, gin.H{"success": true})
+	case err == nil:
+		c.JSON(http.StatusOK, gin.H{"success": true, "lock": lock})
+	case errors.Is(err, store.ErrSessionLockHeld):
+		apierror.RespondWith(c, http.StatusConflict, apierror.CodeConflict, "Lock held", gin.H{"lock": lock})
+	case errors.Is(err, store.ErrSessionLockNotHeld):
+		apierror.Respond(c, http.StatusConflict, apierror.CodeConflict, "Lock not held")
+	case errors.Is(err, store.ErrInvalidSessionLock):
+		apierror.Respond(c, http.StatusBadRequest, apierror.CodeInvalidRequest, "Invalid lock")
+	case errors.Is(err, store.ErrTooManySessionLocks):
+		apierror.Respond(c, http.StatusBadRequest, apierror.CodeInvalidRequest, "Too many locks")
+	case errors.Is(err, store.ErrSessionNotFound):
+		apierror.Respond(c, http.StatusNotFound, apierror.CodeNotFound, "Session not found")
+	default:
+		apierror.Respond(c, http.StatusInternalServerError, apierror.CodeInternal, "Failed to change lock")
+	}
+}
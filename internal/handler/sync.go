@@ -0,0 +1,71 @@
+package handler
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"happy-server-lite/internal/apierror"
+	"happy-server-lite/internal/clock"
+	"happy-server-lite/internal/middleware"
+	"happy-server-lite/internal/store"
+)
+
+type SyncHandler struct {
+	Store store.Storage
+	Clock clock.Clock
+}
+
+// Changes returns sessions and machines updated after ?since= (unix millis)
+// plus tombstones for those deleted since. When since predates the tombstone
+// retention window the response is a full snapshot with "resync" set, and the
+// client should drop any local record not listed.
+func (h *SyncHandler) Changes(c *gin.Context) {
+	ctx := c.Request.Context()
+	userID, ok := middleware.UserIDFromContext(c)
+	if !ok {
+		apierror.Respond(c, http.StatusUnauthorized, apierror.CodeUnauthorized, "Invalid authentication token")
+		return
+	}
+
+	since := int64(0)
+	if raw := c.Query("since"); raw != "" {
+		v, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil || v < 0 {
+			apierror.Respond(c, http.StatusBadRequest, apierror.CodeInvalidRequest, "Invalid since")
+			return
+		}
+		since = v
+	}
+
+	now := clock.Now(h.Clock).UnixMilli()
+	resync := since > 0 && since < h.Store.TombstoneCutoff(now)
+	if resync {
+		since = 0
+	}
+
+	sessions := make([]gin.H, 0)
+	for _, sess := range h.Store.ListSessions(ctx, userID) {
+		if sess.UpdatedAt > since {
+			sessions = append(sessions, sessionJSON(sess))
+		}
+	}
+	machines := make([]gin.H, 0)
+	for _, m := range h.Store.ListMachines(ctx, userID) {
+		if m.UpdatedAt > since {
+			machines = append(machines, machineJSON(m))
+		}
+	}
+	tombstones := make([]gin.H, 0)
+	for _, t := range h.Store.ListTombstones(ctx, userID, since, now) {
+		tombstones = append(tombstones, gin.H{"kind": t.Kind, "id": t.ID, "deletedAt": t.DeletedAt})
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"sessions":   sessions,
+		"machines":   machines,
+		"tombstones": tombstones,
+		"resync":     resync,
+		"now":        now,
+	})
+}
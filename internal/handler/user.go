@@ -4,6 +4,7 @@ import (
 	"net/http"
 
 	"github.com/gin-gonic/gin"
+	"happy-server-lite/internal/apierror"
 )
 
 type UserHandler struct{}
@@ -16,5 +17,5 @@ func (h *UserHandler) Search(c *gin.Context) {
 func (h *UserHandler) Get(c *gin.Context) {
 	// Not implemented: return 404 so clients can treat as missing.
 	_ = c.Param("id")
-	c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+	apierror.Respond(c, http.StatusNotFound, apierror.CodeNotFound, "User not found")
 }
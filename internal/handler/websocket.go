@@ -1,28 +1,65 @@
 package handler
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"net/http"
 	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
+	"happy-server-lite/internal/apierror"
 	"happy-server-lite/internal/auth"
+	"happy-server-lite/internal/clock"
+	"happy-server-lite/internal/events"
 	"happy-server-lite/internal/hub"
 	"happy-server-lite/internal/store"
 )
 
 type WebSocketHandler struct {
 	Hub         *hub.Hub
-	Store       *store.Store
+	Store       store.Storage
 	TokenConfig auth.TokenConfig
+	Limits      WebSocketLimits
+	Clock       clock.Clock
+}
+
+const (
+	defaultWSReadLimit = 1024 * 1024
+	defaultWSPongWait  = 60 * time.Second
+	defaultWSWriteWait = 10 * time.Second
+	// wsSendQueueSize bounds the messages waiting for one client. A client
+	// that falls this far behind is disconnected.
+	wsSendQueueSize = 256
+)
+
+// WebSocketLimits tunes the raw /ws transport. Zero values keep the defaults.
+type WebSocketLimits struct {
+	ReadLimit int64
+	PongWait  time.Duration
+	WriteWait time.Duration
+}
+
+func (l WebSocketLimits) withDefaults() WebSocketLimits {
+	if l.ReadLimit == 0 {
+		l.ReadLimit = defaultWSReadLimit
+	}
+	if l.PongWait == 0 {
+		l.PongWait = defaultWSPongWait
+	}
+	if l.WriteWait == 0 {
+		l.WriteWait = defaultWSWriteWait
+	}
+	return l
 }
 
 type clientMessage struct {
-	Type    string `json:"type"`
-	SID     string `json:"sid,omitempty"`
-	Message string `json:"message,omitempty"`
+	Type     string `json:"type"`
+	SID      string `json:"sid,omitempty"`
+	Message  string `json:"message,omitempty"`
+	Checksum string `json:"checksum,omitempty"`
 }
 
 type serverMessage struct {
@@ -35,28 +72,95 @@ var upgrader = websocket.Upgrader{
 	CheckOrigin: func(r *http.Request) bool { return true },
 }
 
+var (
+	errWSClosed    = errors.New("connection closed")
+	errWSQueueFull = errors.New("send queue full")
+)
+
+// wsWriter queues messages for conn and writes them from its own goroutine.
+// The hub broadcasts from store event publishers, which run on the goroutine
+// making the change, so Write never touches the socket: a client whose queue
+// is full is closed instead of holding up the store.
 type wsWriter struct {
-	conn *websocket.Conn
+	conn      *websocket.Conn
+	writeWait time.Duration
+	send      chan []byte
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newWSWriter(conn *websocket.Conn, writeWait time.Duration) *wsWriter {
+	w := &wsWriter{
+		conn:      conn,
+		writeWait: writeWait,
+		send:      make(chan []byte, wsSendQueueSize),
+		done:      make(chan struct{}),
+	}
+	go w.writeLoop()
+	return w
 }
 
 func (w *wsWriter) Write(message []byte) error {
-	w.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
-	return w.conn.WriteMessage(websocket.TextMessage, message)
+	select {
+	case <-w.done:
+		return errWSClosed
+	default:
+	}
+
+	select {
+	case w.send <- message:
+		return nil
+	case <-w.done:
+		return errWSClosed
+	default:
+		_ = w.Close()
+		return errWSQueueFull
+	}
 }
 
 func (w *wsWriter) Close() error {
-	return w.conn.Close()
+	w.closeOnce.Do(func() {
+		close(w.done)
+		_ = w.conn.Close()
+	})
+	return nil
+}
+
+func (w *wsWriter) writeLoop() {
+	for {
+		select {
+		case <-w.done:
+			return
+		case message := <-w.send:
+			w.conn.SetWriteDeadline(time.Now().Add(w.writeWait))
+			if err := w.conn.WriteMessage(websocket.TextMessage, message); err != nil {
+				_ = w.Close()
+				return
+			}
+		}
+	}
 }
 
 func (h *WebSocketHandler) Serve(c *gin.Context) {
+	ctx := c.Request.Context()
 	tokenString := c.Query("token")
 	if tokenString == "" {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid authentication token"})
+		apierror.Respond(c, http.StatusUnauthorized, apierror.CodeUnauthorized, "Invalid authentication token")
+		return
+	}
+	claims, err := auth.VerifyToken(auth.WithClientIP(ctx, c.ClientIP()), tokenString, h.TokenConfig)
+	if errors.Is(err, auth.ErrAccountDisabled) {
+		apierror.Respond(c, http.StatusForbidden, apierror.CodeForbidden, "Account disabled")
 		return
 	}
-	claims, err := auth.VerifyToken(tokenString, h.TokenConfig)
 	if err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid authentication token"})
+		apierror.Respond(c, http.StatusUnauthorized, apierror.CodeUnauthorized, "Invalid authentication token")
+		return
+	}
+	// The hub fans out every message of the user, so a scoped token has no
+	// place here.
+	if !claims.TokenScope().IsZero() {
+		apierror.Respond(c, http.StatusForbidden, apierror.CodeForbidden, "Token is scoped to another resource")
 		return
 	}
 
@@ -65,16 +169,18 @@ func (h *WebSocketHandler) Serve(c *gin.Context) {
 		return
 	}
 
-	conn := &hub.Connection{UserID: claims.UserID, Writer: &wsWriter{conn: ws}}
+	limits := h.Limits.withDefaults()
+	writer := newWSWriter(ws, limits.WriteWait)
+	conn := &hub.Connection{UserID: claims.UserID, DeviceID: claims.DeviceID, Writer: writer}
 	h.Hub.Register(conn)
 	defer func() {
 		h.Hub.Unregister(conn)
-		_ = ws.Close()
+		_ = writer.Close()
 	}()
 
-	ws.SetReadLimit(1024 * 1024)
-	const pongWait = 60 * time.Second
-	const writeWait = 10 * time.Second
+	ws.SetReadLimit(limits.ReadLimit)
+	pongWait := limits.PongWait
+	writeWait := limits.WriteWait
 	pingPeriod := (pongWait * 9) / 10
 
 	ws.SetReadDeadline(time.Now().Add(pongWait))
@@ -129,28 +235,47 @@ func (h *WebSocketHandler) Serve(c *gin.Context) {
 			if msg.SID == "" || msg.Message == "" {
 				continue
 			}
-			now := time.Now().UnixMilli()
-			stored, err := h.Store.AppendMessage(claims.UserID, msg.SID, msg.Message, now)
-			if err != nil {
-				continue
-			}
-			update := serverMessage{
-				Type:  "update",
-				Event: "new-message",
-				Body: gin.H{
-					"t":         "new-message",
-					"sessionId": msg.SID,
-					"message": gin.H{
-						"id":        stored.ID,
-						"seq":       stored.Seq,
-						"createdAt": stored.CreatedAt,
-						"updatedAt": stored.UpdatedAt,
-						"content":   gin.H{"t": "encrypted", "c": stored.Content},
-					},
-				},
-			}
-			out, _ := json.Marshal(update)
-			h.Hub.Broadcast(claims.UserID, out)
+			// The hub broadcast happens in HandleStoreEvent.
+			_, _ = h.Store.AppendMessageFrom(ctx, store.OriginWebSocket, claims.UserID, msg.SID, msg.Message, msg.Checksum, clock.Now(h.Clock).UnixMilli())
 		}
 	}
 }
+
+// HandleStoreEvent relays messages appended through any API, and new auth
+// requests for the account's key, to /ws clients. It runs inside the store's
+// publish, so it only queues writes; the auth request lookups run on their
+// own goroutine.
+func (h *WebSocketHandler) HandleStoreEvent(ev store.Event) {
+	if ev.Type == store.EventAuthRequested {
+		go h.authRequested(ev.PublicKey)
+		return
+	}
+	if ev.Type != store.EventMessageAppended {
+		return
+	}
+	body := events.NewMessage(ev.SessionID, events.MessageFrom(*ev.Message))
+	body.SessionID = ev.SessionID
+	update := serverMessage{
+		Type:  "update",
+		Event: events.TypeNewMessage,
+		Body:  body,
+	}
+	out, _ := json.Marshal(update)
+	h.Hub.Broadcast(ev.UserID, out)
+}
+
+// authRequested sends the auth-request body to the /ws clients of the
+// account owning publicKey, as Socket.IO does.
+func (h *WebSocketHandler) authRequested(publicKey string) {
+	ctx := context.Background()
+	account, ok := h.Store.GetAccount(ctx, publicKey)
+	if !ok {
+		return
+	}
+	req, ok := h.Store.GetAuthRequest(ctx, publicKey)
+	if !ok {
+		return
+	}
+	out, _ := json.Marshal(serverMessage{Type: events.EventAuthRequest, Body: events.AuthRequested(req)})
+	h.Hub.Broadcast(account.ID, out)
+}
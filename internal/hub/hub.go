@@ -9,7 +9,10 @@ type Writer interface {
 
 type Connection struct {
 	UserID string
-	Writer Writer
+	// DeviceID is the signed-in device the connection's token was issued
+	// to, if any.
+	DeviceID string
+	Writer   Writer
 }
 
 type Hub struct {
@@ -65,3 +68,40 @@ func (h *Hub) Broadcast(userID string, message []byte) {
 		h.Unregister(c)
 	}
 }
+
+// CloseUser closes and unregisters every connection of userID, returning how
+// many there were.
+func (h *Hub) CloseUser(userID string) int {
+	h.mu.Lock()
+	set := h.connections[userID]
+	delete(h.connections, userID)
+	h.mu.Unlock()
+
+	for c := range set {
+		_ = c.Writer.Close()
+	}
+	return len(set)
+}
+
+// CloseDevice closes and unregisters the connections of userID made with a
+// token of deviceID, returning how many there were.
+func (h *Hub) CloseDevice(userID, deviceID string) int {
+	h.mu.Lock()
+	set := h.connections[userID]
+	var closed []*Connection
+	for c := range set {
+		if c.DeviceID == deviceID {
+			closed = append(closed, c)
+			delete(set, c)
+		}
+	}
+	if set != nil && len(set) == 0 {
+		delete(h.connections, userID)
+	}
+	h.mu.Unlock()
+
+	for _, c := range closed {
+		_ = c.Writer.Close()
+	}
+	return len(closed)
+}
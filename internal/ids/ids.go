@@ -0,0 +1,125 @@
+// Package ids generates the ids the server hands out for accounts, sessions,
+// messages and updates.
+package ids
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Generator returns a new id on every call and is safe for concurrent use.
+type Generator func() string
+
+// Strategy names accepted by ForStrategy.
+const (
+	StrategyUUID = "uuid"
+	StrategyULID = "ulid"
+)
+
+// ForStrategy returns a generator for a strategy name; empty picks UUIDs.
+func ForStrategy(name string) (Generator, bool) {
+	switch name {
+	case "", StrategyUUID:
+		return UUID, true
+	case StrategyULID:
+		return NewULID(), true
+	}
+	return nil, false
+}
+
+// UUID returns a random (version 4) UUID.
+func UUID() string {
+	return uuid.NewString()
+}
+
+// Sequential returns a generator of prefix followed by a zero-padded
+// counter from 1, for tests that need predictable ids.
+func Sequential(prefix string) Generator {
+	var n atomic.Int64
+	return func() string {
+		return fmt.Sprintf("%s%012d", prefix, n.Add(1))
+	}
+}
+
+// crockford is the ULID alphabet: Crockford's base32 without I, L, O and U.
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// NewULID returns a generator of ULIDs: 26 characters holding a millisecond
+// timestamp and 80 random bits, which sort by creation time as strings. Ids
+// from the same millisecond increment the random part, so they sort in
+// generation order too.
+func NewULID() Generator {
+	return newULID(time.Now, rand.Reader)
+}
+
+func newULID(now func() time.Time, entropy io.Reader) Generator {
+	var (
+		mu     sync.Mutex
+		lastMs uint64
+		random [10]byte
+	)
+	return func() string {
+		mu.Lock()
+		defer mu.Unlock()
+
+		ms := uint64(now().UnixMilli())
+		fresh := true
+		if ms <= lastMs {
+			// Within the last id's millisecond, or after the clock stepped
+			// back: keep its timestamp and bump the random part, moving on
+			// a millisecond only when that wraps.
+			ms = lastMs
+			if fresh = !increment(&random); fresh {
+				ms++
+			}
+		}
+		if fresh {
+			if _, err := io.ReadFull(entropy, random[:]); err != nil {
+				panic("ids: reading entropy: " + err.Error())
+			}
+		}
+		lastMs = ms
+		return encodeULID(ms, random)
+	}
+}
+
+// increment adds one to b as a big-endian number and reports false when it
+// wraps around.
+func increment(b *[10]byte) bool {
+	for i := len(b) - 1; i >= 0; i-- {
+		b[i]++
+		if b[i] != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func encodeULID(ms uint64, random [10]byte) string {
+	var out [26]byte
+	// 48-bit timestamp in 10 characters; the first holds its top 3 bits.
+	for i := 9; i >= 0; i-- {
+		out[i] = crockford[ms&31]
+		ms >>= 5
+	}
+	// 80 random bits in 16 characters, five bits each.
+	var acc uint64
+	bits := 0
+	pos := 10
+	for _, b := range random {
+		acc = acc<<8 | uint64(b)
+		bits += 8
+		for bits >= 5 {
+			bits -= 5
+			out[pos] = crockford[(acc>>bits)&31]
+			pos++
+		}
+	}
+	return string(out[:])
+}
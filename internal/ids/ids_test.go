@@ -0,0 +1,70 @@
+package ids
+
+import (
+	"bytes"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestEncodeULID(t *testing.T) {
+	var random [10]byte
+	if got := encodeULID(1469918176385, random); got != "01ARYZ6S410000000000000000" {
+		t.Fatalf("unexpected ULID %q", got)
+	}
+	for i := range random {
+		random[i] = 0xff
+	}
+	if got := encodeULID(1<<48-1, random); got != "7ZZZZZZZZZZZZZZZZZZZZZZZZZ" {
+		t.Fatalf("unexpected max ULID %q", got)
+	}
+}
+
+func TestULIDSortsInGenerationOrder(t *testing.T) {
+	clock := time.UnixMilli(1000)
+	gen := newULID(func() time.Time { return clock }, bytes.NewReader(bytes.Repeat([]byte{0xff}, 100)))
+
+	var got []string
+	for i := 0; i < 3; i++ {
+		got = append(got, gen())
+	}
+	// The clock stepping back must not break the order.
+	clock = time.UnixMilli(900)
+	got = append(got, gen())
+	clock = time.UnixMilli(2000)
+	got = append(got, gen())
+
+	if !sort.StringsAreSorted(got) {
+		t.Fatalf("expected sorted ids, got %v", got)
+	}
+	seen := make(map[string]bool)
+	for _, id := range got {
+		if len(id) != 26 || seen[id] {
+			t.Fatalf("unexpected id %q in %v", id, got)
+		}
+		seen[id] = true
+	}
+	// All-ones entropy wraps on the first increment and moves to the next
+	// millisecond.
+	if got[0][:10] != encodeULID(1000, [10]byte{})[:10] || got[1][:10] != encodeULID(1001, [10]byte{})[:10] {
+		t.Fatalf("expected a wrapped random part to advance the timestamp, got %v", got)
+	}
+}
+
+func TestSequential(t *testing.T) {
+	gen := Sequential("id-")
+	if a, b := gen(), gen(); a != "id-000000000001" || b != "id-000000000002" {
+		t.Fatalf("unexpected ids %q %q", a, b)
+	}
+}
+
+func TestForStrategy(t *testing.T) {
+	for _, name := range []string{"", StrategyUUID, StrategyULID} {
+		if gen, ok := ForStrategy(name); !ok || gen() == "" {
+			t.Fatalf("expected a generator for %q", name)
+		}
+	}
+	if _, ok := ForStrategy("snowflake"); ok {
+		t.Fatalf("expected unknown strategies to be rejected")
+	}
+}
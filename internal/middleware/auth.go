@@ -1,14 +1,21 @@
 package middleware
 
 import (
+	"context"
+	"errors"
 	"net/http"
 	"strings"
 
 	"github.com/gin-gonic/gin"
+	"happy-server-lite/internal/apierror"
 	"happy-server-lite/internal/auth"
 )
 
-const userIDContextKey = "userID"
+const (
+	userIDContextKey = "userID"
+	scopeContextKey  = "tokenScope"
+	deviceContextKey = "deviceID"
+)
 
 func UserIDFromContext(c *gin.Context) (string, bool) {
 	userID, ok := c.Get(userIDContextKey)
@@ -19,24 +26,117 @@ func UserIDFromContext(c *gin.Context) (string, bool) {
 	return value, ok && value != ""
 }
 
-func RequireAuth(cfg auth.TokenConfig) gin.HandlerFunc {
+// ScopeFromContext returns the scope of the request's token; the zero Scope
+// when it reaches the whole account.
+func ScopeFromContext(c *gin.Context) auth.Scope {
+	scope, _ := c.Get(scopeContextKey)
+	value, _ := scope.(auth.Scope)
+	return value
+}
+
+// scopeAllows reports whether a token confined to scope may call the matched
+// route: a session's token reaches /v1/sessions/:id for its session, a
+// machine's token /v1/machines/:id for its machine and POST /v1/machines,
+// whose handler checks the machine id in the body. Any token may renew
+// itself.
+func scopeAllows(scope auth.Scope, c *gin.Context) bool {
+	path := c.FullPath()
+	switch {
+	case scope.IsZero(), path == "/v1/auth/renew":
+		return true
+	case scope.SessionID != "":
+		return strings.HasPrefix(path, "/v1/sessions/:id") && c.Param("id") == scope.SessionID
+	case path == "/v1/machines":
+		return c.Request.Method == http.MethodPost
+	default:
+		return strings.HasPrefix(path, "/v1/machines/:id") && c.Param("id") == scope.MachineID
+	}
+}
+
+// APIKeyVerifier looks up the API key id whose secret hashes to secretHash
+// and returns its owner.
+type APIKeyVerifier func(ctx context.Context, id, secretHash string) (userID string, ok bool)
+
+// DeviceIDFromContext returns the signed-in device the request's token was
+// issued to; empty for tokens and API keys made for no device.
+func DeviceIDFromContext(c *gin.Context) string {
+	return c.GetString(deviceContextKey)
+}
+
+// apiKeyAllows keeps API keys away from the routes that manage credentials
+// or the account itself, so a leaked key cannot mint others or lock the
+// owner out.
+func apiKeyAllows(c *gin.Context) bool {
+	path := c.FullPath()
+	switch {
+	case strings.HasPrefix(path, "/v1/account/api-keys"), strings.HasPrefix(path, "/v1/account/devices"), strings.HasPrefix(path, "/v1/auth/"), strings.HasPrefix(path, "/v1/connect/"):
+		return false
+	case path == "/v1/account":
+		return c.Request.Method == http.MethodGet
+	}
+	return true
+}
+
+// RequireAuth accepts "Bearer <token>" and, when apiKeys is set,
+// "ApiKey <key>" credentials.
+func RequireAuth(cfg auth.TokenConfig, apiKeys APIKeyVerifier) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		authHeader := c.GetHeader("Authorization")
 		parts := strings.SplitN(authHeader, " ", 2)
+		if len(parts) == 2 && strings.EqualFold(parts[0], "ApiKey") && apiKeys != nil {
+			requireAPIKey(c, cfg, apiKeys, parts[1])
+			return
+		}
 		if len(parts) != 2 || !strings.EqualFold(parts[0], "Bearer") {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid authentication token"})
-			c.Abort()
+			apierror.Abort(c, http.StatusUnauthorized, apierror.CodeUnauthorized, "Invalid authentication token")
 			return
 		}
 
-		claims, err := auth.VerifyToken(parts[1], cfg)
+		ctx := auth.WithClientIP(c.Request.Context(), c.ClientIP())
+		claims, err := auth.VerifyToken(ctx, parts[1], cfg)
+		if errors.Is(err, auth.ErrAccountDisabled) {
+			apierror.Abort(c, http.StatusForbidden, apierror.CodeForbidden, "Account disabled")
+			return
+		}
 		if err != nil {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid authentication token"})
-			c.Abort()
+			apierror.Abort(c, http.StatusUnauthorized, apierror.CodeUnauthorized, "Invalid authentication token")
+			return
+		}
+
+		scope := claims.TokenScope()
+		if !scopeAllows(scope, c) {
+			apierror.Abort(c, http.StatusForbidden, apierror.CodeForbidden, "Token is scoped to another resource")
 			return
 		}
 
 		c.Set(userIDContextKey, claims.UserID)
+		c.Set(scopeContextKey, scope)
+		c.Set(deviceContextKey, claims.DeviceID)
 		c.Next()
 	}
 }
+
+func requireAPIKey(c *gin.Context, cfg auth.TokenConfig, apiKeys APIKeyVerifier, key string) {
+	ctx := c.Request.Context()
+	id, secret, ok := auth.ParseAPIKey(key)
+	var userID string
+	if ok {
+		userID, ok = apiKeys(ctx, id, auth.HashAPIKeySecret(secret))
+	}
+	if !ok || (cfg.Revocations != nil && cfg.Revocations.IsLocked(userID)) {
+		apierror.Abort(c, http.StatusUnauthorized, apierror.CodeUnauthorized, "Invalid authentication token")
+		return
+	}
+	if cfg.AccountDisabled != nil && cfg.AccountDisabled(ctx, userID) {
+		apierror.Abort(c, http.StatusForbidden, apierror.CodeForbidden, "Account disabled")
+		return
+	}
+	if !apiKeyAllows(c) {
+		apierror.Abort(c, http.StatusForbidden, apierror.CodeForbidden, "API keys cannot manage credentials or the account")
+		return
+	}
+
+	c.Set(userIDContextKey, userID)
+	c.Set(scopeContextKey, auth.Scope{})
+	c.Next()
+}
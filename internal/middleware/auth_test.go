@@ -19,7 +19,7 @@ func TestRequireAuth_SetsUserID(t *testing.T) {
 	}
 
 	r := gin.New()
-	r.GET("/", RequireAuth(auth.TokenConfig{Secret: secret, Expiry: time.Hour, Issuer: "test"}), func(c *gin.Context) {
+	r.GET("/", RequireAuth(auth.TokenConfig{Secret: secret, Expiry: time.Hour, Issuer: "test"}, nil), func(c *gin.Context) {
 		uid, ok := UserIDFromContext(c)
 		if !ok || uid != "user-1" {
 			c.Status(http.StatusInternalServerError)
@@ -36,3 +36,44 @@ func TestRequireAuth_SetsUserID(t *testing.T) {
 		t.Fatalf("expected 200, got %d", w.Code)
 	}
 }
+
+func TestRequireAuth_EnforcesTokenScope(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	cfg := auth.TokenConfig{Secret: "secret", Expiry: time.Hour, Issuer: "test"}
+	sessionTok, _ := auth.CreateScopedToken("user-1", auth.Scope{SessionID: "s1"}, cfg)
+	machineTok, _ := auth.CreateScopedToken("user-1", auth.Scope{MachineID: "m1"}, cfg)
+	userTok, _ := auth.CreateToken("user-1", cfg)
+
+	r := gin.New()
+	v1 := r.Group("/v1", RequireAuth(cfg, nil))
+	ok := func(c *gin.Context) { c.Status(http.StatusOK) }
+	v1.GET("/sessions", ok)
+	v1.GET("/sessions/:id/messages", ok)
+	v1.GET("/machines", ok)
+	v1.POST("/machines", ok)
+	v1.DELETE("/machines/:id", ok)
+
+	for _, tc := range []struct {
+		token, method, path string
+		want                int
+	}{
+		{sessionTok, http.MethodGet, "/v1/sessions/s1/messages", http.StatusOK},
+		{sessionTok, http.MethodGet, "/v1/sessions/s2/messages", http.StatusForbidden},
+		{sessionTok, http.MethodGet, "/v1/sessions", http.StatusForbidden},
+		{sessionTok, http.MethodPost, "/v1/machines", http.StatusForbidden},
+		{machineTok, http.MethodPost, "/v1/machines", http.StatusOK},
+		{machineTok, http.MethodGet, "/v1/machines", http.StatusForbidden},
+		{machineTok, http.MethodDelete, "/v1/machines/m1", http.StatusOK},
+		{machineTok, http.MethodDelete, "/v1/machines/m2", http.StatusForbidden},
+		{machineTok, http.MethodGet, "/v1/sessions/s1/messages", http.StatusForbidden},
+		{userTok, http.MethodGet, "/v1/sessions", http.StatusOK},
+	} {
+		req := httptest.NewRequest(tc.method, tc.path, nil)
+		req.Header.Set("Authorization", "Bearer "+tc.token)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != tc.want {
+			t.Fatalf("%s %s: expected %d, got %d", tc.method, tc.path, tc.want, w.Code)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package middleware
+
+import (
+	"maps"
+	"net/http"
+	"runtime"
+	"runtime/metrics"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"happy-server-lite/internal/apierror"
+)
+
+// heapMetric is the live heap, which tracks what the in-memory store holds
+// more closely than the memory the runtime has mapped.
+const heapMetric = "/memory/classes/heap/objects:bytes"
+
+// loadSampleInterval bounds how often the shedder reads the runtime, so
+// checking every request stays cheap.
+const loadSampleInterval = time.Second
+
+// LoadShedLimits are the pressure thresholds past which low-priority
+// requests are turned away. Zero disables either check.
+type LoadShedLimits struct {
+	MaxHeapBytes  uint64
+	MaxGoroutines int
+}
+
+// LoadShedder rejects low-priority requests, such as the feed, user search
+// and account export, with 503 while the process is over its limits, so
+// the memory they would allocate goes to sign-ins, sync and messages
+// instead of running the in-memory store out of memory.
+type LoadShedder struct {
+	limits LoadShedLimits
+	now    func() time.Time
+	sample func() (heapBytes uint64, goroutines int)
+
+	mu         sync.Mutex
+	sampledAt  time.Time
+	heapBytes  uint64
+	goroutines int
+
+	shedMu sync.Mutex
+	shed   map[string]int64
+	total  int64
+}
+
+// LoadShedStats reports the last sample and how many requests were shed,
+// in total and by route.
+type LoadShedStats struct {
+	Overloaded    bool             `json:"overloaded"`
+	HeapBytes     uint64           `json:"heapBytes"`
+	Goroutines    int              `json:"goroutines"`
+	MaxHeapBytes  uint64           `json:"maxHeapBytes,omitempty"`
+	MaxGoroutines int              `json:"maxGoroutines,omitempty"`
+	Shed          int64            `json:"shed"`
+	ShedByRoute   map[string]int64 `json:"shedByRoute"`
+}
+
+func NewLoadShedder(limits LoadShedLimits) *LoadShedder {
+	return &LoadShedder{limits: limits, now: time.Now, sample: sampleRuntime, shed: make(map[string]int64)}
+}
+
+func sampleRuntime() (uint64, int) {
+	s := []metrics.Sample{{Name: heapMetric}}
+	metrics.Read(s)
+	var heap uint64
+	if s[0].Value.Kind() == metrics.KindUint64 {
+		heap = s[0].Value.Uint64()
+	}
+	return heap, runtime.NumGoroutine()
+}
+
+// load returns the current sample, reading the runtime at most once per
+// loadSampleInterval.
+func (s *LoadShedder) load() (uint64, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if now := s.now(); s.sampledAt.IsZero() || now.Sub(s.sampledAt) >= loadSampleInterval {
+		s.heapBytes, s.goroutines = s.sample()
+		s.sampledAt = now
+	}
+	return s.heapBytes, s.goroutines
+}
+
+func (s *LoadShedder) overloaded(heapBytes uint64, goroutines int) bool {
+	return (s.limits.MaxHeapBytes > 0 && heapBytes > s.limits.MaxHeapBytes) ||
+		(s.limits.MaxGoroutines > 0 && goroutines > s.limits.MaxGoroutines)
+}
+
+// Overloaded reports whether low-priority requests are being shed.
+func (s *LoadShedder) Overloaded() bool {
+	return s.overloaded(s.load())
+}
+
+func (s *LoadShedder) count(route string) {
+	s.shedMu.Lock()
+	s.total++
+	s.shed[route]++
+	s.shedMu.Unlock()
+}
+
+// Stats returns the pressure and shed counts for the admin metrics.
+func (s *LoadShedder) Stats() LoadShedStats {
+	heapBytes, goroutines := s.load()
+	stats := LoadShedStats{
+		Overloaded:    s.overloaded(heapBytes, goroutines),
+		HeapBytes:     heapBytes,
+		Goroutines:    goroutines,
+		MaxHeapBytes:  s.limits.MaxHeapBytes,
+		MaxGoroutines: s.limits.MaxGoroutines,
+	}
+	s.shedMu.Lock()
+	stats.Shed = s.total
+	stats.ShedByRoute = maps.Clone(s.shed)
+	s.shedMu.Unlock()
+	return stats
+}
+
+// Middleware sheds the routes it is attached to while overloaded; a nil
+// shedder lets everything through.
+func (s *LoadShedder) Middleware() gin.HandlerFunc {
+	if s == nil {
+		return func(c *gin.Context) { c.Next() }
+	}
+	return func(c *gin.Context) {
+		if s.Overloaded() {
+			s.count(c.FullPath())
+			c.Header("Retry-After", "5")
+			apierror.Abort(c, http.StatusServiceUnavailable, apierror.CodeUnavailable, "Server is overloaded")
+			return
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,58 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestLoadShedder_ShedsWhileOverloaded(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	clock := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	heap := uint64(100)
+	s := NewLoadShedder(LoadShedLimits{MaxHeapBytes: 1000, MaxGoroutines: 50})
+	s.now = func() time.Time { return clock }
+	s.sample = func() (uint64, int) { return heap, 10 }
+
+	r := gin.New()
+	r.GET("/feed", s.Middleware(), func(c *gin.Context) { c.Status(http.StatusOK) })
+	get := func() int {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/feed", nil))
+		return w.Code
+	}
+
+	if code := get(); code != http.StatusOK {
+		t.Fatalf("expected 200 under the limits, got %d", code)
+	}
+	// The sample is reused until the interval passes.
+	heap = 2000
+	if code := get(); code != http.StatusOK {
+		t.Fatalf("expected the cached sample to be used, got %d", code)
+	}
+	clock = clock.Add(loadSampleInterval)
+	if code := get(); code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 over the heap limit, got %d", code)
+	}
+	stats := s.Stats()
+	if !stats.Overloaded || stats.Shed != 1 || stats.ShedByRoute["/feed"] != 1 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+
+	heap = 100
+	clock = clock.Add(loadSampleInterval)
+	if code := get(); code != http.StatusOK {
+		t.Fatalf("expected 200 once the pressure is gone, got %d", code)
+	}
+}
+
+func TestLoadShedder_GoroutineLimit(t *testing.T) {
+	s := NewLoadShedder(LoadShedLimits{MaxGoroutines: 50})
+	s.sample = func() (uint64, int) { return 1 << 40, 51 }
+	if !s.Overloaded() {
+		t.Fatalf("expected too many goroutines to count as overloaded")
+	}
+}
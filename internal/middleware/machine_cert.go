@@ -0,0 +1,33 @@
+package middleware
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"happy-server-lite/internal/apierror"
+	"happy-server-lite/internal/auth"
+)
+
+// MachineCert binds a verified client certificate to the machine named by
+// its common name: the request's context carries that machine id, and a
+// route's :id must be it. Requests without a certificate pass, unless
+// required, as apps reach the same routes with their token alone.
+func MachineCert(required bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		machineID, ok := auth.MachineCertID(c.Request)
+		if !ok {
+			if required {
+				apierror.Abort(c, http.StatusUnauthorized, apierror.CodeUnauthorized, "Client certificate required")
+				return
+			}
+			c.Next()
+			return
+		}
+		if id := c.Param("id"); id != "" && id != machineID {
+			apierror.Abort(c, http.StatusForbidden, apierror.CodeForbidden, "Client certificate is for another machine")
+			return
+		}
+		c.Request = c.Request.WithContext(auth.WithMachineCert(c.Request.Context(), machineID))
+		c.Next()
+	}
+}
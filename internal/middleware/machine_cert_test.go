@@ -0,0 +1,54 @@
+package middleware
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"happy-server-lite/internal/auth"
+)
+
+// withMachineCert makes req look as if it came with a verified client
+// certificate for machineID.
+func withMachineCert(req *http.Request, machineID string) *http.Request {
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: machineID}}
+	req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+	return req
+}
+
+func TestMachineCert(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	handler := func(c *gin.Context) {
+		id, _ := auth.MachineCertFromContext(c.Request.Context())
+		c.String(http.StatusOK, id)
+	}
+	r.POST("/machines", MachineCert(true), handler)
+	r.DELETE("/machines/:id", MachineCert(false), handler)
+
+	for _, tc := range []struct {
+		method, path, cert string
+		want               int
+		body               string
+	}{
+		{http.MethodPost, "/machines", "m1", http.StatusOK, "m1"},
+		{http.MethodPost, "/machines", "", http.StatusUnauthorized, ""},
+		{http.MethodDelete, "/machines/m1", "m1", http.StatusOK, "m1"},
+		{http.MethodDelete, "/machines/m2", "m1", http.StatusForbidden, ""},
+		{http.MethodDelete, "/machines/m2", "", http.StatusOK, ""},
+	} {
+		req := httptest.NewRequest(tc.method, tc.path, nil)
+		if tc.cert != "" {
+			req = withMachineCert(req, tc.cert)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != tc.want || (tc.want == http.StatusOK && w.Body.String() != tc.body) {
+			t.Fatalf("%s %s with cert %q: got %d %q", tc.method, tc.path, tc.cert, w.Code, w.Body.String())
+		}
+	}
+}
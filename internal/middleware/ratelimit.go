@@ -6,6 +6,7 @@ import (
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"happy-server-lite/internal/apierror"
 )
 
 type RateLimiter struct {
@@ -79,10 +80,204 @@ func RateLimitMiddleware(rl *RateLimiter) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		key := c.ClientIP()
 		if !rl.Allow(key) {
-			c.JSON(http.StatusTooManyRequests, gin.H{"error": "Rate limit exceeded"})
-			c.Abort()
+			apierror.Abort(c, http.StatusTooManyRequests, apierror.CodeRateLimited, "Rate limit exceeded")
 			return
 		}
 		c.Next()
 	}
 }
+
+// Rate limit groups applied to the HTTP routes. Auth covers the
+// unauthenticated sign-in endpoints, read and write split the other /v1
+// routes by method, and socket-upgrade covers new realtime connections.
+const (
+	RateLimitAuth          = "auth"
+	RateLimitRead          = "read"
+	RateLimitWrite         = "write"
+	RateLimitSocketUpgrade = "socket-upgrade"
+)
+
+// RateLimit allows Limit requests per client IP every Window.
+type RateLimit struct {
+	Limit  int
+	Window time.Duration
+}
+
+// DefaultRateLimits suits a lite instance serving one user's few devices,
+// which may share an IP: generous enough for auth polling and sync bursts,
+// low enough to blunt a misbehaving client.
+func DefaultRateLimits() map[string]RateLimit {
+	return map[string]RateLimit{
+		RateLimitAuth:          {Limit: 120, Window: time.Minute},
+		RateLimitRead:          {Limit: 1200, Window: time.Minute},
+		RateLimitWrite:         {Limit: 600, Window: time.Minute},
+		RateLimitSocketUpgrade: {Limit: 30, Window: time.Minute},
+	}
+}
+
+// RateLimitGroups holds one limiter per configured group.
+type RateLimitGroups struct {
+	limiters map[string]*RateLimiter
+}
+
+// NewRateLimitGroups builds limiters for limits; groups left out are not
+// limited.
+func NewRateLimitGroups(limits map[string]RateLimit) *RateLimitGroups {
+	g := &RateLimitGroups{limiters: make(map[string]*RateLimiter, len(limits))}
+	for group, rl := range limits {
+		g.limiters[group] = NewRateLimiter(rl.Limit, rl.Window)
+	}
+	return g
+}
+
+// Middleware limits requests with the group's limiter.
+func (g *RateLimitGroups) Middleware(group string) gin.HandlerFunc {
+	rl, ok := g.limiters[group]
+	if !ok {
+		return func(c *gin.Context) { c.Next() }
+	}
+	return RateLimitMiddleware(rl)
+}
+
+// ReadWriteMiddleware limits GET, HEAD and OPTIONS requests with the read
+// group and all others with the write group.
+func (g *RateLimitGroups) ReadWriteMiddleware() gin.HandlerFunc {
+	read, write := g.Middleware(RateLimitRead), g.Middleware(RateLimitWrite)
+	return func(c *gin.Context) {
+		switch c.Request.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			read(c)
+		default:
+			write(c)
+		}
+	}
+}
+
+// FailureLimit locks a key out once it has failed After times in a row, for
+// Lockout at first and twice as long with each failure after, up to
+// MaxLockout. A key's failures are forgotten once it has been quiet for
+// MaxLockout. Zero durations pick a minute and an hour.
+type FailureLimit struct {
+	After      int
+	Lockout    time.Duration
+	MaxLockout time.Duration
+}
+
+// FailureLimiter is a RateLimiter that counts only what failed, so clients
+// that get it right are never held up however often they ask.
+type FailureLimiter struct {
+	mu       sync.Mutex
+	failures map[string]*failureInfo
+	limit    FailureLimit
+	now      func() time.Time
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+type failureInfo struct {
+	count       int
+	lastFailure time.Time
+	lockedUntil time.Time
+}
+
+func NewFailureLimiter(limit FailureLimit) *FailureLimiter {
+	return NewFailureLimiterWithNow(limit, time.Now)
+}
+
+func NewFailureLimiterWithNow(limit FailureLimit, now func() time.Time) *FailureLimiter {
+	if limit.Lockout <= 0 {
+		limit.Lockout = time.Minute
+	}
+	if limit.MaxLockout <= 0 {
+		limit.MaxLockout = time.Hour
+	}
+	limit.MaxLockout = max(limit.MaxLockout, limit.Lockout)
+	fl := &FailureLimiter{
+		failures: make(map[string]*failureInfo),
+		limit:    limit,
+		now:      now,
+		stop:     make(chan struct{}),
+	}
+	go fl.cleanup()
+	return fl
+}
+
+// Stop ends the goroutine that drops forgotten failures. The limiter keeps
+// working, holding on to them.
+func (fl *FailureLimiter) Stop() {
+	fl.stopOnce.Do(func() { close(fl.stop) })
+}
+
+func (fl *FailureLimiter) cleanup() {
+	ticker := time.NewTicker(fl.limit.MaxLockout)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-fl.stop:
+			return
+		case <-ticker.C:
+		}
+		fl.mu.Lock()
+		now := fl.now()
+		for key, info := range fl.failures {
+			if fl.forgotten(info, now) {
+				delete(fl.failures, key)
+			}
+		}
+		fl.mu.Unlock()
+	}
+}
+
+// forgotten reports whether info's failures are old enough to start over.
+func (fl *FailureLimiter) forgotten(info *failureInfo, now time.Time) bool {
+	return now.After(info.lockedUntil) && now.Sub(info.lastFailure) >= fl.limit.MaxLockout
+}
+
+// Locked reports whether key is locked out, and for how much longer.
+func (fl *FailureLimiter) Locked(key string) (time.Duration, bool) {
+	fl.mu.Lock()
+	defer fl.mu.Unlock()
+
+	info, exists := fl.failures[key]
+	if !exists {
+		return 0, false
+	}
+	left := info.lockedUntil.Sub(fl.now())
+	if left <= 0 {
+		return 0, false
+	}
+	return left, true
+}
+
+// Fail counts a failure of key, locking it out once it has failed After
+// times.
+func (fl *FailureLimiter) Fail(key string) {
+	fl.mu.Lock()
+	defer fl.mu.Unlock()
+
+	now := fl.now()
+	info, exists := fl.failures[key]
+	if !exists || fl.forgotten(info, now) {
+		info = &failureInfo{}
+		fl.failures[key] = info
+	}
+	info.count++
+	info.lastFailure = now
+	if info.count < fl.limit.After {
+		return
+	}
+	lockout := fl.limit.Lockout
+	for i := fl.limit.After; i < info.count && lockout < fl.limit.MaxLockout; i++ {
+		lockout *= 2
+	}
+	info.lockedUntil = now.Add(min(lockout, fl.limit.MaxLockout))
+}
+
+// Succeed forgets key's failures.
+func (fl *FailureLimiter) Succeed(key string) {
+	fl.mu.Lock()
+	defer fl.mu.Unlock()
+
+	delete(fl.failures, key)
+}
@@ -1,8 +1,12 @@
 package middleware
 
 import (
+	"net/http"
+	"net/http/httptest"
 	"testing"
 	"time"
+
+	"github.com/gin-gonic/gin"
 )
 
 func TestRateLimiter_AllowAndDeny(t *testing.T) {
@@ -25,3 +29,76 @@ func TestRateLimiter_AllowAndDeny(t *testing.T) {
 		t.Fatalf("expected allow after window")
 	}
 }
+
+func TestFailureLimiter_LocksOutWithBackoff(t *testing.T) {
+	clock := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	fl := NewFailureLimiterWithNow(FailureLimit{After: 3, Lockout: time.Minute, MaxLockout: 5 * time.Minute}, func() time.Time { return clock })
+
+	fl.Fail("ip")
+	fl.Fail("ip")
+	if _, locked := fl.Locked("ip"); locked {
+		t.Fatalf("expected no lockout before the third failure")
+	}
+	fl.Fail("ip")
+	if left, locked := fl.Locked("ip"); !locked || left != time.Minute {
+		t.Fatalf("expected a minute's lockout, got %v %v", left, locked)
+	}
+
+	// Each failure after doubles the lockout, up to the cap.
+	for _, want := range []time.Duration{2 * time.Minute, 4 * time.Minute, 5 * time.Minute} {
+		left, _ := fl.Locked("ip")
+		clock = clock.Add(left)
+		fl.Fail("ip")
+		if left, _ := fl.Locked("ip"); left != want {
+			t.Fatalf("expected %v, got %v", want, left)
+		}
+	}
+
+	fl.Succeed("ip")
+	if _, locked := fl.Locked("ip"); locked {
+		t.Fatalf("expected success to clear the lockout")
+	}
+
+	// Failures far enough apart are forgotten.
+	fl.Fail("key")
+	fl.Fail("key")
+	clock = clock.Add(5 * time.Minute)
+	fl.Fail("key")
+	if _, locked := fl.Locked("key"); locked {
+		t.Fatalf("expected old failures to be forgotten")
+	}
+}
+
+func TestRateLimitGroups_ReadWriteSplit(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	groups := NewRateLimitGroups(map[string]RateLimit{
+		RateLimitRead:  {Limit: 2, Window: time.Minute},
+		RateLimitWrite: {Limit: 1, Window: time.Minute},
+	})
+	r := gin.New()
+	r.Use(groups.ReadWriteMiddleware())
+	r.GET("/", func(c *gin.Context) { c.Status(http.StatusOK) })
+	r.POST("/", func(c *gin.Context) { c.Status(http.StatusOK) })
+	r.GET("/auth", groups.Middleware(RateLimitAuth), func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	do := func(method, path string) int {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(method, path, nil))
+		return w.Code
+	}
+	for _, want := range []int{http.StatusOK, http.StatusTooManyRequests} {
+		if code := do(http.MethodPost, "/"); code != want {
+			t.Fatalf("POST: expected %d, got %d", want, code)
+		}
+	}
+	if code := do(http.MethodGet, "/"); code != http.StatusOK {
+		t.Fatalf("expected reads to have their own budget, got %d", code)
+	}
+	// /auth counts against read too, but the auth group itself is unlimited.
+	if code := do(http.MethodGet, "/auth"); code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", code)
+	}
+	if code := do(http.MethodGet, "/"); code != http.StatusTooManyRequests {
+		t.Fatalf("expected read budget to be spent, got %d", code)
+	}
+}
@@ -13,8 +13,23 @@ type AuthRequest struct {
 	Response          string
 	ResponseAccountID string
 	Token             string
-	CreatedAt         int64
-	UpdatedAt         int64
+	// Rejected is set when a signed-in device declined the request. It stays
+	// set until the request is approved.
+	Rejected bool
+	// Device is what the requesting device reported about itself; nil when
+	// it sent nothing.
+	Device    *AuthRequestDevice
+	CreatedAt int64
+	UpdatedAt int64
+}
+
+// AuthRequestDevice describes the device behind an auth request so the
+// approving device can show what is asking for access. It is self-reported
+// and unverified.
+type AuthRequestDevice struct {
+	Platform   string
+	Hostname   string
+	AppVersion string
 }
 
 type Session struct {
@@ -39,8 +54,36 @@ type SessionMessage struct {
 	SessionID string
 	Seq       int64
 	Content   string
+	Checksum  string
+	LocalID   string
+	// Deleted marks a tombstone, kept so seqs stay consecutive; its content
+	// and checksum are cleared.
+	Deleted   bool
 	CreatedAt int64
 	UpdatedAt int64
+	// Annotations are the small values clients attached to the message by
+	// key, such as a bookmark; nil when there are none.
+	Annotations map[string]MessageAnnotation
+}
+
+// MessageAnnotation is a client-encrypted value. Version starts at 1 and is
+// bumped by every write of the key.
+type MessageAnnotation struct {
+	Value     string
+	Version   int
+	UpdatedAt int64
+}
+
+// SessionLock is an advisory lock on a session, held by whoever has its
+// Token until ExpiresAt unless renewed. Holder is a label the holder chose,
+// shown to the others.
+type SessionLock struct {
+	SessionID  string
+	Name       string
+	Holder     string
+	Token      string
+	AcquiredAt int64
+	ExpiresAt  int64
 }
 
 type Machine struct {
@@ -63,8 +106,82 @@ type Artifact struct {
 	Body             string
 	BodyVersion      int
 	DataEncryptionKey string
+	HeaderChecksum   string
+	BodyChecksum     string
 	Seq              int64
 	CreatedAt        int64
 	UpdatedAt        int64
 	Deleted          bool
 }
+
+// PushToken is a device's push notification address registered by a
+// signed-in client.
+type PushToken struct {
+	UserID string
+	Token  string
+	// Locale is the device's language, such as "de" or "pt-BR", that
+	// notifications are worded in; empty for the default.
+	Locale    string
+	CreatedAt int64
+	UpdatedAt int64
+}
+
+// RefreshToken is a device's grant to new access tokens. Only hashes of its
+// secret are kept: the current one, and the one it was last rotated from, so
+// a replay of a used secret can be told from a guess.
+type RefreshToken struct {
+	ID     string
+	UserID string
+	// DeviceID is the registered device the grant's access tokens are
+	// issued to; empty for grants made before devices were tracked.
+	DeviceID     string
+	Device       *AuthRequestDevice
+	SecretHash   string
+	PreviousHash string
+	CreatedAt    int64
+	LastUsedAt   int64
+	ExpiresAt    int64
+}
+
+// APIKey is a named long-lived credential for automation such as CI bots.
+// Only a hash of its secret is kept.
+type APIKey struct {
+	ID         string
+	UserID     string
+	Name       string
+	SecretHash string
+	CreatedAt  int64
+	LastUsedAt int64
+}
+
+// Device is a signed-in device. The access tokens and refresh grant issued
+// to it carry its ID, so deleting it signs the device out.
+type Device struct {
+	ID         string
+	UserID     string
+	Device     *AuthRequestDevice
+	CreatedAt  int64
+	LastSeenAt int64
+	LastSeenIP string
+	// ExpiresAt is when the last token issued to the device runs out.
+	ExpiresAt int64
+}
+
+// GitHubIdentity is the GitHub user an account connected through OAuth.
+// Only the public profile is kept, not the access token.
+type GitHubIdentity struct {
+	ID        int64
+	Login     string
+	Name      string
+	AvatarURL string
+	LinkedAt  int64
+}
+
+// Tombstone records a deleted session or machine so offline clients can
+// drop their local copy on the next sync.
+type Tombstone struct {
+	Kind      string
+	ID        string
+	UserID    string
+	DeletedAt int64
+}
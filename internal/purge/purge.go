@@ -0,0 +1,95 @@
+// Package purge periodically removes soft-deleted sessions and artifacts and
+// expired tombstones from a store, and keeps counters of what it removed for
+// the admin API.
+package purge
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"happy-server-lite/internal/clock"
+	"happy-server-lite/internal/store"
+)
+
+const defaultInterval = time.Hour
+
+// Stats summarizes the purges run since the process started.
+type Stats struct {
+	Runs      int64            `json:"runs"`
+	LastRunAt int64            `json:"lastRunAt,omitempty"`
+	LastError string           `json:"lastError,omitempty"`
+	Last      store.PurgeStats `json:"last"`
+	Total     store.PurgeStats `json:"total"`
+}
+
+type Runner struct {
+	store store.Purger
+	clock clock.Clock
+
+	// runMu keeps a manual purge from overlapping a scheduled one.
+	runMu sync.Mutex
+
+	mu    sync.Mutex
+	stats Stats
+}
+
+func New(p store.Purger) *Runner {
+	return &Runner{store: p}
+}
+
+// NewWithClock is New with the clock scheduled purges read the time from.
+func NewWithClock(p store.Purger, c clock.Clock) *Runner {
+	return &Runner{store: p, clock: c}
+}
+
+// RunOnce purges as of now and records the outcome.
+func (r *Runner) RunOnce(ctx context.Context, now time.Time) (store.PurgeStats, error) {
+	r.runMu.Lock()
+	defer r.runMu.Unlock()
+
+	removed, err := r.store.Purge(ctx, now.UnixMilli())
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.stats.Runs++
+	r.stats.LastRunAt = now.UnixMilli()
+	r.stats.Last = removed
+	r.stats.LastError = ""
+	if err != nil {
+		r.stats.LastError = err.Error()
+	}
+	r.stats.Total.Sessions += removed.Sessions
+	r.stats.Total.Artifacts += removed.Artifacts
+	r.stats.Total.Tombstones += removed.Tombstones
+	return removed, err
+}
+
+// Run purges every interval (zero picks one hour) until ctx is done.
+func (r *Runner) Run(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		interval = defaultInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			removed, err := r.RunOnce(ctx, clock.Now(r.clock))
+			if err != nil {
+				log.Printf("purge: %v", err)
+			} else if removed != (store.PurgeStats{}) {
+				log.Printf("purge: removed %d sessions, %d artifacts, %d tombstones", removed.Sessions, removed.Artifacts, removed.Tombstones)
+			}
+		}
+	}
+}
+
+func (r *Runner) Stats() Stats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.stats
+}
@@ -0,0 +1,41 @@
+package purge
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"happy-server-lite/internal/store"
+)
+
+type fakePurger struct {
+	results []store.PurgeStats
+	err     error
+}
+
+func (f *fakePurger) Purge(context.Context, int64) (store.PurgeStats, error) {
+	r := f.results[0]
+	f.results = f.results[1:]
+	return r, f.err
+}
+
+func TestRunnerAccumulatesStats(t *testing.T) {
+	ctx := context.Background()
+	p := &fakePurger{results: []store.PurgeStats{{Sessions: 2, Tombstones: 1}, {Artifacts: 3}}}
+	r := New(p)
+	now := time.UnixMilli(1000)
+	if _, err := r.RunOnce(ctx, now); err != nil {
+		t.Fatalf("RunOnce: %v", err)
+	}
+	p.err = errors.New("boom")
+	if _, err := r.RunOnce(ctx, now.Add(time.Second)); err == nil {
+		t.Fatal("expected error")
+	}
+
+	stats := r.Stats()
+	want := store.PurgeStats{Sessions: 2, Artifacts: 3, Tombstones: 1}
+	if stats.Runs != 2 || stats.LastRunAt != 2000 || stats.LastError != "boom" || stats.Total != want || stats.Last != (store.PurgeStats{Artifacts: 3}) {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
@@ -0,0 +1,86 @@
+// Package push delivers notifications to the devices of an account through a
+// push service.
+package push
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// Notification is one message for the device registered under To.
+type Notification struct {
+	To    string         `json:"to"`
+	Title string         `json:"title,omitempty"`
+	Body  string         `json:"body,omitempty"`
+	Data  map[string]any `json:"data,omitempty"`
+}
+
+type Sender interface {
+	Send(ctx context.Context, notifications []Notification) error
+}
+
+// DefaultExpoURL is the Expo push API the Happy apps register tokens with.
+const DefaultExpoURL = "https://exp.host/--/api/v2/push/send"
+
+type ExpoConfig struct {
+	// URL defaults to DefaultExpoURL.
+	URL string
+	// AccessToken is required only when the Expo project enforces push
+	// security.
+	AccessToken string
+	HTTPClient  *http.Client
+}
+
+// Expo sends notifications through the Expo push API.
+type Expo struct {
+	cfg    ExpoConfig
+	client *http.Client
+}
+
+func NewExpo(cfg ExpoConfig) *Expo {
+	if cfg.URL == "" {
+		cfg.URL = DefaultExpoURL
+	}
+	client := cfg.HTTPClient
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	return &Expo{cfg: cfg, client: client}
+}
+
+// Send posts notifications in one request. Per-token delivery failures are
+// reported by Expo in the response and are not returned as errors.
+func (e *Expo) Send(ctx context.Context, notifications []Notification) error {
+	if len(notifications) == 0 {
+		return nil
+	}
+	payload, err := json.Marshal(notifications)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.cfg.URL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	if e.cfg.AccessToken != "" {
+		req.Header.Set("Authorization", "Bearer "+e.cfg.AccessToken)
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("expo push: %s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	return nil
+}
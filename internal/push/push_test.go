@@ -0,0 +1,46 @@
+package push
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestExpoSendPostsNotifications(t *testing.T) {
+	var got []Notification
+	var auth string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Errorf("decode: %v", err)
+		}
+		_, _ = w.Write([]byte(`{"data":[{"status":"ok","id":"1"}]}`))
+	}))
+	defer srv.Close()
+
+	expo := NewExpo(ExpoConfig{URL: srv.URL, AccessToken: "secret"})
+	err := expo.Send(context.Background(), []Notification{{To: "ExponentPushToken[a]", Title: "t", Body: "b"}})
+	if err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if auth != "Bearer secret" {
+		t.Fatalf("expected bearer auth, got %q", auth)
+	}
+	if len(got) != 1 || got[0].To != "ExponentPushToken[a]" || got[0].Title != "t" {
+		t.Fatalf("unexpected payload: %+v", got)
+	}
+}
+
+func TestExpoSendReportsHTTPErrors(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "nope", http.StatusBadRequest)
+	}))
+	defer srv.Close()
+
+	err := NewExpo(ExpoConfig{URL: srv.URL}).Send(context.Background(), []Notification{{To: "x"}})
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+}
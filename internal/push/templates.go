@@ -0,0 +1,138 @@
+package push
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+	"text/template"
+)
+
+// Event types with notification text. Clients encrypt everything they
+// store, so these are the only notifications the server can word itself.
+const (
+	EventAuthRequest = "auth-request"
+)
+
+// DefaultLocale is used for devices that registered no locale, or one no
+// template is written in.
+const DefaultLocale = "en"
+
+// Template is the text of one event's notifications in one locale. Title
+// and Body are text/template sources, executed with the event's data, such
+// as {{.publicKey}} for EventAuthRequest.
+type Template struct {
+	Title string `json:"title"`
+	Body  string `json:"body"`
+}
+
+// Templates holds notification text by event type, then by locale.
+type Templates struct {
+	byEvent map[string]map[string]compiledTemplate
+}
+
+type compiledTemplate struct {
+	title *template.Template
+	body  *template.Template
+}
+
+func defaultTemplates() map[string]map[string]Template {
+	return map[string]map[string]Template{
+		EventAuthRequest: {
+			DefaultLocale: {
+				Title: "New device wants access",
+				Body:  "Open Happy to approve or ignore the sign-in request.",
+			},
+		},
+	}
+}
+
+// DefaultTemplates returns the built-in English text.
+var DefaultTemplates = sync.OnceValue(func() *Templates {
+	t, err := NewTemplates(nil)
+	if err != nil {
+		panic(err)
+	}
+	return t
+})
+
+// NewTemplates compiles templates over the built-in ones: an event or locale
+// templates leaves out keeps its built-in text.
+func NewTemplates(templates map[string]map[string]Template) (*Templates, error) {
+	merged := defaultTemplates()
+	for event, locales := range templates {
+		if _, ok := merged[event]; !ok {
+			return nil, fmt.Errorf("push templates: unknown event type %q", event)
+		}
+		for locale, tmpl := range locales {
+			merged[event][normalizeLocale(locale)] = tmpl
+		}
+	}
+	t := &Templates{byEvent: make(map[string]map[string]compiledTemplate, len(merged))}
+	for event, locales := range merged {
+		t.byEvent[event] = make(map[string]compiledTemplate, len(locales))
+		for locale, tmpl := range locales {
+			if locale == "" || tmpl.Title == "" || tmpl.Body == "" {
+				return nil, fmt.Errorf("push templates: %s needs a locale, title and body", event)
+			}
+			name := event + "/" + locale
+			title, err := template.New(name).Option("missingkey=zero").Parse(tmpl.Title)
+			if err != nil {
+				return nil, fmt.Errorf("push templates: %w", err)
+			}
+			body, err := template.New(name).Option("missingkey=zero").Parse(tmpl.Body)
+			if err != nil {
+				return nil, fmt.Errorf("push templates: %w", err)
+			}
+			t.byEvent[event][locale] = compiledTemplate{title: title, body: body}
+		}
+	}
+	return t, nil
+}
+
+// normalizeLocale lower-cases a locale and uses "-" between its parts, so
+// "pt_BR" and "pt-br" name the same templates.
+func normalizeLocale(locale string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(locale), "_", "-"))
+}
+
+// lookup picks the templates for locale, falling back to its language and
+// then to DefaultLocale.
+func (t *Templates) lookup(event, locale string) (compiledTemplate, bool) {
+	locales, ok := t.byEvent[event]
+	if !ok {
+		return compiledTemplate{}, false
+	}
+	locale = normalizeLocale(locale)
+	for locale != "" {
+		if tmpl, ok := locales[locale]; ok {
+			return tmpl, true
+		}
+		i := strings.LastIndexByte(locale, '-')
+		if i < 0 {
+			break
+		}
+		locale = locale[:i]
+	}
+	tmpl, ok := locales[DefaultLocale]
+	return tmpl, ok
+}
+
+// Render returns the title and body of event's notification for a device
+// in locale.
+func (t *Templates) Render(event, locale string, data map[string]any) (title, body string, err error) {
+	tmpl, ok := t.lookup(event, locale)
+	if !ok {
+		return "", "", fmt.Errorf("push templates: no text for %q", event)
+	}
+	var buf bytes.Buffer
+	if err := tmpl.title.Execute(&buf, data); err != nil {
+		return "", "", err
+	}
+	title = buf.String()
+	buf.Reset()
+	if err := tmpl.body.Execute(&buf, data); err != nil {
+		return "", "", err
+	}
+	return title, buf.String(), nil
+}
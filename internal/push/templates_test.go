@@ -0,0 +1,39 @@
+package push
+
+import "testing"
+
+func TestTemplatesRenderFallsBackByLocale(t *testing.T) {
+	templates, err := NewTemplates(map[string]map[string]Template{
+		EventAuthRequest: {
+			"pt":    {Title: "Novo dispositivo", Body: "Chave {{.publicKey}}"},
+			"pt_BR": {Title: "Novo aparelho", Body: "Chave {{.publicKey}}"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewTemplates: %v", err)
+	}
+	data := map[string]any{"publicKey": "pk"}
+	for _, tc := range []struct{ locale, title, body string }{
+		{"pt-BR", "Novo aparelho", "Chave pk"},
+		{"pt-PT", "Novo dispositivo", "Chave pk"},
+		{"fr", "New device wants access", "Open Happy to approve or ignore the sign-in request."},
+		{"", "New device wants access", "Open Happy to approve or ignore the sign-in request."},
+	} {
+		title, body, err := templates.Render(EventAuthRequest, tc.locale, data)
+		if err != nil || title != tc.title || body != tc.body {
+			t.Fatalf("Render(%q) = %q, %q, %v", tc.locale, title, body, err)
+		}
+	}
+}
+
+func TestNewTemplatesRejectsInvalidTemplates(t *testing.T) {
+	for name, templates := range map[string]map[string]map[string]Template{
+		"unknown event": {"session-done": {"en": {Title: "t", Body: "b"}}},
+		"empty body":    {EventAuthRequest: {"de": {Title: "t"}}},
+		"bad syntax":    {EventAuthRequest: {"de": {Title: "{{.publicKey", Body: "b"}}},
+	} {
+		if _, err := NewTemplates(templates); err == nil {
+			t.Fatalf("%s: expected an error", name)
+		}
+	}
+}
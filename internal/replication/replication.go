@@ -0,0 +1,326 @@
+// Package replication keeps a warm standby's store in step with a primary
+// instance: the standby loads a snapshot from the primary's admin API, then
+// tails its replication log, until an operator promotes it.
+package replication
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"happy-server-lite/internal/clock"
+	"happy-server-lite/internal/store"
+)
+
+// Headers the snapshot endpoint names the log and LSN it was taken at with.
+// Replaying the log from that LSN over the snapshot brings a standby up to
+// date, whatever changes the snapshot already holds.
+const (
+	HeaderLogID = "X-Replication-Log"
+	HeaderLSN   = "X-Replication-Lsn"
+)
+
+// Changes is the body of the primary's changes endpoint.
+type Changes struct {
+	LogID   string         `json:"logId"`
+	LSN     int64          `json:"lsn"`
+	Changes []store.Change `json:"changes"`
+}
+
+const (
+	defaultWait          = 30 * time.Second
+	defaultRetryInterval = 5 * time.Second
+)
+
+type Config struct {
+	// PrimaryURL is the base URL of the primary, such as
+	// https://happy.example.com.
+	PrimaryURL string
+	// Token is the primary's admin token.
+	Token string
+	// Wait is how long one changes request may wait at the primary for new
+	// changes; zero picks 30 seconds.
+	Wait time.Duration
+	// RetryInterval spaces attempts after a failure; zero picks 5 seconds.
+	RetryInterval time.Duration
+	HTTPClient    *http.Client
+	Clock         clock.Clock
+	// OnPromote runs once the standby is promoted and has stopped following.
+	OnPromote func()
+}
+
+// Status describes a Follower for the admin API.
+type Status struct {
+	Role          string `json:"role"`
+	Primary       string `json:"primary"`
+	LogID         string `json:"logId,omitempty"`
+	AppliedLSN    int64  `json:"appliedLsn"`
+	Snapshots     int64  `json:"snapshots"`
+	LastContactAt int64  `json:"lastContactAt,omitempty"`
+	LastError     string `json:"lastError,omitempty"`
+	PromotedAt    int64  `json:"promotedAt,omitempty"`
+}
+
+// Roles reported by Status.
+const (
+	RoleStandby = "standby"
+	RolePrimary = "primary"
+)
+
+// errResync reports that the standby must start over from a snapshot.
+var errResync = errors.New("replication log moved on")
+
+// Follower applies a primary's changes to a replica store.
+type Follower struct {
+	cfg     Config
+	replica store.Replica
+	client  *http.Client
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	mu       sync.Mutex
+	status   Status
+	started  bool
+	promoted bool
+}
+
+func NewFollower(replica store.Replica, cfg Config) *Follower {
+	cfg.PrimaryURL = strings.TrimRight(cfg.PrimaryURL, "/")
+	if cfg.Wait <= 0 {
+		cfg.Wait = defaultWait
+	}
+	if cfg.RetryInterval <= 0 {
+		cfg.RetryInterval = defaultRetryInterval
+	}
+	client := cfg.HTTPClient
+	if client == nil {
+		client = &http.Client{}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Follower{
+		cfg:     cfg,
+		replica: replica,
+		client:  client,
+		ctx:     ctx,
+		cancel:  cancel,
+		done:    make(chan struct{}),
+		status:  Status{Role: RoleStandby, Primary: cfg.PrimaryURL},
+	}
+}
+
+// Start follows the primary in the background until Promote or Stop.
+func (f *Follower) Start() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.started {
+		return
+	}
+	f.started = true
+	go f.run()
+}
+
+// Standby reports whether the follower has not been promoted yet.
+func (f *Follower) Standby() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return !f.promoted
+}
+
+func (f *Follower) Status() Status {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.status
+}
+
+// Promote stops following, waiting for a batch being applied to finish, and
+// turns the standby into a primary. It reports false when already promoted.
+func (f *Follower) Promote() bool {
+	f.mu.Lock()
+	if f.promoted {
+		f.mu.Unlock()
+		return false
+	}
+	f.promoted = true
+	f.mu.Unlock()
+
+	f.Stop()
+	f.replica.Promote()
+
+	f.mu.Lock()
+	f.status.Role = RolePrimary
+	f.status.PromotedAt = clock.Now(f.cfg.Clock).UnixMilli()
+	status := f.status
+	f.mu.Unlock()
+	log.Printf("replication: promoted at lsn %d of %s", status.AppliedLSN, status.LogID)
+	if f.cfg.OnPromote != nil {
+		f.cfg.OnPromote()
+	}
+	return true
+}
+
+// Stop ends following without promoting, for shutdown.
+func (f *Follower) Stop() {
+	f.cancel()
+	f.mu.Lock()
+	started := f.started
+	f.mu.Unlock()
+	if started {
+		<-f.done
+	}
+}
+
+func (f *Follower) run() {
+	defer close(f.done)
+	for f.ctx.Err() == nil {
+		err := f.step()
+		if err == nil || f.ctx.Err() != nil {
+			continue
+		}
+		if errors.Is(err, errResync) {
+			log.Printf("replication: %v; loading a new snapshot", err)
+			f.setPosition("", 0)
+			continue
+		}
+		log.Printf("replication: %v", err)
+		f.mu.Lock()
+		f.status.LastError = err.Error()
+		f.mu.Unlock()
+		select {
+		case <-f.ctx.Done():
+		case <-time.After(f.cfg.RetryInterval):
+		}
+	}
+}
+
+// step loads a snapshot when the standby has no position in the primary's
+// log, and applies the next batch of changes otherwise.
+func (f *Follower) step() error {
+	status := f.Status()
+	if status.LogID == "" {
+		return f.loadSnapshot()
+	}
+	return f.applyChanges(status.LogID, status.AppliedLSN)
+}
+
+func (f *Follower) loadSnapshot() error {
+	resp, err := f.get("/v1/admin/replication/snapshot", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return responseError("snapshot", resp)
+	}
+	logID := resp.Header.Get(HeaderLogID)
+	lsn, err := strconv.ParseInt(resp.Header.Get(HeaderLSN), 10, 64)
+	if logID == "" || err != nil {
+		return errors.New("snapshot: missing log position")
+	}
+	if err := f.replica.ApplySnapshot(resp.Body); err != nil {
+		return fmt.Errorf("snapshot: %w", err)
+	}
+
+	f.mu.Lock()
+	f.status.Snapshots++
+	f.mu.Unlock()
+	f.setPosition(logID, lsn)
+	log.Printf("replication: loaded snapshot of %s at lsn %d", logID, lsn)
+	return nil
+}
+
+func (f *Follower) applyChanges(logID string, after int64) error {
+	query := url.Values{
+		"logId": {logID},
+		"after": {strconv.FormatInt(after, 10)},
+		"wait":  {strconv.Itoa(int(f.cfg.Wait / time.Second))},
+	}
+	resp, err := f.get("/v1/admin/replication/changes", query)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusGone {
+		return errResync
+	}
+	if resp.StatusCode != http.StatusOK {
+		return responseError("changes", resp)
+	}
+	var body Changes
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return fmt.Errorf("changes: %w", err)
+	}
+	if len(body.Changes) == 0 {
+		f.setPosition(logID, after)
+		return nil
+	}
+	if err := f.replica.ApplyChanges(body.Changes); err != nil {
+		// Part of the batch may be applied; a snapshot puts the store back
+		// in step.
+		return fmt.Errorf("%w: apply: %v", errResync, err)
+	}
+	f.setPosition(logID, body.Changes[len(body.Changes)-1].LSN)
+	return nil
+}
+
+func (f *Follower) get(path string, query url.Values) (*http.Response, error) {
+	// The primary holds a changes request for up to Wait, so allow for that
+	// on top of the transfer itself.
+	ctx, cancel := context.WithTimeout(f.ctx, f.cfg.Wait+time.Minute)
+	u := f.cfg.PrimaryURL + path
+	if query != nil {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+f.cfg.Token)
+	resp, err := f.client.Do(req)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = cancelOnClose{resp.Body, cancel}
+	return resp, nil
+}
+
+// cancelOnClose releases a request's context once its body is closed.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
+
+func (f *Follower) setPosition(logID string, lsn int64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.status.LogID = logID
+	f.status.AppliedLSN = lsn
+	if logID != "" {
+		f.status.LastContactAt = clock.Now(f.cfg.Clock).UnixMilli()
+		f.status.LastError = ""
+	}
+}
+
+func responseError(what string, resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	return fmt.Errorf("%s: %s: %s", what, resp.Status, bytes.TrimSpace(body))
+}
@@ -0,0 +1,124 @@
+// Package selfcheck runs the checks the server makes of its environment on
+// startup, so a misconfigured instance shows up in its logs and fails its
+// readiness probe instead of failing its first real request.
+package selfcheck
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"happy-server-lite/internal/auth"
+)
+
+// Check is one named probe; Run returns why it failed.
+type Check struct {
+	Name string
+	Run  func() error
+}
+
+// Result is the outcome of one Check.
+type Result struct {
+	Name       string `json:"name"`
+	OK         bool   `json:"ok"`
+	Error      string `json:"error,omitempty"`
+	DurationMs int64  `json:"durationMs"`
+}
+
+// Report is the outcome of every check, served at /health/ready.
+type Report struct {
+	OK        bool     `json:"ok"`
+	StartedAt int64    `json:"startedAt"`
+	Checks    []Result `json:"checks"`
+}
+
+// Run runs checks in order and reports them as of startedAt.
+func Run(startedAt int64, checks []Check) Report {
+	report := Report{OK: true, StartedAt: startedAt, Checks: make([]Result, 0, len(checks))}
+	for _, check := range checks {
+		start := time.Now()
+		err := check.Run()
+		result := Result{Name: check.Name, OK: err == nil, DurationMs: time.Since(start).Milliseconds()}
+		if err != nil {
+			result.Error = err.Error()
+			report.OK = false
+		}
+		report.Checks = append(report.Checks, result)
+	}
+	return report
+}
+
+// WritableDirs checks that a file can be written, synced and removed in each
+// of dirs, creating them as the store would.
+func WritableDirs(dirs []string) error {
+	var errs []error
+	for _, dir := range dirs {
+		if err := writeProbe(dir); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", dir, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func writeProbe(dir string) error {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(dir, ".selfcheck-*")
+	if err != nil {
+		return err
+	}
+	name := f.Name()
+	defer os.Remove(name)
+	if _, err := f.Write([]byte("ok\n")); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Remove(name)
+}
+
+// minSaneTime is a floor no correctly set clock reads below: tokens and
+// records stamped before it mean the host clock was never set.
+var minSaneTime = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// Clock checks that now is past minSaneTime and does not run backwards
+// between two reads.
+func Clock(now func() time.Time) error {
+	first := now()
+	if first.Before(minSaneTime) {
+		return fmt.Errorf("clock reads %s, before %s", first.UTC().Format(time.RFC3339), minSaneTime.Format(time.RFC3339))
+	}
+	if second := now(); second.Before(first) {
+		return fmt.Errorf("clock ran backwards by %s", first.Sub(second))
+	}
+	return nil
+}
+
+// TokenRoundTrip checks that a token signed with cfg verifies with it. Only
+// signing is checked: revocations and disabled accounts are left out.
+func TokenRoundTrip(cfg auth.TokenConfig) error {
+	const userID = "selfcheck"
+	cfg.Revocations = nil
+	cfg.AccountDisabled = nil
+	token, err := auth.CreateToken(userID, cfg)
+	if err != nil {
+		return fmt.Errorf("sign: %w", err)
+	}
+	claims, err := auth.VerifyToken(context.Background(), token, cfg)
+	if err != nil {
+		return fmt.Errorf("verify: %w", err)
+	}
+	if claims.UserID != userID {
+		return fmt.Errorf("verify: got user %q", claims.UserID)
+	}
+	return nil
+}
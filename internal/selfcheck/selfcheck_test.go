@@ -0,0 +1,67 @@
+package selfcheck
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"happy-server-lite/internal/auth"
+)
+
+func TestRun_ReportsFailures(t *testing.T) {
+	report := Run(1000, []Check{
+		{Name: "good", Run: func() error { return nil }},
+		{Name: "bad", Run: func() error { return errors.New("broken") }},
+	})
+	if report.OK || report.StartedAt != 1000 || len(report.Checks) != 2 {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+	if !report.Checks[0].OK || report.Checks[1].OK || report.Checks[1].Error != "broken" {
+		t.Fatalf("unexpected results: %+v", report.Checks)
+	}
+}
+
+func TestWritableDirs(t *testing.T) {
+	dir := t.TempDir()
+	if err := WritableDirs([]string{filepath.Join(dir, "nested")}); err != nil {
+		t.Fatalf("WritableDirs: %v", err)
+	}
+	if entries, _ := os.ReadDir(filepath.Join(dir, "nested")); len(entries) != 0 {
+		t.Fatalf("expected the probe file to be removed, got %v", entries)
+	}
+
+	file := filepath.Join(dir, "file")
+	if err := os.WriteFile(file, nil, 0o600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if err := WritableDirs([]string{dir, file}); err == nil {
+		t.Fatal("expected a file in place of a directory to fail")
+	}
+}
+
+func TestClock(t *testing.T) {
+	if err := Clock(time.Now); err != nil {
+		t.Fatalf("Clock: %v", err)
+	}
+	if err := Clock(func() time.Time { return time.Unix(0, 0) }); err == nil {
+		t.Fatal("expected an unset clock to fail")
+	}
+	reads := []time.Time{time.Now(), time.Now().Add(-time.Second)}
+	if err := Clock(func() time.Time { now := reads[0]; reads = reads[1:]; return now }); err == nil {
+		t.Fatal("expected a clock running backwards to fail")
+	}
+}
+
+func TestTokenRoundTrip(t *testing.T) {
+	cfg := auth.DefaultTokenConfig("secret")
+	cfg.AccountDisabled = func(context.Context, string) bool { return true }
+	if err := TokenRoundTrip(cfg); err != nil {
+		t.Fatalf("TokenRoundTrip: %v", err)
+	}
+	if err := TokenRoundTrip(auth.TokenConfig{Expiry: time.Hour}); err == nil {
+		t.Fatal("expected a missing secret to fail")
+	}
+}
@@ -0,0 +1,687 @@
+package server_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"happy-server-lite/pkg/client"
+	"happy-server-lite/pkg/happyserver"
+	"happy-server-lite/pkg/servertest"
+)
+
+func adminRequest(t *testing.T, srv *servertest.Server, token, method, path string, out any) int {
+	t.Helper()
+	req, err := http.NewRequest(method, srv.URL+path, nil)
+	if err != nil {
+		t.Fatalf("NewRequest: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+	if out != nil {
+		_ = json.NewDecoder(resp.Body).Decode(out)
+	}
+	return resp.StatusCode
+}
+
+func TestAdminRequiresToken(t *testing.T) {
+	srv := servertest.New(t, happyserver.WithAdminToken("admin-secret"))
+	if status := adminRequest(t, srv, "wrong", http.MethodGet, "/v1/admin/debug-tap", nil); status != http.StatusUnauthorized {
+		t.Fatalf("expected 401, got %d", status)
+	}
+	if status := adminRequest(t, srv, srv.Token("user-1"), http.MethodGet, "/v1/admin/debug-tap", nil); status != http.StatusUnauthorized {
+		t.Fatalf("expected user token to be rejected, got %d", status)
+	}
+
+	noAdmin := servertest.New(t)
+	if status := adminRequest(t, noAdmin, "", http.MethodGet, "/v1/admin/debug-tap", nil); status != http.StatusUnauthorized {
+		t.Fatalf("expected admin API to be closed without a token, got %d", status)
+	}
+}
+
+func TestDebugTapRecordsHTTPAndSocketFrames(t *testing.T) {
+	srv := servertest.New(t, happyserver.WithAdminToken("admin-secret"))
+	sess := srv.CreateSession("user-1", "tag")
+
+	if status := adminRequest(t, srv, "admin-secret", http.MethodPut, "/v1/admin/debug-tap/user-1", nil); status != http.StatusOK {
+		t.Fatalf("expected enable to succeed, got %d", status)
+	}
+
+	if _, err := srv.Client("user-1").ListSessions(context.Background()); err != nil {
+		t.Fatalf("ListSessions: %v", err)
+	}
+	if _, err := srv.Client("user-2").ListSessions(context.Background()); err != nil {
+		t.Fatalf("ListSessions: %v", err)
+	}
+	user := srv.ConnectUser("user-1")
+	user.Emit("message", map[string]any{"sid": sess.ID, "message": "hello"})
+	user.WaitUpdate("new-message")
+
+	var resp struct {
+		Entries []struct {
+			Kind   string `json:"kind"`
+			Method string `json:"method"`
+			Path   string `json:"path"`
+			Status int    `json:"status"`
+			Frame  string `json:"frame"`
+		} `json:"entries"`
+	}
+	if status := adminRequest(t, srv, "admin-secret", http.MethodGet, "/v1/admin/debug-tap/user-1", &resp); status != http.StatusOK {
+		t.Fatalf("expected entries, got %d", status)
+	}
+
+	kinds := map[string]int{}
+	for _, e := range resp.Entries {
+		kinds[e.Kind]++
+		if e.Kind == "http" && (e.Path != "/v1/sessions" || e.Status != http.StatusOK) {
+			t.Fatalf("unexpected http entry: %+v", e)
+		}
+	}
+	if kinds["http"] != 1 || kinds["socket-in"] == 0 || kinds["socket-out"] == 0 {
+		t.Fatalf("expected one http entry and socket frames both ways, got %v", kinds)
+	}
+
+	if status := adminRequest(t, srv, "admin-secret", http.MethodDelete, "/v1/admin/debug-tap/user-1", nil); status != http.StatusOK {
+		t.Fatalf("expected disable to succeed, got %d", status)
+	}
+	if status := adminRequest(t, srv, "admin-secret", http.MethodGet, "/v1/admin/debug-tap/user-1", nil); status != http.StatusNotFound {
+		t.Fatalf("expected 404 after disable, got %d", status)
+	}
+}
+
+func TestAdminConnectionsReportTrafficCounters(t *testing.T) {
+	srv := servertest.New(t, happyserver.WithAdminToken("admin-secret"), happyserver.WithoutSocketEventRateLimits())
+	sess := srv.CreateSession("user-1", "tag")
+	quiet := srv.ConnectUser("user-1")
+	noisy := srv.ConnectSession("user-1", sess.ID)
+	for i := 0; i < 5; i++ {
+		noisy.Emit("message", map[string]any{"sid": sess.ID, "message": "m"})
+	}
+	for i := 0; i < 5; i++ {
+		quiet.WaitUpdate("new-message")
+	}
+
+	var resp struct {
+		Connections []struct {
+			ID         string `json:"id"`
+			UserID     string `json:"userId"`
+			ClientType string `json:"clientType"`
+			Stats      struct {
+				MessagesIn int64  `json:"messagesIn"`
+				BytesIn    int64  `json:"bytesIn"`
+				LastEvent  string `json:"lastEvent"`
+			} `json:"stats"`
+		} `json:"connections"`
+	}
+	if status := adminRequest(t, srv, "admin-secret", http.MethodGet, "/v1/admin/connections?sort=messagesIn", &resp); status != http.StatusOK {
+		t.Fatalf("expected connections, got %d", status)
+	}
+	if len(resp.Connections) != 2 {
+		t.Fatalf("expected 2 connections, got %d", len(resp.Connections))
+	}
+	top := resp.Connections[0]
+	if top.ClientType != "session-scoped" || top.UserID != "user-1" || top.Stats.LastEvent != "message" {
+		t.Fatalf("expected the session socket first, got %+v", top)
+	}
+	if top.Stats.MessagesIn < 6 || top.Stats.BytesIn == 0 {
+		t.Fatalf("unexpected inbound counters: %+v", top.Stats)
+	}
+
+	if status := adminRequest(t, srv, "admin-secret", http.MethodGet, "/v1/admin/connections?sort=bogus", nil); status != http.StatusBadRequest {
+		t.Fatalf("expected 400 for unknown sort, got %d", status)
+	}
+
+	var metrics struct {
+		Connections int   `json:"connections"`
+		MessagesIn  int64 `json:"messagesIn"`
+		MessagesOut int64 `json:"messagesOut"`
+		Events      map[string]struct {
+			Received int64 `json:"received"`
+		} `json:"events"`
+	}
+	if status := adminRequest(t, srv, "admin-secret", http.MethodGet, "/v1/admin/metrics", &metrics); status != http.StatusOK {
+		t.Fatalf("expected metrics, got %d", status)
+	}
+	if metrics.Connections != 2 || metrics.MessagesIn < top.Stats.MessagesIn || metrics.MessagesOut == 0 {
+		t.Fatalf("unexpected metrics: %+v", metrics)
+	}
+	if got := metrics.Events["message"].Received; got != 5 {
+		t.Fatalf("expected 5 message events, got %d", got)
+	}
+}
+
+func TestAdminForceLogoutRevokesTokensAndClosesSockets(t *testing.T) {
+	srv := servertest.New(t, happyserver.WithAdminToken("admin-secret"))
+	sess := srv.CreateSession("user-1", "tag")
+	user := srv.ConnectUser("user-1")
+	daemon := srv.ConnectSession("user-1", sess.ID)
+	other := srv.ConnectUser("user-2")
+	api := srv.Client("user-1")
+
+	req, err := http.NewRequest(http.MethodPost, srv.URL+"/v1/admin/users/user-1/logout", strings.NewReader(`{"lock":true}`))
+	if err != nil {
+		t.Fatalf("NewRequest: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer admin-secret")
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("logout: %v", err)
+	}
+	var body struct {
+		Disconnected int  `json:"disconnected"`
+		Locked       bool `json:"locked"`
+	}
+	_ = json.NewDecoder(resp.Body).Decode(&body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || body.Disconnected != 2 || !body.Locked {
+		t.Fatalf("unexpected logout response %d: %+v", resp.StatusCode, body)
+	}
+
+	for _, sock := range []*servertest.Socket{user, daemon} {
+		select {
+		case <-sock.Done():
+		case <-time.After(servertest.DefaultTimeout):
+			t.Fatalf("expected user-1 sockets to be closed")
+		}
+	}
+	select {
+	case <-other.Done():
+		t.Fatalf("other users should stay connected")
+	default:
+	}
+
+	if _, err := api.ListSessions(context.Background()); err == nil {
+		t.Fatalf("expected the old token to be revoked")
+	}
+	if _, err := srv.Client("user-1").ListSessions(context.Background()); err == nil {
+		t.Fatalf("expected new tokens to be rejected while locked")
+	}
+	if _, err := srv.Client("user-2").ListSessions(context.Background()); err != nil {
+		t.Fatalf("expected other users unaffected: %v", err)
+	}
+
+	if status := adminRequest(t, srv, "admin-secret", http.MethodDelete, "/v1/admin/users/user-1/lock", nil); status != http.StatusOK {
+		t.Fatalf("expected unlock to succeed, got %d", status)
+	}
+	if status := adminRequest(t, srv, "admin-secret", http.MethodDelete, "/v1/admin/users/user-1/lock", nil); status != http.StatusNotFound {
+		t.Fatalf("expected 404 when not locked, got %d", status)
+	}
+}
+
+func TestAdminDisableAccountRejectsTokensAndSockets(t *testing.T) {
+	srv := servertest.New(t, happyserver.WithAdminToken("admin-secret"))
+	user := srv.ConnectUser("user-1")
+
+	var body struct {
+		Disconnected int `json:"disconnected"`
+	}
+	if status := adminRequest(t, srv, "admin-secret", http.MethodPut, "/v1/admin/users/user-1/disabled", &body); status != http.StatusOK || body.Disconnected != 1 {
+		t.Fatalf("unexpected disable response %d: %+v", status, body)
+	}
+	select {
+	case <-user.Done():
+	case <-time.After(servertest.DefaultTimeout):
+		t.Fatalf("expected user-1 socket to be closed")
+	}
+
+	req, err := http.NewRequest(http.MethodGet, srv.URL+"/v1/sessions", nil)
+	if err != nil {
+		t.Fatalf("NewRequest: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+srv.Token("user-1"))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("list sessions: %v", err)
+	}
+	var apiErr struct {
+		Error string `json:"error"`
+	}
+	_ = json.NewDecoder(resp.Body).Decode(&apiErr)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden || apiErr.Error != "Account disabled" {
+		t.Fatalf("expected 403 account disabled, got %d: %+v", resp.StatusCode, apiErr)
+	}
+	if _, err := srv.Client("user-2").ListSessions(context.Background()); err != nil {
+		t.Fatalf("expected other users unaffected: %v", err)
+	}
+
+	if status := adminRequest(t, srv, "admin-secret", http.MethodDelete, "/v1/admin/users/user-1/disabled", nil); status != http.StatusOK {
+		t.Fatalf("expected enable to succeed, got %d", status)
+	}
+	if status := adminRequest(t, srv, "admin-secret", http.MethodDelete, "/v1/admin/users/user-1/disabled", nil); status != http.StatusNotFound {
+		t.Fatalf("expected 404 when not disabled, got %d", status)
+	}
+	if _, err := srv.Client("user-1").ListSessions(context.Background()); err != nil {
+		t.Fatalf("expected access restored: %v", err)
+	}
+}
+
+func TestAdminBackupRestoresIntoFreshInstance(t *testing.T) {
+	src := servertest.New(t, happyserver.WithAdminToken("admin-secret"))
+	sess := src.CreateSession("user-1", "tag")
+	src.CreateMachine("user-1", "machine-1")
+	ctx := context.Background()
+	if _, err := src.Client("user-1").PostMessage(ctx, sess.ID, "hello", ""); err != nil {
+		t.Fatalf("PostMessage: %v", err)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, src.URL+"/v1/admin/backup", nil)
+	req.Header.Set("Authorization", "Bearer admin-secret")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("backup: %v", err)
+	}
+	archive, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/gzip" {
+		t.Fatalf("unexpected backup response %d %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+
+	restore := func(srv *servertest.Server) int {
+		req, _ := http.NewRequest(http.MethodPost, srv.URL+"/v1/admin/restore", bytes.NewReader(archive))
+		req.Header.Set("Authorization", "Bearer admin-secret")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("restore: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	dst := servertest.New(t, happyserver.WithAdminToken("admin-secret"))
+	if status := restore(dst); status != http.StatusOK {
+		t.Fatalf("expected restore to succeed, got %d", status)
+	}
+	msgs, err := dst.Client("user-1").ListMessages(ctx, sess.ID, 0, 10)
+	if err != nil || len(msgs) != 1 || msgs[0].Content.C != "hello" {
+		t.Fatalf("expected the restored message, got %+v (%v)", msgs, err)
+	}
+	machines, err := dst.Client("user-1").ListMachines(ctx)
+	if err != nil || len(machines) != 1 {
+		t.Fatalf("expected the restored machine, got %+v (%v)", machines, err)
+	}
+
+	if status := restore(src); status != http.StatusConflict {
+		t.Fatalf("expected 409 restoring into a non-empty store, got %d", status)
+	}
+}
+
+func TestAdminPurgeRemovesDeletedSessionsAndReportsStats(t *testing.T) {
+	srv := servertest.New(t, happyserver.WithAdminToken("admin-secret"), happyserver.WithPurge(time.Millisecond, time.Hour))
+	sess := srv.CreateSession("user-1", "tag")
+	if err := srv.Client("user-1").DeleteSession(context.Background(), sess.ID); err != nil {
+		t.Fatalf("DeleteSession: %v", err)
+	}
+	time.Sleep(5 * time.Millisecond)
+
+	var run struct {
+		Removed struct {
+			Sessions int `json:"sessions"`
+		} `json:"removed"`
+	}
+	if status := adminRequest(t, srv, "admin-secret", http.MethodPost, "/v1/admin/purge", &run); status != http.StatusOK || run.Removed.Sessions != 1 {
+		t.Fatalf("expected one purged session, got %d %+v", status, run)
+	}
+
+	var stats struct {
+		Runs  int `json:"runs"`
+		Total struct {
+			Sessions int `json:"sessions"`
+		} `json:"total"`
+	}
+	if status := adminRequest(t, srv, "admin-secret", http.MethodGet, "/v1/admin/purge", &stats); status != http.StatusOK || stats.Runs != 1 || stats.Total.Sessions != 1 {
+		t.Fatalf("unexpected purge stats %d %+v", status, stats)
+	}
+}
+
+func TestAdminDrainRedirectsAndRefusesConnections(t *testing.T) {
+	srv := servertest.New(t, happyserver.WithAdminToken("admin-secret"))
+	sockets := []*servertest.Socket{srv.ConnectUser("user-1"), srv.ConnectUser("user-2")}
+
+	req, err := http.NewRequest(http.MethodPost, srv.URL+"/v1/admin/drain", strings.NewReader(`{"url":"wss://green.example.com","windowSeconds":0}`))
+	if err != nil {
+		t.Fatalf("NewRequest: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer admin-secret")
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("POST drain: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("expected 202, got %d", resp.StatusCode)
+	}
+
+	for _, sock := range sockets {
+		var body struct {
+			URL string `json:"url"`
+		}
+		if err := sock.WaitEvent("reconnect-to").Decode(&body); err != nil || body.URL != "wss://green.example.com" {
+			t.Fatalf("unexpected reconnect-to: %+v, %v", body, err)
+		}
+		select {
+		case <-sock.Done():
+		case <-time.After(servertest.DefaultTimeout):
+			t.Fatal("expected drained socket to close")
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), servertest.DefaultTimeout)
+	defer cancel()
+	if sock, err := srv.Client("user-1").ConnectSocket(ctx, client.SocketOptions{ClientType: client.ClientTypeUser}); err == nil {
+		sock.Close()
+		t.Fatal("expected connects to be refused while draining")
+	}
+	health, err := http.Get(srv.URL + "/health")
+	if err != nil {
+		t.Fatalf("GET health: %v", err)
+	}
+	health.Body.Close()
+	if health.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected draining health check to fail, got %d", health.StatusCode)
+	}
+
+	var status struct {
+		Draining bool `json:"draining"`
+		Closed   int  `json:"closed"`
+	}
+	if code := adminRequest(t, srv, "admin-secret", http.MethodGet, "/v1/admin/drain", &status); code != http.StatusOK || !status.Draining || status.Closed != 2 {
+		t.Fatalf("unexpected drain status %d: %+v", code, status)
+	}
+	if code := adminRequest(t, srv, "admin-secret", http.MethodPost, "/v1/admin/drain", nil); code != http.StatusConflict {
+		t.Fatalf("expected 409 for a second drain, got %d", code)
+	}
+
+	if code := adminRequest(t, srv, "admin-secret", http.MethodDelete, "/v1/admin/drain", nil); code != http.StatusOK {
+		t.Fatalf("expected cancel, got %d", code)
+	}
+	if code := adminRequest(t, srv, "admin-secret", http.MethodDelete, "/v1/admin/drain", nil); code != http.StatusNotFound {
+		t.Fatalf("expected 404 without a drain, got %d", code)
+	}
+	srv.ConnectUser("user-1")
+}
+
+func TestAdminMemoryReportsBudgetEvictions(t *testing.T) {
+	srv := servertest.New(t, happyserver.WithAdminToken("admin-secret"), happyserver.WithMemoryBudget(0, 3))
+	sess := srv.CreateSession("user-1", "tag")
+	ctx, cancel := context.WithTimeout(context.Background(), servertest.DefaultTimeout)
+	defer cancel()
+	for i := 0; i < 4; i++ {
+		if _, err := srv.Client("user-1").PostMessage(ctx, sess.ID, "m", ""); err != nil {
+			t.Fatalf("PostMessage: %v", err)
+		}
+	}
+
+	var stats struct {
+		Messages        int   `json:"messages"`
+		MaxMessages     int   `json:"maxMessages"`
+		EvictedMessages int64 `json:"evictedMessages"`
+	}
+	if status := adminRequest(t, srv, "admin-secret", http.MethodGet, "/v1/admin/memory", &stats); status != http.StatusOK {
+		t.Fatalf("expected memory stats, got %d", status)
+	}
+	if stats.MaxMessages != 3 || stats.Messages != 2 || stats.EvictedMessages != 2 {
+		t.Fatalf("unexpected memory stats: %+v", stats)
+	}
+}
+
+func TestAdminRoomMembersListsConnectionsInRoom(t *testing.T) {
+	srv := servertest.New(t, happyserver.WithAdminToken("admin-secret"))
+	sess := srv.CreateSession("user-1", "tag")
+	srv.CreateMachine("user-1", "machine-1")
+	phone := srv.ConnectUser("user-1")
+	daemon := srv.ConnectSession("user-1", sess.ID)
+	srv.ConnectMachine("user-1", "machine-1")
+	srv.ConnectUser("user-2")
+
+	type room struct {
+		Connections []struct {
+			ID         string `json:"id"`
+			UserID     string `json:"userId"`
+			ClientType string `json:"clientType"`
+		} `json:"connections"`
+	}
+	for path, want := range map[string]string{
+		"/v1/admin/rooms/user/user-1":        phone.SID(),
+		"/v1/admin/rooms/session/" + sess.ID: daemon.SID(),
+	} {
+		var resp room
+		if status := adminRequest(t, srv, "admin-secret", http.MethodGet, path, &resp); status != http.StatusOK {
+			t.Fatalf("%s: expected 200, got %d", path, status)
+		}
+		if len(resp.Connections) != 1 || resp.Connections[0].ID != want || resp.Connections[0].UserID != "user-1" {
+			t.Fatalf("%s: unexpected members %+v", path, resp.Connections)
+		}
+	}
+
+	var machine room
+	adminRequest(t, srv, "admin-secret", http.MethodGet, "/v1/admin/rooms/machine/machine-1", &machine)
+	if len(machine.Connections) != 1 || machine.Connections[0].ClientType != "machine-scoped" {
+		t.Fatalf("unexpected machine room: %+v", machine.Connections)
+	}
+	var empty room
+	adminRequest(t, srv, "admin-secret", http.MethodGet, "/v1/admin/rooms/session/unknown", &empty)
+	if len(empty.Connections) != 0 {
+		t.Fatalf("expected an empty room, got %+v", empty.Connections)
+	}
+	if status := adminRequest(t, srv, "admin-secret", http.MethodGet, "/v1/admin/rooms/bogus/x", nil); status != http.StatusBadRequest {
+		t.Fatalf("expected 400 for unknown kind, got %d", status)
+	}
+}
+
+func TestAdminStatsReportsStoreCounts(t *testing.T) {
+	srv := servertest.New(t, happyserver.WithAdminToken("admin-secret"))
+	sess := srv.CreateSession("user-1", "tag")
+	srv.CreateSession("user-2", "tag")
+	srv.CreateMachine("user-1", "machine-1")
+	ctx, cancel := context.WithTimeout(context.Background(), servertest.DefaultTimeout)
+	defer cancel()
+	if _, err := srv.Client("user-1").PostMessage(ctx, sess.ID, "m", ""); err != nil {
+		t.Fatalf("PostMessage: %v", err)
+	}
+
+	type storeStats struct {
+		Sessions int `json:"sessions"`
+		Machines int `json:"machines"`
+		Memory   struct {
+			Messages int `json:"messages"`
+		} `json:"memory"`
+	}
+	var stats storeStats
+	if status := adminRequest(t, srv, "admin-secret", http.MethodGet, "/v1/admin/stats", &stats); status != http.StatusOK {
+		t.Fatalf("expected stats, got %d", status)
+	}
+	if stats.Sessions != 2 || stats.Machines != 1 || stats.Memory.Messages != 1 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+
+	var metrics struct {
+		Connections int         `json:"connections"`
+		Store       *storeStats `json:"store"`
+	}
+	if status := adminRequest(t, srv, "admin-secret", http.MethodGet, "/v1/admin/metrics", &metrics); status != http.StatusOK {
+		t.Fatalf("expected metrics, got %d", status)
+	}
+	if metrics.Store == nil || *metrics.Store != stats {
+		t.Fatalf("expected metrics to carry the store stats, got %+v", metrics.Store)
+	}
+}
+
+func TestAdminMetricsHistory(t *testing.T) {
+	srv := servertest.New(t, happyserver.WithAdminToken("admin-secret"), happyserver.WithMetricsHistoryInterval(20*time.Millisecond))
+	srv.ConnectUser("user-1")
+
+	var history struct {
+		Resolution string `json:"resolution"`
+		Points     []struct {
+			At             int64   `json:"at"`
+			Connections    float64 `json:"connections"`
+			MaxConnections int     `json:"maxConnections"`
+		} `json:"points"`
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if status := adminRequest(t, srv, "admin-secret", http.MethodGet, "/v1/admin/metrics/history", &history); status != http.StatusOK {
+			t.Fatalf("expected the history, got %d", status)
+		}
+		if n := len(history.Points); n > 0 && history.Points[n-1].MaxConnections == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected a sample of the connection, got %+v", history)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if history.Resolution != "minute" {
+		t.Fatalf("expected minutes by default, got %q", history.Resolution)
+	}
+
+	if status := adminRequest(t, srv, "admin-secret", http.MethodGet, "/v1/admin/metrics/history?resolution=day", &history); status != http.StatusOK || len(history.Points) == 0 {
+		t.Fatalf("expected the days, got %d %+v", status, history)
+	}
+	if status := adminRequest(t, srv, "admin-secret", http.MethodGet, "/v1/admin/metrics/history?resolution=week", nil); status != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an unknown resolution, got %d", status)
+	}
+	if status := adminRequest(t, srv, "admin-secret", http.MethodGet, "/v1/admin/metrics/history?since=x", nil); status != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an invalid since, got %d", status)
+	}
+}
+
+func TestAdminMachineCommandsReachDaemonAndRecordAcks(t *testing.T) {
+	srv := servertest.New(t, happyserver.WithAdminToken("admin-secret"))
+	srv.CreateMachine("user-1", "machine-1")
+	srv.CreateMachine("user-1", "machine-2")
+	daemon := srv.ConnectMachine("user-1", "machine-1")
+	received := make(chan client.MachineCommand, 1)
+	daemon.OnMachineCommand(func(cmd client.MachineCommand) any {
+		received <- cmd
+		return map[string]any{"ok": true}
+	})
+
+	send := func(machineID string, body map[string]any) (int, map[string]any) {
+		t.Helper()
+		payload, _ := json.Marshal(body)
+		req, _ := http.NewRequest(http.MethodPost, srv.URL+"/v1/admin/users/user-1/machines/"+machineID+"/commands", bytes.NewReader(payload))
+		req.Header.Set("Authorization", "Bearer admin-secret")
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("send command: %v", err)
+		}
+		defer resp.Body.Close()
+		var out map[string]any
+		_ = json.NewDecoder(resp.Body).Decode(&out)
+		return resp.StatusCode, out
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), servertest.DefaultTimeout)
+	defer cancel()
+	old, err := srv.Client("user-1").ScopedToken(ctx, client.TokenScope{MachineID: "machine-1"})
+	if err != nil {
+		t.Fatalf("ScopedToken: %v", err)
+	}
+	connectWith := func(token string) error {
+		sock, err := client.New(srv.URL, client.WithToken(token)).ConnectSocket(ctx, client.SocketOptions{Path: client.PathMachineDaemon, ClientType: client.ClientTypeMachine, MachineID: "machine-1"})
+		if err == nil {
+			sock.Close()
+		}
+		return err
+	}
+
+	status, result := send("machine-1", map[string]any{"command": "rotate-token"})
+	if status != http.StatusOK || result["delivered"] != float64(1) {
+		t.Fatalf("unexpected result: %d %v", status, result)
+	}
+	acks, _ := result["acks"].([]any)
+	if len(acks) != 1 || acks[0].(map[string]any)["acked"] != true || acks[0].(map[string]any)["response"].(map[string]any)["ok"] != true {
+		t.Fatalf("expected the daemon's ack, got %v", result["acks"])
+	}
+	cmd := <-received
+	var args struct {
+		Token string `json:"token"`
+	}
+	if cmd.Command != "rotate-token" || json.Unmarshal(cmd.Args, &args) != nil || args.Token == "" {
+		t.Fatalf("expected a new token with rotate-token, got %+v", cmd)
+	}
+	if err := connectWith(args.Token); err != nil {
+		t.Fatalf("expected the new token to connect: %v", err)
+	}
+	if err := connectWith(old); err == nil {
+		t.Fatalf("expected the machine's old token to be revoked")
+	}
+
+	if status, _ := send("machine-1", map[string]any{"command": "format-disk"}); status != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an unknown command, got %d", status)
+	}
+	if status, _ := send("machine-2", map[string]any{"command": "re-sync"}); status != http.StatusConflict {
+		t.Fatalf("expected 409 for an offline machine, got %d", status)
+	}
+	if status, _ := send("unknown", map[string]any{"command": "re-sync"}); status != http.StatusNotFound {
+		t.Fatalf("expected 404 for an unknown machine, got %d", status)
+	}
+
+	var log struct {
+		Commands []struct {
+			Command   string `json:"command"`
+			MachineID string `json:"machineId"`
+		} `json:"commands"`
+	}
+	if status := adminRequest(t, srv, "admin-secret", http.MethodGet, "/v1/admin/machine-commands?machineId=machine-1", &log); status != http.StatusOK {
+		t.Fatalf("expected the command log, got %d", status)
+	}
+	if len(log.Commands) != 1 || log.Commands[0].Command != "rotate-token" {
+		t.Fatalf("unexpected command log: %+v", log.Commands)
+	}
+}
+
+func TestAdminAuthLogRecordsAttempts(t *testing.T) {
+	srv := servertest.New(t, happyserver.WithAdminToken("admin-secret"))
+	ctx := context.Background()
+	anon := client.New(srv.URL)
+	if _, err := anon.Auth(ctx, "cGs=", "Y2hhbGxlbmdl", "c2ln"); err == nil {
+		t.Fatalf("expected a bad signature to be rejected")
+	}
+	if _, err := anon.RequestAuth(ctx, "pairing-key", true); err != nil {
+		t.Fatalf("RequestAuth: %v", err)
+	}
+	if _, err := anon.RequestAuth(ctx, "pairing-key", true); err != nil {
+		t.Fatalf("RequestAuth: %v", err)
+	}
+
+	var body struct {
+		Entries []struct {
+			Event     string `json:"event"`
+			Outcome   string `json:"outcome"`
+			IP        string `json:"ip"`
+			PublicKey string `json:"publicKey"`
+			Reason    string `json:"reason"`
+		} `json:"entries"`
+	}
+	if status := adminRequest(t, srv, "admin-secret", http.MethodGet, "/v1/admin/auth-log", &body); status != http.StatusOK || len(body.Entries) != 2 {
+		t.Fatalf("expected the sign-in and the pairing request, not the poll: %d %+v", status, body)
+	}
+	if e := body.Entries[0]; e.Event != "sign-in" || e.Outcome != "failure" || e.PublicKey != "cGs=" || e.Reason == "" || e.IP != "127.0.0.1" {
+		t.Fatalf("unexpected sign-in entry: %+v", e)
+	}
+	if e := body.Entries[1]; e.Event != "request" || e.Outcome != "success" || e.PublicKey != "pairing-key" {
+		t.Fatalf("unexpected request entry: %+v", e)
+	}
+
+	body.Entries = nil
+	if status := adminRequest(t, srv, "admin-secret", http.MethodGet, "/v1/admin/auth-log?outcome=failure&limit=5", &body); status != http.StatusOK || len(body.Entries) != 1 || body.Entries[0].Event != "sign-in" {
+		t.Fatalf("unexpected failures: %d %+v", status, body)
+	}
+	if status := adminRequest(t, srv, "admin-secret", http.MethodGet, "/v1/admin/auth-log?limit=x", nil); status != http.StatusBadRequest {
+		t.Fatalf("expected 400 for a bad limit, got %d", status)
+	}
+}
@@ -0,0 +1,61 @@
+package server_test
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"happy-server-lite/pkg/servertest"
+)
+
+func TestMessageAnnotationsSyncAcrossClients(t *testing.T) {
+	srv := servertest.New(t)
+	ctx := context.Background()
+	c := srv.Client("user-1")
+	sess := srv.CreateSession("user-1", "tag")
+	msg, err := c.PostMessage(ctx, sess.ID, "enc", "")
+	if err != nil {
+		t.Fatalf("PostMessage: %v", err)
+	}
+	app := srv.ConnectUser("user-1")
+	other := srv.ConnectUser("user-1")
+
+	bookmark := "enc-bookmark"
+	res, err := c.AnnotateMessage(ctx, sess.ID, msg.ID, "bookmarked", &bookmark, 0)
+	if err != nil || !res.Success || res.Message.Annotations["bookmarked"].Version != 1 {
+		t.Fatalf("AnnotateMessage: %+v (%v)", res, err)
+	}
+	u := app.WaitUpdate("annotate-message")
+	annotations, _ := u.Body["annotations"].(map[string]any)
+	if u.Body["messageId"] != msg.ID || annotations["bookmarked"] == nil {
+		t.Fatalf("unexpected annotate update: %v", u.Body)
+	}
+	other.WaitUpdate("annotate-message")
+
+	res, err = c.AnnotateMessage(ctx, sess.ID, msg.ID, "bookmarked", nil, 0)
+	if err != nil || res.Success || res.CurrentVersion != 1 || res.CurrentValue == nil || *res.CurrentValue != bookmark {
+		t.Fatalf("expected a version mismatch with the current bookmark: %+v (%v)", res, err)
+	}
+
+	ack, err := app.EmitWithAck(ctx, "annotate-message", map[string]any{"sid": sess.ID, "messageId": msg.ID, "key": "bookmarked", "expectedVersion": 1, "value": nil})
+	if err != nil || len(ack) != 1 {
+		t.Fatalf("EmitWithAck: %v", err)
+	}
+	var result struct {
+		Result  string  `json:"result"`
+		Version int     `json:"version"`
+		Value   *string `json:"value"`
+	}
+	if err := json.Unmarshal(ack[0], &result); err != nil || result.Result != "success" || result.Version != 0 || result.Value != nil {
+		t.Fatalf("unexpected ack: %s", ack[0])
+	}
+	u = other.WaitUpdate("annotate-message")
+	if annotations, _ := u.Body["annotations"].(map[string]any); len(annotations) != 0 {
+		t.Fatalf("expected the bookmark removed: %v", u.Body)
+	}
+
+	msgs, err := c.ListMessages(ctx, sess.ID, 0, 10)
+	if err != nil || len(msgs) != 1 || msgs[0].Annotations != nil {
+		t.Fatalf("expected no annotations left: %+v (%v)", msgs, err)
+	}
+}
@@ -0,0 +1,86 @@
+package server_test
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"happy-server-lite/pkg/client"
+	"happy-server-lite/pkg/servertest"
+)
+
+func TestAuthRequestNotifiesSignedInClients(t *testing.T) {
+	srv := servertest.New(t)
+	ctx, cancel := context.WithTimeout(context.Background(), servertest.DefaultTimeout)
+	defer cancel()
+
+	pub, priv, _ := ed25519.GenerateKey(nil)
+	publicKey := base64.StdEncoding.EncodeToString(pub)
+	app := client.New(srv.URL)
+	issued, err := app.AuthChallenge(ctx)
+	if err != nil {
+		t.Fatalf("AuthChallenge: %v", err)
+	}
+	challenge, _ := base64.StdEncoding.DecodeString(issued.Challenge)
+	token, err := app.Auth(ctx, publicKey, issued.Challenge, base64.StdEncoding.EncodeToString(ed25519.Sign(priv, challenge)))
+	if err != nil {
+		t.Fatalf("Auth: %v", err)
+	}
+	profile, err := app.Profile(ctx)
+	if err != nil {
+		t.Fatalf("Profile: %v", err)
+	}
+	user := srv.ConnectUser(profile.ID)
+
+	wsConn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/ws?token="+token, nil)
+	if err != nil {
+		t.Fatalf("Dial(ws): %v", err)
+	}
+	defer wsConn.Close()
+	// A ping round trip makes sure the /ws client joined the hub.
+	if err := wsConn.WriteJSON(map[string]any{"type": "ping"}); err != nil {
+		t.Fatalf("WriteJSON: %v", err)
+	}
+	_ = wsConn.SetReadDeadline(time.Now().Add(servertest.DefaultTimeout))
+	var pong map[string]any
+	if err := wsConn.ReadJSON(&pong); err != nil || pong["type"] != "pong" {
+		t.Fatalf("expected pong, got %v: %v", pong, err)
+	}
+
+	// The client sends no device description, so the request is posted as a
+	// new device would.
+	body := `{"publicKey":"` + publicKey + `","device":{"platform":"ios","hostname":"phone"}}`
+	resp, err := http.Post(srv.URL+"/v1/auth/request", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("POST /v1/auth/request: %v", err)
+	}
+	resp.Body.Close()
+
+	var event struct {
+		PublicKey string `json:"publicKey"`
+		Device    struct {
+			Hostname string `json:"hostname"`
+		} `json:"device"`
+	}
+	if err := user.WaitEvent("auth-request").Decode(&event); err != nil || event.PublicKey != publicKey || event.Device.Hostname != "phone" {
+		t.Fatalf("unexpected auth-request event: %+v (%v)", event, err)
+	}
+
+	var msg struct {
+		Type string `json:"type"`
+		Body struct {
+			PublicKey string `json:"publicKey"`
+		} `json:"body"`
+	}
+	if err := wsConn.ReadJSON(&msg); err != nil {
+		t.Fatalf("ReadJSON: %v", err)
+	}
+	if msg.Type != "auth-request" || msg.Body.PublicKey != publicKey {
+		t.Fatalf("unexpected /ws message: %+v", msg)
+	}
+}
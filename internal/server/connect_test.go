@@ -0,0 +1,125 @@
+package server_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"happy-server-lite/pkg/happyserver"
+	"happy-server-lite/pkg/servertest"
+)
+
+// newFakeGitHub answers the token exchange for code "good" and serves the
+// octocat as its user.
+func newFakeGitHub(t *testing.T) *httptest.Server {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/login/oauth/access_token", func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("code") != "good" {
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": "bad_verification_code"})
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]string{"access_token": "gho_1"})
+	})
+	mux.HandleFunc("/user", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]any{"id": 42, "login": "octocat", "name": "The Octocat", "avatar_url": "https://avatars/42"})
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestConnectGitHub(t *testing.T) {
+	gh := newFakeGitHub(t)
+	srv := servertest.New(t,
+		happyserver.WithGitHub("id", "secret", "https://happy.example/v1/connect/github/callback", ""),
+		happyserver.WithGitHubEndpoints(gh.URL+"/login/oauth/authorize", gh.URL+"/login/oauth/access_token", gh.URL))
+	ctx := context.Background()
+	c := srv.Client("user-1")
+
+	connectURL, err := c.GitHubConnectURL(ctx)
+	if err != nil {
+		t.Fatalf("GitHubConnectURL: %v", err)
+	}
+	u, err := url.Parse(connectURL)
+	if err != nil || u.Query().Get("client_id") != "id" {
+		t.Fatalf("unexpected connect URL %q: %v", connectURL, err)
+	}
+	state := u.Query().Get("state")
+
+	callback := func(code, state string) int {
+		resp, err := http.Get(srv.URL + "/v1/connect/github/callback?" + url.Values{"code": {code}, "state": {state}}.Encode())
+		if err != nil {
+			t.Fatalf("callback: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if status := callback("good", srv.Token("user-1")); status != http.StatusBadRequest {
+		t.Fatalf("expected a bearer token to be refused as state, got %d", status)
+	}
+	if status := callback("bad", state); status != http.StatusBadGateway {
+		t.Fatalf("expected a rejected code to fail, got %d", status)
+	}
+	if status := callback("good", state); status != http.StatusOK {
+		t.Fatalf("callback: status %d", status)
+	}
+
+	profile, err := c.Profile(ctx)
+	if err != nil {
+		t.Fatalf("Profile: %v", err)
+	}
+	if profile.GitHub == nil || profile.GitHub.Login != "octocat" || profile.GitHub.ID != 42 {
+		t.Fatalf("expected the GitHub user on the profile: %+v", profile.GitHub)
+	}
+	if len(profile.ConnectedServices) != 1 || profile.ConnectedServices[0] != "github" {
+		t.Fatalf("expected github among connected services: %v", profile.ConnectedServices)
+	}
+	if other, _ := srv.Client("user-2").Profile(ctx); other.GitHub != nil {
+		t.Fatalf("expected another user to have no GitHub user")
+	}
+
+	if err := c.DisconnectGitHub(ctx); err != nil {
+		t.Fatalf("DisconnectGitHub: %v", err)
+	}
+	if profile, _ := c.Profile(ctx); profile.GitHub != nil || len(profile.ConnectedServices) != 0 {
+		t.Fatalf("expected the GitHub user to be unlinked: %+v", profile)
+	}
+	if err := c.DisconnectGitHub(ctx); err == nil {
+		t.Fatalf("expected unlinking twice to fail")
+	}
+}
+
+func TestConnectGitHubRedirectsToReturnURL(t *testing.T) {
+	gh := newFakeGitHub(t)
+	srv := servertest.New(t,
+		happyserver.WithGitHub("id", "secret", "https://happy.example/v1/connect/github/callback", "happy://settings"),
+		happyserver.WithGitHubEndpoints("", gh.URL+"/login/oauth/access_token", gh.URL))
+	connectURL, err := srv.Client("user-1").GitHubConnectURL(context.Background())
+	if err != nil {
+		t.Fatalf("GitHubConnectURL: %v", err)
+	}
+	u, _ := url.Parse(connectURL)
+
+	noFollow := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	for code, want := range map[string]string{"good": "happy://settings?github=connected", "bad": "happy://settings?github=error&reason=GitHub+rejected+the+code"} {
+		resp, err := noFollow.Get(srv.URL + "/v1/connect/github/callback?" + url.Values{"code": {code}, "state": {u.Query().Get("state")}}.Encode())
+		if err != nil {
+			t.Fatalf("callback: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusFound || resp.Header.Get("Location") != want {
+			t.Fatalf("code %s: expected a redirect to %s, got %d %s", code, want, resp.StatusCode, resp.Header.Get("Location"))
+		}
+	}
+}
+
+func TestConnectGitHubDisabled(t *testing.T) {
+	srv := servertest.New(t)
+	if _, err := srv.Client("user-1").GitHubConnectURL(context.Background()); err == nil {
+		t.Fatalf("expected GitHub connect to be unavailable without an OAuth app")
+	}
+}
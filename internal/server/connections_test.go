@@ -0,0 +1,84 @@
+package server_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"happy-server-lite/pkg/client"
+	"happy-server-lite/pkg/servertest"
+)
+
+func TestAccountConnectionsListAndDisconnect(t *testing.T) {
+	srv := servertest.New(t)
+	sess := srv.CreateSession("user-1", "tag")
+	srv.CreateMachine("user-1", "machine-1")
+
+	user := srv.ConnectUser("user-1")
+	daemon := srv.ConnectSession("user-1", sess.ID)
+	srv.ConnectMachine("user-1", "machine-1")
+	srv.ConnectUser("user-2")
+
+	ctx := context.Background()
+	api := srv.Client("user-1")
+	conns, err := api.ListConnections(ctx)
+	if err != nil {
+		t.Fatalf("ListConnections: %v", err)
+	}
+	if len(conns) != 3 {
+		t.Fatalf("expected 3 connections, got %d: %+v", len(conns), conns)
+	}
+	var target client.Connection
+	for _, conn := range conns {
+		if conn.IP == "" || conn.ConnectedAt == 0 {
+			t.Fatalf("expected ip and connectedAt, got %+v", conn)
+		}
+		if conn.ClientType == client.ClientTypeSession {
+			target = conn
+		}
+	}
+	if target.ID != daemon.SID() || target.SessionID != sess.ID {
+		t.Fatalf("unexpected session connection: %+v", target)
+	}
+
+	if err := srv.Client("user-2").Disconnect(ctx, target.ID); err == nil {
+		t.Fatalf("expected other users to be unable to disconnect")
+	}
+	if err := api.Disconnect(ctx, target.ID); err != nil {
+		t.Fatalf("Disconnect: %v", err)
+	}
+	select {
+	case <-daemon.Done():
+	case <-user.Done():
+		t.Fatalf("only the targeted connection should close")
+	case <-time.After(servertest.DefaultTimeout):
+		t.Fatalf("expected targeted connection to be closed")
+	}
+}
+
+func TestProfileReportsDevices(t *testing.T) {
+	srv := servertest.New(t)
+	sess := srv.CreateSession("user-1", "tag")
+	srv.CreateSession("user-1", "idle")
+	srv.CreateMachine("user-1", "machine-1")
+
+	daemon := srv.ConnectSession("user-1", sess.ID)
+	srv.ConnectUser("user-1")
+	daemon.Emit("session-alive", map[string]any{"sid": sess.ID, "time": time.Now().UnixMilli()})
+
+	deadline := time.Now().Add(servertest.DefaultTimeout)
+	for {
+		profile, err := srv.Client("user-1").Profile(context.Background())
+		if err != nil {
+			t.Fatalf("Profile: %v", err)
+		}
+		want := client.Devices{Machines: 1, ActiveSessions: 1, Connections: 2}
+		if profile.Devices == want {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected devices %+v, got %+v", want, profile.Devices)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,92 @@
+package server_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+
+	"happy-server-lite/pkg/client"
+	"happy-server-lite/pkg/servertest"
+)
+
+func TestSocketIOMessageReplayReturnsExisting(t *testing.T) {
+	srv := servertest.New(t)
+	ctx, cancel := context.WithTimeout(context.Background(), servertest.DefaultTimeout)
+	defer cancel()
+	sess := srv.CreateSession("user-1", "tag")
+
+	// Each send arrives on a fresh connection, as a retry after a reconnect
+	// would.
+	send := func() client.Message {
+		t.Helper()
+		daemon := srv.ConnectSession("user-1", sess.ID)
+		defer daemon.Close()
+		ack, err := daemon.EmitWithAck(ctx, "message", map[string]any{"sid": sess.ID, "message": "enc", "localId": "local-1"})
+		var out struct {
+			Message client.Message `json:"message"`
+		}
+		if err != nil || len(ack) != 1 || json.Unmarshal(ack[0], &out) != nil {
+			t.Fatalf("unexpected ack: %v (%v)", ack, err)
+		}
+		return out.Message
+	}
+
+	first := send()
+	again := send()
+	if first.ID == "" || first.ID != again.ID || first.Seq != again.Seq {
+		t.Fatalf("expected the replay to return the first message, got %+v and %+v", first, again)
+	}
+	if again.LocalID != "local-1" {
+		t.Fatalf("expected localId local-1, got %q", again.LocalID)
+	}
+	if msgs, err := srv.Client("user-1").ListMessages(ctx, sess.ID, 0, 10); err != nil || len(msgs) != 1 {
+		t.Fatalf("expected one stored message, got %d (%v)", len(msgs), err)
+	}
+}
+
+func TestSocketIOMessageEditsBroadcast(t *testing.T) {
+	srv := servertest.New(t)
+	ctx, cancel := context.WithTimeout(context.Background(), servertest.DefaultTimeout)
+	defer cancel()
+	c := srv.Client("user-1")
+	sess := srv.CreateSession("user-1", "tag")
+	first, err := c.PostMessage(ctx, sess.ID, "one", "")
+	if err != nil {
+		t.Fatalf("PostMessage: %v", err)
+	}
+	second, err := c.PostMessage(ctx, sess.ID, "two", "")
+	if err != nil {
+		t.Fatalf("PostMessage: %v", err)
+	}
+	user := srv.ConnectUser("user-1")
+	daemon := srv.ConnectSession("user-1", sess.ID)
+
+	ack, err := daemon.EmitWithAck(ctx, "delete-message", map[string]any{"sid": sess.ID, "messageId": second.ID})
+	var deleted struct {
+		Result  string         `json:"result"`
+		Message client.Message `json:"message"`
+	}
+	if err != nil || len(ack) != 1 || json.Unmarshal(ack[0], &deleted) != nil || deleted.Result != "success" || !deleted.Message.Deleted {
+		t.Fatalf("unexpected delete ack: %v (%v)", ack, err)
+	}
+	if u := user.WaitUpdate("delete-message"); u.Body["messageId"] != second.ID || u.Body["sid"] != sess.ID {
+		t.Fatalf("unexpected delete update: %v", u.Body)
+	}
+
+	if _, err := c.UpdateMessage(ctx, sess.ID, first.ID, "uno", ""); err != nil {
+		t.Fatalf("UpdateMessage: %v", err)
+	}
+	u := user.WaitUpdate("update-message")
+	msg, _ := u.Body["message"].(map[string]any)
+	content, _ := msg["content"].(map[string]any)
+	if msg["id"] != first.ID || content["c"] != "uno" {
+		t.Fatalf("unexpected edit update: %v", u.Body)
+	}
+
+	var apiErr *client.APIError
+	if _, err := c.DeleteMessage(ctx, sess.ID, second.ID); !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected 404 deleting a tombstone, got %v", err)
+	}
+}
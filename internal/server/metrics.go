@@ -0,0 +1,42 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	"happy-server-lite/internal/clock"
+	"happy-server-lite/internal/replication"
+	"happy-server-lite/internal/socketio"
+	"happy-server-lite/internal/store"
+)
+
+// sampleMetrics records what the Socket.IO server did every interval into
+// rec until ctx is done. A standby records nothing until promoted: the
+// primary's history reaches it through replication.
+func sampleMetrics(ctx context.Context, sio *socketio.Server, rec store.MetricsRecorder, standby *replication.Follower, c clock.Clock, interval time.Duration) {
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	last, lastAt := sio.Metrics(), clock.Now(c).UnixMilli()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		m, now := sio.Metrics(), clock.Now(c).UnixMilli()
+		if standby == nil || !standby.Standby() {
+			rec.RecordMetrics(store.MetricsSample{
+				At:              now,
+				IntervalMs:      now - lastAt,
+				Connections:     m.Connections,
+				Messages:        m.MessagesIn - last.MessagesIn,
+				Broadcasts:      m.Broadcasts - last.Broadcasts,
+				BroadcastMicros: m.BroadcastMicros - last.BroadcastMicros,
+			})
+		}
+		last, lastAt = m, now
+	}
+}
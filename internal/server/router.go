@@ -1,68 +1,286 @@
 package server
 
 import (
+	"context"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"happy-server-lite/internal/apierror"
 	"happy-server-lite/internal/auth"
+	"happy-server-lite/internal/authaudit"
+	"happy-server-lite/internal/blobstore"
+	"happy-server-lite/internal/clock"
+	"happy-server-lite/internal/debugtap"
+	"happy-server-lite/internal/github"
 	"happy-server-lite/internal/handler"
 	"happy-server-lite/internal/hub"
+	"happy-server-lite/internal/ids"
 	"happy-server-lite/internal/middleware"
+	"happy-server-lite/internal/purge"
+	"happy-server-lite/internal/push"
+	"happy-server-lite/internal/replication"
+	"happy-server-lite/internal/selfcheck"
 	"happy-server-lite/internal/socketio"
 	"happy-server-lite/internal/store"
 )
 
 type Deps struct {
-	Store       *store.Store
-	TokenConfig auth.TokenConfig
+	Store        store.Storage
+	TokenConfig  auth.TokenConfig
+	ErrorFormat  apierror.Format
+	SocketLimits socketio.Limits
+	WSLimits     handler.WebSocketLimits
+	// Blobs holds binary payloads for attachment features; nil when no blob
+	// store is configured.
+	Blobs blobstore.BlobStore
+	// AdminToken enables /v1/admin; empty leaves the admin API unreachable.
+	AdminToken       string
+	DebugTapCapacity int
+	// AuthAuditCapacity is how many sign-in attempts /v1/admin/auth-log
+	// keeps; zero picks the default.
+	AuthAuditCapacity int
+	// Purge runs the deleted-record purge job; nil when the store cannot
+	// purge.
+	Purge *purge.Runner
+	// Push delivers notifications to registered devices; nil disables them.
+	Push push.Sender
+	// PushTemplates words notifications per event type and locale; nil
+	// uses the built-in English text.
+	PushTemplates *push.Templates
+	// GitHub enables /v1/connect/github; nil leaves accounts unable to
+	// link a GitHub user.
+	GitHub *github.OAuth
+	// GitHubReturnURL is where the browser lands after the GitHub
+	// callback; empty answers the callback with JSON.
+	GitHubReturnURL string
+	// RateLimits limits requests per client IP by middleware.RateLimitAuth
+	// and the other groups; groups left out, or a nil map, are unlimited.
+	RateLimits map[string]middleware.RateLimit
+	// NewID generates update ids; nil picks random UUIDs. Pass the store's
+	// generator so all ids follow one strategy.
+	NewID ids.Generator
+	// Clock stamps changes, updates and tokens; nil reads the wall clock.
+	// Pass the store's clock so both agree.
+	Clock clock.Clock
+	// ReplicationLog is the store's log standbys tail; nil when this
+	// instance serves none.
+	ReplicationLog *store.ReplicationLog
+	// Standby follows a primary; while it has not been promoted only the
+	// admin API is served. Nil on a primary.
+	Standby *replication.Follower
+	// SelfCheck is the outcome of the startup checks, served at
+	// /health/ready; nil when none were run.
+	SelfCheck *selfcheck.Report
+	// StartedAt is when the server booted, in unix ms. When set, each user's
+	// first socket connection after boot gets a server-restarted event.
+	StartedAt int64
+	// RefreshTokenExpiry enables refresh tokens, valid this long unused;
+	// zero leaves them off.
+	RefreshTokenExpiry time.Duration
+	// AllowClientAuthChallenge lets /v1/auth accept challenges the client
+	// picked instead of only those issued by /v1/auth/challenge.
+	AllowClientAuthChallenge bool
+	// AuthLockout turns away /v1/auth from client addresses after repeated
+	// bad signatures; zero After disables it.
+	AuthLockout middleware.FailureLimit
+	// ServerName, ServerContact and WelcomeText identify the instance at /
+	// and /v1/server-info; empty values keep the defaults.
+	ServerName    string
+	ServerContact string
+	WelcomeText   string
+	// LoadShedder, when set, turns away the feed, user search and account
+	// export with 503 while the process is over its memory or goroutine
+	// limits.
+	LoadShedder *middleware.LoadShedder
+	// RequireMachineCert refuses daemons that come without a verified
+	// client certificate: machine upserts, the daemon endpoint and
+	// machine-scoped sockets. Certificates are checked against their
+	// machine whether or not it is set.
+	RequireMachineCert bool
+	// MetricsHistoryInterval is how often the Socket.IO metrics are
+	// sampled into the store's history, when it keeps one; zero picks a
+	// minute.
+	MetricsHistoryInterval time.Duration
+	// Context bounds work the router starts that outlives a request, such
+	// as sign-in pushes; cancel it on shutdown. Nil never cancels.
+	Context context.Context
+}
+
+// rejectWhileStandby answers 503 to everything but the admin API until the
+// standby is promoted, as its store only takes the primary's changes.
+func rejectWhileStandby(f *replication.Follower) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		path := c.Request.URL.Path
+		if path == "/" || path == "/v1/server-info" || path == "/.well-known/jwks.json" || path == "/health" || path == "/health/ready" || strings.HasPrefix(path, "/v1/admin/") || !f.Standby() {
+			c.Next()
+			return
+		}
+		apierror.Abort(c, http.StatusServiceUnavailable, apierror.CodeUnavailable, "Server is a standby")
+	}
 }
 
 func NewRouter(deps Deps) *gin.Engine {
 	r := gin.New()
 	r.Use(gin.Recovery())
 	r.Use(gin.Logger())
+	r.Use(apierror.Middleware(deps.ErrorFormat))
+	if deps.Standby != nil {
+		r.Use(rejectWhileStandby(deps.Standby))
+	}
 
-	r.GET("/", func(c *gin.Context) {
-		c.String(http.StatusOK, "Welcome to Happy Server!")
-	})
+	serverInfo := &handler.ServerInfoHandler{Name: deps.ServerName, Contact: deps.ServerContact, Welcome: deps.WelcomeText}
+	r.GET("/", serverInfo.Root)
+	r.GET("/v1/server-info", serverInfo.Info)
+	r.GET("/.well-known/jwks.json", (&handler.JWKSHandler{TokenConfig: deps.TokenConfig}).Keys)
 
-	r.GET("/health", func(c *gin.Context) {
-		c.JSON(200, gin.H{"ok": true})
-	})
+	if deps.TokenConfig.Clock == nil {
+		deps.TokenConfig.Clock = deps.Clock
+	}
+	if deps.TokenConfig.Revocations == nil {
+		deps.TokenConfig.Revocations = auth.NewRevocations()
+	}
+	deps.TokenConfig.AccountDisabled = deps.Store.IsAccountDisabled
+	deps.TokenConfig.DeviceSeen = func(ctx context.Context, userID, deviceID string) bool {
+		return deps.Store.TouchDevice(ctx, userID, deviceID, auth.ClientIPFromContext(ctx), clock.Now(deps.Clock).UnixMilli())
+	}
+
+	limits := middleware.NewRateLimitGroups(deps.RateLimits)
+	authLimit := limits.Middleware(middleware.RateLimitAuth)
+	readWriteLimit := limits.ReadWriteMiddleware()
+	upgradeLimit := limits.Middleware(middleware.RateLimitSocketUpgrade)
+	shed := deps.LoadShedder.Middleware()
 
 	authRequestLimiter := middleware.NewRateLimiter(10, time.Minute)
-	authHandler := &handler.AuthHandler{Store: deps.Store, TokenConfig: deps.TokenConfig, AuthRequestLimiter: authRequestLimiter}
+	authAudit := authaudit.New(deps.AuthAuditCapacity)
+	authHandler := &handler.AuthHandler{Store: deps.Store, TokenConfig: deps.TokenConfig, AuthRequestLimiter: authRequestLimiter, Clock: deps.Clock, RefreshTokenExpiry: deps.RefreshTokenExpiry, AllowClientChallenge: deps.AllowClientAuthChallenge, Audit: authAudit}
+	if deps.AuthLockout.After > 0 {
+		authHandler.Lockout = middleware.NewFailureLimiter(deps.AuthLockout)
+		if deps.Context != nil {
+			context.AfterFunc(deps.Context, authHandler.Lockout.Stop)
+		}
+	}
+	if deps.Push != nil {
+		pusher := &handler.AuthRequestPusher{Store: deps.Store, Push: deps.Push, Templates: deps.PushTemplates, Context: deps.Context}
+		deps.Store.SubscribeTypes(pusher.HandleStoreEvent, store.EventAuthRequested)
+	}
 
-	r.POST("/v1/auth", authHandler.Auth)
-	r.POST("/v1/auth/request", authHandler.Request)
-	r.POST("/v1/auth/account/request", authHandler.Request)
-	r.GET("/v1/auth/request/status", authHandler.RequestStatus)
+	r.GET("/v1/auth/challenge", authLimit, authHandler.Challenge)
+	r.POST("/v1/auth", authLimit, authHandler.Auth)
+	r.POST("/v1/auth/request", authLimit, authHandler.Request)
+	r.POST("/v1/auth/account/request", authLimit, authHandler.Request)
+	r.GET("/v1/auth/request/status", authLimit, authHandler.RequestStatus)
+	r.POST("/v1/auth/refresh", authLimit, authHandler.Refresh)
 
 	versionHandler := &handler.VersionHandler{}
-	r.POST("/v1/version", versionHandler.Check)
+	r.POST("/v1/version", readWriteLimit, versionHandler.Check)
+
+	tap := debugtap.New(deps.DebugTapCapacity)
 
 	protected := r.Group("/v1")
-	protected.Use(middleware.RequireAuth(deps.TokenConfig))
+	protected.Use(readWriteLimit)
+	protected.Use(middleware.RequireAuth(deps.TokenConfig, func(ctx context.Context, id, secretHash string) (string, bool) {
+		k, ok := deps.Store.UseAPIKey(ctx, id, secretHash, clock.Now(deps.Clock).UnixMilli())
+		return k.UserID, ok
+	}))
+	protected.Use(debugtap.Middleware(tap, middleware.UserIDFromContext))
 	protected.POST("/auth/response", authHandler.Response)
 	protected.POST("/auth/account/response", authHandler.Response)
+	protected.POST("/auth/reject", authHandler.Reject)
+	protected.GET("/auth/refresh-tokens", authHandler.ListRefreshTokens)
+	protected.DELETE("/auth/refresh-tokens/:id", authHandler.DeleteRefreshToken)
+	protected.POST("/auth/token/scoped", authHandler.ScopedToken)
+	protected.POST("/auth/renew", authHandler.Renew)
+
+	sio := socketio.NewServer(socketio.Deps{Store: deps.Store, TokenConfig: deps.TokenConfig, Limits: deps.SocketLimits, Tap: tap, NewID: deps.NewID, Clock: deps.Clock, StartedAt: deps.StartedAt, RequireMachineCert: deps.RequireMachineCert})
+
+	if rec, ok := deps.Store.(store.MetricsRecorder); ok {
+		ctx := deps.Context
+		if ctx == nil {
+			ctx = context.Background()
+		}
+		go sampleMetrics(ctx, sio, rec, deps.Standby, deps.Clock, deps.MetricsHistoryInterval)
+	}
+
+	// Load balancers stop routing to an instance once it starts draining,
+	// and only route to a standby once it is promoted.
+	r.GET("/health", func(c *gin.Context) {
+		if sio.Draining() {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"ok": false, "draining": true})
+			return
+		}
+		if deps.Standby != nil && deps.Standby.Standby() {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"ok": false, "standby": true})
+			return
+		}
+		c.JSON(200, gin.H{"ok": true})
+	})
+	// Readiness reports the startup checks, failing while any of them did.
+	r.GET("/health/ready", func(c *gin.Context) {
+		if deps.SelfCheck == nil {
+			c.JSON(http.StatusOK, selfcheck.Report{OK: true, StartedAt: deps.StartedAt, Checks: []selfcheck.Result{}})
+			return
+		}
+		status := http.StatusOK
+		if !deps.SelfCheck.OK {
+			status = http.StatusServiceUnavailable
+		}
+		c.JSON(status, deps.SelfCheck)
+	})
 
-	accountHandler := &handler.AccountHandler{Store: deps.Store}
+	wsHub := hub.New()
+
+	accountHandler := &handler.AccountHandler{Store: deps.Store, Sockets: sio, Hub: wsHub, Revocations: deps.TokenConfig.Revocations, Clock: deps.Clock}
+	protected.DELETE("/account", accountHandler.Delete)
 	protected.GET("/account/profile", accountHandler.Profile)
 	protected.GET("/account/settings", accountHandler.Settings)
 	protected.POST("/account/settings", accountHandler.UpdateSettings)
+	protected.GET("/account/export", shed, accountHandler.Export)
+	protected.GET("/account/api-keys", accountHandler.ListAPIKeys)
+	protected.POST("/account/api-keys", accountHandler.CreateAPIKey)
+	protected.DELETE("/account/api-keys/:id", accountHandler.DeleteAPIKey)
+	protected.GET("/account/devices", accountHandler.ListDevices)
+	protected.DELETE("/account/devices/:id", accountHandler.DeleteDevice)
+
+	if deps.GitHub != nil {
+		connectHandler := &handler.ConnectHandler{Store: deps.Store, GitHub: deps.GitHub, TokenConfig: deps.TokenConfig, ReturnURL: deps.GitHubReturnURL, Clock: deps.Clock}
+		protected.GET("/connect/github/params", connectHandler.GitHubParams)
+		protected.DELETE("/connect/github", connectHandler.DisconnectGitHub)
+		r.GET("/v1/connect/github/callback", authLimit, connectHandler.GitHubCallback)
+	}
 
-	sessionHandler := &handler.SessionHandler{Store: deps.Store}
+	connectionsHandler := &handler.ConnectionsHandler{Sockets: sio}
+	protected.GET("/account/connections", connectionsHandler.List)
+	protected.DELETE("/account/connections/:id", connectionsHandler.Delete)
+
+	sessionHandler := &handler.SessionHandler{Store: deps.Store, Clock: deps.Clock}
 	protected.GET("/sessions", sessionHandler.List)
 	protected.POST("/sessions", sessionHandler.GetOrCreate)
+	protected.GET("/sessions/by-tag/:tag", sessionHandler.ByTag)
 	protected.DELETE("/sessions/:id", sessionHandler.Delete)
 	protected.GET("/sessions/:id/messages", sessionHandler.Messages)
+	protected.GET("/sessions/:id/messages/stream", sessionHandler.StreamMessages)
+	protected.GET("/sessions/:id/export", shed, sessionHandler.Export)
+	protected.POST("/sessions/:id/messages", sessionHandler.PostMessage)
+	protected.PUT("/sessions/:id/messages/:messageId", sessionHandler.UpdateMessage)
+	protected.DELETE("/sessions/:id/messages/:messageId", sessionHandler.DeleteMessage)
+	protected.PUT("/sessions/:id/messages/:messageId/annotations/:key", sessionHandler.AnnotateMessage)
+	protected.DELETE("/sessions/:id/messages/:messageId/annotations/:key", sessionHandler.DeleteAnnotation)
+	protected.GET("/sessions/:id/locks", sessionHandler.Locks)
+	protected.POST("/sessions/:id/locks/:name", sessionHandler.AcquireLock)
+	protected.PUT("/sessions/:id/locks/:name", sessionHandler.RenewLock)
+	protected.DELETE("/sessions/:id/locks/:name", sessionHandler.ReleaseLock)
 
-	machineHandler := &handler.MachineHandler{Store: deps.Store}
+	machineHandler := &handler.MachineHandler{Store: deps.Store, Clock: deps.Clock}
 	protected.GET("/machines", machineHandler.List)
-	protected.POST("/machines", machineHandler.Upsert)
+	protected.POST("/machines", middleware.MachineCert(deps.RequireMachineCert), machineHandler.Upsert)
+	protected.DELETE("/machines/:id", middleware.MachineCert(false), machineHandler.Delete)
+
+	syncHandler := &handler.SyncHandler{Store: deps.Store, Clock: deps.Clock}
+	protected.GET("/sync", syncHandler.Changes)
 
-	artifactHandler := &handler.ArtifactHandler{Store: deps.Store}
+	artifactHandler := &handler.ArtifactHandler{Store: deps.Store, Clock: deps.Clock}
 	protected.GET("/artifacts", artifactHandler.List)
 	protected.POST("/artifacts", artifactHandler.Create)
 	protected.GET("/artifacts/:id", artifactHandler.Get)
@@ -70,7 +288,7 @@ func NewRouter(deps Deps) *gin.Engine {
 	protected.DELETE("/artifacts/:id", artifactHandler.Delete)
 
 	feedHandler := &handler.FeedHandler{}
-	protected.GET("/feed", feedHandler.List)
+	protected.GET("/feed", shed, feedHandler.List)
 
 	friendsHandler := &handler.FriendsHandler{}
 	protected.GET("/friends", friendsHandler.List)
@@ -78,22 +296,63 @@ func NewRouter(deps Deps) *gin.Engine {
 	protected.POST("/friends/remove", friendsHandler.Remove)
 
 	userHandler := &handler.UserHandler{}
-	protected.GET("/user/search", userHandler.Search)
+	protected.GET("/user/search", shed, userHandler.Search)
 	protected.GET("/user/:id", userHandler.Get)
 
-	pushHandler := &handler.PushTokensHandler{}
+	pushHandler := &handler.PushTokensHandler{Store: deps.Store, Clock: deps.Clock}
 	protected.GET("/push-tokens", pushHandler.List)
 	protected.POST("/push-tokens", pushHandler.Register)
+	protected.DELETE("/push-tokens/:token", pushHandler.Delete)
 
-	wsHub := hub.New()
-	wsHandler := &handler.WebSocketHandler{Hub: wsHub, Store: deps.Store, TokenConfig: deps.TokenConfig}
-	r.GET("/ws", wsHandler.Serve)
-
-	sio := socketio.NewServer(socketio.Deps{Store: deps.Store, TokenConfig: deps.TokenConfig})
-	r.Any("/v1/updates", gin.WrapH(sio))
-	r.Any("/v1/updates/*any", gin.WrapH(sio))
-	r.Any("/v1/user-machine-daemon", gin.WrapH(sio))
-	r.Any("/v1/user-machine-daemon/*any", gin.WrapH(sio))
+	admin := r.Group("/v1/admin")
+	admin.Use(readWriteLimit)
+	admin.Use(middleware.RequireAdmin(deps.AdminToken))
+	adminHandler := &handler.AdminHandler{Store: deps.Store, Tap: tap, AuthAudit: authAudit, Sockets: sio, Hub: wsHub, Revocations: deps.TokenConfig.Revocations, TokenConfig: deps.TokenConfig, Purge: deps.Purge, LoadShedder: deps.LoadShedder, Clock: deps.Clock}
+	admin.GET("/debug-tap", adminHandler.ListDebugTaps)
+	admin.PUT("/debug-tap/:userId", adminHandler.EnableDebugTap)
+	admin.DELETE("/debug-tap/:userId", adminHandler.DisableDebugTap)
+	admin.GET("/debug-tap/:userId", adminHandler.DebugTapEntries)
+	admin.GET("/auth-log", adminHandler.AuthLog)
+	admin.GET("/connections", adminHandler.ListConnections)
+	admin.GET("/rooms/:kind/:id", adminHandler.RoomMembers)
+	admin.GET("/metrics", adminHandler.Metrics)
+	admin.GET("/metrics/history", adminHandler.MetricsHistory)
+	admin.GET("/stats", adminHandler.Stats)
+	admin.POST("/users/:userId/logout", adminHandler.ForceLogout)
+	admin.DELETE("/users/:userId/lock", adminHandler.UnlockUser)
+	admin.PUT("/users/:userId/disabled", adminHandler.DisableAccount)
+	admin.DELETE("/users/:userId/disabled", adminHandler.EnableAccount)
+	admin.POST("/users/:userId/machines/:machineId/commands", adminHandler.SendCommand)
+	admin.GET("/machine-commands", adminHandler.ListCommands)
+	admin.GET("/backup", adminHandler.Backup)
+	admin.POST("/restore", adminHandler.Restore)
+	admin.GET("/purge", adminHandler.PurgeStats)
+	admin.POST("/purge", adminHandler.RunPurge)
+	admin.GET("/memory", adminHandler.Memory)
+	admin.GET("/drain", adminHandler.DrainStatus)
+	admin.POST("/drain", adminHandler.Drain)
+	admin.DELETE("/drain", adminHandler.CancelDrain)
+
+	// Replication skips the per-IP limits: a standby asks for changes as
+	// fast as the primary makes them.
+	repl := r.Group("/v1/admin/replication")
+	repl.Use(middleware.RequireAdmin(deps.AdminToken))
+	replicationHandler := &handler.ReplicationHandler{Store: deps.Store, Log: deps.ReplicationLog, Follower: deps.Standby}
+	repl.GET("", replicationHandler.Status)
+	repl.GET("/snapshot", replicationHandler.Snapshot)
+	repl.GET("/changes", replicationHandler.Changes)
+	repl.POST("/promote", replicationHandler.Promote)
+
+	wsHandler := &handler.WebSocketHandler{Hub: wsHub, Store: deps.Store, TokenConfig: deps.TokenConfig, Limits: deps.WSLimits, Clock: deps.Clock}
+	deps.Store.SubscribeTypes(wsHandler.HandleStoreEvent, store.EventMessageAppended, store.EventAuthRequested)
+	r.GET("/ws", upgradeLimit, wsHandler.Serve)
+
+	appCert := middleware.MachineCert(false)
+	daemonCert := middleware.MachineCert(deps.RequireMachineCert)
+	r.Any("/v1/updates", upgradeLimit, appCert, gin.WrapH(sio))
+	r.Any("/v1/updates/*any", upgradeLimit, appCert, gin.WrapH(sio))
+	r.Any("/v1/user-machine-daemon", upgradeLimit, daemonCert, gin.WrapH(sio.DaemonHandler()))
+	r.Any("/v1/user-machine-daemon/*any", upgradeLimit, daemonCert, gin.WrapH(sio.DaemonHandler()))
 
 	return r
 }
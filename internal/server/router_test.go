@@ -2,7 +2,12 @@ package server
 
 import (
 	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"strings"
@@ -10,11 +15,17 @@ import (
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
 	"happy-server-lite/internal/auth"
+	"happy-server-lite/internal/clock"
+	"happy-server-lite/internal/middleware"
+	"happy-server-lite/internal/push"
+	"happy-server-lite/internal/selfcheck"
 	"happy-server-lite/internal/store"
 )
 
 func TestAuthRequestFlow(t *testing.T) {
+	ctx := context.Background()
 	gin.SetMode(gin.TestMode)
 	st := store.New()
 	tokenCfg := auth.TokenConfig{Secret: "secret", Expiry: time.Hour, Issuer: "test"}
@@ -65,13 +76,472 @@ func TestAuthRequestFlow(t *testing.T) {
 		t.Fatalf("unexpected auth response: %v", resp)
 	}
 	issuedToken, _ := resp["token"].(string)
-	claims, err := auth.VerifyToken(issuedToken, tokenCfg)
+	claims, err := auth.VerifyToken(ctx, issuedToken, tokenCfg)
 	if err != nil {
 		t.Fatalf("VerifyToken: %v", err)
 	}
 	if claims.UserID != "mobile-1" {
 		t.Fatalf("expected issued token for mobile-1, got %q", claims.UserID)
 	}
+
+	// The token is handed out once; polling again starts a new request.
+	w = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodPost, "/v1/auth/request", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	r.ServeHTTP(w, req)
+	if !strings.Contains(w.Body.String(), `"state":"requested"`) {
+		t.Fatalf("expected a new pending request, got %s", w.Body.String())
+	}
+}
+
+func TestAuthRequestReject(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	st := store.New()
+	tokenCfg := auth.TokenConfig{Secret: "secret", Expiry: time.Hour, Issuer: "test"}
+	r := NewRouter(Deps{Store: st, TokenConfig: tokenCfg})
+	mobileToken, err := auth.CreateToken("mobile-1", tokenCfg)
+	if err != nil {
+		t.Fatalf("CreateToken: %v", err)
+	}
+
+	post := func(path string, payload map[string]any, token string) *httptest.ResponseRecorder {
+		t.Helper()
+		body, _ := json.Marshal(payload)
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		r.ServeHTTP(w, req)
+		return w
+	}
+	state := func(w *httptest.ResponseRecorder) string {
+		t.Helper()
+		var resp map[string]any
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("unmarshal: %v", err)
+		}
+		s, _ := resp["state"].(string)
+		return s
+	}
+
+	if w := post("/v1/auth/reject", map[string]any{"publicKey": "pk"}, mobileToken); w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for an unknown request, got %d", w.Code)
+	}
+	if w := post("/v1/auth/request", map[string]any{"publicKey": "pk"}, ""); state(w) != "requested" {
+		t.Fatalf("expected requested, got %s", w.Body.String())
+	}
+	if w := post("/v1/auth/reject", map[string]any{"publicKey": "pk"}, ""); w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without a token, got %d", w.Code)
+	}
+	if w := post("/v1/auth/reject", map[string]any{"publicKey": "pk"}, mobileToken); w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := post("/v1/auth/request", map[string]any{"publicKey": "pk"}, ""); state(w) != "rejected" {
+		t.Fatalf("expected rejected, got %s", w.Body.String())
+	}
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/v1/auth/request/status?publicKey=pk", nil))
+	if !strings.Contains(w.Body.String(), `"status":"rejected"`) {
+		t.Fatalf("expected rejected status, got %s", w.Body.String())
+	}
+
+	// Approving afterwards still works, and an approved request stays approved.
+	if w := post("/v1/auth/response", map[string]any{"publicKey": "pk", "response": "resp"}, mobileToken); w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	if w := post("/v1/auth/reject", map[string]any{"publicKey": "pk"}, mobileToken); w.Code != http.StatusConflict {
+		t.Fatalf("expected 409 for an authorized request, got %d", w.Code)
+	}
+	if w := post("/v1/auth/request", map[string]any{"publicKey": "pk"}, ""); state(w) != "authorized" {
+		t.Fatalf("expected authorized, got %s", w.Body.String())
+	}
+}
+
+func TestAuthRequestDeviceInfo(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	st := store.New()
+	tokenCfg := auth.TokenConfig{Secret: "secret", Expiry: time.Hour, Issuer: "test"}
+	r := NewRouter(Deps{Store: st, TokenConfig: tokenCfg})
+
+	post := func(payload map[string]any) int {
+		t.Helper()
+		body, _ := json.Marshal(payload)
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/v1/auth/request", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	device := map[string]any{"platform": "darwin", "hostname": "laptop", "appVersion": "1.2.3"}
+	if code := post(map[string]any{"publicKey": "pk", "device": device}); code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", code)
+	}
+	// A poll without device info keeps what the first request reported.
+	if code := post(map[string]any{"publicKey": "pk"}); code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", code)
+	}
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/v1/auth/request/status?publicKey=pk", nil))
+	var status struct {
+		Status string         `json:"status"`
+		Device map[string]any `json:"device"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+		t.Fatalf("unmarshal: %v (%s)", err, w.Body.String())
+	}
+	if status.Status != "pending" || status.Device["hostname"] != "laptop" || status.Device["appVersion"] != "1.2.3" {
+		t.Fatalf("unexpected status: %s", w.Body.String())
+	}
+
+	long := map[string]any{"hostname": strings.Repeat("h", 300)}
+	if code := post(map[string]any{"publicKey": "pk2", "device": long}); code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for oversized device info, got %d", code)
+	}
+}
+
+func TestAuthRefreshTokens(t *testing.T) {
+	ctx := context.Background()
+	gin.SetMode(gin.TestMode)
+	st := store.New()
+	tokenCfg := auth.TokenConfig{Secret: "secret", Expiry: 15 * time.Minute, Issuer: "test"}
+	r := NewRouter(Deps{Store: st, TokenConfig: tokenCfg, RefreshTokenExpiry: 24 * time.Hour, AllowClientAuthChallenge: true})
+
+	call := func(method, path, token string, payload any) (int, map[string]any) {
+		t.Helper()
+		var body []byte
+		if payload != nil {
+			body, _ = json.Marshal(payload)
+		}
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(method, path, bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		r.ServeHTTP(w, req)
+		var out map[string]any
+		_ = json.Unmarshal(w.Body.Bytes(), &out)
+		return w.Code, out
+	}
+
+	device := map[string]any{"platform": "linux", "hostname": "desktop"}
+	call(http.MethodPost, "/v1/auth/request", "", map[string]any{"publicKey": "pk", "device": device})
+	approver, _ := auth.CreateToken("user-1", tokenCfg)
+	if code, _ := call(http.MethodPost, "/v1/auth/response", approver, map[string]any{"publicKey": "pk", "response": "resp"}); code != http.StatusOK {
+		t.Fatalf("approve: %d", code)
+	}
+	code, polled := call(http.MethodPost, "/v1/auth/request", "", map[string]any{"publicKey": "pk"})
+	first, _ := polled["refreshToken"].(string)
+	if code != http.StatusOK || polled["state"] != "authorized" || first == "" {
+		t.Fatalf("expected a refresh token with the authorized token: %d %v", code, polled)
+	}
+
+	code, refreshed := call(http.MethodPost, "/v1/auth/refresh", "", map[string]any{"refreshToken": first})
+	second, _ := refreshed["refreshToken"].(string)
+	if code != http.StatusOK || refreshed["token"] == nil || second == "" || second == first {
+		t.Fatalf("refresh: %d %v", code, refreshed)
+	}
+	claims, err := auth.VerifyToken(ctx, refreshed["token"].(string), tokenCfg)
+	if err != nil || claims.UserID != "user-1" {
+		t.Fatalf("expected an access token for user-1: %+v %v", claims, err)
+	}
+
+	code, listed := call(http.MethodGet, "/v1/auth/refresh-tokens", approver, nil)
+	grants, _ := listed["refreshTokens"].([]any)
+	if code != http.StatusOK || len(grants) != 1 || grants[0].(map[string]any)["device"].(map[string]any)["hostname"] != "desktop" {
+		t.Fatalf("unexpected refresh tokens: %d %v", code, listed)
+	}
+
+	// Presenting a rotated token again revokes the grant, so the current
+	// one stops working too.
+	if code, _ := call(http.MethodPost, "/v1/auth/refresh", "", map[string]any{"refreshToken": first}); code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for a reused refresh token, got %d", code)
+	}
+	if code, _ := call(http.MethodPost, "/v1/auth/refresh", "", map[string]any{"refreshToken": second}); code != http.StatusUnauthorized {
+		t.Fatalf("expected the grant to be revoked after reuse, got %d", code)
+	}
+
+	// Signing in directly issues a grant too, which can be revoked by id.
+	pub, priv, _ := ed25519.GenerateKey(nil)
+	challenge := []byte("challenge")
+	code, signedIn := call(http.MethodPost, "/v1/auth", "", map[string]any{
+		"publicKey": base64.StdEncoding.EncodeToString(pub),
+		"challenge": base64.StdEncoding.EncodeToString(challenge),
+		"signature": base64.StdEncoding.EncodeToString(ed25519.Sign(priv, challenge)),
+	})
+	refresh, _ := signedIn["refreshToken"].(string)
+	if code != http.StatusOK || refresh == "" {
+		t.Fatalf("auth: %d %v", code, signedIn)
+	}
+	id, _, _ := auth.ParseRefreshToken(refresh)
+	if code, _ := call(http.MethodDelete, "/v1/auth/refresh-tokens/"+id, signedIn["token"].(string), nil); code != http.StatusOK {
+		t.Fatalf("delete: %d", code)
+	}
+	if code, _ := call(http.MethodPost, "/v1/auth/refresh", "", map[string]any{"refreshToken": refresh}); code != http.StatusUnauthorized {
+		t.Fatalf("expected a deleted refresh token to be rejected, got %d", code)
+	}
+}
+
+func TestDevicesRevocation(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	st := store.New()
+	tokenCfg := auth.TokenConfig{Secret: "secret", Expiry: time.Hour, Issuer: "test"}
+	srv := httptest.NewServer(NewRouter(Deps{Store: st, TokenConfig: tokenCfg, RefreshTokenExpiry: 24 * time.Hour, AllowClientAuthChallenge: true}))
+	defer srv.Close()
+
+	call := func(method, path, token string, payload any) (int, map[string]any) {
+		t.Helper()
+		var body []byte
+		if payload != nil {
+			body, _ = json.Marshal(payload)
+		}
+		req, _ := http.NewRequest(method, srv.URL+path, bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s: %v", method, path, err)
+		}
+		defer resp.Body.Close()
+		var out map[string]any
+		_ = json.NewDecoder(resp.Body).Decode(&out)
+		return resp.StatusCode, out
+	}
+
+	pub, priv, _ := ed25519.GenerateKey(nil)
+	signIn := func(hostname string) (string, string) {
+		t.Helper()
+		challenge := []byte("challenge " + hostname)
+		code, out := call(http.MethodPost, "/v1/auth", "", map[string]any{
+			"publicKey": base64.StdEncoding.EncodeToString(pub),
+			"challenge": base64.StdEncoding.EncodeToString(challenge),
+			"signature": base64.StdEncoding.EncodeToString(ed25519.Sign(priv, challenge)),
+			"device":    map[string]any{"hostname": hostname},
+		})
+		if code != http.StatusOK {
+			t.Fatalf("auth: %d %v", code, out)
+		}
+		return out["token"].(string), out["refreshToken"].(string)
+	}
+	laptop, _ := signIn("laptop")
+	phone, phoneRefresh := signIn("phone")
+
+	code, listed := call(http.MethodGet, "/v1/account/devices", laptop, nil)
+	devices, _ := listed["devices"].([]any)
+	if code != http.StatusOK || len(devices) != 2 {
+		t.Fatalf("unexpected devices: %d %v", code, listed)
+	}
+	current, other := devices[0].(map[string]any), devices[1].(map[string]any)
+	if other["current"] == true {
+		current, other = other, current
+	}
+	if current["current"] != true || other["current"] != false || other["device"].(map[string]any)["hostname"] != "phone" || current["lastSeenIp"] != "127.0.0.1" {
+		t.Fatalf("unexpected devices: %v", devices)
+	}
+
+	wsURL := "ws" + strings.TrimPrefix(srv.URL, "http") + "/v1/updates/?EIO=4&transport=websocket"
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+	waitForPrefix(t, conn, "0{", 2*time.Second)
+	connect, _ := json.Marshal(map[string]any{"token": phone, "clientType": "user-scoped"})
+	if err := conn.WriteMessage(websocket.TextMessage, append([]byte("40"), connect...)); err != nil {
+		t.Fatalf("WriteMessage(connect): %v", err)
+	}
+	waitForPrefix(t, conn, "40", 2*time.Second)
+
+	code, deleted := call(http.MethodDelete, "/v1/account/devices/"+other["id"].(string), laptop, nil)
+	if code != http.StatusOK || deleted["disconnected"] != float64(1) {
+		t.Fatalf("delete: %d %v", code, deleted)
+	}
+	if msg := waitForPrefix(t, conn, `42["error"`, 2*time.Second); !strings.Contains(msg, "Device signed out") {
+		t.Fatalf("unexpected disconnect: %s", msg)
+	}
+
+	if code, _ := call(http.MethodGet, "/v1/sessions", phone, nil); code != http.StatusUnauthorized {
+		t.Fatalf("expected the revoked device's token to be rejected, got %d", code)
+	}
+	if code, _ := call(http.MethodPost, "/v1/auth/refresh", "", map[string]any{"refreshToken": phoneRefresh}); code != http.StatusUnauthorized {
+		t.Fatalf("expected the revoked device's refresh token to be rejected, got %d", code)
+	}
+	if code, _ := call(http.MethodGet, "/v1/sessions", laptop, nil); code != http.StatusOK {
+		t.Fatalf("expected other devices to stay signed in, got %d", code)
+	}
+	if code, _ := call(http.MethodDelete, "/v1/account/devices/"+other["id"].(string), laptop, nil); code != http.StatusNotFound {
+		t.Fatalf("expected 404 for a signed-out device, got %d", code)
+	}
+}
+
+func TestAuthChallenge(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	st := store.New()
+	tokenCfg := auth.TokenConfig{Secret: "secret", Expiry: time.Hour, Issuer: "test"}
+	r := NewRouter(Deps{Store: st, TokenConfig: tokenCfg})
+
+	pub, priv, _ := ed25519.GenerateKey(nil)
+	signIn := func(challenge string) int {
+		t.Helper()
+		raw, _ := base64.StdEncoding.DecodeString(challenge)
+		body, _ := json.Marshal(map[string]any{
+			"publicKey": base64.StdEncoding.EncodeToString(pub),
+			"challenge": challenge,
+			"signature": base64.StdEncoding.EncodeToString(ed25519.Sign(priv, raw)),
+		})
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/v1/auth", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	if code := signIn(base64.StdEncoding.EncodeToString([]byte("my own challenge"))); code != http.StatusUnauthorized {
+		t.Fatalf("expected a client-picked challenge to be rejected, got %d", code)
+	}
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/v1/auth/challenge", nil))
+	var issued struct {
+		Challenge string `json:"challenge"`
+		ExpiresAt int64  `json:"expiresAt"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &issued); err != nil || w.Code != http.StatusOK || issued.Challenge == "" || issued.ExpiresAt <= time.Now().UnixMilli() {
+		t.Fatalf("unexpected challenge: %d %s", w.Code, w.Body.String())
+	}
+	if code := signIn(issued.Challenge); code != http.StatusOK {
+		t.Fatalf("expected the issued challenge to sign in, got %d", code)
+	}
+	if code := signIn(issued.Challenge); code != http.StatusUnauthorized {
+		t.Fatalf("expected a replayed challenge to be rejected, got %d", code)
+	}
+	// The compatibility switch lets clients sign a challenge of their own.
+	r = NewRouter(Deps{Store: st, TokenConfig: tokenCfg, AllowClientAuthChallenge: true})
+	if code := signIn(base64.StdEncoding.EncodeToString([]byte("my own challenge"))); code != http.StatusOK {
+		t.Fatalf("expected a client-picked challenge to be allowed, got %d", code)
+	}
+}
+
+func TestAuthLockout(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	st := store.New()
+	tokenCfg := auth.TokenConfig{Secret: "secret", Expiry: time.Hour, Issuer: "test"}
+	r := NewRouter(Deps{Store: st, TokenConfig: tokenCfg, AllowClientAuthChallenge: true, AuthLockout: middleware.FailureLimit{After: 2, Lockout: time.Minute}})
+
+	challenge := []byte("challenge")
+	signIn := func(ip string, pub ed25519.PublicKey, priv ed25519.PrivateKey) *httptest.ResponseRecorder {
+		t.Helper()
+		body, _ := json.Marshal(map[string]any{
+			"publicKey": base64.StdEncoding.EncodeToString(pub),
+			"challenge": base64.StdEncoding.EncodeToString(challenge),
+			"signature": base64.StdEncoding.EncodeToString(ed25519.Sign(priv, challenge)),
+		})
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/v1/auth", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.RemoteAddr = ip + ":1234"
+		r.ServeHTTP(w, req)
+		return w
+	}
+	pubA, privA, _ := ed25519.GenerateKey(nil)
+	pubB, privB, _ := ed25519.GenerateKey(nil)
+	_, wrong, _ := ed25519.GenerateKey(nil)
+
+	if w := signIn("192.0.2.1", pubA, wrong); w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected a bad signature to be rejected, got %d", w.Code)
+	}
+	if w := signIn("192.0.2.1", pubA, wrong); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected the failure that locks out to be answered 429, got %d", w.Code)
+	}
+	w := signIn("192.0.2.1", pubA, privA)
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "60" {
+		t.Fatalf("expected the address to be locked out, got %d %q", w.Code, w.Header().Get("Retry-After"))
+	}
+	if w := signIn("192.0.2.1", pubB, privB); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected the address to be locked out for other keys too, got %d", w.Code)
+	}
+	// Bad signatures for the key from elsewhere are still turned away, but
+	// its owner can sign in: anyone can send bad signatures for a key.
+	if w := signIn("192.0.2.2", pubA, wrong); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected bad signatures for the key to be locked out from other addresses, got %d", w.Code)
+	}
+	if w := signIn("192.0.2.3", pubA, privA); w.Code != http.StatusOK {
+		t.Fatalf("expected a valid signature for the key to sign in, got %d", w.Code)
+	}
+	if w := signIn("192.0.2.3", pubB, privB); w.Code != http.StatusOK {
+		t.Fatalf("expected other keys and addresses to sign in, got %d", w.Code)
+	}
+}
+
+func TestAPIKeys(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	st := store.New()
+	tokenCfg := auth.TokenConfig{Secret: "secret", Expiry: time.Hour, Issuer: "test"}
+	r := NewRouter(Deps{Store: st, TokenConfig: tokenCfg})
+
+	call := func(method, path, authorization string, payload any) (int, map[string]any) {
+		t.Helper()
+		var body []byte
+		if payload != nil {
+			body, _ = json.Marshal(payload)
+		}
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(method, path, bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", authorization)
+		r.ServeHTTP(w, req)
+		var out map[string]any
+		_ = json.Unmarshal(w.Body.Bytes(), &out)
+		return w.Code, out
+	}
+
+	token, _ := auth.CreateToken("user-1", tokenCfg)
+	bearer := "Bearer " + token
+	if code, _ := call(http.MethodPost, "/v1/account/api-keys", bearer, map[string]any{"name": " "}); code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for a blank name, got %d", code)
+	}
+	code, created := call(http.MethodPost, "/v1/account/api-keys", bearer, map[string]any{"name": "ci"})
+	key, _ := created["key"].(string)
+	if code != http.StatusOK || !strings.HasPrefix(key, "hsl_") {
+		t.Fatalf("create: %d %v", code, created)
+	}
+	id := created["apiKey"].(map[string]any)["id"].(string)
+
+	apiKey := "ApiKey " + key
+	if code, _ := call(http.MethodPost, "/v1/artifacts", apiKey, map[string]any{"id": "a1", "header": "aA==", "body": "Yg==", "dataEncryptionKey": "aw=="}); code != http.StatusOK {
+		t.Fatalf("expected the key to publish an artifact, got %d", code)
+	}
+	if code, _ := call(http.MethodGet, "/v1/artifacts/a1", bearer, nil); code != http.StatusOK {
+		t.Fatalf("expected the artifact to belong to the key's owner, got %d", code)
+	}
+	if code, _ := call(http.MethodGet, "/v1/account/api-keys", apiKey, nil); code != http.StatusForbidden {
+		t.Fatalf("expected a key not to manage keys, got %d", code)
+	}
+	if code, _ := call(http.MethodPost, "/v1/auth/token/scoped", apiKey, map[string]any{"sessionId": "s"}); code != http.StatusForbidden {
+		t.Fatalf("expected a key not to mint tokens, got %d", code)
+	}
+	if code, _ := call(http.MethodGet, "/v1/sessions", "ApiKey "+key+"x", nil); code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for a wrong secret, got %d", code)
+	}
+
+	code, listed := call(http.MethodGet, "/v1/account/api-keys", bearer, nil)
+	keys, _ := listed["apiKeys"].([]any)
+	if code != http.StatusOK || len(keys) != 1 || keys[0].(map[string]any)["name"] != "ci" || keys[0].(map[string]any)["key"] != nil {
+		t.Fatalf("unexpected keys: %d %v", code, listed)
+	}
+	if code, _ := call(http.MethodDelete, "/v1/account/api-keys/"+id, bearer, nil); code != http.StatusOK {
+		t.Fatalf("delete: %d", code)
+	}
+	if code, _ := call(http.MethodGet, "/v1/sessions", apiKey, nil); code != http.StatusUnauthorized {
+		t.Fatalf("expected a revoked key to be rejected, got %d", code)
+	}
 }
 
 func TestSessionAndMachineEndpoints(t *testing.T) {
@@ -158,6 +628,203 @@ func TestSessionAndMachineEndpoints(t *testing.T) {
 	}
 }
 
+func TestSessionByTag(t *testing.T) {
+	ctx := context.Background()
+	gin.SetMode(gin.TestMode)
+	st := store.New()
+	tokenCfg := auth.TokenConfig{Secret: "secret", Expiry: time.Hour, Issuer: "test"}
+	r := NewRouter(Deps{Store: st, TokenConfig: tokenCfg})
+	userToken, _ := auth.CreateToken("user-1", tokenCfg)
+	sess, _, _ := st.GetOrCreateSession(ctx, "user-1", "t1", "m1", nil, nil, time.Now().UnixMilli())
+
+	get := func(tag string) *httptest.ResponseRecorder {
+		t.Helper()
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/v1/sessions/by-tag/"+tag, nil)
+		req.Header.Set("Authorization", "Bearer "+userToken)
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	w := get("t1")
+	var resp struct {
+		Session map[string]any `json:"session"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("unexpected response %d: %s", w.Code, w.Body.String())
+	}
+	if resp.Session["id"] != sess.ID || resp.Session["tag"] != "t1" {
+		t.Fatalf("unexpected session: %v", resp.Session)
+	}
+	if w := get("t2"); w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for an unknown tag, got %d", w.Code)
+	}
+}
+
+func TestSessionMessagesPagination(t *testing.T) {
+	ctx := context.Background()
+	gin.SetMode(gin.TestMode)
+	st := store.New()
+	tokenCfg := auth.TokenConfig{Secret: "secret", Expiry: time.Hour, Issuer: "test"}
+	r := NewRouter(Deps{Store: st, TokenConfig: tokenCfg})
+	userToken, err := auth.CreateToken("user-1", tokenCfg)
+	if err != nil {
+		t.Fatalf("CreateToken: %v", err)
+	}
+	sess, _, _ := st.GetOrCreateSession(ctx, "user-1", "tag", "meta", nil, nil, time.Now().UnixMilli())
+	for i := 0; i < 5; i++ {
+		st.AppendMessageFrom(ctx, "", "user-1", sess.ID, "c", "", time.Now().UnixMilli())
+	}
+
+	type page struct {
+		Messages []struct {
+			Seq int64 `json:"seq"`
+		} `json:"messages"`
+		HasMore    bool   `json:"hasMore"`
+		NextCursor *int64 `json:"nextCursor"`
+	}
+	get := func(query string) (int, page) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/v1/sessions/"+sess.ID+"/messages?"+query, nil)
+		req.Header.Set("Authorization", "Bearer "+userToken)
+		r.ServeHTTP(w, req)
+		var p page
+		if w.Code == http.StatusOK {
+			if err := json.Unmarshal(w.Body.Bytes(), &p); err != nil {
+				t.Fatalf("unmarshal: %v", err)
+			}
+		}
+		return w.Code, p
+	}
+
+	// Page backwards from the newest message.
+	var seqs []int64
+	query := "order=desc&limit=2"
+	for {
+		code, p := get(query)
+		if code != http.StatusOK {
+			t.Fatalf("expected 200, got %d", code)
+		}
+		for _, m := range p.Messages {
+			seqs = append(seqs, m.Seq)
+		}
+		if !p.HasMore {
+			if p.NextCursor != nil {
+				t.Fatalf("expected no cursor on the last page")
+			}
+			break
+		}
+		query = fmt.Sprintf("order=desc&limit=2&before=%d", *p.NextCursor)
+	}
+	if fmt.Sprint(seqs) != "[5 4 3 2 1]" {
+		t.Fatalf("unexpected seqs paging backwards: %v", seqs)
+	}
+
+	if _, p := get("after=1&before=4"); len(p.Messages) != 2 || p.Messages[0].Seq != 2 || p.HasMore {
+		t.Fatalf("unexpected bounded page: %+v", p)
+	}
+	if code, _ := get("order=sideways"); code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an unknown order, got %d", code)
+	}
+	if code, _ := get("before=x"); code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for a bad cursor, got %d", code)
+	}
+}
+
+func TestSessionMessagesStream(t *testing.T) {
+	ctx := context.Background()
+	gin.SetMode(gin.TestMode)
+	st := store.New()
+	tokenCfg := auth.TokenConfig{Secret: "secret", Expiry: time.Hour, Issuer: "test"}
+	r := NewRouter(Deps{Store: st, TokenConfig: tokenCfg})
+	userToken, _ := auth.CreateToken("user-1", tokenCfg)
+	sess, _, _ := st.GetOrCreateSession(ctx, "user-1", "tag", "meta", nil, nil, time.Now().UnixMilli())
+	const total = 1234
+	for i := 0; i < total; i++ {
+		st.AppendMessageFrom(ctx, "", "user-1", sess.ID, "c", "", time.Now().UnixMilli())
+	}
+
+	get := func(id, query string) *httptest.ResponseRecorder {
+		t.Helper()
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/v1/sessions/"+id+"/messages/stream?"+query, nil)
+		req.Header.Set("Authorization", "Bearer "+userToken)
+		r.ServeHTTP(w, req)
+		return w
+	}
+	seqs := func(w *httptest.ResponseRecorder) []int64 {
+		t.Helper()
+		if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/x-ndjson" {
+			t.Fatalf("unexpected response %d %q", w.Code, w.Header().Get("Content-Type"))
+		}
+		var got []int64
+		dec := json.NewDecoder(w.Body)
+		for dec.More() {
+			var m struct {
+				Seq int64 `json:"seq"`
+			}
+			if err := dec.Decode(&m); err != nil {
+				t.Fatalf("decode: %v", err)
+			}
+			got = append(got, m.Seq)
+		}
+		return got
+	}
+
+	all := seqs(get(sess.ID, ""))
+	if len(all) != total || all[0] != 1 || all[total-1] != total {
+		t.Fatalf("expected every message in order, got %d from %v", len(all), all[:min(len(all), 3)])
+	}
+	if got := seqs(get(sess.ID, "order=desc&before=1000&limit=3")); fmt.Sprint(got) != "[999 998 997]" {
+		t.Fatalf("unexpected bounded stream: %v", got)
+	}
+	if w := get("missing", ""); w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for an unknown session, got %d", w.Code)
+	}
+	if w := get(sess.ID, "after=x"); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for a bad cursor, got %d", w.Code)
+	}
+}
+
+func TestRateLimitGroups(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	st := store.New()
+	tokenCfg := auth.TokenConfig{Secret: "secret", Expiry: time.Hour, Issuer: "test"}
+	r := NewRouter(Deps{Store: st, TokenConfig: tokenCfg, RateLimits: map[string]middleware.RateLimit{
+		middleware.RateLimitAuth:          {Limit: 1, Window: time.Minute},
+		middleware.RateLimitWrite:         {Limit: 1, Window: time.Minute},
+		middleware.RateLimitSocketUpgrade: {Limit: 1, Window: time.Minute},
+	}})
+	userToken, err := auth.CreateToken("user-1", tokenCfg)
+	if err != nil {
+		t.Fatalf("CreateToken: %v", err)
+	}
+
+	do := func(method, path string) int {
+		t.Helper()
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(method, path, strings.NewReader(`{}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+userToken)
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+	for _, path := range []string{"/v1/auth/request/status?publicKey=pk", "/ws"} {
+		do(http.MethodGet, path)
+		if code := do(http.MethodGet, path); code != http.StatusTooManyRequests {
+			t.Fatalf("%s: expected 429, got %d", path, code)
+		}
+	}
+	do(http.MethodPost, "/v1/machines")
+	if code := do(http.MethodPost, "/v1/machines"); code != http.StatusTooManyRequests {
+		t.Fatalf("expected writes to be limited, got %d", code)
+	}
+	if code := do(http.MethodGet, "/v1/machines"); code != http.StatusOK {
+		t.Fatalf("expected unconfigured reads to pass, got %d", code)
+	}
+}
+
 func TestAuth_InvalidPublicKeyErrorMessage(t *testing.T) {
 	gin.SetMode(gin.TestMode)
 	st := store.New()
@@ -205,6 +872,61 @@ func TestWelcomeAndVersionEndpoints(t *testing.T) {
 	}
 }
 
+func TestServerInfo(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	tokenCfg := auth.TokenConfig{Secret: "secret", Expiry: time.Hour, Issuer: "test"}
+
+	r := NewRouter(Deps{Store: store.New(), TokenConfig: tokenCfg})
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/v1/server-info", nil))
+	var info map[string]any
+	if err := json.Unmarshal(w.Body.Bytes(), &info); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("expected 200 JSON, got %d: %s", w.Code, w.Body.String())
+	}
+	if info["name"] != "happy-server-lite" || info["contact"] != nil || info["welcome"] != "Welcome to Happy Server!" {
+		t.Fatalf("expected the defaults, got %v", info)
+	}
+
+	r = NewRouter(Deps{Store: store.New(), TokenConfig: tokenCfg, ServerName: "team", ServerContact: "ops@example.com", WelcomeText: "Welcome to the team server"})
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if w.Body.String() != "Welcome to the team server" {
+		t.Fatalf("expected the configured welcome text, got %q", w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/v1/server-info", nil))
+	if err := json.Unmarshal(w.Body.Bytes(), &info); err != nil || info["name"] != "team" || info["contact"] != "ops@example.com" || info["welcome"] != "Welcome to the team server" {
+		t.Fatalf("expected the configured info, got %v (%v)", info, err)
+	}
+}
+
+func TestHealthReady(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	tokenCfg := auth.TokenConfig{Secret: "secret", Expiry: time.Hour, Issuer: "test"}
+	report := selfcheck.Run(1000, []selfcheck.Check{
+		{Name: "clock", Run: func() error { return nil }},
+		{Name: "persistence", Run: func() error { return errors.New("read-only file system") }},
+	})
+
+	for _, tc := range []struct {
+		report *selfcheck.Report
+		code   int
+	}{
+		{nil, http.StatusOK},
+		{&report, http.StatusServiceUnavailable},
+	} {
+		r := NewRouter(Deps{Store: store.New(), TokenConfig: tokenCfg, SelfCheck: tc.report})
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/health/ready", nil))
+		if w.Code != tc.code {
+			t.Fatalf("expected %d, got %d: %s", tc.code, w.Code, w.Body.String())
+		}
+		if tc.report != nil && !strings.Contains(w.Body.String(), "read-only file system") {
+			t.Fatalf("expected the failure in the body, got: %s", w.Body.String())
+		}
+	}
+}
+
 func TestAccountSettingsVersionMismatch(t *testing.T) {
 	gin.SetMode(gin.TestMode)
 	st := store.New()
@@ -251,7 +973,201 @@ func TestAccountSettingsVersionMismatch(t *testing.T) {
 	}
 }
 
+func TestAccountSettingsTooLarge(t *testing.T) {
+	ctx := context.Background()
+	gin.SetMode(gin.TestMode)
+	st := store.NewWithOptions(store.Options{Limits: store.Limits{MaxSettingsBytes: 8}})
+	tokenCfg := auth.TokenConfig{Secret: "secret", Expiry: time.Hour, Issuer: "test"}
+	r := NewRouter(Deps{Store: st, TokenConfig: tokenCfg})
+
+	userToken, err := auth.CreateToken("user-1", tokenCfg)
+	if err != nil {
+		t.Fatalf("CreateToken: %v", err)
+	}
+
+	body, _ := json.Marshal(map[string]any{"settings": "0123456789", "expectedVersion": 0})
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/v1/account/settings", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+userToken)
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected 413, got %d: %s", w.Code, w.Body.String())
+	}
+	var resp struct {
+		Code           string `json:"code"`
+		Size           int    `json:"size"`
+		CurrentVersion int    `json:"currentVersion"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || resp.Code != "payload_too_large" || resp.Size != 10 || resp.CurrentVersion != 0 {
+		t.Fatalf("unexpected error body: %s (%v)", w.Body.String(), err)
+	}
+	if settings, version := st.GetAccountSettings(ctx, "user-1"); settings != nil || version != 0 {
+		t.Fatalf("expected settings unchanged, got %v v%d", settings, version)
+	}
+}
+
+func TestAccountExport(t *testing.T) {
+	ctx := context.Background()
+	gin.SetMode(gin.TestMode)
+	st := store.New()
+	tokenCfg := auth.TokenConfig{Secret: "secret", Expiry: time.Hour, Issuer: "test"}
+	r := NewRouter(Deps{Store: st, TokenConfig: tokenCfg})
+
+	userToken, err := auth.CreateToken("user-1", tokenCfg)
+	if err != nil {
+		t.Fatalf("CreateToken: %v", err)
+	}
+	st.UpsertMachine(ctx, "user-1", "m1", "meta", nil, nil, time.Now().UnixMilli())
+	st.UpsertMachine(ctx, "user-2", "m2", "meta", nil, nil, time.Now().UnixMilli())
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/v1/account/export", nil)
+	req.Header.Set("Authorization", "Bearer "+userToken)
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("expected 200 JSON, got %d %q: %s", w.Code, w.Header().Get("Content-Type"), w.Body.String())
+	}
+	var export struct {
+		UserID   string           `json:"userId"`
+		Machines []map[string]any `json:"machines"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &export); err != nil {
+		t.Fatalf("unmarshal: %v (%s)", err, w.Body.String())
+	}
+	if export.UserID != "user-1" || len(export.Machines) != 1 || export.Machines[0]["id"] != "m1" {
+		t.Fatalf("unexpected export: %s", w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodGet, "/v1/account/export?format=tar", nil)
+	req.Header.Set("Authorization", "Bearer "+userToken)
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/x-tar" {
+		t.Fatalf("expected 200 tar, got %d %q", w.Code, w.Header().Get("Content-Type"))
+	}
+
+	w = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodGet, "/v1/account/export?format=zip", nil)
+	req.Header.Set("Authorization", "Bearer "+userToken)
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for unknown format, got %d", w.Code)
+	}
+}
+
+func TestSessionExport(t *testing.T) {
+	ctx := context.Background()
+	gin.SetMode(gin.TestMode)
+	st := store.New()
+	tokenCfg := auth.TokenConfig{Secret: "secret", Expiry: time.Hour, Issuer: "test"}
+	r := NewRouter(Deps{Store: st, TokenConfig: tokenCfg})
+
+	userToken, err := auth.CreateToken("user-1", tokenCfg)
+	if err != nil {
+		t.Fatalf("CreateToken: %v", err)
+	}
+	sess, _, _ := st.GetOrCreateSession(ctx, "user-1", "run", "meta", nil, nil, time.Now().UnixMilli())
+	st.AppendMessage(ctx, "user-1", sess.ID, "hello", time.Now().UnixMilli())
+	other, _, _ := st.GetOrCreateSession(ctx, "user-2", "run", "meta", nil, nil, time.Now().UnixMilli())
+
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("Authorization", "Bearer "+userToken)
+		r.ServeHTTP(w, req)
+		return w
+	}
+	for format, contentType := range map[string]string{"": "application/x-tar", "json": "application/json", "html": "text/html; charset=utf-8"} {
+		w := get("/v1/sessions/" + sess.ID + "/export?format=" + format)
+		if w.Code != http.StatusOK || w.Header().Get("Content-Type") != contentType {
+			t.Fatalf("format %q: expected 200 %s, got %d %q", format, contentType, w.Code, w.Header().Get("Content-Type"))
+		}
+		if !strings.Contains(w.Header().Get("Content-Disposition"), "happy-session-"+sess.ID) {
+			t.Fatalf("format %q: unexpected disposition %q", format, w.Header().Get("Content-Disposition"))
+		}
+	}
+	if w := get("/v1/sessions/" + other.ID + "/export"); w.Code != http.StatusNotFound {
+		t.Fatalf("expected another user's session to be missing, got %d", w.Code)
+	}
+	if w := get("/v1/sessions/" + sess.ID + "/export?format=zip"); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for unknown format, got %d", w.Code)
+	}
+}
+
+func TestAccountDelete(t *testing.T) {
+	ctx := context.Background()
+	gin.SetMode(gin.TestMode)
+	st := store.New()
+	tokenCfg := auth.TokenConfig{Secret: "secret", Expiry: time.Hour, Issuer: "test"}
+	r := NewRouter(Deps{Store: st, TokenConfig: tokenCfg})
+
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	publicKey := base64.StdEncoding.EncodeToString(pub)
+	acc, _ := st.GetOrCreateAccount(ctx, publicKey, time.Now().UnixMilli())
+	st.UpsertMachine(ctx, acc.ID, "m1", "meta", nil, nil, time.Now().UnixMilli())
+	userToken, err := auth.CreateToken(acc.ID, tokenCfg)
+	if err != nil {
+		t.Fatalf("CreateToken: %v", err)
+	}
+
+	deleteAccount := func(challenge string, key ed25519.PrivateKey) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(map[string]string{
+			"publicKey": publicKey,
+			"challenge": base64.StdEncoding.EncodeToString([]byte(challenge)),
+			"signature": base64.StdEncoding.EncodeToString(ed25519.Sign(key, []byte(challenge))),
+		})
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodDelete, "/v1/account", bytes.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+userToken)
+		req.Header.Set("Content-Type", "application/json")
+		r.ServeHTTP(w, req)
+		return w
+	}
+	challenge := fmt.Sprintf("delete-account:%s:%d", acc.ID, time.Now().UnixMilli())
+
+	if w := deleteAccount(fmt.Sprintf("delete-account:other:%d", time.Now().UnixMilli()), priv); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for another account's challenge, got %d", w.Code)
+	}
+	if w := deleteAccount(fmt.Sprintf("delete-account:%s:%d", acc.ID, time.Now().Add(-time.Hour).UnixMilli()), priv); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for a stale challenge, got %d", w.Code)
+	}
+	_, otherKey, _ := ed25519.GenerateKey(nil)
+	if w := deleteAccount(challenge, otherKey); w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for a bad signature, got %d", w.Code)
+	}
+	if _, ok := st.GetAccount(ctx, publicKey); !ok {
+		t.Fatalf("expected rejected requests to keep the account")
+	}
+
+	w := deleteAccount(challenge, priv)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var resp struct {
+		Deleted store.AccountDeletion `json:"deleted"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || resp.Deleted.Machines != 1 {
+		t.Fatalf("unexpected response: %s", w.Body.String())
+	}
+	if _, ok := st.GetAccount(ctx, publicKey); ok {
+		t.Fatalf("expected account to be gone")
+	}
+
+	w = httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/v1/machines", nil)
+	req.Header.Set("Authorization", "Bearer "+userToken)
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized && w.Code != http.StatusForbidden {
+		t.Fatalf("expected the old token to be rejected, got %d", w.Code)
+	}
+}
+
 func TestArtifactsFeedFriendsAndPushTokensEndpoints(t *testing.T) {
+	ctx := context.Background()
 	gin.SetMode(gin.TestMode)
 	st := store.New()
 	tokenCfg := auth.TokenConfig{Secret: "secret", Expiry: time.Hour, Issuer: "test"}
@@ -404,7 +1320,7 @@ func TestArtifactsFeedFriendsAndPushTokensEndpoints(t *testing.T) {
 	}
 
 	// push tokens
-	body, _ = json.Marshal(map[string]any{"token": "expo-1"})
+	body, _ = json.Marshal(map[string]any{"token": "expo-1", "locale": "pt-BR"})
 	w = httptest.NewRecorder()
 	req = httptest.NewRequest(http.MethodPost, "/v1/push-tokens", bytes.NewReader(body))
 	req.Header.Set("Content-Type", "application/json")
@@ -421,6 +1337,31 @@ func TestArtifactsFeedFriendsAndPushTokensEndpoints(t *testing.T) {
 		t.Fatalf("unexpected push response: %v", pushResp)
 	}
 
+	w = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodGet, "/v1/push-tokens", nil)
+	req.Header.Set("Authorization", "Bearer "+userToken)
+	r.ServeHTTP(w, req)
+	var pushList struct {
+		Tokens []struct {
+			Token  string `json:"token"`
+			Locale string `json:"locale"`
+		} `json:"tokens"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &pushList); err != nil || len(pushList.Tokens) != 1 || pushList.Tokens[0].Token != "expo-1" || pushList.Tokens[0].Locale != "pt-BR" {
+		t.Fatalf("unexpected push token list: %s (%v)", w.Body.String(), err)
+	}
+
+	w = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodDelete, "/v1/push-tokens/expo-1", nil)
+	req.Header.Set("Authorization", "Bearer "+userToken)
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if tokens := st.ListPushTokens(ctx, "user-1"); len(tokens) != 0 {
+		t.Fatalf("expected push token deleted, got %+v", tokens)
+	}
+
 	// user search should return schema object
 	w = httptest.NewRecorder()
 	req = httptest.NewRequest(http.MethodGet, "/v1/user/search?query=x", nil)
@@ -549,3 +1490,183 @@ func TestArtifactsAreIsolatedPerUser(t *testing.T) {
 		t.Fatalf("unexpected full2 header: %v", full2["header"])
 	}
 }
+
+func TestErrorFormatLegacyAndEnvelope(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	st := store.New()
+	tokenCfg := auth.TokenConfig{Secret: "secret", Expiry: time.Hour, Issuer: "test"}
+	r := NewRouter(Deps{Store: st, TokenConfig: tokenCfg})
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/v1/sessions", nil)
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401, got %d: %s", w.Code, w.Body.String())
+	}
+	var legacy map[string]any
+	if err := json.Unmarshal(w.Body.Bytes(), &legacy); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	if legacy["error"] != "Invalid authentication token" || legacy["code"] != "unauthorized" {
+		t.Fatalf("unexpected legacy body: %v", legacy)
+	}
+
+	w = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodGet, "/v1/sessions", nil)
+	req.Header.Set("X-Error-Format", "envelope")
+	r.ServeHTTP(w, req)
+	var envelope struct {
+		Success bool `json:"success"`
+		Error   struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &envelope); err != nil {
+		t.Fatalf("unmarshal: %v (%s)", err, w.Body.String())
+	}
+	if envelope.Success || envelope.Error.Code != "unauthorized" || envelope.Error.Message != "Invalid authentication token" {
+		t.Fatalf("unexpected envelope body: %s", w.Body.String())
+	}
+}
+
+type recordingPush struct {
+	sent chan []push.Notification
+}
+
+func (p *recordingPush) Send(_ context.Context, notifications []push.Notification) error {
+	p.sent <- notifications
+	return nil
+}
+
+func TestAuthRequestNotifiesPairedDevices(t *testing.T) {
+	ctx := context.Background()
+	gin.SetMode(gin.TestMode)
+	st := store.New()
+	tokenCfg := auth.TokenConfig{Secret: "secret", Expiry: time.Hour, Issuer: "test"}
+	sender := &recordingPush{sent: make(chan []push.Notification, 4)}
+	templates, err := push.NewTemplates(map[string]map[string]push.Template{
+		push.EventAuthRequest: {"de": {Title: "Neues Gerät", Body: "Anmeldung von {{.publicKey}}"}},
+	})
+	if err != nil {
+		t.Fatalf("NewTemplates: %v", err)
+	}
+	r := NewRouter(Deps{Store: st, TokenConfig: tokenCfg, Push: sender, PushTemplates: templates})
+
+	acc, _ := st.GetOrCreateAccount(ctx, "pk", time.Now().UnixMilli())
+	st.AddPushToken(ctx, acc.ID, "expo-1", "", time.Now().UnixMilli())
+	st.AddPushToken(ctx, acc.ID, "expo-2", "de_AT", time.Now().UnixMilli()+1)
+
+	request := func(publicKey string) {
+		t.Helper()
+		body, _ := json.Marshal(map[string]any{"publicKey": publicKey})
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/v1/auth/request", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		r.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+		}
+	}
+
+	request("pk")
+	select {
+	case got := <-sender.sent:
+		if len(got) != 2 || got[0].To != "expo-1" || got[0].Data["publicKey"] != "pk" {
+			t.Fatalf("unexpected notifications: %+v", got)
+		}
+		if got[0].Title != "New device wants access" || got[1].Title != "Neues Gerät" || got[1].Body != "Anmeldung von pk" {
+			t.Fatalf("expected localized text, got %+v", got)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected a push for the new auth request")
+	}
+
+	// Polling the same request and requests from unknown keys send nothing.
+	request("pk")
+	request("unknown")
+	select {
+	case got := <-sender.sent:
+		t.Fatalf("unexpected push: %+v", got)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestPostMessageLocalIDReplay(t *testing.T) {
+	ctx := context.Background()
+	gin.SetMode(gin.TestMode)
+	st := store.New()
+	tokenCfg := auth.TokenConfig{Secret: "secret", Expiry: time.Hour, Issuer: "test"}
+	r := NewRouter(Deps{Store: st, TokenConfig: tokenCfg})
+	userToken, err := auth.CreateToken("user-1", tokenCfg)
+	if err != nil {
+		t.Fatalf("CreateToken: %v", err)
+	}
+	sess, _, _ := st.GetOrCreateSession(ctx, "user-1", "tag", "meta", nil, nil, time.Now().UnixMilli())
+
+	post := func(body string) map[string]any {
+		t.Helper()
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/v1/sessions/"+sess.ID+"/messages", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+userToken)
+		req.Header.Set("Content-Type", "application/json")
+		r.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+		}
+		var resp struct {
+			Message map[string]any `json:"message"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("unmarshal: %v", err)
+		}
+		return resp.Message
+	}
+
+	first := post(`{"message":"enc","localId":"local-1"}`)
+	again := post(`{"message":"enc","localId":"local-1"}`)
+	if first["id"] != again["id"] || first["seq"] != again["seq"] || again["localId"] != "local-1" {
+		t.Fatalf("expected the replay to return the first message, got %v and %v", first, again)
+	}
+	if other := post(`{"message":"enc"}`); other["seq"] != float64(2) {
+		t.Fatalf("expected a message without localId to append, got %v", other)
+	}
+}
+
+func TestRouterUsesInjectedClock(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	clk := clock.NewFake(time.UnixMilli(1_700_000_000_000))
+	tokenCfg := auth.TokenConfig{Secret: "secret", Expiry: time.Hour, Issuer: "test"}
+	r := NewRouter(Deps{Store: store.NewWithOptions(store.Options{Clock: clk}), TokenConfig: tokenCfg, Clock: clk})
+	tokenCfg.Clock = clk
+	userToken, err := auth.CreateToken("user-1", tokenCfg)
+	if err != nil {
+		t.Fatalf("CreateToken: %v", err)
+	}
+
+	createSession := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/v1/sessions", strings.NewReader(`{"tag":"t1","metadata":"m"}`))
+		req.Header.Set("Authorization", "Bearer "+userToken)
+		req.Header.Set("Content-Type", "application/json")
+		r.ServeHTTP(w, req)
+		return w
+	}
+	w := createSession()
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var resp struct {
+		Session struct {
+			CreatedAt int64 `json:"createdAt"`
+		} `json:"session"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || resp.Session.CreatedAt != clk.Now().UnixMilli() {
+		t.Fatalf("expected the session stamped by the clock, got %s (%v)", w.Body.String(), err)
+	}
+
+	clk.Advance(2 * time.Hour)
+	if w := createSession(); w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected the token to expire by the clock, got %d", w.Code)
+	}
+}
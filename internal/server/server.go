@@ -1,8 +1,11 @@
 package server
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"net/http"
+	"os"
 	"time"
 
 	"happy-server-lite/internal/config"
@@ -16,8 +19,30 @@ func NewHTTPServer(cfg config.Config, handler http.Handler) *http.Server {
 	}
 }
 
+// ClientCertTLSConfig asks clients for a certificate issued by a CA in the
+// PEM bundle at caFile and verifies the ones they send; clients without one
+// are still served.
+func ClientCertTLSConfig(caFile string) (*tls.Config, error) {
+	data, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("read client CA bundle: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates in client CA bundle %s", caFile)
+	}
+	return &tls.Config{ClientCAs: pool, ClientAuth: tls.VerifyClientCertIfGiven}, nil
+}
+
 func Run(cfg config.Config, handler http.Handler) error {
 	srv := NewHTTPServer(cfg, handler)
+	if cfg.TLSClientCAFile != "" {
+		tlsConfig, err := ClientCertTLSConfig(cfg.TLSClientCAFile)
+		if err != nil {
+			return err
+		}
+		srv.TLSConfig = tlsConfig
+	}
 	if cfg.TLSCertFile != "" && cfg.TLSKeyFile != "" {
 		return srv.ListenAndServeTLS(cfg.TLSCertFile, cfg.TLSKeyFile)
 	}
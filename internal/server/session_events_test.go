@@ -0,0 +1,508 @@
+package server_test
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"happy-server-lite/internal/events"
+	"happy-server-lite/pkg/client"
+	"happy-server-lite/pkg/happyserver"
+	"happy-server-lite/pkg/servertest"
+)
+
+func TestDeleteSessionBroadcastsAndDisconnectsDaemon(t *testing.T) {
+	srv := servertest.New(t)
+	sess := srv.CreateSession("user-1", "tag")
+
+	user := srv.ConnectUser("user-1")
+	daemon := srv.ConnectSession("user-1", sess.ID)
+
+	if err := srv.Client("user-1").DeleteSession(context.Background(), sess.ID); err != nil {
+		t.Fatalf("DeleteSession: %v", err)
+	}
+
+	if update := user.WaitUpdate(events.TypeDeleteSession); update.Body["sid"] != sess.ID {
+		t.Fatalf("unexpected user update: %v", update.Body)
+	}
+	if update := daemon.WaitUpdate(events.TypeDeleteSession); update.Body["sid"] != sess.ID {
+		t.Fatalf("unexpected daemon update: %v", update.Body)
+	}
+
+	select {
+	case <-daemon.Done():
+	case <-user.Done():
+		t.Fatalf("user-scoped connection should stay open")
+	case <-time.After(servertest.DefaultTimeout):
+		t.Fatalf("expected session-scoped connection to be closed")
+	}
+}
+
+func TestSessionScopedConnectIsSingleWriter(t *testing.T) {
+	srv := servertest.New(t)
+	sess := srv.CreateSession("user-1", "tag")
+
+	first := srv.ConnectSession("user-1", sess.ID)
+
+	ctx, cancel := context.WithTimeout(context.Background(), servertest.DefaultTimeout)
+	defer cancel()
+	if _, err := srv.Client("user-1").ConnectSocket(ctx, client.SocketOptions{
+		ClientType: client.ClientTypeSession,
+		SessionID:  sess.ID,
+	}); err == nil {
+		t.Fatalf("expected second session-scoped connect to be rejected")
+	}
+
+	second := srv.Connect("user-1", client.SocketOptions{
+		ClientType: client.ClientTypeSession,
+		SessionID:  sess.ID,
+		Takeover:   true,
+	})
+
+	var payload map[string]any
+	if err := first.WaitEvent("error").Decode(&payload); err != nil || payload["code"] != "conflict" {
+		t.Fatalf("expected conflict error on replaced connection, got %v (%v)", payload, err)
+	}
+	select {
+	case <-first.Done():
+	case <-time.After(servertest.DefaultTimeout):
+		t.Fatalf("expected replaced connection to be closed")
+	}
+
+	user := srv.ConnectUser("user-1")
+	second.Emit("message", map[string]any{"sid": sess.ID, "message": "hello"})
+	user.WaitUpdate("new-message")
+}
+
+func TestSuppressEchoSkipsOriginatingConnection(t *testing.T) {
+	srv := servertest.New(t)
+	sess := srv.CreateSession("user-1", "tag")
+
+	user := srv.ConnectUser("user-1")
+	daemon := srv.Connect("user-1", client.SocketOptions{
+		ClientType:   client.ClientTypeSession,
+		SessionID:    sess.ID,
+		SuppressEcho: true,
+	})
+
+	daemon.Emit("message", map[string]any{"sid": sess.ID, "message": "hello"})
+	user.WaitUpdate("new-message")
+	daemon.ExpectNoEvent("update", 200*time.Millisecond)
+
+	user.Emit("message", map[string]any{"sid": sess.ID, "message": "from app"})
+	daemon.WaitUpdate("new-message")
+}
+
+func TestUpdatesCarryNegotiatedSchemaVersion(t *testing.T) {
+	srv := servertest.New(t)
+	sess := srv.CreateSession("user-1", "tag")
+
+	user := srv.ConnectUser("user-1")
+	if user.UpdateSchema() != client.UpdateSchemaVersion {
+		t.Fatalf("expected negotiated schema %d, got %d", client.UpdateSchemaVersion, user.UpdateSchema())
+	}
+
+	user.Emit("message", map[string]any{"sid": sess.ID, "message": "hello"})
+	if update := user.WaitUpdate("new-message"); update.Schema != client.UpdateSchemaVersion {
+		t.Fatalf("expected update schema %d, got %d", client.UpdateSchemaVersion, update.Schema)
+	}
+}
+
+func TestMessageChecksumRoundTrip(t *testing.T) {
+	srv := servertest.New(t)
+	sess := srv.CreateSession("user-1", "tag")
+	user := srv.ConnectUser("user-1")
+
+	sum := sha256.Sum256([]byte("ciphertext"))
+	checksum := hex.EncodeToString(sum[:])
+
+	user.Emit("message", map[string]any{"sid": sess.ID, "message": "ciphertext", "checksum": "deadbeef"})
+	user.WaitEvent("error")
+
+	user.Emit("message", map[string]any{"sid": sess.ID, "message": "ciphertext", "checksum": checksum})
+	update := user.WaitUpdate("new-message")
+	if msg, _ := update.Body["message"].(map[string]any); msg["checksum"] != checksum {
+		t.Fatalf("expected checksum in update, got %v", update.Body)
+	}
+
+	msgs, err := srv.Client("user-1").ListMessages(context.Background(), sess.ID, 0, 10)
+	if err != nil {
+		t.Fatalf("ListMessages: %v", err)
+	}
+	if len(msgs) != 1 || msgs[0].Checksum != checksum {
+		t.Fatalf("expected one message with checksum, got %+v", msgs)
+	}
+}
+
+func TestConcurrentUpdatesArriveInSeqOrder(t *testing.T) {
+	srv := servertest.New(t, happyserver.WithoutSocketEventRateLimits())
+	sess := srv.CreateSession("user-1", "tag")
+	observer := srv.ConnectUser("user-1")
+
+	const senders, perSender = 4, 25
+	var wg sync.WaitGroup
+	for i := 0; i < senders; i++ {
+		sender := srv.ConnectUser("user-1")
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < perSender; j++ {
+				_ = sender.Socket.Emit("message", map[string]any{"sid": sess.ID, "message": "m"})
+			}
+		}()
+	}
+	wg.Wait()
+
+	last := int64(0)
+	for i := 0; i < senders*perSender; i++ {
+		update := observer.WaitUpdate("new-message")
+		if update.Seq <= last {
+			t.Fatalf("update %d: seq %d after %d", i, update.Seq, last)
+		}
+		last = update.Seq
+	}
+}
+
+func TestMessagesFromEveryAPIReachEveryTransport(t *testing.T) {
+	srv := servertest.New(t)
+	sess := srv.CreateSession("user-1", "tag")
+	sock := srv.ConnectUser("user-1")
+
+	wsURL := "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws?token=" + srv.Token("user-1")
+	raw, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer raw.Close()
+	readRaw := func() events.Message {
+		t.Helper()
+		_ = raw.SetReadDeadline(time.Now().Add(servertest.DefaultTimeout))
+		var update struct {
+			Event string                `json:"event"`
+			Body  events.NewMessageBody `json:"body"`
+		}
+		if err := raw.ReadJSON(&update); err != nil {
+			t.Fatalf("ReadJSON: %v", err)
+		}
+		if update.Event != events.TypeNewMessage || update.Body.SID != sess.ID || update.Body.SessionID != sess.ID {
+			t.Fatalf("expected new-message for %s on /ws, got %q %+v", sess.ID, update.Event, update.Body)
+		}
+		return update.Body.Message
+	}
+
+	posted, err := srv.Client("user-1").PostMessage(context.Background(), sess.ID, "from-rest", "")
+	if err != nil {
+		t.Fatalf("PostMessage: %v", err)
+	}
+	if got := sock.WaitUpdate("new-message"); got.Body["sid"] != sess.ID {
+		t.Fatalf("expected socket update for REST message, got %+v", got.Body)
+	}
+	if msg := readRaw(); msg.ID != posted.ID {
+		t.Fatalf("expected /ws update for REST message %s, got %v", posted.ID, msg.ID)
+	}
+
+	sock.Emit("message", map[string]any{"sid": sess.ID, "message": "from-socket"})
+	sock.WaitUpdate("new-message")
+	if msg := readRaw(); msg.Seq != 2 {
+		t.Fatalf("expected /ws update for socket message, got %+v", msg)
+	}
+
+	if err := raw.WriteJSON(map[string]any{"type": "message", "sid": sess.ID, "message": "from-ws"}); err != nil {
+		t.Fatalf("WriteJSON: %v", err)
+	}
+	readRaw()
+	update := sock.WaitUpdate("new-message")
+	if msg, _ := update.Body["message"].(map[string]any); msg["seq"] != float64(3) {
+		t.Fatalf("expected socket update for /ws message, got %+v", update.Body)
+	}
+}
+
+func TestSilentDaemonMarksSessionStalled(t *testing.T) {
+	srv := servertest.New(t, happyserver.WithSessionStallTimeout(200*time.Millisecond))
+	sess := srv.CreateSession("user-1", "tag")
+	user := srv.ConnectUser("user-1")
+	daemon := srv.ConnectSession("user-1", sess.ID)
+
+	ephemeralType := func(want string) func(client.Event) bool {
+		return func(ev client.Event) bool {
+			var body struct {
+				Type string `json:"type"`
+			}
+			return ev.Decode(&body) == nil && body.Type == want
+		}
+	}
+
+	daemon.Emit("session-alive", map[string]any{"sid": sess.ID, "time": time.Now().UnixMilli()})
+	user.WaitEventMatching("ephemeral", ephemeralType("activity"))
+	user.WaitEventMatching("ephemeral", ephemeralType("session-stalled"))
+
+	sessions, err := srv.Client("user-1").ListSessions(context.Background())
+	if err != nil {
+		t.Fatalf("ListSessions: %v", err)
+	}
+	if len(sessions) != 1 || sessions[0].Active {
+		t.Fatalf("expected stalled session to be inactive, got %+v", sessions)
+	}
+
+	// Reported once per silence, not on every check.
+	user.ExpectNoEvent("ephemeral", 500*time.Millisecond)
+}
+
+func TestRPCRelayRejectsWhenQueueFullWithoutStallingEvents(t *testing.T) {
+	srv := servertest.New(t, happyserver.WithRPCRelayLimits(1, 1), happyserver.WithoutSocketEventRateLimits())
+	srv.CreateMachine("user-1", "m1")
+	daemon := srv.ConnectMachine("user-1", "m1")
+	caller := srv.ConnectUser("user-1")
+
+	release := make(chan struct{})
+	ctx, cancel := context.WithTimeout(context.Background(), servertest.DefaultTimeout)
+	defer cancel()
+	if err := daemon.RegisterRPC(ctx, "m1:slow", func(params string) string {
+		<-release
+		return "done:" + params
+	}); err != nil {
+		t.Fatalf("RegisterRPC: %v", err)
+	}
+
+	results := make(chan error, 2)
+	for _, p := range []string{"a", "b"} {
+		p := p
+		go func() {
+			_, err := caller.CallRPC(ctx, "m1:slow", p)
+			results <- err
+		}()
+	}
+	// Give both calls time to occupy the relay slot and the queue.
+	time.Sleep(100 * time.Millisecond)
+
+	if _, err := caller.CallRPC(ctx, "m1:slow", "c"); err == nil || !strings.Contains(err.Error(), "Server busy") {
+		t.Fatalf("expected server busy, got %v", err)
+	}
+	if _, err := caller.EmitWithAck(ctx, "ping"); err != nil {
+		t.Fatalf("expected events to keep flowing while RPCs wait, got %v", err)
+	}
+
+	close(release)
+	for i := 0; i < 2; i++ {
+		if err := <-results; err != nil {
+			t.Fatalf("queued call failed: %v", err)
+		}
+	}
+}
+
+func TestMachineEventRelaysBetweenOwnMachines(t *testing.T) {
+	srv := servertest.New(t)
+	srv.CreateMachine("user-1", "m1")
+	srv.CreateMachine("user-1", "m2")
+	srv.CreateMachine("user-2", "m3")
+	sender := srv.ConnectMachine("user-1", "m1")
+	receiver := srv.ConnectMachine("user-1", "m2")
+	stranger := srv.ConnectMachine("user-2", "m3")
+	user := srv.ConnectUser("user-1")
+
+	ctx, cancel := context.WithTimeout(context.Background(), servertest.DefaultTimeout)
+	defer cancel()
+
+	delivered, err := sender.SendMachineEvent(ctx, "m2", "job-handoff", map[string]string{"job": "42"})
+	if err != nil || delivered != 1 {
+		t.Fatalf("SendMachineEvent: delivered=%d err=%v", delivered, err)
+	}
+	var ev struct {
+		From    string            `json:"from"`
+		Event   string            `json:"event"`
+		Payload map[string]string `json:"payload"`
+	}
+	if err := receiver.WaitEvent("machine-event").Decode(&ev); err != nil {
+		t.Fatalf("decode machine-event: %v", err)
+	}
+	if ev.From != "m1" || ev.Event != "job-handoff" || ev.Payload["job"] != "42" {
+		t.Fatalf("unexpected machine-event %+v", ev)
+	}
+
+	if _, err := sender.SendMachineEvent(ctx, "m3", "job-handoff", nil); err == nil || !strings.Contains(err.Error(), "Machine not found") {
+		t.Fatalf("expected other user's machine to be rejected, got %v", err)
+	}
+	if _, err := user.SendMachineEvent(ctx, "m2", "job-handoff", nil); err == nil {
+		t.Fatal("expected user-scoped connection to be rejected")
+	}
+	receiver.Close()
+	// The server notices the disconnect asynchronously.
+	for {
+		_, err := sender.SendMachineEvent(ctx, "m2", "job-handoff", nil)
+		if err != nil && strings.Contains(err.Error(), "Machine offline") {
+			break
+		}
+		if ctx.Err() != nil {
+			t.Fatalf("expected offline machine to be rejected, got %v", err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	stranger.ExpectNoEvent("machine-event", 200*time.Millisecond)
+}
+
+func TestMessageRetentionPrunesInBackground(t *testing.T) {
+	srv := servertest.New(t, happyserver.WithMessageRetention(0, 2, 20*time.Millisecond))
+	sess := srv.CreateSession("user-1", "tag")
+	c := srv.Client("user-1")
+	ctx, cancel := context.WithTimeout(context.Background(), servertest.DefaultTimeout)
+	defer cancel()
+	for _, content := range []string{"one", "two", "three", "four"} {
+		if _, err := c.PostMessage(ctx, sess.ID, content, ""); err != nil {
+			t.Fatalf("PostMessage: %v", err)
+		}
+	}
+
+	for {
+		msgs, err := c.ListMessages(ctx, sess.ID, 0, 10)
+		if err != nil {
+			t.Fatalf("ListMessages: %v", err)
+		}
+		if len(msgs) == 2 {
+			if msgs[0].Seq != 3 || msgs[1].Content.C != "four" {
+				t.Fatalf("expected the newest messages to survive, got %+v", msgs)
+			}
+			return
+		}
+		if ctx.Err() != nil {
+			t.Fatalf("expected messages pruned to 2, still have %d", len(msgs))
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestScopedTokenReachesOnlyItsSession(t *testing.T) {
+	srv := servertest.New(t)
+	sess := srv.CreateSession("user-1", "tag")
+	other := srv.CreateSession("user-1", "other")
+
+	ctx, cancel := context.WithTimeout(context.Background(), servertest.DefaultTimeout)
+	defer cancel()
+	token, err := srv.Client("user-1").ScopedToken(ctx, client.TokenScope{SessionID: sess.ID})
+	if err != nil {
+		t.Fatalf("ScopedToken: %v", err)
+	}
+	daemon := client.New(srv.URL, client.WithToken(token))
+
+	if _, err := daemon.ListMessages(ctx, sess.ID, 0, 10); err != nil {
+		t.Fatalf("expected the scoped token to read its session: %v", err)
+	}
+	for name, call := range map[string]func() error{
+		"other session": func() error { _, err := daemon.ListMessages(ctx, other.ID, 0, 10); return err },
+		"session list":  func() error { _, err := daemon.ListSessions(ctx); return err },
+		"mint token":    func() error { _, err := daemon.ScopedToken(ctx, client.TokenScope{SessionID: sess.ID}); return err },
+	} {
+		var apiErr *client.APIError
+		if err := call(); !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusForbidden {
+			t.Fatalf("%s: expected 403, got %v", name, err)
+		}
+	}
+
+	if _, err := daemon.ConnectSocket(ctx, client.SocketOptions{ClientType: client.ClientTypeUser}); err == nil {
+		t.Fatalf("expected a user-scoped connect with a scoped token to be rejected")
+	}
+	if _, err := daemon.ConnectSocket(ctx, client.SocketOptions{ClientType: client.ClientTypeSession, SessionID: other.ID}); err == nil {
+		t.Fatalf("expected a connect to another session to be rejected")
+	}
+	sock, err := daemon.ConnectSocket(ctx, client.SocketOptions{ClientType: client.ClientTypeSession, SessionID: sess.ID})
+	if err != nil {
+		t.Fatalf("ConnectSocket: %v", err)
+	}
+	defer sock.Close()
+
+	user := srv.ConnectUser("user-1")
+	if err := sock.Emit("message", map[string]any{"sid": other.ID, "message": "stray"}); err != nil {
+		t.Fatalf("Emit: %v", err)
+	}
+	if err := sock.Emit("message", map[string]any{"sid": sess.ID, "message": "hello"}); err != nil {
+		t.Fatalf("Emit: %v", err)
+	}
+	if update := user.WaitUpdate("new-message"); update.Body["sid"] != sess.ID {
+		t.Fatalf("expected only the in-scope message to be stored, got %v", update.Body)
+	}
+}
+
+func TestRenewTokenKeepsScope(t *testing.T) {
+	srv := servertest.New(t)
+	sess := srv.CreateSession("user-1", "tag")
+	other := srv.CreateSession("user-1", "other")
+
+	ctx, cancel := context.WithTimeout(context.Background(), servertest.DefaultTimeout)
+	defer cancel()
+	token, err := srv.Client("user-1").ScopedToken(ctx, client.TokenScope{SessionID: sess.ID})
+	if err != nil {
+		t.Fatalf("ScopedToken: %v", err)
+	}
+	daemon := client.New(srv.URL, client.WithToken(token))
+	renewed, err := daemon.RenewToken(ctx)
+	if err != nil {
+		t.Fatalf("RenewToken: %v", err)
+	}
+	if renewed == token {
+		t.Fatalf("expected a fresh token")
+	}
+	if _, err := daemon.ListMessages(ctx, sess.ID, 0, 10); err != nil {
+		t.Fatalf("expected the renewed token to read its session: %v", err)
+	}
+	var apiErr *client.APIError
+	if _, err := daemon.ListMessages(ctx, other.ID, 0, 10); !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected the renewed token to keep its scope, got %v", err)
+	}
+
+	if _, err := client.New(srv.URL).RenewToken(ctx); !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected renewing without a token to fail, got %v", err)
+	}
+}
+
+func TestRPCMethodsAreScopedPerUser(t *testing.T) {
+	srv := servertest.New(t)
+	srv.CreateMachine("user-1", "m1")
+	srv.CreateMachine("user-2", "m1")
+	daemon1 := srv.ConnectMachine("user-1", "m1")
+	daemon2 := srv.ConnectMachine("user-2", "m1")
+	caller1 := srv.ConnectUser("user-1")
+	caller2 := srv.ConnectUser("user-2")
+
+	ctx, cancel := context.WithTimeout(context.Background(), servertest.DefaultTimeout)
+	defer cancel()
+	if err := daemon1.RegisterRPC(ctx, "m1:whoami", func(string) string { return "user-1" }); err != nil {
+		t.Fatalf("RegisterRPC user-1: %v", err)
+	}
+	if _, err := caller2.CallRPC(ctx, "m1:whoami", ""); err == nil || !strings.Contains(err.Error(), "Method not found") {
+		t.Fatalf("expected user-2 not to reach user-1's daemon, got %v", err)
+	}
+
+	// The second daemon registering the same method must not take over the
+	// first user's registration.
+	if err := daemon2.RegisterRPC(ctx, "m1:whoami", func(string) string { return "user-2" }); err != nil {
+		t.Fatalf("RegisterRPC user-2: %v", err)
+	}
+	for caller, want := range map[*servertest.Socket]string{caller1: "user-1", caller2: "user-2"} {
+		got, err := caller.CallRPC(ctx, "m1:whoami", "")
+		if err != nil {
+			t.Fatalf("CallRPC for %s: %v", want, err)
+		}
+		if got != want {
+			t.Fatalf("expected %s's daemon to answer, got %q", want, got)
+		}
+	}
+
+	// Disconnecting one daemon leaves the other user's method in place.
+	_ = daemon2.Close()
+	caller2.WaitEventMatching("ephemeral", func(ev client.Event) bool {
+		var body events.MachineActivity
+		return ev.Decode(&body) == nil && body.Type == events.TypeMachineActivity && !body.Active
+	})
+	if _, err := caller2.CallRPC(ctx, "m1:whoami", ""); err == nil || !strings.Contains(err.Error(), "Method not found") {
+		t.Fatalf("expected user-2's method to go away with its daemon, got %v", err)
+	}
+	if _, err := caller1.CallRPC(ctx, "m1:whoami", ""); err != nil {
+		t.Fatalf("expected user-1's method to survive user-2's disconnect, got %v", err)
+	}
+}
@@ -0,0 +1,83 @@
+package server_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+
+	"happy-server-lite/pkg/client"
+	"happy-server-lite/pkg/servertest"
+)
+
+func TestSessionLocksCoordinateRESTAndSockets(t *testing.T) {
+	srv := servertest.New(t)
+	ctx := context.Background()
+	c := srv.Client("user-1")
+	sess := srv.CreateSession("user-1", "tag")
+	app := srv.ConnectUser("user-1")
+	daemon := srv.ConnectSession("user-1", sess.ID)
+
+	lock, err := c.AcquireSessionLock(ctx, sess.ID, "metadata", "cli", 60)
+	if err != nil || lock.Token == "" || lock.Holder != "cli" {
+		t.Fatalf("AcquireSessionLock: %+v (%v)", lock, err)
+	}
+	var changed struct {
+		Type   string `json:"type"`
+		ID     string `json:"id"`
+		Name   string `json:"name"`
+		Holder string `json:"holder"`
+		Held   bool   `json:"held"`
+		Token  string `json:"token"`
+	}
+	ev := app.WaitEventMatching("ephemeral", func(ev client.Event) bool {
+		return ev.Decode(&changed) == nil && changed.Type == "session-lock"
+	})
+	if changed.ID != sess.ID || changed.Name != "metadata" || !changed.Held || changed.Token != "" {
+		t.Fatalf("unexpected session-lock ephemeral: %s", ev.Args[0])
+	}
+
+	type lockAck struct {
+		Result string      `json:"result"`
+		Lock   client.Lock `json:"lock"`
+	}
+	acquire := func() lockAck {
+		t.Helper()
+		ack, err := daemon.EmitWithAck(ctx, "lock-acquire", map[string]any{"sid": sess.ID, "name": "metadata", "holder": "daemon", "ttlSeconds": 30})
+		if err != nil || len(ack) != 1 {
+			t.Fatalf("EmitWithAck: %v", err)
+		}
+		var res lockAck
+		if err := json.Unmarshal(ack[0], &res); err != nil {
+			t.Fatalf("unexpected ack: %s", ack[0])
+		}
+		return res
+	}
+	if res := acquire(); res.Result != "held" || res.Lock.Holder != "cli" || res.Lock.Token != "" {
+		t.Fatalf("expected the lock held by cli, got %+v", res)
+	}
+
+	var apiErr *client.APIError
+	if current, err := c.AcquireSessionLock(ctx, sess.ID, "metadata", "other", 0); !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusConflict || current.Holder != "cli" {
+		t.Fatalf("expected a conflict with the current lock, got %+v (%v)", current, err)
+	}
+	if _, err := c.RenewSessionLock(ctx, sess.ID, "metadata", lock.Token, 120); err != nil {
+		t.Fatalf("RenewSessionLock: %v", err)
+	}
+	if err := c.ReleaseSessionLock(ctx, sess.ID, "metadata", lock.Token); err != nil {
+		t.Fatalf("ReleaseSessionLock: %v", err)
+	}
+	if err := c.ReleaseSessionLock(ctx, sess.ID, "metadata", lock.Token); !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusConflict {
+		t.Fatalf("expected releasing twice to conflict, got %v", err)
+	}
+
+	res := acquire()
+	if res.Result != "success" || res.Lock.Token == "" {
+		t.Fatalf("expected the released lock to be taken, got %+v", res)
+	}
+	locks, err := c.ListSessionLocks(ctx, sess.ID)
+	if err != nil || len(locks) != 1 || locks[0].Holder != "daemon" || locks[0].Token != "" {
+		t.Fatalf("unexpected locks: %+v (%v)", locks, err)
+	}
+}
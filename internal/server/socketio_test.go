@@ -1,8 +1,10 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
 	"net"
+	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
@@ -11,6 +13,7 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
 	"happy-server-lite/internal/auth"
+	"happy-server-lite/internal/socketio"
 	"happy-server-lite/internal/store"
 )
 
@@ -41,6 +44,7 @@ func waitForPrefix(t *testing.T, c *websocket.Conn, prefix string, timeout time.
 }
 
 func TestSocketIOHandshakeAndPingAck(t *testing.T) {
+	ctx := context.Background()
 	gin.SetMode(gin.TestMode)
 	st := store.New()
 	tokenCfg := auth.TokenConfig{Secret: "secret", Expiry: time.Hour, Issuer: "test"}
@@ -50,7 +54,7 @@ func TestSocketIOHandshakeAndPingAck(t *testing.T) {
 	if err != nil {
 		t.Fatalf("CreateToken: %v", err)
 	}
-	sess, _, err := st.GetOrCreateSession("user-1", "tag", "m", nil, nil, time.Now().UnixMilli())
+	sess, _, err := st.GetOrCreateSession(ctx, "user-1", "tag", "m", nil, nil, time.Now().UnixMilli())
 	if err != nil {
 		t.Fatalf("GetOrCreateSession: %v", err)
 	}
@@ -86,7 +90,41 @@ func TestSocketIOHandshakeAndPingAck(t *testing.T) {
 	}
 }
 
+func TestSocketIOClientPingEchoesPayload(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	st := store.New()
+	tokenCfg := auth.TokenConfig{Secret: "secret", Expiry: time.Hour, Issuer: "test"}
+	r := NewRouter(Deps{Store: st, TokenConfig: tokenCfg})
+
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(srv.URL, "http") + "/v1/updates/?EIO=4&transport=websocket"
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+
+	_ = waitForPrefix(t, conn, "0{", 2*time.Second)
+
+	if err := conn.WriteMessage(websocket.TextMessage, []byte("2probe")); err != nil {
+		t.Fatalf("WriteMessage(ping): %v", err)
+	}
+	if pong := waitForPrefix(t, conn, "3", 2*time.Second); pong != "3probe" {
+		t.Fatalf("expected 3probe, got %s", pong)
+	}
+
+	if err := conn.WriteMessage(websocket.TextMessage, []byte("2")); err != nil {
+		t.Fatalf("WriteMessage(ping): %v", err)
+	}
+	if pong := waitForPrefix(t, conn, "3", 2*time.Second); pong != "3" {
+		t.Fatalf("expected empty pong, got %s", pong)
+	}
+}
+
 func TestSocketIOUpdateBroadcastToUserScoped(t *testing.T) {
+	ctx := context.Background()
 	gin.SetMode(gin.TestMode)
 	st := store.New()
 	tokenCfg := auth.TokenConfig{Secret: "secret", Expiry: time.Hour, Issuer: "test"}
@@ -96,7 +134,7 @@ func TestSocketIOUpdateBroadcastToUserScoped(t *testing.T) {
 	if err != nil {
 		t.Fatalf("CreateToken: %v", err)
 	}
-	sess, _, err := st.GetOrCreateSession("user-1", "tag", "m", nil, nil, time.Now().UnixMilli())
+	sess, _, err := st.GetOrCreateSession(ctx, "user-1", "tag", "m", nil, nil, time.Now().UnixMilli())
 	if err != nil {
 		t.Fatalf("GetOrCreateSession: %v", err)
 	}
@@ -156,6 +194,7 @@ func TestSocketIOUpdateBroadcastToUserScoped(t *testing.T) {
 }
 
 func TestSocketIOMachineAliveBroadcastsEphemeral(t *testing.T) {
+	ctx := context.Background()
 	gin.SetMode(gin.TestMode)
 	st := store.New()
 	tokenCfg := auth.TokenConfig{Secret: "secret", Expiry: time.Hour, Issuer: "test"}
@@ -165,7 +204,7 @@ func TestSocketIOMachineAliveBroadcastsEphemeral(t *testing.T) {
 	if err != nil {
 		t.Fatalf("CreateToken: %v", err)
 	}
-	_, _, err = st.UpsertMachine("user-1", "m1", "mm", nil, nil, time.Now().UnixMilli())
+	_, _, err = st.UpsertMachine(ctx, "user-1", "m1", "mm", nil, nil, time.Now().UnixMilli())
 	if err != nil {
 		t.Fatalf("UpsertMachine: %v", err)
 	}
@@ -227,6 +266,7 @@ func TestSocketIOMachineAliveBroadcastsEphemeral(t *testing.T) {
 }
 
 func TestSocketIOSessionAliveBroadcastsThinkingState(t *testing.T) {
+	ctx := context.Background()
 	gin.SetMode(gin.TestMode)
 	st := store.New()
 	tokenCfg := auth.TokenConfig{Secret: "secret", Expiry: time.Hour, Issuer: "test"}
@@ -236,7 +276,7 @@ func TestSocketIOSessionAliveBroadcastsThinkingState(t *testing.T) {
 	if err != nil {
 		t.Fatalf("CreateToken: %v", err)
 	}
-	sess, _, err := st.GetOrCreateSession("user-1", "tag", "m", nil, nil, time.Now().UnixMilli())
+	sess, _, err := st.GetOrCreateSession(ctx, "user-1", "tag", "m", nil, nil, time.Now().UnixMilli())
 	if err != nil {
 		t.Fatalf("GetOrCreateSession: %v", err)
 	}
@@ -296,7 +336,7 @@ func TestSocketIOSessionAliveBroadcastsThinkingState(t *testing.T) {
 		t.Fatalf("unexpected thinking: %v", data["thinking"])
 	}
 
-	updated, ok := st.GetSession("user-1", sess.ID)
+	updated, ok := st.GetSession(ctx, "user-1", sess.ID)
 	if !ok {
 		t.Fatalf("GetSession: not found")
 	}
@@ -306,6 +346,7 @@ func TestSocketIOSessionAliveBroadcastsThinkingState(t *testing.T) {
 }
 
 func TestSocketIOHandshakeOnUserMachineDaemonPath(t *testing.T) {
+	ctx := context.Background()
 	gin.SetMode(gin.TestMode)
 	st := store.New()
 	tokenCfg := auth.TokenConfig{Secret: "secret", Expiry: time.Hour, Issuer: "test"}
@@ -315,7 +356,7 @@ func TestSocketIOHandshakeOnUserMachineDaemonPath(t *testing.T) {
 	if err != nil {
 		t.Fatalf("CreateToken: %v", err)
 	}
-	sess, _, err := st.GetOrCreateSession("user-1", "tag", "m", nil, nil, time.Now().UnixMilli())
+	sess, _, err := st.GetOrCreateSession(ctx, "user-1", "tag", "m", nil, nil, time.Now().UnixMilli())
 	if err != nil {
 		t.Fatalf("GetOrCreateSession: %v", err)
 	}
@@ -340,6 +381,7 @@ func TestSocketIOHandshakeOnUserMachineDaemonPath(t *testing.T) {
 }
 
 func TestSocketIOSendMessageFromUserScopedBroadcastToSessionScoped(t *testing.T) {
+	ctx := context.Background()
 	gin.SetMode(gin.TestMode)
 	st := store.New()
 	tokenCfg := auth.TokenConfig{Secret: "secret", Expiry: time.Hour, Issuer: "test"}
@@ -349,7 +391,7 @@ func TestSocketIOSendMessageFromUserScopedBroadcastToSessionScoped(t *testing.T)
 	if err != nil {
 		t.Fatalf("CreateToken: %v", err)
 	}
-	sess, _, err := st.GetOrCreateSession("user-1", "tag", "m", nil, nil, time.Now().UnixMilli())
+	sess, _, err := st.GetOrCreateSession(ctx, "user-1", "tag", "m", nil, nil, time.Now().UnixMilli())
 	if err != nil {
 		t.Fatalf("GetOrCreateSession: %v", err)
 	}
@@ -414,3 +456,222 @@ func TestSocketIOSendMessageFromUserScopedBroadcastToSessionScoped(t *testing.T)
 		t.Fatalf("unexpected createdAt: %v", msg["createdAt"])
 	}
 }
+
+func TestSocketIOEventRateLimit(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	st := store.New()
+	tokenCfg := auth.TokenConfig{Secret: "secret", Expiry: time.Hour, Issuer: "test"}
+	r := NewRouter(Deps{Store: st, TokenConfig: tokenCfg, SocketLimits: socketio.Limits{
+		EventRates:        map[string]socketio.EventRateLimit{"ping": {Limit: 1, Window: time.Minute}},
+		MaxRateViolations: 2,
+	}})
+
+	userToken, err := auth.CreateToken("user-1", tokenCfg)
+	if err != nil {
+		t.Fatalf("CreateToken: %v", err)
+	}
+
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+	wsURL := "ws" + strings.TrimPrefix(srv.URL, "http") + "/v1/updates/?EIO=4&transport=websocket"
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+	_ = waitForPrefix(t, conn, "0{", 2*time.Second)
+	authBytes, _ := json.Marshal(map[string]any{"token": userToken, "clientType": "user-scoped"})
+	if err := conn.WriteMessage(websocket.TextMessage, []byte("40"+string(authBytes))); err != nil {
+		t.Fatalf("WriteMessage(connect): %v", err)
+	}
+	_ = waitForPrefix(t, conn, "40", 2*time.Second)
+
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(`421["ping"]`)); err != nil {
+		t.Fatalf("WriteMessage(ping): %v", err)
+	}
+	if ack := waitForPrefix(t, conn, "431", 2*time.Second); ack != "431[]" {
+		t.Fatalf("unexpected ack: %s", ack)
+	}
+
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(`422["ping"]`)); err != nil {
+		t.Fatalf("WriteMessage(ping): %v", err)
+	}
+	limited := waitForPrefix(t, conn, "432", 2*time.Second)
+	if !strings.Contains(limited, `"result":"rate-limited"`) || !strings.Contains(limited, `"code":"rate_limited"`) {
+		t.Fatalf("unexpected rate-limited ack: %s", limited)
+	}
+
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(`423["ping"]`)); err != nil {
+		t.Fatalf("WriteMessage(ping): %v", err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				t.Fatalf("expected disconnect after sustained abuse")
+			}
+			break
+		}
+	}
+}
+
+func TestSocketIOHandshakeTimeoutClosesUnauthenticated(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	st := store.New()
+	tokenCfg := auth.TokenConfig{Secret: "secret", Expiry: time.Hour, Issuer: "test"}
+	r := NewRouter(Deps{Store: st, TokenConfig: tokenCfg, SocketLimits: socketio.Limits{HandshakeTimeout: 100 * time.Millisecond}})
+
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+	wsURL := "ws" + strings.TrimPrefix(srv.URL, "http") + "/v1/updates/?EIO=4&transport=websocket"
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+	_ = waitForPrefix(t, conn, "0{", 2*time.Second)
+
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				t.Fatalf("expected disconnect after handshake timeout")
+			}
+			break
+		}
+		if strings.HasPrefix(string(data), `42["error"`) && !strings.Contains(string(data), "Handshake timeout") {
+			t.Fatalf("unexpected error event: %s", data)
+		}
+	}
+}
+
+func TestSocketIOHandshakeTokenPreCheck(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	st := store.New()
+	tokenCfg := auth.TokenConfig{Secret: "secret", Expiry: time.Hour, Issuer: "test"}
+	r := NewRouter(Deps{Store: st, TokenConfig: tokenCfg, SocketLimits: socketio.Limits{RequireHandshakeToken: true, MaxPendingPerIP: 1}})
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	userToken, _ := auth.CreateToken("user-1", tokenCfg)
+	otherToken, _ := auth.CreateToken("user-2", tokenCfg)
+	wsURL := "ws" + strings.TrimPrefix(srv.URL, "http") + "/v1/updates/?EIO=4&transport=websocket"
+	dial := func(header http.Header) (*websocket.Conn, int) {
+		t.Helper()
+		conn, resp, err := websocket.DefaultDialer.Dial(wsURL, header)
+		if err != nil {
+			if resp == nil {
+				t.Fatalf("Dial: %v", err)
+			}
+			return nil, resp.StatusCode
+		}
+		return conn, http.StatusSwitchingProtocols
+	}
+
+	if _, code := dial(nil); code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without a token, got %d", code)
+	}
+	if _, code := dial(http.Header{"Authorization": {"Bearer bogus"}}); code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for a bad token, got %d", code)
+	}
+
+	conn, code := dial(http.Header{"Authorization": {"Bearer " + userToken}})
+	if conn == nil {
+		t.Fatalf("expected upgrade, got %d", code)
+	}
+	defer conn.Close()
+	_ = waitForPrefix(t, conn, "0{", 2*time.Second)
+
+	// The first socket has not connected yet, so it holds the IP's only
+	// pending slot.
+	if _, code := dial(http.Header{"Authorization": {"Bearer " + userToken}}); code != http.StatusTooManyRequests {
+		t.Fatalf("expected 429 with a pending socket, got %d", code)
+	}
+
+	// The connect packet must carry the handshake user's token.
+	authBytes, _ := json.Marshal(map[string]any{"token": otherToken, "clientType": "user-scoped"})
+	if err := conn.WriteMessage(websocket.TextMessage, []byte("40"+string(authBytes))); err != nil {
+		t.Fatalf("WriteMessage(connect): %v", err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		_, data, err := conn.ReadMessage()
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			t.Fatalf("expected the socket to be closed")
+		}
+		if err != nil {
+			break
+		}
+		if strings.HasPrefix(string(data), "40") {
+			t.Fatalf("expected a mismatched token to be refused, got %s", data)
+		}
+	}
+
+	conn2, code := dial(nil)
+	if conn2 != nil || code != http.StatusUnauthorized {
+		t.Fatalf("expected the token to stay required, got %d", code)
+	}
+	conn2, code = dial(http.Header{"Authorization": {"Bearer " + userToken}})
+	for i := 0; conn2 == nil && code == http.StatusTooManyRequests && i < 50; i++ {
+		// The closed socket frees its slot once its read loop exits.
+		time.Sleep(20 * time.Millisecond)
+		conn2, code = dial(http.Header{"Authorization": {"Bearer " + userToken}})
+	}
+	if conn2 == nil {
+		t.Fatalf("expected the slot to be freed, got %d", code)
+	}
+	defer conn2.Close()
+	_ = waitForPrefix(t, conn2, "0{", 2*time.Second)
+	authBytes, _ = json.Marshal(map[string]any{"token": userToken, "clientType": "user-scoped"})
+	if err := conn2.WriteMessage(websocket.TextMessage, []byte("40"+string(authBytes))); err != nil {
+		t.Fatalf("WriteMessage(connect): %v", err)
+	}
+	_ = waitForPrefix(t, conn2, "40", 2*time.Second)
+
+	// Connected sockets no longer count as pending.
+	conn3, code := dial(http.Header{"Authorization": {"Bearer " + userToken}})
+	if conn3 == nil {
+		t.Fatalf("expected upgrade after connect, got %d", code)
+	}
+	conn3.Close()
+}
+
+func TestSocketIODaemonEndpointRejectsUserScoped(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	st := store.New()
+	tokenCfg := auth.TokenConfig{Secret: "secret", Expiry: time.Hour, Issuer: "test"}
+	r := NewRouter(Deps{Store: st, TokenConfig: tokenCfg})
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	userToken, err := auth.CreateToken("user-1", tokenCfg)
+	if err != nil {
+		t.Fatalf("CreateToken: %v", err)
+	}
+	wsURL := "ws" + strings.TrimPrefix(srv.URL, "http") + "/v1/user-machine-daemon/?EIO=4&transport=websocket"
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+	_ = waitForPrefix(t, conn, "0{", 2*time.Second)
+
+	authBytes, _ := json.Marshal(map[string]any{"token": userToken, "clientType": "user-scoped"})
+	if err := conn.WriteMessage(websocket.TextMessage, []byte("40"+string(authBytes))); err != nil {
+		t.Fatalf("WriteMessage(connect): %v", err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		_, data, err := conn.ReadMessage()
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			t.Fatalf("expected the socket to be closed")
+		}
+		if err != nil {
+			break
+		}
+		if strings.HasPrefix(string(data), "40") {
+			t.Fatalf("expected a user-scoped daemon connection to be refused, got %s", data)
+		}
+	}
+}
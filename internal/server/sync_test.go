@@ -0,0 +1,68 @@
+package server_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"happy-server-lite/pkg/servertest"
+)
+
+func TestSyncReportsChangesAndTombstones(t *testing.T) {
+	srv := servertest.New(t)
+	api := srv.Client("user-1")
+	ctx := context.Background()
+
+	kept := srv.CreateSession("user-1", "kept")
+	gone := srv.CreateSession("user-1", "gone")
+	srv.CreateMachine("user-1", "machine-1")
+
+	first, err := api.Sync(ctx, 0)
+	if err != nil {
+		t.Fatalf("Sync: %v", err)
+	}
+	if len(first.Sessions) != 2 || len(first.Machines) != 1 || len(first.Tombstones) != 0 || first.Resync {
+		t.Fatalf("unexpected initial sync: %+v", first)
+	}
+
+	user := srv.ConnectUser("user-1")
+	time.Sleep(5 * time.Millisecond)
+	if err := api.DeleteSession(ctx, gone.ID); err != nil {
+		t.Fatalf("DeleteSession: %v", err)
+	}
+	if err := api.DeleteMachine(ctx, "machine-1"); err != nil {
+		t.Fatalf("DeleteMachine: %v", err)
+	}
+	if update := user.WaitUpdate("delete-machine"); update.Body["machineId"] != "machine-1" {
+		t.Fatalf("unexpected delete-machine update: %v", update.Body)
+	}
+
+	delta, err := api.Sync(ctx, first.Now)
+	if err != nil {
+		t.Fatalf("Sync: %v", err)
+	}
+	if len(delta.Sessions) != 0 || len(delta.Machines) != 0 {
+		t.Fatalf("expected no live changes, got %+v", delta)
+	}
+	if len(delta.Tombstones) != 2 {
+		t.Fatalf("expected 2 tombstones, got %+v", delta.Tombstones)
+	}
+	for _, ts := range delta.Tombstones {
+		if ts.ID == kept.ID {
+			t.Fatalf("kept session reported as deleted")
+		}
+	}
+}
+
+func TestSyncResyncsPastRetention(t *testing.T) {
+	srv := servertest.New(t)
+	srv.CreateSession("user-1", "tag")
+
+	result, err := srv.Client("user-1").Sync(context.Background(), 1)
+	if err != nil {
+		t.Fatalf("Sync: %v", err)
+	}
+	if !result.Resync || len(result.Sessions) != 1 {
+		t.Fatalf("expected full resync snapshot, got %+v", result)
+	}
+}
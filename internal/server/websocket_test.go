@@ -1,6 +1,7 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
 	"net/http/httptest"
 	"strings"
@@ -10,6 +11,7 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
 	"happy-server-lite/internal/auth"
+	"happy-server-lite/internal/handler"
 	"happy-server-lite/internal/store"
 )
 
@@ -46,3 +48,42 @@ func TestWebSocketPingPong(t *testing.T) {
 		t.Fatalf("expected pong, got %s", string(data))
 	}
 }
+
+func TestWebSocketSlowClientDoesNotBlockAppends(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	st := store.New()
+	tokenCfg := auth.TokenConfig{Secret: "secret", Expiry: time.Hour, Issuer: "test"}
+	r := NewRouter(Deps{Store: st, TokenConfig: tokenCfg, WSLimits: handler.WebSocketLimits{WriteWait: 10 * time.Second}})
+
+	tok, err := auth.CreateToken("user-1", tokenCfg)
+	if err != nil {
+		t.Fatalf("CreateToken: %v", err)
+	}
+
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	// The client never reads, so once the socket buffers fill every write
+	// to it would block for the whole write wait.
+	wsURL := "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws?token=" + tok
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+	// Let the server register the connection with the hub.
+	time.Sleep(50 * time.Millisecond)
+
+	ctx := context.Background()
+	sess, _, _ := st.GetOrCreateSession(ctx, "user-1", "tag", "meta", nil, nil, time.Now().UnixMilli())
+	content := strings.Repeat("x", 64*1024)
+	start := time.Now()
+	for i := 0; i < 2*256; i++ {
+		if _, err := st.AppendMessageFrom(ctx, "", "user-1", sess.ID, content, "", time.Now().UnixMilli()); err != nil {
+			t.Fatalf("AppendMessageFrom: %v", err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("expected appends not to wait on the slow client, took %s", elapsed)
+	}
+}
@@ -0,0 +1,150 @@
+package socketio
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Commands an operator can send a machine's daemon with SendMachineCommand.
+const (
+	// CommandResync asks the daemon to re-read its sessions and machine
+	// state from the server.
+	CommandResync = "re-sync"
+	// CommandRotateToken hands the daemon a new machine-scoped token to
+	// reconnect with.
+	CommandRotateToken = "rotate-token"
+	// CommandShutdown asks the daemon to finish its work and exit.
+	CommandShutdown = "shutdown"
+)
+
+// ValidMachineCommand reports whether daemons are sent command.
+func ValidMachineCommand(command string) bool {
+	switch command {
+	case CommandResync, CommandRotateToken, CommandShutdown:
+		return true
+	}
+	return false
+}
+
+// maxCommandLog bounds how many recent commands CommandLog keeps.
+const maxCommandLog = 200
+
+// CommandAck is one daemon connection's answer to a command. Error is set
+// when it did not ack before the timeout.
+type CommandAck struct {
+	ConnectionID string          `json:"connectionId"`
+	Acked        bool            `json:"acked"`
+	Response     json.RawMessage `json:"response,omitempty"`
+	Error        string          `json:"error,omitempty"`
+}
+
+// CommandResult records a command sent to a machine's daemon connections
+// and what each answered.
+type CommandResult struct {
+	ID        string       `json:"id"`
+	UserID    string       `json:"userId"`
+	MachineID string       `json:"machineId"`
+	Command   string       `json:"command"`
+	SentAt    int64        `json:"sentAt"`
+	Delivered int          `json:"delivered"`
+	Acks      []CommandAck `json:"acks"`
+}
+
+// Acked reports whether any connection acked the command.
+func (r CommandResult) Acked() bool {
+	for _, ack := range r.Acks {
+		if ack.Acked {
+			return true
+		}
+	}
+	return false
+}
+
+type commandLog struct {
+	mu      sync.Mutex
+	results []CommandResult
+}
+
+func (l *commandLog) add(r CommandResult) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.results = append(l.results, r)
+	if len(l.results) > maxCommandLog {
+		l.results = append([]CommandResult(nil), l.results[len(l.results)-maxCommandLog:]...)
+	}
+}
+
+// SendMachineCommand emits a "machine-command" event carrying command and
+// args to every daemon connection of the user's machine and waits up to
+// timeout for their acks. The result is kept for CommandLog. It reports
+// false when the machine has no daemon connected.
+func (s *Server) SendMachineCommand(ctx context.Context, userID, machineID, command string, args any, timeout time.Duration) (CommandResult, bool) {
+	s.mu.RLock()
+	var targets []*conn
+	for c := range s.roomMachines[machineRoom(userID, machineID)] {
+		if c.clientType == "machine-scoped" {
+			targets = append(targets, c)
+		}
+	}
+	s.mu.RUnlock()
+	if len(targets) == 0 {
+		return CommandResult{}, false
+	}
+
+	result := CommandResult{
+		ID:        s.newID(),
+		UserID:    userID,
+		MachineID: machineID,
+		Command:   command,
+		SentAt:    s.nowMillis(),
+		Delivered: len(targets),
+		Acks:      make([]CommandAck, len(targets)),
+	}
+	event := gin.H{"id": result.ID, "command": command, "args": args, "sentAt": result.SentAt}
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < timeout {
+		timeout = time.Until(deadline)
+	}
+	var wg sync.WaitGroup
+	for i, c := range targets {
+		wg.Add(1)
+		go func(i int, c *conn) {
+			defer wg.Done()
+			ack := CommandAck{ConnectionID: c.sid}
+			resp, err := c.emitWithAck("machine-command", event, timeout)
+			switch {
+			case errors.Is(err, errAckTimeout):
+				ack.Error = "No ack before the timeout"
+			case err != nil:
+				ack.Error = err.Error()
+			default:
+				ack.Acked = true
+				if len(resp) > 0 {
+					ack.Response = resp[0]
+				}
+			}
+			result.Acks[i] = ack
+		}(i, c)
+	}
+	wg.Wait()
+	s.commands.add(result)
+	return result, true
+}
+
+// CommandLog lists the most recent commands, oldest first, optionally only
+// those sent to userID or to its machineID.
+func (s *Server) CommandLog(userID, machineID string) []CommandResult {
+	s.commands.mu.Lock()
+	defer s.commands.mu.Unlock()
+	out := make([]CommandResult, 0, len(s.commands.results))
+	for _, r := range s.commands.results {
+		if (userID == "" || r.UserID == userID) && (machineID == "" || r.MachineID == machineID) {
+			out = append(out, r)
+		}
+	}
+	return out
+}
@@ -0,0 +1,151 @@
+package socketio
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// DrainStatus describes a drain started with Drain. Remaining counts the
+// connections still open.
+type DrainStatus struct {
+	Draining  bool   `json:"draining"`
+	URL       string `json:"url,omitempty"`
+	StartedAt int64  `json:"startedAt,omitempty"`
+	WindowMs  int64  `json:"windowMs,omitempty"`
+	Closed    int    `json:"closed"`
+	Remaining int    `json:"remaining"`
+}
+
+type drainState struct {
+	mu        sync.Mutex
+	active    bool
+	url       string
+	startedAt time.Time
+	window    time.Duration
+	closed    int
+	stop      chan struct{}
+}
+
+// Drain refuses new connections and moves existing ones off the server: each
+// gets a "reconnect-to" event carrying url, which may be empty to mean "this
+// address", and is then closed. Closes are spread evenly over window so
+// clients do not all reconnect at once. It reports false when a drain is
+// already running.
+func (s *Server) Drain(url string, window time.Duration) (DrainStatus, bool) {
+	s.drain.mu.Lock()
+	if s.drain.active {
+		s.drain.mu.Unlock()
+		return s.DrainStatus(), false
+	}
+	s.drain.active = true
+	s.drain.url = url
+	s.drain.startedAt = time.Now()
+	s.drain.window = window
+	s.drain.closed = 0
+	stop := make(chan struct{})
+	s.drain.stop = stop
+	s.drain.mu.Unlock()
+
+	s.mu.RLock()
+	var targets []*conn
+	var pending []*conn
+	for _, c := range s.connsBySocket {
+		if c.connected.Load() {
+			targets = append(targets, c)
+		} else {
+			pending = append(pending, c)
+		}
+	}
+	s.mu.RUnlock()
+
+	// Connections still in the handshake have no namespace to receive the
+	// redirect; their clients simply retry.
+	for _, c := range pending {
+		c.close()
+	}
+	go s.drainConns(targets, url, window, stop)
+	return s.DrainStatus(), true
+}
+
+func (s *Server) drainConns(targets []*conn, url string, window time.Duration, stop <-chan struct{}) {
+	var interval time.Duration
+	if len(targets) > 1 {
+		interval = window / time.Duration(len(targets)-1)
+	}
+	packet, err := buildSocketEventPacket("/", nil, "reconnect-to", gin.H{"url": url})
+	if err != nil {
+		return
+	}
+	for i, c := range targets {
+		if i > 0 && interval > 0 {
+			select {
+			case <-stop:
+				return
+			case <-time.After(interval):
+			}
+		}
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		if !c.connected.Load() {
+			continue
+		}
+		s.drain.mu.Lock()
+		s.drain.closed++
+		s.drain.mu.Unlock()
+
+		_ = c.enqueueText(string(engineMessage) + packet)
+		c.closeAfterFlush()
+	}
+}
+
+// CancelDrain accepts connections again and stops closing the ones left. It
+// reports false when no drain was running.
+func (s *Server) CancelDrain() bool {
+	s.drain.mu.Lock()
+	defer s.drain.mu.Unlock()
+	if !s.drain.active {
+		return false
+	}
+	close(s.drain.stop)
+	s.drain.active = false
+	s.drain.url = ""
+	s.drain.window = 0
+	return true
+}
+
+// Draining reports whether the server is refusing new connections.
+func (s *Server) Draining() bool {
+	s.drain.mu.Lock()
+	defer s.drain.mu.Unlock()
+	return s.drain.active
+}
+
+func (s *Server) DrainStatus() DrainStatus {
+	s.drain.mu.Lock()
+	st := DrainStatus{Draining: s.drain.active, Closed: s.drain.closed}
+	if s.drain.active {
+		st.URL = s.drain.url
+		st.StartedAt = s.drain.startedAt.UnixMilli()
+		st.WindowMs = s.drain.window.Milliseconds()
+	}
+	s.drain.mu.Unlock()
+	st.Remaining = s.Metrics().Connections
+	return st
+}
+
+// refuseWhileDraining answers a connect attempt during a drain and reports
+// whether it did.
+func (s *Server) refuseWhileDraining(w http.ResponseWriter) bool {
+	if !s.Draining() {
+		return false
+	}
+	w.Header().Set("Retry-After", "1")
+	http.Error(w, "Server is draining", http.StatusServiceUnavailable)
+	return true
+}
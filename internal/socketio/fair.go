@@ -0,0 +1,96 @@
+package socketio
+
+import "sync"
+
+// fairQueue runs jobs on at most workers goroutines, taking one from each
+// user with work in turn rather than in arrival order, so one user's
+// backlog only delays that user. Workers are started as work arrives and
+// exit once there is none.
+type fairQueue struct {
+	workers int
+	// serial runs each user's jobs one at a time in the order they were
+	// submitted.
+	serial bool
+	// maxPending caps the jobs running or waiting across users and
+	// maxPerUser those of one user; zero leaves either uncapped.
+	maxPending int
+	maxPerUser int
+
+	mu      sync.Mutex
+	users   map[string]*userJobs
+	turns   []string // users with a job ready to run, next first
+	pending int
+	running int // workers
+}
+
+type userJobs struct {
+	jobs   []func()
+	active int
+	inTurn bool
+}
+
+func newFairQueue(workers int, serial bool, maxPending, maxPerUser int) *fairQueue {
+	return &fairQueue{workers: workers, serial: serial, maxPending: maxPending, maxPerUser: maxPerUser, users: make(map[string]*userJobs)}
+}
+
+// submit queues job for userID, or reports false when the queue or the
+// user's share of it is full.
+func (q *fairQueue) submit(userID string, job func()) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	u := q.users[userID]
+	if u == nil {
+		u = &userJobs{}
+	}
+	if (q.maxPending > 0 && q.pending >= q.maxPending) || (q.maxPerUser > 0 && len(u.jobs)+u.active >= q.maxPerUser) {
+		return false
+	}
+	q.users[userID] = u
+	u.jobs = append(u.jobs, job)
+	q.pending++
+	q.takeTurnLocked(userID, u)
+	if len(q.turns) > 0 && q.running < q.workers {
+		q.running++
+		go q.work()
+	}
+	return true
+}
+
+// takeTurnLocked puts userID at the back of the line if it has a job that
+// may run and is not in line already.
+func (q *fairQueue) takeTurnLocked(userID string, u *userJobs) {
+	if u.inTurn || len(u.jobs) == 0 || (q.serial && u.active > 0) {
+		return
+	}
+	u.inTurn = true
+	q.turns = append(q.turns, userID)
+}
+
+func (q *fairQueue) work() {
+	q.mu.Lock()
+	for len(q.turns) > 0 {
+		userID := q.turns[0]
+		q.turns = q.turns[1:]
+		u := q.users[userID]
+		u.inTurn = false
+		job := u.jobs[0]
+		u.jobs[0] = nil
+		u.jobs = u.jobs[1:]
+		u.active++
+		q.takeTurnLocked(userID, u)
+		q.mu.Unlock()
+
+		job()
+
+		q.mu.Lock()
+		u.active--
+		q.pending--
+		if len(u.jobs) == 0 && u.active == 0 {
+			delete(q.users, userID)
+		} else {
+			q.takeTurnLocked(userID, u)
+		}
+	}
+	q.running--
+	q.mu.Unlock()
+}
@@ -0,0 +1,90 @@
+package socketio
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFairQueue_TakesUsersInTurn(t *testing.T) {
+	q := newFairQueue(1, false, 0, 0)
+	block := make(chan struct{})
+	started := make(chan struct{})
+	q.submit("busy", func() { close(started); <-block })
+	<-started
+
+	var mu sync.Mutex
+	var order []string
+	done := make(chan struct{}, 5)
+	record := func(name string) func() {
+		return func() {
+			mu.Lock()
+			order = append(order, name)
+			mu.Unlock()
+			done <- struct{}{}
+		}
+	}
+	q.submit("busy", record("busy-1"))
+	q.submit("busy", record("busy-2"))
+	q.submit("busy", record("busy-3"))
+	q.submit("quiet", record("quiet-1"))
+	q.submit("quiet", record("quiet-2"))
+	close(block)
+	for i := 0; i < 5; i++ {
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatalf("jobs did not run: %v", order)
+		}
+	}
+
+	want := []string{"busy-1", "quiet-1", "busy-2", "quiet-2", "busy-3"}
+	for i := range want {
+		if order[i] != want[i] {
+			t.Fatalf("expected %v, got %v", want, order)
+		}
+	}
+}
+
+func TestFairQueue_CapsPendingJobs(t *testing.T) {
+	q := newFairQueue(1, false, 3, 2)
+	block := make(chan struct{})
+	defer close(block)
+	wait := func() { <-block }
+
+	if !q.submit("u1", wait) || !q.submit("u1", wait) {
+		t.Fatalf("expected u1's first jobs accepted")
+	}
+	if q.submit("u1", wait) {
+		t.Fatalf("expected u1 held to its share")
+	}
+	if !q.submit("u2", wait) {
+		t.Fatalf("expected u2 accepted while u1 is full")
+	}
+	if q.submit("u3", wait) {
+		t.Fatalf("expected the queue to be full")
+	}
+}
+
+func TestFairQueue_SerialKeepsUserOrder(t *testing.T) {
+	q := newFairQueue(4, true, 0, 0)
+	var mu sync.Mutex
+	var got []int
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		i := i
+		wg.Add(1)
+		q.submit("u1", func() {
+			defer wg.Done()
+			mu.Lock()
+			got = append(got, i)
+			mu.Unlock()
+		})
+	}
+	wg.Wait()
+	for i, v := range got {
+		if v != i {
+			t.Fatalf("expected jobs in submission order, got %v", got)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package socketio
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+
+	"happy-server-lite/internal/auth"
+)
+
+// handshakeToken returns the token sent with the upgrade request, from the
+// token query parameter or an Authorization bearer header.
+func handshakeToken(r *http.Request) string {
+	if token := r.URL.Query().Get("token"); token != "" {
+		return token
+	}
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if ok && strings.EqualFold(scheme, "Bearer") {
+		return token
+	}
+	return ""
+}
+
+// authenticateUpgrade checks the handshake token before the connection is
+// upgraded, so bad credentials cost a plain HTTP response rather than a
+// socket. It returns the token's user, empty when no token was sent and
+// none is required, and false after writing a refusal.
+func (s *Server) authenticateUpgrade(w http.ResponseWriter, r *http.Request) (string, bool) {
+	token := handshakeToken(r)
+	if token == "" {
+		if s.limits.RequireHandshakeToken {
+			http.Error(w, "Missing token", http.StatusUnauthorized)
+			return "", false
+		}
+		return "", true
+	}
+	claims, err := auth.VerifyToken(auth.WithClientIP(r.Context(), remoteIP(r)), token, s.tokenConfig)
+	if errors.Is(err, auth.ErrAccountDisabled) {
+		http.Error(w, "Account disabled", http.StatusForbidden)
+		return "", false
+	}
+	if err != nil || claims == nil || claims.UserID == "" {
+		http.Error(w, "Invalid authentication token", http.StatusUnauthorized)
+		return "", false
+	}
+	return claims.UserID, true
+}
+
+// pendingConns counts, per IP, the connections that have not yet completed
+// the Socket.IO connect.
+type pendingConns struct {
+	mu    sync.Mutex
+	byIP  map[string]int
+	limit int
+}
+
+// reserve claims a pending slot for ip and returns its release func, safe
+// to call more than once, or false when ip already holds limit slots. A
+// non-positive limit never refuses.
+func (p *pendingConns) reserve(ip string) (func(), bool) {
+	if p.limit <= 0 {
+		return func() {}, true
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.byIP[ip] >= p.limit {
+		return nil, false
+	}
+	if p.byIP == nil {
+		p.byIP = make(map[string]int)
+	}
+	p.byIP[ip]++
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			p.mu.Lock()
+			defer p.mu.Unlock()
+			if p.byIP[ip]--; p.byIP[ip] <= 0 {
+				delete(p.byIP, ip)
+			}
+		})
+	}, true
+}
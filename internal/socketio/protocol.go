@@ -143,8 +143,8 @@ func buildSocketEventPacket(namespace string, id *int, event string, args ...any
 	return b.String(), nil
 }
 
-func buildSocketConnectPacket(namespace string, sid string) (string, error) {
-	data, err := json.Marshal(map[string]string{"sid": sid})
+func buildSocketConnectPacket(namespace string, sid string, updateSchema int) (string, error) {
+	data, err := json.Marshal(map[string]any{"sid": sid, "updateSchema": updateSchema})
 	if err != nil {
 		return "", err
 	}
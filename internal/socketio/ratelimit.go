@@ -0,0 +1,126 @@
+package socketio
+
+import (
+	"sync"
+	"time"
+)
+
+// EventRateLimit caps how many events of one type a single connection may
+// send per fixed window.
+type EventRateLimit struct {
+	Limit  int
+	Window time.Duration
+}
+
+// AnyEvent keys the fallback limit applied to events without their own entry.
+const AnyEvent = "*"
+
+type Limits struct {
+	EventRates map[string]EventRateLimit
+	// MaxRateViolations disconnects a connection once it has been rejected this
+	// many times within one window of a limited event. Zero never disconnects.
+	MaxRateViolations int
+	// HandshakeTimeout closes connections that have not completed the
+	// Socket.IO connect within this long of opening. Zero never times out.
+	HandshakeTimeout time.Duration
+	// SessionStallTimeout marks a session inactive and emits session-stalled
+	// when its connected daemon stops sending session-alive for this long.
+	// Zero disables the check.
+	SessionStallTimeout time.Duration
+	// RPCWorkers bounds how many rpc-calls are relayed concurrently and
+	// RPCQueueDepth how many may wait for a worker before callers get
+	// "Server busy". Waiting calls take workers user by user, and no user
+	// may hold more than half the queue. Zero picks the default.
+	RPCWorkers    int
+	RPCQueueDepth int
+	// RequireHandshakeToken refuses upgrades without a valid token in the
+	// token query parameter or an Authorization bearer header. Otherwise a
+	// token sent there is still checked before upgrading, but clients may
+	// authenticate in the connect packet alone.
+	RequireHandshakeToken bool
+	// MaxPendingPerIP caps the connections from one IP that have not yet
+	// completed the Socket.IO connect. Zero leaves them uncapped.
+	MaxPendingPerIP int
+}
+
+const (
+	defaultRPCWorkers    = 32
+	defaultRPCQueueDepth = 256
+	// fanoutWorkers bounds how many users' updates are fanned out to their
+	// rooms at once.
+	fanoutWorkers = 8
+	// fanoutQueuePerUser caps one user's broadcasts waiting to be fanned
+	// out. An update that does not fit closes the connections it was for,
+	// as a full send queue does, so they resync rather than miss it.
+	fanoutQueuePerUser = sendQueueSize
+)
+
+func DefaultLimits() Limits {
+	return Limits{
+		EventRates: map[string]EventRateLimit{
+			"message":                 {Limit: 60, Window: time.Second},
+			"update-metadata":         {Limit: 30, Window: time.Second},
+			"update-state":            {Limit: 30, Window: time.Second},
+			"machine-update-metadata": {Limit: 30, Window: time.Second},
+			"machine-update-state":    {Limit: 30, Window: time.Second},
+			"machine-event":           {Limit: 30, Window: time.Second},
+		},
+		MaxRateViolations: 100,
+		HandshakeTimeout:  10 * time.Second,
+
+		SessionStallTimeout: 5 * time.Minute,
+
+		MaxPendingPerIP: 16,
+	}
+}
+
+type eventWindow struct {
+	count      int
+	violations int
+	resetAt    time.Time
+}
+
+type eventLimiter struct {
+	mu      sync.Mutex
+	limits  map[string]EventRateLimit
+	windows map[string]*eventWindow
+}
+
+func newEventLimiter(limits map[string]EventRateLimit) *eventLimiter {
+	return &eventLimiter{limits: limits, windows: make(map[string]*eventWindow)}
+}
+
+func (l *eventLimiter) limitFor(event string) (EventRateLimit, bool) {
+	if lim, ok := l.limits[event]; ok {
+		return lim, lim.Limit > 0 && lim.Window > 0
+	}
+	lim, ok := l.limits[AnyEvent]
+	return lim, ok && lim.Limit > 0 && lim.Window > 0
+}
+
+// allow reports whether event may be handled now, and how many times it has
+// already been rejected in the current window.
+func (l *eventLimiter) allow(event string, now time.Time) (bool, int) {
+	if l == nil {
+		return true, 0
+	}
+	lim, ok := l.limitFor(event)
+	if !ok {
+		return true, 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	w, exists := l.windows[event]
+	if !exists || now.After(w.resetAt) {
+		l.windows[event] = &eventWindow{count: 1, resetAt: now.Add(lim.Window)}
+		return true, 0
+	}
+	if w.count >= lim.Limit {
+		w.violations++
+		return false, w.violations
+	}
+	w.count++
+	return true, 0
+}
@@ -0,0 +1,45 @@
+package socketio
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEventLimiter_PerEventWindows(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	l := newEventLimiter(map[string]EventRateLimit{
+		"message": {Limit: 2, Window: time.Second},
+		AnyEvent:  {Limit: 1, Window: time.Second},
+		"ping":    {Limit: 0, Window: time.Second},
+	})
+
+	for i := 0; i < 2; i++ {
+		if ok, _ := l.allow("message", now); !ok {
+			t.Fatalf("expected message %d allowed", i)
+		}
+	}
+	if ok, violations := l.allow("message", now); ok || violations != 1 {
+		t.Fatalf("expected first violation, got ok=%v violations=%d", ok, violations)
+	}
+	if ok, violations := l.allow("message", now); ok || violations != 2 {
+		t.Fatalf("expected second violation, got ok=%v violations=%d", ok, violations)
+	}
+
+	if ok, _ := l.allow("update-state", now); !ok {
+		t.Fatalf("expected wildcard limit to allow first event")
+	}
+	if ok, _ := l.allow("update-state", now); ok {
+		t.Fatalf("expected wildcard limit to reject second event")
+	}
+
+	for i := 0; i < 5; i++ {
+		if ok, _ := l.allow("ping", now); !ok {
+			t.Fatalf("expected zero limit to mean unlimited")
+		}
+	}
+
+	later := now.Add(time.Second + time.Millisecond)
+	if ok, _ := l.allow("message", later); !ok {
+		t.Fatalf("expected allow after window reset")
+	}
+}
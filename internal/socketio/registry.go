@@ -0,0 +1,177 @@
+package socketio
+
+import (
+	"encoding/json"
+	"strings"
+	"sync/atomic"
+)
+
+// eventHandler handles one client event that every middleware on its route
+// let through.
+type eventHandler func(c *conn, pkt socketEventPacket)
+
+// eventMiddleware wraps the handler of one route with a check or side effect,
+// calling next to continue or returning to drop the event.
+type eventMiddleware func(route *eventRoute, next eventHandler) eventHandler
+
+// EventMetrics counts the client events of one name the server received and
+// how many of those a rate limit or scope check dropped.
+type EventMetrics struct {
+	Received int64 `json:"received"`
+	Rejected int64 `json:"rejected"`
+}
+
+type eventRoute struct {
+	name     string
+	handle   eventHandler
+	received atomic.Int64
+	rejected atomic.Int64
+}
+
+// eventRegistry maps client event names to their handlers. Events without a
+// route go to a no-op route named AnyEvent, so they still pass through the
+// common middleware.
+type eventRegistry struct {
+	common   []eventMiddleware
+	routes   map[string]*eventRoute
+	fallback *eventRoute
+}
+
+// newEventRegistry returns a registry whose routes all run common, outermost
+// first, ahead of their own middleware.
+func newEventRegistry(common ...eventMiddleware) *eventRegistry {
+	r := &eventRegistry{common: common, routes: make(map[string]*eventRoute)}
+	r.fallback = r.build(AnyEvent, func(*conn, socketEventPacket) {})
+	return r
+}
+
+// on routes event to h behind mw, applied outermost first.
+func (r *eventRegistry) on(event string, h eventHandler, mw ...eventMiddleware) {
+	r.routes[event] = r.build(event, h, mw...)
+}
+
+func (r *eventRegistry) build(name string, h eventHandler, mw ...eventMiddleware) *eventRoute {
+	route := &eventRoute{name: name}
+	chain := append(append([]eventMiddleware{}, r.common...), mw...)
+	for i := len(chain) - 1; i >= 0; i-- {
+		h = chain[i](route, h)
+	}
+	route.handle = h
+	return route
+}
+
+// only returns a registry serving just events, sharing this one's routes and
+// so their metrics. Other events go to the fallback.
+func (r *eventRegistry) only(events ...string) *eventRegistry {
+	sub := &eventRegistry{common: r.common, routes: make(map[string]*eventRoute, len(events)), fallback: r.fallback}
+	for _, event := range events {
+		if route, ok := r.routes[event]; ok {
+			sub.routes[event] = route
+		}
+	}
+	return sub
+}
+
+func (r *eventRegistry) dispatch(c *conn, pkt socketEventPacket) {
+	route, ok := r.routes[pkt.Event]
+	if !ok {
+		route = r.fallback
+	}
+	route.handle(c, pkt)
+}
+
+// metrics reports every route that has received at least one event.
+func (r *eventRegistry) metrics() map[string]EventMetrics {
+	out := make(map[string]EventMetrics)
+	routes := append(make([]*eventRoute, 0, len(r.routes)+1), r.fallback)
+	for _, route := range r.routes {
+		routes = append(routes, route)
+	}
+	for _, route := range routes {
+		if received := route.received.Load(); received > 0 {
+			out[route.name] = EventMetrics{Received: received, Rejected: route.rejected.Load()}
+		}
+	}
+	return out
+}
+
+// countEvents records every event a route receives, on the route and on the
+// sending connection.
+func countEvents(route *eventRoute, next eventHandler) eventHandler {
+	return func(c *conn, pkt socketEventPacket) {
+		route.received.Add(1)
+		c.stats.recordEvent(pkt.Event)
+		next(c, pkt)
+	}
+}
+
+// requireAck drops events sent without an ack id, for handlers whose only
+// reply is the ack.
+func requireAck(_ *eventRoute, next eventHandler) eventHandler {
+	return func(c *conn, pkt socketEventPacket) {
+		if pkt.ID == nil {
+			return
+		}
+		next(c, pkt)
+	}
+}
+
+// scoped drops events from connections whose client type is not one of
+// clientTypes.
+func scoped(clientTypes ...string) eventMiddleware {
+	return func(route *eventRoute, next eventHandler) eventHandler {
+		return func(c *conn, pkt socketEventPacket) {
+			for _, t := range clientTypes {
+				if c.clientType == t {
+					next(c, pkt)
+					return
+				}
+			}
+			route.rejected.Add(1)
+		}
+	}
+}
+
+// withinTokenScope drops events from connections with a scoped token when
+// they name a session, machine or RPC method outside that scope. RPC methods
+// are prefixed with the id of the session or machine serving them.
+func withinTokenScope(route *eventRoute, next eventHandler) eventHandler {
+	return func(c *conn, pkt socketEventPacket) {
+		if c.tokenScope.IsZero() || len(pkt.Args) == 0 {
+			next(c, pkt)
+			return
+		}
+		var body struct {
+			SID       string `json:"sid"`
+			MachineID string `json:"machineId"`
+			Method    string `json:"method"`
+		}
+		_ = json.Unmarshal(pkt.Args[0], &body)
+		scope := c.tokenScope
+		var inScope bool
+		var scopeID string
+		if scope.SessionID != "" {
+			scopeID = scope.SessionID
+			inScope = body.MachineID == "" && (body.SID == "" || body.SID == scopeID)
+		} else {
+			scopeID = scope.MachineID
+			inScope = body.SID == "" && (body.MachineID == "" || body.MachineID == scopeID)
+		}
+		if !inScope || (body.Method != "" && !strings.HasPrefix(body.Method, scopeID+":")) {
+			route.rejected.Add(1)
+			return
+		}
+		next(c, pkt)
+	}
+}
+
+// rateLimited applies the connection's event rate limits.
+func (s *Server) rateLimited(route *eventRoute, next eventHandler) eventHandler {
+	return func(c *conn, pkt socketEventPacket) {
+		if !s.allowEvent(c, pkt) {
+			route.rejected.Add(1)
+			return
+		}
+		next(c, pkt)
+	}
+}
@@ -0,0 +1,124 @@
+package socketio
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"happy-server-lite/internal/auth"
+)
+
+func TestEventRegistry_RunsMiddlewareInOrder(t *testing.T) {
+	var calls []string
+	trace := func(name string) eventMiddleware {
+		return func(_ *eventRoute, next eventHandler) eventHandler {
+			return func(c *conn, pkt socketEventPacket) {
+				calls = append(calls, name)
+				next(c, pkt)
+			}
+		}
+	}
+
+	r := newEventRegistry(countEvents, trace("common"))
+	r.on("message", func(*conn, socketEventPacket) { calls = append(calls, "handler") }, trace("route"))
+
+	r.dispatch(&conn{}, socketEventPacket{Event: "message"})
+	if want := []string{"common", "route", "handler"}; !reflect.DeepEqual(calls, want) {
+		t.Fatalf("expected %v, got %v", want, calls)
+	}
+
+	calls = nil
+	r.dispatch(&conn{}, socketEventPacket{Event: "unknown"})
+	if want := []string{"common"}; !reflect.DeepEqual(calls, want) {
+		t.Fatalf("expected unknown events to run common middleware only, got %v", calls)
+	}
+
+	got := r.metrics()
+	want := map[string]EventMetrics{"message": {Received: 1}, AnyEvent: {Received: 1}}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected metrics %v, got %v", want, got)
+	}
+}
+
+func TestEventRegistry_ScopedRejectsOtherClientTypes(t *testing.T) {
+	handled := 0
+	r := newEventRegistry(countEvents)
+	r.on("machine-alive", func(*conn, socketEventPacket) { handled++ }, scoped("machine-scoped"))
+
+	r.dispatch(&conn{clientType: "user-scoped"}, socketEventPacket{Event: "machine-alive"})
+	r.dispatch(&conn{clientType: "machine-scoped"}, socketEventPacket{Event: "machine-alive"})
+
+	if handled != 1 {
+		t.Fatalf("expected only the machine-scoped event handled, got %d", handled)
+	}
+	if got := r.metrics()["machine-alive"]; got != (EventMetrics{Received: 2, Rejected: 1}) {
+		t.Fatalf("unexpected metrics: %+v", got)
+	}
+}
+
+func TestEventRegistry_WithinTokenScopeDropsOtherResources(t *testing.T) {
+	var handled []string
+	r := newEventRegistry(countEvents, withinTokenScope)
+	r.on("message", func(_ *conn, pkt socketEventPacket) { handled = append(handled, string(pkt.Args[0])) })
+
+	session := &conn{tokenScope: auth.Scope{SessionID: "s1"}}
+	machine := &conn{tokenScope: auth.Scope{MachineID: "m1"}}
+	for _, tc := range []struct {
+		c    *conn
+		body string
+	}{
+		{session, `{"sid":"s1"}`},
+		{session, `{"sid":"s2"}`},
+		{session, `{"machineId":"m1"}`},
+		{session, `{"method":"s1:bash"}`},
+		{session, `{"method":"s2:bash"}`},
+		{machine, `{"machineId":"m1"}`},
+		{machine, `{"machineId":"m2"}`},
+		{machine, `{"sid":"s1"}`},
+		{&conn{}, `{"sid":"s2"}`},
+	} {
+		r.dispatch(tc.c, socketEventPacket{Event: "message", Args: []json.RawMessage{json.RawMessage(tc.body)}})
+	}
+
+	want := []string{`{"sid":"s1"}`, `{"method":"s1:bash"}`, `{"machineId":"m1"}`, `{"sid":"s2"}`}
+	if !reflect.DeepEqual(handled, want) {
+		t.Fatalf("expected %v handled, got %v", want, handled)
+	}
+	if got := r.metrics()["message"]; got != (EventMetrics{Received: 9, Rejected: 5}) {
+		t.Fatalf("unexpected metrics: %+v", got)
+	}
+}
+
+func TestEventRegistry_RequireAckDropsEventsWithoutID(t *testing.T) {
+	handled := 0
+	r := newEventRegistry()
+	r.on("update-state", func(*conn, socketEventPacket) { handled++ }, requireAck)
+
+	id := 1
+	r.dispatch(&conn{}, socketEventPacket{Event: "update-state"})
+	r.dispatch(&conn{}, socketEventPacket{Event: "update-state", ID: &id})
+
+	if handled != 1 {
+		t.Fatalf("expected only the acked event handled, got %d", handled)
+	}
+}
+
+func TestEventRegistry_OnlyServesListedEvents(t *testing.T) {
+	var handled []string
+	r := newEventRegistry(countEvents)
+	for _, event := range []string{"machine-alive", "secret"} {
+		event := event
+		r.on(event, func(*conn, socketEventPacket) { handled = append(handled, event) })
+	}
+	sub := r.only("machine-alive", "missing")
+
+	sub.dispatch(&conn{}, socketEventPacket{Event: "machine-alive"})
+	sub.dispatch(&conn{}, socketEventPacket{Event: "secret"})
+	if want := []string{"machine-alive"}; !reflect.DeepEqual(handled, want) {
+		t.Fatalf("expected %v, got %v", want, handled)
+	}
+	want := map[string]EventMetrics{"machine-alive": {Received: 1}, AnyEvent: {Received: 1}}
+	if got := r.metrics(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected shared metrics %v, got %v", want, got)
+	}
+}
@@ -0,0 +1,37 @@
+package socketio
+
+import "happy-server-lite/internal/events"
+
+// UpdateSchemaVersion is the shape of the "update" and "ephemeral" bodies this
+// server emits, as defined by package events.
+const (
+	UpdateSchemaVersion    = events.SchemaVersion
+	MinUpdateSchemaVersion = events.MinSchemaVersion
+)
+
+// negotiateUpdateSchema picks the version used for a connection from the one
+// the client declared. Clients that predate negotiation declare nothing and
+// get the oldest supported shape.
+func negotiateUpdateSchema(declared int) (int, bool) {
+	switch {
+	case declared == 0:
+		return MinUpdateSchemaVersion, true
+	case declared < MinUpdateSchemaVersion:
+		return 0, false
+	case declared > UpdateSchemaVersion:
+		return UpdateSchemaVersion, true
+	default:
+		return declared, true
+	}
+}
+
+func buildUpdatePacket(update events.Update) (string, error) {
+	update.V = UpdateSchemaVersion
+	return buildSocketEventPacket("/", nil, "update", update)
+}
+
+// buildEphemeralPacket sends one of the ephemeral bodies in package events,
+// which carry their own schema version.
+func buildEphemeralPacket(payload any) (string, error) {
+	return buildSocketEventPacket("/", nil, "ephemeral", payload)
+}
@@ -0,0 +1,22 @@
+package socketio
+
+import "testing"
+
+func TestNegotiateUpdateSchema(t *testing.T) {
+	cases := []struct {
+		declared int
+		want     int
+		ok       bool
+	}{
+		{declared: 0, want: MinUpdateSchemaVersion, ok: true},
+		{declared: UpdateSchemaVersion, want: UpdateSchemaVersion, ok: true},
+		{declared: UpdateSchemaVersion + 5, want: UpdateSchemaVersion, ok: true},
+		{declared: -1, ok: false},
+	}
+	for _, tc := range cases {
+		got, ok := negotiateUpdateSchema(tc.declared)
+		if ok != tc.ok || got != tc.want {
+			t.Fatalf("declared %d: expected (%d, %v), got (%d, %v)", tc.declared, tc.want, tc.ok, got, ok)
+		}
+	}
+}
@@ -1,9 +1,12 @@
 package socketio
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
+	"net"
 	"net/http"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -11,7 +14,13 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
+	"happy-server-lite/internal/apierror"
 	"happy-server-lite/internal/auth"
+	"happy-server-lite/internal/clock"
+	"happy-server-lite/internal/debugtap"
+	"happy-server-lite/internal/events"
+	"happy-server-lite/internal/ids"
+	"happy-server-lite/internal/model"
 	"happy-server-lite/internal/store"
 )
 
@@ -24,54 +33,243 @@ const (
 	pingInterval time.Duration = 15 * time.Second
 	pingTimeout  time.Duration = 45 * time.Second
 	rpcTimeout   time.Duration = 30 * time.Second
+
+	// closeSentinel is queued behind pending writes to close a connection only
+	// after they have been flushed. Engine.IO never sends empty frames.
+	closeSentinel = ""
 )
 
 type Deps struct {
-	Store       *store.Store
+	Store       store.Storage
 	TokenConfig auth.TokenConfig
+	Limits      Limits
+	Tap         *debugtap.Tap
+	// NewID generates update ids; nil picks random UUIDs.
+	NewID ids.Generator
+	// Clock stamps updates and store changes; nil reads the wall clock.
+	// Socket deadlines and pings always use the wall clock.
+	Clock clock.Clock
+	// StartedAt, when set, is sent in a server-restarted ephemeral to each
+	// user's room when the user's first user-scoped connection after it
+	// connects.
+	StartedAt int64
+	// RequireMachineCert refuses machine-scoped connections that came
+	// without a verified client certificate (see middleware.MachineCert).
+	RequireMachineCert bool
 }
 
 type Server struct {
-	store       *store.Store
+	store       store.Storage
 	tokenConfig auth.TokenConfig
+	tap         *debugtap.Tap
+	limits      Limits
 
 	upgrader websocket.Upgrader
 
+	newID     ids.Generator
+	clock     clock.Clock
 	updateSeq int64
-
-	mu            sync.RWMutex
-	roomUsers     map[string]map[*conn]struct{}
-	roomSessions  map[string]map[*conn]struct{}
-	roomMachines  map[string]map[*conn]struct{}
-	rpcByMethod   map[string]*conn
+	publishMu sync.Mutex
+
+	traffic    trafficCounters
+	broadcasts broadcastCounters
+
+	// RPC relays run off the caller's read loop, and updates are fanned
+	// out to rooms off the publisher's, each user taking turns with the
+	// others so a busy one cannot hold them up. A user's fan-outs run in
+	// order.
+	rpc    *fairQueue
+	fanout *fairQueue
+
+	mu           sync.RWMutex
+	roomUsers    map[string]map[*conn]struct{}
+	roomSessions map[string]map[*conn]struct{}
+	roomMachines map[string]map[*conn]struct{}
+	// rpcByUser maps each user to the connections serving their RPC
+	// methods. Method names embed daemon-chosen machine ids, so they are
+	// only unique within one user.
+	rpcByUser     map[string]map[string]*conn
 	connsBySocket map[*websocket.Conn]*conn
+	// sessionWriters holds the single session-scoped connection allowed to
+	// append to each session.
+	sessionWriters map[string]*conn
+
+	handlers *eventRegistry
+	drain    drainState
+	pending  pendingConns
+	commands commandLog
+
+	// daemonHandlers is the subset of handlers served on the daemon
+	// endpoint.
+	daemonHandlers *eventRegistry
+
+	// startedAt and restartNoticed, guarded by mu, track which users were
+	// told of the restart.
+	startedAt      int64
+	restartNoticed map[string]bool
+
+	requireMachineCert bool
 }
 
 func NewServer(deps Deps) *Server {
-	return &Server{
+	s := &Server{
 		store:       deps.Store,
 		tokenConfig: deps.TokenConfig,
+		tap:         deps.Tap,
+		limits:      deps.Limits,
 		upgrader: websocket.Upgrader{
 			CheckOrigin: func(r *http.Request) bool { return true },
 		},
-		roomUsers:     make(map[string]map[*conn]struct{}),
-		roomSessions:  make(map[string]map[*conn]struct{}),
-		roomMachines:  make(map[string]map[*conn]struct{}),
-		rpcByMethod:   make(map[string]*conn),
-		connsBySocket: make(map[*websocket.Conn]*conn),
+		roomUsers:      make(map[string]map[*conn]struct{}),
+		roomSessions:   make(map[string]map[*conn]struct{}),
+		roomMachines:   make(map[string]map[*conn]struct{}),
+		rpcByUser:      make(map[string]map[string]*conn),
+		connsBySocket:  make(map[*websocket.Conn]*conn),
+		sessionWriters: make(map[string]*conn),
+		pending:        pendingConns{limit: deps.Limits.MaxPendingPerIP},
+		newID:          deps.NewID,
+		clock:          deps.Clock,
+		startedAt:      deps.StartedAt,
+		restartNoticed: make(map[string]bool),
+
+		requireMachineCert: deps.RequireMachineCert,
+	}
+	if s.newID == nil {
+		s.newID = ids.UUID
+	}
+	s.registerEvents()
+	if s.store != nil {
+		s.store.SubscribeTypes(s.handleStoreEvent,
+			store.EventMessageAppended, store.EventMessageUpdated, store.EventMessageDeleted, store.EventMessageAnnotated,
+			store.EventSessionLocked, store.EventSessionUnlocked,
+			store.EventSessionDeleted, store.EventMachineDeleted, store.EventAuthRequested)
+	}
+
+	workers, depth := s.limits.RPCWorkers, s.limits.RPCQueueDepth
+	if workers <= 0 {
+		workers = defaultRPCWorkers
+	}
+	if depth <= 0 {
+		depth = defaultRPCQueueDepth
+	}
+	s.rpc = newFairQueue(workers, false, workers+depth, workers+(depth+1)/2)
+	s.fanout = newFairQueue(fanoutWorkers, true, 0, fanoutQueuePerUser)
+	return s
+}
+
+// relayRPC runs job for userID on a relay worker, or reports false when
+// the queue, or the user's half of it, is full.
+func (s *Server) relayRPC(userID string, job func()) bool {
+	return s.rpc.submit(userID, job)
+}
+
+// handleStoreEvent fans out changes made through other APIs. Socket events
+// publish their own updates so they can honour echo suppression.
+func (s *Server) handleStoreEvent(ev store.Event) {
+	switch ev.Type {
+	case store.EventMessageAppended:
+		if ev.Origin == store.OriginSocketIO {
+			return
+		}
+		s.publishUpdate(ev.UserID, ev.At, events.NewMessage(ev.SessionID, events.MessageFrom(*ev.Message)), nil, roomTarget{s.roomSessions, ev.SessionID}, roomTarget{s.roomUsers, ev.UserID})
+	case store.EventMessageUpdated, store.EventMessageDeleted:
+		if ev.Origin == store.OriginSocketIO {
+			return
+		}
+		s.publishUpdate(ev.UserID, ev.At, messageEditBody(ev.Type, ev.SessionID, *ev.Message), nil, roomTarget{s.roomSessions, ev.SessionID}, roomTarget{s.roomUsers, ev.UserID})
+	case store.EventMessageAnnotated:
+		if ev.Origin == store.OriginSocketIO {
+			return
+		}
+		s.publishUpdate(ev.UserID, ev.At, events.MessageAnnotated(ev.SessionID, events.MessageFrom(*ev.Message)), nil, roomTarget{s.roomSessions, ev.SessionID}, roomTarget{s.roomUsers, ev.UserID})
+	case store.EventSessionLocked, store.EventSessionUnlocked:
+		s.sessionLockChanged(ev.UserID, *ev.Lock, ev.Type == store.EventSessionLocked)
+	case store.EventSessionDeleted:
+		s.sessionDeleted(ev.UserID, ev.SessionID)
+	case store.EventMachineDeleted:
+		s.machineDeleted(ev.UserID, ev.MachineID)
+	case store.EventAuthRequested:
+		s.authRequested(ev.PublicKey)
+	}
+}
+
+// sessionLockChanged tells the session's clients about a lock taken,
+// renewed or released through any API; the ephemeral has nothing to echo
+// back, so socket events do not send their own.
+func (s *Server) sessionLockChanged(userID string, lock model.SessionLock, held bool) {
+	ephemeral, err := buildEphemeralPacket(events.SessionLockChanged(lock, held))
+	if err != nil {
+		return
+	}
+	s.publishEphemeral(userID, ephemeral, roomTarget{s.roomUsers, userID}, roomTarget{s.roomSessions, lock.SessionID})
+}
+
+// authRequested tells the clients of the account owning publicKey, if there
+// is one, that a new device asked to sign in with it.
+func (s *Server) authRequested(publicKey string) {
+	ctx := context.Background()
+	account, ok := s.store.GetAccount(ctx, publicKey)
+	if !ok {
+		return
+	}
+	req, ok := s.store.GetAuthRequest(ctx, publicKey)
+	if !ok {
+		return
+	}
+	if pkt, err := buildSocketEventPacket("/", nil, events.EventAuthRequest, events.AuthRequested(req)); err == nil {
+		s.publishEphemeral(account.ID, pkt, roomTarget{s.roomUsers, account.ID})
 	}
 }
 
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.serve(w, r, false)
+}
+
+// DaemonHandler serves the machine daemon endpoint. Its connections may
+// only be machine- or session-scoped, so they never join a user's room, and
+// only send the machine, session and RPC events in daemonEvents.
+func (s *Server) DaemonHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.serve(w, r, true)
+	})
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request, daemon bool) {
+	if s.refuseWhileDraining(w) {
+		return
+	}
+	handshakeUserID, ok := s.authenticateUpgrade(w, r)
+	if !ok {
+		return
+	}
+	ip := remoteIP(r)
+	releasePending, ok := s.pending.reserve(ip)
+	if !ok {
+		http.Error(w, "Too many pending connections", http.StatusTooManyRequests)
+		return
+	}
+	defer releasePending()
 	ws, err := s.upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		return
 	}
 	ws.SetReadLimit(maxPayload)
 
-	c := newConn(ws)
+	c := newConn(auth.WithClientIP(r.Context(), ip), ws)
+	c.remoteIP = ip
+	c.handshakeUserID = handshakeUserID
+	c.releasePending = releasePending
+	c.daemon = daemon
+	c.tap = s.tap
+	c.stats.totals = &s.traffic
+	c.limiter = newEventLimiter(s.limits.EventRates)
 	s.registerConn(c)
 	defer s.unregisterConn(c)
+	// A drain that began after the check above has already taken its
+	// snapshot of connections and would miss this one.
+	if s.Draining() {
+		return
+	}
 	go c.writeLoop()
 
 	open := map[string]any{
@@ -84,7 +282,20 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	openBytes, _ := json.Marshal(open)
 	_ = c.enqueueText(string(engineOpen) + string(openBytes))
 
+	if s.limits.HandshakeTimeout > 0 {
+		handshake := time.AfterFunc(s.limits.HandshakeTimeout, func() {
+			if !c.connected.Load() {
+				_ = c.writeSocketError(apierror.CodeUnauthorized, "Handshake timeout")
+				c.closeAfterFlush()
+			}
+		})
+		defer handshake.Stop()
+	}
+
 	go c.pingLoop()
+	if s.limits.SessionStallTimeout > 0 {
+		go s.stallLoop(c)
+	}
 	c.readLoop(func(msg string) {
 		s.handleMessage(c, msg)
 	})
@@ -104,6 +315,10 @@ func (s *Server) unregisterConn(c *conn) {
 
 	s.mu.Lock()
 	delete(s.connsBySocket, c.ws)
+	wasWriter := sessionID != "" && s.sessionWriters[sessionID] == c
+	if wasWriter {
+		delete(s.sessionWriters, sessionID)
+	}
 	if userID != "" {
 		if clientType == "user-scoped" {
 			s.leaveRoom(s.roomUsers, userID, c)
@@ -112,29 +327,32 @@ func (s *Server) unregisterConn(c *conn) {
 			s.leaveRoom(s.roomSessions, sessionID, c)
 		}
 		if machineID != "" {
-			s.leaveRoom(s.roomMachines, machineID, c)
+			s.leaveRoom(s.roomMachines, machineRoom(userID, machineID), c)
 		}
 	}
-	for method, owner := range s.rpcByMethod {
+	methods := s.rpcByUser[userID]
+	for method, owner := range methods {
 		if owner == c {
-			delete(s.rpcByMethod, method)
+			delete(methods, method)
 		}
 	}
+	if len(methods) == 0 {
+		delete(s.rpcByUser, userID)
+	}
 	s.mu.Unlock()
 
-	now := time.Now().UnixMilli()
+	now := s.nowMillis()
 	if userID != "" {
 		if clientType == "machine-scoped" && machineID != "" {
-			pkt, err := buildSocketEventPacket("/", nil, "ephemeral", gin.H{"type": "machine-activity", "id": machineID, "active": false, "activeAt": now})
+			pkt, err := buildEphemeralPacket(events.MachineActive(machineID, false, now))
 			if err == nil {
-				s.broadcastToRoom(s.roomUsers, userID, pkt)
+				s.publishEphemeral(userID, pkt, roomTarget{s.roomUsers, userID})
 			}
 		}
-		if clientType == "session-scoped" && sessionID != "" {
-			pkt, err := buildSocketEventPacket("/", nil, "ephemeral", gin.H{"type": "activity", "id": sessionID, "active": false, "activeAt": now, "thinking": false})
+		if clientType == "session-scoped" && wasWriter {
+			pkt, err := buildEphemeralPacket(events.SessionActivity(sessionID, false, now, false))
 			if err == nil {
-				s.broadcastToRoom(s.roomUsers, userID, pkt)
-				s.broadcastToRoom(s.roomSessions, sessionID, pkt)
+				s.publishEphemeral(userID, pkt, roomTarget{s.roomUsers, userID}, roomTarget{s.roomSessions, sessionID})
 			}
 		}
 	}
@@ -166,6 +384,12 @@ func (s *Server) leaveRoom(rooms map[string]map[*conn]struct{}, key string, c *c
 }
 
 func (s *Server) broadcastToRoom(rooms map[string]map[*conn]struct{}, key string, payload string) {
+	s.broadcastToRoomExcept(rooms, key, payload, nil)
+}
+
+// broadcastToRoomExcept is broadcastToRoom skipping one connection, typically
+// the emitter of the change.
+func (s *Server) broadcastToRoomExcept(rooms map[string]map[*conn]struct{}, key string, payload string, except *conn) {
 	if key == "" {
 		return
 	}
@@ -178,7 +402,9 @@ func (s *Server) broadcastToRoom(rooms map[string]map[*conn]struct{}, key string
 	}
 	conns := make([]*conn, 0, len(set))
 	for c := range set {
-		conns = append(conns, c)
+		if c != except {
+			conns = append(conns, c)
+		}
 	}
 	s.mu.RUnlock()
 
@@ -193,11 +419,17 @@ func (s *Server) handleMessage(c *conn, msg string) {
 	if msg == "" {
 		return
 	}
+	c.stats.recordIn(len(msg))
+	c.recordFrame(debugtap.KindSocketIn, msg)
 
 	switch enginePacketType(msg[0]) {
 	case enginePong:
 		c.markPong()
 		return
+	case enginePing:
+		// Clients may probe with their own pings; echo the payload back.
+		_ = c.enqueueText(string(enginePong) + msg[1:])
+		return
 	case engineMessage:
 		s.handleSocketPayload(c, msg[1:])
 		return
@@ -214,6 +446,14 @@ type connectAuth struct {
 	ClientType string `json:"clientType"`
 	SessionID  string `json:"sessionId"`
 	MachineID  string `json:"machineId"`
+	// Takeover lets a session-scoped client replace the connection currently
+	// attached to the session instead of being rejected.
+	Takeover bool `json:"takeover"`
+	// SuppressEcho stops the server from sending a client the updates caused
+	// by its own events.
+	SuppressEcho bool `json:"suppressEcho"`
+	// UpdateSchema is the newest update body version the client understands.
+	UpdateSchema int `json:"updateSchema"`
 }
 
 func (s *Server) handleSocketPayload(c *conn, payload string) {
@@ -247,84 +487,160 @@ func (s *Server) handleConnect(c *conn, payload string) {
 
 	ns, rest := parseOptionalNamespace(payload[1:])
 	if rest == "" {
-		_ = c.writeSocketError("Missing auth")
+		_ = c.writeSocketError(apierror.CodeInvalidRequest, "Missing auth")
 		c.close()
 		return
 	}
 
 	var authObj connectAuth
 	if err := json.Unmarshal([]byte(rest), &authObj); err != nil {
-		_ = c.writeSocketError("Invalid auth")
+		_ = c.writeSocketError(apierror.CodeInvalidRequest, "Invalid auth")
 		c.close()
 		return
 	}
 	if authObj.Token == "" {
-		_ = c.writeSocketError("Missing token")
+		_ = c.writeSocketError(apierror.CodeUnauthorized, "Missing token")
+		c.close()
+		return
+	}
+	claims, err := auth.VerifyToken(c.ctx, authObj.Token, s.tokenConfig)
+	if errors.Is(err, auth.ErrAccountDisabled) {
+		_ = c.writeSocketError(apierror.CodeForbidden, "Account disabled")
 		c.close()
 		return
 	}
-	claims, err := auth.VerifyToken(authObj.Token, s.tokenConfig)
 	if err != nil || claims == nil || claims.UserID == "" {
-		_ = c.writeSocketError("Invalid authentication token")
+		_ = c.writeSocketError(apierror.CodeUnauthorized, "Invalid authentication token")
+		c.close()
+		return
+	}
+	if c.handshakeUserID != "" && claims.UserID != c.handshakeUserID {
+		_ = c.writeSocketError(apierror.CodeUnauthorized, "Token does not match handshake")
 		c.close()
 		return
 	}
 
 	if authObj.ClientType != "user-scoped" && authObj.ClientType != "session-scoped" && authObj.ClientType != "machine-scoped" {
-		_ = c.writeSocketError("Invalid client type")
+		_ = c.writeSocketError(apierror.CodeInvalidRequest, "Invalid client type")
+		c.close()
+		return
+	}
+	if c.daemon && authObj.ClientType == "user-scoped" {
+		_ = c.writeSocketError(apierror.CodeForbidden, "User-scoped connections are not allowed on the daemon endpoint")
+		c.close()
+		return
+	}
+
+	// A scoped token only connects as the session or machine it names.
+	if scope := claims.TokenScope(); !scope.IsZero() {
+		if (scope.SessionID != "" && (authObj.ClientType != "session-scoped" || authObj.SessionID != scope.SessionID)) ||
+			(scope.MachineID != "" && (authObj.ClientType != "machine-scoped" || authObj.MachineID != scope.MachineID)) {
+			_ = c.writeSocketError(apierror.CodeForbidden, "Token is scoped to another resource")
+			c.close()
+			return
+		}
+	}
+
+	updateSchema, ok := negotiateUpdateSchema(authObj.UpdateSchema)
+	if !ok {
+		_ = c.writeSocketError(apierror.CodeInvalidRequest, "Unsupported update schema")
 		c.close()
 		return
 	}
 
 	if authObj.ClientType == "session-scoped" {
 		if authObj.SessionID == "" {
-			_ = c.writeSocketError("Missing sessionId")
+			_ = c.writeSocketError(apierror.CodeInvalidRequest, "Missing sessionId")
 			c.close()
 			return
 		}
-		if _, ok := s.store.GetSession(claims.UserID, authObj.SessionID); !ok {
-			_ = c.writeSocketError("Session not found")
+		if _, ok := s.store.GetSession(c.ctx, claims.UserID, authObj.SessionID); !ok {
+			_ = c.writeSocketError(apierror.CodeNotFound, "Session not found")
 			c.close()
 			return
 		}
 	}
 	if authObj.ClientType == "machine-scoped" {
 		if authObj.MachineID == "" {
-			_ = c.writeSocketError("Missing machineId")
+			_ = c.writeSocketError(apierror.CodeInvalidRequest, "Missing machineId")
+			c.close()
+			return
+		}
+		certID, ok := auth.MachineCertFromContext(c.ctx)
+		if (ok && certID != authObj.MachineID) || (!ok && s.requireMachineCert) {
+			_ = c.writeSocketError(apierror.CodeForbidden, "Client certificate does not match machine")
 			c.close()
 			return
 		}
-		if _, ok := s.store.GetMachine(claims.UserID, authObj.MachineID); !ok {
-			_ = c.writeSocketError("Machine not found")
+		if _, ok := s.store.GetMachine(c.ctx, claims.UserID, authObj.MachineID); !ok {
+			_ = c.writeSocketError(apierror.CodeNotFound, "Machine not found")
 			c.close()
 			return
 		}
 	}
 
 	c.userID = claims.UserID
+	c.connectedAt = s.nowMillis()
 	c.clientType = authObj.ClientType
 	c.sessionID = authObj.SessionID
 	c.machineID = authObj.MachineID
-	c.connected.Store(true)
+	c.tokenScope = claims.TokenScope()
+	c.deviceID = claims.DeviceID
+	c.suppressEcho = authObj.SuppressEcho
+	c.updateSchema = updateSchema
 
 	s.mu.Lock()
+	var replaced *conn
+	if c.clientType == "session-scoped" {
+		if current := s.sessionWriters[c.sessionID]; current != nil {
+			if !authObj.Takeover {
+				s.mu.Unlock()
+				_ = c.writeSocketError(apierror.CodeConflict, "Session already has an active connection")
+				c.closeAfterFlush()
+				return
+			}
+			replaced = current
+			s.leaveRoom(s.roomSessions, c.sessionID, current)
+		}
+		s.sessionWriters[c.sessionID] = c
+	}
+	c.connected.Store(true)
+	if c.releasePending != nil {
+		c.releasePending()
+	}
+	noticeRestart := false
 	if c.clientType == "user-scoped" {
 		s.joinRoom(s.roomUsers, c.userID, c)
+		if s.startedAt != 0 && !s.restartNoticed[c.userID] {
+			s.restartNoticed[c.userID] = true
+			noticeRestart = true
+		}
 	}
 	if c.sessionID != "" {
 		s.joinRoom(s.roomSessions, c.sessionID, c)
 	}
 	if c.machineID != "" {
-		s.joinRoom(s.roomMachines, c.machineID, c)
+		s.joinRoom(s.roomMachines, machineRoom(c.userID, c.machineID), c)
 	}
 	s.mu.Unlock()
 
-	ack, err := buildSocketConnectPacket(ns, c.sid)
+	if replaced != nil {
+		_ = replaced.writeSocketError(apierror.CodeConflict, "Session taken over by another connection")
+		replaced.closeAfterFlush()
+	}
+
+	ack, err := buildSocketConnectPacket(ns, c.sid, c.updateSchema)
 	if err != nil {
 		c.close()
 		return
 	}
 	_ = c.enqueueText(string(engineMessage) + ack)
+
+	if noticeRestart {
+		if pkt, err := buildEphemeralPacket(events.ServerRestarted(s.startedAt)); err == nil {
+			s.publishEphemeral(c.userID, pkt, roomTarget{s.roomUsers, c.userID})
+		}
+	}
 }
 
 func (s *Server) handleEvent(c *conn, payload string) {
@@ -336,64 +652,119 @@ func (s *Server) handleEvent(c *conn, payload string) {
 	if err != nil {
 		return
 	}
-
-	switch pkt.Event {
-	case "ping":
-		if pkt.ID != nil {
-			ackPayload, err := buildSocketAckPacket(pkt.Namespace, *pkt.ID)
-			if err == nil {
-				_ = c.enqueueText(string(engineMessage) + ackPayload)
-			}
-		}
+	if c.daemon {
+		s.daemonHandlers.dispatch(c, pkt)
 		return
+	}
+	s.handlers.dispatch(c, pkt)
+}
 
-	case "rpc-register":
-		var body struct {
-			Method string `json:"method"`
-		}
-		if len(pkt.Args) < 1 || json.Unmarshal(pkt.Args[0], &body) != nil || body.Method == "" {
-			return
-		}
-		s.mu.Lock()
-		s.rpcByMethod[body.Method] = c
-		s.mu.Unlock()
-		registered, err := buildSocketEventPacket(pkt.Namespace, nil, "rpc-registered", gin.H{"method": body.Method})
-		if err == nil {
-			_ = c.enqueueText(string(engineMessage) + registered)
-		}
+// registerEvents routes every client event the server understands. Each
+// route counts its events and applies the connection's rate limits before
+// its own middleware.
+func (s *Server) registerEvents() {
+	r := newEventRegistry(countEvents, s.rateLimited, withinTokenScope)
+
+	r.on("ping", s.handlePing)
+	r.on("rpc-register", s.handleRPCRegister)
+	r.on("rpc-unregister", s.handleRPCUnregister)
+	r.on("rpc-call", s.handleRPCCallEvent, requireAck)
+
+	r.on("message", s.handleSessionMessage, scoped("session-scoped", "user-scoped"))
+	r.on("update-message", s.handleMessageUpdate, scoped("session-scoped", "user-scoped"))
+	r.on("delete-message", s.handleMessageDelete, scoped("session-scoped", "user-scoped"))
+	r.on("annotate-message", s.handleMessageAnnotate, scoped("session-scoped", "user-scoped"))
+	r.on("update-metadata", s.handleSessionMetadataUpdate, requireAck)
+	r.on("lock-acquire", s.handleLockAcquire, requireAck)
+	r.on("lock-renew", s.handleLockRenew, requireAck)
+	r.on("lock-release", s.handleLockRelease, requireAck)
+	r.on("update-state", s.handleSessionStateUpdate, requireAck)
+	r.on("session-alive", s.handleSessionAlive)
+	r.on("session-end", s.handleSessionEnd)
+	r.on("usage-report", s.handleUsageReport)
+
+	r.on("machine-update-metadata", s.handleMachineMetadataUpdate, requireAck)
+	r.on("machine-update-state", s.handleMachineStateUpdate, requireAck)
+	r.on("machine-alive", s.handleMachineAlive, scoped("machine-scoped"))
+	r.on("machine-event", s.handleMachineEvent)
+
+	s.handlers = r
+	s.daemonHandlers = r.only(daemonEvents...)
+}
+
+// daemonEvents are the events a daemon sends about its machine and sessions,
+// plus RPC. Events added for app clients stay off the daemon endpoint until
+// listed here.
+var daemonEvents = []string{
+	"ping",
+	"rpc-register", "rpc-unregister", "rpc-call",
+	"message", "update-metadata", "update-state", "session-alive", "session-end", "usage-report",
+	"lock-acquire", "lock-renew", "lock-release",
+	"machine-update-metadata", "machine-update-state", "machine-alive", "machine-event",
+}
+
+func (s *Server) handlePing(c *conn, pkt socketEventPacket) {
+	if pkt.ID == nil {
 		return
+	}
+	ackPayload, err := buildSocketAckPacket(pkt.Namespace, *pkt.ID)
+	if err == nil {
+		_ = c.enqueueText(string(engineMessage) + ackPayload)
+	}
+}
 
-	case "rpc-unregister":
-		var body struct {
-			Method string `json:"method"`
-		}
-		if len(pkt.Args) < 1 || json.Unmarshal(pkt.Args[0], &body) != nil || body.Method == "" {
-			return
-		}
-		s.mu.Lock()
-		owner, ok := s.rpcByMethod[body.Method]
-		if ok && owner == c {
-			delete(s.rpcByMethod, body.Method)
-		}
-		s.mu.Unlock()
-		unregistered, err := buildSocketEventPacket(pkt.Namespace, nil, "rpc-unregistered", gin.H{"method": body.Method})
-		if err == nil {
-			_ = c.enqueueText(string(engineMessage) + unregistered)
-		}
+func (s *Server) handleRPCRegister(c *conn, pkt socketEventPacket) {
+	var body struct {
+		Method string `json:"method"`
+	}
+	if len(pkt.Args) < 1 || json.Unmarshal(pkt.Args[0], &body) != nil || body.Method == "" {
 		return
+	}
+	s.mu.Lock()
+	methods := s.rpcByUser[c.userID]
+	if methods == nil {
+		methods = make(map[string]*conn)
+		s.rpcByUser[c.userID] = methods
+	}
+	methods[body.Method] = c
+	s.mu.Unlock()
+	registered, err := buildSocketEventPacket(pkt.Namespace, nil, "rpc-registered", gin.H{"method": body.Method})
+	if err == nil {
+		_ = c.enqueueText(string(engineMessage) + registered)
+	}
+}
 
-	case "rpc-call":
-		if pkt.ID == nil {
-			return
-		}
-		var body struct {
-			Method string `json:"method"`
-			Params string `json:"params"`
-		}
-		if len(pkt.Args) < 1 || json.Unmarshal(pkt.Args[0], &body) != nil || body.Method == "" {
-			return
+func (s *Server) handleRPCUnregister(c *conn, pkt socketEventPacket) {
+	var body struct {
+		Method string `json:"method"`
+	}
+	if len(pkt.Args) < 1 || json.Unmarshal(pkt.Args[0], &body) != nil || body.Method == "" {
+		return
+	}
+	s.mu.Lock()
+	methods := s.rpcByUser[c.userID]
+	if owner, ok := methods[body.Method]; ok && owner == c {
+		delete(methods, body.Method)
+		if len(methods) == 0 {
+			delete(s.rpcByUser, c.userID)
 		}
-		result, err := s.handleRPCCall(body.Method, body.Params)
+	}
+	s.mu.Unlock()
+	unregistered, err := buildSocketEventPacket(pkt.Namespace, nil, "rpc-unregistered", gin.H{"method": body.Method})
+	if err == nil {
+		_ = c.enqueueText(string(engineMessage) + unregistered)
+	}
+}
+
+func (s *Server) handleRPCCallEvent(c *conn, pkt socketEventPacket) {
+	var body struct {
+		Method string `json:"method"`
+		Params string `json:"params"`
+	}
+	if len(pkt.Args) < 1 || json.Unmarshal(pkt.Args[0], &body) != nil || body.Method == "" {
+		return
+	}
+	reply := func(result string, err error) {
 		resp := gin.H{"ok": err == nil}
 		if err != nil {
 			resp["error"] = err.Error()
@@ -404,134 +775,147 @@ func (s *Server) handleEvent(c *conn, payload string) {
 		if err2 == nil {
 			_ = c.enqueueText(string(engineMessage) + ackPayload)
 		}
-		return
+	}
+	if !s.relayRPC(c.userID, func() { reply(s.handleRPCCall(c.userID, body.Method, body.Params)) }) {
+		reply("", errors.New("Server busy"))
+	}
+}
 
-	case "message":
-		s.handleSessionMessage(c, pkt)
+func (s *Server) handleMachineAlive(c *conn, pkt socketEventPacket) {
+	var body struct {
+		MachineID string `json:"machineId"`
+		Time      int64  `json:"time"`
+	}
+	if len(pkt.Args) < 1 || json.Unmarshal(pkt.Args[0], &body) != nil {
 		return
-
-	case "update-metadata":
-		s.handleSessionMetadataUpdate(c, pkt)
+	}
+	machineID := body.MachineID
+	if machineID == "" {
+		machineID = c.machineID
+	}
+	if machineID == "" || machineID != c.machineID {
 		return
-
-	case "update-state":
-		s.handleSessionStateUpdate(c, pkt)
+	}
+	activeAt := body.Time
+	if activeAt <= 0 {
+		activeAt = s.nowMillis()
+	}
+	pktStr, err := buildEphemeralPacket(events.MachineActive(machineID, true, activeAt))
+	if err != nil {
 		return
+	}
+	s.publishEphemeral(c.userID, pktStr, roomTarget{s.roomMachines, machineRoom(c.userID, machineID)}, roomTarget{s.roomUsers, c.userID})
+}
 
-	case "machine-update-metadata":
-		s.handleMachineMetadataUpdate(c, pkt)
+func (s *Server) handleUsageReport(c *conn, pkt socketEventPacket) {
+	var body struct {
+		Key       string             `json:"key"`
+		SessionID string             `json:"sessionId"`
+		Tokens    map[string]float64 `json:"tokens"`
+		Cost      map[string]float64 `json:"cost"`
+	}
+	if len(pkt.Args) < 1 || json.Unmarshal(pkt.Args[0], &body) != nil {
 		return
-
-	case "machine-update-state":
-		s.handleMachineStateUpdate(c, pkt)
+	}
+	if body.Key == "" || body.SessionID == "" {
 		return
-
-	case "machine-alive":
-		var body struct {
-			MachineID string `json:"machineId"`
-			Time      int64  `json:"time"`
-		}
-		if len(pkt.Args) < 1 || json.Unmarshal(pkt.Args[0], &body) != nil {
-			return
-		}
-		machineID := body.MachineID
-		if machineID == "" {
-			machineID = c.machineID
-		}
-		if c.clientType != "machine-scoped" || machineID == "" || machineID != c.machineID {
-			return
-		}
-		activeAt := body.Time
-		if activeAt <= 0 {
-			activeAt = time.Now().UnixMilli()
-		}
-		pktStr, err := buildSocketEventPacket("/", nil, "ephemeral", gin.H{"type": "machine-activity", "id": machineID, "active": true, "activeAt": activeAt})
-		if err != nil {
-			return
-		}
-		s.broadcastToRoom(s.roomMachines, machineID, pktStr)
-		s.broadcastToRoom(s.roomUsers, c.userID, pktStr)
+	}
+	now := s.nowMillis()
+	tokens := events.UsageTokens{
+		Total:         body.Tokens["total"],
+		Input:         body.Tokens["input"],
+		Output:        body.Tokens["output"],
+		CacheCreation: body.Tokens["cache_creation"],
+		CacheRead:     body.Tokens["cache_read"],
+	}
+	cost := events.UsageCost{
+		Total:  body.Cost["total"],
+		Input:  body.Cost["input"],
+		Output: body.Cost["output"],
+	}
+	ephemeral, err := buildEphemeralPacket(events.UsageReported(body.SessionID, body.Key, now, tokens, cost))
+	if err != nil {
 		return
+	}
+	s.publishEphemeral(c.userID, ephemeral, roomTarget{s.roomUsers, c.userID}, roomTarget{s.roomSessions, body.SessionID})
+}
 
-	case "usage-report":
-		var body struct {
-			Key       string             `json:"key"`
-			SessionID string             `json:"sessionId"`
-			Tokens    map[string]float64 `json:"tokens"`
-			Cost      map[string]float64 `json:"cost"`
-		}
-		if len(pkt.Args) < 1 || json.Unmarshal(pkt.Args[0], &body) != nil {
-			return
-		}
-		if body.Key == "" || body.SessionID == "" {
-			return
-		}
-		now := time.Now().UnixMilli()
-		tokens := gin.H{
-			"total":         body.Tokens["total"],
-			"input":         body.Tokens["input"],
-			"output":        body.Tokens["output"],
-			"cache_creation": body.Tokens["cache_creation"],
-			"cache_read":     body.Tokens["cache_read"],
-		}
-		cost := gin.H{
-			"total":  body.Cost["total"],
-			"input":  body.Cost["input"],
-			"output": body.Cost["output"],
-		}
-		ephemeral, err := buildSocketEventPacket("/", nil, "ephemeral", gin.H{"type": "usage", "id": body.SessionID, "key": body.Key, "timestamp": now, "tokens": tokens, "cost": cost})
-		if err != nil {
-			return
-		}
-		s.broadcastToRoom(s.roomUsers, c.userID, ephemeral)
-		s.broadcastToRoom(s.roomSessions, body.SessionID, ephemeral)
+func (s *Server) handleSessionAlive(c *conn, pkt socketEventPacket) {
+	var body struct {
+		SID      string `json:"sid"`
+		Time     int64  `json:"time"`
+		Thinking bool   `json:"thinking"`
+	}
+	if len(pkt.Args) < 1 || json.Unmarshal(pkt.Args[0], &body) != nil || body.SID == "" {
 		return
+	}
+	activeAt := body.Time
+	if activeAt <= 0 {
+		activeAt = s.nowMillis()
+	}
+	s.store.SetSessionActive(c.ctx, c.userID, body.SID, true, activeAt, s.nowMillis())
+	if c.clientType == "session-scoped" && body.SID == c.sessionID {
+		c.lastAliveAt.Store(s.nowMillis())
+		c.stalled.Store(false)
+	}
+	ephemeral, err := buildEphemeralPacket(events.SessionActivity(body.SID, true, activeAt, body.Thinking))
+	if err == nil {
+		s.publishEphemeral(c.userID, ephemeral, roomTarget{s.roomUsers, c.userID}, roomTarget{s.roomSessions, body.SID})
+	}
+}
 
-	case "session-alive":
-		var body struct {
-			SID      string `json:"sid"`
-			Time     int64  `json:"time"`
-			Thinking bool   `json:"thinking"`
-		}
-		if len(pkt.Args) < 1 || json.Unmarshal(pkt.Args[0], &body) != nil || body.SID == "" {
-			return
-		}
-		activeAt := body.Time
-		if activeAt <= 0 {
-			activeAt = time.Now().UnixMilli()
-		}
-		s.store.SetSessionActive(c.userID, body.SID, true, activeAt, time.Now().UnixMilli())
-		ephemeral, err := buildSocketEventPacket("/", nil, "ephemeral", gin.H{"type": "activity", "id": body.SID, "active": true, "activeAt": activeAt, "thinking": body.Thinking})
-		if err == nil {
-			s.broadcastToRoom(s.roomUsers, c.userID, ephemeral)
-			s.broadcastToRoom(s.roomSessions, body.SID, ephemeral)
-		}
+func (s *Server) handleSessionEnd(c *conn, pkt socketEventPacket) {
+	var body struct {
+		SID string `json:"sid"`
+	}
+	if len(pkt.Args) < 1 || json.Unmarshal(pkt.Args[0], &body) != nil || body.SID == "" {
 		return
+	}
+	now := s.nowMillis()
+	s.store.SetSessionActive(c.ctx, c.userID, body.SID, false, 0, now)
+	if body.SID == c.sessionID {
+		c.lastAliveAt.Store(0)
+	}
+	ephemeral, err := buildEphemeralPacket(events.SessionActivity(body.SID, false, now, false))
+	if err == nil {
+		s.publishEphemeral(c.userID, ephemeral, roomTarget{s.roomUsers, c.userID}, roomTarget{s.roomSessions, body.SID})
+	}
+}
 
-	case "session-end":
-		var body struct {
-			SID string `json:"sid"`
-		}
-		if len(pkt.Args) < 1 || json.Unmarshal(pkt.Args[0], &body) != nil || body.SID == "" {
-			return
-		}
-		now := time.Now().UnixMilli()
-		s.store.SetSessionActive(c.userID, body.SID, false, 0, now)
-		ephemeral, err := buildSocketEventPacket("/", nil, "ephemeral", gin.H{"type": "activity", "id": body.SID, "active": false, "activeAt": now, "thinking": false})
+// allowEvent applies the per-connection event rate limits. Rejected events get
+// a "rate-limited" ack when the client asked for one and an error event
+// otherwise; sustained abuse closes the connection.
+func (s *Server) allowEvent(c *conn, pkt socketEventPacket) bool {
+	allowed, violations := c.limiter.allow(pkt.Event, time.Now())
+	if allowed {
+		return true
+	}
+
+	if s.limits.MaxRateViolations > 0 && violations >= s.limits.MaxRateViolations {
+		_ = c.writeSocketError(apierror.CodeRateLimited, "Rate limit exceeded")
+		c.close()
+		return false
+	}
+
+	if pkt.ID != nil {
+		ackPayload, err := buildSocketAckPacket(pkt.Namespace, *pkt.ID, gin.H{"result": "rate-limited", "code": apierror.CodeRateLimited, "event": pkt.Event})
 		if err == nil {
-			s.broadcastToRoom(s.roomUsers, c.userID, ephemeral)
-			s.broadcastToRoom(s.roomSessions, body.SID, ephemeral)
+			_ = c.enqueueText(string(engineMessage) + ackPayload)
 		}
-		return
-
-	default:
-		return
+		return false
+	}
+	body := apierror.Socket(apierror.CodeRateLimited, "Rate limit exceeded")
+	body["event"] = pkt.Event
+	packet, err := buildSocketEventPacket("/", nil, "error", body)
+	if err == nil {
+		_ = c.enqueueText(string(engineMessage) + packet)
 	}
+	return false
 }
 
-func (s *Server) handleRPCCall(method string, params string) (string, error) {
+func (s *Server) handleRPCCall(userID, method, params string) (string, error) {
 	s.mu.RLock()
-	h := s.rpcByMethod[method]
+	h := s.rpcByUser[userID][method]
 	s.mu.RUnlock()
 	if h == nil {
 		return "", errors.New("Method not found")
@@ -551,78 +935,326 @@ func (s *Server) handleRPCCall(method string, params string) (string, error) {
 	return result, nil
 }
 
+func (s *Server) nowMillis() int64 {
+	return clock.Now(s.clock).UnixMilli()
+}
+
 func (s *Server) nextUpdateID() (string, int64) {
 	seq := atomic.AddInt64(&s.updateSeq, 1)
-	return uuid.NewString(), seq
+	return s.newID(), seq
 }
 
-func (s *Server) handleSessionMessage(c *conn, pkt socketEventPacket) {
-	var body struct {
-		SID     string `json:"sid"`
-		Message string `json:"message"`
-		LocalID string `json:"localId"`
+// machineRoom keys the room of a machine. Daemons pick their own machine
+// ids, so rooms are per user to keep one user's machine events from
+// reaching another's daemon with the same id.
+func machineRoom(userID, machineID string) string {
+	if machineID == "" {
+		return ""
 	}
-	if len(pkt.Args) < 1 || json.Unmarshal(pkt.Args[0], &body) != nil {
+	return userID + "|" + machineID
+}
+
+type roomTarget struct {
+	rooms map[string]map[*conn]struct{}
+	key   string
+}
+
+// publishUpdate stamps body with the next update seq and enqueues it to every
+// target under publishMu. Stamping and enqueueing together keeps each
+// connection's updates in seq order even when events race.
+func (s *Server) publishUpdate(userID string, createdAt int64, body any, except *conn, targets ...roomTarget) {
+	s.publishMu.Lock()
+	defer s.publishMu.Unlock()
+
+	updateID, updateSeq := s.nextUpdateID()
+	payload, err := buildUpdatePacket(events.Update{ID: updateID, Seq: updateSeq, CreatedAt: createdAt, Body: body})
+	if err != nil {
 		return
 	}
-	if body.SID == "" {
-		return
+	// Queued under publishMu, so each user's updates go out in seq order.
+	queuedAt := time.Now()
+	queued := s.fanout.submit(userID, func() {
+		for _, t := range targets {
+			s.broadcastToRoomExcept(t.rooms, t.key, payload, except)
+		}
+		s.broadcasts.record(time.Since(queuedAt))
+	})
+	if !queued {
+		s.closeRooms(targets)
 	}
+}
 
-	switch c.clientType {
-	case "session-scoped":
-		if body.SID != c.sessionID {
-			return
+// publishEphemeral queues payload for the targets behind the user's pending
+// updates, so it cannot overtake them. Ephemerals are not replayed, so one
+// that does not fit in the user's queue is dropped.
+func (s *Server) publishEphemeral(userID, payload string, targets ...roomTarget) {
+	s.fanout.submit(userID, func() {
+		for _, t := range targets {
+			s.broadcastToRoom(t.rooms, t.key, payload)
 		}
-	case "user-scoped":
-		if _, ok := s.store.GetSession(c.userID, body.SID); !ok {
-			return
+	})
+}
+
+// closeRooms closes every connection in the targets.
+func (s *Server) closeRooms(targets []roomTarget) {
+	s.mu.RLock()
+	var doomed []*conn
+	for _, t := range targets {
+		for c := range t.rooms[t.key] {
+			doomed = append(doomed, c)
 		}
-	default:
+	}
+	s.mu.RUnlock()
+
+	for _, c := range doomed {
+		c.close()
+	}
+}
+
+func (s *Server) handleSessionMessage(c *conn, pkt socketEventPacket) {
+	var body struct {
+		SID      string `json:"sid"`
+		Message  string `json:"message"`
+		LocalID  string `json:"localId"`
+		Checksum string `json:"checksum"`
+	}
+	if len(pkt.Args) < 1 || json.Unmarshal(pkt.Args[0], &body) != nil {
+		return
+	}
+	if body.SID == "" {
+		return
+	}
+
+	if c.clientType == "session-scoped" && body.SID != c.sessionID {
 		return
 	}
+	if c.clientType == "user-scoped" {
+		if _, ok := s.store.GetSession(c.ctx, c.userID, body.SID); !ok {
+			return
+		}
+	}
 
-	now := time.Now().UnixMilli()
-	msg, err := s.store.AppendMessage(c.userID, body.SID, body.Message, now)
+	now := s.nowMillis()
+	msg, created, err := s.store.AppendMessageOnce(c.ctx, store.OriginSocketIO, c.userID, body.SID, body.Message, body.Checksum, body.LocalID, now)
+	if errors.Is(err, store.ErrChecksumMismatch) {
+		_ = c.writeSocketError(apierror.CodeInvalidRequest, "Checksum mismatch")
+		return
+	}
 	if err != nil {
 		return
 	}
 
-	messageObj := gin.H{
-		"id":  msg.ID,
-		"seq": msg.Seq,
-		"content": gin.H{
-			"t": "encrypted",
-			"c": msg.Content,
-		},
-		"createdAt": msg.CreatedAt,
+	message := events.MessageFrom(msg)
+	if pkt.ID != nil {
+		ackPayload, err := buildSocketAckPacket(pkt.Namespace, *pkt.ID, gin.H{"message": message})
+		if err == nil {
+			_ = c.enqueueText(string(engineMessage) + ackPayload)
+		}
 	}
-	if body.LocalID != "" {
-		messageObj["localId"] = body.LocalID
+	// A replayed localId was published when the message was first sent.
+	if !created {
+		return
+	}
+	s.publishUpdate(c.userID, now, events.NewMessage(body.SID, message), c.echoExclusion(), roomTarget{s.roomSessions, body.SID}, roomTarget{s.roomUsers, c.userID})
+}
+
+// messageEditBody is the update telling clients a message was edited or
+// deleted.
+func messageEditBody(eventType, sessionID string, msg model.SessionMessage) any {
+	if eventType == store.EventMessageDeleted {
+		return events.MessageDeleted(sessionID, events.MessageFrom(msg))
+	}
+	return events.MessageUpdated(sessionID, events.MessageFrom(msg))
+}
+
+func (s *Server) handleMessageUpdate(c *conn, pkt socketEventPacket) {
+	var body struct {
+		SID       string `json:"sid"`
+		MessageID string `json:"messageId"`
+		Message   string `json:"message"`
+		Checksum  string `json:"checksum"`
+	}
+	if len(pkt.Args) < 1 || json.Unmarshal(pkt.Args[0], &body) != nil || body.SID == "" || body.MessageID == "" || body.Message == "" {
+		return
+	}
+	if c.clientType == "session-scoped" && body.SID != c.sessionID {
+		return
+	}
+
+	now := s.nowMillis()
+	msg, err := s.store.UpdateMessageFrom(c.ctx, store.OriginSocketIO, c.userID, body.SID, body.MessageID, body.Message, body.Checksum, now)
+	s.finishMessageEdit(c, pkt, store.EventMessageUpdated, body.SID, msg, err, now)
+}
+
+func (s *Server) handleMessageDelete(c *conn, pkt socketEventPacket) {
+	var body struct {
+		SID       string `json:"sid"`
+		MessageID string `json:"messageId"`
+	}
+	if len(pkt.Args) < 1 || json.Unmarshal(pkt.Args[0], &body) != nil || body.SID == "" || body.MessageID == "" {
+		return
+	}
+	if c.clientType == "session-scoped" && body.SID != c.sessionID {
+		return
+	}
+
+	now := s.nowMillis()
+	msg, err := s.store.DeleteMessageFrom(c.ctx, store.OriginSocketIO, c.userID, body.SID, body.MessageID, now)
+	s.finishMessageEdit(c, pkt, store.EventMessageDeleted, body.SID, msg, err, now)
+}
+
+// finishMessageEdit acks a message edit or delete, {"result": "success",
+// "message"} or {"result": "error", "code", "error"}, when the client asked,
+// and publishes the change on success.
+func (s *Server) finishMessageEdit(c *conn, pkt socketEventPacket, eventType, sessionID string, msg model.SessionMessage, err error, now int64) {
+	if pkt.ID != nil {
+		resp := gin.H{"result": "success", "message": events.MessageFrom(msg)}
+		switch {
+		case errors.Is(err, store.ErrChecksumMismatch):
+			resp = gin.H{"result": "error", "code": apierror.CodeInvalidRequest, "error": "Checksum mismatch"}
+		case errors.Is(err, store.ErrMessageNotFound):
+			resp = gin.H{"result": "error", "code": apierror.CodeNotFound, "error": "Message not found"}
+		case err != nil:
+			resp = gin.H{"result": "error", "code": apierror.CodeNotFound, "error": "Session not found"}
+		}
+		ackPayload, ackErr := buildSocketAckPacket(pkt.Namespace, *pkt.ID, resp)
+		if ackErr == nil {
+			_ = c.enqueueText(string(engineMessage) + ackPayload)
+		}
+	}
+	if err != nil {
+		return
+	}
+	s.publishUpdate(c.userID, now, messageEditBody(eventType, sessionID, msg), c.echoExclusion(), roomTarget{s.roomSessions, sessionID}, roomTarget{s.roomUsers, c.userID})
+}
+
+// handleMessageAnnotate sets or, with a null value, removes one annotation
+// of a message. The ack is {"result": "success" or "version-mismatch",
+// "version", "value"}, with the annotation as it now stands, or {"result":
+// "error", "code", "error"}.
+func (s *Server) handleMessageAnnotate(c *conn, pkt socketEventPacket) {
+	var body struct {
+		SID             string  `json:"sid"`
+		MessageID       string  `json:"messageId"`
+		Key             string  `json:"key"`
+		ExpectedVersion int     `json:"expectedVersion"`
+		Value           *string `json:"value"`
+	}
+	if len(pkt.Args) < 1 || json.Unmarshal(pkt.Args[0], &body) != nil || body.SID == "" || body.MessageID == "" {
+		return
+	}
+	if c.clientType == "session-scoped" && body.SID != c.sessionID {
+		return
+	}
+
+	now := s.nowMillis()
+	msg, err := s.store.AnnotateMessageFrom(c.ctx, store.OriginSocketIO, c.userID, body.SID, body.MessageID, body.Key, body.ExpectedVersion, body.Value, now)
+	if pkt.ID != nil {
+		var resp gin.H
+		switch {
+		case err == nil, errors.Is(err, store.ErrAnnotationVersionMismatch):
+			result := "success"
+			if err != nil {
+				result = "version-mismatch"
+			}
+			resp = gin.H{"result": result, "version": 0, "value": nil}
+			if a, ok := msg.Annotations[body.Key]; ok {
+				resp["version"], resp["value"] = a.Version, a.Value
+			}
+		case errors.Is(err, store.ErrInvalidAnnotationKey):
+			resp = gin.H{"result": "error", "code": apierror.CodeInvalidRequest, "error": "Invalid annotation key"}
+		case errors.Is(err, store.ErrTooManyAnnotations):
+			resp = gin.H{"result": "error", "code": apierror.CodeInvalidRequest, "error": "Too many annotations"}
+		case errors.Is(err, store.ErrTooLarge):
+			resp = gin.H{"result": "error", "code": apierror.CodePayloadTooLarge, "error": "Annotation too large"}
+		case errors.Is(err, store.ErrMessageNotFound):
+			resp = gin.H{"result": "error", "code": apierror.CodeNotFound, "error": "Message not found"}
+		default:
+			resp = gin.H{"result": "error", "code": apierror.CodeNotFound, "error": "Session not found"}
+		}
+		ackPayload, ackErr := buildSocketAckPacket(pkt.Namespace, *pkt.ID, resp)
+		if ackErr == nil {
+			_ = c.enqueueText(string(engineMessage) + ackPayload)
+		}
 	}
-	updateID, updateSeq := s.nextUpdateID()
-	updatePayload, err := buildSocketEventPacket("/", nil, "update", gin.H{
-		"id":        updateID,
-		"seq":       updateSeq,
-		"createdAt": now,
-		"body": gin.H{
-			"t":   "new-message",
-			"sid": body.SID,
-			"message": messageObj,
-		},
-	})
 	if err != nil {
 		return
 	}
+	s.publishUpdate(c.userID, now, events.MessageAnnotated(body.SID, events.MessageFrom(msg)), c.echoExclusion(), roomTarget{s.roomSessions, body.SID}, roomTarget{s.roomUsers, c.userID})
+}
 
-	s.broadcastToRoom(s.roomSessions, body.SID, updatePayload)
-	s.broadcastToRoom(s.roomUsers, c.userID, updatePayload)
+type lockEventBody struct {
+	SID        string `json:"sid"`
+	Name       string `json:"name"`
+	Holder     string `json:"holder"`
+	Token      string `json:"token"`
+	TTLSeconds int    `json:"ttlSeconds"`
 }
 
-func (s *Server) handleSessionMetadataUpdate(c *conn, pkt socketEventPacket) {
-	if pkt.ID == nil {
+func (s *Server) handleLockAcquire(c *conn, pkt socketEventPacket) {
+	s.changeLock(c, pkt, true, func(body lockEventBody, expiresAt, now int64) (model.SessionLock, error) {
+		return s.store.AcquireSessionLock(c.ctx, store.OriginSocketIO, c.userID, body.SID, body.Name, body.Holder, expiresAt, now)
+	})
+}
+
+func (s *Server) handleLockRenew(c *conn, pkt socketEventPacket) {
+	s.changeLock(c, pkt, true, func(body lockEventBody, expiresAt, now int64) (model.SessionLock, error) {
+		return s.store.RenewSessionLock(c.ctx, store.OriginSocketIO, c.userID, body.SID, body.Name, body.Token, expiresAt, now)
+	})
+}
+
+func (s *Server) handleLockRelease(c *conn, pkt socketEventPacket) {
+	s.changeLock(c, pkt, false, func(body lockEventBody, _, now int64) (model.SessionLock, error) {
+		return s.store.ReleaseSessionLock(c.ctx, store.OriginSocketIO, c.userID, body.SID, body.Name, body.Token, now)
+	})
+}
+
+// changeLock acquires, renews or releases an advisory session lock. The ack
+// is {"result": "success", "lock"}, with the token after acquiring, {"result":
+// "held", "lock"} with the lock someone else holds, {"result": "not-held"}
+// or {"result": "error", "code", "error"}.
+func (s *Server) changeLock(c *conn, pkt socketEventPacket, expires bool, change func(body lockEventBody, expiresAt, now int64) (model.SessionLock, error)) {
+	var body lockEventBody
+	if len(pkt.Args) < 1 || json.Unmarshal(pkt.Args[0], &body) != nil || body.SID == "" {
+		return
+	}
+	if c.clientType == "session-scoped" && body.SID != c.sessionID {
 		return
 	}
+
+	now := s.nowMillis()
+	var resp gin.H
+	var expiresAt int64
+	ok := true
+	if expires {
+		expiresAt, ok = store.SessionLockExpiresAt(body.TTLSeconds, now)
+	}
+	if !ok {
+		resp = gin.H{"result": "error", "code": apierror.CodeInvalidRequest, "error": "Invalid ttlSeconds"}
+	} else {
+		lock, err := change(body, expiresAt, now)
+		switch {
+		case err == nil:
+			resp = gin.H{"result": "success", "lock": events.LockFrom(lock)}
+		case errors.Is(err, store.ErrSessionLockHeld):
+			resp = gin.H{"result": "held", "lock": events.LockFrom(lock)}
+		case errors.Is(err, store.ErrSessionLockNotHeld):
+			resp = gin.H{"result": "not-held"}
+		case errors.Is(err, store.ErrInvalidSessionLock):
+			resp = gin.H{"result": "error", "code": apierror.CodeInvalidRequest, "error": "Invalid lock"}
+		case errors.Is(err, store.ErrTooManySessionLocks):
+			resp = gin.H{"result": "error", "code": apierror.CodeInvalidRequest, "error": "Too many locks"}
+		default:
+			resp = gin.H{"result": "error", "code": apierror.CodeNotFound, "error": "Session not found"}
+		}
+	}
+	ackPayload, err := buildSocketAckPacket(pkt.Namespace, *pkt.ID, resp)
+	if err == nil {
+		_ = c.enqueueText(string(engineMessage) + ackPayload)
+	}
+}
+
+func (s *Server) handleSessionMetadataUpdate(c *conn, pkt socketEventPacket) {
 	var body struct {
 		SID             string `json:"sid"`
 		ExpectedVersion int    `json:"expectedVersion"`
@@ -632,8 +1264,8 @@ func (s *Server) handleSessionMetadataUpdate(c *conn, pkt socketEventPacket) {
 		return
 	}
 
-	now := time.Now().UnixMilli()
-	status, version, value := s.store.UpdateSessionMetadata(c.userID, body.SID, body.ExpectedVersion, body.Metadata, now)
+	now := s.nowMillis()
+	status, version, value := s.store.UpdateSessionMetadata(c.ctx, c.userID, body.SID, body.ExpectedVersion, body.Metadata, now)
 	resp := gin.H{"result": status, "version": version, "metadata": value}
 	ackPayload, err := buildSocketAckPacket(pkt.Namespace, *pkt.ID, resp)
 	if err == nil {
@@ -643,31 +1275,10 @@ func (s *Server) handleSessionMetadataUpdate(c *conn, pkt socketEventPacket) {
 		return
 	}
 
-	updateID, updateSeq := s.nextUpdateID()
-	updatePayload, err := buildSocketEventPacket("/", nil, "update", gin.H{
-		"id":        updateID,
-		"seq":       updateSeq,
-		"createdAt": now,
-		"body": gin.H{
-			"t":   "update-session",
-			"sid": body.SID,
-			"metadata": gin.H{
-				"version": version,
-				"value":   value,
-			},
-		},
-	})
-	if err != nil {
-		return
-	}
-	s.broadcastToRoom(s.roomSessions, body.SID, updatePayload)
-	s.broadcastToRoom(s.roomUsers, c.userID, updatePayload)
+	s.publishUpdate(c.userID, now, events.SessionMetadataUpdated(body.SID, version, value), c.echoExclusion(), roomTarget{s.roomSessions, body.SID}, roomTarget{s.roomUsers, c.userID})
 }
 
 func (s *Server) handleSessionStateUpdate(c *conn, pkt socketEventPacket) {
-	if pkt.ID == nil {
-		return
-	}
 	var body struct {
 		SID             string  `json:"sid"`
 		ExpectedVersion int     `json:"expectedVersion"`
@@ -677,8 +1288,8 @@ func (s *Server) handleSessionStateUpdate(c *conn, pkt socketEventPacket) {
 		return
 	}
 
-	now := time.Now().UnixMilli()
-	status, version, value := s.store.UpdateSessionAgentState(c.userID, body.SID, body.ExpectedVersion, body.AgentState, now)
+	now := s.nowMillis()
+	status, version, value := s.store.UpdateSessionAgentState(c.ctx, c.userID, body.SID, body.ExpectedVersion, body.AgentState, now)
 	resp := gin.H{"result": status, "version": version, "agentState": value}
 	ackPayload, err := buildSocketAckPacket(pkt.Namespace, *pkt.ID, resp)
 	if err == nil {
@@ -688,31 +1299,10 @@ func (s *Server) handleSessionStateUpdate(c *conn, pkt socketEventPacket) {
 		return
 	}
 
-	updateID, updateSeq := s.nextUpdateID()
-	updatePayload, err := buildSocketEventPacket("/", nil, "update", gin.H{
-		"id":        updateID,
-		"seq":       updateSeq,
-		"createdAt": now,
-		"body": gin.H{
-			"t":   "update-session",
-			"sid": body.SID,
-			"agentState": gin.H{
-				"version": version,
-				"value":   value,
-			},
-		},
-	})
-	if err != nil {
-		return
-	}
-	s.broadcastToRoom(s.roomSessions, body.SID, updatePayload)
-	s.broadcastToRoom(s.roomUsers, c.userID, updatePayload)
+	s.publishUpdate(c.userID, now, events.SessionAgentStateUpdated(body.SID, version, value), c.echoExclusion(), roomTarget{s.roomSessions, body.SID}, roomTarget{s.roomUsers, c.userID})
 }
 
 func (s *Server) handleMachineMetadataUpdate(c *conn, pkt socketEventPacket) {
-	if pkt.ID == nil {
-		return
-	}
 	var body struct {
 		MachineID       string `json:"machineId"`
 		ExpectedVersion int    `json:"expectedVersion"`
@@ -722,8 +1312,8 @@ func (s *Server) handleMachineMetadataUpdate(c *conn, pkt socketEventPacket) {
 		return
 	}
 
-	now := time.Now().UnixMilli()
-	status, version, value := s.store.UpdateMachineMetadata(c.userID, body.MachineID, body.ExpectedVersion, body.Metadata, now)
+	now := s.nowMillis()
+	status, version, value := s.store.UpdateMachineMetadata(c.ctx, c.userID, body.MachineID, body.ExpectedVersion, body.Metadata, now)
 	resp := gin.H{"result": status, "version": version, "metadata": value}
 	ackPayload, err := buildSocketAckPacket(pkt.Namespace, *pkt.ID, resp)
 	if err == nil {
@@ -733,31 +1323,10 @@ func (s *Server) handleMachineMetadataUpdate(c *conn, pkt socketEventPacket) {
 		return
 	}
 
-	updateID, updateSeq := s.nextUpdateID()
-	updatePayload, err := buildSocketEventPacket("/", nil, "update", gin.H{
-		"id":        updateID,
-		"seq":       updateSeq,
-		"createdAt": now,
-		"body": gin.H{
-			"t":         "update-machine",
-			"machineId": body.MachineID,
-			"metadata": gin.H{
-				"version": version,
-				"value":   value,
-			},
-		},
-	})
-	if err != nil {
-		return
-	}
-	s.broadcastToRoom(s.roomMachines, body.MachineID, updatePayload)
-	s.broadcastToRoom(s.roomUsers, c.userID, updatePayload)
+	s.publishUpdate(c.userID, now, events.MachineMetadataUpdated(body.MachineID, version, value), c.echoExclusion(), roomTarget{s.roomMachines, machineRoom(c.userID, body.MachineID)}, roomTarget{s.roomUsers, c.userID})
 }
 
 func (s *Server) handleMachineStateUpdate(c *conn, pkt socketEventPacket) {
-	if pkt.ID == nil {
-		return
-	}
 	var body struct {
 		MachineID       string  `json:"machineId"`
 		ExpectedVersion int     `json:"expectedVersion"`
@@ -767,8 +1336,8 @@ func (s *Server) handleMachineStateUpdate(c *conn, pkt socketEventPacket) {
 		return
 	}
 
-	now := time.Now().UnixMilli()
-	status, version, value := s.store.UpdateMachineDaemonState(c.userID, body.MachineID, body.ExpectedVersion, body.DaemonState, now)
+	now := s.nowMillis()
+	status, version, value := s.store.UpdateMachineDaemonState(c.ctx, c.userID, body.MachineID, body.ExpectedVersion, body.DaemonState, now)
 	resp := gin.H{"result": status, "version": version, "daemonState": value}
 	ackPayload, err := buildSocketAckPacket(pkt.Namespace, *pkt.ID, resp)
 	if err == nil {
@@ -778,30 +1347,331 @@ func (s *Server) handleMachineStateUpdate(c *conn, pkt socketEventPacket) {
 		return
 	}
 
-	updateID, updateSeq := s.nextUpdateID()
-	updatePayload, err := buildSocketEventPacket("/", nil, "update", gin.H{
-		"id":        updateID,
-		"seq":       updateSeq,
-		"createdAt": now,
-		"body": gin.H{
-			"t":         "update-machine",
-			"machineId": body.MachineID,
-			"daemonState": gin.H{
-				"version": version,
-				"value":   value,
-			},
-		},
+	s.publishUpdate(c.userID, now, events.MachineDaemonStateUpdated(body.MachineID, version, value), c.echoExclusion(), roomTarget{s.roomMachines, machineRoom(c.userID, body.MachineID)}, roomTarget{s.roomUsers, c.userID})
+}
+
+// stallLoop watches a session-scoped connection that has sent session-alive
+// at least once. If the heartbeats stop while the socket stays open, the agent
+// is likely hung: the session is marked inactive and the owner's clients get a
+// session-stalled event. The next session-alive clears the state.
+func (s *Server) stallLoop(c *conn) {
+	interval := s.limits.SessionStallTimeout / 4
+	if interval > time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+		}
+		if !c.connected.Load() || c.clientType != "session-scoped" || c.stalled.Load() {
+			continue
+		}
+		lastAliveAt := c.lastAliveAt.Load()
+		now := s.nowMillis()
+		if lastAliveAt == 0 || now-lastAliveAt < s.limits.SessionStallTimeout.Milliseconds() {
+			continue
+		}
+		if !c.stalled.CompareAndSwap(false, true) {
+			continue
+		}
+
+		s.store.SetSessionActive(c.ctx, c.userID, c.sessionID, false, 0, now)
+		for _, payload := range []any{
+			events.SessionActivity(c.sessionID, false, now, false),
+			events.SessionStalledSince(c.sessionID, lastAliveAt),
+		} {
+			pkt, err := buildEphemeralPacket(payload)
+			if err != nil {
+				continue
+			}
+			s.publishEphemeral(c.userID, pkt, roomTarget{s.roomUsers, c.userID}, roomTarget{s.roomSessions, c.sessionID})
+		}
+	}
+}
+
+// handleMachineEvent relays an event from one of a user's daemons to the
+// daemon of another machine they own, acking {"ok", "delivered"} or
+// {"ok": false, "error"} when the sender asked for an ack.
+func (s *Server) handleMachineEvent(c *conn, pkt socketEventPacket) {
+	reply := func(resp gin.H) {
+		if pkt.ID == nil {
+			return
+		}
+		ackPayload, err := buildSocketAckPacket(pkt.Namespace, *pkt.ID, resp)
+		if err == nil {
+			_ = c.enqueueText(string(engineMessage) + ackPayload)
+		}
+	}
+	fail := func(msg string) { reply(gin.H{"ok": false, "error": msg}) }
+
+	var body struct {
+		MachineID string          `json:"machineId"`
+		Event     string          `json:"event"`
+		Payload   json.RawMessage `json:"payload"`
+	}
+	if len(pkt.Args) < 1 || json.Unmarshal(pkt.Args[0], &body) != nil || body.MachineID == "" || body.Event == "" {
+		fail("Invalid request")
+		return
+	}
+	if c.clientType != "machine-scoped" || c.machineID == "" {
+		fail("Only machine connections can send machine events")
+		return
+	}
+	if body.MachineID == c.machineID {
+		fail("Cannot send a machine event to itself")
+		return
+	}
+	if _, ok := s.store.GetMachine(c.ctx, c.userID, body.MachineID); !ok {
+		fail("Machine not found")
+		return
+	}
+
+	packet, err := buildSocketEventPacket("/", nil, "machine-event", gin.H{
+		"from":    c.machineID,
+		"event":   body.Event,
+		"payload": body.Payload,
+		"sentAt":  s.nowMillis(),
 	})
 	if err != nil {
+		fail("Invalid request")
 		return
 	}
-	s.broadcastToRoom(s.roomMachines, body.MachineID, updatePayload)
-	s.broadcastToRoom(s.roomUsers, c.userID, updatePayload)
+
+	s.mu.RLock()
+	var targets []*conn
+	for target := range s.roomMachines[machineRoom(c.userID, body.MachineID)] {
+		if target.clientType == "machine-scoped" {
+			targets = append(targets, target)
+		}
+	}
+	s.mu.RUnlock()
+
+	delivered := 0
+	for _, target := range targets {
+		if target.enqueueText(string(engineMessage)+packet) == nil {
+			delivered++
+		}
+	}
+	if delivered == 0 {
+		fail("Machine offline")
+		return
+	}
+	reply(gin.H{"ok": true, "delivered": delivered})
+}
+
+// sessionDeleted tells the owner's clients and any daemon attached to the
+// session that it is gone, then disconnects the session-scoped connections so
+// they stop appending to a deleted history.
+func (s *Server) sessionDeleted(userID, sessionID string) {
+	s.publishUpdate(userID, s.nowMillis(), events.SessionDeleted(sessionID), nil, roomTarget{s.roomSessions, sessionID}, roomTarget{s.roomUsers, userID})
+
+	// Queued behind the update, so it is delivered before they close, or
+	// run now if the user's queue is full.
+	disconnect := func() {
+		s.mu.RLock()
+		var doomed []*conn
+		for c := range s.roomSessions[sessionID] {
+			if c.clientType == "session-scoped" {
+				doomed = append(doomed, c)
+			}
+		}
+		s.mu.RUnlock()
+
+		for _, c := range doomed {
+			c.closeAfterFlush()
+		}
+	}
+	if !s.fanout.submit(userID, disconnect) {
+		disconnect()
+	}
+}
+
+// machineDeleted tells the owner's clients that a machine is gone and
+// disconnects its daemon.
+func (s *Server) machineDeleted(userID, machineID string) {
+	s.publishUpdate(userID, s.nowMillis(), events.MachineDeleted(machineID), nil, roomTarget{s.roomMachines, machineRoom(userID, machineID)}, roomTarget{s.roomUsers, userID})
+
+	// Queued behind the update, so it is delivered before they close, or
+	// run now if the user's queue is full.
+	disconnect := func() {
+		s.mu.RLock()
+		var doomed []*conn
+		for c := range s.roomMachines[machineRoom(userID, machineID)] {
+			if c.clientType == "machine-scoped" {
+				doomed = append(doomed, c)
+			}
+		}
+		s.mu.RUnlock()
+
+		for _, c := range doomed {
+			c.closeAfterFlush()
+		}
+	}
+	if !s.fanout.submit(userID, disconnect) {
+		disconnect()
+	}
+}
+
+// ConnectionInfo describes one authenticated socket for the presence API.
+// UserID and Stats are only filled in for the admin listing.
+type ConnectionInfo struct {
+	ID          string           `json:"id"`
+	UserID      string           `json:"userId,omitempty"`
+	ClientType  string           `json:"clientType"`
+	SessionID   string           `json:"sessionId,omitempty"`
+	MachineID   string           `json:"machineId,omitempty"`
+	ConnectedAt int64            `json:"connectedAt"`
+	IP          string           `json:"ip"`
+	Stats       *ConnectionStats `json:"stats,omitempty"`
+}
+
+// Connections lists userID's live connections, oldest first.
+func (s *Server) Connections(userID string) []ConnectionInfo {
+	return s.listConnections(func(c *conn) bool { return c.userID == userID }, false)
+}
+
+// AllConnections lists every live connection with its traffic counters,
+// optionally restricted to one user, oldest first.
+func (s *Server) AllConnections(userID string) []ConnectionInfo {
+	return s.listConnections(func(c *conn) bool { return userID == "" || c.userID == userID }, true)
+}
+
+// RoomMembers lists, with their traffic counters, the live connections
+// joined to the "user", "session" or "machine" room key, oldest first. A
+// machine key matches that machine id's room for every user. It reports
+// false for any other kind.
+func (s *Server) RoomMembers(kind, key string) ([]ConnectionInfo, bool) {
+	var room func(c *conn) string
+	var rooms map[string]map[*conn]struct{}
+	switch kind {
+	case "user":
+		rooms, room = s.roomUsers, func(*conn) string { return key }
+	case "session":
+		rooms, room = s.roomSessions, func(*conn) string { return key }
+	case "machine":
+		rooms, room = s.roomMachines, func(c *conn) string { return machineRoom(c.userID, key) }
+	default:
+		return nil, false
+	}
+	// listConnections calls match with s.mu held.
+	return s.listConnections(func(c *conn) bool {
+		_, ok := rooms[room(c)][c]
+		return ok
+	}, true), true
+}
+
+func (s *Server) listConnections(match func(*conn) bool, withStats bool) []ConnectionInfo {
+	s.mu.RLock()
+	out := make([]ConnectionInfo, 0)
+	for _, c := range s.connsBySocket {
+		if !c.connected.Load() || !match(c) {
+			continue
+		}
+		info := ConnectionInfo{
+			ID:          c.sid,
+			ClientType:  c.clientType,
+			SessionID:   c.sessionID,
+			MachineID:   c.machineID,
+			ConnectedAt: c.connectedAt,
+			IP:          c.remoteIP,
+		}
+		if withStats {
+			stats := c.stats.snapshot()
+			info.UserID = c.userID
+			info.Stats = &stats
+		}
+		out = append(out, info)
+	}
+	s.mu.RUnlock()
+
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].ConnectedAt != out[j].ConnectedAt {
+			return out[i].ConnectedAt < out[j].ConnectedAt
+		}
+		return out[i].ID < out[j].ID
+	})
+	return out
+}
+
+// Disconnect force-closes the connection with the given id if it belongs to
+// userID, and reports whether one was found.
+func (s *Server) Disconnect(userID, id string) bool {
+	s.mu.RLock()
+	var target *conn
+	for _, c := range s.connsBySocket {
+		if c.sid == id && c.userID == userID && c.connected.Load() {
+			target = c
+			break
+		}
+	}
+	s.mu.RUnlock()
+	if target == nil {
+		return false
+	}
+
+	_ = target.writeSocketError(apierror.CodeUnauthorized, "Disconnected by account owner")
+	target.closeAfterFlush()
+	return true
+}
+
+// DisconnectUser closes every live connection of userID with reason and
+// returns how many were closed.
+func (s *Server) DisconnectUser(userID, reason string) int {
+	s.mu.RLock()
+	var targets []*conn
+	for _, c := range s.connsBySocket {
+		if c.userID == userID && c.connected.Load() {
+			targets = append(targets, c)
+		}
+	}
+	s.mu.RUnlock()
+
+	for _, c := range targets {
+		_ = c.writeSocketError(apierror.CodeUnauthorized, reason)
+		c.closeAfterFlush()
+	}
+	return len(targets)
+}
+
+// DisconnectDevice closes every live connection made with a token of device
+// deviceID of userID with reason and returns how many were closed.
+func (s *Server) DisconnectDevice(userID, deviceID, reason string) int {
+	s.mu.RLock()
+	var targets []*conn
+	for _, c := range s.connsBySocket {
+		if c.userID == userID && c.deviceID == deviceID && c.connected.Load() {
+			targets = append(targets, c)
+		}
+	}
+	s.mu.RUnlock()
+
+	for _, c := range targets {
+		_ = c.writeSocketError(apierror.CodeUnauthorized, reason)
+		c.closeAfterFlush()
+	}
+	return len(targets)
+}
+
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
 }
 
 type conn struct {
 	ws *websocket.Conn
 
+	// ctx is the upgrade request's context, cancelled when the connection
+	// closes; store calls made for the connection run under it.
+	ctx    context.Context
+	cancel context.CancelFunc
+
 	sid string
 
 	connected atomic.Bool
@@ -810,6 +1680,30 @@ type conn struct {
 	clientType string
 	sessionID  string
 	machineID  string
+	// tokenScope confines a connection made with a scoped token to its
+	// session or machine.
+	tokenScope auth.Scope
+	// deviceID is the signed-in device the connection's token was issued
+	// to, if any.
+	deviceID string
+
+	remoteIP     string
+	connectedAt  int64
+	lastAliveAt  atomic.Int64
+	stalled      atomic.Bool
+	suppressEcho bool
+	updateSchema int
+
+	// handshakeUserID is the user of the token checked before upgrading, if
+	// one was sent; releasePending frees the IP's pending slot on connect.
+	handshakeUserID string
+	releasePending  func()
+	// daemon marks connections made on the daemon endpoint.
+	daemon bool
+
+	limiter *eventLimiter
+	tap     *debugtap.Tap
+	stats   connStats
 
 	ackMu      sync.Mutex
 	nextAckID  int
@@ -826,9 +1720,12 @@ type conn struct {
 	closed atomic.Bool
 }
 
-func newConn(ws *websocket.Conn) *conn {
+func newConn(ctx context.Context, ws *websocket.Conn) *conn {
+	ctx, cancel := context.WithCancel(ctx)
 	return &conn{
 		ws:         ws,
+		ctx:        ctx,
+		cancel:     cancel,
 		sid:        uuid.NewString(),
 		pendingAck: make(map[int]chan []json.RawMessage),
 		nextPingAt: time.Now().Add(pingInterval),
@@ -842,6 +1739,7 @@ func (c *conn) close() {
 		return
 	}
 	close(c.done)
+	c.cancel()
 	_ = c.ws.Close()
 }
 
@@ -870,16 +1768,57 @@ func (c *conn) enqueueText(msg string) error {
 	}
 }
 
+// closeAfterFlush closes the connection once everything already queued has
+// been written, so a final update or error event is not lost.
+func (c *conn) closeAfterFlush() {
+	if err := c.enqueueText(closeSentinel); err != nil {
+		c.close()
+	}
+}
+
+// recordFrame hands authenticated, non-heartbeat frames to the debug tap.
+// Frames before connect are skipped since they carry the auth token.
+func (c *conn) recordFrame(kind, msg string) {
+	if c.tap == nil || !c.connected.Load() || msg[0] == byte(enginePing) || msg[0] == byte(enginePong) {
+		return
+	}
+	if !c.tap.Enabled(c.userID) {
+		return
+	}
+	frame, cut := debugtap.Clip(msg)
+	c.tap.Record(c.userID, debugtap.Entry{
+		Time:      time.Now().UnixMilli(),
+		Kind:      kind,
+		ConnID:    c.sid,
+		Frame:     frame,
+		Truncated: cut,
+	})
+}
+
+// echoExclusion is the connection to leave out of broadcasts caused by c.
+func (c *conn) echoExclusion() *conn {
+	if c.suppressEcho {
+		return c
+	}
+	return nil
+}
+
 func (c *conn) writeLoop() {
 	for {
 		select {
 		case <-c.done:
 			return
 		case msg := <-c.sendCh:
+			if msg == closeSentinel {
+				c.close()
+				return
+			}
 			if err := c.writeText(msg); err != nil {
 				c.close()
 				return
 			}
+			c.stats.recordOut(len(msg))
+			c.recordFrame(debugtap.KindSocketOut, msg)
 		}
 	}
 }
@@ -933,8 +1872,8 @@ func (c *conn) markPong() {
 	c.pingMu.Unlock()
 }
 
-func (c *conn) writeSocketError(msg string) error {
-	packet, err := buildSocketEventPacket("/", nil, "error", gin.H{"message": msg})
+func (c *conn) writeSocketError(code apierror.Code, msg string) error {
+	packet, err := buildSocketEventPacket("/", nil, "error", apierror.Socket(code, msg))
 	if err != nil {
 		return err
 	}
@@ -970,10 +1909,13 @@ func (c *conn) emitWithAck(event string, arg any, timeout time.Duration) ([]json
 		c.ackMu.Lock()
 		delete(c.pendingAck, id)
 		c.ackMu.Unlock()
-		return nil, errors.New("RPC timeout")
+		return nil, errAckTimeout
 	}
 }
 
+// errAckTimeout is returned by emitWithAck when no ack arrives in time.
+var errAckTimeout = errors.New("RPC timeout")
+
 func (c *conn) resolveAck(id int, args []json.RawMessage) {
 	c.ackMu.Lock()
 	ch := c.pendingAck[id]
@@ -0,0 +1,130 @@
+package socketio
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ConnectionStats counts the Engine.IO frames a connection has exchanged.
+type ConnectionStats struct {
+	MessagesIn  int64  `json:"messagesIn"`
+	MessagesOut int64  `json:"messagesOut"`
+	BytesIn     int64  `json:"bytesIn"`
+	BytesOut    int64  `json:"bytesOut"`
+	LastEvent   string `json:"lastEvent,omitempty"`
+	LastEventAt int64  `json:"lastEventAt,omitempty"`
+}
+
+// Metrics are server-wide totals, including connections that have since
+// closed.
+type Metrics struct {
+	Connections int   `json:"connections"`
+	MessagesIn  int64 `json:"messagesIn"`
+	MessagesOut int64 `json:"messagesOut"`
+	BytesIn     int64 `json:"bytesIn"`
+	BytesOut    int64 `json:"bytesOut"`
+	// Broadcasts counts the updates fanned out to rooms, and
+	// BroadcastMicros the time they took in all from being queued to being
+	// handed to every connection.
+	Broadcasts      int64 `json:"broadcasts"`
+	BroadcastMicros int64 `json:"broadcastMicros"`
+	// Events is keyed by event name; events the server does not handle are
+	// counted under AnyEvent.
+	Events map[string]EventMetrics `json:"events"`
+}
+
+type trafficCounters struct {
+	messagesIn  atomic.Int64
+	messagesOut atomic.Int64
+	bytesIn     atomic.Int64
+	bytesOut    atomic.Int64
+}
+
+func (t *trafficCounters) recordIn(n int) {
+	t.messagesIn.Add(1)
+	t.bytesIn.Add(int64(n))
+}
+
+func (t *trafficCounters) recordOut(n int) {
+	t.messagesOut.Add(1)
+	t.bytesOut.Add(int64(n))
+}
+
+type broadcastCounters struct {
+	count  atomic.Int64
+	micros atomic.Int64
+}
+
+func (b *broadcastCounters) record(took time.Duration) {
+	b.count.Add(1)
+	b.micros.Add(took.Microseconds())
+}
+
+type connStats struct {
+	trafficCounters
+	// totals is the server-wide counter set every frame is also added to.
+	totals *trafficCounters
+
+	mu          sync.Mutex
+	lastEvent   string
+	lastEventAt int64
+}
+
+func (st *connStats) recordIn(n int) {
+	st.trafficCounters.recordIn(n)
+	if st.totals != nil {
+		st.totals.recordIn(n)
+	}
+}
+
+func (st *connStats) recordOut(n int) {
+	st.trafficCounters.recordOut(n)
+	if st.totals != nil {
+		st.totals.recordOut(n)
+	}
+}
+
+func (st *connStats) recordEvent(name string) {
+	st.mu.Lock()
+	st.lastEvent = name
+	st.lastEventAt = time.Now().UnixMilli()
+	st.mu.Unlock()
+}
+
+func (st *connStats) snapshot() ConnectionStats {
+	st.mu.Lock()
+	lastEvent, lastEventAt := st.lastEvent, st.lastEventAt
+	st.mu.Unlock()
+	return ConnectionStats{
+		MessagesIn:  st.messagesIn.Load(),
+		MessagesOut: st.messagesOut.Load(),
+		BytesIn:     st.bytesIn.Load(),
+		BytesOut:    st.bytesOut.Load(),
+		LastEvent:   lastEvent,
+		LastEventAt: lastEventAt,
+	}
+}
+
+// Metrics reports live connection count, traffic totals and per-event
+// counts.
+func (s *Server) Metrics() Metrics {
+	s.mu.RLock()
+	live := 0
+	for _, c := range s.connsBySocket {
+		if c.connected.Load() {
+			live++
+		}
+	}
+	s.mu.RUnlock()
+	return Metrics{
+		Connections:     live,
+		MessagesIn:      s.traffic.messagesIn.Load(),
+		MessagesOut:     s.traffic.messagesOut.Load(),
+		BytesIn:         s.traffic.bytesIn.Load(),
+		BytesOut:        s.traffic.bytesOut.Load(),
+		Broadcasts:      s.broadcasts.count.Load(),
+		BroadcastMicros: s.broadcasts.micros.Load(),
+		Events:          s.handlers.metrics(),
+	}
+}
@@ -0,0 +1,289 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"happy-server-lite/internal/model"
+)
+
+// AccountDeletion counts what DeleteAccount removed.
+type AccountDeletion struct {
+	Sessions   int `json:"sessions"`
+	Machines   int `json:"machines"`
+	Artifacts  int `json:"artifacts"`
+	PushTokens int `json:"pushTokens"`
+	// RefreshTokens counts the device grants revoked with the account.
+	RefreshTokens int `json:"refreshTokens"`
+	// APIKeys counts the API keys revoked with the account.
+	APIKeys int `json:"apiKeys"`
+	// Devices counts the signed-in devices revoked with the account.
+	Devices int `json:"devices"`
+}
+
+// DeleteAccount removes the account registered for publicKey with its
+// sessions and their messages, machines, artifacts, settings, linked GitHub
+// user, push tokens, refresh tokens, API keys, devices, tombstones and auth
+// requests. The account's user id is left disabled so tokens issued before
+// the deletion stop working; it is a random id and holds no data.
+// DeleteAccount reports false when there is no such account.
+func (s *Store) DeleteAccount(ctx context.Context, publicKey string) (AccountDeletion, bool) {
+	var removed AccountDeletion
+	s.mu.Lock()
+	acc, ok := s.accountsByPublicKey[publicKey]
+	if !ok {
+		s.mu.Unlock()
+		return removed, false
+	}
+	userID := acc.ID
+	// Loaded before anything is removed, so an account whose sessions
+	// cannot be read is left whole rather than half deleted.
+	sh, unpin, err := s.userShard(userID)
+	if err != nil {
+		s.mu.Unlock()
+		return removed, false
+	}
+	defer unpin()
+	s.disabledAccounts[userID] = true
+	s.persist(recordDisabled, userID, true)
+
+	delete(s.accountsByPublicKey, publicKey)
+	s.unpersist(recordAccount, publicKey)
+	for key, req := range s.authRequestsByKey {
+		if key == publicKey || req.ResponseAccountID == userID {
+			delete(s.authRequestsByKey, key)
+			s.unpersist(recordAuthRequest, key)
+		}
+	}
+	if _, ok := s.accountSettingsByUserID[userID]; ok {
+		delete(s.accountSettingsByUserID, userID)
+		s.unpersist(recordSettings, userID)
+	}
+	if _, ok := s.githubByUserID[userID]; ok {
+		delete(s.githubByUserID, userID)
+		s.unpersist(recordGitHub, userID)
+	}
+
+	sh.mu.Lock()
+	if u := sh.records(userID); u != nil {
+		for id, sess := range u.sessions {
+			s.unpersist(recordSession, id)
+			s.messages.deleteSession(id)
+			s.unpersistMessages(id)
+			if s.journal != nil {
+				s.journal.remove(id)
+			}
+			s.seq.reset(id)
+			s.dropSessionLocks(id)
+			if !sess.Deleted {
+				removed.Sessions++
+			}
+		}
+		for id := range u.machines {
+			s.unpersist(recordMachine, machineKey(userID, id))
+			removed.Machines++
+		}
+		delete(sh.users, userID)
+	}
+	sh.mu.Unlock()
+	artifactsChanged := false
+	for key, a := range s.artifactsByKey {
+		if a.UserID != userID {
+			continue
+		}
+		delete(s.artifactsByKey, key)
+		s.unpersist(recordArtifact, key)
+		artifactsChanged = true
+		if !a.Deleted {
+			removed.Artifacts++
+		}
+	}
+	for key, pt := range s.pushTokens {
+		if pt.UserID != userID {
+			continue
+		}
+		delete(s.pushTokens, key)
+		s.unpersist(recordPushToken, key)
+		removed.PushTokens++
+	}
+	removed.RefreshTokens = s.deleteRefreshTokensLocked(userID)
+	removed.APIKeys = s.deleteAPIKeysLocked(userID)
+	removed.Devices = s.deleteDevicesLocked(userID)
+	s.tombstonesMu.Lock()
+	for key, t := range s.tombstones {
+		if t.UserID == userID {
+			delete(s.tombstones, key)
+			s.unpersist(recordTombstone, key)
+		}
+	}
+	s.tombstonesMu.Unlock()
+	s.mu.Unlock()
+
+	s.saveAccounts()
+	s.saveSessions()
+	if artifactsChanged {
+		s.saveArtifacts()
+	}
+	if removed.Machines > 0 {
+		s.machinesChanged()
+	}
+	return removed, true
+}
+
+func (p *PostgresStore) DeleteAccount(ctx context.Context, publicKey string) (AccountDeletion, bool) {
+	var removed AccountDeletion
+	found := false
+	err := p.withTx(ctx, func(tx *sql.Tx) error {
+		var userID string
+		err := tx.QueryRowContext(ctx, `DELETE FROM accounts WHERE public_key = $1 RETURNING id`, publicKey).Scan(&userID)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		found = true
+		if _, err := tx.ExecContext(ctx, `INSERT INTO disabled_accounts (user_id) VALUES ($1) ON CONFLICT DO NOTHING`, userID); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, `DELETE FROM messages WHERE session_id IN (SELECT id FROM sessions WHERE user_id = $1)`, userID); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, `DELETE FROM session_locks WHERE session_id IN (SELECT id FROM sessions WHERE user_id = $1)`, userID); err != nil {
+			return err
+		}
+		for _, step := range []struct {
+			query string
+			arg   string
+			count *int
+		}{
+			{`DELETE FROM sessions WHERE user_id = $1 AND NOT deleted`, userID, &removed.Sessions},
+			{`DELETE FROM sessions WHERE user_id = $1`, userID, nil},
+			{`DELETE FROM machines WHERE user_id = $1`, userID, &removed.Machines},
+			{`DELETE FROM artifacts WHERE user_id = $1 AND NOT deleted`, userID, &removed.Artifacts},
+			{`DELETE FROM artifacts WHERE user_id = $1`, userID, nil},
+			{`DELETE FROM push_tokens WHERE user_id = $1`, userID, &removed.PushTokens},
+			{`DELETE FROM refresh_tokens WHERE user_id = $1`, userID, &removed.RefreshTokens},
+			{`DELETE FROM api_keys WHERE user_id = $1`, userID, &removed.APIKeys},
+			{`DELETE FROM devices WHERE user_id = $1`, userID, &removed.Devices},
+			{`DELETE FROM account_settings WHERE user_id = $1`, userID, nil},
+			{`DELETE FROM github_identities WHERE user_id = $1`, userID, nil},
+			{`DELETE FROM tombstones WHERE user_id = $1`, userID, nil},
+			{`DELETE FROM auth_requests WHERE public_key = $1`, publicKey, nil},
+			{`DELETE FROM auth_requests WHERE response_account_id = $1`, userID, nil},
+		} {
+			res, err := tx.ExecContext(ctx, step.query, step.arg)
+			if err != nil {
+				return err
+			}
+			if step.count != nil {
+				n, _ := res.RowsAffected()
+				*step.count = int(n)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		p.logError("delete account", err)
+		return AccountDeletion{}, false
+	}
+	return removed, found
+}
+
+// DeleteAccount removes the account's keys one set at a time rather than in
+// one transaction; the account is disabled first, so its tokens cannot add
+// records while the rest is removed.
+func (r *RedisStore) DeleteAccount(ctx context.Context, publicKey string) (AccountDeletion, bool) {
+	var removed AccountDeletion
+	acc, ok := r.GetAccount(ctx, publicKey)
+	if !ok {
+		return removed, false
+	}
+	userID := acc.ID
+	if _, err := r.client.do(ctx, "SET", r.disabledKey(userID), "1"); err != nil {
+		r.logError("delete account", err)
+		return removed, false
+	}
+
+	members := func(kind string) []string {
+		reply, err := r.client.do(ctx, "SMEMBERS", r.userSetKey(userID, kind))
+		if err != nil {
+			r.logError("delete account", err)
+			return nil
+		}
+		return redisStrings(reply)
+	}
+	keys := []string{
+		r.accountKey(publicKey),
+		r.authRequestKey(publicKey),
+		r.settingsKey(userID),
+		r.githubKey(userID),
+		r.tombstonesKey(userID),
+	}
+	for _, id := range members("sessions") {
+		var sess model.Session
+		if ok, err := getJSON(r.client.doFunc(ctx), r.sessionKey(id), &sess); err == nil && ok {
+			keys = append(keys, r.sessionTagKey(userID, sess.Tag))
+		}
+		keys = append(keys, r.sessionKey(id), r.sessionSeqKey(id), r.messagesKey(id), r.messageLocalIDsKey(id), r.sessionLocksKey(id))
+		removed.Sessions++
+	}
+	for _, id := range members("machines") {
+		keys = append(keys, r.machineKey(userID, id))
+		removed.Machines++
+	}
+	for _, id := range members("artifacts") {
+		var a model.Artifact
+		if ok, err := getJSON(r.client.doFunc(ctx), r.artifactKey(userID, id), &a); err == nil && ok && !a.Deleted {
+			removed.Artifacts++
+		}
+		keys = append(keys, r.artifactKey(userID, id))
+	}
+	for _, token := range members("push-tokens") {
+		keys = append(keys, r.pushTokenKey(userID, token))
+		removed.PushTokens++
+	}
+	for _, id := range members("refresh-tokens") {
+		keys = append(keys, r.refreshTokenKey(id))
+		removed.RefreshTokens++
+	}
+	for _, id := range members("api-keys") {
+		keys = append(keys, r.apiKeyKey(id))
+		removed.APIKeys++
+	}
+	for _, id := range members("devices") {
+		keys = append(keys, r.deviceKey(id))
+		removed.Devices++
+	}
+	for _, kind := range []string{"sessions", "machines", "artifacts", "push-tokens", "refresh-tokens", "api-keys", "devices"} {
+		keys = append(keys, r.userSetKey(userID, kind))
+	}
+	// Requests this account approved still hold tokens issued to it.
+	requests, err := r.scanKeys(ctx, redisGlobEscape(r.prefix)+"auth-request:*")
+	if err != nil {
+		r.logError("delete account", err)
+	}
+	for _, key := range requests {
+		var req model.AuthRequest
+		if ok, err := getJSON(r.client.doFunc(ctx), key, &req); err == nil && ok && req.ResponseAccountID == userID {
+			keys = append(keys, key)
+		}
+	}
+
+	const batch = 100
+	for len(keys) > 0 {
+		n := min(batch, len(keys))
+		args := make([]any, 0, n+1)
+		args = append(args, "DEL")
+		for _, k := range keys[:n] {
+			args = append(args, k)
+		}
+		if _, err := r.client.do(ctx, args...); err != nil {
+			r.logError("delete account", err)
+			return removed, false
+		}
+		keys = keys[n:]
+	}
+	return removed, true
+}
@@ -0,0 +1,77 @@
+package store
+
+import (
+	"context"
+	"testing"
+)
+
+// testDeleteAccount returns the id of the deleted account's session, which
+// held a lock, so callers can check the lock went with it.
+func testDeleteAccount(t *testing.T, s Storage) string {
+	t.Helper()
+	ctx := context.Background()
+	now := int64(1000)
+	acc, _ := s.GetOrCreateAccount(ctx, "pk", now)
+	other, _ := s.GetOrCreateAccount(ctx, "pk2", now)
+	s.UpdateAccountSettings(ctx, acc.ID, 0, "prefs", now)
+	sess, _, err := s.GetOrCreateSession(ctx, acc.ID, "tag", "meta", nil, nil, now)
+	if err != nil {
+		t.Fatalf("GetOrCreateSession: %v", err)
+	}
+	if _, err := s.AppendMessageFrom(ctx, "", acc.ID, sess.ID, "c", "", now); err != nil {
+		t.Fatalf("AppendMessage: %v", err)
+	}
+	s.UpsertMachine(ctx, acc.ID, "m1", "meta", nil, nil, now)
+	if _, _, err := s.CreateArtifactWithChecksums(ctx, acc.ID, "a1", "h", "b", "k", ArtifactChecksums{}, now); err != nil {
+		t.Fatalf("CreateArtifact: %v", err)
+	}
+	s.AddPushToken(ctx, acc.ID, "t1", "", now)
+	if _, err := s.AcquireSessionLock(ctx, OriginREST, acc.ID, sess.ID, "metadata", "cli", now+60000, now); err != nil {
+		t.Fatalf("AcquireSessionLock: %v", err)
+	}
+	kept, _, _ := s.GetOrCreateSession(ctx, other.ID, "tag", "meta", nil, nil, now)
+
+	removed, ok := s.DeleteAccount(ctx, "pk")
+	if !ok {
+		t.Fatalf("expected DeleteAccount to find the account")
+	}
+	if removed != (AccountDeletion{Sessions: 1, Machines: 1, Artifacts: 1, PushTokens: 1}) {
+		t.Fatalf("unexpected counts: %+v", removed)
+	}
+	if _, ok := s.GetAccount(ctx, "pk"); ok {
+		t.Fatalf("expected account to be gone")
+	}
+	if !s.IsAccountDisabled(ctx, acc.ID) {
+		t.Fatalf("expected the deleted user id to stay disabled")
+	}
+	if len(s.ListSessions(ctx, acc.ID)) != 0 || len(s.ListMachines(ctx, acc.ID)) != 0 ||
+		len(s.ListArtifacts(ctx, acc.ID)) != 0 || len(s.ListPushTokens(ctx, acc.ID)) != 0 {
+		t.Fatalf("expected the account's records to be gone")
+	}
+	if settings, _ := s.GetAccountSettings(ctx, acc.ID); settings != nil {
+		t.Fatalf("expected settings to be gone, got %q", *settings)
+	}
+	if _, ok := s.GetSession(ctx, other.ID, kept.ID); !ok {
+		t.Fatalf("expected other accounts to be untouched")
+	}
+	if _, ok := s.DeleteAccount(ctx, "pk"); ok {
+		t.Fatalf("expected a second delete to report no account")
+	}
+	return sess.ID
+}
+
+func TestStore_DeleteAccount(t *testing.T) {
+	s := New()
+	sessionID := testDeleteAccount(t, s)
+	if _, ok := s.sessionLocks[sessionID]; ok {
+		t.Fatalf("expected the deleted session's locks to be dropped")
+	}
+}
+
+func TestRedisStore_DeleteAccount(t *testing.T) {
+	r := openFakeRedisStore(t, 0)
+	sessionID := testDeleteAccount(t, r)
+	if n, err := r.client.do(context.Background(), "EXISTS", r.sessionLocksKey(sessionID)); err != nil || n != int64(0) {
+		t.Fatalf("expected the deleted session's locks to be dropped, got %v (%v)", n, err)
+	}
+}
@@ -0,0 +1,138 @@
+package store
+
+import (
+	"log"
+	"sort"
+	"time"
+
+	"happy-server-lite/internal/model"
+)
+
+type persistedAccountsFile struct {
+	Version  int                        `json:"version"`
+	Accounts []model.Account            `json:"accounts"`
+	Settings map[string]accountSettings `json:"settings,omitempty"`
+	// Disabled lists suspended user ids, including those of deleted
+	// accounts, so their tokens stay rejected after a restart.
+	Disabled []string `json:"disabled,omitempty"`
+	// GitHub holds the GitHub users linked to accounts, by user id.
+	GitHub map[string]model.GitHubIdentity `json:"github,omitempty"`
+	// RefreshTokens are the devices' grants, kept so signed-in devices
+	// stay signed in across restarts.
+	RefreshTokens []model.RefreshToken `json:"refreshTokens,omitempty"`
+	APIKeys       []model.APIKey       `json:"apiKeys,omitempty"`
+	Devices       []model.Device       `json:"devices,omitempty"`
+	SavedAt       int64                `json:"savedAt"`
+}
+
+// loadAccountsFromFile reports whether the file was in an older format.
+func (s *Store) loadAccountsFromFile(path string) (bool, error) {
+	var file persistedAccountsFile
+	found, migrated, err := readStateFile(path, stateAccounts, &file)
+	if err != nil || !found {
+		return false, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, acc := range file.Accounts {
+		if acc.ID == "" || acc.PublicKey == "" {
+			continue
+		}
+		s.accountsByPublicKey[acc.PublicKey] = acc
+	}
+	for userID, st := range file.Settings {
+		s.accountSettingsByUserID[userID] = st
+	}
+	for _, userID := range file.Disabled {
+		s.disabledAccounts[userID] = true
+	}
+	for userID, identity := range file.GitHub {
+		s.githubByUserID[userID] = identity
+	}
+	for _, rt := range file.RefreshTokens {
+		if rt.ID != "" && rt.UserID != "" {
+			s.refreshTokens[rt.ID] = rt
+		}
+	}
+	for _, k := range file.APIKeys {
+		if k.ID != "" && k.UserID != "" {
+			s.apiKeys[k.ID] = k
+		}
+	}
+	for _, d := range file.Devices {
+		if d.ID != "" && d.UserID != "" {
+			s.devices[d.ID] = d
+		}
+	}
+	return migrated, nil
+}
+
+// unlockAndSaveAccounts releases s.mu and, if *changed is set, rewrites the
+// accounts state file.
+func (s *Store) unlockAndSaveAccounts(changed *bool) {
+	s.mu.Unlock()
+	if *changed {
+		s.saveAccounts()
+	}
+}
+
+// saveAccounts snapshots accounts, their settings, linked GitHub users,
+// refresh tokens and the disabled user ids
+// while holding accountsPersistMu, so the last writer always writes the
+// newest state.
+func (s *Store) saveAccounts() {
+	if s.partitions != nil {
+		s.savePartitions()
+		return
+	}
+	path := s.accountsStateFile
+	if path == "" {
+		return
+	}
+
+	s.accountsPersistMu.Lock()
+	defer s.accountsPersistMu.Unlock()
+
+	s.mu.RLock()
+	file := persistedAccountsFile{
+		Version:  stateVersions[stateAccounts],
+		Accounts: make([]model.Account, 0, len(s.accountsByPublicKey)),
+		Settings: make(map[string]accountSettings, len(s.accountSettingsByUserID)),
+		SavedAt:  time.Now().UnixMilli(),
+	}
+	for _, acc := range s.accountsByPublicKey {
+		file.Accounts = append(file.Accounts, acc)
+	}
+	for userID, st := range s.accountSettingsByUserID {
+		file.Settings[userID] = st
+	}
+	for userID := range s.disabledAccounts {
+		file.Disabled = append(file.Disabled, userID)
+	}
+	if len(s.githubByUserID) > 0 {
+		file.GitHub = make(map[string]model.GitHubIdentity, len(s.githubByUserID))
+		for userID, identity := range s.githubByUserID {
+			file.GitHub[userID] = identity
+		}
+	}
+	for _, rt := range s.refreshTokens {
+		file.RefreshTokens = append(file.RefreshTokens, rt)
+	}
+	for _, k := range s.apiKeys {
+		file.APIKeys = append(file.APIKeys, k)
+	}
+	for _, d := range s.devices {
+		file.Devices = append(file.Devices, d)
+	}
+	s.mu.RUnlock()
+	sort.Slice(file.Accounts, func(i, j int) bool { return file.Accounts[i].ID < file.Accounts[j].ID })
+	sort.Strings(file.Disabled)
+	sortRefreshTokens(file.RefreshTokens)
+	sortAPIKeys(file.APIKeys)
+	sortDevices(file.Devices)
+
+	if err := s.persistStats.accountsFile.record(writeStateFile(path, file)); err != nil {
+		log.Printf("accounts persistence: %v", err)
+	}
+}
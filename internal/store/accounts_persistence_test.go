@@ -0,0 +1,37 @@
+package store
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+)
+
+func TestStore_AccountsPersistence_RoundTrip(t *testing.T) {
+	ctx := context.Background()
+	opts := Options{AccountsStateFile: filepath.Join(t.TempDir(), "accounts-state.json")}
+
+	s1 := NewWithOptions(opts)
+	acc, _ := s1.GetOrCreateAccount(ctx, "pk1", 1000)
+	if status, _, _ := s1.UpdateAccountSettings(ctx, acc.ID, 0, "settings", 1000); status != "success" {
+		t.Fatalf("UpdateAccountSettings: %s", status)
+	}
+	gone, _ := s1.GetOrCreateAccount(ctx, "pk2", 1000)
+	s1.DeleteAccount(ctx, "pk2")
+	suspended, _ := s1.GetOrCreateAccount(ctx, "pk3", 1000)
+	s1.SetAccountDisabled(ctx, suspended.ID, true)
+
+	s2 := NewWithOptions(opts)
+	again, created := s2.GetOrCreateAccount(ctx, "pk1", 2000)
+	if created || again.ID != acc.ID {
+		t.Fatalf("expected the account to keep its id, got %+v (created %v)", again, created)
+	}
+	if settings, version := s2.GetAccountSettings(ctx, acc.ID); settings == nil || *settings != "settings" || version != 1 {
+		t.Fatalf("unexpected settings after reload: %v %d", settings, version)
+	}
+	if !s2.IsAccountDisabled(ctx, gone.ID) || !s2.IsAccountDisabled(ctx, suspended.ID) || s2.IsAccountDisabled(ctx, acc.ID) {
+		t.Fatalf("expected deleted and suspended accounts to stay disabled")
+	}
+	if fresh, created := s2.GetOrCreateAccount(ctx, "pk2", 2000); !created || fresh.ID == gone.ID {
+		t.Fatalf("expected a deleted account's key to get a new account, got %+v", fresh)
+	}
+}
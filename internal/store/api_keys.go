@@ -0,0 +1,294 @@
+package store
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"errors"
+	"sort"
+
+	"happy-server-lite/internal/model"
+)
+
+// apiKeyTouchInterval bounds how often a key's LastUsedAt is written, so a
+// bot calling in a loop does not rewrite the store on every request.
+const apiKeyTouchInterval int64 = 60_000
+
+// sortAPIKeys orders keys oldest first.
+func sortAPIKeys(keys []model.APIKey) {
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].CreatedAt != keys[j].CreatedAt {
+			return keys[i].CreatedAt < keys[j].CreatedAt
+		}
+		return keys[i].ID < keys[j].ID
+	})
+}
+
+func apiKeyMatches(k model.APIKey, secretHash string) bool {
+	return subtle.ConstantTimeCompare([]byte(k.SecretHash), []byte(secretHash)) == 1
+}
+
+// CreateAPIKey stores a key named name for the secret hashing to
+// secretHash.
+func (s *Store) CreateAPIKey(ctx context.Context, userID, name, secretHash string, nowMillis int64) model.APIKey {
+	k := model.APIKey{
+		ID:         s.newID(),
+		UserID:     userID,
+		Name:       name,
+		SecretHash: secretHash,
+		CreatedAt:  nowMillis,
+		LastUsedAt: nowMillis,
+	}
+	s.mu.Lock()
+	s.apiKeys[k.ID] = k
+	s.persist(recordAPIKey, k.ID, k)
+	s.mu.Unlock()
+	s.saveAccounts()
+	return k
+}
+
+// UseAPIKey returns key id when its secret hashes to secretHash, recording
+// the use.
+func (s *Store) UseAPIKey(ctx context.Context, id, secretHash string, nowMillis int64) (model.APIKey, bool) {
+	s.mu.Lock()
+	k, ok := s.apiKeys[id]
+	if !ok || !apiKeyMatches(k, secretHash) {
+		s.mu.Unlock()
+		return model.APIKey{}, false
+	}
+	touched := nowMillis-k.LastUsedAt >= apiKeyTouchInterval
+	if touched {
+		k.LastUsedAt = nowMillis
+		s.apiKeys[id] = k
+		s.persist(recordAPIKey, id, k)
+	}
+	s.mu.Unlock()
+	if touched {
+		s.saveAccounts()
+	}
+	return k, true
+}
+
+func (s *Store) ListAPIKeys(ctx context.Context, userID string) []model.APIKey {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	result := make([]model.APIKey, 0)
+	for _, k := range s.apiKeys {
+		if k.UserID == userID {
+			result = append(result, k)
+		}
+	}
+	sortAPIKeys(result)
+	return result
+}
+
+func (s *Store) DeleteAPIKey(ctx context.Context, userID, id string) bool {
+	s.mu.Lock()
+	k, ok := s.apiKeys[id]
+	if !ok || k.UserID != userID {
+		s.mu.Unlock()
+		return false
+	}
+	delete(s.apiKeys, id)
+	s.unpersist(recordAPIKey, id)
+	s.mu.Unlock()
+	s.saveAccounts()
+	return true
+}
+
+// DeleteAPIKeys revokes every key of the user and returns how many there
+// were.
+func (s *Store) DeleteAPIKeys(ctx context.Context, userID string) int {
+	s.mu.Lock()
+	n := s.deleteAPIKeysLocked(userID)
+	s.mu.Unlock()
+	if n > 0 {
+		s.saveAccounts()
+	}
+	return n
+}
+
+func (s *Store) deleteAPIKeysLocked(userID string) int {
+	n := 0
+	for id, k := range s.apiKeys {
+		if k.UserID == userID {
+			delete(s.apiKeys, id)
+			s.unpersist(recordAPIKey, id)
+			n++
+		}
+	}
+	return n
+}
+
+const apiKeyColumns = `id, user_id, name, secret_hash, created_at, last_used_at`
+
+func scanAPIKey(row rowScanner) (model.APIKey, error) {
+	var k model.APIKey
+	err := row.Scan(&k.ID, &k.UserID, &k.Name, &k.SecretHash, &k.CreatedAt, &k.LastUsedAt)
+	return k, err
+}
+
+func (p *PostgresStore) CreateAPIKey(ctx context.Context, userID, name, secretHash string, nowMillis int64) model.APIKey {
+	k := model.APIKey{
+		ID:         p.newID(),
+		UserID:     userID,
+		Name:       name,
+		SecretHash: secretHash,
+		CreatedAt:  nowMillis,
+		LastUsedAt: nowMillis,
+	}
+	_, err := p.db.ExecContext(ctx, `INSERT INTO api_keys (`+apiKeyColumns+`) VALUES ($1, $2, $3, $4, $5, $5)`,
+		k.ID, userID, name, secretHash, nowMillis)
+	if err != nil {
+		p.logError("create api key", err)
+	}
+	return k
+}
+
+func (p *PostgresStore) UseAPIKey(ctx context.Context, id, secretHash string, nowMillis int64) (model.APIKey, bool) {
+	k, err := scanAPIKey(p.db.QueryRowContext(ctx, `SELECT `+apiKeyColumns+` FROM api_keys WHERE id = $1`, id))
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			p.logError("use api key", err)
+		}
+		return model.APIKey{}, false
+	}
+	if !apiKeyMatches(k, secretHash) {
+		return model.APIKey{}, false
+	}
+	if nowMillis-k.LastUsedAt >= apiKeyTouchInterval {
+		k.LastUsedAt = nowMillis
+		if _, err := p.db.ExecContext(ctx, `UPDATE api_keys SET last_used_at = $2 WHERE id = $1`, id, nowMillis); err != nil {
+			p.logError("use api key", err)
+		}
+	}
+	return k, true
+}
+
+func (p *PostgresStore) ListAPIKeys(ctx context.Context, userID string) []model.APIKey {
+	rows, err := p.db.QueryContext(ctx, `SELECT `+apiKeyColumns+` FROM api_keys WHERE user_id = $1 ORDER BY created_at, id`, userID)
+	if err != nil {
+		p.logError("list api keys", err)
+		return []model.APIKey{}
+	}
+	defer rows.Close()
+
+	result := make([]model.APIKey, 0)
+	for rows.Next() {
+		k, err := scanAPIKey(rows)
+		if err != nil {
+			p.logError("scan api key", err)
+			break
+		}
+		result = append(result, k)
+	}
+	return result
+}
+
+func (p *PostgresStore) DeleteAPIKey(ctx context.Context, userID, id string) bool {
+	res, err := p.db.ExecContext(ctx, `DELETE FROM api_keys WHERE user_id = $1 AND id = $2`, userID, id)
+	if err != nil {
+		p.logError("delete api key", err)
+		return false
+	}
+	n, _ := res.RowsAffected()
+	return n > 0
+}
+
+func (p *PostgresStore) DeleteAPIKeys(ctx context.Context, userID string) int {
+	res, err := p.db.ExecContext(ctx, `DELETE FROM api_keys WHERE user_id = $1`, userID)
+	if err != nil {
+		p.logError("delete api keys", err)
+		return 0
+	}
+	n, _ := res.RowsAffected()
+	return int(n)
+}
+
+func (r *RedisStore) CreateAPIKey(ctx context.Context, userID, name, secretHash string, nowMillis int64) model.APIKey {
+	k := model.APIKey{
+		ID:         r.newID(),
+		UserID:     userID,
+		Name:       name,
+		SecretHash: secretHash,
+		CreatedAt:  nowMillis,
+		LastUsedAt: nowMillis,
+	}
+	err := r.client.watch(ctx, []string{r.apiKeyKey(k.ID)}, func(tx *redisTx) error {
+		tx.queue("SET", r.apiKeyKey(k.ID), redisJSON(k))
+		tx.queue("SADD", r.userSetKey(userID, "api-keys"), k.ID)
+		return nil
+	})
+	if err != nil {
+		r.logError("create api key", err)
+	}
+	return k
+}
+
+func (r *RedisStore) UseAPIKey(ctx context.Context, id, secretHash string, nowMillis int64) (model.APIKey, bool) {
+	var k model.APIKey
+	ok, err := getJSON(r.client.doFunc(ctx), r.apiKeyKey(id), &k)
+	if err != nil {
+		r.logError("use api key", err)
+		return model.APIKey{}, false
+	}
+	if !ok || !apiKeyMatches(k, secretHash) {
+		return model.APIKey{}, false
+	}
+	if nowMillis-k.LastUsedAt >= apiKeyTouchInterval {
+		k.LastUsedAt = nowMillis
+		// SET XX leaves a key deleted meanwhile deleted.
+		if _, err := r.client.do(ctx, "SET", r.apiKeyKey(id), redisJSON(k), "XX"); err != nil {
+			r.logError("use api key", err)
+		}
+	}
+	return k, true
+}
+
+func (r *RedisStore) ListAPIKeys(ctx context.Context, userID string) []model.APIKey {
+	keys, err := mgetJSON[model.APIKey](ctx, r, r.userSetKey(userID, "api-keys"), r.apiKeyKey)
+	if err != nil {
+		r.logError("list api keys", err)
+		return []model.APIKey{}
+	}
+	sortAPIKeys(keys)
+	return keys
+}
+
+func (r *RedisStore) DeleteAPIKey(ctx context.Context, userID, id string) bool {
+	var k model.APIKey
+	if ok, err := getJSON(r.client.doFunc(ctx), r.apiKeyKey(id), &k); err != nil || !ok || k.UserID != userID {
+		if err != nil {
+			r.logError("delete api key", err)
+		}
+		return false
+	}
+	if _, err := r.client.do(ctx, "DEL", r.apiKeyKey(id)); err != nil {
+		r.logError("delete api key", err)
+		return false
+	}
+	if _, err := r.client.do(ctx, "SREM", r.userSetKey(userID, "api-keys"), id); err != nil {
+		r.logError("delete api key", err)
+	}
+	return true
+}
+
+func (r *RedisStore) DeleteAPIKeys(ctx context.Context, userID string) int {
+	setKey := r.userSetKey(userID, "api-keys")
+	reply, err := r.client.do(ctx, "SMEMBERS", setKey)
+	if err != nil {
+		r.logError("delete api keys", err)
+		return 0
+	}
+	ids := redisStrings(reply)
+	args := []any{"DEL", setKey}
+	for _, id := range ids {
+		args = append(args, r.apiKeyKey(id))
+	}
+	if _, err := r.client.do(ctx, args...); err != nil {
+		r.logError("delete api keys", err)
+		return 0
+	}
+	return len(ids)
+}
@@ -0,0 +1,55 @@
+package store
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+)
+
+func TestStore_APIKeys(t *testing.T) {
+	ctx := context.Background()
+	s := New()
+	k := s.CreateAPIKey(ctx, "user-1", "ci", "h1", 1000)
+
+	if _, ok := s.UseAPIKey(ctx, k.ID, "wrong", 2000); ok {
+		t.Fatalf("expected a wrong secret to be rejected")
+	}
+	if _, ok := s.UseAPIKey(ctx, k.ID, "h1", 2000); !ok {
+		t.Fatalf("expected the key to be accepted")
+	}
+	if keys := s.ListAPIKeys(ctx, "user-1"); len(keys) != 1 || keys[0].LastUsedAt != 1000 {
+		t.Fatalf("expected a use within the touch interval not to be recorded: %+v", keys)
+	}
+	s.UseAPIKey(ctx, k.ID, "h1", 1000+apiKeyTouchInterval)
+	if keys := s.ListAPIKeys(ctx, "user-1"); keys[0].LastUsedAt != 1000+apiKeyTouchInterval {
+		t.Fatalf("expected the use to be recorded: %+v", keys)
+	}
+
+	other := s.CreateAPIKey(ctx, "user-2", "bot", "h2", 3000)
+	if s.DeleteAPIKey(ctx, "user-1", other.ID) {
+		t.Fatalf("expected a user not to delete another user's key")
+	}
+	s.CreateAPIKey(ctx, "user-1", "second", "h3", 3001)
+	if n := s.DeleteAPIKeys(ctx, "user-1"); n != 2 {
+		t.Fatalf("expected 2 keys deleted, got %d", n)
+	}
+	if _, ok := s.UseAPIKey(ctx, k.ID, "h1", 4000); ok {
+		t.Fatalf("expected a deleted key to be rejected")
+	}
+	if keys := s.ListAPIKeys(ctx, "user-2"); len(keys) != 1 {
+		t.Fatalf("expected user-2's key to stay: %+v", keys)
+	}
+}
+
+func TestStore_APIKeys_Persist(t *testing.T) {
+	ctx := context.Background()
+	opts := Options{AccountsStateFile: filepath.Join(t.TempDir(), "accounts-state.json")}
+
+	s1 := NewWithOptions(opts)
+	k := s1.CreateAPIKey(ctx, "user-1", "ci", "h1", 1000)
+
+	s2 := NewWithOptions(opts)
+	if used, ok := s2.UseAPIKey(ctx, k.ID, "h1", 2000); !ok || used.Name != "ci" {
+		t.Fatalf("expected the key to survive a reload: %+v %v", used, ok)
+	}
+}
@@ -1,6 +1,7 @@
 package store
 
 import (
+	"context"
 	"errors"
 	"sort"
 
@@ -19,11 +20,17 @@ type ArtifactUpdateResult struct {
 	CurrentBody          *string
 }
 
+// ArtifactChecksums are optional hex SHA-256 digests of the header and body.
+type ArtifactChecksums struct {
+	Header string
+	Body   string
+}
+
 func artifactKey(userID, artifactID string) string {
 	return userID + "|" + artifactID
 }
 
-func (s *Store) ListArtifacts(userID string) []model.Artifact {
+func (s *Store) ListArtifacts(ctx context.Context, userID string) []model.Artifact {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
@@ -42,7 +49,7 @@ func (s *Store) ListArtifacts(userID string) []model.Artifact {
 	return result
 }
 
-func (s *Store) GetArtifact(userID, artifactID string) (model.Artifact, bool) {
+func (s *Store) GetArtifact(ctx context.Context, userID, artifactID string) (model.Artifact, bool) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
@@ -53,7 +60,11 @@ func (s *Store) GetArtifact(userID, artifactID string) (model.Artifact, bool) {
 	return a, true
 }
 
-func (s *Store) CreateArtifact(userID, artifactID, header, body, dataEncryptionKey string, nowMillis int64) (model.Artifact, bool, error) {
+func (s *Store) CreateArtifact(ctx context.Context, userID, artifactID, header, body, dataEncryptionKey string, nowMillis int64) (model.Artifact, bool, error) {
+	return s.CreateArtifactWithChecksums(ctx, userID, artifactID, header, body, dataEncryptionKey, ArtifactChecksums{}, nowMillis)
+}
+
+func (s *Store) CreateArtifactWithChecksums(ctx context.Context, userID, artifactID, header, body, dataEncryptionKey string, sums ArtifactChecksums, nowMillis int64) (model.Artifact, bool, error) {
 	if userID == "" {
 		return model.Artifact{}, false, errors.New("missing user id")
 	}
@@ -63,9 +74,18 @@ func (s *Store) CreateArtifact(userID, artifactID, header, body, dataEncryptionK
 	if header == "" || body == "" || dataEncryptionKey == "" {
 		return model.Artifact{}, false, errors.New("missing artifact fields")
 	}
+	headerChecksum, err := verifyChecksum(header, sums.Header)
+	if err != nil {
+		return model.Artifact{}, false, err
+	}
+	bodyChecksum, err := verifyChecksum(body, sums.Body)
+	if err != nil {
+		return model.Artifact{}, false, err
+	}
 
 	s.mu.Lock()
-	defer s.mu.Unlock()
+	changed := false
+	defer s.unlockAndSaveArtifacts(&changed)
 
 	key := artifactKey(userID, artifactID)
 	if existing, ok := s.artifactsByKey[key]; ok && !existing.Deleted {
@@ -81,24 +101,50 @@ func (s *Store) CreateArtifact(userID, artifactID, header, body, dataEncryptionK
 		Body:             body,
 		BodyVersion:      1,
 		DataEncryptionKey: dataEncryptionKey,
+		HeaderChecksum:   headerChecksum,
+		BodyChecksum:     bodyChecksum,
 		Seq:              s.artifactSeq,
 		CreatedAt:        nowMillis,
 		UpdatedAt:        nowMillis,
 	}
 	s.artifactsByKey[key] = a
+	s.persist(recordArtifact, key, a)
+	changed = true
 	return a, true, nil
 }
 
-func (s *Store) UpdateArtifact(userID, artifactID string, header *string, expectedHeaderVersion *int, body *string, expectedBodyVersion *int, nowMillis int64) (ArtifactUpdateResult, error) {
+func (s *Store) UpdateArtifact(ctx context.Context, userID, artifactID string, header *string, expectedHeaderVersion *int, body *string, expectedBodyVersion *int, nowMillis int64) (ArtifactUpdateResult, error) {
+	return s.UpdateArtifactWithChecksums(ctx, userID, artifactID, header, expectedHeaderVersion, body, expectedBodyVersion, ArtifactChecksums{}, nowMillis)
+}
+
+// UpdateArtifactWithChecksums replaces the stored checksum of each part it
+// writes; a part written without one loses its previous checksum.
+func (s *Store) UpdateArtifactWithChecksums(ctx context.Context, userID, artifactID string, header *string, expectedHeaderVersion *int, body *string, expectedBodyVersion *int, sums ArtifactChecksums, nowMillis int64) (ArtifactUpdateResult, error) {
 	if userID == "" {
 		return ArtifactUpdateResult{}, errors.New("missing user id")
 	}
 	if artifactID == "" {
 		return ArtifactUpdateResult{}, errors.New("missing artifact id")
 	}
+	var headerChecksum, bodyChecksum string
+	if header != nil {
+		sum, err := verifyChecksum(*header, sums.Header)
+		if err != nil {
+			return ArtifactUpdateResult{}, err
+		}
+		headerChecksum = sum
+	}
+	if body != nil {
+		sum, err := verifyChecksum(*body, sums.Body)
+		if err != nil {
+			return ArtifactUpdateResult{}, err
+		}
+		bodyChecksum = sum
+	}
 
 	s.mu.Lock()
-	defer s.mu.Unlock()
+	changed := false
+	defer s.unlockAndSaveArtifacts(&changed)
 
 	key := artifactKey(userID, artifactID)
 	a, ok := s.artifactsByKey[key]
@@ -121,6 +167,7 @@ func (s *Store) UpdateArtifact(userID, artifactID string, header *string, expect
 			}, nil
 		}
 		a.Header = *header
+		a.HeaderChecksum = headerChecksum
 		a.HeaderVersion++
 	}
 
@@ -139,6 +186,7 @@ func (s *Store) UpdateArtifact(userID, artifactID string, header *string, expect
 			}, nil
 		}
 		a.Body = *body
+		a.BodyChecksum = bodyChecksum
 		a.BodyVersion++
 	}
 
@@ -147,6 +195,8 @@ func (s *Store) UpdateArtifact(userID, artifactID string, header *string, expect
 	s.artifactSeq++
 	a.Seq = s.artifactSeq
 	s.artifactsByKey[key] = a
+	s.persist(recordArtifact, key, a)
+	changed = true
 
 	res := ArtifactUpdateResult{Success: true}
 	if header != nil {
@@ -160,13 +210,14 @@ func (s *Store) UpdateArtifact(userID, artifactID string, header *string, expect
 	return res, nil
 }
 
-func (s *Store) DeleteArtifact(userID, artifactID string) bool {
+func (s *Store) DeleteArtifact(ctx context.Context, userID, artifactID string) bool {
 	if userID == "" || artifactID == "" {
 		return false
 	}
 
 	s.mu.Lock()
-	defer s.mu.Unlock()
+	changed := false
+	defer s.unlockAndSaveArtifacts(&changed)
 
 	key := artifactKey(userID, artifactID)
 	a, ok := s.artifactsByKey[key]
@@ -174,6 +225,9 @@ func (s *Store) DeleteArtifact(userID, artifactID string) bool {
 		return false
 	}
 	a.Deleted = true
+	a.UpdatedAt = s.nowMillis()
 	s.artifactsByKey[key] = a
+	s.persist(recordArtifact, key, a)
+	changed = true
 	return true
 }
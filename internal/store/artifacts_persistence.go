@@ -0,0 +1,89 @@
+package store
+
+import (
+	"log"
+	"sort"
+	"time"
+
+	"happy-server-lite/internal/model"
+)
+
+type persistedArtifactsFile struct {
+	Version   int              `json:"version"`
+	Artifacts []model.Artifact `json:"artifacts"`
+	// ArtifactSeq is the last seq handed out, which may belong to an
+	// artifact since purged.
+	ArtifactSeq int64 `json:"artifactSeq"`
+	SavedAt     int64 `json:"savedAt"`
+}
+
+// loadArtifactsFromFile reports whether the file was in an older format.
+func (s *Store) loadArtifactsFromFile(path string) (bool, error) {
+	var file persistedArtifactsFile
+	found, migrated, err := readStateFile(path, stateArtifacts, &file)
+	if err != nil || !found {
+		return false, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, a := range file.Artifacts {
+		if a.ID == "" || a.UserID == "" {
+			continue
+		}
+		s.artifactsByKey[artifactKey(a.UserID, a.ID)] = a
+		if a.Seq > s.artifactSeq {
+			s.artifactSeq = a.Seq
+		}
+	}
+	if file.ArtifactSeq > s.artifactSeq {
+		s.artifactSeq = file.ArtifactSeq
+	}
+	return migrated, nil
+}
+
+// unlockAndSaveArtifacts releases s.mu and, if *changed is set, rewrites the
+// artifacts state file.
+func (s *Store) unlockAndSaveArtifacts(changed *bool) {
+	s.mu.Unlock()
+	if *changed {
+		s.saveArtifacts()
+	}
+}
+
+// saveArtifacts snapshots artifacts while holding artifactsPersistMu, so the
+// last writer always writes the newest state.
+func (s *Store) saveArtifacts() {
+	if s.partitions != nil {
+		s.savePartitions()
+		return
+	}
+	path := s.artifactsStateFile
+	if path == "" {
+		return
+	}
+
+	s.artifactsPersistMu.Lock()
+	defer s.artifactsPersistMu.Unlock()
+
+	s.mu.RLock()
+	artifacts := make([]model.Artifact, 0, len(s.artifactsByKey))
+	for _, a := range s.artifactsByKey {
+		artifacts = append(artifacts, a)
+	}
+	seq := s.artifactSeq
+	s.mu.RUnlock()
+	sort.Slice(artifacts, func(i, j int) bool {
+		return artifactKey(artifacts[i].UserID, artifacts[i].ID) < artifactKey(artifacts[j].UserID, artifacts[j].ID)
+	})
+
+	file := persistedArtifactsFile{
+		Version:     stateVersions[stateArtifacts],
+		Artifacts:   artifacts,
+		ArtifactSeq: seq,
+		SavedAt:     time.Now().UnixMilli(),
+	}
+	if err := s.persistStats.artifactsFile.record(writeStateFile(path, file)); err != nil {
+		log.Printf("artifacts persistence: %v", err)
+	}
+}
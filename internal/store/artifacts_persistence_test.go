@@ -0,0 +1,64 @@
+package store
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStore_ArtifactsPersistence_RoundTrip(t *testing.T) {
+	ctx := context.Background()
+	stateFile := filepath.Join(t.TempDir(), "artifacts-state.json")
+	opts := Options{ArtifactsStateFile: stateFile}
+
+	s1 := NewWithOptions(opts)
+	if _, _, err := s1.CreateArtifact(ctx, "u1", "a1", "h", "b", "key", 1000); err != nil {
+		t.Fatalf("CreateArtifact: %v", err)
+	}
+	header := "h2"
+	one := 1
+	if res, err := s1.UpdateArtifact(ctx, "u1", "a1", &header, &one, nil, nil, 2000); err != nil || !res.Success {
+		t.Fatalf("UpdateArtifact: %+v (%v)", res, err)
+	}
+	s1.CreateArtifact(ctx, "u1", "a2", "h", "b", "key", 1000)
+	s1.DeleteArtifact(ctx, "u1", "a2")
+
+	s2 := NewWithOptions(opts)
+	got, ok := s2.GetArtifact(ctx, "u1", "a1")
+	if !ok || got.Header != "h2" || got.HeaderVersion != 2 || got.DataEncryptionKey != "key" || got.Seq != 2 {
+		t.Fatalf("unexpected artifact after reload: %+v", got)
+	}
+	if _, ok := s2.GetArtifact(ctx, "u1", "a2"); ok {
+		t.Fatalf("expected the deleted artifact to stay deleted")
+	}
+	a3, _, _ := s2.CreateArtifact(ctx, "u1", "a3", "h", "b", "key", 3000)
+	if a3.Seq != 4 {
+		t.Fatalf("expected artifact seqs to continue after reload, got %d", a3.Seq)
+	}
+	if stats := s2.Stats(); stats.Persistence.ArtifactsFile == nil || stats.Persistence.ArtifactsFile.LastSuccessAt == 0 {
+		t.Fatalf("expected artifacts file stats, got %+v", stats.Persistence)
+	}
+}
+
+func TestStore_ArtifactsPersistence_SeqSurvivesPurge(t *testing.T) {
+	ctx := context.Background()
+	stateFile := filepath.Join(t.TempDir(), "artifacts-state.json")
+	opts := Options{ArtifactsStateFile: stateFile, PurgeGrace: time.Millisecond}
+
+	s1 := NewWithOptions(opts)
+	s1.CreateArtifact(ctx, "u1", "a1", "h", "b", "key", 1000)
+	s1.DeleteArtifact(ctx, "u1", "a1")
+	if stats, _ := s1.Purge(ctx, time.Now().Add(time.Hour).UnixMilli()); stats.Artifacts != 1 {
+		t.Fatalf("expected the artifact purged, got %+v", stats)
+	}
+
+	s2 := NewWithOptions(opts)
+	if len(s2.ListArtifacts(ctx, "u1")) != 0 {
+		t.Fatalf("expected no artifacts after reload")
+	}
+	a, _, _ := s2.CreateArtifact(ctx, "u1", "a2", "h", "b", "key", 2000)
+	if a.Seq != 2 {
+		t.Fatalf("expected seqs of purged artifacts not to be reused, got %d", a.Seq)
+	}
+}
@@ -0,0 +1,105 @@
+package store
+
+import (
+	"context"
+	"strconv"
+)
+
+// IssueAuthChallenge records nonce as a challenge /v1/auth accepts once,
+// until expiresAt.
+func (s *Store) IssueAuthChallenge(ctx context.Context, nonce string, expiresAt int64) {
+	s.mu.Lock()
+	s.authChallenges[nonce] = expiresAt
+	s.mu.Unlock()
+}
+
+// UseAuthChallenge consumes nonce, reporting whether it was issued and had
+// neither expired nor been used.
+func (s *Store) UseAuthChallenge(ctx context.Context, nonce string, nowMillis int64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	expiresAt, ok := s.authChallenges[nonce]
+	if !ok {
+		return false
+	}
+	delete(s.authChallenges, nonce)
+	return nowMillis < expiresAt
+}
+
+// expireAuthChallengesLocked drops challenges past their expiry, so ones
+// never used do not pile up.
+func (s *Store) expireAuthChallengesLocked(nowMillis int64) int {
+	n := 0
+	for nonce, expiresAt := range s.authChallenges {
+		if nowMillis >= expiresAt {
+			delete(s.authChallenges, nonce)
+			n++
+		}
+	}
+	return n
+}
+
+func (p *PostgresStore) IssueAuthChallenge(ctx context.Context, nonce string, expiresAt int64) {
+	if _, err := p.db.ExecContext(ctx, `INSERT INTO auth_challenges (nonce, expires_at) VALUES ($1, $2)`, nonce, expiresAt); err != nil {
+		p.logError("issue auth challenge", err)
+	}
+}
+
+func (p *PostgresStore) UseAuthChallenge(ctx context.Context, nonce string, nowMillis int64) bool {
+	res, err := p.db.ExecContext(ctx, `DELETE FROM auth_challenges WHERE nonce = $1 AND expires_at > $2`, nonce, nowMillis)
+	if err != nil {
+		p.logError("use auth challenge", err)
+		return false
+	}
+	n, _ := res.RowsAffected()
+	return n > 0
+}
+
+func (r *RedisStore) IssueAuthChallenge(ctx context.Context, nonce string, expiresAt int64) {
+	if _, err := r.client.do(ctx, "SET", r.authChallengeKey(nonce), strconv.FormatInt(expiresAt, 10)); err != nil {
+		r.logError("issue auth challenge", err)
+	}
+}
+
+func (r *RedisStore) UseAuthChallenge(ctx context.Context, nonce string, nowMillis int64) bool {
+	key := r.authChallengeKey(nonce)
+	used := false
+	err := r.client.watch(ctx, []string{key}, func(tx *redisTx) error {
+		var expiresAt int64
+		ok, err := getJSON(tx.do, key, &expiresAt)
+		if err != nil || !ok {
+			used = false
+			return err
+		}
+		used = nowMillis < expiresAt
+		tx.queue("DEL", key)
+		return nil
+	})
+	if err != nil {
+		r.logError("use auth challenge", err)
+		return false
+	}
+	return used
+}
+
+func (r *RedisStore) expireAuthChallenges(ctx context.Context, nowMillis int64) error {
+	keys, err := r.scanKeys(ctx, redisGlobEscape(r.prefix)+"auth-challenge:*")
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		err := r.client.watch(ctx, []string{key}, func(tx *redisTx) error {
+			var expiresAt int64
+			ok, err := getJSON(tx.do, key, &expiresAt)
+			if err != nil || !ok || nowMillis < expiresAt {
+				return err
+			}
+			tx.queue("DEL", key)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
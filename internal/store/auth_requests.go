@@ -0,0 +1,153 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"happy-server-lite/internal/model"
+)
+
+const defaultAuthRequestTTL = 10 * time.Minute
+
+// AuthRequestExpirer is implemented by stores that can drop auth requests
+// nobody has touched within Options.AuthRequestTTL.
+type AuthRequestExpirer interface {
+	// ExpireAuthRequests removes auth requests last updated more than the
+	// TTL before nowMillis, and auth challenges past their expiry, and
+	// returns how many requests it removed.
+	ExpireAuthRequests(ctx context.Context, nowMillis int64) (int, error)
+}
+
+var (
+	_ AuthRequestExpirer = (*Store)(nil)
+	_ AuthRequestExpirer = (*PostgresStore)(nil)
+	_ AuthRequestExpirer = (*RedisStore)(nil)
+)
+
+// authRequestCutoff is the oldest UpdatedAt an auth request may have and
+// still be kept. Polls refresh UpdatedAt, so a device still waiting keeps
+// its request alive.
+func authRequestCutoff(ttl time.Duration, nowMillis int64) int64 {
+	if ttl <= 0 {
+		ttl = defaultAuthRequestTTL
+	}
+	return nowMillis - ttl.Milliseconds()
+}
+
+// ExpireAuthRequests drops pending, rejected and unclaimed authorized
+// requests older than Options.AuthRequestTTL.
+func (s *Store) ExpireAuthRequests(ctx context.Context, nowMillis int64) (int, error) {
+	cutoff := authRequestCutoff(s.authRequestTTL, nowMillis)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expireAuthChallengesLocked(nowMillis)
+	n := 0
+	for key, req := range s.authRequestsByKey {
+		if req.UpdatedAt >= cutoff {
+			continue
+		}
+		delete(s.authRequestsByKey, key)
+		s.unpersist(recordAuthRequest, key)
+		n++
+	}
+	return n, nil
+}
+
+// ClaimAuthRequest removes the authorized request for publicKey and returns
+// it with its token, so a token is handed out once. It reports false when
+// the request is missing or not authorized.
+func (s *Store) ClaimAuthRequest(ctx context.Context, publicKey string) (model.AuthRequest, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	req, ok := s.authRequestsByKey[publicKey]
+	if !ok || req.Token == "" {
+		return model.AuthRequest{}, false
+	}
+	delete(s.authRequestsByKey, publicKey)
+	s.unpersist(recordAuthRequest, publicKey)
+	return req, true
+}
+
+func (p *PostgresStore) ExpireAuthRequests(ctx context.Context, nowMillis int64) (int, error) {
+	if _, err := p.db.ExecContext(ctx, `DELETE FROM auth_challenges WHERE expires_at <= $1`, nowMillis); err != nil {
+		return 0, err
+	}
+	res, err := p.db.ExecContext(ctx, `DELETE FROM auth_requests WHERE updated_at < $1`, authRequestCutoff(p.authRequestTTL, nowMillis))
+	if err != nil {
+		return 0, err
+	}
+	n, _ := res.RowsAffected()
+	return int(n), nil
+}
+
+func (p *PostgresStore) ClaimAuthRequest(ctx context.Context, publicKey string) (model.AuthRequest, bool) {
+	req, err := scanAuthRequest(p.db.QueryRowContext(ctx, `DELETE FROM auth_requests WHERE public_key = $1 AND token <> ''
+		RETURNING `+authRequestColumns, publicKey))
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			p.logError("claim auth request", err)
+		}
+		return model.AuthRequest{}, false
+	}
+	return req, true
+}
+
+func (r *RedisStore) ExpireAuthRequests(ctx context.Context, nowMillis int64) (int, error) {
+	if err := r.expireAuthChallenges(ctx, nowMillis); err != nil {
+		return 0, err
+	}
+	cutoff := authRequestCutoff(r.authRequestTTL, nowMillis)
+	keys, err := r.scanKeys(ctx, redisGlobEscape(r.prefix)+"auth-request:*")
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, key := range keys {
+		expired := false
+		err := r.client.watch(ctx, []string{key}, func(tx *redisTx) error {
+			var req model.AuthRequest
+			ok, err := getJSON(tx.do, key, &req)
+			expired = ok && req.UpdatedAt < cutoff
+			if err != nil || !expired {
+				return err
+			}
+			tx.queue("DEL", key)
+			return nil
+		})
+		if err != nil {
+			return n, err
+		}
+		if expired {
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (r *RedisStore) ClaimAuthRequest(ctx context.Context, publicKey string) (model.AuthRequest, bool) {
+	key := r.authRequestKey(publicKey)
+	var req model.AuthRequest
+	claimed := false
+	err := r.client.watch(ctx, []string{key}, func(tx *redisTx) error {
+		req = model.AuthRequest{}
+		ok, err := getJSON(tx.do, key, &req)
+		claimed = ok && req.Token != ""
+		if err != nil || !claimed {
+			return err
+		}
+		tx.queue("DEL", key)
+		return nil
+	})
+	if err != nil {
+		r.logError("claim auth request", err)
+		return model.AuthRequest{}, false
+	}
+	if !claimed {
+		return model.AuthRequest{}, false
+	}
+	return req, true
+}
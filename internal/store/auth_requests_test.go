@@ -0,0 +1,108 @@
+package store
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func testAuthRequestExpiry(t *testing.T, s interface {
+	Storage
+	AuthRequestExpirer
+}) {
+	t.Helper()
+	ctx := context.Background()
+	s.UpsertAuthRequest(ctx, "stale", false, nil, 1000)
+	s.UpsertAuthRequest(ctx, "polled", false, nil, 1000)
+	s.UpsertAuthRequest(ctx, "polled", false, nil, 50_000)
+
+	n, err := s.ExpireAuthRequests(ctx, 62_000)
+	if err != nil || n != 1 {
+		t.Fatalf("ExpireAuthRequests: %d %v", n, err)
+	}
+	if _, ok := s.GetAuthRequest(ctx, "stale"); ok {
+		t.Fatalf("expected the stale request to expire")
+	}
+	if _, ok := s.GetAuthRequest(ctx, "polled"); !ok {
+		t.Fatalf("expected a request polled within the TTL to be kept")
+	}
+}
+
+func testClaimAuthRequest(t *testing.T, s Storage) {
+	t.Helper()
+	ctx := context.Background()
+	s.UpsertAuthRequest(ctx, "pk", false, nil, 1000)
+	if _, ok := s.ClaimAuthRequest(ctx, "pk"); ok {
+		t.Fatalf("expected a pending request not to be claimable")
+	}
+	s.AuthorizeAuthRequest(ctx, "pk", "resp", "user-1", "tok", 2000)
+	req, ok := s.ClaimAuthRequest(ctx, "pk")
+	if !ok || req.Token != "tok" || req.ResponseAccountID != "user-1" {
+		t.Fatalf("unexpected claim: %+v %v", req, ok)
+	}
+	if _, ok := s.ClaimAuthRequest(ctx, "pk"); ok {
+		t.Fatalf("expected the token to be claimable once")
+	}
+	if _, ok := s.GetAuthRequest(ctx, "pk"); ok {
+		t.Fatalf("expected the claimed request to be removed")
+	}
+}
+
+func TestStore_AuthRequestExpiry(t *testing.T) {
+	testAuthRequestExpiry(t, NewWithOptions(Options{AuthRequestTTL: time.Minute}))
+}
+
+func TestRedisStore_AuthRequestExpiry(t *testing.T) {
+	f := newFakeRedis(t)
+	r, err := OpenRedis(RedisOptions{URL: f.URL()}, Options{AuthRequestTTL: time.Minute})
+	if err != nil {
+		t.Fatalf("OpenRedis: %v", err)
+	}
+	testAuthRequestExpiry(t, r)
+}
+
+func TestStore_ClaimAuthRequest(t *testing.T) {
+	testClaimAuthRequest(t, New())
+}
+
+func TestRedisStore_ClaimAuthRequest(t *testing.T) {
+	testClaimAuthRequest(t, openFakeRedisStore(t, 0))
+}
+
+func testAuthChallenges(t *testing.T, s interface {
+	Storage
+	AuthRequestExpirer
+}) {
+	t.Helper()
+	ctx := context.Background()
+	s.IssueAuthChallenge(ctx, "n1", 10_000)
+	s.IssueAuthChallenge(ctx, "n2", 10_000)
+	s.IssueAuthChallenge(ctx, "n3", 10_000)
+
+	if s.UseAuthChallenge(ctx, "unknown", 1000) {
+		t.Fatalf("expected a challenge never issued to be rejected")
+	}
+	if !s.UseAuthChallenge(ctx, "n1", 1000) {
+		t.Fatalf("expected an issued challenge to be accepted")
+	}
+	if s.UseAuthChallenge(ctx, "n1", 1000) {
+		t.Fatalf("expected a challenge to be accepted once")
+	}
+	if s.UseAuthChallenge(ctx, "n2", 10_000) {
+		t.Fatalf("expected an expired challenge to be rejected")
+	}
+	if _, err := s.ExpireAuthRequests(ctx, 10_000); err != nil {
+		t.Fatalf("ExpireAuthRequests: %v", err)
+	}
+	if s.UseAuthChallenge(ctx, "n3", 0) {
+		t.Fatalf("expected expired challenges to be dropped")
+	}
+}
+
+func TestStore_AuthChallenges(t *testing.T) {
+	testAuthChallenges(t, New())
+}
+
+func TestRedisStore_AuthChallenges(t *testing.T) {
+	testAuthChallenges(t, openFakeRedisStore(t, 0))
+}
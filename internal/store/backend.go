@@ -0,0 +1,280 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+
+	"happy-server-lite/internal/model"
+)
+
+// Backend durably mirrors the store. The in-memory maps stay authoritative
+// while the process runs; every change is written through as a JSON record
+// and the maps are rebuilt from Load on start.
+type Backend interface {
+	Load() ([]Record, error)
+	Put(r Record) error
+	Delete(kind, key string) error
+	// DeletePrefix removes every record of kind whose key starts with prefix.
+	DeletePrefix(kind, prefix string) error
+}
+
+type Record struct {
+	Kind string
+	Key  string
+	Data []byte
+	// Owner is the user a session, machine or message record belongs to,
+	// empty for the rest. Backends that are not a UserBackend may drop it.
+	Owner string
+}
+
+// UserBackend is a Backend that also loads records by owner, so a store can
+// leave users' sessions, machines and messages out of its start and load
+// them on first access (see Options.HydratedUsers).
+type UserBackend interface {
+	Backend
+	// LoadShared returns every record without an owner.
+	LoadShared() ([]Record, error)
+	// LoadUser returns every record owned by userID.
+	LoadUser(userID string) ([]Record, error)
+}
+
+const (
+	recordAccount     = "account"
+	recordAuthRequest = "auth-request"
+	recordSession     = "session"
+	recordMessage     = "message"
+	recordMachine     = "machine"
+	recordArtifact    = "artifact"
+	recordSettings    = "settings"
+	recordTombstone   = "tombstone"
+	recordDisabled    = "account-disabled"
+	recordGitHub      = "github"
+	recordPushToken   = "push-token"
+	// recordRefreshToken is keyed by the grant id alone, as refreshes look
+	// it up without knowing the user.
+	recordRefreshToken = "refresh-token"
+	// recordAPIKey is keyed by the key id alone, for the same reason.
+	recordAPIKey = "api-key"
+	// recordDevice is keyed by the device id alone, as token checks look
+	// it up by the id in the token.
+	recordDevice = "device"
+)
+
+// messageKey sorts a session's messages by seq under a plain string order.
+func messageKey(sessionID string, seq int64) string {
+	return fmt.Sprintf("%s|%020d", sessionID, seq)
+}
+
+func (s *Store) persist(kind, key string, v any) {
+	s.persistOwned(kind, key, "", v)
+}
+
+// persistMessage writes msg through with userID, the owner of its session,
+// as the record's owner.
+func (s *Store) persistMessage(userID string, msg model.SessionMessage) {
+	s.persistOwned(recordMessage, messageKey(msg.SessionID, msg.Seq), userID, msg)
+}
+
+func (s *Store) persistOwned(kind, key, owner string, v any) {
+	if s.backend == nil {
+		return
+	}
+	switch rec := v.(type) {
+	case model.Session:
+		v = s.compressSession(rec)
+		owner = rec.UserID
+	case model.Machine:
+		v = s.compressMachine(rec)
+		owner = rec.UserID
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		s.persistStats.backend.record(err)
+		log.Printf("store persistence: marshal %s %s failed: %v", kind, key, err)
+		return
+	}
+	if err := s.persistStats.backend.record(s.backend.Put(Record{Kind: kind, Key: key, Data: data, Owner: owner})); err != nil {
+		log.Printf("store persistence: put %s %s failed: %v", kind, key, err)
+	}
+}
+
+func (s *Store) unpersist(kind, key string) {
+	if s.backend == nil {
+		return
+	}
+	if err := s.persistStats.backend.record(s.backend.Delete(kind, key)); err != nil {
+		log.Printf("store persistence: delete %s %s failed: %v", kind, key, err)
+	}
+}
+
+func (s *Store) unpersistMessages(sessionID string) {
+	if s.backend == nil {
+		return
+	}
+	if err := s.persistStats.backend.record(s.backend.DeletePrefix(recordMessage, sessionID+"|")); err != nil {
+		log.Printf("store persistence: delete messages of %s failed: %v", sessionID, err)
+	}
+}
+
+func (s *Store) loadBackend() error {
+	if s.hydration != nil {
+		return s.loadSharedRecords()
+	}
+	records, err := s.backend.Load()
+	if err != nil {
+		return err
+	}
+	sort.Slice(records, func(i, j int) bool {
+		if records[i].Kind != records[j].Kind {
+			return records[i].Kind < records[j].Kind
+		}
+		return records[i].Key < records[j].Key
+	})
+
+	s.lockAll()
+	defer s.unlockAll()
+	for _, r := range records {
+		if err := s.loadRecordLocked(r); err != nil {
+			return fmt.Errorf("%s %s: %w", r.Kind, r.Key, err)
+		}
+	}
+	s.rekeyRecordsLocked(records)
+	return nil
+}
+
+// rekeyRecordsLocked moves machine and machine tombstone records written
+// before machine ids were namespaced by user, when they were keyed by the
+// machine id alone, to the keys the store now uses.
+func (s *Store) rekeyRecordsLocked(records []Record) {
+	for _, r := range records {
+		var key string
+		var v any
+		switch r.Kind {
+		case recordMachine:
+			var m model.Machine
+			if json.Unmarshal(r.Data, &m) != nil {
+				continue
+			}
+			key = machineKey(m.UserID, m.ID)
+			v, _ = s.shard(m.UserID).records(m.UserID).machine(m.ID)
+		case recordTombstone:
+			var t model.Tombstone
+			if json.Unmarshal(r.Data, &t) != nil {
+				continue
+			}
+			key = tombstoneKey(t)
+			v = s.tombstones[key]
+		default:
+			continue
+		}
+		if key == r.Key {
+			continue
+		}
+		s.persist(r.Kind, key, v)
+		s.unpersist(r.Kind, r.Key)
+	}
+}
+
+func (s *Store) loadRecordLocked(r Record) error {
+	switch r.Kind {
+	case recordAccount:
+		var acc model.Account
+		if err := json.Unmarshal(r.Data, &acc); err != nil {
+			return err
+		}
+		s.accountsByPublicKey[acc.PublicKey] = acc
+	case recordAuthRequest:
+		var req model.AuthRequest
+		if err := json.Unmarshal(r.Data, &req); err != nil {
+			return err
+		}
+		s.authRequestsByKey[req.PublicKey] = req
+	case recordSession:
+		var sess model.Session
+		if err := json.Unmarshal(r.Data, &sess); err != nil {
+			return err
+		}
+		sess, err := decompressSession(sess)
+		if err != nil {
+			return err
+		}
+		s.putSessionLocked(sess)
+	case recordMessage:
+		var msg model.SessionMessage
+		if err := json.Unmarshal(r.Data, &msg); err != nil {
+			return err
+		}
+		s.messages.put(msg)
+		if msg.Seq > s.seq.perSession[msg.SessionID] {
+			s.seq.perSession[msg.SessionID] = msg.Seq
+		}
+	case recordMachine:
+		var m model.Machine
+		if err := json.Unmarshal(r.Data, &m); err != nil {
+			return err
+		}
+		m, err := decompressMachine(m)
+		if err != nil {
+			return err
+		}
+		s.putMachineLocked(m)
+	case recordArtifact:
+		var a model.Artifact
+		if err := json.Unmarshal(r.Data, &a); err != nil {
+			return err
+		}
+		s.artifactsByKey[artifactKey(a.UserID, a.ID)] = a
+		if a.Seq > s.artifactSeq {
+			s.artifactSeq = a.Seq
+		}
+	case recordSettings:
+		var st accountSettings
+		if err := json.Unmarshal(r.Data, &st); err != nil {
+			return err
+		}
+		s.accountSettingsByUserID[r.Key] = st
+	case recordDisabled:
+		s.disabledAccounts[r.Key] = true
+	case recordGitHub:
+		var identity model.GitHubIdentity
+		if err := json.Unmarshal(r.Data, &identity); err != nil {
+			return err
+		}
+		s.githubByUserID[r.Key] = identity
+	case recordTombstone:
+		var t model.Tombstone
+		if err := json.Unmarshal(r.Data, &t); err != nil {
+			return err
+		}
+		s.tombstones[tombstoneKey(t)] = t
+	case recordPushToken:
+		var pt model.PushToken
+		if err := json.Unmarshal(r.Data, &pt); err != nil {
+			return err
+		}
+		s.pushTokens[pushTokenKey(pt.UserID, pt.Token)] = pt
+	case recordRefreshToken:
+		var rt model.RefreshToken
+		if err := json.Unmarshal(r.Data, &rt); err != nil {
+			return err
+		}
+		s.refreshTokens[rt.ID] = rt
+	case recordAPIKey:
+		var k model.APIKey
+		if err := json.Unmarshal(r.Data, &k); err != nil {
+			return err
+		}
+		s.apiKeys[k.ID] = k
+	case recordDevice:
+		var d model.Device
+		if err := json.Unmarshal(r.Data, &d); err != nil {
+			return err
+		}
+		s.devices[d.ID] = d
+	case recordMetrics:
+		return s.loadMetricsRecord(r)
+	}
+	return nil
+}
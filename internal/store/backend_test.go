@@ -0,0 +1,142 @@
+package store
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+
+	"happy-server-lite/internal/model"
+)
+
+// memBackend is a Backend kept in a map, standing in for SQLite.
+type memBackend struct {
+	mu      sync.Mutex
+	records map[string]Record
+}
+
+func newMemBackend() *memBackend {
+	return &memBackend{records: make(map[string]Record)}
+}
+
+func (b *memBackend) Load() ([]Record, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	out := make([]Record, 0, len(b.records))
+	for _, r := range b.records {
+		out = append(out, r)
+	}
+	return out, nil
+}
+
+func (b *memBackend) LoadShared() ([]Record, error) {
+	return b.LoadUser("")
+}
+
+func (b *memBackend) LoadUser(userID string) ([]Record, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var out []Record
+	for _, r := range b.records {
+		if r.Owner == userID {
+			out = append(out, r)
+		}
+	}
+	return out, nil
+}
+
+func (b *memBackend) Put(r Record) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.records[r.Kind+"/"+r.Key] = r
+	return nil
+}
+
+func (b *memBackend) Delete(kind, key string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.records, kind+"/"+key)
+	return nil
+}
+
+func (b *memBackend) DeletePrefix(kind, prefix string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for k, r := range b.records {
+		if r.Kind == kind && strings.HasPrefix(r.Key, prefix) {
+			delete(b.records, k)
+		}
+	}
+	return nil
+}
+
+func TestStore_BackendRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	backend := newMemBackend()
+	s1 := NewWithOptions(Options{Backend: backend})
+	now := int64(1000)
+
+	acc, _ := s1.GetOrCreateAccount(ctx, "pk", now)
+	s1.UpsertAuthRequest(ctx, "pk", true, &model.AuthRequestDevice{Platform: "darwin"}, now)
+	s1.UpdateAccountSettings(ctx, acc.ID, 0, "settings", now)
+	s1.AddPushToken(ctx, acc.ID, "t1", "", now)
+	sess, _, err := s1.GetOrCreateSession(ctx, acc.ID, "tag", "meta", nil, nil, now)
+	if err != nil {
+		t.Fatalf("GetOrCreateSession: %v", err)
+	}
+	for _, c := range []string{"c1", "c2"} {
+		if _, err := s1.AppendMessage(ctx, acc.ID, sess.ID, c, now); err != nil {
+			t.Fatalf("AppendMessage: %v", err)
+		}
+	}
+	gone, _, _ := s1.GetOrCreateSession(ctx, acc.ID, "gone", "meta", nil, nil, now)
+	s1.AppendMessage(ctx, acc.ID, gone.ID, "lost", now)
+	s1.DeleteSession(ctx, acc.ID, gone.ID, now)
+	s1.UpsertMachine(ctx, acc.ID, "m1", "meta", nil, nil, now)
+	s1.UpdateMachineMetadata(ctx, acc.ID, "m1", 1, "meta2", now)
+	if _, _, err := s1.CreateArtifact(ctx, acc.ID, "a1", "h", "b", "k", now); err != nil {
+		t.Fatalf("CreateArtifact: %v", err)
+	}
+
+	s2 := NewWithOptions(Options{Backend: backend})
+	if got, created := s2.GetOrCreateAccount(ctx, "pk", now); created || got.ID != acc.ID {
+		t.Fatalf("expected account %s to survive, got %+v (created=%v)", acc.ID, got, created)
+	}
+	if req, ok := s2.GetAuthRequest(ctx, "pk"); !ok || !req.SupportsV2 || req.Device == nil || req.Device.Platform != "darwin" {
+		t.Fatalf("expected auth request to survive, got %+v", req)
+	}
+	if settings, version := s2.GetAccountSettings(ctx, acc.ID); version != 1 || settings == nil || *settings != "settings" {
+		t.Fatalf("unexpected settings: %v %d", settings, version)
+	}
+	if tokens := s2.ListPushTokens(ctx, acc.ID); len(tokens) != 1 || tokens[0].Token != "t1" {
+		t.Fatalf("expected push token to survive, got %+v", tokens)
+	}
+	if sessions := s2.ListSessions(ctx, acc.ID); len(sessions) != 1 || sessions[0].ID != sess.ID {
+		t.Fatalf("expected only the live session, got %+v", sessions)
+	}
+	if same, created, _ := s2.GetOrCreateSession(ctx, acc.ID, "tag", "", nil, nil, now); created || same.ID != sess.ID {
+		t.Fatalf("expected tag lookup to find the loaded session")
+	}
+	msgs, err := s2.ListMessages(ctx, acc.ID, sess.ID, 0, 10)
+	if err != nil || len(msgs) != 2 || msgs[0].Content != "c1" || msgs[1].Seq != 2 {
+		t.Fatalf("unexpected messages: %+v (%v)", msgs, err)
+	}
+	next, err := s2.AppendMessage(ctx, acc.ID, sess.ID, "c3", now)
+	if err != nil || next.Seq != 3 {
+		t.Fatalf("expected seq to continue at 3, got %d (%v)", next.Seq, err)
+	}
+	if m, ok := s2.GetMachine(ctx, acc.ID, "m1"); !ok || m.Metadata != "meta2" || m.MetadataVersion != 2 {
+		t.Fatalf("unexpected machine: %+v", m)
+	}
+	if a, ok := s2.GetArtifact(ctx, acc.ID, "a1"); !ok || a.Header != "h" {
+		t.Fatalf("unexpected artifact: %+v", a)
+	}
+	if ts := s2.ListTombstones(ctx, acc.ID, 0, now); len(ts) != 1 || ts[0].ID != gone.ID {
+		t.Fatalf("expected session tombstone to survive, got %+v", ts)
+	}
+	for _, r := range backend.records {
+		if r.Kind == recordMessage && strings.HasPrefix(r.Key, gone.ID+"|") {
+			t.Fatalf("expected messages of deleted session to be removed")
+		}
+	}
+}
@@ -0,0 +1,253 @@
+package store
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"happy-server-lite/internal/model"
+)
+
+// Backups are gzip-compressed JSON lines: a header followed by one line per
+// record, using the same kinds and keys a Backend sees. State strings are
+// written uncompressed so a backup restores under any compression setting.
+const (
+	backupFormat  = "happy-server-lite-backup"
+	backupVersion = 1
+)
+
+// Archiver is implemented by stores that can write and restore backups.
+type Archiver interface {
+	Export(w io.Writer) error
+	Import(r io.Reader) error
+}
+
+var _ Archiver = (*Store)(nil)
+
+// ErrStoreNotEmpty is returned by Import when the store already holds data.
+var ErrStoreNotEmpty = errors.New("store is not empty")
+
+// ErrInvalidBackup is returned by Import for archives it cannot read.
+var ErrInvalidBackup = errors.New("invalid backup")
+
+type backupHeader struct {
+	Format    string `json:"format"`
+	Version   int    `json:"version"`
+	CreatedAt int64  `json:"createdAt"`
+}
+
+type backupRecord struct {
+	Kind string          `json:"kind"`
+	Key  string          `json:"key"`
+	Data json.RawMessage `json:"data"`
+}
+
+// Export writes a snapshot of every account, auth request, session, message,
+// machine, artifact, setting, push token and tombstone to w.
+func (s *Store) Export(w io.Writer) error {
+	records, err := s.snapshotRecords()
+	if err != nil {
+		return err
+	}
+
+	zw := gzip.NewWriter(w)
+	enc := json.NewEncoder(zw)
+	if err := enc.Encode(backupHeader{Format: backupFormat, Version: backupVersion, CreatedAt: s.nowMillis()}); err != nil {
+		return err
+	}
+	for _, r := range records {
+		if err := enc.Encode(backupRecord{Kind: r.Kind, Key: r.Key, Data: r.Data}); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+func (s *Store) snapshotRecords() ([]Record, error) {
+	if s.hydration != nil {
+		return s.backendSnapshot()
+	}
+	var records []Record
+	add := func(kind, key string, v any) error {
+		data, err := json.Marshal(v)
+		if err != nil {
+			return fmt.Errorf("%s %s: %w", kind, key, err)
+		}
+		records = append(records, Record{Kind: kind, Key: key, Data: data})
+		return nil
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var err error
+	for key, acc := range s.accountsByPublicKey {
+		err = errors.Join(err, add(recordAccount, key, acc))
+	}
+	for userID := range s.disabledAccounts {
+		err = errors.Join(err, add(recordDisabled, userID, true))
+	}
+	for userID, identity := range s.githubByUserID {
+		err = errors.Join(err, add(recordGitHub, userID, identity))
+	}
+	for key, req := range s.authRequestsByKey {
+		err = errors.Join(err, add(recordAuthRequest, key, req))
+	}
+	s.eachSession(func(sess model.Session) {
+		err = errors.Join(err, add(recordSession, sess.ID, sess))
+	})
+	for _, msg := range s.messages.snapshot() {
+		err = errors.Join(err, add(recordMessage, messageKey(msg.SessionID, msg.Seq), msg))
+	}
+	s.eachMachine(func(m model.Machine) {
+		err = errors.Join(err, add(recordMachine, machineKey(m.UserID, m.ID), m))
+	})
+	for key, a := range s.artifactsByKey {
+		err = errors.Join(err, add(recordArtifact, key, a))
+	}
+	for userID, st := range s.accountSettingsByUserID {
+		err = errors.Join(err, add(recordSettings, userID, st))
+	}
+	for key, pt := range s.pushTokens {
+		err = errors.Join(err, add(recordPushToken, key, pt))
+	}
+	for id, rt := range s.refreshTokens {
+		err = errors.Join(err, add(recordRefreshToken, id, rt))
+	}
+	for id, k := range s.apiKeys {
+		err = errors.Join(err, add(recordAPIKey, id, k))
+	}
+	for id, d := range s.devices {
+		err = errors.Join(err, add(recordDevice, id, d))
+	}
+	s.tombstonesMu.Lock()
+	for key, t := range s.tombstones {
+		err = errors.Join(err, add(recordTombstone, key, t))
+	}
+	s.tombstonesMu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	sortRecords(records)
+	return records, nil
+}
+
+func sortRecords(records []Record) {
+	sort.Slice(records, func(i, j int) bool {
+		if records[i].Kind != records[j].Kind {
+			return records[i].Kind < records[j].Kind
+		}
+		return records[i].Key < records[j].Key
+	})
+}
+
+// Import loads a backup written by Export into an empty store and writes it
+// through to the configured backend, state files and message journal.
+func (s *Store) Import(r io.Reader) error {
+	records, err := readBackup(r)
+	if err != nil {
+		return err
+	}
+
+	s.lockAll()
+	if !s.emptyLocked() {
+		s.unlockAll()
+		return ErrStoreNotEmpty
+	}
+	for _, rec := range records {
+		if err := s.loadRecordLocked(rec); err != nil {
+			s.resetLocked(records)
+			s.unlockAll()
+			return fmt.Errorf("%w: %s %s: %v", ErrInvalidBackup, rec.Kind, rec.Key, err)
+		}
+	}
+	if s.backend != nil {
+		assignOwners(records)
+		for _, rec := range records {
+			if err := s.backend.Put(rec); err != nil {
+				s.unlockAll()
+				return fmt.Errorf("write %s %s: %w", rec.Kind, rec.Key, err)
+			}
+		}
+		s.rekeyRecordsLocked(records)
+	}
+	s.unlockAll()
+
+	s.reconcileSessionSeqs()
+	s.saveAccounts()
+	s.saveMachines()
+	s.saveSessions()
+	s.saveArtifacts()
+	s.CompactJournals()
+	s.enforceMemoryBudget()
+	return nil
+}
+
+// readBackup decodes an archive written by Export into records sorted by
+// kind and key.
+func readBackup(r io.Reader) ([]Record, error) {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidBackup, err)
+	}
+	defer zr.Close()
+
+	dec := json.NewDecoder(bufio.NewReader(zr))
+	var header backupHeader
+	if err := dec.Decode(&header); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidBackup, err)
+	}
+	if header.Format != backupFormat || header.Version != backupVersion {
+		return nil, fmt.Errorf("%w: unsupported format %q version %d", ErrInvalidBackup, header.Format, header.Version)
+	}
+	var records []Record
+	for {
+		var br backupRecord
+		if err := dec.Decode(&br); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidBackup, err)
+		}
+		records = append(records, Record{Kind: br.Kind, Key: br.Key, Data: br.Data})
+	}
+	sortRecords(records)
+	return records, nil
+}
+
+func (s *Store) emptyLocked() bool {
+	return len(s.accountsByPublicKey) == 0 && len(s.authRequestsByKey) == 0 &&
+		s.usersEmptyLocked() && len(s.artifactsByKey) == 0 && len(s.accountSettingsByUserID) == 0
+}
+
+// resetLocked drops a partially imported backup.
+func (s *Store) resetLocked(records []Record) {
+	clear(s.accountsByPublicKey)
+	clear(s.disabledAccounts)
+	clear(s.githubByUserID)
+	clear(s.authRequestsByKey)
+	for i := range s.users {
+		clear(s.users[i].users)
+	}
+	clear(s.artifactsByKey)
+	clear(s.accountSettingsByUserID)
+	clear(s.pushTokens)
+	clear(s.refreshTokens)
+	clear(s.apiKeys)
+	clear(s.devices)
+	clear(s.tombstones)
+	s.artifactSeq = 0
+	for _, rec := range records {
+		if rec.Kind != recordMessage {
+			continue
+		}
+		if sessionID, _, ok := strings.Cut(rec.Key, "|"); ok {
+			s.messages.deleteSession(sessionID)
+			s.seq.reset(sessionID)
+		}
+	}
+}
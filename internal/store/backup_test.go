@@ -0,0 +1,69 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestStore_ExportImportRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	src := New()
+	now := int64(1000)
+	acc, _ := src.GetOrCreateAccount(ctx, "pk", now)
+	src.SetAccountDisabled(ctx, acc.ID, true)
+	src.UpdateAccountSettings(ctx, acc.ID, 0, "settings", now)
+	sess, _, _ := src.GetOrCreateSession(ctx, "user-1", "tag", "meta", nil, nil, now)
+	src.AppendMessageFrom(ctx, OriginREST, "user-1", sess.ID, "m1", "", now)
+	src.AppendMessageFrom(ctx, OriginREST, "user-1", sess.ID, "m2", "", now)
+	src.UpsertMachine(ctx, "user-1", "m1", "meta", nil, nil, now)
+	src.DeleteMachine(ctx, "user-1", "m1", now+1)
+	src.CreateArtifactWithChecksums(ctx, "user-1", "a1", "h", "b", "k", ArtifactChecksums{}, now)
+
+	var buf bytes.Buffer
+	if err := src.Export(&buf); err != nil {
+		t.Fatalf("Export: %v", err)
+	}
+
+	backend := newMemBackend()
+	dst := NewWithOptions(Options{Backend: backend})
+	if err := dst.Import(bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatalf("Import: %v", err)
+	}
+	if got, created := dst.GetOrCreateAccount(ctx, "pk", now); created || got.ID != acc.ID {
+		t.Fatalf("expected the account to be restored")
+	}
+	if !dst.IsAccountDisabled(ctx, acc.ID) {
+		t.Fatalf("expected the disabled flag to be restored")
+	}
+	if settings, version := dst.GetAccountSettings(ctx, acc.ID); settings == nil || *settings != "settings" || version != 1 {
+		t.Fatalf("unexpected settings: %v %d", settings, version)
+	}
+	msgs, err := dst.ListMessages(ctx, "user-1", sess.ID, 0, 10)
+	if err != nil || len(msgs) != 2 {
+		t.Fatalf("expected 2 messages, got %+v (%v)", msgs, err)
+	}
+	if next, _ := dst.AppendMessageFrom(ctx, OriginREST, "user-1", sess.ID, "m3", "", now); next.Seq != 3 {
+		t.Fatalf("expected seq to continue at 3, got %d", next.Seq)
+	}
+	if tombs := dst.ListTombstones(ctx, "user-1", 0, now+1); len(tombs) != 1 {
+		t.Fatalf("expected the machine tombstone, got %+v", tombs)
+	}
+	if _, ok := dst.GetArtifact(ctx, "user-1", "a1"); !ok {
+		t.Fatalf("expected the artifact to be restored")
+	}
+
+	reloaded := NewWithOptions(Options{Backend: backend})
+	if _, ok := reloaded.GetSession(ctx, "user-1", sess.ID); !ok {
+		t.Fatalf("expected the import to be written through to the backend")
+	}
+
+	if err := dst.Import(bytes.NewReader(buf.Bytes())); !errors.Is(err, ErrStoreNotEmpty) {
+		t.Fatalf("expected ErrStoreNotEmpty, got %v", err)
+	}
+	if err := New().Import(strings.NewReader("not a backup")); !errors.Is(err, ErrInvalidBackup) {
+		t.Fatalf("expected ErrInvalidBackup, got %v", err)
+	}
+}
@@ -0,0 +1,83 @@
+//go:build bolt
+
+package store
+
+import (
+	"bytes"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// BoltBackend keeps store records in an embedded bbolt database, one bucket
+// per record kind. It is linked by building with -tags bolt.
+type BoltBackend struct {
+	db *bolt.DB
+}
+
+func init() {
+	openBolt = func(path string) (ClosableBackend, error) {
+		// The timeout turns a second process holding the file lock into an
+		// error instead of a hang.
+		db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: time.Second})
+		if err != nil {
+			return nil, err
+		}
+		return &BoltBackend{db: db}, nil
+	}
+}
+
+func (b *BoltBackend) Load() ([]Record, error) {
+	var records []Record
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(kind []byte, bucket *bolt.Bucket) error {
+			return bucket.ForEach(func(k, v []byte) error {
+				records = append(records, Record{Kind: string(kind), Key: string(k), Data: bytes.Clone(v)})
+				return nil
+			})
+		})
+	})
+	return records, err
+}
+
+func (b *BoltBackend) Put(r Record) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(r.Kind))
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(r.Key), r.Data)
+	})
+}
+
+func (b *BoltBackend) Delete(kind, key string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(kind))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.Delete([]byte(key))
+	})
+}
+
+func (b *BoltBackend) DeletePrefix(kind, prefix string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(kind))
+		if bucket == nil {
+			return nil
+		}
+		p := []byte(prefix)
+		c := bucket.Cursor()
+		// Deleting through the cursor moves it to the next key.
+		for k, _ := c.Seek(p); k != nil && bytes.HasPrefix(k, p); k, _ = c.Seek(p) {
+			if err := c.Delete(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (b *BoltBackend) Close() error {
+	return b.db.Close()
+}
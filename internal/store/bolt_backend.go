@@ -0,0 +1,37 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// BoltFile is the database file OpenBoltBackend keeps in its data directory.
+const BoltFile = "happy.db"
+
+// ErrBoltNotCompiled is returned by OpenBoltBackend in binaries built
+// without -tags bolt.
+var ErrBoltNotCompiled = errors.New("bolt store backend is not compiled in; rebuild with -tags bolt")
+
+// ClosableBackend is a Backend holding a file or connection until closed.
+type ClosableBackend interface {
+	Backend
+	io.Closer
+}
+
+// openBolt is set by bolt.go in binaries built with -tags bolt.
+var openBolt func(path string) (ClosableBackend, error)
+
+// OpenBoltBackend opens the embedded bbolt database in dataDir, creating
+// the directory and database file if needed.
+func OpenBoltBackend(dataDir string) (ClosableBackend, error) {
+	if openBolt == nil {
+		return nil, ErrBoltNotCompiled
+	}
+	if err := os.MkdirAll(dataDir, 0o700); err != nil {
+		return nil, fmt.Errorf("create data dir: %w", err)
+	}
+	return openBolt(filepath.Join(dataDir, BoltFile))
+}
@@ -0,0 +1,53 @@
+//go:build bolt
+
+package store
+
+import (
+	"context"
+	"testing"
+)
+
+func TestBoltBackend_RoundTrip(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	b, err := OpenBoltBackend(dir)
+	if err != nil {
+		t.Fatalf("OpenBoltBackend: %v", err)
+	}
+	s1 := NewWithOptions(Options{Backend: b})
+	sess, _, err := s1.GetOrCreateSession(ctx, "u1", "tag", "meta", nil, nil, 1)
+	if err != nil {
+		t.Fatalf("GetOrCreateSession: %v", err)
+	}
+	for _, c := range []string{"c1", "c2"} {
+		if _, err := s1.AppendMessage(ctx, "u1", sess.ID, c, 1); err != nil {
+			t.Fatalf("AppendMessage: %v", err)
+		}
+	}
+	gone, _, _ := s1.GetOrCreateSession(ctx, "u1", "gone", "meta", nil, nil, 1)
+	s1.AppendMessage(ctx, "u1", gone.ID, "lost", 1)
+	s1.DeleteSession(ctx, "u1", gone.ID, 2)
+	if err := b.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	b2, err := OpenBoltBackend(dir)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer b2.Close()
+	s2 := NewWithOptions(Options{Backend: b2})
+	msgs, err := s2.ListMessages(ctx, "u1", sess.ID, 0, 10)
+	if err != nil || len(msgs) != 2 || msgs[1].Content != "c2" {
+		t.Fatalf("unexpected messages after reopen: %+v (%v)", msgs, err)
+	}
+	records, err := b2.Load()
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	for _, r := range records {
+		if r.Kind == recordMessage && r.Key[:len(gone.ID)] == gone.ID {
+			t.Fatalf("expected messages of deleted session removed, found %s", r.Key)
+		}
+	}
+}
@@ -0,0 +1,26 @@
+package store
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strings"
+)
+
+// ErrChecksumMismatch is returned when a client-supplied checksum does not
+// match the ciphertext it accompanies.
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+// verifyChecksum checks an optional hex SHA-256 of content, exactly as the
+// client sent it, and returns the normalised form to store.
+func verifyChecksum(content, checksum string) (string, error) {
+	if checksum == "" {
+		return "", nil
+	}
+	sum := sha256.Sum256([]byte(content))
+	want := hex.EncodeToString(sum[:])
+	if strings.ToLower(checksum) != want {
+		return "", ErrChecksumMismatch
+	}
+	return want, nil
+}
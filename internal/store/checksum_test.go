@@ -0,0 +1,71 @@
+package store
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func sha256Hex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestStore_MessageChecksum(t *testing.T) {
+	ctx := context.Background()
+	s := New()
+	now := int64(1000)
+	sess, _, err := s.GetOrCreateSession(ctx, "u1", "tag1", "m1", nil, nil, now)
+	if err != nil {
+		t.Fatalf("GetOrCreateSession: %v", err)
+	}
+
+	if _, err := s.AppendMessageWithChecksum(ctx, "u1", sess.ID, "ciphertext", sha256Hex("other"), now); !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("expected ErrChecksumMismatch, got %v", err)
+	}
+	msg, err := s.AppendMessageWithChecksum(ctx, "u1", sess.ID, "ciphertext", strings.ToUpper(sha256Hex("ciphertext")), now)
+	if err != nil {
+		t.Fatalf("AppendMessageWithChecksum: %v", err)
+	}
+	if msg.Checksum != sha256Hex("ciphertext") {
+		t.Fatalf("expected normalised checksum, got %q", msg.Checksum)
+	}
+
+	msgs, err := s.ListMessages(ctx, "u1", sess.ID, 0, 10)
+	if err != nil || len(msgs) != 1 || msgs[0].Checksum != msg.Checksum {
+		t.Fatalf("expected stored checksum, got %+v (%v)", msgs, err)
+	}
+}
+
+func TestStore_ArtifactChecksums(t *testing.T) {
+	ctx := context.Background()
+	s := New()
+	now := int64(1000)
+
+	bad := ArtifactChecksums{Body: sha256Hex("nope")}
+	if _, _, err := s.CreateArtifactWithChecksums(ctx, "u1", "a1", "h", "b", "k", bad, now); !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("expected ErrChecksumMismatch, got %v", err)
+	}
+
+	sums := ArtifactChecksums{Header: sha256Hex("h"), Body: sha256Hex("b")}
+	a, _, err := s.CreateArtifactWithChecksums(ctx, "u1", "a1", "h", "b", "k", sums, now)
+	if err != nil {
+		t.Fatalf("CreateArtifactWithChecksums: %v", err)
+	}
+	if a.HeaderChecksum != sums.Header || a.BodyChecksum != sums.Body {
+		t.Fatalf("unexpected checksums: %+v", a)
+	}
+
+	body := "b2"
+	v := 1
+	if _, err := s.UpdateArtifact(ctx, "u1", "a1", nil, nil, &body, &v, now+1); err != nil {
+		t.Fatalf("UpdateArtifact: %v", err)
+	}
+	a, _ = s.GetArtifact(ctx, "u1", "a1")
+	if a.HeaderChecksum != sums.Header || a.BodyChecksum != "" {
+		t.Fatalf("expected body checksum cleared and header kept, got %+v", a)
+	}
+}
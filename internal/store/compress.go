@@ -0,0 +1,187 @@
+package store
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"happy-server-lite/internal/model"
+)
+
+// Codec compresses large metadata, agent state and daemon state strings at
+// rest, in state files and Backend records. The in-memory maps always hold
+// the plain values.
+type Codec interface {
+	Name() string
+	Compress(data []byte) ([]byte, error)
+	Decompress(data []byte) ([]byte, error)
+}
+
+const defaultCompressMinBytes = 4096
+
+// compressedPrefix marks a compressed value as "\x00<codec>\x00<base64>".
+// Clients can send values starting with a NUL too, so those are stored
+// escaped as "\x00\x00<value>", naming no codec.
+const compressedPrefix = "\x00"
+
+// maxDecompressedBytes bounds what one value may inflate to, well above the
+// store's size limits, so a crafted value cannot exhaust memory on load.
+const maxDecompressedBytes = 64 << 20
+
+var errDecompressedTooLarge = fmt.Errorf("decompressed value exceeds %d bytes", maxDecompressedBytes)
+
+var (
+	codecsMu sync.RWMutex
+	codecs   = map[string]Codec{"gzip": gzipCodec{}}
+)
+
+// RegisterCodec makes c available by name. zstd is registered by binaries
+// built with -tags zstd.
+func RegisterCodec(c Codec) {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+	codecs[c.Name()] = c
+}
+
+func LookupCodec(name string) (Codec, bool) {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	c, ok := codecs[name]
+	return c, ok
+}
+
+type gzipCodec struct{}
+
+func (gzipCodec) Name() string { return "gzip" }
+
+func (gzipCodec) Compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gzipCodec) Decompress(data []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	plain, err := io.ReadAll(io.LimitReader(r, maxDecompressedBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(plain) > maxDecompressedBytes {
+		return nil, errDecompressedTooLarge
+	}
+	return plain, nil
+}
+
+// compressValue encodes v with the store's codec when it is at least the
+// configured size and the result is actually smaller. Values that would read
+// as compressed are escaped whether or not a codec is set.
+func (s *Store) compressValue(v string) string {
+	if strings.HasPrefix(v, compressedPrefix) {
+		return compressedPrefix + "\x00" + v
+	}
+	if s.codec == nil || len(v) < s.compressMinBytes {
+		return v
+	}
+	packed, err := s.codec.Compress([]byte(v))
+	if err != nil {
+		return v
+	}
+	out := compressedPrefix + s.codec.Name() + "\x00" + base64.StdEncoding.EncodeToString(packed)
+	if len(out) >= len(v) {
+		return v
+	}
+	return out
+}
+
+func (s *Store) compressOptional(v *string) *string {
+	if v == nil {
+		return nil
+	}
+	out := s.compressValue(*v)
+	return &out
+}
+
+// decompressValue reverses compressValue with whichever codec the value
+// names, so data stays readable after compression is switched off. Values
+// naming no known codec, such as ones stored before escaping, are taken as
+// they are.
+func decompressValue(v string) (string, error) {
+	if !strings.HasPrefix(v, compressedPrefix) {
+		return v, nil
+	}
+	name, encoded, ok := strings.Cut(v[len(compressedPrefix):], "\x00")
+	if !ok {
+		return v, nil
+	}
+	if name == "" {
+		return encoded, nil
+	}
+	codec, ok := LookupCodec(name)
+	if !ok {
+		return v, nil
+	}
+	packed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", err
+	}
+	plain, err := codec.Decompress(packed)
+	if err != nil {
+		return "", err
+	}
+	return string(plain), nil
+}
+
+func decompressOptional(v *string) (*string, error) {
+	if v == nil {
+		return nil, nil
+	}
+	out, err := decompressValue(*v)
+	if err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+func (s *Store) compressSession(sess model.Session) model.Session {
+	sess.Metadata = s.compressValue(sess.Metadata)
+	sess.AgentState = s.compressOptional(sess.AgentState)
+	return sess
+}
+
+func decompressSession(sess model.Session) (model.Session, error) {
+	var err error
+	if sess.Metadata, err = decompressValue(sess.Metadata); err != nil {
+		return sess, err
+	}
+	sess.AgentState, err = decompressOptional(sess.AgentState)
+	return sess, err
+}
+
+func (s *Store) compressMachine(m model.Machine) model.Machine {
+	m.Metadata = s.compressValue(m.Metadata)
+	m.DaemonState = s.compressOptional(m.DaemonState)
+	return m
+}
+
+func decompressMachine(m model.Machine) (model.Machine, error) {
+	var err error
+	if m.Metadata, err = decompressValue(m.Metadata); err != nil {
+		return m, err
+	}
+	m.DaemonState, err = decompressOptional(m.DaemonState)
+	return m, err
+}
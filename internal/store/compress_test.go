@@ -0,0 +1,126 @@
+package store
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestStore_CompressesLargeStateAtRest(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	machinesFile := filepath.Join(dir, "machines-state.json")
+	sessionsFile := filepath.Join(dir, "sessions-state.json")
+	backend := newMemBackend()
+	opts := Options{
+		MachinesStateFile: machinesFile,
+		SessionsStateFile: sessionsFile,
+		Backend:           backend,
+		Compression:       "gzip",
+		CompressMinBytes:  64,
+	}
+	big := strings.Repeat("verbose agent state ", 50)
+	small := "meta"
+
+	s1 := NewWithOptions(opts)
+	now := int64(1000)
+	sess, _, err := s1.GetOrCreateSession(ctx, "u1", "tag", small, &big, nil, now)
+	if err != nil {
+		t.Fatalf("GetOrCreateSession: %v", err)
+	}
+	if _, _, err := s1.UpsertMachine(ctx, "u1", "m1", big, nil, nil, now); err != nil {
+		t.Fatalf("UpsertMachine: %v", err)
+	}
+	if *sess.AgentState != big {
+		t.Fatalf("expected plain agent state in memory")
+	}
+
+	for _, path := range []string{machinesFile, sessionsFile} {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("read %s: %v", path, err)
+		}
+		if strings.Contains(string(data), "verbose agent state") {
+			t.Fatalf("expected %s to hold compressed state", filepath.Base(path))
+		}
+	}
+	for _, r := range backend.records {
+		if strings.Contains(string(r.Data), "verbose agent state") {
+			t.Fatalf("expected %s record to hold compressed state", r.Kind)
+		}
+	}
+
+	// Compression off still reads compressed values back.
+	for _, reload := range []Options{
+		{MachinesStateFile: machinesFile, SessionsStateFile: sessionsFile},
+		{Backend: backend},
+	} {
+		s2 := NewWithOptions(reload)
+		got, ok := s2.GetSession(ctx, "u1", sess.ID)
+		if !ok || got.Metadata != small || got.AgentState == nil || *got.AgentState != big {
+			t.Fatalf("unexpected session after reload: %+v", got)
+		}
+		m, ok := s2.GetMachine(ctx, "u1", "m1")
+		if !ok || m.Metadata != big {
+			t.Fatalf("unexpected machine after reload: %+v", m)
+		}
+	}
+}
+
+func TestStore_ValuesThatLookCompressedRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	sessionsFile := filepath.Join(t.TempDir(), "sessions-state.json")
+	opts := Options{SessionsStateFile: sessionsFile}
+	crafted := "\x00x\x00not compressed"
+	claimsGzip := "\x00gzip\x00AAAA"
+
+	s1 := NewWithOptions(opts)
+	sess, _, _ := s1.GetOrCreateSession(ctx, "u1", "tag", crafted, &claimsGzip, nil, 1000)
+	other, _, _ := s1.GetOrCreateSession(ctx, "u2", "tag", "meta", nil, nil, 1000)
+	s1.AppendMessage(ctx, "u2", other.ID, "hello", 1000)
+
+	s2, err := Open(opts)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	got, ok := s2.GetSession(ctx, "u1", sess.ID)
+	if !ok || got.Metadata != crafted || *got.AgentState != claimsGzip {
+		t.Fatalf("expected crafted values back as sent, got %+v", got)
+	}
+	if msgs, _ := s2.ListMessages(ctx, "u2", other.ID, 0, 10); len(msgs) != 1 {
+		t.Fatalf("expected other users' messages kept, got %d", len(msgs))
+	}
+
+	// A value stored before escaping naming an unknown codec reads as is.
+	if v, err := decompressValue(crafted); err != nil || v != crafted {
+		t.Fatalf("expected an unknown codec to read as plain, got %q (%v)", v, err)
+	}
+}
+
+func TestDecompressValue_CapsInflatedSize(t *testing.T) {
+	packed, err := gzipCodec{}.Compress(make([]byte, maxDecompressedBytes+1))
+	if err != nil {
+		t.Fatalf("Compress: %v", err)
+	}
+	bomb := compressedPrefix + "gzip\x00" + base64.StdEncoding.EncodeToString(packed)
+	if _, err := decompressValue(bomb); !errors.Is(err, errDecompressedTooLarge) {
+		t.Fatalf("expected the inflated size to be capped, got %v", err)
+	}
+}
+
+func TestOpen_FailsRatherThanDroppingState(t *testing.T) {
+	sessionsFile := filepath.Join(t.TempDir(), "sessions-state.json")
+	if err := os.WriteFile(sessionsFile, []byte("{not json"), 0o600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if _, err := Open(Options{SessionsStateFile: sessionsFile}); err == nil {
+		t.Fatalf("expected a state file that cannot be loaded to fail Open")
+	}
+	if data, _ := os.ReadFile(sessionsFile); string(data) != "{not json" {
+		t.Fatalf("expected the state file left alone, got %q", data)
+	}
+}
@@ -0,0 +1,422 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"sort"
+
+	"happy-server-lite/internal/model"
+)
+
+// deviceTouchInterval bounds how often a device's LastSeenAt is written, as
+// it is touched on every authenticated request. A new IP is written at once.
+const deviceTouchInterval int64 = 60_000
+
+// sortDevices orders devices oldest sign-in first.
+func sortDevices(devices []model.Device) {
+	sort.Slice(devices, func(i, j int) bool {
+		if devices[i].CreatedAt != devices[j].CreatedAt {
+			return devices[i].CreatedAt < devices[j].CreatedAt
+		}
+		return devices[i].ID < devices[j].ID
+	})
+}
+
+// touchDevice records a request from d at ip and reports whether d changed
+// enough to be written back.
+func touchDevice(d *model.Device, ip string, nowMillis int64) bool {
+	if nowMillis-d.LastSeenAt < deviceTouchInterval && (ip == "" || ip == d.LastSeenIP) {
+		return false
+	}
+	d.LastSeenAt = nowMillis
+	if ip != "" {
+		d.LastSeenIP = ip
+	}
+	return true
+}
+
+func newDevice(id, userID string, device *model.AuthRequestDevice, ip string, expiresAt, nowMillis int64) model.Device {
+	return model.Device{
+		ID:         id,
+		UserID:     userID,
+		Device:     device,
+		CreatedAt:  nowMillis,
+		LastSeenAt: nowMillis,
+		LastSeenIP: ip,
+		ExpiresAt:  expiresAt,
+	}
+}
+
+// CreateDevice registers a device of userID signing in from ip, whose
+// tokens run out at expiresAt. Expired devices of the user are dropped on
+// the way.
+func (s *Store) CreateDevice(ctx context.Context, userID string, device *model.AuthRequestDevice, ip string, expiresAt, nowMillis int64) model.Device {
+	d := newDevice(s.newID(), userID, device, ip, expiresAt, nowMillis)
+	s.mu.Lock()
+	for id, old := range s.devices {
+		if old.UserID == userID && old.ExpiresAt <= nowMillis {
+			delete(s.devices, id)
+			s.unpersist(recordDevice, id)
+		}
+	}
+	s.devices[d.ID] = d
+	s.persist(recordDevice, d.ID, d)
+	s.mu.Unlock()
+	s.saveAccounts()
+	return d
+}
+
+// TouchDevice reports whether device id of userID is still signed in,
+// recording that it was seen from ip.
+func (s *Store) TouchDevice(ctx context.Context, userID, id, ip string, nowMillis int64) bool {
+	s.mu.Lock()
+	d, ok := s.devices[id]
+	if !ok || d.UserID != userID || d.ExpiresAt <= nowMillis {
+		s.mu.Unlock()
+		return false
+	}
+	touched := touchDevice(&d, ip, nowMillis)
+	if touched {
+		s.devices[id] = d
+		s.persist(recordDevice, id, d)
+	}
+	s.mu.Unlock()
+	if touched {
+		s.saveAccounts()
+	}
+	return true
+}
+
+// RenewDevice keeps device id of userID signed in until at least expiresAt,
+// for a refreshed grant. It reports false for a revoked device.
+func (s *Store) RenewDevice(ctx context.Context, userID, id string, expiresAt, nowMillis int64) bool {
+	s.mu.Lock()
+	d, ok := s.devices[id]
+	if !ok || d.UserID != userID || d.ExpiresAt <= nowMillis {
+		s.mu.Unlock()
+		return false
+	}
+	renewed := expiresAt > d.ExpiresAt
+	if renewed {
+		d.ExpiresAt = expiresAt
+		s.devices[id] = d
+		s.persist(recordDevice, id, d)
+	}
+	s.mu.Unlock()
+	if renewed {
+		s.saveAccounts()
+	}
+	return true
+}
+
+// ListDevices returns the user's devices that are still signed in.
+func (s *Store) ListDevices(ctx context.Context, userID string, nowMillis int64) []model.Device {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	result := make([]model.Device, 0)
+	for _, d := range s.devices {
+		if d.UserID == userID && d.ExpiresAt > nowMillis {
+			result = append(result, d)
+		}
+	}
+	sortDevices(result)
+	return result
+}
+
+// DeleteDevice signs device id out, revoking the refresh grants issued to
+// it.
+func (s *Store) DeleteDevice(ctx context.Context, userID, id string) bool {
+	s.mu.Lock()
+	d, ok := s.devices[id]
+	if !ok || d.UserID != userID {
+		s.mu.Unlock()
+		return false
+	}
+	delete(s.devices, id)
+	s.unpersist(recordDevice, id)
+	for rtID, rt := range s.refreshTokens {
+		if rt.UserID == userID && rt.DeviceID == id {
+			delete(s.refreshTokens, rtID)
+			s.unpersist(recordRefreshToken, rtID)
+		}
+	}
+	s.mu.Unlock()
+	s.saveAccounts()
+	return true
+}
+
+// DeleteDevices signs every device of the user out and returns how many
+// there were. Their refresh grants are left to DeleteRefreshTokens; they
+// can no longer be used either way.
+func (s *Store) DeleteDevices(ctx context.Context, userID string) int {
+	s.mu.Lock()
+	n := s.deleteDevicesLocked(userID)
+	s.mu.Unlock()
+	if n > 0 {
+		s.saveAccounts()
+	}
+	return n
+}
+
+func (s *Store) deleteDevicesLocked(userID string) int {
+	n := 0
+	for id, d := range s.devices {
+		if d.UserID == userID {
+			delete(s.devices, id)
+			s.unpersist(recordDevice, id)
+			n++
+		}
+	}
+	return n
+}
+
+const deviceColumns = `id, user_id, device, created_at, last_seen_at, last_seen_ip, expires_at`
+
+func scanDevice(row rowScanner) (model.Device, error) {
+	var d model.Device
+	var device *string
+	err := row.Scan(&d.ID, &d.UserID, &device, &d.CreatedAt, &d.LastSeenAt, &d.LastSeenIP, &d.ExpiresAt)
+	if err == nil && device != nil {
+		d.Device = &model.AuthRequestDevice{}
+		err = json.Unmarshal([]byte(*device), d.Device)
+	}
+	return d, err
+}
+
+func (p *PostgresStore) CreateDevice(ctx context.Context, userID string, device *model.AuthRequestDevice, ip string, expiresAt, nowMillis int64) model.Device {
+	d := newDevice(p.newID(), userID, device, ip, expiresAt, nowMillis)
+	err := p.withTx(ctx, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, `DELETE FROM devices WHERE user_id = $1 AND expires_at <= $2`, userID, nowMillis); err != nil {
+			return err
+		}
+		_, err := tx.ExecContext(ctx, `INSERT INTO devices (`+deviceColumns+`) VALUES ($1, $2, $3, $4, $4, $5, $6)`,
+			d.ID, userID, authRequestDeviceJSON(device), nowMillis, ip, expiresAt)
+		return err
+	})
+	if err != nil {
+		p.logError("create device", err)
+	}
+	return d
+}
+
+func (p *PostgresStore) getDevice(ctx context.Context, userID, id string, nowMillis int64) (model.Device, bool) {
+	d, err := scanDevice(p.db.QueryRowContext(ctx, `SELECT `+deviceColumns+` FROM devices WHERE user_id = $1 AND id = $2 AND expires_at > $3`, userID, id, nowMillis))
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			p.logError("get device", err)
+		}
+		return model.Device{}, false
+	}
+	return d, true
+}
+
+func (p *PostgresStore) TouchDevice(ctx context.Context, userID, id, ip string, nowMillis int64) bool {
+	d, ok := p.getDevice(ctx, userID, id, nowMillis)
+	if !ok {
+		return false
+	}
+	if touchDevice(&d, ip, nowMillis) {
+		if _, err := p.db.ExecContext(ctx, `UPDATE devices SET last_seen_at = $2, last_seen_ip = $3 WHERE id = $1`, id, d.LastSeenAt, d.LastSeenIP); err != nil {
+			p.logError("touch device", err)
+		}
+	}
+	return true
+}
+
+func (p *PostgresStore) RenewDevice(ctx context.Context, userID, id string, expiresAt, nowMillis int64) bool {
+	res, err := p.db.ExecContext(ctx, `UPDATE devices SET expires_at = GREATEST(expires_at, $3) WHERE user_id = $1 AND id = $2 AND expires_at > $4`,
+		userID, id, expiresAt, nowMillis)
+	if err != nil {
+		p.logError("renew device", err)
+		return false
+	}
+	n, _ := res.RowsAffected()
+	return n > 0
+}
+
+func (p *PostgresStore) ListDevices(ctx context.Context, userID string, nowMillis int64) []model.Device {
+	rows, err := p.db.QueryContext(ctx, `SELECT `+deviceColumns+` FROM devices WHERE user_id = $1 AND expires_at > $2 ORDER BY created_at, id`, userID, nowMillis)
+	if err != nil {
+		p.logError("list devices", err)
+		return []model.Device{}
+	}
+	defer rows.Close()
+
+	result := make([]model.Device, 0)
+	for rows.Next() {
+		d, err := scanDevice(rows)
+		if err != nil {
+			p.logError("scan device", err)
+			break
+		}
+		result = append(result, d)
+	}
+	return result
+}
+
+func (p *PostgresStore) DeleteDevice(ctx context.Context, userID, id string) bool {
+	var deleted bool
+	err := p.withTx(ctx, func(tx *sql.Tx) error {
+		res, err := tx.ExecContext(ctx, `DELETE FROM devices WHERE user_id = $1 AND id = $2`, userID, id)
+		if err != nil {
+			return err
+		}
+		n, _ := res.RowsAffected()
+		deleted = n > 0
+		if !deleted {
+			return nil
+		}
+		_, err = tx.ExecContext(ctx, `DELETE FROM refresh_tokens WHERE user_id = $1 AND device_id = $2`, userID, id)
+		return err
+	})
+	if err != nil {
+		p.logError("delete device", err)
+		return false
+	}
+	return deleted
+}
+
+func (p *PostgresStore) DeleteDevices(ctx context.Context, userID string) int {
+	res, err := p.db.ExecContext(ctx, `DELETE FROM devices WHERE user_id = $1`, userID)
+	if err != nil {
+		p.logError("delete devices", err)
+		return 0
+	}
+	n, _ := res.RowsAffected()
+	return int(n)
+}
+
+func (r *RedisStore) CreateDevice(ctx context.Context, userID string, device *model.AuthRequestDevice, ip string, expiresAt, nowMillis int64) model.Device {
+	d := newDevice(r.newID(), userID, device, ip, expiresAt, nowMillis)
+	setKey := r.userSetKey(userID, "devices")
+	old, err := mgetJSON[model.Device](ctx, r, setKey, r.deviceKey)
+	if err != nil {
+		r.logError("create device", err)
+	}
+	err = r.client.watch(ctx, []string{r.deviceKey(d.ID)}, func(tx *redisTx) error {
+		for _, o := range old {
+			if o.ExpiresAt <= nowMillis {
+				tx.queue("DEL", r.deviceKey(o.ID))
+				tx.queue("SREM", setKey, o.ID)
+			}
+		}
+		tx.queue("SET", r.deviceKey(d.ID), redisJSON(d))
+		tx.queue("SADD", setKey, d.ID)
+		return nil
+	})
+	if err != nil {
+		r.logError("create device", err)
+	}
+	return d
+}
+
+func (r *RedisStore) getDevice(ctx context.Context, userID, id string, nowMillis int64) (model.Device, bool) {
+	var d model.Device
+	ok, err := getJSON(r.client.doFunc(ctx), r.deviceKey(id), &d)
+	if err != nil {
+		r.logError("get device", err)
+		return model.Device{}, false
+	}
+	if !ok || d.UserID != userID || d.ExpiresAt <= nowMillis {
+		return model.Device{}, false
+	}
+	return d, true
+}
+
+func (r *RedisStore) TouchDevice(ctx context.Context, userID, id, ip string, nowMillis int64) bool {
+	d, ok := r.getDevice(ctx, userID, id, nowMillis)
+	if !ok {
+		return false
+	}
+	if touchDevice(&d, ip, nowMillis) {
+		// SET XX leaves a device revoked meanwhile revoked.
+		if _, err := r.client.do(ctx, "SET", r.deviceKey(id), redisJSON(d), "XX"); err != nil {
+			r.logError("touch device", err)
+		}
+	}
+	return true
+}
+
+func (r *RedisStore) RenewDevice(ctx context.Context, userID, id string, expiresAt, nowMillis int64) bool {
+	d, ok := r.getDevice(ctx, userID, id, nowMillis)
+	if !ok {
+		return false
+	}
+	if expiresAt > d.ExpiresAt {
+		d.ExpiresAt = expiresAt
+		reply, err := r.client.do(ctx, "SET", r.deviceKey(id), redisJSON(d), "XX")
+		if err != nil {
+			r.logError("renew device", err)
+			return false
+		}
+		if reply == nil {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *RedisStore) ListDevices(ctx context.Context, userID string, nowMillis int64) []model.Device {
+	devices, err := mgetJSON[model.Device](ctx, r, r.userSetKey(userID, "devices"), r.deviceKey)
+	if err != nil {
+		r.logError("list devices", err)
+		return []model.Device{}
+	}
+	result := devices[:0]
+	for _, d := range devices {
+		if d.ExpiresAt > nowMillis {
+			result = append(result, d)
+		}
+	}
+	sortDevices(result)
+	return result
+}
+
+func (r *RedisStore) DeleteDevice(ctx context.Context, userID, id string) bool {
+	var d model.Device
+	if ok, err := getJSON(r.client.doFunc(ctx), r.deviceKey(id), &d); err != nil || !ok || d.UserID != userID {
+		if err != nil {
+			r.logError("delete device", err)
+		}
+		return false
+	}
+	if _, err := r.client.do(ctx, "DEL", r.deviceKey(id)); err != nil {
+		r.logError("delete device", err)
+		return false
+	}
+	if _, err := r.client.do(ctx, "SREM", r.userSetKey(userID, "devices"), id); err != nil {
+		r.logError("delete device", err)
+	}
+	tokens, err := mgetJSON[model.RefreshToken](ctx, r, r.userSetKey(userID, "refresh-tokens"), r.refreshTokenKey)
+	if err != nil {
+		r.logError("delete device", err)
+	}
+	for _, rt := range tokens {
+		if rt.DeviceID == id {
+			r.DeleteRefreshToken(ctx, userID, rt.ID)
+		}
+	}
+	return true
+}
+
+func (r *RedisStore) DeleteDevices(ctx context.Context, userID string) int {
+	setKey := r.userSetKey(userID, "devices")
+	reply, err := r.client.do(ctx, "SMEMBERS", setKey)
+	if err != nil {
+		r.logError("delete devices", err)
+		return 0
+	}
+	ids := redisStrings(reply)
+	args := []any{"DEL", setKey}
+	for _, id := range ids {
+		args = append(args, r.deviceKey(id))
+	}
+	if _, err := r.client.do(ctx, args...); err != nil {
+		r.logError("delete devices", err)
+		return 0
+	}
+	return len(ids)
+}
@@ -0,0 +1,76 @@
+package store
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"happy-server-lite/internal/model"
+)
+
+func testDevices(t *testing.T, s Storage) {
+	t.Helper()
+	ctx := context.Background()
+	laptop := s.CreateDevice(ctx, "user-1", &model.AuthRequestDevice{Hostname: "laptop"}, "192.0.2.1", 100_000, 1000)
+	phone := s.CreateDevice(ctx, "user-1", nil, "", 100_000, 2000)
+	s.CreateRefreshToken(ctx, "user-1", phone.ID, nil, "h1", 100_000, 2000)
+	s.CreateRefreshToken(ctx, "user-1", laptop.ID, nil, "h2", 100_000, 2000)
+
+	if s.TouchDevice(ctx, "user-2", laptop.ID, "", 3000) {
+		t.Fatalf("expected another user's device to be unknown")
+	}
+	if !s.TouchDevice(ctx, "user-1", laptop.ID, "192.0.2.1", 3000) {
+		t.Fatalf("expected the device to be signed in")
+	}
+	if devices := s.ListDevices(ctx, "user-1", 3000); len(devices) != 2 || devices[0].ID != laptop.ID || devices[0].LastSeenAt != 1000 {
+		t.Fatalf("expected a visit within the touch interval not to be recorded: %+v", devices)
+	}
+	s.TouchDevice(ctx, "user-1", laptop.ID, "192.0.2.2", 4000)
+	if devices := s.ListDevices(ctx, "user-1", 4000); devices[0].LastSeenAt != 4000 || devices[0].LastSeenIP != "192.0.2.2" || devices[0].Device.Hostname != "laptop" {
+		t.Fatalf("expected a new address to be recorded: %+v", devices)
+	}
+
+	if !s.RenewDevice(ctx, "user-1", laptop.ID, 200_000, 5000) {
+		t.Fatalf("expected the device to be renewed")
+	}
+	if s.TouchDevice(ctx, "user-1", phone.ID, "", 150_000) || !s.TouchDevice(ctx, "user-1", laptop.ID, "", 150_000) {
+		t.Fatalf("expected only the renewed device to outlive its first expiry")
+	}
+	if devices := s.ListDevices(ctx, "user-1", 150_000); len(devices) != 1 || devices[0].ID != laptop.ID {
+		t.Fatalf("expected expired devices to be hidden: %+v", devices)
+	}
+
+	if s.DeleteDevice(ctx, "user-2", phone.ID) || !s.DeleteDevice(ctx, "user-1", phone.ID) {
+		t.Fatalf("expected only the owner to delete a device")
+	}
+	if tokens := s.ListRefreshTokens(ctx, "user-1", 5000); len(tokens) != 1 || tokens[0].DeviceID != laptop.ID {
+		t.Fatalf("expected the deleted device's refresh token to be revoked: %+v", tokens)
+	}
+	if n := s.DeleteDevices(ctx, "user-1"); n != 1 {
+		t.Fatalf("expected 1 device deleted, got %d", n)
+	}
+	if s.TouchDevice(ctx, "user-1", laptop.ID, "", 5000) {
+		t.Fatalf("expected a deleted device to be signed out")
+	}
+}
+
+func TestStore_Devices(t *testing.T) {
+	testDevices(t, New())
+}
+
+func TestRedisStore_Devices(t *testing.T) {
+	testDevices(t, openFakeRedisStore(t, 0))
+}
+
+func TestStore_Devices_Persist(t *testing.T) {
+	ctx := context.Background()
+	opts := Options{AccountsStateFile: filepath.Join(t.TempDir(), "accounts-state.json")}
+
+	s1 := NewWithOptions(opts)
+	d := s1.CreateDevice(ctx, "user-1", nil, "192.0.2.1", 100_000, 1000)
+
+	s2 := NewWithOptions(opts)
+	if devices := s2.ListDevices(ctx, "user-1", 2000); len(devices) != 1 || devices[0].ID != d.ID || devices[0].LastSeenIP != "192.0.2.1" {
+		t.Fatalf("expected the device to survive a reload: %+v", devices)
+	}
+}
@@ -0,0 +1,96 @@
+package store
+
+import (
+	"sync"
+
+	"happy-server-lite/internal/model"
+)
+
+// Event types published to subscribers.
+const (
+	EventMessageAppended = "message-appended"
+	EventMessageUpdated  = "message-updated"
+	EventMessageDeleted  = "message-deleted"
+	EventSessionDeleted  = "session-deleted"
+	EventMachineDeleted  = "machine-deleted"
+	// EventMessageAnnotated carries the message with its annotations after
+	// one of them was set or removed.
+	EventMessageAnnotated = "message-annotated"
+	// EventSessionLocked carries a session lock, without its token, after it
+	// was acquired or renewed, and EventSessionUnlocked after it was
+	// released. Locks that lapse are not announced.
+	EventSessionLocked   = "session-locked"
+	EventSessionUnlocked = "session-unlocked"
+	// EventAuthRequested is published when a device first asks to sign in
+	// with PublicKey; polls of a pending request do not repeat it.
+	EventAuthRequested = "auth-requested"
+)
+
+// Origins identify the API a mutation came through, so a transport that has
+// already fanned out its own change can skip the echo from the bus.
+const (
+	OriginREST      = "rest"
+	OriginSocketIO  = "socketio"
+	OriginWebSocket = "ws"
+)
+
+// Event describes a committed mutation.
+type Event struct {
+	Type      string
+	Origin    string
+	UserID    string
+	SessionID string
+	MachineID string
+	PublicKey string
+	Message   *model.SessionMessage
+	Lock      *model.SessionLock
+	At        int64
+}
+
+// eventBus is embedded by Storage implementations. It is the one place
+// changes are fanned out from: transports, push and any other consumer
+// subscribe to the event types they need rather than being called from each
+// place that makes a change.
+type eventBus struct {
+	subsMu      sync.RWMutex
+	subscribers []subscription
+}
+
+type subscription struct {
+	// types is nil for a subscriber of every event.
+	types map[string]bool
+	fn    func(Event)
+}
+
+// Subscribe registers fn for every event published after the call. Events are
+// delivered synchronously, outside the store lock, on the goroutine that made
+// the change.
+func (b *eventBus) Subscribe(fn func(Event)) {
+	b.SubscribeTypes(fn)
+}
+
+// SubscribeTypes is Subscribe for events of the given types only; with no
+// types fn receives every event.
+func (b *eventBus) SubscribeTypes(fn func(Event), types ...string) {
+	sub := subscription{fn: fn}
+	if len(types) > 0 {
+		sub.types = make(map[string]bool, len(types))
+		for _, t := range types {
+			sub.types[t] = true
+		}
+	}
+	b.subsMu.Lock()
+	defer b.subsMu.Unlock()
+	b.subscribers = append(b.subscribers, sub)
+}
+
+func (b *eventBus) publish(ev Event) {
+	b.subsMu.RLock()
+	subs := b.subscribers
+	b.subsMu.RUnlock()
+	for _, sub := range subs {
+		if sub.types == nil || sub.types[ev.Type] {
+			sub.fn(ev)
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package store
+
+import (
+	"context"
+	"testing"
+)
+
+func testSubscribeTypes(t *testing.T, s Storage) {
+	t.Helper()
+	ctx := context.Background()
+	var all, requests []string
+	s.Subscribe(func(ev Event) { all = append(all, ev.Type) })
+	s.SubscribeTypes(func(ev Event) { requests = append(requests, ev.PublicKey) }, EventAuthRequested)
+
+	sess, _, err := s.GetOrCreateSession(ctx, "u1", "tag", "meta", nil, nil, 1000)
+	if err != nil {
+		t.Fatalf("GetOrCreateSession: %v", err)
+	}
+	s.AppendMessageFrom(ctx, OriginREST, "u1", sess.ID, "hello", "", 1000)
+	s.UpsertAuthRequest(ctx, "pk", false, nil, 1000)
+	// Polling an existing request is not a new one.
+	s.UpsertAuthRequest(ctx, "pk", true, nil, 2000)
+
+	if len(all) != 2 || all[0] != EventMessageAppended || all[1] != EventAuthRequested {
+		t.Fatalf("unexpected events: %v", all)
+	}
+	if len(requests) != 1 || requests[0] != "pk" {
+		t.Fatalf("expected one auth request event, got %v", requests)
+	}
+}
+
+func TestStore_SubscribeTypes(t *testing.T) {
+	testSubscribeTypes(t, New())
+}
+
+func TestRedisStore_SubscribeTypes(t *testing.T) {
+	testSubscribeTypes(t, openFakeRedisStore(t, 0))
+}
@@ -0,0 +1,127 @@
+package store
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"io"
+	"time"
+)
+
+// Session exports archive one session outside the app: its record and
+// messages as in a user export, and a viewer page that lists the timeline
+// without any other file or network access. Content stays encrypted as
+// stored; the viewer shows it as is.
+const (
+	sessionExportFormat  = "happy-server-lite-session-export"
+	sessionExportVersion = 1
+
+	// ExportHTML is the viewer page alone, with the session embedded.
+	ExportHTML ExportFormat = "html"
+)
+
+// ErrSessionNotFound is returned by ExportSession and the session lock
+// methods for sessions that do not exist or were deleted.
+var ErrSessionNotFound = errors.New("session not found")
+
+type sessionExport struct {
+	Format     string            `json:"format"`
+	Version    int               `json:"version"`
+	ExportedAt int64             `json:"exportedAt"`
+	Session    userExportSession `json:"session"`
+}
+
+// ExportSession writes sessionID of userID to w as JSON, as the viewer page
+// (ExportHTML), or as a tar archive of session.json and index.html.
+func ExportSession(ctx context.Context, st Storage, userID, sessionID string, w io.Writer, format ExportFormat, now time.Time) error {
+	switch format {
+	case ExportJSON, ExportHTML, ExportTar:
+	default:
+		return ErrInvalidExportFormat
+	}
+	sess, ok := st.GetSession(ctx, userID, sessionID)
+	if !ok || sess.Deleted {
+		return ErrSessionNotFound
+	}
+	item, err := exportSession(ctx, st, userID, sess)
+	if err != nil {
+		return err
+	}
+	export := sessionExport{Format: sessionExportFormat, Version: sessionExportVersion, ExportedAt: now.UnixMilli(), Session: item}
+
+	switch format {
+	case ExportJSON:
+		return json.NewEncoder(w).Encode(export)
+	case ExportHTML:
+		return sessionViewer.Execute(w, export)
+	}
+	out := &tarUserExport{tw: tar.NewWriter(w), modTime: now}
+	if err := out.object("session", export); err != nil {
+		return err
+	}
+	var page bytes.Buffer
+	if err := sessionViewer.Execute(&page, export); err != nil {
+		return err
+	}
+	hdr := &tar.Header{Name: "index.html", Mode: 0o600, Size: int64(page.Len()), ModTime: now}
+	if err := out.tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if _, err := page.WriteTo(out.tw); err != nil {
+		return err
+	}
+	return out.close()
+}
+
+// sessionViewer renders the export into the page; html/template escapes the
+// embedded JSON so message content cannot close the script.
+var sessionViewer = template.Must(template.New("session").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Session {{.Session.Tag}}</title>
+<style>
+body { font: 14px/1.4 system-ui, sans-serif; margin: 2em auto; max-width: 60em; padding: 0 1em; color: #222; }
+h1 { font-size: 1.3em; margin-bottom: 0; }
+.meta { color: #666; margin-bottom: 1.5em; }
+ol { list-style: none; padding: 0; }
+li { border-left: 3px solid #ccc; margin: 0 0 1em; padding: 0 0 0 1em; }
+li.deleted { border-color: #e99; color: #999; }
+.when { color: #666; font-size: 0.9em; }
+pre { white-space: pre-wrap; word-break: break-all; background: #f6f6f6; padding: 0.5em; margin: 0.3em 0 0; }
+</style>
+</head>
+<body>
+<h1>Session {{.Session.Tag}}</h1>
+<div class="meta" id="meta"></div>
+<ol id="timeline"></ol>
+<script>
+var data = {{.}};
+(function () {
+  function when(ms) { return new Date(ms).toLocaleString(); }
+  function el(tag, cls, text) {
+    var e = document.createElement(tag);
+    if (cls) e.className = cls;
+    if (text !== undefined) e.textContent = text;
+    return e;
+  }
+  var s = data.session;
+  document.getElementById("meta").textContent =
+    s.messages.length + " messages, " + when(s.createdAt) + " – " + when(s.updatedAt) +
+    ". Exported " + when(data.exportedAt) + ".";
+  var list = document.getElementById("timeline");
+  s.messages.forEach(function (m) {
+    var li = el("li", m.content === "" ? "deleted" : "");
+    li.appendChild(el("div", "when", "#" + m.seq + " · " + when(m.createdAt) + (m.updatedAt !== m.createdAt ? " (edited " + when(m.updatedAt) + ")" : "")));
+    li.appendChild(el("pre", "", m.content === "" ? "(deleted)" : m.content));
+    list.appendChild(li);
+  });
+})();
+</script>
+</body>
+</html>
+`))
@@ -0,0 +1,73 @@
+package store
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExportSession(t *testing.T) {
+	ctx := context.Background()
+	s := New()
+	sess, _, _ := s.GetOrCreateSession(ctx, "u1", "run", "meta", nil, nil, 1000)
+	s.AppendMessage(ctx, "u1", sess.ID, "first", 1000)
+	s.AppendMessage(ctx, "u1", sess.ID, "</script><b>x</b>", 2000)
+	now := time.UnixMilli(3000)
+
+	var buf bytes.Buffer
+	if err := ExportSession(ctx, s, "u1", sess.ID, &buf, ExportJSON, now); err != nil {
+		t.Fatalf("ExportSession: %v", err)
+	}
+	var export sessionExport
+	if err := json.Unmarshal(buf.Bytes(), &export); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	if export.Format != sessionExportFormat || export.ExportedAt != 3000 || export.Session.ID != sess.ID || len(export.Session.Messages) != 2 {
+		t.Fatalf("unexpected export: %+v", export)
+	}
+
+	buf.Reset()
+	if err := ExportSession(ctx, s, "u1", sess.ID, &buf, ExportHTML, now); err != nil {
+		t.Fatalf("ExportSession: %v", err)
+	}
+	if page := buf.String(); strings.Contains(page, "</script><b>") || !strings.Contains(page, "<title>Session run</title>") {
+		t.Fatalf("expected message content to be escaped in the viewer:\n%s", page)
+	}
+
+	buf.Reset()
+	if err := ExportSession(ctx, s, "u1", sess.ID, &buf, ExportTar, now); err != nil {
+		t.Fatalf("ExportSession: %v", err)
+	}
+	var names []string
+	tr := tar.NewReader(&buf)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatalf("tar: %v", err)
+		}
+		names = append(names, hdr.Name)
+	}
+	if strings.Join(names, ",") != "session.json,index.html" {
+		t.Fatalf("unexpected bundle: %v", names)
+	}
+
+	if err := ExportSession(ctx, s, "u2", sess.ID, io.Discard, ExportJSON, now); !errors.Is(err, ErrSessionNotFound) {
+		t.Fatalf("expected another user's session to be missing, got %v", err)
+	}
+	s.DeleteSession(ctx, "u1", sess.ID, 4000)
+	if err := ExportSession(ctx, s, "u1", sess.ID, io.Discard, ExportJSON, now); !errors.Is(err, ErrSessionNotFound) {
+		t.Fatalf("expected a deleted session to be missing, got %v", err)
+	}
+	if err := ExportSession(ctx, s, "u1", sess.ID, io.Discard, "zip", now); !errors.Is(err, ErrInvalidExportFormat) {
+		t.Fatalf("expected ErrInvalidExportFormat, got %v", err)
+	}
+}
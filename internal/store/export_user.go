@@ -0,0 +1,348 @@
+package store
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/url"
+	"time"
+
+	"happy-server-lite/internal/clock"
+	"happy-server-lite/internal/model"
+)
+
+// User exports hold everything the store keeps for one account, using the
+// field names of the REST API: one JSON document, or a tar archive with one
+// JSON file per record. Encrypted fields are exported as stored.
+const (
+	userExportFormat  = "happy-server-lite-user-export"
+	userExportVersion = 1
+)
+
+type ExportFormat string
+
+const (
+	ExportJSON ExportFormat = "json"
+	ExportTar  ExportFormat = "tar"
+)
+
+// ErrInvalidExportFormat is returned by ExportUser for unknown formats.
+var ErrInvalidExportFormat = errors.New("invalid export format")
+
+type userExportHeader struct {
+	Format     string `json:"format"`
+	Version    int    `json:"version"`
+	UserID     string `json:"userId"`
+	ExportedAt int64  `json:"exportedAt"`
+}
+
+type userExportSettings struct {
+	Settings *string `json:"settings"`
+	Version  int     `json:"version"`
+}
+
+type userExportMessage struct {
+	ID          string                          `json:"id"`
+	Seq         int64                           `json:"seq"`
+	Content     string                          `json:"content"`
+	CreatedAt   int64                           `json:"createdAt"`
+	UpdatedAt   int64                           `json:"updatedAt"`
+	Annotations map[string]userExportAnnotation `json:"annotations,omitempty"`
+}
+
+type userExportAnnotation struct {
+	Value     string `json:"value"`
+	Version   int    `json:"version"`
+	UpdatedAt int64  `json:"updatedAt"`
+}
+
+type userExportSession struct {
+	ID                string              `json:"id"`
+	Tag               string              `json:"tag"`
+	Seq               int64               `json:"seq"`
+	Metadata          string              `json:"metadata"`
+	MetadataVersion   int                 `json:"metadataVersion"`
+	AgentState        *string             `json:"agentState"`
+	AgentStateVersion int                 `json:"agentStateVersion"`
+	DataEncryptionKey *string             `json:"dataEncryptionKey"`
+	Active            bool                `json:"active"`
+	ActiveAt          int64               `json:"activeAt"`
+	CreatedAt         int64               `json:"createdAt"`
+	UpdatedAt         int64               `json:"updatedAt"`
+	Messages          []userExportMessage `json:"messages"`
+}
+
+type userExportMachine struct {
+	ID                 string  `json:"id"`
+	Metadata           string  `json:"metadata"`
+	MetadataVersion    int     `json:"metadataVersion"`
+	DaemonState        *string `json:"daemonState"`
+	DaemonStateVersion int     `json:"daemonStateVersion"`
+	DataEncryptionKey  *string `json:"dataEncryptionKey"`
+	CreatedAt          int64   `json:"createdAt"`
+	UpdatedAt          int64   `json:"updatedAt"`
+}
+
+type userExportArtifact struct {
+	ID                string `json:"id"`
+	Header            string `json:"header"`
+	HeaderVersion     int    `json:"headerVersion"`
+	Body              string `json:"body"`
+	BodyVersion       int    `json:"bodyVersion"`
+	DataEncryptionKey string `json:"dataEncryptionKey"`
+	CreatedAt         int64  `json:"createdAt"`
+	UpdatedAt         int64  `json:"updatedAt"`
+}
+
+// userExportWriter lays out the records of an export. Records arrive as
+// named objects and as items of the "sessions", "machines" and "artifacts"
+// lists, in that order.
+type userExportWriter interface {
+	object(name string, v any) error
+	beginList(name string) error
+	item(list, id string, v any) error
+	endList() error
+	close() error
+}
+
+// ExportUser writes the sessions with their messages, machines, artifacts
+// and settings of userID to w. Deleted sessions and artifacts are left out.
+func (s *Store) ExportUser(ctx context.Context, userID string, w io.Writer, format ExportFormat) error {
+	return exportUser(ctx, s, userID, w, format, clock.Now(s.clock))
+}
+
+func (p *PostgresStore) ExportUser(ctx context.Context, userID string, w io.Writer, format ExportFormat) error {
+	return exportUser(ctx, p, userID, w, format, clock.Now(p.clock))
+}
+
+func (r *RedisStore) ExportUser(ctx context.Context, userID string, w io.Writer, format ExportFormat) error {
+	return exportUser(ctx, r, userID, w, format, clock.Now(r.clock))
+}
+
+// exportUser builds an export from the Storage methods alone, so it reads
+// the same data the REST API serves whatever the backend. One session's
+// messages are held in memory at a time.
+func exportUser(ctx context.Context, st Storage, userID string, w io.Writer, format ExportFormat, now time.Time) error {
+	var out userExportWriter
+	switch format {
+	case ExportJSON:
+		out = &jsonUserExport{w: w}
+	case ExportTar:
+		out = &tarUserExport{tw: tar.NewWriter(w), modTime: now}
+	default:
+		return ErrInvalidExportFormat
+	}
+
+	header := userExportHeader{Format: userExportFormat, Version: userExportVersion, UserID: userID, ExportedAt: now.UnixMilli()}
+	if err := out.object("export", header); err != nil {
+		return err
+	}
+	settings, version := st.GetAccountSettings(ctx, userID)
+	if err := out.object("settings", userExportSettings{Settings: settings, Version: version}); err != nil {
+		return err
+	}
+
+	if err := out.beginList("sessions"); err != nil {
+		return err
+	}
+	for _, sess := range st.ListSessions(ctx, userID) {
+		item, err := exportSession(ctx, st, userID, sess)
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		if err != nil {
+			// The session was deleted while the export ran.
+			continue
+		}
+		if err := out.item("sessions", sess.ID, item); err != nil {
+			return err
+		}
+	}
+	if err := out.endList(); err != nil {
+		return err
+	}
+
+	if err := out.beginList("machines"); err != nil {
+		return err
+	}
+	for _, m := range st.ListMachines(ctx, userID) {
+		item := userExportMachine{
+			ID:                 m.ID,
+			Metadata:           m.Metadata,
+			MetadataVersion:    m.MetadataVersion,
+			DaemonState:        m.DaemonState,
+			DaemonStateVersion: m.DaemonStateVersion,
+			DataEncryptionKey:  m.DataEncryptionKey,
+			CreatedAt:          m.CreatedAt,
+			UpdatedAt:          m.UpdatedAt,
+		}
+		if err := out.item("machines", m.ID, item); err != nil {
+			return err
+		}
+	}
+	if err := out.endList(); err != nil {
+		return err
+	}
+
+	if err := out.beginList("artifacts"); err != nil {
+		return err
+	}
+	for _, listed := range st.ListArtifacts(ctx, userID) {
+		a, ok := st.GetArtifact(ctx, userID, listed.ID)
+		if !ok {
+			continue
+		}
+		item := userExportArtifact{
+			ID:                a.ID,
+			Header:            a.Header,
+			HeaderVersion:     a.HeaderVersion,
+			Body:              a.Body,
+			BodyVersion:       a.BodyVersion,
+			DataEncryptionKey: a.DataEncryptionKey,
+			CreatedAt:         a.CreatedAt,
+			UpdatedAt:         a.UpdatedAt,
+		}
+		if err := out.item("artifacts", a.ID, item); err != nil {
+			return err
+		}
+	}
+	if err := out.endList(); err != nil {
+		return err
+	}
+	return out.close()
+}
+
+func exportSession(ctx context.Context, st Storage, userID string, sess model.Session) (userExportSession, error) {
+	item := userExportSession{
+		ID:                sess.ID,
+		Tag:               sess.Tag,
+		Seq:               sess.Seq,
+		Metadata:          sess.Metadata,
+		MetadataVersion:   sess.MetadataVersion,
+		AgentState:        sess.AgentState,
+		AgentStateVersion: sess.AgentStateVersion,
+		DataEncryptionKey: sess.DataEncryptionKey,
+		Active:            sess.Active,
+		ActiveAt:          sess.ActiveAt,
+		CreatedAt:         sess.CreatedAt,
+		UpdatedAt:         sess.UpdatedAt,
+		Messages:          []userExportMessage{},
+	}
+	err := StreamMessages(ctx, st, userID, sess.ID, MessageQuery{}, func(m model.SessionMessage) error {
+		msg := userExportMessage{
+			ID:        m.ID,
+			Seq:       m.Seq,
+			Content:   m.Content,
+			CreatedAt: m.CreatedAt,
+			UpdatedAt: m.UpdatedAt,
+		}
+		for key, a := range m.Annotations {
+			if msg.Annotations == nil {
+				msg.Annotations = make(map[string]userExportAnnotation, len(m.Annotations))
+			}
+			msg.Annotations[key] = userExportAnnotation{Value: a.Value, Version: a.Version, UpdatedAt: a.UpdatedAt}
+		}
+		item.Messages = append(item.Messages, msg)
+		return nil
+	})
+	if err != nil {
+		return userExportSession{}, err
+	}
+	return item, nil
+}
+
+// jsonUserExport writes one JSON object: the "export" header's fields at the
+// top level, then every other object and list under its name.
+type jsonUserExport struct {
+	w     io.Writer
+	items int
+}
+
+func (j *jsonUserExport) write(parts ...[]byte) error {
+	for _, p := range parts {
+		if _, err := j.w.Write(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (j *jsonUserExport) object(name string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if name == "export" {
+		// Leave the header object open for the fields that follow.
+		return j.write(bytes.TrimSuffix(data, []byte("}")))
+	}
+	return j.write([]byte(`,"`+name+`":`), data)
+}
+
+func (j *jsonUserExport) beginList(name string) error {
+	j.items = 0
+	return j.write([]byte(`,"` + name + `":[`))
+}
+
+func (j *jsonUserExport) item(_, _ string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if j.items > 0 {
+		data = append([]byte(","), data...)
+	}
+	j.items++
+	return j.write(data)
+}
+
+func (j *jsonUserExport) endList() error {
+	return j.write([]byte("]"))
+}
+
+func (j *jsonUserExport) close() error {
+	return j.write([]byte("}\n"))
+}
+
+// tarUserExport writes export.json, settings.json and one
+// <list>/<id>.json file per item, with the id path-escaped so client-chosen
+// ids cannot name other paths.
+type tarUserExport struct {
+	tw      *tar.Writer
+	modTime time.Time
+}
+
+func (t *tarUserExport) file(name string, v any) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	hdr := &tar.Header{Name: name, Mode: 0o600, Size: int64(len(data)), ModTime: t.modTime}
+	if err := t.tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err = t.tw.Write(data)
+	return err
+}
+
+func (t *tarUserExport) object(name string, v any) error {
+	return t.file(name+".json", v)
+}
+
+func (t *tarUserExport) beginList(name string) error {
+	return t.tw.WriteHeader(&tar.Header{Name: name + "/", Typeflag: tar.TypeDir, Mode: 0o700, ModTime: t.modTime})
+}
+
+func (t *tarUserExport) item(list, id string, v any) error {
+	return t.file(list+"/"+url.PathEscape(id)+".json", v)
+}
+
+func (t *tarUserExport) endList() error { return nil }
+
+func (t *tarUserExport) close() error {
+	return t.tw.Close()
+}
@@ -0,0 +1,112 @@
+package store
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"sort"
+	"testing"
+)
+
+func seedExportUser(t *testing.T) *Store {
+	t.Helper()
+	ctx := context.Background()
+	s := New()
+	now := int64(1000)
+	s.UpdateAccountSettings(ctx, "u1", 0, "prefs", now)
+	sess, _, err := s.GetOrCreateSession(ctx, "u1", "tag", "meta", nil, nil, now)
+	if err != nil {
+		t.Fatalf("GetOrCreateSession: %v", err)
+	}
+	for i := 0; i < streamMessagesPage+1; i++ {
+		if _, err := s.AppendMessage(ctx, "u1", sess.ID, "c", now); err != nil {
+			t.Fatalf("AppendMessage: %v", err)
+		}
+	}
+	gone, _, _ := s.GetOrCreateSession(ctx, "u1", "gone", "meta", nil, nil, now)
+	s.DeleteSession(ctx, "u1", gone.ID, now)
+	s.UpsertMachine(ctx, "u1", "m1", "mmeta", nil, nil, now)
+	if _, _, err := s.CreateArtifact(ctx, "u1", "../a1", "h", "b", "k", now); err != nil {
+		t.Fatalf("CreateArtifact: %v", err)
+	}
+	s.GetOrCreateSession(ctx, "u2", "other", "meta", nil, nil, now)
+	return s
+}
+
+func TestStore_ExportUserJSON(t *testing.T) {
+	ctx := context.Background()
+	s := seedExportUser(t)
+
+	var buf bytes.Buffer
+	if err := s.ExportUser(ctx, "u1", &buf, ExportJSON); err != nil {
+		t.Fatalf("ExportUser: %v", err)
+	}
+	var got struct {
+		Format    string             `json:"format"`
+		UserID    string             `json:"userId"`
+		Settings  userExportSettings `json:"settings"`
+		Sessions  []userExportSession
+		Machines  []userExportMachine
+		Artifacts []userExportArtifact
+	}
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("unmarshal: %v (%s)", err, buf.String())
+	}
+	if got.Format != userExportFormat || got.UserID != "u1" {
+		t.Fatalf("unexpected header: %+v", got)
+	}
+	if got.Settings.Settings == nil || *got.Settings.Settings != "prefs" || got.Settings.Version != 1 {
+		t.Fatalf("unexpected settings: %+v", got.Settings)
+	}
+	if len(got.Sessions) != 1 || got.Sessions[0].Tag != "tag" || len(got.Sessions[0].Messages) != streamMessagesPage+1 {
+		t.Fatalf("expected the live session with every message, got %d sessions", len(got.Sessions))
+	}
+	if len(got.Machines) != 1 || got.Machines[0].Metadata != "mmeta" {
+		t.Fatalf("unexpected machines: %+v", got.Machines)
+	}
+	if len(got.Artifacts) != 1 || got.Artifacts[0].Body != "b" {
+		t.Fatalf("unexpected artifacts: %+v", got.Artifacts)
+	}
+}
+
+func TestStore_ExportUserTar(t *testing.T) {
+	ctx := context.Background()
+	s := seedExportUser(t)
+
+	var buf bytes.Buffer
+	if err := s.ExportUser(ctx, "u1", &buf, ExportTar); err != nil {
+		t.Fatalf("ExportUser: %v", err)
+	}
+	var names []string
+	tr := tar.NewReader(&buf)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatalf("tar: %v", err)
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			names = append(names, hdr.Name)
+		}
+	}
+	sort.Strings(names)
+	sessions := s.ListSessions(ctx, "u1")
+	want := []string{"artifacts/..%2Fa1.json", "export.json", "machines/m1.json", "sessions/" + sessions[0].ID + ".json", "settings.json"}
+	if len(names) != len(want) {
+		t.Fatalf("expected %v, got %v", want, names)
+	}
+	for i := range want {
+		if names[i] != want[i] {
+			t.Fatalf("expected %v, got %v", want, names)
+		}
+	}
+
+	if err := s.ExportUser(ctx, "u1", io.Discard, "zip"); !errors.Is(err, ErrInvalidExportFormat) {
+		t.Fatalf("expected ErrInvalidExportFormat, got %v", err)
+	}
+}
@@ -0,0 +1,121 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"happy-server-lite/internal/model"
+)
+
+// SetGitHubIdentity links userID to a GitHub user, replacing any user
+// linked before.
+func (s *Store) SetGitHubIdentity(ctx context.Context, userID string, identity model.GitHubIdentity) bool {
+	if userID == "" {
+		return false
+	}
+	s.mu.Lock()
+	changed := false
+	defer s.unlockAndSaveAccounts(&changed)
+
+	s.githubByUserID[userID] = identity
+	s.persist(recordGitHub, userID, identity)
+	changed = true
+	return true
+}
+
+func (s *Store) GetGitHubIdentity(ctx context.Context, userID string) (model.GitHubIdentity, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	identity, ok := s.githubByUserID[userID]
+	return identity, ok
+}
+
+// DeleteGitHubIdentity unlinks the GitHub user of userID and reports
+// whether there was one.
+func (s *Store) DeleteGitHubIdentity(ctx context.Context, userID string) bool {
+	s.mu.Lock()
+	changed := false
+	defer s.unlockAndSaveAccounts(&changed)
+
+	if _, ok := s.githubByUserID[userID]; !ok {
+		return false
+	}
+	delete(s.githubByUserID, userID)
+	s.unpersist(recordGitHub, userID)
+	changed = true
+	return true
+}
+
+// Postgres.
+
+func (p *PostgresStore) SetGitHubIdentity(ctx context.Context, userID string, identity model.GitHubIdentity) bool {
+	if userID == "" {
+		return false
+	}
+	_, err := p.db.ExecContext(ctx, `INSERT INTO github_identities (user_id, github_id, login, name, avatar_url, linked_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (user_id) DO UPDATE SET github_id = $2, login = $3, name = $4, avatar_url = $5, linked_at = $6`,
+		userID, identity.ID, identity.Login, identity.Name, identity.AvatarURL, identity.LinkedAt)
+	if err != nil {
+		p.logError("set github identity", err)
+		return false
+	}
+	return true
+}
+
+func (p *PostgresStore) GetGitHubIdentity(ctx context.Context, userID string) (model.GitHubIdentity, bool) {
+	var identity model.GitHubIdentity
+	err := p.db.QueryRowContext(ctx, `SELECT github_id, login, name, avatar_url, linked_at FROM github_identities WHERE user_id = $1`, userID).
+		Scan(&identity.ID, &identity.Login, &identity.Name, &identity.AvatarURL, &identity.LinkedAt)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			p.logError("get github identity", err)
+		}
+		return model.GitHubIdentity{}, false
+	}
+	return identity, true
+}
+
+func (p *PostgresStore) DeleteGitHubIdentity(ctx context.Context, userID string) bool {
+	res, err := p.db.ExecContext(ctx, `DELETE FROM github_identities WHERE user_id = $1`, userID)
+	if err != nil {
+		p.logError("delete github identity", err)
+		return false
+	}
+	n, _ := res.RowsAffected()
+	return n > 0
+}
+
+// Redis.
+
+func (r *RedisStore) SetGitHubIdentity(ctx context.Context, userID string, identity model.GitHubIdentity) bool {
+	if userID == "" {
+		return false
+	}
+	if _, err := r.client.do(ctx, "SET", r.githubKey(userID), redisJSON(identity)); err != nil {
+		r.logError("set github identity", err)
+		return false
+	}
+	return true
+}
+
+func (r *RedisStore) GetGitHubIdentity(ctx context.Context, userID string) (model.GitHubIdentity, bool) {
+	var identity model.GitHubIdentity
+	ok, err := getJSON(r.client.doFunc(ctx), r.githubKey(userID), &identity)
+	if err != nil {
+		r.logError("get github identity", err)
+		return model.GitHubIdentity{}, false
+	}
+	return identity, ok
+}
+
+func (r *RedisStore) DeleteGitHubIdentity(ctx context.Context, userID string) bool {
+	reply, err := r.client.do(ctx, "DEL", r.githubKey(userID))
+	if err != nil {
+		r.logError("delete github identity", err)
+		return false
+	}
+	n, _ := reply.(int64)
+	return n > 0
+}
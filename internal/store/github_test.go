@@ -0,0 +1,54 @@
+package store
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"happy-server-lite/internal/model"
+)
+
+func testGitHubIdentity(t *testing.T, s Storage) {
+	t.Helper()
+	ctx := context.Background()
+	if _, ok := s.GetGitHubIdentity(ctx, "user-1"); ok {
+		t.Fatalf("expected no GitHub user before linking")
+	}
+	s.SetGitHubIdentity(ctx, "user-1", model.GitHubIdentity{ID: 1, Login: "old", LinkedAt: 1000})
+	if !s.SetGitHubIdentity(ctx, "user-1", model.GitHubIdentity{ID: 42, Login: "octocat", Name: "The Octocat", LinkedAt: 2000}) {
+		t.Fatalf("expected the GitHub user to be linked")
+	}
+	if got, ok := s.GetGitHubIdentity(ctx, "user-1"); !ok || got.ID != 42 || got.Login != "octocat" || got.LinkedAt != 2000 {
+		t.Fatalf("expected relinking to replace the GitHub user: %+v %v", got, ok)
+	}
+	if _, ok := s.GetGitHubIdentity(ctx, "user-2"); ok {
+		t.Fatalf("expected another user to have no GitHub user")
+	}
+	if s.DeleteGitHubIdentity(ctx, "user-2") || !s.DeleteGitHubIdentity(ctx, "user-1") {
+		t.Fatalf("expected only the linked user to be unlinked")
+	}
+	if _, ok := s.GetGitHubIdentity(ctx, "user-1"); ok {
+		t.Fatalf("expected the GitHub user to be unlinked")
+	}
+}
+
+func TestStore_GitHubIdentity(t *testing.T) {
+	testGitHubIdentity(t, New())
+}
+
+func TestRedisStore_GitHubIdentity(t *testing.T) {
+	testGitHubIdentity(t, openFakeRedisStore(t, 0))
+}
+
+func TestStore_GitHubIdentity_Persist(t *testing.T) {
+	ctx := context.Background()
+	opts := Options{AccountsStateFile: filepath.Join(t.TempDir(), "accounts-state.json")}
+
+	s1 := NewWithOptions(opts)
+	s1.SetGitHubIdentity(ctx, "user-1", model.GitHubIdentity{ID: 42, Login: "octocat"})
+
+	s2 := NewWithOptions(opts)
+	if got, ok := s2.GetGitHubIdentity(ctx, "user-1"); !ok || got.Login != "octocat" {
+		t.Fatalf("expected the GitHub user to survive a reload: %+v %v", got, ok)
+	}
+}
@@ -0,0 +1,377 @@
+package store
+
+import (
+	"container/list"
+	"encoding/json"
+	"log"
+	"strings"
+	"sync"
+
+	"happy-server-lite/internal/model"
+)
+
+// hydration tracks the users whose sessions, machines and messages are in
+// memory when they are loaded from a UserBackend on first access rather
+// than on start, and evicts the least recently used past capacity. Records
+// are written through as they change, so an evicted user is reloaded as it
+// was left.
+type hydration struct {
+	backend  UserBackend
+	capacity int
+
+	mu    sync.Mutex
+	order *list.List // of *hydratedUser, most recently used first
+	users map[string]*list.Element
+}
+
+type hydratedUser struct {
+	userID string
+	// ready is closed once the user's records are loaded, or loading them
+	// failed with err.
+	ready chan struct{}
+	err   error
+	// pins counts the calls using the user's records, which keep it from
+	// being evicted. Guarded by hydration.mu.
+	pins int
+}
+
+// newHydration returns nil, keeping the whole store in memory, unless
+// opts.HydratedUsers is set and the backend is the only place sessions and
+// machines are kept: state files and journals are rewritten from memory and
+// would lose the users it does not hold.
+func newHydration(opts Options) *hydration {
+	if opts.HydratedUsers <= 0 || opts.Backend == nil {
+		return nil
+	}
+	b, ok := opts.Backend.(UserBackend)
+	switch {
+	case !ok:
+		log.Printf("store persistence: backend cannot load users on their own, loading everything")
+		return nil
+	case opts.SessionsStateFile != "" || opts.MachinesStateFile != "" || opts.MessageJournalDir != "" || opts.StatePartitionDir != "":
+		log.Printf("store persistence: users are loaded on start while state files or journals are kept")
+		return nil
+	}
+	return &hydration{backend: b, capacity: opts.HydratedUsers, order: list.New(), users: make(map[string]*list.Element)}
+}
+
+// userShard returns userID's shard once the user's records are in memory,
+// pinned there until unpin is called; the store's per-user methods reach
+// their records through it.
+func (s *Store) userShard(userID string) (sh *userShard, unpin func(), err error) {
+	unpin, err = s.pinUser(userID)
+	if err != nil {
+		return nil, nil, err
+	}
+	return s.shard(userID), unpin, nil
+}
+
+// pinUser loads userID's records unless they are in memory or being loaded,
+// in which case it waits for them, and keeps them from being evicted until
+// unpin is called. Users are evicted past HydratedUsers only once no call
+// has them pinned, so more can be in memory for a while when more are in
+// use at once. When loading fails every caller waiting on it gets the
+// error, and the next call tries again.
+func (s *Store) pinUser(userID string) (unpin func(), err error) {
+	h := s.hydration
+	if h == nil || userID == "" {
+		return func() {}, nil
+	}
+	h.mu.Lock()
+	if e, ok := h.users[userID]; ok {
+		u := e.Value.(*hydratedUser)
+		u.pins++
+		h.order.MoveToFront(e)
+		h.mu.Unlock()
+		<-u.ready
+		if u.err != nil {
+			s.unpinUser(u)
+			return nil, u.err
+		}
+		return func() { s.unpinUser(u) }, nil
+	}
+	u := &hydratedUser{userID: userID, ready: make(chan struct{}), pins: 1}
+	e := h.order.PushFront(u)
+	h.users[userID] = e
+	s.evictLocked()
+	h.mu.Unlock()
+
+	if err := s.loadUser(userID); err != nil {
+		log.Printf("store persistence: load user %s failed: %v", userID, err)
+		h.mu.Lock()
+		h.order.Remove(e)
+		delete(h.users, userID)
+		s.dropUser(userID)
+		h.mu.Unlock()
+		u.err = err
+		close(u.ready)
+		return nil, err
+	}
+	close(u.ready)
+	return func() { s.unpinUser(u) }, nil
+}
+
+func (s *Store) unpinUser(u *hydratedUser) {
+	h := s.hydration
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	u.pins--
+	s.evictLocked()
+}
+
+// evictLocked drops users past capacity, least recently used first. Users
+// still loading or pinned are left alone. Users are dropped under
+// hydration.mu, so one being dropped cannot be loaded again meanwhile.
+func (s *Store) evictLocked() {
+	h := s.hydration
+	for e := h.order.Back(); e != nil && h.order.Len() > h.capacity; {
+		prev := e.Prev()
+		u := e.Value.(*hydratedUser)
+		select {
+		case <-u.ready:
+			if u.pins == 0 {
+				h.order.Remove(e)
+				delete(h.users, u.userID)
+				s.dropUser(u.userID)
+			}
+		default:
+		}
+		e = prev
+	}
+}
+
+// hydratedUsers returns how many users are in memory.
+func (h *hydration) hydratedUsers() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.order.Len()
+}
+
+func (s *Store) loadUser(userID string) error {
+	records, err := s.hydration.backend.LoadUser(userID)
+	if err != nil {
+		return err
+	}
+	sortRecords(records)
+
+	sh := s.shard(userID)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	for _, r := range records {
+		switch r.Kind {
+		case recordSession, recordMachine:
+			if err := s.loadRecordLocked(r); err != nil {
+				return err
+			}
+		case recordMessage:
+			var msg model.SessionMessage
+			if err := json.Unmarshal(r.Data, &msg); err != nil {
+				return err
+			}
+			s.messages.put(msg)
+		}
+	}
+	// Messages may have been pruned, so a session's Seq is where its
+	// counter resumes unless a newer message says otherwise.
+	u := sh.records(userID)
+	if u == nil {
+		return nil
+	}
+	s.seq.mu.Lock()
+	defer s.seq.mu.Unlock()
+	for sid, sess := range u.sessions {
+		last := sess.Seq
+		if msgs := s.messages.forSession(sid); len(msgs) > 0 && msgs[len(msgs)-1].Seq > last {
+			last = msgs[len(msgs)-1].Seq
+		}
+		s.seq.perSession[sid] = last
+	}
+	return nil
+}
+
+// dropUser forgets userID's records and the messages of its sessions.
+func (s *Store) dropUser(userID string) {
+	sh := s.shard(userID)
+	sh.mu.Lock()
+	u := sh.records(userID)
+	delete(sh.users, userID)
+	sh.mu.Unlock()
+	if u == nil {
+		return
+	}
+	for sid := range u.sessions {
+		s.messages.deleteSession(sid)
+		s.seq.reset(sid)
+	}
+}
+
+// ownedKinds are the records loaded with their owner rather than on start.
+var ownedKinds = map[string]bool{recordSession: true, recordMachine: true, recordMessage: true}
+
+// loadSharedRecords loads the records every user shares and leaves the rest
+// to hydrate. Owned kinds without an owner were written before owners were
+// kept; they are given theirs first.
+func (s *Store) loadSharedRecords() error {
+	records, err := s.hydration.backend.LoadShared()
+	if err != nil {
+		return err
+	}
+	var shared, unowned []Record
+	for _, r := range records {
+		if ownedKinds[r.Kind] {
+			unowned = append(unowned, r)
+		} else {
+			shared = append(shared, r)
+		}
+	}
+	if len(unowned) > 0 {
+		if err := s.claimRecords(unowned); err != nil {
+			return err
+		}
+	}
+	sortRecords(shared)
+
+	s.lockAll()
+	defer s.unlockAll()
+	for _, r := range shared {
+		if err := s.loadRecordLocked(r); err != nil {
+			return err
+		}
+	}
+	s.rekeyRecordsLocked(shared)
+	return nil
+}
+
+// recordUser reads the user id a session or machine record holds.
+func recordUser(r Record) string {
+	var v struct{ UserID string }
+	if json.Unmarshal(r.Data, &v) != nil {
+		return ""
+	}
+	return v.UserID
+}
+
+// assignOwners sets the owner of session and machine records, and of
+// message records whose session is among them.
+func assignOwners(records []Record) {
+	owners := make(map[string]string) // sessionID -> userID
+	for i, r := range records {
+		switch r.Kind {
+		case recordSession:
+			records[i].Owner = recordUser(r)
+			owners[r.Key] = records[i].Owner
+		case recordMachine:
+			records[i].Owner = recordUser(r)
+		}
+	}
+	for i, r := range records {
+		if r.Kind == recordMessage {
+			sid, _, _ := strings.Cut(r.Key, "|")
+			records[i].Owner = owners[sid]
+		}
+	}
+}
+
+// claimRecords writes unowned session, machine and message records back
+// with their owner, moving machines still keyed by the machine id alone to
+// machineKey. A message's owner is its session's, found by loading
+// everything once when its session already has one.
+func (s *Store) claimRecords(unowned []Record) error {
+	owners := make(map[string]string) // sessionID -> userID
+	missing := false
+	for _, r := range unowned {
+		if r.Kind == recordSession {
+			owners[r.Key] = recordUser(r)
+		}
+	}
+	for _, r := range unowned {
+		if sid, _, _ := strings.Cut(r.Key, "|"); r.Kind == recordMessage && owners[sid] == "" {
+			missing = true
+		}
+	}
+	if missing {
+		all, err := s.hydration.backend.Load()
+		if err != nil {
+			return err
+		}
+		for _, r := range all {
+			if r.Kind == recordSession {
+				owners[r.Key] = recordUser(r)
+			}
+		}
+	}
+
+	claimed := 0
+	for _, r := range unowned {
+		key := r.Key
+		switch r.Kind {
+		case recordSession:
+			r.Owner = owners[r.Key]
+		case recordMachine:
+			var m model.Machine
+			if json.Unmarshal(r.Data, &m) == nil {
+				r.Owner = m.UserID
+				key = machineKey(m.UserID, m.ID)
+			}
+		case recordMessage:
+			sid, _, _ := strings.Cut(r.Key, "|")
+			r.Owner = owners[sid]
+		}
+		if r.Owner == "" {
+			log.Printf("store persistence: %s %s has no owner, skipped", r.Kind, r.Key)
+			continue
+		}
+		oldKey := r.Key
+		r.Key = key
+		if err := s.backend.Put(r); err != nil {
+			return err
+		}
+		if key != oldKey {
+			if err := s.backend.Delete(r.Kind, oldKey); err != nil {
+				return err
+			}
+		}
+		claimed++
+	}
+	log.Printf("store persistence: recorded owners of %d records", claimed)
+	return nil
+}
+
+// backendSnapshot returns every record the backend holds with state strings
+// uncompressed, for backups of a store that keeps only some users in
+// memory.
+func (s *Store) backendSnapshot() ([]Record, error) {
+	records, err := s.backend.Load()
+	if err != nil {
+		return nil, err
+	}
+	for i, r := range records {
+		var v any
+		switch r.Kind {
+		case recordSession:
+			var sess model.Session
+			if err := json.Unmarshal(r.Data, &sess); err != nil {
+				return nil, err
+			}
+			v, err = decompressSession(sess)
+		case recordMachine:
+			var m model.Machine
+			if err := json.Unmarshal(r.Data, &m); err != nil {
+				return nil, err
+			}
+			v, err = decompressMachine(m)
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		data, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		records[i] = Record{Kind: r.Kind, Key: r.Key, Data: data}
+	}
+	sortRecords(records)
+	return records, nil
+}
@@ -0,0 +1,183 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+)
+
+// seedUsers gives each user an account, a session with two messages and a
+// machine, written through to backend.
+func seedUsers(t *testing.T, backend Backend, users ...string) map[string]string {
+	t.Helper()
+	ctx := context.Background()
+	s := NewWithOptions(Options{Backend: backend})
+	sessions := make(map[string]string)
+	for _, pk := range users {
+		acc, _ := s.GetOrCreateAccount(ctx, pk, 1000)
+		sess, _, err := s.GetOrCreateSession(ctx, acc.ID, "tag", "meta", nil, nil, 1000)
+		if err != nil {
+			t.Fatalf("GetOrCreateSession: %v", err)
+		}
+		s.AppendMessage(ctx, acc.ID, sess.ID, "c1", 1000)
+		s.AppendMessage(ctx, acc.ID, sess.ID, "c2", 1000)
+		s.UpsertMachine(ctx, acc.ID, "m1", "meta", nil, nil, 1000)
+		sessions[acc.ID] = sess.ID
+	}
+	return sessions
+}
+
+func TestStore_HydratesUsersOnFirstAccess(t *testing.T) {
+	ctx := context.Background()
+	backend := newMemBackend()
+	sessions := seedUsers(t, backend, "pk1", "pk2", "pk3")
+
+	s := NewWithOptions(Options{Backend: backend, HydratedUsers: 2})
+	if st := s.Stats(); st.Accounts != 3 || st.Sessions != 0 || st.Machines != 0 || st.HydratedUsers != 0 {
+		t.Fatalf("expected only accounts loaded on start: %+v", st)
+	}
+	acc, created := s.GetOrCreateAccount(ctx, "pk1", 2000)
+	if created {
+		t.Fatalf("expected the account to be loaded on start")
+	}
+	u1 := acc.ID
+	msgs, err := s.ListMessages(ctx, u1, sessions[u1], 0, 10)
+	if err != nil || len(msgs) != 2 {
+		t.Fatalf("unexpected messages: %+v (%v)", msgs, err)
+	}
+	if msg, err := s.AppendMessage(ctx, u1, sessions[u1], "c3", 2000); err != nil || msg.Seq != 3 {
+		t.Fatalf("expected seq 3, got %+v (%v)", msg, err)
+	}
+
+	for userID := range sessions {
+		if userID != u1 {
+			if len(s.ListMachines(ctx, userID)) != 1 {
+				t.Fatalf("expected %s's machine", userID)
+			}
+		}
+	}
+	if st := s.Stats(); st.HydratedUsers != 2 || st.Sessions != 2 {
+		t.Fatalf("expected the least recently used user evicted: %+v", st)
+	}
+
+	msgs, err = s.ListMessages(ctx, u1, sessions[u1], 0, 10)
+	if err != nil || len(msgs) != 3 {
+		t.Fatalf("expected the appended message after reloading: %+v (%v)", msgs, err)
+	}
+	if msg, _ := s.AppendMessage(ctx, u1, sessions[u1], "c4", 3000); msg.Seq != 4 {
+		t.Fatalf("expected seqs to resume after reloading, got %d", msg.Seq)
+	}
+	if sess, ok := s.GetSession(ctx, u1, sessions[u1]); !ok || sess.Seq != 4 {
+		t.Fatalf("unexpected session: %+v", sess)
+	}
+}
+
+// flakyUserBackend fails to load users while err is set.
+type flakyUserBackend struct {
+	*memBackend
+	err error
+}
+
+func (b *flakyUserBackend) LoadUser(userID string) ([]Record, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+	return b.memBackend.LoadUser(userID)
+}
+
+func TestStore_HydrationPinsUsersAndReportsLoadErrors(t *testing.T) {
+	ctx := context.Background()
+	backend := &flakyUserBackend{memBackend: newMemBackend()}
+	sessions := seedUsers(t, backend.memBackend, "pk1", "pk2", "pk3")
+	var users []string
+	for userID := range sessions {
+		users = append(users, userID)
+	}
+	s := NewWithOptions(Options{Backend: backend, HydratedUsers: 1})
+
+	// A user in use is not evicted to make room; the others go once their
+	// calls are done.
+	unpin, err := s.pinUser(users[0])
+	if err != nil {
+		t.Fatalf("pinUser: %v", err)
+	}
+	if len(s.ListMachines(ctx, users[1])) != 1 {
+		t.Fatalf("expected the second user's machine")
+	}
+	hydrated := func(userID string) bool {
+		s.hydration.mu.Lock()
+		defer s.hydration.mu.Unlock()
+		_, ok := s.hydration.users[userID]
+		return ok
+	}
+	if !hydrated(users[0]) || hydrated(users[1]) {
+		t.Fatalf("expected the pinned user to be kept and the other evicted")
+	}
+	unpin()
+	if len(s.ListMachines(ctx, users[1])) != 1 || hydrated(users[0]) {
+		t.Fatalf("expected the user to be evicted once unpinned")
+	}
+
+	// A user that cannot be loaded is an error, not an empty user, and is
+	// tried again on the next call.
+	backend.err = errors.New("disk on fire")
+	if _, err := s.ListMessages(ctx, users[2], sessions[users[2]], 0, 10); !errors.Is(err, backend.err) {
+		t.Fatalf("expected the load error, got %v", err)
+	}
+	if _, _, err := s.GetOrCreateSession(ctx, users[2], "tag", "meta", nil, nil, 2000); !errors.Is(err, backend.err) {
+		t.Fatalf("expected no session to be created over an unloaded user, got %v", err)
+	}
+	backend.err = nil
+	if msgs, err := s.ListMessages(ctx, users[2], sessions[users[2]], 0, 10); err != nil || len(msgs) != 2 {
+		t.Fatalf("expected the user to load on retry: %+v (%v)", msgs, err)
+	}
+}
+
+func TestStore_HydrationClaimsUnownedRecords(t *testing.T) {
+	ctx := context.Background()
+	backend := newMemBackend()
+	sessions := seedUsers(t, backend, "pk1", "pk2")
+	// Records written before owners were kept.
+	for k, r := range backend.records {
+		r.Owner = ""
+		backend.records[k] = r
+	}
+
+	s := NewWithOptions(Options{Backend: backend, HydratedUsers: 10})
+	for userID, sid := range sessions {
+		msgs, err := s.ListMessages(ctx, userID, sid, 0, 10)
+		if err != nil || len(msgs) != 2 {
+			t.Fatalf("unexpected messages of %s: %+v (%v)", userID, msgs, err)
+		}
+		if len(s.ListMachines(ctx, userID)) != 1 {
+			t.Fatalf("expected %s's machine", userID)
+		}
+	}
+	for _, r := range backend.records {
+		if ownedKinds[r.Kind] && r.Owner == "" {
+			t.Fatalf("expected %s %s to be given an owner", r.Kind, r.Key)
+		}
+	}
+}
+
+func TestStore_HydratedExportHoldsEveryUser(t *testing.T) {
+	ctx := context.Background()
+	backend := newMemBackend()
+	sessions := seedUsers(t, backend, "pk1", "pk2", "pk3")
+	s := NewWithOptions(Options{Backend: backend, HydratedUsers: 1})
+
+	var buf bytes.Buffer
+	if err := s.Export(&buf); err != nil {
+		t.Fatalf("Export: %v", err)
+	}
+	restored := New()
+	if err := restored.Import(&buf); err != nil {
+		t.Fatalf("Import: %v", err)
+	}
+	for userID, sid := range sessions {
+		if sess, ok := restored.GetSession(ctx, userID, sid); !ok || sess.Metadata != "meta" {
+			t.Fatalf("expected %s's session in the backup: %+v", userID, sess)
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package store
+
+import (
+	"context"
+	"testing"
+
+	"happy-server-lite/internal/ids"
+)
+
+func testIDGenerator(t *testing.T, s Storage) {
+	t.Helper()
+	ctx := context.Background()
+	sess, _, err := s.GetOrCreateSession(ctx, "u1", "tag", "meta", nil, nil, 1000)
+	if err != nil {
+		t.Fatalf("GetOrCreateSession: %v", err)
+	}
+	msg, err := s.AppendMessageFrom(ctx, "", "u1", sess.ID, "hello", "", 1000)
+	if err != nil {
+		t.Fatalf("AppendMessageFrom: %v", err)
+	}
+	if sess.ID != "id-000000000001" || msg.ID != "id-000000000002" {
+		t.Fatalf("expected ids from the configured generator, got %q %q", sess.ID, msg.ID)
+	}
+}
+
+func TestStore_IDGenerator(t *testing.T) {
+	testIDGenerator(t, NewWithOptions(Options{NewID: ids.Sequential("id-")}))
+}
+
+func TestRedisStore_IDGenerator(t *testing.T) {
+	f := newFakeRedis(t)
+	r, err := OpenRedis(RedisOptions{URL: f.URL()}, Options{NewID: ids.Sequential("id-")})
+	if err != nil {
+		t.Fatalf("OpenRedis: %v", err)
+	}
+	t.Cleanup(func() { _ = r.Close() })
+	testIDGenerator(t, r)
+}
@@ -0,0 +1,210 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"happy-server-lite/internal/model"
+)
+
+const journalExt = ".ndjson"
+
+// messageJournal appends each message as one JSON line to a per-session file,
+// so a write costs one line instead of a full sessions snapshot.
+type messageJournal struct {
+	dir string
+
+	mu sync.Mutex
+	// lines counts what each journal holds on disk, including lines that
+	// failed to parse, so compaction can spot drift from memory.
+	lines map[string]int
+}
+
+func newMessageJournal(dir string) *messageJournal {
+	return &messageJournal{dir: dir, lines: make(map[string]int)}
+}
+
+func (j *messageJournal) path(sessionID string) string {
+	return filepath.Join(j.dir, sessionID+journalExt)
+}
+
+func (j *messageJournal) append(msg model.SessionMessage) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if err := os.MkdirAll(j.dir, 0o700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(j.path(msg.SessionID), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	j.lines[msg.SessionID]++
+	return nil
+}
+
+func (j *messageJournal) remove(sessionID string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	delete(j.lines, sessionID)
+	if err := os.Remove(j.path(sessionID)); err != nil && !os.IsNotExist(err) {
+		log.Printf("message journal: remove %s failed: %v", sessionID, err)
+	}
+}
+
+// sessionIDs lists the sessions that have a journal file.
+func (j *messageJournal) sessionIDs() ([]string, error) {
+	entries, err := os.ReadDir(j.dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var ids []string
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasSuffix(name, journalExt) {
+			continue
+		}
+		ids = append(ids, strings.TrimSuffix(name, journalExt))
+	}
+	return ids, nil
+}
+
+// read returns a session's messages ordered by seq without duplicates, and
+// how many lines the file holds.
+func (j *messageJournal) read(sessionID string) ([]model.SessionMessage, int, error) {
+	data, err := os.ReadFile(j.path(sessionID))
+	if err != nil {
+		return nil, 0, err
+	}
+	var msgs []model.SessionMessage
+	seen := make(map[int64]bool)
+	lines := 0
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	sc.Buffer(make([]byte, 0, 64*1024), len(data)+1)
+	for sc.Scan() {
+		lines++
+		var msg model.SessionMessage
+		if err := json.Unmarshal(sc.Bytes(), &msg); err != nil || msg.SessionID != sessionID || seen[msg.Seq] {
+			continue
+		}
+		seen[msg.Seq] = true
+		msgs = append(msgs, msg)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, 0, err
+	}
+	sort.Slice(msgs, func(a, b int) bool { return msgs[a].Seq < msgs[b].Seq })
+	return msgs, lines, nil
+}
+
+// rewrite replaces a session's journal with exactly msgs.
+func (j *messageJournal) rewrite(sessionID string, msgs []model.SessionMessage) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, msg := range msgs {
+		if err := enc.Encode(msg); err != nil {
+			return err
+		}
+	}
+	if err := writeFileAtomic(j.path(sessionID), buf.Bytes()); err != nil {
+		return err
+	}
+	j.lines[sessionID] = len(msgs)
+	return nil
+}
+
+// loadJournalLocked adds journaled messages newer than what is already
+// loaded and records journal sizes for CompactJournals.
+func (s *Store) loadJournalLocked() error {
+	ids, err := s.journal.sessionIDs()
+	if err != nil {
+		return err
+	}
+	known := s.sessionIDs()
+	s.journal.mu.Lock()
+	defer s.journal.mu.Unlock()
+	for _, sid := range ids {
+		if !known[sid] {
+			continue
+		}
+		msgs, lines, err := s.journal.read(sid)
+		if err != nil {
+			return fmt.Errorf("session %s: %w", sid, err)
+		}
+		s.journal.lines[sid] = lines
+		for _, msg := range msgs {
+			if msg.Seq <= s.seq.perSession[sid] {
+				continue
+			}
+			s.messages.append(sid, msg)
+			s.seq.perSession[sid] = msg.Seq
+		}
+	}
+	return nil
+}
+
+// CompactJournals removes journals of deleted or unknown sessions and
+// rewrites journals whose contents drifted from memory, for example after a
+// torn write, a crash between appends, or messages first loaded from the
+// sessions state file. It does nothing without a journal.
+func (s *Store) CompactJournals() {
+	if s.journal == nil {
+		return
+	}
+	ids, err := s.journal.sessionIDs()
+	if err != nil {
+		log.Printf("message journal: list failed: %v", err)
+		return
+	}
+
+	var live []string
+	s.eachSession(func(sess model.Session) {
+		if !sess.Deleted {
+			live = append(live, sess.ID)
+		}
+	})
+
+	isLive := make(map[string]bool, len(live))
+	for _, sid := range live {
+		isLive[sid] = true
+	}
+	for _, sid := range ids {
+		if !isLive[sid] {
+			s.journal.remove(sid)
+		}
+	}
+
+	for _, sid := range live {
+		s.journal.mu.Lock()
+		msgs := s.messages.forSession(sid)
+		if s.journal.lines[sid] != len(msgs) {
+			if err := s.persistStats.journal.record(s.journal.rewrite(sid, msgs)); err != nil {
+				log.Printf("message journal: compact %s failed: %v", sid, err)
+			}
+		}
+		s.journal.mu.Unlock()
+	}
+}
@@ -0,0 +1,94 @@
+package store
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestStore_MessageJournal(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	stateFile := filepath.Join(dir, "sessions-state.json")
+	journalDir := filepath.Join(dir, "journal")
+	opts := Options{SessionsStateFile: stateFile, MessageJournalDir: journalDir}
+
+	s1 := NewWithOptions(opts)
+	now := int64(1000)
+	sess, _, _ := s1.GetOrCreateSession(ctx, "u1", "tag", "meta", nil, nil, now)
+	gone, _, _ := s1.GetOrCreateSession(ctx, "u1", "gone", "meta", nil, nil, now)
+	for _, content := range []string{"one", "two"} {
+		if _, err := s1.AppendMessage(ctx, "u1", sess.ID, content, now); err != nil {
+			t.Fatalf("AppendMessage: %v", err)
+		}
+	}
+	if _, err := s1.AppendMessage(ctx, "u1", gone.ID, "bye", now); err != nil {
+		t.Fatalf("AppendMessage: %v", err)
+	}
+	s1.DeleteSession(ctx, "u1", gone.ID, now)
+
+	state, err := os.ReadFile(stateFile)
+	if err != nil {
+		t.Fatalf("read state file: %v", err)
+	}
+	if strings.Contains(string(state), `"messages"`) {
+		t.Fatalf("expected messages to stay out of the state file")
+	}
+	journal := filepath.Join(journalDir, sess.ID+journalExt)
+	data, err := os.ReadFile(journal)
+	if err != nil || strings.Count(string(data), "\n") != 2 {
+		t.Fatalf("expected two journal lines, got %q (%v)", data, err)
+	}
+	if _, err := os.Stat(filepath.Join(journalDir, gone.ID+journalExt)); !os.IsNotExist(err) {
+		t.Fatalf("expected deleted session journal removed, got %v", err)
+	}
+
+	// A torn write and an orphan are cleaned up on the next start.
+	f, _ := os.OpenFile(journal, os.O_WRONLY|os.O_APPEND, 0)
+	_, _ = f.WriteString(`{"id":"torn","sess`)
+	_ = f.Close()
+	orphan := filepath.Join(journalDir, "unknown"+journalExt)
+	_ = os.WriteFile(orphan, []byte("{}\n"), 0o600)
+
+	s2 := NewWithOptions(opts)
+	msgs, err := s2.ListMessages(ctx, "u1", sess.ID, 0, 10)
+	if err != nil || len(msgs) != 2 || msgs[1].Content != "two" {
+		t.Fatalf("unexpected messages after reload: %+v (%v)", msgs, err)
+	}
+	if data, _ := os.ReadFile(journal); strings.Contains(string(data), "torn") {
+		t.Fatalf("expected torn line compacted away")
+	}
+	if _, err := os.Stat(orphan); !os.IsNotExist(err) {
+		t.Fatalf("expected orphan journal removed, got %v", err)
+	}
+	next, err := s2.AppendMessage(ctx, "u1", sess.ID, "three", now)
+	if err != nil || next.Seq != 3 {
+		t.Fatalf("expected seq 3, got %d (%v)", next.Seq, err)
+	}
+}
+
+func TestStore_MessageJournalMigratesStateFileMessages(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	stateFile := filepath.Join(dir, "sessions-state.json")
+
+	s1 := NewWithOptions(Options{SessionsStateFile: stateFile})
+	sess, _, _ := s1.GetOrCreateSession(ctx, "u1", "tag", "meta", nil, nil, 1000)
+	if _, err := s1.AppendMessage(ctx, "u1", sess.ID, "before", 1000); err != nil {
+		t.Fatalf("AppendMessage: %v", err)
+	}
+
+	opts := Options{SessionsStateFile: stateFile, MessageJournalDir: filepath.Join(dir, "journal")}
+	s2 := NewWithOptions(opts)
+	if _, err := s2.AppendMessage(ctx, "u1", sess.ID, "after", 2000); err != nil {
+		t.Fatalf("AppendMessage: %v", err)
+	}
+
+	s3 := NewWithOptions(opts)
+	msgs, err := s3.ListMessages(ctx, "u1", sess.ID, 0, 10)
+	if err != nil || len(msgs) != 2 || msgs[0].Content != "before" || msgs[1].Content != "after" {
+		t.Fatalf("unexpected messages after migration: %+v (%v)", msgs, err)
+	}
+}
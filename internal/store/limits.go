@@ -0,0 +1,68 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+)
+
+const (
+	defaultMaxMetadataBytes    = 256 * 1024
+	defaultMaxDaemonStateBytes = 256 * 1024
+	defaultMaxAgentStateBytes  = 512 * 1024
+	defaultMaxSettingsBytes    = 256 * 1024
+)
+
+// Limits caps the size of opaque client blobs. Zero picks the default and a
+// negative value disables the check.
+type Limits struct {
+	MaxMetadataBytes    int
+	MaxDaemonStateBytes int
+	MaxAgentStateBytes  int
+	MaxSettingsBytes    int
+}
+
+func (l Limits) withDefaults() Limits {
+	if l.MaxMetadataBytes == 0 {
+		l.MaxMetadataBytes = defaultMaxMetadataBytes
+	}
+	if l.MaxDaemonStateBytes == 0 {
+		l.MaxDaemonStateBytes = defaultMaxDaemonStateBytes
+	}
+	if l.MaxAgentStateBytes == 0 {
+		l.MaxAgentStateBytes = defaultMaxAgentStateBytes
+	}
+	if l.MaxSettingsBytes == 0 {
+		l.MaxSettingsBytes = defaultMaxSettingsBytes
+	}
+	return l
+}
+
+var ErrTooLarge = errors.New("payload too large")
+
+type SizeError struct {
+	Field string
+	Size  int
+	Max   int
+}
+
+func (e *SizeError) Error() string {
+	return fmt.Sprintf("%s too large: %d bytes exceeds limit of %d", e.Field, e.Size, e.Max)
+}
+
+func (e *SizeError) Is(target error) bool {
+	return target == ErrTooLarge
+}
+
+func checkSize(field string, value string, max int) error {
+	if max < 0 || len(value) <= max {
+		return nil
+	}
+	return &SizeError{Field: field, Size: len(value), Max: max}
+}
+
+func checkOptionalSize(field string, value *string, max int) error {
+	if value == nil {
+		return nil
+	}
+	return checkSize(field, *value, max)
+}
@@ -0,0 +1,50 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestStore_BlobSizeLimits(t *testing.T) {
+	ctx := context.Background()
+	s := NewWithOptions(Options{Limits: Limits{MaxMetadataBytes: 8, MaxDaemonStateBytes: 8, MaxAgentStateBytes: 8, MaxSettingsBytes: 8}})
+	now := int64(1000)
+	big := strings.Repeat("x", 9)
+
+	_, _, err := s.UpsertMachine(ctx, "u1", "m1", big, nil, nil, now)
+	if !errors.Is(err, ErrTooLarge) {
+		t.Fatalf("expected ErrTooLarge, got %v", err)
+	}
+	m, _, err := s.UpsertMachine(ctx, "u1", "m1", "meta", nil, nil, now)
+	if err != nil {
+		t.Fatalf("UpsertMachine: %v", err)
+	}
+	if status, version, _ := s.UpdateMachineDaemonState(ctx, "u1", "m1", m.DaemonStateVersion, &big, now); status != "too-large" || version != m.DaemonStateVersion {
+		t.Fatalf("expected too-large, got %q (version %d)", status, version)
+	}
+
+	if _, _, err := s.GetOrCreateSession(ctx, "u1", "tag", "meta", &big, nil, now); !errors.Is(err, ErrTooLarge) {
+		t.Fatalf("expected ErrTooLarge for agentState, got %v", err)
+	}
+	sess, _, err := s.GetOrCreateSession(ctx, "u1", "tag", "meta", nil, nil, now)
+	if err != nil {
+		t.Fatalf("GetOrCreateSession: %v", err)
+	}
+	if status, _, value := s.UpdateSessionMetadata(ctx, "u1", sess.ID, sess.MetadataVersion, big, now); status != "too-large" || value != "meta" {
+		t.Fatalf("expected too-large with unchanged value, got %q %q", status, value)
+	}
+
+	if status, version, _ := s.UpdateAccountSettings(ctx, "u1", 0, big, now); status != "too-large" || version != 0 {
+		t.Fatalf("expected too-large settings, got %q (version %d)", status, version)
+	}
+}
+
+func TestStore_BlobSizeLimitsDisabled(t *testing.T) {
+	ctx := context.Background()
+	s := NewWithOptions(Options{Limits: Limits{MaxMetadataBytes: -1}})
+	if _, _, err := s.UpsertMachine(ctx, "u1", "m1", strings.Repeat("x", defaultMaxMetadataBytes+1), nil, nil, 1000); err != nil {
+		t.Fatalf("expected no limit, got %v", err)
+	}
+}
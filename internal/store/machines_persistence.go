@@ -0,0 +1,75 @@
+package store
+
+import (
+	"sync"
+	"time"
+)
+
+// machinesFlusher coalesces machine state file writes: the first change
+// after a write starts a timer, and every change until it fires is written
+// together.
+type machinesFlusher struct {
+	interval time.Duration
+
+	mu      sync.Mutex
+	pending bool
+	timer   *time.Timer
+}
+
+// Flusher is implemented by stores that write some changes in the
+// background. Flush writes them before returning.
+type Flusher interface {
+	Flush()
+}
+
+var _ Flusher = (*Store)(nil)
+
+// machinesChanged writes the machines state file, at once or, with a flush
+// interval, at most once per interval from a background timer.
+func (s *Store) machinesChanged() {
+	if s.partitions != nil {
+		s.savePartitions()
+		return
+	}
+	if s.machinesStateFile == "" {
+		return
+	}
+	f := &s.machinesFlush
+	if f.interval <= 0 {
+		s.saveMachines()
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.pending = true
+	if f.timer == nil {
+		f.timer = time.AfterFunc(f.interval, s.flushMachines)
+	}
+}
+
+// flushMachines writes pending machine changes. It holds persistMu
+// throughout, so a caller also waits out a write the timer already started.
+func (s *Store) flushMachines() {
+	s.persistMu.Lock()
+	defer s.persistMu.Unlock()
+
+	f := &s.machinesFlush
+	f.mu.Lock()
+	if f.timer != nil {
+		f.timer.Stop()
+		f.timer = nil
+	}
+	pending := f.pending
+	f.pending = false
+	f.mu.Unlock()
+
+	if pending {
+		s.writeMachinesLocked()
+	}
+}
+
+// Flush writes machine changes still waiting for their debounced write;
+// call it before exiting.
+func (s *Store) Flush() {
+	s.flushMachines()
+}
@@ -1,18 +1,21 @@
 package store
 
 import (
+	"context"
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 )
 
 func TestStore_MachinesPersistence_RoundTrip(t *testing.T) {
+	ctx := context.Background()
 	dir := t.TempDir()
 	stateFile := filepath.Join(dir, "machines-state.json")
 
 	s1 := NewWithOptions(Options{MachinesStateFile: stateFile})
 	now := int64(1000)
-	_, created, err := s1.UpsertMachine("u1", "m1", "meta", nil, nil, now)
+	_, created, err := s1.UpsertMachine(ctx, "u1", "m1", "meta", nil, nil, now)
 	if err != nil {
 		t.Fatalf("UpsertMachine: %v", err)
 	}
@@ -29,7 +32,7 @@ func TestStore_MachinesPersistence_RoundTrip(t *testing.T) {
 	}
 
 	s2 := NewWithOptions(Options{MachinesStateFile: stateFile})
-	got := s2.ListMachines("u1")
+	got := s2.ListMachines(ctx, "u1")
 	if len(got) != 1 {
 		t.Fatalf("expected 1 machine, got %d", len(got))
 	}
@@ -37,19 +40,20 @@ func TestStore_MachinesPersistence_RoundTrip(t *testing.T) {
 		t.Fatalf("unexpected machine loaded: %+v", got[0])
 	}
 
-	other := s2.ListMachines("u2")
+	other := s2.ListMachines(ctx, "u2")
 	if len(other) != 0 {
 		t.Fatalf("expected 0 machines for other user")
 	}
 }
 
 func TestStore_MachinesPersistence_PersistsUpdates(t *testing.T) {
+	ctx := context.Background()
 	dir := t.TempDir()
 	stateFile := filepath.Join(dir, "machines-state.json")
 
 	s1 := NewWithOptions(Options{MachinesStateFile: stateFile})
 	now := int64(1000)
-	createdMachine, created, err := s1.UpsertMachine("u1", "m1", "meta", nil, nil, now)
+	createdMachine, created, err := s1.UpsertMachine(ctx, "u1", "m1", "meta", nil, nil, now)
 	if err != nil {
 		t.Fatalf("UpsertMachine: %v", err)
 	}
@@ -57,7 +61,7 @@ func TestStore_MachinesPersistence_PersistsUpdates(t *testing.T) {
 		t.Fatalf("expected machine created")
 	}
 
-	status, version, value := s1.UpdateMachineMetadata("u1", "m1", createdMachine.MetadataVersion, "meta2", now+1)
+	status, version, value := s1.UpdateMachineMetadata(ctx, "u1", "m1", createdMachine.MetadataVersion, "meta2", now+1)
 	if status != "success" {
 		t.Fatalf("expected success, got %q", status)
 	}
@@ -69,7 +73,7 @@ func TestStore_MachinesPersistence_PersistsUpdates(t *testing.T) {
 	}
 
 	s2 := NewWithOptions(Options{MachinesStateFile: stateFile})
-	got := s2.ListMachines("u1")
+	got := s2.ListMachines(ctx, "u1")
 	if len(got) != 1 {
 		t.Fatalf("expected 1 machine, got %d", len(got))
 	}
@@ -80,3 +84,50 @@ func TestStore_MachinesPersistence_PersistsUpdates(t *testing.T) {
 		t.Fatalf("expected updated metadata version, got %d", got[0].MetadataVersion)
 	}
 }
+
+func TestStore_MachinesPersistence_FlushIntervalCoalescesWrites(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	stateFile := filepath.Join(dir, "machines-state.json")
+
+	s1 := NewWithOptions(Options{MachinesStateFile: stateFile, MachinesFlushInterval: time.Hour})
+	now := int64(1000)
+	m, _, err := s1.UpsertMachine(ctx, "u1", "m1", "meta", nil, nil, now)
+	if err != nil {
+		t.Fatalf("UpsertMachine: %v", err)
+	}
+	s1.UpdateMachineMetadata(ctx, "u1", "m1", m.MetadataVersion, "meta2", now+1)
+
+	if _, err := os.Stat(stateFile); !os.IsNotExist(err) {
+		t.Fatalf("expected no write before the flush interval, got %v", err)
+	}
+
+	s1.Flush()
+	s2 := NewWithOptions(Options{MachinesStateFile: stateFile})
+	got := s2.ListMachines(ctx, "u1")
+	if len(got) != 1 || got[0].Metadata != "meta2" {
+		t.Fatalf("expected flushed machine state, got %+v", got)
+	}
+}
+
+func TestStore_MachinesPersistence_FlushIntervalWritesInBackground(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	stateFile := filepath.Join(dir, "machines-state.json")
+
+	s1 := NewWithOptions(Options{MachinesStateFile: stateFile, MachinesFlushInterval: 10 * time.Millisecond})
+	if _, _, err := s1.UpsertMachine(ctx, "u1", "m1", "meta", nil, nil, 1000); err != nil {
+		t.Fatalf("UpsertMachine: %v", err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if _, err := os.Stat(stateFile); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the state file to be written after the flush interval")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
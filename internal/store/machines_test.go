@@ -0,0 +1,107 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"happy-server-lite/internal/model"
+)
+
+func testMachineIDsPerUser(t *testing.T, s Storage) {
+	t.Helper()
+	ctx := context.Background()
+	now := int64(1000)
+	if _, created, err := s.UpsertMachine(ctx, "user-1", "m1", "meta-1", nil, nil, now); err != nil || !created {
+		t.Fatalf("UpsertMachine user-1: %v %v", created, err)
+	}
+	if _, created, err := s.UpsertMachine(ctx, "user-2", "m1", "meta-2", nil, nil, now); err != nil || !created {
+		t.Fatalf("expected another user's machine with the same id to be created, got %v %v", created, err)
+	}
+	if status, _, _ := s.UpdateMachineMetadata(ctx, "user-2", "m1", 1, "meta-2b", now+1); status != "success" {
+		t.Fatalf("unexpected metadata update: %s", status)
+	}
+	if m, ok := s.GetMachine(ctx, "user-1", "m1"); !ok || m.Metadata != "meta-1" || m.UserID != "user-1" {
+		t.Fatalf("expected user-1's machine untouched, got %+v %v", m, ok)
+	}
+	if got := s.ListMachines(ctx, "user-2"); len(got) != 1 || got[0].ID != "m1" || got[0].Metadata != "meta-2b" {
+		t.Fatalf("unexpected user-2 machines: %+v", got)
+	}
+
+	if !s.DeleteMachine(ctx, "user-1", "m1", now+2) {
+		t.Fatalf("expected delete to succeed")
+	}
+	if _, ok := s.GetMachine(ctx, "user-2", "m1"); !ok {
+		t.Fatalf("expected user-2's machine to survive user-1's delete")
+	}
+	// Re-creating the id elsewhere keeps user-1's deletion visible.
+	s.UpsertMachine(ctx, "user-2", "m1", "meta-2c", nil, nil, now+3)
+	if tombs := s.ListTombstones(ctx, "user-1", 0, now+3); len(tombs) != 1 || tombs[0].ID != "m1" {
+		t.Fatalf("unexpected user-1 tombstones: %+v", tombs)
+	}
+	if tombs := s.ListTombstones(ctx, "user-2", 0, now+3); len(tombs) != 0 {
+		t.Fatalf("unexpected user-2 tombstones: %+v", tombs)
+	}
+}
+
+func TestStore_MachineIDsPerUser(t *testing.T) {
+	testMachineIDsPerUser(t, New())
+}
+
+func TestRedisStore_MachineIDsPerUser(t *testing.T) {
+	testMachineIDsPerUser(t, openFakeRedisStore(t, 0))
+}
+
+func TestStore_BackendRekeysMachines(t *testing.T) {
+	ctx := context.Background()
+	backend := newMemBackend()
+	put := func(kind, key string, v any) {
+		data, _ := json.Marshal(v)
+		backend.Put(Record{Kind: kind, Key: key, Data: data})
+	}
+	put(recordMachine, "m1", model.Machine{ID: "m1", UserID: "user-1", Metadata: "meta"})
+	put(recordTombstone, TombstoneMachine+"|m2", model.Tombstone{Kind: TombstoneMachine, ID: "m2", UserID: "user-1", DeletedAt: 1000})
+
+	s := NewWithOptions(Options{Backend: backend})
+	if m, ok := s.GetMachine(ctx, "user-1", "m1"); !ok || m.Metadata != "meta" {
+		t.Fatalf("expected the machine to load, got %+v %v", m, ok)
+	}
+	for _, key := range []string{recordMachine + "/m1", recordTombstone + "/" + TombstoneMachine + "|m2"} {
+		if _, ok := backend.records[key]; ok {
+			t.Fatalf("expected %s to be rekeyed", key)
+		}
+	}
+	if _, ok := backend.records[recordMachine+"/user-1|m1"]; !ok {
+		t.Fatalf("expected the machine under its per-user key, got %v", backend.records)
+	}
+
+	s2 := NewWithOptions(Options{Backend: backend})
+	if !s2.DeleteMachine(ctx, "user-1", "m1", 2000) {
+		t.Fatalf("expected the rekeyed machine to delete")
+	}
+	if _, ok := NewWithOptions(Options{Backend: backend}).GetMachine(ctx, "user-1", "m1"); ok {
+		t.Fatalf("expected the deleted machine to stay deleted")
+	}
+}
+
+func TestRedisStore_RekeysMachines(t *testing.T) {
+	ctx := context.Background()
+	f := newFakeRedis(t)
+	r1, err := OpenRedis(RedisOptions{URL: f.URL()}, Options{})
+	if err != nil {
+		t.Fatalf("OpenRedis: %v", err)
+	}
+	r1.client.do(ctx, "SET", r1.prefix+"machine:m1", redisJSON(model.Machine{ID: "m1", UserID: "user-1", Metadata: "meta"}))
+	r1.client.do(ctx, "SADD", r1.userSetKey("user-1", "machines"), "m1")
+
+	r2, err := OpenRedis(RedisOptions{URL: f.URL()}, Options{})
+	if err != nil {
+		t.Fatalf("OpenRedis: %v", err)
+	}
+	if got := r2.ListMachines(ctx, "user-1"); len(got) != 1 || got[0].Metadata != "meta" {
+		t.Fatalf("expected the machine under its per-user key, got %+v", got)
+	}
+	if ok, _ := getJSON(r2.client.doFunc(ctx), r2.prefix+"machine:m1", &model.Machine{}); ok {
+		t.Fatalf("expected the old key to be removed")
+	}
+}
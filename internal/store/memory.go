@@ -0,0 +1,113 @@
+package store
+
+import (
+	"log"
+	"sync/atomic"
+
+	"happy-server-lite/internal/model"
+)
+
+// MemoryBudget caps the messages an in-memory Store holds. Zero leaves a
+// limit unchecked.
+type MemoryBudget struct {
+	// MaxBytes approximates the memory message contents may use.
+	MaxBytes int64
+	// MaxMessages caps the messages held across all sessions.
+	MaxMessages int
+}
+
+func (b MemoryBudget) enabled() bool {
+	return b.MaxBytes > 0 || b.MaxMessages > 0
+}
+
+// exceeded reports whether bytes or count is over the budget.
+func (b MemoryBudget) exceeded(bytes int64, count int) bool {
+	return (b.MaxBytes > 0 && bytes > b.MaxBytes) || (b.MaxMessages > 0 && count > b.MaxMessages)
+}
+
+// memoryLowWatermark is the share of the budget eviction frees down to, so a
+// busy store does not evict on every append once it is full.
+const memoryLowWatermark = 0.9
+
+// MemoryStats reports message memory use against the budget and what
+// eviction has removed since start.
+type MemoryStats struct {
+	Bytes           int64 `json:"bytes"`
+	Messages        int   `json:"messages"`
+	MaxBytes        int64 `json:"maxBytes,omitempty"`
+	MaxMessages     int   `json:"maxMessages,omitempty"`
+	Evictions       int64 `json:"evictions"`
+	EvictedMessages int64 `json:"evictedMessages"`
+	EvictedBytes    int64 `json:"evictedBytes"`
+}
+
+// MemoryReporter is implemented by stores that hold data in process memory.
+type MemoryReporter interface {
+	MemoryStats() MemoryStats
+}
+
+var _ MemoryReporter = (*Store)(nil)
+
+type evictionCounters struct {
+	runs     atomic.Int64
+	messages atomic.Int64
+	bytes    atomic.Int64
+}
+
+func (s *Store) MemoryStats() MemoryStats {
+	bytes, count := s.messages.usage()
+	return MemoryStats{
+		Bytes:           bytes,
+		Messages:        count,
+		MaxBytes:        s.memoryBudget.MaxBytes,
+		MaxMessages:     s.memoryBudget.MaxMessages,
+		Evictions:       s.evictions.runs.Load(),
+		EvictedMessages: s.evictions.messages.Load(),
+		EvictedBytes:    s.evictions.bytes.Load(),
+	}
+}
+
+// enforceMemoryBudget evicts messages once the store is over its budget,
+// oldest first from inactive sessions that have gone longest without a new
+// message. Evicted messages are deleted, as with PruneMessages; the newest
+// message of each session is kept so seqs survive a restart.
+func (s *Store) enforceMemoryBudget() {
+	if !s.memoryBudget.enabled() {
+		return
+	}
+	if !s.memoryBudget.exceeded(s.messages.usage()) {
+		return
+	}
+
+	active := make(map[string]bool)
+	s.eachSession(func(sess model.Session) {
+		if sess.Active {
+			active[sess.ID] = true
+		}
+	})
+
+	maxBytes := int64(float64(s.memoryBudget.MaxBytes) * memoryLowWatermark)
+	maxCount := int(float64(s.memoryBudget.MaxMessages) * memoryLowWatermark)
+	removed, freed := s.messages.evict(maxBytes, maxCount, func(id string) bool { return active[id] })
+	if len(removed) == 0 {
+		return
+	}
+
+	n := 0
+	for sessionID, seqs := range removed {
+		for _, seq := range seqs {
+			s.unpersist(recordMessage, messageKey(sessionID, seq))
+		}
+		n += len(seqs)
+	}
+	s.evictions.runs.Add(1)
+	s.evictions.messages.Add(int64(n))
+	s.evictions.bytes.Add(freed)
+	log.Printf("store memory budget: evicted %d messages (%d bytes) from %d sessions", n, freed, len(removed))
+
+	if s.journal != nil {
+		s.CompactJournals()
+	} else {
+		s.saveSessions()
+	}
+}
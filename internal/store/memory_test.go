@@ -0,0 +1,74 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+func TestStore_MemoryBudgetEvictsLeastRecentInactiveSessionsFirst(t *testing.T) {
+	ctx := context.Background()
+	s := NewWithOptions(Options{MemoryBudget: MemoryBudget{MaxMessages: 10}})
+	active, _, _ := s.GetOrCreateSession(ctx, "u1", "active", "meta", nil, nil, 0)
+	old, _, _ := s.GetOrCreateSession(ctx, "u1", "old", "meta", nil, nil, 0)
+	recent, _, _ := s.GetOrCreateSession(ctx, "u1", "recent", "meta", nil, nil, 0)
+	s.SetSessionActive(ctx, "u1", active.ID, true, 0, 0)
+
+	appendN := func(sessionID string, n int, at int64) {
+		for i := 0; i < n; i++ {
+			if _, err := s.AppendMessage(ctx, "u1", sessionID, fmt.Sprintf("m-%d", i), at); err != nil {
+				t.Fatalf("AppendMessage: %v", err)
+			}
+		}
+	}
+	appendN(active.ID, 4, 0)
+	appendN(old.ID, 4, 1)
+	appendN(recent.ID, 3, 2)
+
+	// The eleventh message goes over budget; eviction frees down to 9 from
+	// the inactive session that has gone longest without a message.
+	for id, want := range map[string]int{active.ID: 4, old.ID: 2, recent.ID: 3} {
+		msgs, _ := s.ListMessages(ctx, "u1", id, 0, 10)
+		if len(msgs) != want {
+			t.Fatalf("session %s kept %d messages, want %d", id, len(msgs), want)
+		}
+	}
+	msgs, _ := s.ListMessages(ctx, "u1", old.ID, 0, 10)
+	if msgs[0].Content != "m-2" {
+		t.Fatalf("expected the oldest messages evicted, got %+v", msgs)
+	}
+
+	stats := s.MemoryStats()
+	if stats.Messages != 9 || stats.Evictions != 1 || stats.EvictedMessages != 2 || stats.EvictedBytes == 0 || stats.Bytes == 0 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestStore_MemoryBudgetKeepsNewestMessageAcrossRestart(t *testing.T) {
+	ctx := context.Background()
+	opts := Options{
+		SessionsStateFile: filepath.Join(t.TempDir(), "sessions-state.json"),
+		MemoryBudget:      MemoryBudget{MaxMessages: 2},
+	}
+	s1 := NewWithOptions(opts)
+	sess, _, _ := s1.GetOrCreateSession(ctx, "u1", "tag", "meta", nil, nil, 0)
+	for i := 0; i < 3; i++ {
+		if _, err := s1.AppendMessage(ctx, "u1", sess.ID, fmt.Sprintf("m-%d", i), int64(i)); err != nil {
+			t.Fatalf("AppendMessage: %v", err)
+		}
+	}
+
+	s2 := NewWithOptions(opts)
+	msgs, _ := s2.ListMessages(ctx, "u1", sess.ID, 0, 10)
+	if len(msgs) != 1 || msgs[0].Content != "m-2" {
+		t.Fatalf("expected only the newest message after reload, got %+v", msgs)
+	}
+	next, err := s2.AppendMessage(ctx, "u1", sess.ID, "m-3", 3)
+	if err != nil || next.Seq != 4 {
+		t.Fatalf("expected seq 4, got %d (%v)", next.Seq, err)
+	}
+	if stats := s2.MemoryStats(); stats.Messages != 2 || stats.MaxMessages != 2 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+}
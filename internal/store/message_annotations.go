@@ -0,0 +1,124 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"maps"
+
+	"happy-server-lite/internal/model"
+)
+
+// Annotations are meant for marks such as bookmarked or needs-review, not for
+// content, so they are kept small.
+const (
+	MaxAnnotationKeyBytes    = 64
+	MaxAnnotationValueBytes  = 4 * 1024
+	MaxAnnotationsPerMessage = 32
+)
+
+var (
+	// ErrAnnotationVersionMismatch is returned with the current message when
+	// the annotation is not at the expected version.
+	ErrAnnotationVersionMismatch = errors.New("annotation version mismatch")
+	ErrInvalidAnnotationKey      = errors.New("invalid annotation key")
+	ErrTooManyAnnotations        = errors.New("too many annotations")
+)
+
+// annotateMessage returns msg with key set to value, or removed when value
+// is nil, if the annotation is at expectedVersion; 0 expects no annotation.
+// A removed key starts again at version 1.
+func annotateMessage(msg model.SessionMessage, key string, expectedVersion int, value *string, nowMillis int64) (model.SessionMessage, error) {
+	if key == "" || len(key) > MaxAnnotationKeyBytes {
+		return msg, ErrInvalidAnnotationKey
+	}
+	if err := checkOptionalSize("annotation", value, MaxAnnotationValueBytes); err != nil {
+		return msg, err
+	}
+	current, ok := msg.Annotations[key]
+	if current.Version != expectedVersion {
+		return msg, ErrAnnotationVersionMismatch
+	}
+	// Messages are shared with readers, so the map is copied, never written.
+	if value == nil {
+		if !ok {
+			return msg, nil
+		}
+		msg.Annotations = maps.Clone(msg.Annotations)
+		delete(msg.Annotations, key)
+		if len(msg.Annotations) == 0 {
+			msg.Annotations = nil
+		}
+		return msg, nil
+	}
+	if !ok && len(msg.Annotations) >= MaxAnnotationsPerMessage {
+		return msg, ErrTooManyAnnotations
+	}
+	annotations := make(map[string]model.MessageAnnotation, len(msg.Annotations)+1)
+	maps.Copy(annotations, msg.Annotations)
+	annotations[key] = model.MessageAnnotation{Value: *value, Version: current.Version + 1, UpdatedAt: nowMillis}
+	msg.Annotations = annotations
+	return msg, nil
+}
+
+// AnnotateMessageFrom sets the annotation key of a session's message to
+// value, or removes it when value is nil, if it is at expectedVersion. The
+// message's content and UpdatedAt are left alone. Deleted messages cannot be
+// annotated.
+func (s *Store) AnnotateMessageFrom(ctx context.Context, origin, userID, sessionID, messageID, key string, expectedVersion int, value *string, nowMillis int64) (model.SessionMessage, error) {
+	return s.changeMessage(ctx, origin, userID, sessionID, messageID, EventMessageAnnotated, nowMillis, func(msg model.SessionMessage) (model.SessionMessage, error) {
+		return annotateMessage(msg, key, expectedVersion, value, nowMillis)
+	})
+}
+
+func (r *RedisStore) AnnotateMessageFrom(ctx context.Context, origin, userID, sessionID, messageID, key string, expectedVersion int, value *string, nowMillis int64) (model.SessionMessage, error) {
+	return r.changeMessage(ctx, origin, userID, sessionID, messageID, EventMessageAnnotated, nowMillis, func(msg model.SessionMessage) (model.SessionMessage, error) {
+		return annotateMessage(msg, key, expectedVersion, value, nowMillis)
+	})
+}
+
+// AnnotateMessageFrom locks the message row while the annotations are
+// rewritten.
+func (p *PostgresStore) AnnotateMessageFrom(ctx context.Context, origin, userID, sessionID, messageID, key string, expectedVersion int, value *string, nowMillis int64) (model.SessionMessage, error) {
+	if _, ok := p.GetSession(ctx, userID, sessionID); !ok {
+		return model.SessionMessage{}, errors.New("session not found")
+	}
+	var msg model.SessionMessage
+	err := p.withTx(ctx, func(tx *sql.Tx) error {
+		current, err := scanMessage(tx.QueryRowContext(ctx, `SELECT `+messageColumns+` FROM messages
+			WHERE session_id = $1 AND id = $2 AND NOT deleted FOR UPDATE`, sessionID, messageID))
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrMessageNotFound
+		}
+		if err != nil {
+			return err
+		}
+		msg, err = annotateMessage(current, key, expectedVersion, value, nowMillis)
+		if err != nil {
+			return err
+		}
+		annotations, err := marshalAnnotations(msg.Annotations)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, `UPDATE messages SET annotations = $3 WHERE session_id = $1 AND seq = $2`, sessionID, msg.Seq, annotations)
+		return err
+	})
+	if err != nil {
+		return msg, err
+	}
+
+	p.publish(Event{Type: EventMessageAnnotated, Origin: origin, UserID: userID, SessionID: sessionID, Message: &msg, At: nowMillis})
+	return msg, nil
+}
+
+// marshalAnnotations is the annotations column of a message: their JSON, or
+// empty when there are none.
+func marshalAnnotations(annotations map[string]model.MessageAnnotation) (string, error) {
+	if len(annotations) == 0 {
+		return "", nil
+	}
+	data, err := json.Marshal(annotations)
+	return string(data), err
+}
@@ -0,0 +1,122 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testAnnotateMessages(t *testing.T, s Storage) {
+	t.Helper()
+	ctx := context.Background()
+	sess, _, err := s.GetOrCreateSession(ctx, "u1", "tag", "meta", nil, nil, 1000)
+	if err != nil {
+		t.Fatalf("GetOrCreateSession: %v", err)
+	}
+	msg, _ := s.AppendMessageFrom(ctx, "", "u1", sess.ID, "one", "", 1000)
+
+	var published []Event
+	s.Subscribe(func(ev Event) { published = append(published, ev) })
+
+	bookmark := "enc-bookmark"
+	got, err := s.AnnotateMessageFrom(ctx, OriginREST, "u1", sess.ID, msg.ID, "bookmarked", 0, &bookmark, 2000)
+	if err != nil {
+		t.Fatalf("AnnotateMessageFrom: %v", err)
+	}
+	a := got.Annotations["bookmarked"]
+	if a.Value != bookmark || a.Version != 1 || a.UpdatedAt != 2000 || got.UpdatedAt != 1000 || got.Content != "one" {
+		t.Fatalf("unexpected annotated message: %+v", got)
+	}
+	current, err := s.AnnotateMessageFrom(ctx, OriginREST, "u1", sess.ID, msg.ID, "bookmarked", 0, &bookmark, 2000)
+	if !errors.Is(err, ErrAnnotationVersionMismatch) || current.Annotations["bookmarked"].Version != 1 {
+		t.Fatalf("expected a version mismatch with the current annotation, got %+v (%v)", current, err)
+	}
+	review := "enc-review"
+	if _, err := s.AnnotateMessageFrom(ctx, OriginREST, "u1", sess.ID, msg.ID, "needs-review", 0, &review, 2500); err != nil {
+		t.Fatalf("AnnotateMessageFrom: %v", err)
+	}
+	got, err = s.AnnotateMessageFrom(ctx, OriginREST, "u1", sess.ID, msg.ID, "bookmarked", 1, nil, 3000)
+	if err != nil {
+		t.Fatalf("AnnotateMessageFrom(remove): %v", err)
+	}
+	if _, ok := got.Annotations["bookmarked"]; ok || len(got.Annotations) != 1 {
+		t.Fatalf("expected only the bookmark removed, got %+v", got.Annotations)
+	}
+
+	if _, err := s.AnnotateMessageFrom(ctx, OriginREST, "u1", sess.ID, msg.ID, "", 0, &review, 3000); !errors.Is(err, ErrInvalidAnnotationKey) {
+		t.Fatalf("expected an empty key to be refused, got %v", err)
+	}
+	large := strings.Repeat("x", MaxAnnotationValueBytes+1)
+	if _, err := s.AnnotateMessageFrom(ctx, OriginREST, "u1", sess.ID, msg.ID, "large", 0, &large, 3000); !errors.Is(err, ErrTooLarge) {
+		t.Fatalf("expected a large value to be refused, got %v", err)
+	}
+	if _, err := s.AnnotateMessageFrom(ctx, OriginREST, "u1", sess.ID, "missing", "bookmarked", 0, &bookmark, 3000); !errors.Is(err, ErrMessageNotFound) {
+		t.Fatalf("expected an unknown message to report not found, got %v", err)
+	}
+	if _, err := s.AnnotateMessageFrom(ctx, OriginREST, "u2", sess.ID, msg.ID, "bookmarked", 0, &bookmark, 3000); err == nil || errors.Is(err, ErrMessageNotFound) {
+		t.Fatalf("expected other users' sessions to be hidden, got %v", err)
+	}
+
+	if len(published) != 3 || published[0].Type != EventMessageAnnotated || published[2].Message.Annotations["needs-review"].Value != review {
+		t.Fatalf("unexpected events: %+v", published)
+	}
+	msgs, _ := s.ListMessages(ctx, "u1", sess.ID, 0, 10)
+	if len(msgs) != 1 || msgs[0].Annotations["needs-review"].Version != 1 {
+		t.Fatalf("unexpected messages: %+v", msgs)
+	}
+
+	tomb, err := s.DeleteMessageFrom(ctx, OriginREST, "u1", sess.ID, msg.ID, 4000)
+	if err != nil || tomb.Annotations != nil {
+		t.Fatalf("expected deleting to drop the annotations, got %+v (%v)", tomb, err)
+	}
+	if _, err := s.AnnotateMessageFrom(ctx, OriginREST, "u1", sess.ID, msg.ID, "bookmarked", 0, &bookmark, 4000); !errors.Is(err, ErrMessageNotFound) {
+		t.Fatalf("expected annotating a tombstone to report not found, got %v", err)
+	}
+}
+
+func TestStore_AnnotateMessages(t *testing.T) {
+	testAnnotateMessages(t, New())
+}
+
+func TestRedisStore_AnnotateMessages(t *testing.T) {
+	testAnnotateMessages(t, openFakeRedisStore(t, 0))
+}
+
+func TestStore_AnnotationLimit(t *testing.T) {
+	ctx := context.Background()
+	s := New()
+	sess, _, _ := s.GetOrCreateSession(ctx, "u1", "tag", "meta", nil, nil, 1000)
+	msg, _ := s.AppendMessageFrom(ctx, "", "u1", sess.ID, "one", "", 1000)
+	v := "v"
+	for i := 0; i < MaxAnnotationsPerMessage; i++ {
+		if _, err := s.AnnotateMessageFrom(ctx, "", "u1", sess.ID, msg.ID, fmt.Sprintf("k%d", i), 0, &v, 1000); err != nil {
+			t.Fatalf("AnnotateMessageFrom: %v", err)
+		}
+	}
+	if _, err := s.AnnotateMessageFrom(ctx, "", "u1", sess.ID, msg.ID, "one-more", 0, &v, 1000); !errors.Is(err, ErrTooManyAnnotations) {
+		t.Fatalf("expected too many annotations, got %v", err)
+	}
+	if _, err := s.AnnotateMessageFrom(ctx, "", "u1", sess.ID, msg.ID, "k0", 1, &v, 1000); err != nil {
+		t.Fatalf("expected an existing key to stay writable: %v", err)
+	}
+}
+
+func TestStore_AnnotationSurvivesJournalReload(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	opts := Options{SessionsStateFile: filepath.Join(dir, "sessions-state.json"), MessageJournalDir: filepath.Join(dir, "journal")}
+	s1 := NewWithOptions(opts)
+	sess, _, _ := s1.GetOrCreateSession(ctx, "u1", "tag", "meta", nil, nil, 1000)
+	msg, _ := s1.AppendMessageFrom(ctx, "", "u1", sess.ID, "one", "", 1000)
+	v := "enc"
+	s1.AnnotateMessageFrom(ctx, "", "u1", sess.ID, msg.ID, "bookmarked", 0, &v, 2000)
+
+	s2 := NewWithOptions(opts)
+	msgs, err := s2.ListMessages(ctx, "u1", sess.ID, 0, 10)
+	if err != nil || len(msgs) != 1 || msgs[0].Annotations["bookmarked"].Value != "enc" {
+		t.Fatalf("unexpected messages after reload: %+v (%v)", msgs, err)
+	}
+}
@@ -1,6 +1,7 @@
 package store
 
 import (
+	"sort"
 	"sync"
 
 	"happy-server-lite/internal/model"
@@ -9,10 +10,36 @@ import (
 type messageStore struct {
 	mu   sync.RWMutex
 	data map[string][]model.SessionMessage
+
+	// bytes and count total the messages held, and lastAppend keeps the
+	// creation time of each session's newest message for eviction.
+	bytes      int64
+	count      int
+	lastAppend map[string]int64
+
+	// localIDs maps each session's client-chosen local ids to the seq of
+	// the message they were sent with.
+	localIDs map[string]map[string]int64
 }
 
 func newMessageStore() *messageStore {
-	return &messageStore{data: make(map[string][]model.SessionMessage)}
+	return &messageStore{
+		data:       make(map[string][]model.SessionMessage),
+		lastAppend: make(map[string]int64),
+		localIDs:   make(map[string]map[string]int64),
+	}
+}
+
+// messageOverhead approximates the memory a message costs beyond its
+// strings.
+const messageOverhead = 128
+
+func messageSize(msg model.SessionMessage) int64 {
+	n := len(msg.ID) + len(msg.SessionID) + len(msg.Content) + len(msg.Checksum) + len(msg.LocalID) + messageOverhead
+	for key, a := range msg.Annotations {
+		n += len(key) + len(a.Value)
+	}
+	return int64(n)
 }
 
 func (m *messageStore) append(sessionID string, msg model.SessionMessage) {
@@ -20,6 +47,101 @@ func (m *messageStore) append(sessionID string, msg model.SessionMessage) {
 	defer m.mu.Unlock()
 
 	m.data[sessionID] = append(m.data[sessionID], msg)
+	m.bytes += messageSize(msg)
+	m.count++
+	if msg.CreatedAt > m.lastAppend[sessionID] {
+		m.lastAppend[sessionID] = msg.CreatedAt
+	}
+	if msg.LocalID != "" {
+		if m.localIDs[sessionID] == nil {
+			m.localIDs[sessionID] = make(map[string]int64)
+		}
+		m.localIDs[sessionID][msg.LocalID] = msg.Seq
+	}
+}
+
+// put stores msg in seq order, replacing the message already held with its
+// seq, so records replayed from a backend or a replication log apply
+// idempotently.
+func (m *messageStore) put(msg model.SessionMessage) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	msgs := m.data[msg.SessionID]
+	i := sort.Search(len(msgs), func(i int) bool { return msgs[i].Seq >= msg.Seq })
+	switch {
+	case i < len(msgs) && msgs[i].Seq == msg.Seq:
+		m.drop(msgs[i : i+1])
+		msgs[i] = msg
+	case i == len(msgs):
+		m.data[msg.SessionID] = append(msgs, msg)
+	default:
+		msgs = append(msgs, model.SessionMessage{})
+		copy(msgs[i+1:], msgs[i:])
+		msgs[i] = msg
+		m.data[msg.SessionID] = msgs
+	}
+	m.bytes += messageSize(msg)
+	m.count++
+	if msg.CreatedAt > m.lastAppend[msg.SessionID] {
+		m.lastAppend[msg.SessionID] = msg.CreatedAt
+	}
+	if msg.LocalID != "" {
+		if m.localIDs[msg.SessionID] == nil {
+			m.localIDs[msg.SessionID] = make(map[string]int64)
+		}
+		m.localIDs[msg.SessionID][msg.LocalID] = msg.Seq
+	}
+}
+
+// remove drops the message of sessionID with seq, if it is held.
+func (m *messageStore) remove(sessionID string, seq int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	msgs := m.data[sessionID]
+	i := sort.Search(len(msgs), func(i int) bool { return msgs[i].Seq >= seq })
+	if i == len(msgs) || msgs[i].Seq != seq {
+		return
+	}
+	m.drop(msgs[i : i+1])
+	m.data[sessionID] = append(msgs[:i:i], msgs[i+1:]...)
+}
+
+// drop removes msgs from the totals and the local id index.
+func (m *messageStore) drop(msgs []model.SessionMessage) {
+	for _, msg := range msgs {
+		m.bytes -= messageSize(msg)
+		if msg.LocalID != "" {
+			delete(m.localIDs[msg.SessionID], msg.LocalID)
+		}
+	}
+	m.count -= len(msgs)
+}
+
+// byLocalID returns the message of sessionID that was sent with localID, if
+// it is still held.
+func (m *messageStore) byLocalID(sessionID, localID string) (model.SessionMessage, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	seq, ok := m.localIDs[sessionID][localID]
+	if !ok {
+		return model.SessionMessage{}, false
+	}
+	msgs := m.data[sessionID]
+	i := sort.Search(len(msgs), func(i int) bool { return msgs[i].Seq >= seq })
+	if i == len(msgs) || msgs[i].Seq != seq {
+		return model.SessionMessage{}, false
+	}
+	return msgs[i], true
+}
+
+// usage reports the approximate bytes and the number of messages held.
+func (m *messageStore) usage() (int64, int) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.bytes, m.count
 }
 
 func (m *messageStore) getAfter(sessionID string, after int64, limit int) []model.SessionMessage {
@@ -46,5 +168,129 @@ func (m *messageStore) getAfter(sessionID string, after int64, limit int) []mode
 func (m *messageStore) deleteSession(sessionID string) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
+	m.drop(m.data[sessionID])
 	delete(m.data, sessionID)
+	delete(m.lastAppend, sessionID)
+	delete(m.localIDs, sessionID)
+}
+
+// snapshot returns every message ordered by session id, then seq.
+func (m *messageStore) snapshot() []model.SessionMessage {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	ids := make([]string, 0, len(m.data))
+	for id := range m.data {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	result := make([]model.SessionMessage, 0)
+	for _, id := range ids {
+		result = append(result, m.data[id]...)
+	}
+	return result
+}
+
+func (m *messageStore) forSession(sessionID string) []model.SessionMessage {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return append([]model.SessionMessage(nil), m.data[sessionID]...)
+}
+
+// pruneCandidates returns copies of each session's messages created before
+// cutoff and all but its newest max (when positive), always leaving out the
+// newest one. Nothing is dropped until dropThrough.
+func (m *messageStore) pruneCandidates(cutoff int64, max int) map[string][]model.SessionMessage {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	candidates := make(map[string][]model.SessionMessage)
+	for sessionID, msgs := range m.data {
+		drop := 0
+		if max > 0 && len(msgs) > max {
+			drop = len(msgs) - max
+		}
+		for drop < len(msgs)-1 && msgs[drop].CreatedAt < cutoff {
+			drop++
+		}
+		if drop > 0 {
+			candidates[sessionID] = append([]model.SessionMessage(nil), msgs[:drop]...)
+		}
+	}
+	return candidates
+}
+
+// dropThrough drops sessionID's messages up to and including seq and
+// returns their seqs.
+func (m *messageStore) dropThrough(sessionID string, seq int64) []int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	msgs := m.data[sessionID]
+	drop := sort.Search(len(msgs), func(i int) bool { return msgs[i].Seq > seq })
+	if drop == 0 {
+		return nil
+	}
+	seqs := make([]int64, drop)
+	for i, msg := range msgs[:drop] {
+		seqs[i] = msg.Seq
+	}
+	m.drop(msgs[:drop])
+	m.data[sessionID] = append([]model.SessionMessage(nil), msgs[drop:]...)
+	return seqs
+}
+
+// evict drops the oldest messages of the least recently appended sessions,
+// those for which active reports false first, until at most maxBytes and
+// maxCount remain (zero leaves that limit unchecked). The newest message of
+// each session is kept. It returns the removed seqs by session and the bytes
+// they freed.
+func (m *messageStore) evict(maxBytes int64, maxCount int, active func(sessionID string) bool) (map[string][]int64, int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	over := func() bool {
+		return (maxBytes > 0 && m.bytes > maxBytes) || (maxCount > 0 && m.count > maxCount)
+	}
+	if !over() {
+		return nil, 0
+	}
+
+	type candidate struct {
+		id     string
+		active bool
+		used   int64
+	}
+	candidates := make([]candidate, 0, len(m.data))
+	for id, msgs := range m.data {
+		if len(msgs) > 1 {
+			candidates = append(candidates, candidate{id: id, active: active(id), used: m.lastAppend[id]})
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].active != candidates[j].active {
+			return !candidates[i].active
+		}
+		return candidates[i].used < candidates[j].used
+	})
+
+	removed := make(map[string][]int64)
+	var freed int64
+	for _, cand := range candidates {
+		if !over() {
+			break
+		}
+		msgs := m.data[cand.id]
+		drop := 0
+		for drop < len(msgs)-1 && over() {
+			size := messageSize(msgs[drop])
+			m.drop(msgs[drop : drop+1])
+			freed += size
+			removed[cand.id] = append(removed[cand.id], msgs[drop].Seq)
+			drop++
+		}
+		m.data[cand.id] = append([]model.SessionMessage(nil), msgs[drop:]...)
+	}
+	return removed, freed
 }
@@ -0,0 +1,225 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+
+	"happy-server-lite/internal/model"
+)
+
+// ErrMessageNotFound is returned when an edit or delete names a message the
+// session does not hold, or one that is already deleted.
+var ErrMessageNotFound = errors.New("message not found")
+
+// editMessage returns msg with new content, or as a tombstone when deleting,
+// updated at nowMillis.
+func editMessage(msg model.SessionMessage, content, checksum string, deleting bool, nowMillis int64) model.SessionMessage {
+	if deleting {
+		msg.Deleted = true
+		msg.Annotations = nil
+		content, checksum = "", ""
+	}
+	msg.Content = content
+	msg.Checksum = checksum
+	msg.UpdatedAt = nowMillis
+	return msg
+}
+
+func messageEditEvent(deleting bool) string {
+	if deleting {
+		return EventMessageDeleted
+	}
+	return EventMessageUpdated
+}
+
+// update replaces the live message of sessionID with messageID by fn's
+// result. When fn fails the message is kept and returned with its error.
+func (m *messageStore) update(sessionID, messageID string, fn func(model.SessionMessage) (model.SessionMessage, error)) (model.SessionMessage, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	msgs := m.data[sessionID]
+	for i := len(msgs) - 1; i >= 0; i-- {
+		if msgs[i].ID != messageID {
+			continue
+		}
+		if msgs[i].Deleted {
+			break
+		}
+		msg, err := fn(msgs[i])
+		if err != nil {
+			return msgs[i], err
+		}
+		m.bytes += messageSize(msg) - messageSize(msgs[i])
+		msgs[i] = msg
+		return msg, nil
+	}
+	return model.SessionMessage{}, ErrMessageNotFound
+}
+
+// UpdateMessageFrom replaces the content of a session's message, bumping
+// its UpdatedAt. Deleted messages cannot be edited.
+func (s *Store) UpdateMessageFrom(ctx context.Context, origin, userID, sessionID, messageID, content, checksum string, nowMillis int64) (model.SessionMessage, error) {
+	checksum, err := verifyChecksum(content, checksum)
+	if err != nil {
+		return model.SessionMessage{}, err
+	}
+	return s.editMessage(ctx, origin, userID, sessionID, messageID, content, checksum, false, nowMillis)
+}
+
+// DeleteMessageFrom turns a session's message into a tombstone: its content
+// is cleared, Deleted is set and UpdatedAt bumped. The message keeps its seq
+// and local id, so a replayed send still finds it.
+func (s *Store) DeleteMessageFrom(ctx context.Context, origin, userID, sessionID, messageID string, nowMillis int64) (model.SessionMessage, error) {
+	return s.editMessage(ctx, origin, userID, sessionID, messageID, "", "", true, nowMillis)
+}
+
+func (s *Store) editMessage(ctx context.Context, origin, userID, sessionID, messageID, content, checksum string, deleting bool, nowMillis int64) (model.SessionMessage, error) {
+	return s.changeMessage(ctx, origin, userID, sessionID, messageID, messageEditEvent(deleting), nowMillis, func(msg model.SessionMessage) (model.SessionMessage, error) {
+		return editMessage(msg, content, checksum, deleting, nowMillis), nil
+	})
+}
+
+// changeMessage replaces a session's live message by fn's result, saves it
+// and publishes eventType. When fn fails the message is returned unchanged
+// with its error.
+func (s *Store) changeMessage(ctx context.Context, origin, userID, sessionID, messageID, eventType string, nowMillis int64, fn func(model.SessionMessage) (model.SessionMessage, error)) (model.SessionMessage, error) {
+	unpin, err := s.pinUser(userID)
+	if err != nil {
+		return model.SessionMessage{}, err
+	}
+	defer unpin()
+
+	if _, ok := s.GetSession(ctx, userID, sessionID); !ok {
+		return model.SessionMessage{}, errors.New("session not found")
+	}
+	msg, err := s.messages.update(sessionID, messageID, fn)
+	if err != nil {
+		return msg, err
+	}
+	s.persistMessage(userID, msg)
+	if s.journal != nil {
+		// Journals are append-only and keep the first line for a seq, so an
+		// edit rewrites the session's journal.
+		s.journal.mu.Lock()
+		if err := s.persistStats.journal.record(s.journal.rewrite(sessionID, s.messages.forSession(sessionID))); err != nil {
+			log.Printf("message journal: rewrite %s failed: %v", sessionID, err)
+		}
+		s.journal.mu.Unlock()
+	} else {
+		s.saveSessions()
+	}
+
+	s.publish(Event{Type: eventType, Origin: origin, UserID: userID, SessionID: sessionID, Message: &msg, At: nowMillis})
+	return msg, nil
+}
+
+func (p *PostgresStore) UpdateMessageFrom(ctx context.Context, origin, userID, sessionID, messageID, content, checksum string, nowMillis int64) (model.SessionMessage, error) {
+	checksum, err := verifyChecksum(content, checksum)
+	if err != nil {
+		return model.SessionMessage{}, err
+	}
+	return p.editMessage(ctx, origin, userID, sessionID, messageID, content, checksum, false, nowMillis)
+}
+
+func (p *PostgresStore) DeleteMessageFrom(ctx context.Context, origin, userID, sessionID, messageID string, nowMillis int64) (model.SessionMessage, error) {
+	return p.editMessage(ctx, origin, userID, sessionID, messageID, "", "", true, nowMillis)
+}
+
+func (p *PostgresStore) editMessage(ctx context.Context, origin, userID, sessionID, messageID, content, checksum string, deleting bool, nowMillis int64) (model.SessionMessage, error) {
+	if _, ok := p.GetSession(ctx, userID, sessionID); !ok {
+		return model.SessionMessage{}, errors.New("session not found")
+	}
+	msg, err := scanMessage(p.db.QueryRowContext(ctx, `UPDATE messages SET content = $3, checksum = $4, deleted = $5, updated_at = $6,
+		annotations = CASE WHEN $5 THEN '' ELSE annotations END
+		WHERE session_id = $1 AND id = $2 AND NOT deleted
+		RETURNING `+messageColumns, sessionID, messageID, content, checksum, deleting, nowMillis))
+	if errors.Is(err, sql.ErrNoRows) {
+		return model.SessionMessage{}, ErrMessageNotFound
+	}
+	if err != nil {
+		return model.SessionMessage{}, err
+	}
+
+	p.publish(Event{Type: messageEditEvent(deleting), Origin: origin, UserID: userID, SessionID: sessionID, Message: &msg, At: nowMillis})
+	return msg, nil
+}
+
+func (r *RedisStore) UpdateMessageFrom(ctx context.Context, origin, userID, sessionID, messageID, content, checksum string, nowMillis int64) (model.SessionMessage, error) {
+	checksum, err := verifyChecksum(content, checksum)
+	if err != nil {
+		return model.SessionMessage{}, err
+	}
+	return r.editMessage(ctx, origin, userID, sessionID, messageID, content, checksum, false, nowMillis)
+}
+
+func (r *RedisStore) DeleteMessageFrom(ctx context.Context, origin, userID, sessionID, messageID string, nowMillis int64) (model.SessionMessage, error) {
+	return r.editMessage(ctx, origin, userID, sessionID, messageID, "", "", true, nowMillis)
+}
+
+// redisEditScan is how many list entries editMessage reads at a time while
+// searching from the newest message back.
+const redisEditScan = 100
+
+func (r *RedisStore) editMessage(ctx context.Context, origin, userID, sessionID, messageID, content, checksum string, deleting bool, nowMillis int64) (model.SessionMessage, error) {
+	return r.changeMessage(ctx, origin, userID, sessionID, messageID, messageEditEvent(deleting), nowMillis, func(msg model.SessionMessage) (model.SessionMessage, error) {
+		return editMessage(msg, content, checksum, deleting, nowMillis), nil
+	})
+}
+
+// changeMessage searches the session's list from the tail, where edits are
+// most likely, and rewrites the entry in place with LSET by fn's result.
+// When fn fails the message is returned unchanged with its error.
+func (r *RedisStore) changeMessage(ctx context.Context, origin, userID, sessionID, messageID, eventType string, nowMillis int64, fn func(model.SessionMessage) (model.SessionMessage, error)) (model.SessionMessage, error) {
+	key, listKey := r.sessionKey(sessionID), r.messagesKey(sessionID)
+	var msg model.SessionMessage
+	err := r.client.watch(ctx, []string{key, listKey}, func(tx *redisTx) error {
+		var sess model.Session
+		ok, err := getJSON(tx.do, key, &sess)
+		if err != nil {
+			return err
+		}
+		if !ok || sess.UserID != userID || sess.Deleted {
+			return errors.New("session not found")
+		}
+		for stop := int64(-1); ; stop -= redisEditScan {
+			reply, err := tx.do("LRANGE", listKey, stop-redisEditScan+1, stop)
+			if err != nil {
+				return err
+			}
+			entries := redisStrings(reply)
+			for i := len(entries) - 1; i >= 0; i-- {
+				var m model.SessionMessage
+				if err := json.Unmarshal([]byte(entries[i]), &m); err != nil {
+					return err
+				}
+				if m.ID != messageID {
+					continue
+				}
+				if m.Deleted {
+					return ErrMessageNotFound
+				}
+				msg, err = fn(m)
+				if err != nil {
+					msg = m
+					return err
+				}
+				index := stop - int64(len(entries)-1-i)
+				tx.queue("LSET", listKey, index, redisJSON(msg))
+				return nil
+			}
+			if len(entries) < redisEditScan {
+				return ErrMessageNotFound
+			}
+		}
+	})
+	if err != nil {
+		return msg, err
+	}
+
+	r.publish(Event{Type: eventType, Origin: origin, UserID: userID, SessionID: sessionID, Message: &msg, At: nowMillis})
+	return msg, nil
+}
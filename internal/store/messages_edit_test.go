@@ -0,0 +1,107 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func testEditMessages(t *testing.T, s Storage) {
+	t.Helper()
+	ctx := context.Background()
+	sess, _, err := s.GetOrCreateSession(ctx, "u1", "tag", "meta", nil, nil, 1000)
+	if err != nil {
+		t.Fatalf("GetOrCreateSession: %v", err)
+	}
+	first, _ := s.AppendMessageFrom(ctx, "", "u1", sess.ID, "one", "", 1000)
+	second, _, _ := s.AppendMessageOnce(ctx, "", "u1", sess.ID, "two", "", "l2", 1000)
+
+	var published []Event
+	s.Subscribe(func(ev Event) { published = append(published, ev) })
+
+	edited, err := s.UpdateMessageFrom(ctx, OriginREST, "u1", sess.ID, first.ID, "uno", "", 2000)
+	if err != nil {
+		t.Fatalf("UpdateMessageFrom: %v", err)
+	}
+	if edited.Content != "uno" || edited.Seq != first.Seq || edited.UpdatedAt != 2000 || edited.CreatedAt != 1000 {
+		t.Fatalf("unexpected edited message: %+v", edited)
+	}
+	if _, err := s.UpdateMessageFrom(ctx, OriginREST, "u1", sess.ID, first.ID, "uno", "00", 2000); !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("expected a checksum mismatch, got %v", err)
+	}
+
+	tomb, err := s.DeleteMessageFrom(ctx, OriginREST, "u1", sess.ID, second.ID, 3000)
+	if err != nil {
+		t.Fatalf("DeleteMessageFrom: %v", err)
+	}
+	if !tomb.Deleted || tomb.Content != "" || tomb.UpdatedAt != 3000 || tomb.LocalID != "l2" {
+		t.Fatalf("unexpected tombstone: %+v", tomb)
+	}
+	if _, err := s.DeleteMessageFrom(ctx, OriginREST, "u1", sess.ID, second.ID, 3000); !errors.Is(err, ErrMessageNotFound) {
+		t.Fatalf("expected deleting twice to report not found, got %v", err)
+	}
+	if _, err := s.UpdateMessageFrom(ctx, OriginREST, "u1", sess.ID, second.ID, "x", "", 3000); !errors.Is(err, ErrMessageNotFound) {
+		t.Fatalf("expected editing a tombstone to report not found, got %v", err)
+	}
+	if _, err := s.UpdateMessageFrom(ctx, OriginREST, "u1", sess.ID, "missing", "x", "", 3000); !errors.Is(err, ErrMessageNotFound) {
+		t.Fatalf("expected an unknown message to report not found, got %v", err)
+	}
+	if _, err := s.DeleteMessageFrom(ctx, OriginREST, "u2", sess.ID, first.ID, 3000); err == nil || errors.Is(err, ErrMessageNotFound) {
+		t.Fatalf("expected other users' sessions to be hidden, got %v", err)
+	}
+
+	if len(published) != 2 || published[0].Type != EventMessageUpdated || published[1].Type != EventMessageDeleted {
+		t.Fatalf("unexpected events: %+v", published)
+	}
+	msgs, _ := s.ListMessages(ctx, "u1", sess.ID, 0, 10)
+	if len(msgs) != 2 || msgs[0].Content != "uno" || !msgs[1].Deleted {
+		t.Fatalf("unexpected messages: %+v", msgs)
+	}
+	if replay, created, _ := s.AppendMessageOnce(ctx, "", "u1", sess.ID, "two", "", "l2", 4000); created || !replay.Deleted {
+		t.Fatalf("expected a replay of a deleted message to return its tombstone, got %+v", replay)
+	}
+}
+
+func TestStore_EditMessages(t *testing.T) {
+	testEditMessages(t, New())
+}
+
+func TestRedisStore_EditMessages(t *testing.T) {
+	testEditMessages(t, openFakeRedisStore(t, 0))
+}
+
+func TestRedisStore_EditMessageBeyondFirstScan(t *testing.T) {
+	ctx := context.Background()
+	r := openFakeRedisStore(t, 0)
+	sess, _, _ := r.GetOrCreateSession(ctx, "u1", "tag", "meta", nil, nil, 1000)
+	first, _ := r.AppendMessageFrom(ctx, "", "u1", sess.ID, "c", "", 1000)
+	for i := 0; i < redisEditScan+5; i++ {
+		r.AppendMessageFrom(ctx, "", "u1", sess.ID, "c", "", 1000)
+	}
+	if _, err := r.UpdateMessageFrom(ctx, "", "u1", sess.ID, first.ID, "edited", "", 2000); err != nil {
+		t.Fatalf("UpdateMessageFrom: %v", err)
+	}
+	msgs, _ := r.ListMessages(ctx, "u1", sess.ID, 0, 2)
+	if msgs[0].Content != "edited" || msgs[1].Content != "c" {
+		t.Fatalf("expected only the first message edited, got %+v", msgs)
+	}
+}
+
+func TestStore_EditMessageSurvivesJournalReload(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	opts := Options{SessionsStateFile: filepath.Join(dir, "sessions-state.json"), MessageJournalDir: filepath.Join(dir, "journal")}
+	s1 := NewWithOptions(opts)
+	sess, _, _ := s1.GetOrCreateSession(ctx, "u1", "tag", "meta", nil, nil, 1000)
+	first, _ := s1.AppendMessageFrom(ctx, "", "u1", sess.ID, "one", "", 1000)
+	second, _ := s1.AppendMessageFrom(ctx, "", "u1", sess.ID, "two", "", 1000)
+	s1.UpdateMessageFrom(ctx, "", "u1", sess.ID, first.ID, "uno", "", 2000)
+	s1.DeleteMessageFrom(ctx, "", "u1", sess.ID, second.ID, 2000)
+
+	s2 := NewWithOptions(opts)
+	msgs, err := s2.ListMessages(ctx, "u1", sess.ID, 0, 10)
+	if err != nil || len(msgs) != 2 || msgs[0].Content != "uno" || !msgs[1].Deleted {
+		t.Fatalf("unexpected messages after reload: %+v (%v)", msgs, err)
+	}
+}
@@ -0,0 +1,88 @@
+package store
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func testAppendMessageOnce(t *testing.T, s Storage) {
+	t.Helper()
+	ctx := context.Background()
+	sess, _, err := s.GetOrCreateSession(ctx, "u1", "tag", "meta", nil, nil, 1000)
+	if err != nil {
+		t.Fatalf("GetOrCreateSession: %v", err)
+	}
+	other, _, _ := s.GetOrCreateSession(ctx, "u1", "other", "meta", nil, nil, 1000)
+
+	published := 0
+	s.Subscribe(func(ev Event) {
+		if ev.Type == EventMessageAppended {
+			published++
+		}
+	})
+
+	first, created, err := s.AppendMessageOnce(ctx, "", "u1", sess.ID, "c", "", "l1", 1000)
+	if err != nil || !created {
+		t.Fatalf("AppendMessageOnce: created=%v err=%v", created, err)
+	}
+	if first.LocalID != "l1" {
+		t.Fatalf("expected the local id to be stored, got %q", first.LocalID)
+	}
+	again, created, err := s.AppendMessageOnce(ctx, "", "u1", sess.ID, "retry", "", "l1", 2000)
+	if err != nil || created {
+		t.Fatalf("expected a replay, got created=%v err=%v", created, err)
+	}
+	if !reflect.DeepEqual(again, first) {
+		t.Fatalf("expected the first message back, got %+v want %+v", again, first)
+	}
+	if published != 1 {
+		t.Fatalf("expected one published message, got %d", published)
+	}
+
+	next, created, _ := s.AppendMessageOnce(ctx, "", "u1", sess.ID, "c", "", "l2", 1000)
+	if !created || next.Seq != first.Seq+1 {
+		t.Fatalf("expected a new message at seq %d, got %+v", first.Seq+1, next)
+	}
+	if _, created, _ := s.AppendMessageOnce(ctx, "", "u1", other.ID, "c", "", "l1", 1000); !created {
+		t.Fatalf("expected local ids to be scoped to their session")
+	}
+	for i := 0; i < 2; i++ {
+		if _, created, _ := s.AppendMessageOnce(ctx, "", "u1", sess.ID, "c", "", "", 1000); !created {
+			t.Fatalf("expected messages without a local id to always append")
+		}
+	}
+
+	msgs, err := s.ListMessages(ctx, "u1", sess.ID, 0, 10)
+	if err != nil {
+		t.Fatalf("ListMessages: %v", err)
+	}
+	if len(msgs) != 4 || msgs[0].LocalID != "l1" {
+		t.Fatalf("unexpected messages: %+v", msgs)
+	}
+	if _, _, err := s.AppendMessageOnce(ctx, "", "u2", sess.ID, "c", "", "l1", 1000); err == nil {
+		t.Fatalf("expected other users' sessions to be hidden")
+	}
+}
+
+func TestStore_AppendMessageOnce(t *testing.T) {
+	testAppendMessageOnce(t, New())
+}
+
+func TestRedisStore_AppendMessageOnce(t *testing.T) {
+	testAppendMessageOnce(t, openFakeRedisStore(t, 0))
+}
+
+func TestRedisStore_AppendMessageOnceAfterTrim(t *testing.T) {
+	ctx := context.Background()
+	r := openFakeRedisStore(t, 2)
+	sess, _, _ := r.GetOrCreateSession(ctx, "u1", "tag", "meta", nil, nil, 1000)
+	first, _, _ := r.AppendMessageOnce(ctx, "", "u1", sess.ID, "c", "", "l1", 1000)
+	for i := 0; i < 2; i++ {
+		r.AppendMessageOnce(ctx, "", "u1", sess.ID, "c", "", "", 1000)
+	}
+	msg, created, err := r.AppendMessageOnce(ctx, "", "u1", sess.ID, "c", "", "l1", 1000)
+	if err != nil || !created || msg.Seq == first.Seq {
+		t.Fatalf("expected a trimmed local id to append again, got %+v created=%v err=%v", msg, created, err)
+	}
+}
@@ -0,0 +1,160 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sort"
+
+	"happy-server-lite/internal/model"
+)
+
+// MessageQuery selects a page of a session's messages by seq. Zero After and
+// Before leave that side unbounded.
+type MessageQuery struct {
+	After  int64
+	Before int64
+	// Desc returns the newest matching messages first.
+	Desc  bool
+	Limit int
+}
+
+func (q MessageQuery) matches(seq int64) bool {
+	return seq > q.After && (q.Before <= 0 || seq < q.Before)
+}
+
+// query returns the messages of sessionID selected by q, which must have a
+// positive Limit. A session's messages are held in seq order.
+func (m *messageStore) query(sessionID string, q MessageQuery) []model.SessionMessage {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	msgs := m.data[sessionID]
+	result := make([]model.SessionMessage, 0)
+	if q.Desc {
+		i := len(msgs)
+		if q.Before > 0 {
+			i = sort.Search(len(msgs), func(i int) bool { return msgs[i].Seq >= q.Before })
+		}
+		for i--; i >= 0 && msgs[i].Seq > q.After && len(result) < q.Limit; i-- {
+			result = append(result, msgs[i])
+		}
+		return result
+	}
+	i := sort.Search(len(msgs), func(i int) bool { return msgs[i].Seq > q.After })
+	for ; i < len(msgs) && q.matches(msgs[i].Seq) && len(result) < q.Limit; i++ {
+		result = append(result, msgs[i])
+	}
+	return result
+}
+
+// QueryMessages returns a page of the session's messages in the order q asks
+// for. A non-positive Limit means 100, as for ListMessages.
+func (s *Store) QueryMessages(ctx context.Context, userID, sessionID string, q MessageQuery) ([]model.SessionMessage, error) {
+	unpin, err := s.pinUser(userID)
+	if err != nil {
+		return nil, err
+	}
+	defer unpin()
+
+	if _, ok := s.GetSession(ctx, userID, sessionID); !ok {
+		return nil, errors.New("session not found")
+	}
+	if q.Limit <= 0 {
+		q.Limit = 100
+	}
+	return s.messages.query(sessionID, q), nil
+}
+
+func (p *PostgresStore) QueryMessages(ctx context.Context, userID, sessionID string, q MessageQuery) ([]model.SessionMessage, error) {
+	if _, ok := p.GetSession(ctx, userID, sessionID); !ok {
+		return nil, errors.New("session not found")
+	}
+	if q.Limit <= 0 {
+		q.Limit = 100
+	}
+	order := "ASC"
+	if q.Desc {
+		order = "DESC"
+	}
+	rows, err := p.db.QueryContext(ctx, `SELECT `+messageColumns+` FROM messages
+		WHERE session_id = $1 AND seq > $2 AND ($3 <= 0 OR seq < $3) ORDER BY seq `+order+` LIMIT $4`,
+		sessionID, q.After, q.Before, q.Limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make([]model.SessionMessage, 0)
+	for rows.Next() {
+		m, err := scanMessage(rows)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, m)
+	}
+	return result, rows.Err()
+}
+
+// QueryMessages maps the seq bounds to list indexes the way ListMessages
+// does. Newest-first pages without Before read from the tail of the list,
+// which trimming cannot shift.
+func (r *RedisStore) QueryMessages(ctx context.Context, userID, sessionID string, q MessageQuery) ([]model.SessionMessage, error) {
+	if _, ok := r.GetSession(ctx, userID, sessionID); !ok {
+		return nil, errors.New("session not found")
+	}
+	if q.Limit <= 0 {
+		q.Limit = 100
+	}
+	key := r.messagesKey(sessionID)
+	reply, err := r.client.do(ctx, "LINDEX", key, 0)
+	if err != nil {
+		return nil, err
+	}
+	if reply == nil {
+		return []model.SessionMessage{}, nil
+	}
+	var first model.SessionMessage
+	if err := json.Unmarshal([]byte(reply.(string)), &first); err != nil {
+		return nil, err
+	}
+
+	lo := max(q.After-first.Seq+1, 0)
+	var start, stop int64
+	switch {
+	case q.Desc && q.Before <= 0:
+		start, stop = -int64(q.Limit), -1
+	case q.Desc:
+		stop = q.Before - first.Seq - 1
+		start = max(stop-int64(q.Limit)+1, lo)
+	default:
+		start, stop = lo, lo+int64(q.Limit)-1
+		if q.Before > 0 {
+			stop = min(stop, q.Before-first.Seq-1)
+		}
+	}
+	result := make([]model.SessionMessage, 0)
+	if stop < 0 && start >= 0 {
+		return result, nil
+	}
+	reply, err = r.client.do(ctx, "LRANGE", key, start, stop)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range redisStrings(reply) {
+		var m model.SessionMessage
+		if err := json.Unmarshal([]byte(s), &m); err != nil {
+			return nil, err
+		}
+		// Trimming between LINDEX and LRANGE shifts the list left.
+		if q.matches(m.Seq) {
+			result = append(result, m)
+		}
+	}
+	if q.Desc {
+		for i, j := 0, len(result)-1; i < j; i, j = i+1, j-1 {
+			result[i], result[j] = result[j], result[i]
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,87 @@
+package store
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"happy-server-lite/internal/model"
+)
+
+func seqsOf(msgs []model.SessionMessage) []int64 {
+	seqs := make([]int64, 0, len(msgs))
+	for _, m := range msgs {
+		seqs = append(seqs, m.Seq)
+	}
+	return seqs
+}
+
+func testQueryMessages(t *testing.T, s Storage) {
+	t.Helper()
+	ctx := context.Background()
+	sess, _, err := s.GetOrCreateSession(ctx, "u1", "tag", "meta", nil, nil, 1000)
+	if err != nil {
+		t.Fatalf("GetOrCreateSession: %v", err)
+	}
+	if got, err := s.QueryMessages(ctx, "u1", sess.ID, MessageQuery{Desc: true}); err != nil || len(got) != 0 {
+		t.Fatalf("expected no messages, got %v %v", got, err)
+	}
+	for i := 0; i < 10; i++ {
+		if _, err := s.AppendMessageFrom(ctx, "", "u1", sess.ID, "c", "", 1000); err != nil {
+			t.Fatalf("AppendMessageFrom: %v", err)
+		}
+	}
+
+	for _, tc := range []struct {
+		q    MessageQuery
+		want []int64
+	}{
+		{MessageQuery{Limit: 3}, []int64{1, 2, 3}},
+		{MessageQuery{After: 8, Limit: 3}, []int64{9, 10}},
+		{MessageQuery{After: 2, Before: 6, Limit: 10}, []int64{3, 4, 5}},
+		{MessageQuery{Desc: true, Limit: 3}, []int64{10, 9, 8}},
+		{MessageQuery{Desc: true, Before: 4, Limit: 5}, []int64{3, 2, 1}},
+		{MessageQuery{Desc: true, After: 5, Before: 9, Limit: 2}, []int64{8, 7}},
+		{MessageQuery{Desc: true, After: 7, Limit: 5}, []int64{10, 9, 8}},
+		{MessageQuery{Before: 1, Limit: 5}, []int64{}},
+		{MessageQuery{Desc: true, Before: 1, Limit: 5}, []int64{}},
+	} {
+		got, err := s.QueryMessages(ctx, "u1", sess.ID, tc.q)
+		if err != nil {
+			t.Fatalf("QueryMessages(%+v): %v", tc.q, err)
+		}
+		if seqs := seqsOf(got); !reflect.DeepEqual(seqs, tc.want) {
+			t.Fatalf("QueryMessages(%+v) = %v, want %v", tc.q, seqs, tc.want)
+		}
+	}
+
+	if _, err := s.QueryMessages(ctx, "u2", sess.ID, MessageQuery{}); err == nil {
+		t.Fatalf("expected other users' sessions to be hidden")
+	}
+}
+
+func TestStore_QueryMessages(t *testing.T) {
+	testQueryMessages(t, New())
+}
+
+func TestRedisStore_QueryMessages(t *testing.T) {
+	testQueryMessages(t, openFakeRedisStore(t, 0))
+}
+
+func TestRedisStore_QueryMessagesAfterTrim(t *testing.T) {
+	ctx := context.Background()
+	r := openFakeRedisStore(t, 5)
+	sess, _, _ := r.GetOrCreateSession(ctx, "u1", "tag", "meta", nil, nil, 1000)
+	for i := 0; i < 10; i++ {
+		if _, err := r.AppendMessageFrom(ctx, "", "u1", sess.ID, "c", "", 1000); err != nil {
+			t.Fatalf("AppendMessageFrom: %v", err)
+		}
+	}
+	got, err := r.QueryMessages(ctx, "u1", sess.ID, MessageQuery{Desc: true, Before: 8, Limit: 10})
+	if err != nil {
+		t.Fatalf("QueryMessages: %v", err)
+	}
+	if seqs := seqsOf(got); !reflect.DeepEqual(seqs, []int64{7, 6}) {
+		t.Fatalf("unexpected seqs %v", seqs)
+	}
+}
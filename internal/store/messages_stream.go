@@ -0,0 +1,52 @@
+package store
+
+import (
+	"context"
+
+	"happy-server-lite/internal/model"
+)
+
+// streamMessagesPage is how many messages StreamMessages reads at a time.
+const streamMessagesPage = 500
+
+// StreamMessages calls fn with the messages of a session selected by q, in
+// the order q asks for, reading them a page at a time through QueryMessages
+// so that only one page is held in memory whatever the session's length. A
+// positive q.Limit caps the total. It stops at the first error from fn, and
+// fn is never called when the session does not exist. It gives up with
+// ctx's error between pages once ctx is done.
+func StreamMessages(ctx context.Context, st Storage, userID, sessionID string, q MessageQuery, fn func(model.SessionMessage) error) error {
+	remaining := q.Limit
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		page := q
+		page.Limit = streamMessagesPage
+		if remaining > 0 {
+			page.Limit = min(page.Limit, remaining)
+		}
+		msgs, err := st.QueryMessages(ctx, userID, sessionID, page)
+		if err != nil {
+			return err
+		}
+		for _, m := range msgs {
+			if err := fn(m); err != nil {
+				return err
+			}
+		}
+		if remaining > 0 {
+			if remaining -= len(msgs); remaining == 0 {
+				return nil
+			}
+		}
+		if len(msgs) < page.Limit {
+			return nil
+		}
+		if last := msgs[len(msgs)-1].Seq; q.Desc {
+			q.Before = last
+		} else {
+			q.After = last
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"happy-server-lite/internal/model"
+)
+
+func testStreamMessages(t *testing.T, s Storage) {
+	t.Helper()
+	ctx := context.Background()
+	sess, _, err := s.GetOrCreateSession(ctx, "u1", "tag", "meta", nil, nil, 1000)
+	if err != nil {
+		t.Fatalf("GetOrCreateSession: %v", err)
+	}
+	const total = streamMessagesPage*2 + 7
+	for i := 0; i < total; i++ {
+		if _, err := s.AppendMessageFrom(ctx, OriginREST, "u1", sess.ID, "c", "", 1000); err != nil {
+			t.Fatalf("AppendMessage: %v", err)
+		}
+	}
+
+	collect := func(q MessageQuery) []int64 {
+		t.Helper()
+		var seqs []int64
+		if err := StreamMessages(ctx, s, "u1", sess.ID, q, func(m model.SessionMessage) error {
+			seqs = append(seqs, m.Seq)
+			return nil
+		}); err != nil {
+			t.Fatalf("StreamMessages: %v", err)
+		}
+		return seqs
+	}
+	if seqs := collect(MessageQuery{}); len(seqs) != total || seqs[0] != 1 || seqs[total-1] != total {
+		t.Fatalf("expected all %d messages in order, got %d", total, len(seqs))
+	}
+	seqs := collect(MessageQuery{Desc: true, Limit: streamMessagesPage + 3})
+	if len(seqs) != streamMessagesPage+3 || seqs[0] != total || seqs[len(seqs)-1] != total-streamMessagesPage-2 {
+		t.Fatalf("unexpected newest-first stream of %d: %v..%v", len(seqs), seqs[0], seqs[len(seqs)-1])
+	}
+
+	stop := errors.New("stop")
+	calls := 0
+	err = StreamMessages(ctx, s, "u1", sess.ID, MessageQuery{}, func(model.SessionMessage) error {
+		calls++
+		return stop
+	})
+	if !errors.Is(err, stop) || calls != 1 {
+		t.Fatalf("expected the stream to stop at fn's error, got %v after %d calls", err, calls)
+	}
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := StreamMessages(cancelled, s, "u1", sess.ID, MessageQuery{}, func(model.SessionMessage) error { return nil }); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected a cancelled stream to stop with the context's error, got %v", err)
+	}
+	if err := StreamMessages(ctx, s, "u2", sess.ID, MessageQuery{}, func(model.SessionMessage) error { return nil }); err == nil {
+		t.Fatalf("expected another user's session to be rejected")
+	}
+}
+
+func TestStore_StreamMessages(t *testing.T) {
+	testStreamMessages(t, New())
+}
+
+func TestRedisStore_StreamMessages(t *testing.T) {
+	testStreamMessages(t, openFakeRedisStore(t, 0))
+}
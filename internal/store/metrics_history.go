@@ -0,0 +1,209 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MetricsSample is what the server measured over the IntervalMs ending at
+// At, in Unix milliseconds.
+type MetricsSample struct {
+	At          int64
+	IntervalMs  int64
+	Connections int
+	// Messages counts the Socket.IO frames received in the interval.
+	Messages int64
+	// Broadcasts counts the updates fanned out in the interval, and
+	// BroadcastMicros the time they took in all from being queued to being
+	// handed to every connection.
+	Broadcasts      int64
+	BroadcastMicros int64
+}
+
+// MetricsPoint is one bucket of the metrics history, starting at At.
+type MetricsPoint struct {
+	At int64 `json:"at"`
+	// Connections is the mean of the samples in the bucket.
+	Connections        float64 `json:"connections"`
+	MaxConnections     int     `json:"maxConnections"`
+	MessagesPerMinute  float64 `json:"messagesPerMinute"`
+	BroadcastLatencyMs float64 `json:"broadcastLatencyMs"`
+}
+
+// MetricsResolution is a granularity the history is kept at: buckets of
+// Step, the oldest dropped once Keep old.
+type MetricsResolution struct {
+	Name string
+	Step time.Duration
+	Keep time.Duration
+}
+
+// MetricsResolutions are the granularities every sample is folded into,
+// finest first.
+var MetricsResolutions = []MetricsResolution{
+	{Name: "minute", Step: time.Minute, Keep: 24 * time.Hour},
+	{Name: "hour", Step: time.Hour, Keep: 30 * 24 * time.Hour},
+	{Name: "day", Step: 24 * time.Hour, Keep: 365 * 24 * time.Hour},
+}
+
+var ErrUnknownMetricsResolution = errors.New("unknown metrics resolution")
+
+// MetricsRecorder is implemented by stores that keep a history of the
+// server's metrics, so it can be graphed without an external time-series
+// database.
+type MetricsRecorder interface {
+	RecordMetrics(sample MetricsSample)
+	// MetricsHistory returns the buckets of resolution that end after
+	// since, oldest first.
+	MetricsHistory(resolution string, since int64) ([]MetricsPoint, error)
+}
+
+var _ MetricsRecorder = (*Store)(nil)
+
+// recordMetrics is keyed by resolution and bucket start.
+const recordMetrics = "metrics"
+
+// metricsBucket keeps sums rather than means, so samples fold into coarser
+// buckets without losing their weight.
+type metricsBucket struct {
+	At              int64
+	Samples         int
+	DurationMs      int64
+	ConnectionsSum  int64
+	MaxConnections  int
+	Messages        int64
+	Broadcasts      int64
+	BroadcastMicros int64
+}
+
+func (b *metricsBucket) add(sample MetricsSample) {
+	b.Samples++
+	b.DurationMs += sample.IntervalMs
+	b.ConnectionsSum += int64(sample.Connections)
+	b.MaxConnections = max(b.MaxConnections, sample.Connections)
+	b.Messages += sample.Messages
+	b.Broadcasts += sample.Broadcasts
+	b.BroadcastMicros += sample.BroadcastMicros
+}
+
+func (b metricsBucket) point() MetricsPoint {
+	p := MetricsPoint{At: b.At, MaxConnections: b.MaxConnections}
+	if b.Samples > 0 {
+		p.Connections = float64(b.ConnectionsSum) / float64(b.Samples)
+	}
+	if b.DurationMs > 0 {
+		p.MessagesPerMinute = float64(b.Messages) * float64(time.Minute.Milliseconds()) / float64(b.DurationMs)
+	}
+	if b.Broadcasts > 0 {
+		p.BroadcastLatencyMs = float64(b.BroadcastMicros) / float64(b.Broadcasts) / 1000
+	}
+	return p
+}
+
+func metricsKey(resolution string, at int64) string {
+	return fmt.Sprintf("%s|%020d", resolution, at)
+}
+
+// putMetricsBucketLocked inserts b into the buckets of resolution in order,
+// replacing one with the same start; the caller holds metricsMu.
+func (s *Store) putMetricsBucketLocked(resolution string, b metricsBucket) {
+	buckets := s.metrics[resolution]
+	i := sort.Search(len(buckets), func(i int) bool { return buckets[i].At >= b.At })
+	if i < len(buckets) && buckets[i].At == b.At {
+		buckets[i] = b
+		return
+	}
+	s.metrics[resolution] = append(buckets[:i], append([]metricsBucket{b}, buckets[i:]...)...)
+}
+
+// RecordMetrics folds sample into the bucket it falls in at every
+// resolution and drops the buckets that have aged out. With a backend the
+// history survives restarts.
+func (s *Store) RecordMetrics(sample MetricsSample) {
+	s.metricsMu.Lock()
+	defer s.metricsMu.Unlock()
+	for _, res := range MetricsResolutions {
+		step := res.Step.Milliseconds()
+		at := sample.At - sample.At%step
+		buckets := s.metrics[res.Name]
+		i := sort.Search(len(buckets), func(i int) bool { return buckets[i].At >= at })
+		b := metricsBucket{At: at}
+		if i < len(buckets) && buckets[i].At == at {
+			b = buckets[i]
+		}
+		b.add(sample)
+		s.putMetricsBucketLocked(res.Name, b)
+		s.persist(recordMetrics, metricsKey(res.Name, at), b)
+
+		buckets = s.metrics[res.Name]
+		cutoff := sample.At - res.Keep.Milliseconds()
+		n := 0
+		for n < len(buckets) && buckets[n].At+step <= cutoff {
+			s.unpersist(recordMetrics, metricsKey(res.Name, buckets[n].At))
+			n++
+		}
+		s.metrics[res.Name] = buckets[n:]
+	}
+}
+
+func (s *Store) MetricsHistory(resolution string, since int64) ([]MetricsPoint, error) {
+	var step int64
+	for _, res := range MetricsResolutions {
+		if res.Name == resolution {
+			step = res.Step.Milliseconds()
+		}
+	}
+	if step == 0 {
+		return nil, ErrUnknownMetricsResolution
+	}
+	s.metricsMu.Lock()
+	defer s.metricsMu.Unlock()
+	points := []MetricsPoint{}
+	for _, b := range s.metrics[resolution] {
+		if b.At+step > since {
+			points = append(points, b.point())
+		}
+	}
+	return points, nil
+}
+
+// loadMetricsRecord restores a bucket written by RecordMetrics. Buckets of
+// resolutions no longer kept are skipped.
+func (s *Store) loadMetricsRecord(r Record) error {
+	resolution, _, _ := strings.Cut(r.Key, "|")
+	var b metricsBucket
+	if err := json.Unmarshal(r.Data, &b); err != nil {
+		return err
+	}
+	for _, res := range MetricsResolutions {
+		if res.Name == resolution {
+			s.metricsMu.Lock()
+			s.putMetricsBucketLocked(resolution, b)
+			s.metricsMu.Unlock()
+		}
+	}
+	return nil
+}
+
+// unloadMetricsRecord drops the bucket under key, the reverse of
+// loadMetricsRecord.
+func (s *Store) unloadMetricsRecord(key string) error {
+	resolution, rawAt, _ := strings.Cut(key, "|")
+	at, err := strconv.ParseInt(rawAt, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid metrics key: %w", err)
+	}
+	s.metricsMu.Lock()
+	defer s.metricsMu.Unlock()
+	buckets := s.metrics[resolution]
+	i := sort.Search(len(buckets), func(i int) bool { return buckets[i].At >= at })
+	if i < len(buckets) && buckets[i].At == at {
+		s.metrics[resolution] = append(buckets[:i], buckets[i+1:]...)
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package store
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestStore_MetricsHistoryDownsamples(t *testing.T) {
+	backend := newMemBackend()
+	s := NewWithOptions(Options{Backend: backend})
+	minute := time.Minute.Milliseconds()
+	day := 24 * time.Hour.Milliseconds()
+	start := 10 * day
+
+	// Two hours of one-minute samples: connections climb, 60 messages and
+	// 2 broadcasts of 3ms each a minute.
+	for i := int64(1); i <= 120; i++ {
+		s.RecordMetrics(MetricsSample{At: start + i*minute - 1, IntervalMs: minute, Connections: int(i), Messages: 60, Broadcasts: 2, BroadcastMicros: 6000})
+	}
+
+	minutes, err := s.MetricsHistory("minute", 0)
+	if err != nil || len(minutes) != 120 {
+		t.Fatalf("expected 120 minutes, got %d (%v)", len(minutes), err)
+	}
+	if p := minutes[0]; p.At != start || p.Connections != 1 || p.MessagesPerMinute != 60 || p.BroadcastLatencyMs != 3 {
+		t.Fatalf("unexpected first minute: %+v", p)
+	}
+	hours, _ := s.MetricsHistory("hour", 0)
+	if len(hours) != 2 || hours[0].Connections != 30.5 || hours[0].MaxConnections != 60 || hours[1].At != start+60*minute || hours[1].MessagesPerMinute != 60 {
+		t.Fatalf("unexpected hours: %+v", hours)
+	}
+	if since, _ := s.MetricsHistory("minute", start+119*minute); len(since) != 1 || since[0].At != start+119*minute {
+		t.Fatalf("expected only the last minute, got %+v", since)
+	}
+	if _, err := s.MetricsHistory("week", 0); !errors.Is(err, ErrUnknownMetricsResolution) {
+		t.Fatalf("expected an unknown resolution to be refused, got %v", err)
+	}
+
+	// A day later the minutes have aged out, the hours have not.
+	s.RecordMetrics(MetricsSample{At: start + day + 121*minute, IntervalMs: minute, Connections: 1})
+	if minutes, _ := s.MetricsHistory("minute", 0); len(minutes) != 1 {
+		t.Fatalf("expected old minutes to be dropped, got %d", len(minutes))
+	}
+
+	// The history is kept across restarts.
+	reopened := NewWithOptions(Options{Backend: backend})
+	hours, _ = reopened.MetricsHistory("hour", 0)
+	if len(hours) != 3 || hours[0].MaxConnections != 60 {
+		t.Fatalf("unexpected hours after reopening: %+v", hours)
+	}
+	if minutes, _ := reopened.MetricsHistory("minute", 0); len(minutes) != 1 {
+		t.Fatalf("expected dropped minutes to stay dropped, got %d", len(minutes))
+	}
+}
@@ -0,0 +1,440 @@
+package store
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"happy-server-lite/internal/model"
+)
+
+// statePartitions keeps what the four state files would hold as one file
+// per account instead, each sealed with a key derived for that account from
+// the store's partition key. A single leaked file then exposes neither the
+// other accounts nor, without the partition key, its own.
+type statePartitions struct {
+	dir string
+	key []byte
+
+	mu sync.Mutex
+	// written holds the SHA-256 of each user's partition as last written,
+	// so a save rewrites only the partitions that changed.
+	written     map[string][sha256.Size]byte
+	artifactSeq int64
+}
+
+const (
+	partitionSuffix  = ".state"
+	partitionIndex   = "index.json"
+	partitionVersion = 1
+	partitionSalt    = "happy-server-lite state partitions"
+)
+
+// persistedPartition is the plaintext of one account's partition.
+type persistedPartition struct {
+	Version   int                    `json:"version"`
+	UserID    string                 `json:"userId"`
+	Accounts  []model.Account        `json:"accounts,omitempty"`
+	Settings  *accountSettings       `json:"settings,omitempty"`
+	Disabled  bool                   `json:"disabled,omitempty"`
+	GitHub    *model.GitHubIdentity  `json:"github,omitempty"`
+	Sessions  []model.Session        `json:"sessions,omitempty"`
+	Messages  []model.SessionMessage `json:"messages,omitempty"`
+	Machines  []model.Machine        `json:"machines,omitempty"`
+	Artifacts []model.Artifact       `json:"artifacts,omitempty"`
+
+	RefreshTokens []model.RefreshToken `json:"refreshTokens,omitempty"`
+	APIKeys       []model.APIKey       `json:"apiKeys,omitempty"`
+	Devices       []model.Device       `json:"devices,omitempty"`
+}
+
+// sealedPartition is a partition file: the owner's user id, which the key
+// is derived from, in the clear, and the partition sealed with AES-256-GCM.
+type sealedPartition struct {
+	Version int    `json:"version"`
+	UserID  string `json:"userId"`
+	Nonce   []byte `json:"nonce"`
+	Data    []byte `json:"data"`
+	SavedAt int64  `json:"savedAt"`
+}
+
+// partitionIndexFile holds the little state that belongs to no account.
+type partitionIndexFile struct {
+	Version int `json:"version"`
+	// ArtifactSeq is the last artifact seq handed out, as in the artifacts
+	// state file.
+	ArtifactSeq int64 `json:"artifactSeq"`
+	SavedAt     int64 `json:"savedAt"`
+}
+
+// errPartitionKey is returned for a partition that does not authenticate
+// under the store's partition key.
+var errPartitionKey = errors.New("cannot decrypt: wrong partition key or corrupt file")
+
+func newStatePartitions(dir string, key []byte) *statePartitions {
+	return &statePartitions{dir: dir, key: key, written: make(map[string][sha256.Size]byte)}
+}
+
+// hkdfSHA256 derives a 32-byte key from secret with HKDF-SHA256 (RFC 5869).
+func hkdfSHA256(secret []byte, salt, info string) []byte {
+	extract := hmac.New(sha256.New, []byte(salt))
+	extract.Write(secret)
+	expand := hmac.New(sha256.New, extract.Sum(nil))
+	expand.Write([]byte(info))
+	expand.Write([]byte{1})
+	return expand.Sum(nil)
+}
+
+// aead returns the cipher for userID's partition.
+func (p *statePartitions) aead(userID string) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(hkdfSHA256(p.key, partitionSalt, "account\x00"+userID))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// path names userID's partition by a keyed hash, so user ids are not
+// listed by the directory and need not be safe file names.
+func (p *statePartitions) path(userID string) string {
+	mac := hmac.New(sha256.New, hkdfSHA256(p.key, partitionSalt, "name"))
+	mac.Write([]byte(userID))
+	return filepath.Join(p.dir, hex.EncodeToString(mac.Sum(nil)[:16])+partitionSuffix)
+}
+
+func (p *statePartitions) seal(userID string, plain []byte) (sealedPartition, error) {
+	aead, err := p.aead(userID)
+	if err != nil {
+		return sealedPartition{}, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return sealedPartition{}, err
+	}
+	return sealedPartition{
+		Version: partitionVersion,
+		UserID:  userID,
+		Nonce:   nonce,
+		Data:    aead.Seal(nil, nonce, plain, []byte(userID)),
+		SavedAt: time.Now().UnixMilli(),
+	}, nil
+}
+
+func (p *statePartitions) open(sealed sealedPartition) ([]byte, error) {
+	if sealed.Version != partitionVersion {
+		return nil, fmt.Errorf("unsupported partition version %d", sealed.Version)
+	}
+	aead, err := p.aead(sealed.UserID)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed.Nonce) != aead.NonceSize() {
+		return nil, errors.New("invalid nonce")
+	}
+	plain, err := aead.Open(nil, sealed.Nonce, sealed.Data, []byte(sealed.UserID))
+	if err != nil {
+		return nil, errPartitionKey
+	}
+	return plain, nil
+}
+
+// loadPartitions loads every partition under the directory. A partition
+// that does not decrypt fails the load, since it most likely means the key
+// changed and the accounts it holds would be recreated empty over it. Any
+// other partition that fails to load is logged and skipped, leaving the
+// others usable, unless none of them loads.
+func (s *Store) loadPartitions() error {
+	p := s.partitions
+	if index, err := os.ReadFile(filepath.Join(p.dir, partitionIndex)); err == nil {
+		var file partitionIndexFile
+		if err := json.Unmarshal(index, &file); err != nil {
+			return fmt.Errorf("%s: %w", partitionIndex, err)
+		}
+		p.artifactSeq = file.ArtifactSeq
+		s.artifactSeq = max(s.artifactSeq, file.ArtifactSeq)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	entries, err := os.ReadDir(p.dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	var loaded, failed int
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), partitionSuffix) {
+			continue
+		}
+		path := filepath.Join(p.dir, entry.Name())
+		err := s.loadPartition(path)
+		switch {
+		case err == nil:
+			loaded++
+		case errors.Is(err, errPartitionKey):
+			return fmt.Errorf("%s: %w", entry.Name(), err)
+		default:
+			failed++
+			log.Printf("state partitions: load failed (%s): %v", path, err)
+		}
+	}
+	if loaded == 0 && failed > 0 {
+		return fmt.Errorf("none of %d partitions loaded", failed)
+	}
+	return nil
+}
+
+func (s *Store) loadPartition(path string) error {
+	p := s.partitions
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var sealed sealedPartition
+	if err := json.Unmarshal(data, &sealed); err != nil {
+		return err
+	}
+	plain, err := p.open(sealed)
+	if err != nil {
+		return err
+	}
+	if p.path(sealed.UserID) != path {
+		return fmt.Errorf("partition of %s under the wrong name", sealed.UserID)
+	}
+	var part persistedPartition
+	if err := json.Unmarshal(plain, &part); err != nil {
+		return err
+	}
+	if part.UserID != sealed.UserID {
+		return fmt.Errorf("partition of %s holds user %s", sealed.UserID, part.UserID)
+	}
+	userID := part.UserID
+
+	// Decode everything before touching the store, so a partition that
+	// fails part way does not leave half an account behind.
+	sessions := make([]model.Session, 0, len(part.Sessions))
+	owned := make(map[string]bool, len(part.Sessions))
+	for _, sess := range part.Sessions {
+		if sess.ID == "" || sess.UserID != userID {
+			continue
+		}
+		decoded, err := decompressSession(sess)
+		if err != nil {
+			return fmt.Errorf("session %s: %w", sess.ID, err)
+		}
+		sessions = append(sessions, decoded)
+		owned[sess.ID] = true
+	}
+	machines := make([]model.Machine, 0, len(part.Machines))
+	for _, m := range part.Machines {
+		if m.ID == "" || m.UserID != userID {
+			continue
+		}
+		decoded, err := decompressMachine(m)
+		if err != nil {
+			return fmt.Errorf("machine %s: %w", m.ID, err)
+		}
+		machines = append(machines, decoded)
+	}
+
+	s.lockAll()
+	defer s.unlockAll()
+	for _, acc := range part.Accounts {
+		if acc.ID == userID && acc.PublicKey != "" {
+			s.accountsByPublicKey[acc.PublicKey] = acc
+		}
+	}
+	if part.Settings != nil {
+		s.accountSettingsByUserID[userID] = *part.Settings
+	}
+	if part.Disabled {
+		s.disabledAccounts[userID] = true
+	}
+	if part.GitHub != nil {
+		s.githubByUserID[userID] = *part.GitHub
+	}
+	for _, rt := range part.RefreshTokens {
+		if rt.ID != "" && rt.UserID == userID {
+			s.refreshTokens[rt.ID] = rt
+		}
+	}
+	for _, k := range part.APIKeys {
+		if k.ID != "" && k.UserID == userID {
+			s.apiKeys[k.ID] = k
+		}
+	}
+	for _, d := range part.Devices {
+		if d.ID != "" && d.UserID == userID {
+			s.devices[d.ID] = d
+		}
+	}
+	for _, sess := range sessions {
+		s.putSessionLocked(sess)
+	}
+	for _, msg := range part.Messages {
+		if !owned[msg.SessionID] {
+			continue
+		}
+		s.messages.append(msg.SessionID, msg)
+		if msg.Seq > s.seq.perSession[msg.SessionID] {
+			s.seq.perSession[msg.SessionID] = msg.Seq
+		}
+	}
+	for _, m := range machines {
+		s.putMachineLocked(m)
+	}
+	for _, a := range part.Artifacts {
+		if a.ID == "" || a.UserID != userID {
+			continue
+		}
+		s.artifactsByKey[artifactKey(a.UserID, a.ID)] = a
+		s.artifactSeq = max(s.artifactSeq, a.Seq)
+	}
+
+	p.mu.Lock()
+	p.written[userID] = sha256.Sum256(plain)
+	p.mu.Unlock()
+	return nil
+}
+
+// snapshotPartitions groups the state the state files would hold by the
+// account it belongs to.
+func (s *Store) snapshotPartitions() (map[string]*persistedPartition, int64) {
+	parts := make(map[string]*persistedPartition)
+	part := func(userID string) *persistedPartition {
+		p, ok := parts[userID]
+		if !ok {
+			p = &persistedPartition{Version: partitionVersion, UserID: userID}
+			parts[userID] = p
+		}
+		return p
+	}
+
+	s.mu.RLock()
+	for _, acc := range s.accountsByPublicKey {
+		if acc.ID != "" {
+			part(acc.ID).Accounts = append(part(acc.ID).Accounts, acc)
+		}
+	}
+	for userID, st := range s.accountSettingsByUserID {
+		st := st
+		part(userID).Settings = &st
+	}
+	for userID := range s.disabledAccounts {
+		part(userID).Disabled = true
+	}
+	for userID, identity := range s.githubByUserID {
+		identity := identity
+		part(userID).GitHub = &identity
+	}
+	for _, a := range s.artifactsByKey {
+		part(a.UserID).Artifacts = append(part(a.UserID).Artifacts, a)
+	}
+	for _, rt := range s.refreshTokens {
+		part(rt.UserID).RefreshTokens = append(part(rt.UserID).RefreshTokens, rt)
+	}
+	for _, k := range s.apiKeys {
+		part(k.UserID).APIKeys = append(part(k.UserID).APIKeys, k)
+	}
+	for _, d := range s.devices {
+		part(d.UserID).Devices = append(part(d.UserID).Devices, d)
+	}
+	artifactSeq := s.artifactSeq
+	s.mu.RUnlock()
+
+	owners := make(map[string]string)
+	s.eachSession(func(sess model.Session) {
+		owners[sess.ID] = sess.UserID
+		part(sess.UserID).Sessions = append(part(sess.UserID).Sessions, s.compressSession(sess))
+	})
+	s.eachMachine(func(m model.Machine) {
+		part(m.UserID).Machines = append(part(m.UserID).Machines, s.compressMachine(m))
+	})
+	if s.journal == nil {
+		for _, msg := range s.messages.snapshot() {
+			if userID, ok := owners[msg.SessionID]; ok {
+				part(userID).Messages = append(part(userID).Messages, msg)
+			}
+		}
+	}
+
+	for _, p := range parts {
+		sort.Slice(p.Accounts, func(i, j int) bool { return p.Accounts[i].PublicKey < p.Accounts[j].PublicKey })
+		sort.Slice(p.Sessions, func(i, j int) bool { return p.Sessions[i].ID < p.Sessions[j].ID })
+		sort.Slice(p.Machines, func(i, j int) bool { return p.Machines[i].ID < p.Machines[j].ID })
+		sort.Slice(p.Artifacts, func(i, j int) bool { return p.Artifacts[i].ID < p.Artifacts[j].ID })
+		sortRefreshTokens(p.RefreshTokens)
+		sortAPIKeys(p.APIKeys)
+		sortDevices(p.Devices)
+	}
+	return parts, artifactSeq
+}
+
+// savePartitions stands in for every state file save when the store keeps
+// partitions. It writes the partitions that changed since they were last
+// written and removes those of accounts left with nothing, holding
+// partitions.mu so the last writer always writes the newest state.
+func (s *Store) savePartitions() {
+	p := s.partitions
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	parts, artifactSeq := s.snapshotPartitions()
+	var errs []error
+	for userID, part := range parts {
+		plain, err := json.Marshal(part)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: marshal failed: %w", userID, err))
+			continue
+		}
+		sum := sha256.Sum256(plain)
+		if written, ok := p.written[userID]; ok && written == sum {
+			continue
+		}
+		sealed, err := p.seal(userID, plain)
+		if err == nil {
+			err = writeStateFile(p.path(userID), sealed)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", userID, err))
+			continue
+		}
+		p.written[userID] = sum
+	}
+	for userID := range p.written {
+		if _, ok := parts[userID]; ok {
+			continue
+		}
+		if err := os.Remove(p.path(userID)); err != nil && !os.IsNotExist(err) {
+			errs = append(errs, fmt.Errorf("%s: %w", userID, err))
+			continue
+		}
+		delete(p.written, userID)
+	}
+	if artifactSeq != p.artifactSeq {
+		file := partitionIndexFile{Version: partitionVersion, ArtifactSeq: artifactSeq, SavedAt: time.Now().UnixMilli()}
+		if err := writeStateFile(filepath.Join(p.dir, partitionIndex), file); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", partitionIndex, err))
+		} else {
+			p.artifactSeq = artifactSeq
+		}
+	}
+	if err := s.persistStats.partitions.record(errors.Join(errs...)); err != nil {
+		log.Printf("state partitions: %v", err)
+	}
+}
@@ -0,0 +1,131 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"happy-server-lite/internal/model"
+)
+
+func TestStore_StatePartitions_RoundTrip(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	opts := Options{StatePartitionDir: dir, StatePartitionKey: []byte("partition-key")}
+
+	s1 := NewWithOptions(opts)
+	acc, _ := s1.GetOrCreateAccount(ctx, "pk1", 1000)
+	s1.UpdateAccountSettings(ctx, acc.ID, 0, "settings", 1000)
+	sess, _, _ := s1.GetOrCreateSession(ctx, acc.ID, "tag", "secret-metadata", nil, nil, 1000)
+	s1.AppendMessageFrom(ctx, OriginREST, acc.ID, sess.ID, "m1", "", 1000)
+	s1.UpsertMachine(ctx, acc.ID, "m1", "meta", nil, nil, 1000)
+	if _, _, err := s1.CreateArtifact(ctx, acc.ID, "a1", "h", "b", "k", 1000); err != nil {
+		t.Fatalf("CreateArtifact: %v", err)
+	}
+	s1.UpsertMachine(ctx, "user-2", "m2", "meta", nil, nil, 1000)
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*"+partitionSuffix))
+	if len(files) != 2 {
+		t.Fatalf("expected a partition per account, got %v", files)
+	}
+	for _, f := range files {
+		data, _ := os.ReadFile(f)
+		if bytes.Contains(data, []byte("secret-metadata")) || bytes.Contains(data, []byte("pk1")) {
+			t.Fatalf("partition %s holds plaintext", f)
+		}
+	}
+
+	s2 := NewWithOptions(opts)
+	requireSameRecords(t, s1, s2)
+	if next, err := s2.AppendMessageFrom(ctx, OriginREST, acc.ID, sess.ID, "m2", "", 2000); err != nil || next.Seq != 2 {
+		t.Fatalf("expected messages to continue at seq 2, got %+v %v", next, err)
+	}
+
+	// Only the partition that changed is rewritten, and one left empty is
+	// removed.
+	untouched := s2.partitions.path(acc.ID)
+	before, _ := os.ReadFile(untouched)
+	s2.DeleteMachine(ctx, "user-2", "m2", 2000)
+	if after, _ := os.ReadFile(untouched); !bytes.Equal(before, after) {
+		t.Fatal("expected the untouched partition to be left alone")
+	}
+	if _, err := os.Stat(s2.partitions.path("user-2")); !os.IsNotExist(err) {
+		t.Fatalf("expected the emptied partition to be removed, got %v", err)
+	}
+
+	if _, err := Open(Options{StatePartitionDir: dir, StatePartitionKey: []byte("other-key")}); !errors.Is(err, errPartitionKey) {
+		t.Fatalf("expected the wrong key to fail the load, got %v", err)
+	}
+}
+
+func TestStatePartitions_RejectsSwappedFiles(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	opts := Options{StatePartitionDir: dir, StatePartitionKey: []byte("partition-key")}
+	s := NewWithOptions(opts)
+	a, _ := s.GetOrCreateAccount(ctx, "pk1", 1000)
+	b, _ := s.GetOrCreateAccount(ctx, "pk2", 1000)
+
+	// A partition copied over another account's is not loaded as that
+	// account's.
+	data, _ := os.ReadFile(s.partitions.path(a.ID))
+	if err := os.WriteFile(s.partitions.path(b.ID), data, 0o600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	reloaded := NewWithOptions(opts)
+	if _, ok := reloaded.accountsByPublicKey["pk2"]; ok {
+		t.Fatal("expected the swapped partition to be rejected")
+	}
+	if _, ok := reloaded.accountsByPublicKey["pk1"]; !ok {
+		t.Fatal("expected the intact partition to load")
+	}
+}
+
+func TestStatePartitions_SkipsBrokenPartitionsWhole(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	opts := Options{StatePartitionDir: dir, StatePartitionKey: []byte("partition-key")}
+	s := NewWithOptions(opts)
+	s.GetOrCreateAccount(ctx, "pk1", 1000)
+
+	// A partition whose second session does not decompress.
+	broken := persistedPartition{
+		Version:  partitionVersion,
+		UserID:   "user-2",
+		Accounts: []model.Account{{ID: "user-2", PublicKey: "pk2"}},
+		Sessions: []model.Session{
+			{ID: "s1", UserID: "user-2", Metadata: "meta"},
+			{ID: "s2", UserID: "user-2", Metadata: compressedPrefix + "gzip\x00!!!"},
+		},
+	}
+	plain, _ := json.Marshal(broken)
+	sealed, err := s.partitions.seal("user-2", plain)
+	if err != nil {
+		t.Fatalf("seal: %v", err)
+	}
+	if err := writeStateFile(s.partitions.path("user-2"), sealed); err != nil {
+		t.Fatalf("writeStateFile: %v", err)
+	}
+
+	reloaded, err := Open(opts)
+	if err != nil {
+		t.Fatalf("expected the intact partition to load, got %v", err)
+	}
+	if _, ok := reloaded.accountsByPublicKey["pk2"]; ok {
+		t.Fatal("expected nothing of the broken partition to load")
+	}
+	if _, ok := reloaded.GetSession(ctx, "user-2", "s1"); ok {
+		t.Fatal("expected the broken partition's valid session not to load")
+	}
+
+	if err := os.Remove(s.partitions.path(s.accountsByPublicKey["pk1"].ID)); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	if _, err := Open(opts); err == nil {
+		t.Fatal("expected the load to fail when no partition loads")
+	}
+}
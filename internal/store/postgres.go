@@ -0,0 +1,1327 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"happy-server-lite/internal/clock"
+	"happy-server-lite/internal/ids"
+	"happy-server-lite/internal/model"
+)
+
+// PostgresStore is a Storage kept entirely in PostgreSQL, so several server
+// instances can share one database. Events are only delivered to subscribers
+// of the instance that made the change; clients connected elsewhere pick the
+// change up on their next fetch or sync.
+//
+// The database/sql driver is linked by building with -tags postgres (see
+// pkg/happyserver).
+type PostgresStore struct {
+	eventBus
+
+	db                 *sql.DB
+	limits             Limits
+	tombstoneRetention time.Duration
+	authRequestTTL     time.Duration
+
+	messageRetention      time.Duration
+	maxMessagesPerSession int
+	purgeGrace            time.Duration
+
+	newID ids.Generator
+	clock clock.Clock
+}
+
+var _ Storage = (*PostgresStore)(nil)
+
+var postgresSchema = []string{
+	`CREATE TABLE IF NOT EXISTS accounts (
+		public_key TEXT PRIMARY KEY,
+		id         TEXT NOT NULL UNIQUE,
+		created_at BIGINT NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS disabled_accounts (
+		user_id TEXT PRIMARY KEY
+	)`,
+	`CREATE TABLE IF NOT EXISTS auth_requests (
+		public_key          TEXT PRIMARY KEY,
+		id                  TEXT NOT NULL,
+		supports_v2         BOOLEAN NOT NULL,
+		response            TEXT NOT NULL DEFAULT '',
+		response_account_id TEXT NOT NULL DEFAULT '',
+		token               TEXT NOT NULL DEFAULT '',
+		rejected            BOOLEAN NOT NULL DEFAULT FALSE,
+		device              TEXT,
+		created_at          BIGINT NOT NULL,
+		updated_at          BIGINT NOT NULL
+	)`,
+	`ALTER TABLE auth_requests ADD COLUMN IF NOT EXISTS device TEXT`,
+	`ALTER TABLE auth_requests ADD COLUMN IF NOT EXISTS rejected BOOLEAN NOT NULL DEFAULT FALSE`,
+	`CREATE TABLE IF NOT EXISTS account_settings (
+		user_id  TEXT PRIMARY KEY,
+		settings TEXT,
+		version  INTEGER NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS sessions (
+		id                  TEXT PRIMARY KEY,
+		user_id             TEXT NOT NULL,
+		tag                 TEXT NOT NULL,
+		metadata            TEXT NOT NULL,
+		metadata_version    INTEGER NOT NULL,
+		agent_state         TEXT,
+		agent_state_version INTEGER NOT NULL,
+		data_encryption_key TEXT,
+		active              BOOLEAN NOT NULL DEFAULT FALSE,
+		active_at           BIGINT NOT NULL DEFAULT 0,
+		created_at          BIGINT NOT NULL,
+		updated_at          BIGINT NOT NULL,
+		deleted             BOOLEAN NOT NULL DEFAULT FALSE,
+		last_message_seq    BIGINT NOT NULL DEFAULT 0
+	)`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS sessions_user_tag ON sessions (user_id, tag) WHERE NOT deleted`,
+	`CREATE TABLE IF NOT EXISTS messages (
+		session_id TEXT NOT NULL,
+		seq        BIGINT NOT NULL,
+		id         TEXT NOT NULL,
+		content    TEXT NOT NULL,
+		checksum   TEXT NOT NULL DEFAULT '',
+		local_id   TEXT,
+		deleted    BOOLEAN NOT NULL DEFAULT FALSE,
+		created_at BIGINT NOT NULL,
+		updated_at BIGINT NOT NULL,
+		PRIMARY KEY (session_id, seq)
+	)`,
+	`ALTER TABLE messages ADD COLUMN IF NOT EXISTS local_id TEXT`,
+	`ALTER TABLE messages ADD COLUMN IF NOT EXISTS deleted BOOLEAN NOT NULL DEFAULT FALSE`,
+	`ALTER TABLE messages ADD COLUMN IF NOT EXISTS annotations TEXT NOT NULL DEFAULT ''`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS messages_session_local_id ON messages (session_id, local_id) WHERE local_id IS NOT NULL`,
+	`CREATE TABLE IF NOT EXISTS machines (
+		id                   TEXT NOT NULL,
+		user_id              TEXT NOT NULL,
+		metadata             TEXT NOT NULL,
+		metadata_version     INTEGER NOT NULL,
+		daemon_state         TEXT,
+		daemon_state_version INTEGER NOT NULL,
+		data_encryption_key  TEXT,
+		created_at           BIGINT NOT NULL,
+		updated_at           BIGINT NOT NULL,
+		PRIMARY KEY (user_id, id)
+	)`,
+	// Machine ids were once unique across users.
+	primaryKeyMigration("machines", 1, "user_id, id"),
+	`CREATE SEQUENCE IF NOT EXISTS artifact_seq`,
+	`CREATE TABLE IF NOT EXISTS artifacts (
+		user_id             TEXT NOT NULL,
+		id                  TEXT NOT NULL,
+		header              TEXT NOT NULL,
+		header_version      INTEGER NOT NULL,
+		body                TEXT NOT NULL,
+		body_version        INTEGER NOT NULL,
+		data_encryption_key TEXT NOT NULL,
+		header_checksum     TEXT NOT NULL DEFAULT '',
+		body_checksum       TEXT NOT NULL DEFAULT '',
+		seq                 BIGINT NOT NULL,
+		created_at          BIGINT NOT NULL,
+		updated_at          BIGINT NOT NULL,
+		deleted             BOOLEAN NOT NULL DEFAULT FALSE,
+		PRIMARY KEY (user_id, id)
+	)`,
+	`CREATE TABLE IF NOT EXISTS tombstones (
+		kind       TEXT NOT NULL,
+		id         TEXT NOT NULL,
+		user_id    TEXT NOT NULL,
+		deleted_at BIGINT NOT NULL,
+		PRIMARY KEY (kind, user_id, id)
+	)`,
+	primaryKeyMigration("tombstones", 2, "kind, user_id, id"),
+	`CREATE TABLE IF NOT EXISTS auth_challenges (
+		nonce      TEXT PRIMARY KEY,
+		expires_at BIGINT NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS session_locks (
+		session_id  TEXT NOT NULL,
+		name        TEXT NOT NULL,
+		holder      TEXT NOT NULL,
+		token       TEXT NOT NULL,
+		acquired_at BIGINT NOT NULL,
+		expires_at  BIGINT NOT NULL,
+		PRIMARY KEY (session_id, name)
+	)`,
+	`CREATE TABLE IF NOT EXISTS push_tokens (
+		user_id    TEXT NOT NULL,
+		token      TEXT NOT NULL,
+		created_at BIGINT NOT NULL,
+		updated_at BIGINT NOT NULL,
+		PRIMARY KEY (user_id, token)
+	)`,
+	`ALTER TABLE push_tokens ADD COLUMN IF NOT EXISTS locale TEXT NOT NULL DEFAULT ''`,
+	`CREATE TABLE IF NOT EXISTS refresh_tokens (
+		id            TEXT PRIMARY KEY,
+		user_id       TEXT NOT NULL,
+		device        TEXT,
+		secret_hash   TEXT NOT NULL,
+		previous_hash TEXT NOT NULL DEFAULT '',
+		created_at    BIGINT NOT NULL,
+		last_used_at  BIGINT NOT NULL,
+		expires_at    BIGINT NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS refresh_tokens_user_id ON refresh_tokens (user_id)`,
+	`ALTER TABLE refresh_tokens ADD COLUMN IF NOT EXISTS device_id TEXT NOT NULL DEFAULT ''`,
+	`CREATE TABLE IF NOT EXISTS api_keys (
+		id           TEXT PRIMARY KEY,
+		user_id      TEXT NOT NULL,
+		name         TEXT NOT NULL,
+		secret_hash  TEXT NOT NULL,
+		created_at   BIGINT NOT NULL,
+		last_used_at BIGINT NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS api_keys_user_id ON api_keys (user_id)`,
+	`CREATE TABLE IF NOT EXISTS devices (
+		id           TEXT PRIMARY KEY,
+		user_id      TEXT NOT NULL,
+		device       TEXT,
+		created_at   BIGINT NOT NULL,
+		last_seen_at BIGINT NOT NULL,
+		last_seen_ip TEXT NOT NULL DEFAULT '',
+		expires_at   BIGINT NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS devices_user_id ON devices (user_id)`,
+	`CREATE TABLE IF NOT EXISTS github_identities (
+		user_id    TEXT PRIMARY KEY,
+		github_id  BIGINT NOT NULL,
+		login      TEXT NOT NULL,
+		name       TEXT NOT NULL DEFAULT '',
+		avatar_url TEXT NOT NULL DEFAULT '',
+		linked_at  BIGINT NOT NULL
+	)`,
+}
+
+// primaryKeyMigration replaces table's primary key of oldColumns columns by
+// one on columns, and does nothing once that has happened.
+func primaryKeyMigration(table string, oldColumns int, columns string) string {
+	return fmt.Sprintf(`DO $$ BEGIN
+		IF EXISTS (SELECT 1 FROM pg_index WHERE indrelid = '%[1]s'::regclass AND indisprimary AND indnatts = %[2]d) THEN
+			ALTER TABLE %[1]s DROP CONSTRAINT %[1]s_pkey;
+			ALTER TABLE %[1]s ADD PRIMARY KEY (%[3]s);
+		END IF;
+	END $$`, table, oldColumns, columns)
+}
+
+// OpenPostgres connects with driverName and dsn and creates the schema if
+// needed. The state file options and Options.Backend are ignored.
+func OpenPostgres(driverName, dsn string, opts Options) (*PostgresStore, error) {
+	db, err := sql.Open(driverName, dsn)
+	if err != nil {
+		return nil, err
+	}
+	for _, stmt := range postgresSchema {
+		if _, err := db.Exec(stmt); err != nil {
+			_ = db.Close()
+			return nil, fmt.Errorf("create schema: %w", err)
+		}
+	}
+	p := &PostgresStore{
+		db:                 db,
+		limits:             opts.Limits.withDefaults(),
+		tombstoneRetention: opts.TombstoneRetention,
+		authRequestTTL:     opts.AuthRequestTTL,
+
+		messageRetention:      opts.MessageRetention,
+		maxMessagesPerSession: opts.MaxMessagesPerSession,
+		purgeGrace:            opts.PurgeGrace,
+		newID:                 opts.idGenerator(),
+		clock:                 opts.Clock,
+	}
+	if p.tombstoneRetention <= 0 {
+		p.tombstoneRetention = defaultTombstoneRetention
+	}
+	return p, nil
+}
+
+func (p *PostgresStore) Close() error {
+	return p.db.Close()
+}
+
+// logError logs a failed operation. Operations cut short because the caller
+// went away are not worth a line.
+func (p *PostgresStore) logError(op string, err error) {
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+	log.Printf("postgres store: %s: %v", op, err)
+}
+
+func (p *PostgresStore) withTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+// Accounts and auth requests.
+
+func (p *PostgresStore) GetOrCreateAccount(ctx context.Context, publicKey string, nowMillis int64) (model.Account, bool) {
+	acc := model.Account{ID: p.newID(), PublicKey: publicKey, CreatedAt: nowMillis}
+	res, err := p.db.ExecContext(ctx, `INSERT INTO accounts (public_key, id, created_at) VALUES ($1, $2, $3)
+		ON CONFLICT (public_key) DO NOTHING`, acc.PublicKey, acc.ID, acc.CreatedAt)
+	if err != nil {
+		p.logError("create account", err)
+		return model.Account{}, false
+	}
+	if n, _ := res.RowsAffected(); n == 1 {
+		return acc, true
+	}
+	existing := model.Account{PublicKey: publicKey}
+	err = p.db.QueryRowContext(ctx, `SELECT id, created_at FROM accounts WHERE public_key = $1`, publicKey).Scan(&existing.ID, &existing.CreatedAt)
+	if err != nil {
+		p.logError("get account", err)
+		return model.Account{}, false
+	}
+	return existing, false
+}
+
+func (p *PostgresStore) GetAccount(ctx context.Context, publicKey string) (model.Account, bool) {
+	acc := model.Account{PublicKey: publicKey}
+	err := p.db.QueryRowContext(ctx, `SELECT id, created_at FROM accounts WHERE public_key = $1`, publicKey).Scan(&acc.ID, &acc.CreatedAt)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			p.logError("get account", err)
+		}
+		return model.Account{}, false
+	}
+	return acc, true
+}
+
+func (p *PostgresStore) SetAccountDisabled(ctx context.Context, userID string, disabled bool) bool {
+	var res sql.Result
+	var err error
+	if disabled {
+		res, err = p.db.ExecContext(ctx, `INSERT INTO disabled_accounts (user_id) VALUES ($1) ON CONFLICT DO NOTHING`, userID)
+	} else {
+		res, err = p.db.ExecContext(ctx, `DELETE FROM disabled_accounts WHERE user_id = $1`, userID)
+	}
+	if err != nil {
+		p.logError("set account disabled", err)
+		return false
+	}
+	n, _ := res.RowsAffected()
+	return n > 0
+}
+
+func (p *PostgresStore) IsAccountDisabled(ctx context.Context, userID string) bool {
+	var one int
+	err := p.db.QueryRowContext(ctx, `SELECT 1 FROM disabled_accounts WHERE user_id = $1`, userID).Scan(&one)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		p.logError("is account disabled", err)
+	}
+	return err == nil
+}
+
+const authRequestColumns = `id, public_key, supports_v2, response, response_account_id, token, rejected, device, created_at, updated_at`
+
+func scanAuthRequest(row rowScanner) (model.AuthRequest, error) {
+	var req model.AuthRequest
+	var device *string
+	err := row.Scan(&req.ID, &req.PublicKey, &req.SupportsV2, &req.Response, &req.ResponseAccountID, &req.Token, &req.Rejected, &device, &req.CreatedAt, &req.UpdatedAt)
+	if err == nil && device != nil {
+		req.Device = &model.AuthRequestDevice{}
+		err = json.Unmarshal([]byte(*device), req.Device)
+	}
+	return req, err
+}
+
+// authRequestDeviceJSON encodes device for the device column, NULL when nil.
+func authRequestDeviceJSON(device *model.AuthRequestDevice) *string {
+	if device == nil {
+		return nil
+	}
+	data, _ := json.Marshal(device)
+	s := string(data)
+	return &s
+}
+
+func (p *PostgresStore) GetAuthRequest(ctx context.Context, publicKey string) (model.AuthRequest, bool) {
+	req, err := scanAuthRequest(p.db.QueryRowContext(ctx, `SELECT `+authRequestColumns+` FROM auth_requests WHERE public_key = $1`, publicKey))
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			p.logError("get auth request", err)
+		}
+		return model.AuthRequest{}, false
+	}
+	return req, true
+}
+
+func (p *PostgresStore) UpsertAuthRequest(ctx context.Context, publicKey string, supportsV2 bool, device *model.AuthRequestDevice, nowMillis int64) model.AuthRequest {
+	id := p.newID()
+	req, err := scanAuthRequest(p.db.QueryRowContext(ctx, `INSERT INTO auth_requests (id, public_key, supports_v2, device, created_at, updated_at)
+		VALUES ($1, $2, $3, $5, $4, $4)
+		ON CONFLICT (public_key) DO UPDATE SET
+			supports_v2 = auth_requests.supports_v2 OR EXCLUDED.supports_v2,
+			device = COALESCE(EXCLUDED.device, auth_requests.device),
+			updated_at = EXCLUDED.updated_at
+		RETURNING `+authRequestColumns, id, publicKey, supportsV2, nowMillis, authRequestDeviceJSON(device)))
+	if err != nil {
+		p.logError("upsert auth request", err)
+		return model.AuthRequest{}
+	}
+	// A conflict keeps the existing row's id.
+	if req.ID == id {
+		p.publish(Event{Type: EventAuthRequested, PublicKey: publicKey, At: nowMillis})
+	}
+	return req
+}
+
+func (p *PostgresStore) AuthorizeAuthRequest(ctx context.Context, publicKey, response, responseAccountID, token string, nowMillis int64) (model.AuthRequest, bool) {
+	req, err := scanAuthRequest(p.db.QueryRowContext(ctx, `UPDATE auth_requests
+		SET response = $2, response_account_id = $3, token = $4, rejected = FALSE, updated_at = $5
+		WHERE public_key = $1
+		RETURNING `+authRequestColumns, publicKey, response, responseAccountID, token, nowMillis))
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			p.logError("authorize auth request", err)
+		}
+		return model.AuthRequest{}, false
+	}
+	return req, true
+}
+
+func (p *PostgresStore) RejectAuthRequest(ctx context.Context, publicKey string, nowMillis int64) (model.AuthRequest, bool) {
+	req, err := scanAuthRequest(p.db.QueryRowContext(ctx, `UPDATE auth_requests
+		SET rejected = TRUE, updated_at = $2
+		WHERE public_key = $1 AND token = '' AND NOT rejected
+		RETURNING `+authRequestColumns, publicKey, nowMillis))
+	if errors.Is(err, sql.ErrNoRows) {
+		// Already decided, or no such request.
+		return p.GetAuthRequest(ctx, publicKey)
+	}
+	if err != nil {
+		p.logError("reject auth request", err)
+		return model.AuthRequest{}, false
+	}
+	return req, true
+}
+
+// Account settings.
+
+func (p *PostgresStore) GetAccountSettings(ctx context.Context, userID string) (*string, int) {
+	var settings *string
+	var version int
+	err := p.db.QueryRowContext(ctx, `SELECT settings, version FROM account_settings WHERE user_id = $1`, userID).Scan(&settings, &version)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			p.logError("get settings", err)
+		}
+		return nil, 0
+	}
+	return settings, version
+}
+
+func (p *PostgresStore) UpdateAccountSettings(ctx context.Context, userID string, expectedVersion int, settings string, nowMillis int64) (status string, currentVersion int, currentSettings *string) {
+	if userID == "" {
+		return "error", 0, nil
+	}
+	if checkSize("settings", settings, p.limits.MaxSettingsBytes) != nil {
+		current, version := p.GetAccountSettings(ctx, userID)
+		return "too-large", version, current
+	}
+
+	var err error
+	var version int
+	if expectedVersion == 0 {
+		err = p.db.QueryRowContext(ctx, `INSERT INTO account_settings (user_id, settings, version) VALUES ($1, $2, 1)
+			ON CONFLICT (user_id) DO NOTHING RETURNING version`, userID, settings).Scan(&version)
+	} else {
+		err = p.db.QueryRowContext(ctx, `UPDATE account_settings SET settings = $2, version = version + 1
+			WHERE user_id = $1 AND version = $3 RETURNING version`, userID, settings, expectedVersion).Scan(&version)
+	}
+	if err == nil {
+		return "success", version, &settings
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		p.logError("update settings", err)
+		return "error", 0, nil
+	}
+	current, version := p.GetAccountSettings(ctx, userID)
+	return "version-mismatch", version, current
+}
+
+func (p *PostgresStore) AddPushToken(ctx context.Context, userID, token, locale string, nowMillis int64) model.PushToken {
+	pt := model.PushToken{UserID: userID, Token: token, Locale: locale, UpdatedAt: nowMillis}
+	err := p.db.QueryRowContext(ctx, `INSERT INTO push_tokens (user_id, token, locale, created_at, updated_at) VALUES ($1, $2, $3, $4, $4)
+		ON CONFLICT (user_id, token) DO UPDATE SET locale = excluded.locale, updated_at = excluded.updated_at
+		RETURNING created_at`, userID, token, locale, nowMillis).Scan(&pt.CreatedAt)
+	if err != nil {
+		p.logError("add push token", err)
+		pt.CreatedAt = nowMillis
+	}
+	return pt
+}
+
+func (p *PostgresStore) ListPushTokens(ctx context.Context, userID string) []model.PushToken {
+	rows, err := p.db.QueryContext(ctx, `SELECT token, locale, created_at, updated_at FROM push_tokens
+		WHERE user_id = $1 ORDER BY created_at, token`, userID)
+	if err != nil {
+		p.logError("list push tokens", err)
+		return []model.PushToken{}
+	}
+	defer rows.Close()
+
+	result := make([]model.PushToken, 0)
+	for rows.Next() {
+		pt := model.PushToken{UserID: userID}
+		if err := rows.Scan(&pt.Token, &pt.Locale, &pt.CreatedAt, &pt.UpdatedAt); err != nil {
+			p.logError("scan push token", err)
+			break
+		}
+		result = append(result, pt)
+	}
+	return result
+}
+
+func (p *PostgresStore) DeletePushToken(ctx context.Context, userID, token string) bool {
+	res, err := p.db.ExecContext(ctx, `DELETE FROM push_tokens WHERE user_id = $1 AND token = $2`, userID, token)
+	if err != nil {
+		p.logError("delete push token", err)
+		return false
+	}
+	n, _ := res.RowsAffected()
+	return n > 0
+}
+
+// Sessions.
+
+const sessionColumns = `id, user_id, tag, metadata, metadata_version, agent_state, agent_state_version,
+	data_encryption_key, active, active_at, created_at, updated_at, deleted, last_message_seq`
+
+func scanSession(row rowScanner) (model.Session, error) {
+	var sess model.Session
+	err := row.Scan(&sess.ID, &sess.UserID, &sess.Tag, &sess.Metadata, &sess.MetadataVersion, &sess.AgentState,
+		&sess.AgentStateVersion, &sess.DataEncryptionKey, &sess.Active, &sess.ActiveAt, &sess.CreatedAt,
+		&sess.UpdatedAt, &sess.Deleted, &sess.Seq)
+	return sess, err
+}
+
+func (p *PostgresStore) GetOrCreateSession(ctx context.Context, userID, tag, metadata string, agentState *string, dataEncryptionKey *string, nowMillis int64) (model.Session, bool, error) {
+	if userID == "" {
+		return model.Session{}, false, errors.New("missing userID")
+	}
+	if tag == "" {
+		return model.Session{}, false, errors.New("missing tag")
+	}
+	if err := checkSize("metadata", metadata, p.limits.MaxMetadataBytes); err != nil {
+		return model.Session{}, false, err
+	}
+	if err := checkOptionalSize("agentState", agentState, p.limits.MaxAgentStateBytes); err != nil {
+		return model.Session{}, false, err
+	}
+
+	// A concurrent create of the same tag makes the insert a no-op; the second
+	// pass then finds and updates that session.
+	for attempt := 0; attempt < 2; attempt++ {
+		var sess model.Session
+		var found, created bool
+		err := p.withTx(ctx, func(tx *sql.Tx) error {
+			existing, err := scanSession(tx.QueryRowContext(ctx, `SELECT `+sessionColumns+` FROM sessions
+				WHERE user_id = $1 AND tag = $2 AND NOT deleted FOR UPDATE`, userID, tag))
+			if err == nil {
+				found = true
+				sess = existing
+				changed := false
+				if metadata != "" && metadata != sess.Metadata {
+					sess.Metadata = metadata
+					sess.MetadataVersion++
+					changed = true
+				}
+				if agentState != nil {
+					if sess.AgentState == nil || *sess.AgentState != *agentState {
+						sess.AgentState = agentState
+						sess.AgentStateVersion++
+						changed = true
+					}
+				}
+				if dataEncryptionKey != nil {
+					sess.DataEncryptionKey = dataEncryptionKey
+					changed = true
+				}
+				if !changed {
+					return nil
+				}
+				sess.UpdatedAt = nowMillis
+				_, err := tx.ExecContext(ctx, `UPDATE sessions SET metadata = $2, metadata_version = $3, agent_state = $4,
+					agent_state_version = $5, data_encryption_key = $6, updated_at = $7 WHERE id = $1`,
+					sess.ID, sess.Metadata, sess.MetadataVersion, sess.AgentState, sess.AgentStateVersion,
+					sess.DataEncryptionKey, sess.UpdatedAt)
+				return err
+			}
+			if !errors.Is(err, sql.ErrNoRows) {
+				return err
+			}
+
+			sess = model.Session{
+				ID:                p.newID(),
+				UserID:            userID,
+				Tag:               tag,
+				Metadata:          metadata,
+				AgentState:        agentState,
+				DataEncryptionKey: dataEncryptionKey,
+				CreatedAt:         nowMillis,
+				UpdatedAt:         nowMillis,
+			}
+			if metadata != "" {
+				sess.MetadataVersion = 1
+			}
+			if agentState != nil {
+				sess.AgentStateVersion = 1
+			}
+			res, err := tx.ExecContext(ctx, `INSERT INTO sessions (id, user_id, tag, metadata, metadata_version, agent_state,
+				agent_state_version, data_encryption_key, created_at, updated_at)
+				VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $9)
+				ON CONFLICT (user_id, tag) WHERE NOT deleted DO NOTHING`,
+				sess.ID, sess.UserID, sess.Tag, sess.Metadata, sess.MetadataVersion, sess.AgentState,
+				sess.AgentStateVersion, sess.DataEncryptionKey, nowMillis)
+			if err != nil {
+				return err
+			}
+			n, _ := res.RowsAffected()
+			created = n == 1
+			return nil
+		})
+		if err != nil {
+			p.logError("get or create session", err)
+			return model.Session{}, false, err
+		}
+		if found || created {
+			return sess, created, nil
+		}
+	}
+	return model.Session{}, false, errors.New("session create conflict")
+}
+
+func (p *PostgresStore) ListSessions(ctx context.Context, userID string) []model.Session {
+	rows, err := p.db.QueryContext(ctx, `SELECT `+sessionColumns+` FROM sessions
+		WHERE user_id = $1 AND NOT deleted ORDER BY updated_at DESC`, userID)
+	if err != nil {
+		p.logError("list sessions", err)
+		return []model.Session{}
+	}
+	defer rows.Close()
+
+	result := make([]model.Session, 0)
+	for rows.Next() {
+		sess, err := scanSession(rows)
+		if err != nil {
+			p.logError("scan session", err)
+			break
+		}
+		result = append(result, sess)
+	}
+	return result
+}
+
+func (p *PostgresStore) GetSession(ctx context.Context, userID, sessionID string) (model.Session, bool) {
+	sess, err := scanSession(p.db.QueryRowContext(ctx, `SELECT `+sessionColumns+` FROM sessions
+		WHERE id = $1 AND user_id = $2 AND NOT deleted`, sessionID, userID))
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			p.logError("get session", err)
+		}
+		return model.Session{}, false
+	}
+	return sess, true
+}
+
+// GetSessionByTag is served by the sessions_user_tag index.
+func (p *PostgresStore) GetSessionByTag(ctx context.Context, userID, tag string) (model.Session, bool) {
+	sess, err := scanSession(p.db.QueryRowContext(ctx, `SELECT `+sessionColumns+` FROM sessions
+		WHERE user_id = $1 AND tag = $2 AND NOT deleted`, userID, tag))
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			p.logError("get session by tag", err)
+		}
+		return model.Session{}, false
+	}
+	return sess, true
+}
+
+// versionedColumn names a value guarded by an optimistic version counter.
+type versionedColumn struct {
+	table   string
+	column  string
+	version string
+	// match selects the row from $1 (id) and $2 (user id).
+	match string
+}
+
+var (
+	sessionMetadataColumn   = versionedColumn{"sessions", "metadata", "metadata_version", "id = $1 AND user_id = $2 AND NOT deleted"}
+	sessionAgentStateColumn = versionedColumn{"sessions", "agent_state", "agent_state_version", "id = $1 AND user_id = $2 AND NOT deleted"}
+	machineMetadataColumn   = versionedColumn{"machines", "metadata", "metadata_version", "id = $1 AND user_id = $2"}
+	machineDaemonColumn     = versionedColumn{"machines", "daemon_state", "daemon_state_version", "id = $1 AND user_id = $2"}
+)
+
+// versionedUpdate writes value if the row's version still equals expected,
+// reporting statuses in the same order as the in-memory store: not-found,
+// version-mismatch, then too-large.
+func (p *PostgresStore) versionedUpdate(ctx context.Context, col versionedColumn, id, userID string, expected int, value *string, tooLarge bool, nowMillis int64) (string, int, *string) {
+	readCurrent := func() (string, int, *string) {
+		var version int
+		var current *string
+		err := p.db.QueryRowContext(ctx, fmt.Sprintf(`SELECT %s, %s FROM %s WHERE %s`, col.version, col.column, col.table, col.match), id, userID).Scan(&version, &current)
+		if errors.Is(err, sql.ErrNoRows) {
+			return "not-found", 0, nil
+		}
+		if err != nil {
+			p.logError("read "+col.table+"."+col.column, err)
+			return "error", 0, nil
+		}
+		if version != expected {
+			return "version-mismatch", version, current
+		}
+		return "", version, current
+	}
+
+	if tooLarge {
+		status, version, current := readCurrent()
+		if status == "" {
+			status = "too-large"
+		}
+		return status, version, current
+	}
+
+	var version int
+	err := p.db.QueryRowContext(ctx, fmt.Sprintf(`UPDATE %s SET %s = $3, %s = %s + 1, updated_at = $4
+		WHERE %s AND %s = $5 RETURNING %s`, col.table, col.column, col.version, col.version, col.match, col.version, col.version),
+		id, userID, value, nowMillis, expected).Scan(&version)
+	if err == nil {
+		return "success", version, value
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		p.logError("update "+col.table+"."+col.column, err)
+		return "error", 0, nil
+	}
+	status, version, current := readCurrent()
+	if status == "" {
+		status = "version-mismatch"
+	}
+	return status, version, current
+}
+
+func derefString(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+func (p *PostgresStore) UpdateSessionMetadata(ctx context.Context, userID, sessionID string, expectedVersion int, metadata string, nowMillis int64) (status string, version int, currentValue string) {
+	tooLarge := checkSize("metadata", metadata, p.limits.MaxMetadataBytes) != nil
+	status, version, current := p.versionedUpdate(ctx, sessionMetadataColumn, sessionID, userID, expectedVersion, &metadata, tooLarge, nowMillis)
+	return status, version, derefString(current)
+}
+
+func (p *PostgresStore) UpdateSessionAgentState(ctx context.Context, userID, sessionID string, expectedVersion int, agentState *string, nowMillis int64) (status string, version int, currentValue *string) {
+	tooLarge := checkOptionalSize("agentState", agentState, p.limits.MaxAgentStateBytes) != nil
+	return p.versionedUpdate(ctx, sessionAgentStateColumn, sessionID, userID, expectedVersion, agentState, tooLarge, nowMillis)
+}
+
+func (p *PostgresStore) SetSessionActive(ctx context.Context, userID, sessionID string, active bool, activeAt int64, nowMillis int64) bool {
+	res, err := p.db.ExecContext(ctx, `UPDATE sessions
+		SET active = $3, active_at = CASE WHEN $3 THEN $4 ELSE active_at END, updated_at = $5
+		WHERE id = $1 AND user_id = $2 AND NOT deleted`, sessionID, userID, active, activeAt, nowMillis)
+	if err != nil {
+		p.logError("set session active", err)
+		return false
+	}
+	n, _ := res.RowsAffected()
+	return n > 0
+}
+
+func insertTombstone(ctx context.Context, tx *sql.Tx, kind, userID, id string, nowMillis int64) error {
+	_, err := tx.ExecContext(ctx, `INSERT INTO tombstones (kind, id, user_id, deleted_at) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (kind, user_id, id) DO UPDATE SET deleted_at = EXCLUDED.deleted_at`,
+		kind, id, userID, nowMillis)
+	return err
+}
+
+var errNoRows = errors.New("no rows affected")
+
+func (p *PostgresStore) DeleteSession(ctx context.Context, userID, sessionID string, nowMillis int64) bool {
+	err := p.withTx(ctx, func(tx *sql.Tx) error {
+		res, err := tx.ExecContext(ctx, `UPDATE sessions SET deleted = TRUE, updated_at = $3
+			WHERE id = $1 AND user_id = $2 AND NOT deleted`, sessionID, userID, nowMillis)
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return errNoRows
+		}
+		if _, err := tx.ExecContext(ctx, `DELETE FROM messages WHERE session_id = $1`, sessionID); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, `DELETE FROM session_locks WHERE session_id = $1`, sessionID); err != nil {
+			return err
+		}
+		return insertTombstone(ctx, tx, TombstoneSession, userID, sessionID, nowMillis)
+	})
+	if err != nil {
+		if !errors.Is(err, errNoRows) {
+			p.logError("delete session", err)
+		}
+		return false
+	}
+	p.publish(Event{Type: EventSessionDeleted, Origin: OriginREST, UserID: userID, SessionID: sessionID, At: nowMillis})
+	return true
+}
+
+// Messages.
+
+func (p *PostgresStore) AppendMessageFrom(ctx context.Context, origin, userID, sessionID, content, checksum string, nowMillis int64) (model.SessionMessage, error) {
+	msg, _, err := p.AppendMessageOnce(ctx, origin, userID, sessionID, content, checksum, "", nowMillis)
+	return msg, err
+}
+
+// errMessageReplayed rolls back the seq taken for a message whose local id
+// the session already holds.
+var errMessageReplayed = errors.New("message replayed")
+
+// AppendMessageOnce looks for the local id after bumping the session's seq,
+// which locks the session row until the transaction ends.
+func (p *PostgresStore) AppendMessageOnce(ctx context.Context, origin, userID, sessionID, content, checksum, localID string, nowMillis int64) (model.SessionMessage, bool, error) {
+	var msg model.SessionMessage
+	err := p.withTx(ctx, func(tx *sql.Tx) error {
+		var seq int64
+		err := tx.QueryRowContext(ctx, `UPDATE sessions SET last_message_seq = last_message_seq + 1, updated_at = $3
+			WHERE id = $1 AND user_id = $2 AND NOT deleted RETURNING last_message_seq`, sessionID, userID, nowMillis).Scan(&seq)
+		if errors.Is(err, sql.ErrNoRows) {
+			return errors.New("session not found")
+		}
+		if err != nil {
+			return err
+		}
+		sum, err := verifyChecksum(content, checksum)
+		if err != nil {
+			return err
+		}
+		if localID != "" {
+			existing, err := scanMessage(tx.QueryRowContext(ctx, `SELECT `+messageColumns+` FROM messages
+				WHERE session_id = $1 AND local_id = $2`, sessionID, localID))
+			if err == nil {
+				msg = existing
+				return errMessageReplayed
+			}
+			if !errors.Is(err, sql.ErrNoRows) {
+				return err
+			}
+		}
+		msg = model.SessionMessage{
+			ID:        p.newID(),
+			SessionID: sessionID,
+			Seq:       seq,
+			Content:   content,
+			Checksum:  sum,
+			LocalID:   localID,
+			CreatedAt: nowMillis,
+			UpdatedAt: nowMillis,
+		}
+		_, err = tx.ExecContext(ctx, `INSERT INTO messages (session_id, seq, id, content, checksum, local_id, created_at, updated_at)
+			VALUES ($1, $2, $3, $4, $5, NULLIF($6, ''), $7, $7)`, msg.SessionID, msg.Seq, msg.ID, msg.Content, msg.Checksum, msg.LocalID, nowMillis)
+		return err
+	})
+	if errors.Is(err, errMessageReplayed) {
+		return msg, false, nil
+	}
+	if err != nil {
+		return model.SessionMessage{}, false, err
+	}
+	p.publish(Event{Type: EventMessageAppended, Origin: origin, UserID: userID, SessionID: sessionID, Message: &msg, At: nowMillis})
+	return msg, true, nil
+}
+
+const messageColumns = `id, session_id, seq, content, checksum, COALESCE(local_id, ''), deleted, created_at, updated_at, annotations`
+
+func scanMessage(row rowScanner) (model.SessionMessage, error) {
+	var m model.SessionMessage
+	var annotations string
+	err := row.Scan(&m.ID, &m.SessionID, &m.Seq, &m.Content, &m.Checksum, &m.LocalID, &m.Deleted, &m.CreatedAt, &m.UpdatedAt, &annotations)
+	if err == nil && annotations != "" {
+		err = json.Unmarshal([]byte(annotations), &m.Annotations)
+	}
+	return m, err
+}
+
+func (p *PostgresStore) ListMessages(ctx context.Context, userID, sessionID string, after int64, limit int) ([]model.SessionMessage, error) {
+	if _, ok := p.GetSession(ctx, userID, sessionID); !ok {
+		return nil, errors.New("session not found")
+	}
+	if limit <= 0 {
+		limit = 100
+	}
+	rows, err := p.db.QueryContext(ctx, `SELECT `+messageColumns+` FROM messages
+		WHERE session_id = $1 AND seq > $2 ORDER BY seq LIMIT $3`, sessionID, after, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []model.SessionMessage
+	for rows.Next() {
+		m, err := scanMessage(rows)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, m)
+	}
+	return result, rows.Err()
+}
+
+// PruneMessages applies the same limits as Store.PruneMessages. A session's
+// seqs are consecutive, so its newest MaxMessagesPerSession messages are those
+// within that many of last_message_seq.
+func (p *PostgresStore) PruneMessages(ctx context.Context, nowMillis int64) (int, error) {
+	var total int64
+	if p.messageRetention > 0 {
+		res, err := p.db.ExecContext(ctx, `DELETE FROM messages m USING sessions s
+			WHERE m.session_id = s.id AND m.created_at < $1 AND m.seq < s.last_message_seq`,
+			messageCutoff(p.messageRetention, nowMillis))
+		if err != nil {
+			return 0, err
+		}
+		n, _ := res.RowsAffected()
+		total += n
+	}
+	if p.maxMessagesPerSession > 0 {
+		res, err := p.db.ExecContext(ctx, `DELETE FROM messages m USING sessions s
+			WHERE m.session_id = s.id AND m.seq <= s.last_message_seq - $1`, p.maxMessagesPerSession)
+		if err != nil {
+			return int(total), err
+		}
+		n, _ := res.RowsAffected()
+		total += n
+	}
+	return int(total), nil
+}
+
+// Machines.
+
+const machineColumns = `id, user_id, metadata, metadata_version, daemon_state, daemon_state_version,
+	data_encryption_key, created_at, updated_at`
+
+func scanMachine(row rowScanner) (model.Machine, error) {
+	var m model.Machine
+	err := row.Scan(&m.ID, &m.UserID, &m.Metadata, &m.MetadataVersion, &m.DaemonState, &m.DaemonStateVersion,
+		&m.DataEncryptionKey, &m.CreatedAt, &m.UpdatedAt)
+	return m, err
+}
+
+func (p *PostgresStore) UpsertMachine(ctx context.Context, userID, machineID, metadata string, daemonState *string, dataEncryptionKey *string, nowMillis int64) (model.Machine, bool, error) {
+	if machineID == "" {
+		return model.Machine{}, false, errors.New("missing machine id")
+	}
+	if err := checkSize("metadata", metadata, p.limits.MaxMetadataBytes); err != nil {
+		return model.Machine{}, false, err
+	}
+	if err := checkOptionalSize("daemonState", daemonState, p.limits.MaxDaemonStateBytes); err != nil {
+		return model.Machine{}, false, err
+	}
+
+	// A concurrent first upsert makes the insert a no-op; the second pass
+	// then finds and updates that machine.
+	for attempt := 0; attempt < 2; attempt++ {
+		var m model.Machine
+		var found, created bool
+		err := p.withTx(ctx, func(tx *sql.Tx) error {
+			existing, err := scanMachine(tx.QueryRowContext(ctx, `SELECT `+machineColumns+` FROM machines WHERE id = $1 AND user_id = $2 FOR UPDATE`, machineID, userID))
+			if err == nil {
+				found = true
+				m = existing
+				changed := false
+				if metadata != "" && metadata != m.Metadata {
+					m.Metadata = metadata
+					m.MetadataVersion++
+					changed = true
+				}
+				if daemonState != nil {
+					if m.DaemonState == nil || *m.DaemonState != *daemonState {
+						m.DaemonState = daemonState
+						m.DaemonStateVersion++
+						changed = true
+					}
+				}
+				if dataEncryptionKey != nil {
+					m.DataEncryptionKey = dataEncryptionKey
+					changed = true
+				}
+				if !changed {
+					return nil
+				}
+				m.UpdatedAt = nowMillis
+				_, err := tx.ExecContext(ctx, `UPDATE machines SET metadata = $2, metadata_version = $3, daemon_state = $4,
+					daemon_state_version = $5, data_encryption_key = $6, updated_at = $7 WHERE id = $1 AND user_id = $8`,
+					m.ID, m.Metadata, m.MetadataVersion, m.DaemonState, m.DaemonStateVersion, m.DataEncryptionKey, m.UpdatedAt, m.UserID)
+				return err
+			}
+			if !errors.Is(err, sql.ErrNoRows) {
+				return err
+			}
+
+			m = model.Machine{
+				ID:                machineID,
+				UserID:            userID,
+				Metadata:          metadata,
+				DaemonState:       daemonState,
+				DataEncryptionKey: dataEncryptionKey,
+				CreatedAt:         nowMillis,
+				UpdatedAt:         nowMillis,
+			}
+			if metadata != "" {
+				m.MetadataVersion = 1
+			}
+			if daemonState != nil {
+				m.DaemonStateVersion = 1
+			}
+			res, err := tx.ExecContext(ctx, `INSERT INTO machines (id, user_id, metadata, metadata_version, daemon_state,
+				daemon_state_version, data_encryption_key, created_at, updated_at)
+				VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $8) ON CONFLICT (user_id, id) DO NOTHING`,
+				m.ID, m.UserID, m.Metadata, m.MetadataVersion, m.DaemonState, m.DaemonStateVersion, m.DataEncryptionKey, nowMillis)
+			if err != nil {
+				return err
+			}
+			if n, _ := res.RowsAffected(); n == 0 {
+				return nil
+			}
+			created = true
+			_, err = tx.ExecContext(ctx, `DELETE FROM tombstones WHERE kind = $1 AND user_id = $2 AND id = $3`, TombstoneMachine, userID, machineID)
+			return err
+		})
+		if err != nil {
+			p.logError("upsert machine", err)
+			return model.Machine{}, false, err
+		}
+		if found || created {
+			return m, created, nil
+		}
+	}
+	return model.Machine{}, false, errors.New("machine create conflict")
+}
+
+func (p *PostgresStore) GetMachine(ctx context.Context, userID, machineID string) (model.Machine, bool) {
+	m, err := scanMachine(p.db.QueryRowContext(ctx, `SELECT `+machineColumns+` FROM machines WHERE id = $1 AND user_id = $2`, machineID, userID))
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			p.logError("get machine", err)
+		}
+		return model.Machine{}, false
+	}
+	return m, true
+}
+
+func (p *PostgresStore) ListMachines(ctx context.Context, userID string) []model.Machine {
+	rows, err := p.db.QueryContext(ctx, `SELECT `+machineColumns+` FROM machines WHERE user_id = $1 ORDER BY updated_at DESC`, userID)
+	if err != nil {
+		p.logError("list machines", err)
+		return []model.Machine{}
+	}
+	defer rows.Close()
+
+	result := make([]model.Machine, 0)
+	for rows.Next() {
+		m, err := scanMachine(rows)
+		if err != nil {
+			p.logError("scan machine", err)
+			break
+		}
+		result = append(result, m)
+	}
+	return result
+}
+
+func (p *PostgresStore) UpdateMachineMetadata(ctx context.Context, userID, machineID string, expectedVersion int, metadata string, nowMillis int64) (status string, version int, currentValue string) {
+	tooLarge := checkSize("metadata", metadata, p.limits.MaxMetadataBytes) != nil
+	status, version, current := p.versionedUpdate(ctx, machineMetadataColumn, machineID, userID, expectedVersion, &metadata, tooLarge, nowMillis)
+	return status, version, derefString(current)
+}
+
+func (p *PostgresStore) UpdateMachineDaemonState(ctx context.Context, userID, machineID string, expectedVersion int, daemonState *string, nowMillis int64) (status string, version int, currentValue *string) {
+	tooLarge := checkOptionalSize("daemonState", daemonState, p.limits.MaxDaemonStateBytes) != nil
+	return p.versionedUpdate(ctx, machineDaemonColumn, machineID, userID, expectedVersion, daemonState, tooLarge, nowMillis)
+}
+
+func (p *PostgresStore) DeleteMachine(ctx context.Context, userID, machineID string, nowMillis int64) bool {
+	err := p.withTx(ctx, func(tx *sql.Tx) error {
+		res, err := tx.ExecContext(ctx, `DELETE FROM machines WHERE id = $1 AND user_id = $2`, machineID, userID)
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return errNoRows
+		}
+		return insertTombstone(ctx, tx, TombstoneMachine, userID, machineID, nowMillis)
+	})
+	if err != nil {
+		if !errors.Is(err, errNoRows) {
+			p.logError("delete machine", err)
+		}
+		return false
+	}
+	p.publish(Event{Type: EventMachineDeleted, Origin: OriginREST, UserID: userID, MachineID: machineID, At: nowMillis})
+	return true
+}
+
+// Artifacts.
+
+const artifactColumns = `id, user_id, header, header_version, body, body_version, data_encryption_key,
+	header_checksum, body_checksum, seq, created_at, updated_at, deleted`
+
+func scanArtifact(row rowScanner) (model.Artifact, error) {
+	var a model.Artifact
+	err := row.Scan(&a.ID, &a.UserID, &a.Header, &a.HeaderVersion, &a.Body, &a.BodyVersion, &a.DataEncryptionKey,
+		&a.HeaderChecksum, &a.BodyChecksum, &a.Seq, &a.CreatedAt, &a.UpdatedAt, &a.Deleted)
+	return a, err
+}
+
+func (p *PostgresStore) ListArtifacts(ctx context.Context, userID string) []model.Artifact {
+	rows, err := p.db.QueryContext(ctx, `SELECT `+artifactColumns+` FROM artifacts
+		WHERE user_id = $1 AND NOT deleted ORDER BY updated_at DESC, id ASC`, userID)
+	if err != nil {
+		p.logError("list artifacts", err)
+		return []model.Artifact{}
+	}
+	defer rows.Close()
+
+	result := make([]model.Artifact, 0)
+	for rows.Next() {
+		a, err := scanArtifact(rows)
+		if err != nil {
+			p.logError("scan artifact", err)
+			break
+		}
+		result = append(result, a)
+	}
+	return result
+}
+
+func (p *PostgresStore) GetArtifact(ctx context.Context, userID, artifactID string) (model.Artifact, bool) {
+	a, err := scanArtifact(p.db.QueryRowContext(ctx, `SELECT `+artifactColumns+` FROM artifacts
+		WHERE user_id = $1 AND id = $2 AND NOT deleted`, userID, artifactID))
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			p.logError("get artifact", err)
+		}
+		return model.Artifact{}, false
+	}
+	return a, true
+}
+
+func (p *PostgresStore) CreateArtifactWithChecksums(ctx context.Context, userID, artifactID, header, body, dataEncryptionKey string, sums ArtifactChecksums, nowMillis int64) (model.Artifact, bool, error) {
+	if userID == "" {
+		return model.Artifact{}, false, errors.New("missing user id")
+	}
+	if artifactID == "" {
+		return model.Artifact{}, false, errors.New("missing artifact id")
+	}
+	if header == "" || body == "" || dataEncryptionKey == "" {
+		return model.Artifact{}, false, errors.New("missing artifact fields")
+	}
+	headerChecksum, err := verifyChecksum(header, sums.Header)
+	if err != nil {
+		return model.Artifact{}, false, err
+	}
+	bodyChecksum, err := verifyChecksum(body, sums.Body)
+	if err != nil {
+		return model.Artifact{}, false, err
+	}
+
+	// A deleted artifact with the same id is replaced; a live one is returned
+	// unchanged.
+	a, err := scanArtifact(p.db.QueryRowContext(ctx, `INSERT INTO artifacts (user_id, id, header, header_version, body,
+		body_version, data_encryption_key, header_checksum, body_checksum, seq, created_at, updated_at, deleted)
+		VALUES ($1, $2, $3, 1, $4, 1, $5, $6, $7, nextval('artifact_seq'), $8, $8, FALSE)
+		ON CONFLICT (user_id, id) DO UPDATE SET
+			header = EXCLUDED.header, header_version = 1, body = EXCLUDED.body, body_version = 1,
+			data_encryption_key = EXCLUDED.data_encryption_key, header_checksum = EXCLUDED.header_checksum,
+			body_checksum = EXCLUDED.body_checksum, seq = EXCLUDED.seq, created_at = EXCLUDED.created_at,
+			updated_at = EXCLUDED.updated_at, deleted = FALSE
+		WHERE artifacts.deleted
+		RETURNING `+artifactColumns,
+		userID, artifactID, header, body, dataEncryptionKey, headerChecksum, bodyChecksum, nowMillis))
+	if err == nil {
+		return a, true, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		p.logError("create artifact", err)
+		return model.Artifact{}, false, err
+	}
+	existing, ok := p.GetArtifact(ctx, userID, artifactID)
+	if !ok {
+		return model.Artifact{}, false, errors.New("artifact create conflict")
+	}
+	return existing, false, nil
+}
+
+func (p *PostgresStore) UpdateArtifactWithChecksums(ctx context.Context, userID, artifactID string, header *string, expectedHeaderVersion *int, body *string, expectedBodyVersion *int, sums ArtifactChecksums, nowMillis int64) (ArtifactUpdateResult, error) {
+	if userID == "" {
+		return ArtifactUpdateResult{}, errors.New("missing user id")
+	}
+	if artifactID == "" {
+		return ArtifactUpdateResult{}, errors.New("missing artifact id")
+	}
+	var headerChecksum, bodyChecksum string
+	if header != nil {
+		sum, err := verifyChecksum(*header, sums.Header)
+		if err != nil {
+			return ArtifactUpdateResult{}, err
+		}
+		headerChecksum = sum
+	}
+	if body != nil {
+		sum, err := verifyChecksum(*body, sums.Body)
+		if err != nil {
+			return ArtifactUpdateResult{}, err
+		}
+		bodyChecksum = sum
+	}
+
+	var res ArtifactUpdateResult
+	err := p.withTx(ctx, func(tx *sql.Tx) error {
+		a, err := scanArtifact(tx.QueryRowContext(ctx, `SELECT `+artifactColumns+` FROM artifacts
+			WHERE user_id = $1 AND id = $2 AND NOT deleted FOR UPDATE`, userID, artifactID))
+		if errors.Is(err, sql.ErrNoRows) {
+			return errors.New("artifact not found")
+		}
+		if err != nil {
+			return err
+		}
+
+		mismatch := func() ArtifactUpdateResult {
+			chv, cbv, ch, cb := a.HeaderVersion, a.BodyVersion, a.Header, a.Body
+			return ArtifactUpdateResult{
+				CurrentHeaderVersion: &chv,
+				CurrentBodyVersion:   &cbv,
+				CurrentHeader:        &ch,
+				CurrentBody:          &cb,
+			}
+		}
+		if header != nil {
+			if expectedHeaderVersion == nil || *expectedHeaderVersion != a.HeaderVersion {
+				res = mismatch()
+				return nil
+			}
+			a.Header = *header
+			a.HeaderChecksum = headerChecksum
+			a.HeaderVersion++
+		}
+		if body != nil {
+			if expectedBodyVersion == nil || *expectedBodyVersion != a.BodyVersion {
+				res = mismatch()
+				return nil
+			}
+			a.Body = *body
+			a.BodyChecksum = bodyChecksum
+			a.BodyVersion++
+		}
+
+		_, err = tx.ExecContext(ctx, `UPDATE artifacts SET header = $3, header_version = $4, header_checksum = $5, body = $6,
+			body_version = $7, body_checksum = $8, seq = nextval('artifact_seq'), updated_at = $9
+			WHERE user_id = $1 AND id = $2`,
+			userID, artifactID, a.Header, a.HeaderVersion, a.HeaderChecksum, a.Body, a.BodyVersion, a.BodyChecksum, nowMillis)
+		if err != nil {
+			return err
+		}
+		res = ArtifactUpdateResult{Success: true}
+		if header != nil {
+			hv := a.HeaderVersion
+			res.HeaderVersion = &hv
+		}
+		if body != nil {
+			bv := a.BodyVersion
+			res.BodyVersion = &bv
+		}
+		return nil
+	})
+	if err != nil {
+		return ArtifactUpdateResult{}, err
+	}
+	return res, nil
+}
+
+func (p *PostgresStore) DeleteArtifact(ctx context.Context, userID, artifactID string) bool {
+	if userID == "" || artifactID == "" {
+		return false
+	}
+	res, err := p.db.ExecContext(ctx, `UPDATE artifacts SET deleted = TRUE, updated_at = $3 WHERE user_id = $1 AND id = $2 AND NOT deleted`,
+		userID, artifactID, clock.Now(p.clock).UnixMilli())
+	if err != nil {
+		p.logError("delete artifact", err)
+		return false
+	}
+	n, _ := res.RowsAffected()
+	return n > 0
+}
+
+// Purge applies the same rules as Store.Purge. A deleted session's messages
+// are already gone, so only its row remains.
+func (p *PostgresStore) Purge(ctx context.Context, nowMillis int64) (PurgeStats, error) {
+	cutoff := purgeCutoff(p.purgeGrace, nowMillis)
+	var stats PurgeStats
+	for _, step := range []struct {
+		query string
+		arg   int64
+		count *int
+	}{
+		{`DELETE FROM sessions WHERE deleted AND updated_at < $1`, cutoff, &stats.Sessions},
+		{`DELETE FROM artifacts WHERE deleted AND updated_at < $1`, cutoff, &stats.Artifacts},
+		{`DELETE FROM tombstones WHERE deleted_at < $1`, p.TombstoneCutoff(nowMillis), &stats.Tombstones},
+	} {
+		res, err := p.db.ExecContext(ctx, step.query, step.arg)
+		if err != nil {
+			return stats, err
+		}
+		n, _ := res.RowsAffected()
+		*step.count = int(n)
+	}
+	return stats, nil
+}
+
+// Tombstones.
+
+func (p *PostgresStore) TombstoneCutoff(nowMillis int64) int64 {
+	return nowMillis - p.tombstoneRetention.Milliseconds()
+}
+
+func (p *PostgresStore) ListTombstones(ctx context.Context, userID string, since int64, nowMillis int64) []model.Tombstone {
+	if _, err := p.db.ExecContext(ctx, `DELETE FROM tombstones WHERE deleted_at < $1`, p.TombstoneCutoff(nowMillis)); err != nil {
+		p.logError("prune tombstones", err)
+	}
+	rows, err := p.db.QueryContext(ctx, `SELECT kind, id, user_id, deleted_at FROM tombstones
+		WHERE user_id = $1 AND deleted_at > $2 ORDER BY deleted_at`, userID, since)
+	if err != nil {
+		p.logError("list tombstones", err)
+		return []model.Tombstone{}
+	}
+	defer rows.Close()
+
+	result := make([]model.Tombstone, 0)
+	for rows.Next() {
+		var t model.Tombstone
+		if err := rows.Scan(&t.Kind, &t.ID, &t.UserID, &t.DeletedAt); err != nil {
+			p.logError("scan tombstone", err)
+			break
+		}
+		result = append(result, t)
+	}
+	return result
+}
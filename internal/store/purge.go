@@ -0,0 +1,91 @@
+package store
+
+import (
+	"context"
+	"time"
+)
+
+const defaultPurgeGrace = 30 * 24 * time.Hour
+
+// PurgeStats counts what one Purge call removed permanently.
+type PurgeStats struct {
+	Sessions   int `json:"sessions"`
+	Artifacts  int `json:"artifacts"`
+	Tombstones int `json:"tombstones"`
+}
+
+// Purger is implemented by stores that can permanently remove soft-deleted
+// records.
+type Purger interface {
+	// Purge removes sessions and artifacts deleted more than the purge grace
+	// period before nowMillis, and tombstones past their retention.
+	Purge(ctx context.Context, nowMillis int64) (PurgeStats, error)
+}
+
+var (
+	_ Purger = (*Store)(nil)
+	_ Purger = (*PostgresStore)(nil)
+	_ Purger = (*RedisStore)(nil)
+)
+
+func purgeCutoff(grace time.Duration, nowMillis int64) int64 {
+	if grace <= 0 {
+		grace = defaultPurgeGrace
+	}
+	return nowMillis - grace.Milliseconds()
+}
+
+// Purge drops deleted sessions and artifacts whose UpdatedAt, the deletion
+// time, is older than Options.PurgeGrace, along with expired tombstones.
+func (s *Store) Purge(ctx context.Context, nowMillis int64) (PurgeStats, error) {
+	cutoff := purgeCutoff(s.purgeGrace, nowMillis)
+	tombstoneCutoff := s.TombstoneCutoff(nowMillis)
+
+	var stats PurgeStats
+	for i := range s.users {
+		sh := &s.users[i]
+		sh.mu.Lock()
+		for _, u := range sh.users {
+			for id, sess := range u.sessions {
+				if !sess.Deleted || sess.UpdatedAt >= cutoff {
+					continue
+				}
+				delete(u.sessions, id)
+				s.seq.reset(id)
+				s.unpersist(recordSession, id)
+				stats.Sessions++
+			}
+		}
+		sh.mu.Unlock()
+	}
+
+	s.mu.Lock()
+	for key, a := range s.artifactsByKey {
+		if !a.Deleted || a.UpdatedAt >= cutoff {
+			continue
+		}
+		delete(s.artifactsByKey, key)
+		s.unpersist(recordArtifact, key)
+		stats.Artifacts++
+	}
+	s.mu.Unlock()
+
+	s.tombstonesMu.Lock()
+	for key, t := range s.tombstones {
+		if t.DeletedAt >= tombstoneCutoff {
+			continue
+		}
+		delete(s.tombstones, key)
+		s.unpersist(recordTombstone, key)
+		stats.Tombstones++
+	}
+	s.tombstonesMu.Unlock()
+
+	if stats.Sessions > 0 {
+		s.saveSessions()
+	}
+	if stats.Artifacts > 0 {
+		s.saveArtifacts()
+	}
+	return stats, nil
+}
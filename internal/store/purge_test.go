@@ -0,0 +1,53 @@
+package store
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStore_PurgeRemovesDeletedRecordsAfterGrace(t *testing.T) {
+	ctx := context.Background()
+	const day = int64(24 * time.Hour / time.Millisecond)
+	opts := Options{
+		SessionsStateFile:  filepath.Join(t.TempDir(), "sessions-state.json"),
+		PurgeGrace:         7 * 24 * time.Hour,
+		TombstoneRetention: 24 * time.Hour,
+	}
+	s := NewWithOptions(opts)
+
+	gone, _, _ := s.GetOrCreateSession(ctx, "u1", "gone", "meta", nil, nil, 0)
+	recent, _, _ := s.GetOrCreateSession(ctx, "u1", "recent", "meta", nil, nil, 0)
+	live, _, _ := s.GetOrCreateSession(ctx, "u1", "live", "meta", nil, nil, 0)
+	s.DeleteSession(ctx, "u1", gone.ID, 0)
+	s.DeleteSession(ctx, "u1", recent.ID, 6*day)
+	if _, _, err := s.CreateArtifactWithChecksums(ctx, "u1", "a1", "h", "b", "k", ArtifactChecksums{}, 0); err != nil {
+		t.Fatalf("CreateArtifact: %v", err)
+	}
+	s.DeleteArtifact(ctx, "u1", "a1")
+
+	stats, err := s.Purge(ctx, 8*day)
+	if err != nil || stats != (PurgeStats{Sessions: 1, Tombstones: 2}) {
+		t.Fatalf("Purge = %+v, %v", stats, err)
+	}
+	if !s.sessionIDs()[recent.ID] {
+		t.Fatal("expected session deleted within the grace period to stay")
+	}
+
+	// The artifact was deleted at wall-clock time, so it is purged once the
+	// grace period has passed from now.
+	later := time.Now().Add(8 * 24 * time.Hour).UnixMilli()
+	stats, _ = s.Purge(ctx, later)
+	if stats.Sessions != 1 || stats.Artifacts != 1 {
+		t.Fatalf("expected the remaining deleted session and artifact purged, got %+v", stats)
+	}
+
+	reloaded := NewWithOptions(opts)
+	if ids := reloaded.sessionIDs(); len(ids) != 1 {
+		t.Fatalf("expected only the live session after reload, got %d", len(ids))
+	}
+	if _, ok := reloaded.GetSession(ctx, "u1", live.ID); !ok {
+		t.Fatal("expected live session to survive")
+	}
+}
@@ -0,0 +1,76 @@
+package store
+
+import (
+	"context"
+	"sort"
+
+	"happy-server-lite/internal/model"
+)
+
+func pushTokenKey(userID, token string) string {
+	return userID + "|" + token
+}
+
+// sortPushTokens orders tokens oldest registration first.
+func sortPushTokens(tokens []model.PushToken) {
+	sort.Slice(tokens, func(i, j int) bool {
+		if tokens[i].CreatedAt != tokens[j].CreatedAt {
+			return tokens[i].CreatedAt < tokens[j].CreatedAt
+		}
+		return tokens[i].Token < tokens[j].Token
+	})
+}
+
+// GetAccount returns the account registered for publicKey without creating
+// one.
+func (s *Store) GetAccount(ctx context.Context, publicKey string) (model.Account, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	acc, ok := s.accountsByPublicKey[publicKey]
+	return acc, ok
+}
+
+// AddPushToken registers token for userID, refreshing its locale and
+// UpdatedAt when it is already known.
+func (s *Store) AddPushToken(ctx context.Context, userID, token, locale string, nowMillis int64) model.PushToken {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := pushTokenKey(userID, token)
+	pt, ok := s.pushTokens[key]
+	if !ok {
+		pt = model.PushToken{UserID: userID, Token: token, CreatedAt: nowMillis}
+	}
+	pt.Locale = locale
+	pt.UpdatedAt = nowMillis
+	s.pushTokens[key] = pt
+	s.persist(recordPushToken, key, pt)
+	return pt
+}
+
+func (s *Store) ListPushTokens(ctx context.Context, userID string) []model.PushToken {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	result := make([]model.PushToken, 0)
+	for _, pt := range s.pushTokens {
+		if pt.UserID == userID {
+			result = append(result, pt)
+		}
+	}
+	sortPushTokens(result)
+	return result
+}
+
+func (s *Store) DeletePushToken(ctx context.Context, userID, token string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := pushTokenKey(userID, token)
+	if _, ok := s.pushTokens[key]; !ok {
+		return false
+	}
+	delete(s.pushTokens, key)
+	s.unpersist(recordPushToken, key)
+	return true
+}
@@ -0,0 +1,1429 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"happy-server-lite/internal/clock"
+	"happy-server-lite/internal/ids"
+	"happy-server-lite/internal/model"
+)
+
+const (
+	defaultRedisKeyPrefix          = "happy:"
+	defaultRedisMaxSessionMessages = 10000
+)
+
+// RedisOptions configures OpenRedis.
+type RedisOptions struct {
+	// URL is redis://[user:password@]host[:port][/db]; rediss:// uses TLS.
+	URL string
+	// KeyPrefix namespaces every key; empty picks "happy:".
+	KeyPrefix string
+	// MaxSessionMessages caps each session's message list; older messages
+	// are trimmed. Zero picks Options.MaxMessagesPerSession, or 10000 when
+	// that is unset too.
+	MaxSessionMessages int
+}
+
+// RedisStore is a Storage kept entirely in Redis, so several server instances
+// behind a load balancer can share state. Records are JSON values updated
+// with WATCH/MULTI/EXEC transactions; each session's messages are a list
+// capped at RedisOptions.MaxSessionMessages. As with PostgresStore, events
+// only reach subscribers of the instance that made the change.
+type RedisStore struct {
+	eventBus
+
+	client             *redisClient
+	prefix             string
+	maxMessages        int
+	limits             Limits
+	tombstoneRetention time.Duration
+	authRequestTTL     time.Duration
+	messageRetention   time.Duration
+	purgeGrace         time.Duration
+	newID              ids.Generator
+	clock              clock.Clock
+}
+
+var _ Storage = (*RedisStore)(nil)
+
+// OpenRedis connects to the server at ro.URL. The state file options and
+// Options.Backend are ignored.
+func OpenRedis(ro RedisOptions, opts Options) (*RedisStore, error) {
+	client, err := newRedisClient(ro.URL)
+	if err != nil {
+		return nil, err
+	}
+	ctx := context.Background()
+	if _, err := client.do(ctx, "PING"); err != nil {
+		_ = client.Close()
+		return nil, err
+	}
+	r := &RedisStore{
+		client:             client,
+		prefix:             ro.KeyPrefix,
+		maxMessages:        ro.MaxSessionMessages,
+		limits:             opts.Limits.withDefaults(),
+		tombstoneRetention: opts.TombstoneRetention,
+		authRequestTTL:     opts.AuthRequestTTL,
+		messageRetention:   opts.MessageRetention,
+		purgeGrace:         opts.PurgeGrace,
+		newID:              opts.idGenerator(),
+		clock:              opts.Clock,
+	}
+	if r.prefix == "" {
+		r.prefix = defaultRedisKeyPrefix
+	}
+	if r.maxMessages <= 0 {
+		r.maxMessages = opts.MaxMessagesPerSession
+	}
+	if r.maxMessages <= 0 {
+		r.maxMessages = defaultRedisMaxSessionMessages
+	}
+	if r.tombstoneRetention <= 0 {
+		r.tombstoneRetention = defaultTombstoneRetention
+	}
+	if err := r.rekeyMachines(ctx); err != nil {
+		r.logError("rekey machines", err)
+	}
+	return r, nil
+}
+
+func (r *RedisStore) Close() error {
+	return r.client.Close()
+}
+
+// logError logs a failed operation. Operations cut short because the caller
+// went away are not worth a line.
+func (r *RedisStore) logError(op string, err error) {
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+	log.Printf("redis store: %s: %v", op, err)
+}
+
+// Keys.
+
+func (r *RedisStore) accountKey(publicKey string) string { return r.prefix + "account:" + publicKey }
+func (r *RedisStore) disabledKey(userID string) string   { return r.prefix + "disabled:" + userID }
+func (r *RedisStore) githubKey(userID string) string     { return r.prefix + "github:" + userID }
+func (r *RedisStore) authRequestKey(publicKey string) string {
+	return r.prefix + "auth-request:" + publicKey
+}
+func (r *RedisStore) authChallengeKey(nonce string) string {
+	return r.prefix + "auth-challenge:" + nonce
+}
+func (r *RedisStore) settingsKey(userID string) string { return r.prefix + "settings:" + userID }
+func (r *RedisStore) sessionKey(id string) string      { return r.prefix + "session:" + id }
+func (r *RedisStore) sessionSeqKey(id string) string   { return r.prefix + "session-seq:" + id }
+func (r *RedisStore) messagesKey(id string) string     { return r.prefix + "messages:" + id }
+func (r *RedisStore) sessionLocksKey(id string) string {
+	return r.prefix + "session-locks:" + id
+}
+func (r *RedisStore) messageLocalIDsKey(id string) string {
+	return r.prefix + "message-local-ids:" + id
+}
+func (r *RedisStore) sessionTagKey(userID, tag string) string {
+	return r.prefix + "session-tag:" + userID + ":" + tag
+}
+func (r *RedisStore) machineKey(userID, id string) string {
+	return r.prefix + "machine:" + userID + ":" + id
+}
+func (r *RedisStore) artifactKey(userID, id string) string {
+	return r.prefix + "artifact:" + userID + ":" + id
+}
+func (r *RedisStore) artifactSeqKey() string { return r.prefix + "artifact-seq" }
+func (r *RedisStore) userSetKey(userID, kind string) string {
+	return r.prefix + "user:" + userID + ":" + kind
+}
+func (r *RedisStore) tombstonesKey(userID string) string { return r.userSetKey(userID, "tombstones") }
+func (r *RedisStore) pushTokenKey(userID, token string) string {
+	return r.prefix + "push-token:" + userID + ":" + token
+}
+func (r *RedisStore) refreshTokenKey(id string) string { return r.prefix + "refresh-token:" + id }
+func (r *RedisStore) apiKeyKey(id string) string       { return r.prefix + "api-key:" + id }
+func (r *RedisStore) deviceKey(id string) string       { return r.prefix + "device:" + id }
+
+// Reply helpers.
+
+func redisJSON(v any) string {
+	data, _ := json.Marshal(v)
+	return string(data)
+}
+
+// getJSON loads key into v and reports whether it existed.
+func getJSON(do func(args ...any) (any, error), key string, v any) (bool, error) {
+	reply, err := do("GET", key)
+	if err != nil || reply == nil {
+		return false, err
+	}
+	s, ok := reply.(string)
+	if !ok {
+		return false, errors.New("redis: unexpected GET reply")
+	}
+	return true, json.Unmarshal([]byte(s), v)
+}
+
+func redisStrings(reply any) []string {
+	items, _ := reply.([]any)
+	result := make([]string, 0, len(items))
+	for _, item := range items {
+		if s, ok := item.(string); ok {
+			result = append(result, s)
+		}
+	}
+	return result
+}
+
+// mgetJSON loads the members of the set at setKey through keyFn, skipping
+// members whose record is gone.
+func mgetJSON[T any](ctx context.Context, r *RedisStore, setKey string, keyFn func(id string) string) ([]T, error) {
+	ids, err := r.client.do(ctx, "SMEMBERS", setKey)
+	if err != nil {
+		return nil, err
+	}
+	members := redisStrings(ids)
+	result := make([]T, 0, len(members))
+	if len(members) == 0 {
+		return result, nil
+	}
+	args := []any{"MGET"}
+	for _, id := range members {
+		args = append(args, keyFn(id))
+	}
+	reply, err := r.client.do(ctx, args...)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range redisStrings(reply) {
+		var v T
+		if err := json.Unmarshal([]byte(s), &v); err != nil {
+			return nil, err
+		}
+		result = append(result, v)
+	}
+	return result, nil
+}
+
+// updateJSON applies fn to the record at key inside a WATCH transaction and
+// writes it back when fn returns true. It reports whether the record exists;
+// fn may run more than once when the transaction is retried.
+func updateJSON[T any](ctx context.Context, r *RedisStore, key string, fn func(v *T) bool) (bool, error) {
+	var found bool
+	err := r.client.watch(ctx, []string{key}, func(tx *redisTx) error {
+		var v T
+		ok, err := getJSON(tx.do, key, &v)
+		found = ok
+		if err != nil || !ok {
+			return err
+		}
+		if fn(&v) {
+			tx.queue("SET", key, redisJSON(v))
+		}
+		return nil
+	})
+	return found, err
+}
+
+// Accounts and auth requests.
+
+func (r *RedisStore) GetOrCreateAccount(ctx context.Context, publicKey string, nowMillis int64) (model.Account, bool) {
+	acc := model.Account{ID: r.newID(), PublicKey: publicKey, CreatedAt: nowMillis}
+	reply, err := r.client.do(ctx, "SET", r.accountKey(publicKey), redisJSON(acc), "NX")
+	if err != nil {
+		r.logError("create account", err)
+		return model.Account{}, false
+	}
+	if reply != nil {
+		return acc, true
+	}
+	var existing model.Account
+	if _, err := getJSON(r.client.doFunc(ctx), r.accountKey(publicKey), &existing); err != nil {
+		r.logError("get account", err)
+		return model.Account{}, false
+	}
+	return existing, false
+}
+
+func (r *RedisStore) GetAccount(ctx context.Context, publicKey string) (model.Account, bool) {
+	var acc model.Account
+	ok, err := getJSON(r.client.doFunc(ctx), r.accountKey(publicKey), &acc)
+	if err != nil {
+		r.logError("get account", err)
+		return model.Account{}, false
+	}
+	return acc, ok
+}
+
+func (r *RedisStore) SetAccountDisabled(ctx context.Context, userID string, disabled bool) bool {
+	var reply any
+	var err error
+	if disabled {
+		reply, err = r.client.do(ctx, "SET", r.disabledKey(userID), "1", "NX")
+	} else {
+		reply, err = r.client.do(ctx, "DEL", r.disabledKey(userID))
+	}
+	if err != nil {
+		r.logError("set account disabled", err)
+		return false
+	}
+	if n, ok := reply.(int64); ok {
+		return n > 0
+	}
+	return reply != nil
+}
+
+func (r *RedisStore) IsAccountDisabled(ctx context.Context, userID string) bool {
+	reply, err := r.client.do(ctx, "EXISTS", r.disabledKey(userID))
+	if err != nil {
+		r.logError("is account disabled", err)
+		return false
+	}
+	n, _ := reply.(int64)
+	return n > 0
+}
+
+func (r *RedisStore) GetAuthRequest(ctx context.Context, publicKey string) (model.AuthRequest, bool) {
+	var req model.AuthRequest
+	ok, err := getJSON(r.client.doFunc(ctx), r.authRequestKey(publicKey), &req)
+	if err != nil {
+		r.logError("get auth request", err)
+		return model.AuthRequest{}, false
+	}
+	return req, ok
+}
+
+func (r *RedisStore) UpsertAuthRequest(ctx context.Context, publicKey string, supportsV2 bool, device *model.AuthRequestDevice, nowMillis int64) model.AuthRequest {
+	key := r.authRequestKey(publicKey)
+	var req model.AuthRequest
+	created := false
+	err := r.client.watch(ctx, []string{key}, func(tx *redisTx) error {
+		req = model.AuthRequest{}
+		ok, err := getJSON(tx.do, key, &req)
+		if err != nil {
+			return err
+		}
+		created = !ok
+		if ok {
+			req.SupportsV2 = req.SupportsV2 || supportsV2
+			if device != nil {
+				req.Device = device
+			}
+			req.UpdatedAt = nowMillis
+		} else {
+			req = model.AuthRequest{
+				ID:         r.newID(),
+				PublicKey:  publicKey,
+				SupportsV2: supportsV2,
+				Device:     device,
+				CreatedAt:  nowMillis,
+				UpdatedAt:  nowMillis,
+			}
+		}
+		tx.queue("SET", key, redisJSON(req))
+		return nil
+	})
+	if err != nil {
+		r.logError("upsert auth request", err)
+		return model.AuthRequest{}
+	}
+	if created {
+		r.publish(Event{Type: EventAuthRequested, PublicKey: publicKey, At: nowMillis})
+	}
+	return req
+}
+
+func (r *RedisStore) AuthorizeAuthRequest(ctx context.Context, publicKey, response, responseAccountID, token string, nowMillis int64) (model.AuthRequest, bool) {
+	var req model.AuthRequest
+	found, err := updateJSON(ctx, r, r.authRequestKey(publicKey), func(v *model.AuthRequest) bool {
+		v.Response = response
+		v.ResponseAccountID = responseAccountID
+		v.Token = token
+		v.Rejected = false
+		v.UpdatedAt = nowMillis
+		req = *v
+		return true
+	})
+	if err != nil {
+		r.logError("authorize auth request", err)
+		return model.AuthRequest{}, false
+	}
+	return req, found
+}
+
+func (r *RedisStore) RejectAuthRequest(ctx context.Context, publicKey string, nowMillis int64) (model.AuthRequest, bool) {
+	var req model.AuthRequest
+	found, err := updateJSON(ctx, r, r.authRequestKey(publicKey), func(v *model.AuthRequest) bool {
+		pending := v.Token == "" && !v.Rejected
+		if pending {
+			v.Rejected = true
+			v.UpdatedAt = nowMillis
+		}
+		req = *v
+		return pending
+	})
+	if err != nil {
+		r.logError("reject auth request", err)
+		return model.AuthRequest{}, false
+	}
+	return req, found
+}
+
+// Account settings.
+
+type redisSettings struct {
+	Settings *string
+	Version  int
+}
+
+func (r *RedisStore) GetAccountSettings(ctx context.Context, userID string) (*string, int) {
+	var st redisSettings
+	if _, err := getJSON(r.client.doFunc(ctx), r.settingsKey(userID), &st); err != nil {
+		r.logError("get settings", err)
+		return nil, 0
+	}
+	return st.Settings, st.Version
+}
+
+func (r *RedisStore) UpdateAccountSettings(ctx context.Context, userID string, expectedVersion int, settings string, nowMillis int64) (status string, currentVersion int, currentSettings *string) {
+	if userID == "" {
+		return "error", 0, nil
+	}
+	if checkSize("settings", settings, r.limits.MaxSettingsBytes) != nil {
+		current, version := r.GetAccountSettings(ctx, userID)
+		return "too-large", version, current
+	}
+
+	key := r.settingsKey(userID)
+	err := r.client.watch(ctx, []string{key}, func(tx *redisTx) error {
+		var st redisSettings
+		if _, err := getJSON(tx.do, key, &st); err != nil {
+			return err
+		}
+		if st.Version != expectedVersion {
+			status, currentVersion, currentSettings = "version-mismatch", st.Version, st.Settings
+			return nil
+		}
+		st = redisSettings{Settings: &settings, Version: st.Version + 1}
+		tx.queue("SET", key, redisJSON(st))
+		status, currentVersion, currentSettings = "success", st.Version, &settings
+		return nil
+	})
+	if err != nil {
+		r.logError("update settings", err)
+		return "error", 0, nil
+	}
+	return status, currentVersion, currentSettings
+}
+
+func (r *RedisStore) AddPushToken(ctx context.Context, userID, token, locale string, nowMillis int64) model.PushToken {
+	key := r.pushTokenKey(userID, token)
+	pt := model.PushToken{UserID: userID, Token: token, Locale: locale, CreatedAt: nowMillis, UpdatedAt: nowMillis}
+	err := r.client.watch(ctx, []string{key}, func(tx *redisTx) error {
+		var existing model.PushToken
+		found, err := getJSON(tx.do, key, &existing)
+		if err != nil {
+			return err
+		}
+		if found {
+			pt.CreatedAt = existing.CreatedAt
+		}
+		tx.queue("SET", key, redisJSON(pt))
+		tx.queue("SADD", r.userSetKey(userID, "push-tokens"), token)
+		return nil
+	})
+	if err != nil {
+		r.logError("add push token", err)
+	}
+	return pt
+}
+
+func (r *RedisStore) ListPushTokens(ctx context.Context, userID string) []model.PushToken {
+	tokens, err := mgetJSON[model.PushToken](ctx, r, r.userSetKey(userID, "push-tokens"), func(token string) string {
+		return r.pushTokenKey(userID, token)
+	})
+	if err != nil {
+		r.logError("list push tokens", err)
+		return []model.PushToken{}
+	}
+	sortPushTokens(tokens)
+	return tokens
+}
+
+func (r *RedisStore) DeletePushToken(ctx context.Context, userID, token string) bool {
+	reply, err := r.client.do(ctx, "DEL", r.pushTokenKey(userID, token))
+	if err != nil {
+		r.logError("delete push token", err)
+		return false
+	}
+	if _, err := r.client.do(ctx, "SREM", r.userSetKey(userID, "push-tokens"), token); err != nil {
+		r.logError("delete push token", err)
+	}
+	n, _ := reply.(int64)
+	return n > 0
+}
+
+// Sessions.
+
+func (r *RedisStore) GetOrCreateSession(ctx context.Context, userID, tag, metadata string, agentState *string, dataEncryptionKey *string, nowMillis int64) (model.Session, bool, error) {
+	if userID == "" {
+		return model.Session{}, false, errors.New("missing userID")
+	}
+	if tag == "" {
+		return model.Session{}, false, errors.New("missing tag")
+	}
+	if err := checkSize("metadata", metadata, r.limits.MaxMetadataBytes); err != nil {
+		return model.Session{}, false, err
+	}
+	if err := checkOptionalSize("agentState", agentState, r.limits.MaxAgentStateBytes); err != nil {
+		return model.Session{}, false, err
+	}
+
+	tagKey := r.sessionTagKey(userID, tag)
+	var sess model.Session
+	var created bool
+	err := r.client.watch(ctx, []string{tagKey}, func(tx *redisTx) error {
+		sess, created = model.Session{}, false
+		reply, err := tx.do("GET", tagKey)
+		if err != nil {
+			return err
+		}
+		if id, ok := reply.(string); ok {
+			key := r.sessionKey(id)
+			if err := tx.watch(key); err != nil {
+				return err
+			}
+			found, err := getJSON(tx.do, key, &sess)
+			if err != nil {
+				return err
+			}
+			if found {
+				changed := false
+				if metadata != "" && metadata != sess.Metadata {
+					sess.Metadata = metadata
+					sess.MetadataVersion++
+					changed = true
+				}
+				if agentState != nil {
+					if sess.AgentState == nil || *sess.AgentState != *agentState {
+						sess.AgentState = agentState
+						sess.AgentStateVersion++
+						changed = true
+					}
+				}
+				if dataEncryptionKey != nil {
+					sess.DataEncryptionKey = dataEncryptionKey
+					changed = true
+				}
+				if changed {
+					sess.UpdatedAt = nowMillis
+					tx.queue("SET", key, redisJSON(sess))
+				}
+				return nil
+			}
+		}
+
+		sess = model.Session{
+			ID:                r.newID(),
+			UserID:            userID,
+			Tag:               tag,
+			Metadata:          metadata,
+			AgentState:        agentState,
+			DataEncryptionKey: dataEncryptionKey,
+			CreatedAt:         nowMillis,
+			UpdatedAt:         nowMillis,
+		}
+		if metadata != "" {
+			sess.MetadataVersion = 1
+		}
+		if agentState != nil {
+			sess.AgentStateVersion = 1
+		}
+		created = true
+		tx.queue("SET", r.sessionKey(sess.ID), redisJSON(sess))
+		tx.queue("SET", tagKey, sess.ID)
+		tx.queue("SADD", r.userSetKey(userID, "sessions"), sess.ID)
+		return nil
+	})
+	if err != nil {
+		r.logError("get or create session", err)
+		return model.Session{}, false, err
+	}
+	return sess, created, nil
+}
+
+func (r *RedisStore) ListSessions(ctx context.Context, userID string) []model.Session {
+	sessions, err := mgetJSON[model.Session](ctx, r, r.userSetKey(userID, "sessions"), r.sessionKey)
+	if err != nil {
+		r.logError("list sessions", err)
+		return []model.Session{}
+	}
+	result := sessions[:0]
+	for _, sess := range sessions {
+		if sess.UserID == userID && !sess.Deleted {
+			result = append(result, sess)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].UpdatedAt > result[j].UpdatedAt })
+	return result
+}
+
+func (r *RedisStore) GetSession(ctx context.Context, userID, sessionID string) (model.Session, bool) {
+	var sess model.Session
+	ok, err := getJSON(r.client.doFunc(ctx), r.sessionKey(sessionID), &sess)
+	if err != nil {
+		r.logError("get session", err)
+		return model.Session{}, false
+	}
+	if !ok || sess.UserID != userID || sess.Deleted {
+		return model.Session{}, false
+	}
+	return sess, true
+}
+
+// GetSessionByTag follows the session-tag key to the session.
+func (r *RedisStore) GetSessionByTag(ctx context.Context, userID, tag string) (model.Session, bool) {
+	reply, err := r.client.do(ctx, "GET", r.sessionTagKey(userID, tag))
+	if err != nil {
+		r.logError("get session by tag", err)
+		return model.Session{}, false
+	}
+	sessionID, _ := reply.(string)
+	if sessionID == "" {
+		return model.Session{}, false
+	}
+	return r.GetSession(ctx, userID, sessionID)
+}
+
+func (r *RedisStore) UpdateSessionMetadata(ctx context.Context, userID, sessionID string, expectedVersion int, metadata string, nowMillis int64) (status string, version int, currentValue string) {
+	tooLarge := checkSize("metadata", metadata, r.limits.MaxMetadataBytes) != nil
+	status = "not-found"
+	_, err := updateJSON(ctx, r, r.sessionKey(sessionID), func(s *model.Session) bool {
+		switch {
+		case s.UserID != userID || s.Deleted:
+			status, version, currentValue = "not-found", 0, ""
+			return false
+		case s.MetadataVersion != expectedVersion:
+			status, version, currentValue = "version-mismatch", s.MetadataVersion, s.Metadata
+			return false
+		case tooLarge:
+			status, version, currentValue = "too-large", s.MetadataVersion, s.Metadata
+			return false
+		}
+		s.Metadata = metadata
+		s.MetadataVersion++
+		s.UpdatedAt = nowMillis
+		status, version, currentValue = "success", s.MetadataVersion, metadata
+		return true
+	})
+	if err != nil {
+		r.logError("update session metadata", err)
+		return "error", 0, ""
+	}
+	return status, version, currentValue
+}
+
+func (r *RedisStore) UpdateSessionAgentState(ctx context.Context, userID, sessionID string, expectedVersion int, agentState *string, nowMillis int64) (status string, version int, currentValue *string) {
+	tooLarge := checkOptionalSize("agentState", agentState, r.limits.MaxAgentStateBytes) != nil
+	status = "not-found"
+	_, err := updateJSON(ctx, r, r.sessionKey(sessionID), func(s *model.Session) bool {
+		switch {
+		case s.UserID != userID || s.Deleted:
+			status, version, currentValue = "not-found", 0, nil
+			return false
+		case s.AgentStateVersion != expectedVersion:
+			status, version, currentValue = "version-mismatch", s.AgentStateVersion, s.AgentState
+			return false
+		case tooLarge:
+			status, version, currentValue = "too-large", s.AgentStateVersion, s.AgentState
+			return false
+		}
+		s.AgentState = agentState
+		s.AgentStateVersion++
+		s.UpdatedAt = nowMillis
+		status, version, currentValue = "success", s.AgentStateVersion, agentState
+		return true
+	})
+	if err != nil {
+		r.logError("update session agent state", err)
+		return "error", 0, nil
+	}
+	return status, version, currentValue
+}
+
+func (r *RedisStore) SetSessionActive(ctx context.Context, userID, sessionID string, active bool, activeAt int64, nowMillis int64) bool {
+	updated := false
+	_, err := updateJSON(ctx, r, r.sessionKey(sessionID), func(s *model.Session) bool {
+		updated = s.UserID == userID && !s.Deleted
+		if !updated {
+			return false
+		}
+		s.Active = active
+		if active {
+			s.ActiveAt = activeAt
+		}
+		s.UpdatedAt = nowMillis
+		return true
+	})
+	if err != nil {
+		r.logError("set session active", err)
+		return false
+	}
+	return updated
+}
+
+func (r *RedisStore) DeleteSession(ctx context.Context, userID, sessionID string, nowMillis int64) bool {
+	key := r.sessionKey(sessionID)
+	deleted := false
+	err := r.client.watch(ctx, []string{key}, func(tx *redisTx) error {
+		var sess model.Session
+		ok, err := getJSON(tx.do, key, &sess)
+		deleted = ok && sess.UserID == userID && !sess.Deleted
+		if err != nil || !deleted {
+			return err
+		}
+		tx.queue("DEL", key, r.sessionSeqKey(sessionID), r.messagesKey(sessionID), r.messageLocalIDsKey(sessionID), r.sessionLocksKey(sessionID))
+		tx.queue("SREM", r.userSetKey(userID, "sessions"), sessionID)
+		tx.queue("ZADD", r.tombstonesKey(userID), nowMillis, TombstoneSession+":"+sessionID)
+		// The tag may already point at a newer session created after a race.
+		if reply, err := tx.do("GET", r.sessionTagKey(userID, sess.Tag)); err == nil && reply == sessionID {
+			tx.queue("DEL", r.sessionTagKey(userID, sess.Tag))
+		}
+		return nil
+	})
+	if err != nil {
+		r.logError("delete session", err)
+		return false
+	}
+	if !deleted {
+		return false
+	}
+	r.publish(Event{Type: EventSessionDeleted, Origin: OriginREST, UserID: userID, SessionID: sessionID, At: nowMillis})
+	return true
+}
+
+// Messages.
+
+func (r *RedisStore) AppendMessageFrom(ctx context.Context, origin, userID, sessionID, content, checksum string, nowMillis int64) (model.SessionMessage, error) {
+	msg, _, err := r.AppendMessageOnce(ctx, origin, userID, sessionID, content, checksum, "", nowMillis)
+	return msg, err
+}
+
+// AppendMessageOnce keeps each session's local ids in a sorted set scored by
+// seq, trimmed along with the message list. A local id whose message has
+// been trimmed no longer matches.
+func (r *RedisStore) AppendMessageOnce(ctx context.Context, origin, userID, sessionID, content, checksum, localID string, nowMillis int64) (model.SessionMessage, bool, error) {
+	sum, err := verifyChecksum(content, checksum)
+	if err != nil {
+		return model.SessionMessage{}, false, err
+	}
+	key, seqKey, localIDsKey := r.sessionKey(sessionID), r.sessionSeqKey(sessionID), r.messageLocalIDsKey(sessionID)
+	var msg model.SessionMessage
+	replayed := false
+	err = r.client.watch(ctx, []string{key, seqKey, localIDsKey}, func(tx *redisTx) error {
+		var sess model.Session
+		ok, err := getJSON(tx.do, key, &sess)
+		if err != nil {
+			return err
+		}
+		if !ok || sess.UserID != userID || sess.Deleted {
+			return errors.New("session not found")
+		}
+		reply, err := tx.do("GET", seqKey)
+		if err != nil {
+			return err
+		}
+		var seq int64
+		if s, ok := reply.(string); ok {
+			if seq, err = strconv.ParseInt(s, 10, 64); err != nil {
+				return err
+			}
+		}
+		if localID != "" {
+			existing, ok, err := r.messageByLocalID(tx, sessionID, localID, seq)
+			if err != nil {
+				return err
+			}
+			if ok {
+				msg, replayed = existing, true
+				return nil
+			}
+		}
+		msg = model.SessionMessage{
+			ID:        r.newID(),
+			SessionID: sessionID,
+			Seq:       seq + 1,
+			Content:   content,
+			Checksum:  sum,
+			LocalID:   localID,
+			CreatedAt: nowMillis,
+			UpdatedAt: nowMillis,
+		}
+		sess.Seq = msg.Seq
+		sess.UpdatedAt = nowMillis
+		tx.queue("SET", key, redisJSON(sess))
+		tx.queue("SET", seqKey, msg.Seq)
+		tx.queue("RPUSH", r.messagesKey(sessionID), redisJSON(msg))
+		tx.queue("LTRIM", r.messagesKey(sessionID), -r.maxMessages, -1)
+		if localID != "" {
+			tx.queue("ZADD", localIDsKey, msg.Seq, localID)
+			tx.queue("ZREMRANGEBYSCORE", localIDsKey, "-inf", msg.Seq-int64(r.maxMessages))
+		}
+		return nil
+	})
+	if err != nil {
+		return model.SessionMessage{}, false, err
+	}
+	if replayed {
+		return msg, false, nil
+	}
+	r.publish(Event{Type: EventMessageAppended, Origin: origin, UserID: userID, SessionID: sessionID, Message: &msg, At: nowMillis})
+	return msg, true, nil
+}
+
+// messageByLocalID finds the message sent with localID in a session whose
+// newest seq is lastSeq. The list holds consecutive seqs ending at lastSeq,
+// so the message sits at a fixed offset from the tail.
+func (r *RedisStore) messageByLocalID(tx *redisTx, sessionID, localID string, lastSeq int64) (model.SessionMessage, bool, error) {
+	reply, err := tx.do("ZSCORE", r.messageLocalIDsKey(sessionID), localID)
+	if err != nil || reply == nil {
+		return model.SessionMessage{}, false, err
+	}
+	seq, err := strconv.ParseInt(reply.(string), 10, 64)
+	if err != nil {
+		return model.SessionMessage{}, false, err
+	}
+	reply, err = tx.do("LINDEX", r.messagesKey(sessionID), seq-lastSeq-1)
+	if err != nil || reply == nil {
+		return model.SessionMessage{}, false, err
+	}
+	var msg model.SessionMessage
+	if err := json.Unmarshal([]byte(reply.(string)), &msg); err != nil {
+		return model.SessionMessage{}, false, err
+	}
+	return msg, msg.Seq == seq && msg.LocalID == localID, nil
+}
+
+// ListMessages relies on each list holding consecutive seqs, so the first
+// entry locates after+1 without scanning.
+func (r *RedisStore) ListMessages(ctx context.Context, userID, sessionID string, after int64, limit int) ([]model.SessionMessage, error) {
+	if _, ok := r.GetSession(ctx, userID, sessionID); !ok {
+		return nil, errors.New("session not found")
+	}
+	if limit <= 0 {
+		limit = 100
+	}
+	key := r.messagesKey(sessionID)
+	reply, err := r.client.do(ctx, "LINDEX", key, 0)
+	if err != nil || reply == nil {
+		return nil, err
+	}
+	var first model.SessionMessage
+	if err := json.Unmarshal([]byte(reply.(string)), &first); err != nil {
+		return nil, err
+	}
+	start := after - first.Seq + 1
+	if start < 0 {
+		start = 0
+	}
+	reply, err = r.client.do(ctx, "LRANGE", key, start, start+int64(limit)-1)
+	if err != nil {
+		return nil, err
+	}
+	var result []model.SessionMessage
+	for _, s := range redisStrings(reply) {
+		var m model.SessionMessage
+		if err := json.Unmarshal([]byte(s), &m); err != nil {
+			return nil, err
+		}
+		// Trimming between LINDEX and LRANGE shifts the list left.
+		if m.Seq > after {
+			result = append(result, m)
+		}
+	}
+	return result, nil
+}
+
+// PruneMessages drops messages older than Options.MessageRetention from the
+// head of every session's list. The per-session cap is already applied on
+// append, and seqs live in their own key, so nothing else needs keeping.
+func (r *RedisStore) PruneMessages(ctx context.Context, nowMillis int64) (int, error) {
+	if r.messageRetention <= 0 {
+		return 0, nil
+	}
+	cutoff := messageCutoff(r.messageRetention, nowMillis)
+	keys, err := r.scanKeys(ctx, redisGlobEscape(r.prefix)+"messages:*")
+	if err != nil {
+		return 0, err
+	}
+	total := 0
+	for _, key := range keys {
+		var expired int
+		err := r.client.watch(ctx, []string{key}, func(tx *redisTx) error {
+			n, err := countExpiredMessages(tx, key, cutoff)
+			expired = n
+			if err != nil || n == 0 {
+				return err
+			}
+			tx.queue("LTRIM", key, n, -1)
+			return nil
+		})
+		if err != nil {
+			return total, err
+		}
+		total += expired
+	}
+	return total, nil
+}
+
+const redisPruneBatch = 100
+
+// countExpiredMessages counts the leading messages of the list at key created
+// before cutoff.
+func countExpiredMessages(tx *redisTx, key string, cutoff int64) (int, error) {
+	n := 0
+	for {
+		reply, err := tx.do("LRANGE", key, n, n+redisPruneBatch-1)
+		if err != nil {
+			return 0, err
+		}
+		items := redisStrings(reply)
+		for _, s := range items {
+			var m model.SessionMessage
+			if err := json.Unmarshal([]byte(s), &m); err != nil {
+				return 0, err
+			}
+			if m.CreatedAt >= cutoff {
+				return n, nil
+			}
+			n++
+		}
+		if len(items) < redisPruneBatch {
+			return n, nil
+		}
+	}
+}
+
+// scanKeys lists the keys matching pattern without blocking the server the
+// way KEYS would.
+func (r *RedisStore) scanKeys(ctx context.Context, pattern string) ([]string, error) {
+	var keys []string
+	cursor := "0"
+	for {
+		reply, err := r.client.do(ctx, "SCAN", cursor, "MATCH", pattern, "COUNT", 500)
+		if err != nil {
+			return nil, err
+		}
+		parts, _ := reply.([]any)
+		if len(parts) != 2 {
+			return nil, errors.New("redis: unexpected SCAN reply")
+		}
+		cursor, _ = parts[0].(string)
+		keys = append(keys, redisStrings(parts[1])...)
+		if cursor == "0" || cursor == "" {
+			return keys, nil
+		}
+	}
+}
+
+func redisGlobEscape(s string) string {
+	var b strings.Builder
+	for _, c := range s {
+		if strings.ContainsRune(`*?[]\`, c) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// Machines.
+
+func (r *RedisStore) UpsertMachine(ctx context.Context, userID, machineID, metadata string, daemonState *string, dataEncryptionKey *string, nowMillis int64) (model.Machine, bool, error) {
+	if machineID == "" {
+		return model.Machine{}, false, errors.New("missing machine id")
+	}
+	if err := checkSize("metadata", metadata, r.limits.MaxMetadataBytes); err != nil {
+		return model.Machine{}, false, err
+	}
+	if err := checkOptionalSize("daemonState", daemonState, r.limits.MaxDaemonStateBytes); err != nil {
+		return model.Machine{}, false, err
+	}
+
+	key := r.machineKey(userID, machineID)
+	var m model.Machine
+	var created bool
+	err := r.client.watch(ctx, []string{key}, func(tx *redisTx) error {
+		m, created = model.Machine{}, false
+		found, err := getJSON(tx.do, key, &m)
+		if err != nil {
+			return err
+		}
+		if found {
+			changed := false
+			if metadata != "" && metadata != m.Metadata {
+				m.Metadata = metadata
+				m.MetadataVersion++
+				changed = true
+			}
+			if daemonState != nil {
+				if m.DaemonState == nil || *m.DaemonState != *daemonState {
+					m.DaemonState = daemonState
+					m.DaemonStateVersion++
+					changed = true
+				}
+			}
+			if dataEncryptionKey != nil {
+				m.DataEncryptionKey = dataEncryptionKey
+				changed = true
+			}
+			if changed {
+				m.UpdatedAt = nowMillis
+				tx.queue("SET", key, redisJSON(m))
+			}
+			return nil
+		}
+
+		m = model.Machine{
+			ID:                machineID,
+			UserID:            userID,
+			Metadata:          metadata,
+			DaemonState:       daemonState,
+			DataEncryptionKey: dataEncryptionKey,
+			CreatedAt:         nowMillis,
+			UpdatedAt:         nowMillis,
+		}
+		if metadata != "" {
+			m.MetadataVersion = 1
+		}
+		if daemonState != nil {
+			m.DaemonStateVersion = 1
+		}
+		created = true
+		tx.queue("SET", key, redisJSON(m))
+		tx.queue("SADD", r.userSetKey(userID, "machines"), machineID)
+		tx.queue("ZREM", r.tombstonesKey(userID), TombstoneMachine+":"+machineID)
+		return nil
+	})
+	if err != nil {
+		r.logError("upsert machine", err)
+		return model.Machine{}, false, err
+	}
+	return m, created, nil
+}
+
+func (r *RedisStore) GetMachine(ctx context.Context, userID, machineID string) (model.Machine, bool) {
+	var m model.Machine
+	ok, err := getJSON(r.client.doFunc(ctx), r.machineKey(userID, machineID), &m)
+	if err != nil {
+		r.logError("get machine", err)
+		return model.Machine{}, false
+	}
+	if !ok {
+		return model.Machine{}, false
+	}
+	return m, true
+}
+
+func (r *RedisStore) ListMachines(ctx context.Context, userID string) []model.Machine {
+	machines, err := mgetJSON[model.Machine](ctx, r, r.userSetKey(userID, "machines"), func(id string) string {
+		return r.machineKey(userID, id)
+	})
+	if err != nil {
+		r.logError("list machines", err)
+		return []model.Machine{}
+	}
+	sort.Slice(machines, func(i, j int) bool { return machines[i].UpdatedAt > machines[j].UpdatedAt })
+	return machines
+}
+
+func (r *RedisStore) UpdateMachineMetadata(ctx context.Context, userID, machineID string, expectedVersion int, metadata string, nowMillis int64) (status string, version int, currentValue string) {
+	tooLarge := checkSize("metadata", metadata, r.limits.MaxMetadataBytes) != nil
+	status = "not-found"
+	_, err := updateJSON(ctx, r, r.machineKey(userID, machineID), func(m *model.Machine) bool {
+		switch {
+		case m.MetadataVersion != expectedVersion:
+			status, version, currentValue = "version-mismatch", m.MetadataVersion, m.Metadata
+			return false
+		case tooLarge:
+			status, version, currentValue = "too-large", m.MetadataVersion, m.Metadata
+			return false
+		}
+		m.Metadata = metadata
+		m.MetadataVersion++
+		m.UpdatedAt = nowMillis
+		status, version, currentValue = "success", m.MetadataVersion, metadata
+		return true
+	})
+	if err != nil {
+		r.logError("update machine metadata", err)
+		return "error", 0, ""
+	}
+	return status, version, currentValue
+}
+
+func (r *RedisStore) UpdateMachineDaemonState(ctx context.Context, userID, machineID string, expectedVersion int, daemonState *string, nowMillis int64) (status string, version int, currentValue *string) {
+	tooLarge := checkOptionalSize("daemonState", daemonState, r.limits.MaxDaemonStateBytes) != nil
+	status = "not-found"
+	_, err := updateJSON(ctx, r, r.machineKey(userID, machineID), func(m *model.Machine) bool {
+		switch {
+		case m.DaemonStateVersion != expectedVersion:
+			status, version, currentValue = "version-mismatch", m.DaemonStateVersion, m.DaemonState
+			return false
+		case tooLarge:
+			status, version, currentValue = "too-large", m.DaemonStateVersion, m.DaemonState
+			return false
+		}
+		m.DaemonState = daemonState
+		m.DaemonStateVersion++
+		m.UpdatedAt = nowMillis
+		status, version, currentValue = "success", m.DaemonStateVersion, daemonState
+		return true
+	})
+	if err != nil {
+		r.logError("update machine daemon state", err)
+		return "error", 0, nil
+	}
+	return status, version, currentValue
+}
+
+func (r *RedisStore) DeleteMachine(ctx context.Context, userID, machineID string, nowMillis int64) bool {
+	key := r.machineKey(userID, machineID)
+	deleted := false
+	err := r.client.watch(ctx, []string{key}, func(tx *redisTx) error {
+		var m model.Machine
+		ok, err := getJSON(tx.do, key, &m)
+		deleted = ok
+		if err != nil || !deleted {
+			return err
+		}
+		tx.queue("DEL", key)
+		tx.queue("SREM", r.userSetKey(userID, "machines"), machineID)
+		tx.queue("ZADD", r.tombstonesKey(userID), nowMillis, TombstoneMachine+":"+machineID)
+		return nil
+	})
+	if err != nil {
+		r.logError("delete machine", err)
+		return false
+	}
+	if !deleted {
+		return false
+	}
+	r.publish(Event{Type: EventMachineDeleted, Origin: OriginREST, UserID: userID, MachineID: machineID, At: nowMillis})
+	return true
+}
+
+// rekeyMachines moves machines written before machine ids were namespaced by
+// user, under machine:<id>, to their per-user keys.
+func (r *RedisStore) rekeyMachines(ctx context.Context) error {
+	keys, err := r.scanKeys(ctx, redisGlobEscape(r.prefix)+"machine:*")
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		err := r.client.watch(ctx, []string{key}, func(tx *redisTx) error {
+			var m model.Machine
+			ok, err := getJSON(tx.do, key, &m)
+			if err != nil || !ok {
+				return err
+			}
+			if rekeyed := r.machineKey(m.UserID, m.ID); rekeyed != key {
+				tx.queue("SET", rekeyed, redisJSON(m))
+				tx.queue("DEL", key)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Artifacts.
+
+func (r *RedisStore) nextArtifactSeq(ctx context.Context) (int64, error) {
+	reply, err := r.client.do(ctx, "INCR", r.artifactSeqKey())
+	if err != nil {
+		return 0, err
+	}
+	return reply.(int64), nil
+}
+
+func (r *RedisStore) ListArtifacts(ctx context.Context, userID string) []model.Artifact {
+	artifacts, err := mgetJSON[model.Artifact](ctx, r, r.userSetKey(userID, "artifacts"), func(id string) string {
+		return r.artifactKey(userID, id)
+	})
+	if err != nil {
+		r.logError("list artifacts", err)
+		return []model.Artifact{}
+	}
+	result := artifacts[:0]
+	for _, a := range artifacts {
+		if !a.Deleted {
+			result = append(result, a)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].UpdatedAt != result[j].UpdatedAt {
+			return result[i].UpdatedAt > result[j].UpdatedAt
+		}
+		return result[i].ID < result[j].ID
+	})
+	return result
+}
+
+func (r *RedisStore) GetArtifact(ctx context.Context, userID, artifactID string) (model.Artifact, bool) {
+	var a model.Artifact
+	ok, err := getJSON(r.client.doFunc(ctx), r.artifactKey(userID, artifactID), &a)
+	if err != nil {
+		r.logError("get artifact", err)
+		return model.Artifact{}, false
+	}
+	if !ok || a.Deleted {
+		return model.Artifact{}, false
+	}
+	return a, true
+}
+
+func (r *RedisStore) CreateArtifactWithChecksums(ctx context.Context, userID, artifactID, header, body, dataEncryptionKey string, sums ArtifactChecksums, nowMillis int64) (model.Artifact, bool, error) {
+	if userID == "" {
+		return model.Artifact{}, false, errors.New("missing user id")
+	}
+	if artifactID == "" {
+		return model.Artifact{}, false, errors.New("missing artifact id")
+	}
+	if header == "" || body == "" || dataEncryptionKey == "" {
+		return model.Artifact{}, false, errors.New("missing artifact fields")
+	}
+	headerChecksum, err := verifyChecksum(header, sums.Header)
+	if err != nil {
+		return model.Artifact{}, false, err
+	}
+	bodyChecksum, err := verifyChecksum(body, sums.Body)
+	if err != nil {
+		return model.Artifact{}, false, err
+	}
+	seq, err := r.nextArtifactSeq(ctx)
+	if err != nil {
+		r.logError("create artifact", err)
+		return model.Artifact{}, false, err
+	}
+
+	// A deleted artifact with the same id is replaced; a live one is returned
+	// unchanged.
+	key := r.artifactKey(userID, artifactID)
+	var a model.Artifact
+	var created bool
+	err = r.client.watch(ctx, []string{key}, func(tx *redisTx) error {
+		a, created = model.Artifact{}, false
+		found, err := getJSON(tx.do, key, &a)
+		if err != nil || (found && !a.Deleted) {
+			return err
+		}
+		a = model.Artifact{
+			ID:                artifactID,
+			UserID:            userID,
+			Header:            header,
+			HeaderVersion:     1,
+			Body:              body,
+			BodyVersion:       1,
+			DataEncryptionKey: dataEncryptionKey,
+			HeaderChecksum:    headerChecksum,
+			BodyChecksum:      bodyChecksum,
+			Seq:               seq,
+			CreatedAt:         nowMillis,
+			UpdatedAt:         nowMillis,
+		}
+		created = true
+		tx.queue("SET", key, redisJSON(a))
+		tx.queue("SADD", r.userSetKey(userID, "artifacts"), artifactID)
+		return nil
+	})
+	if err != nil {
+		r.logError("create artifact", err)
+		return model.Artifact{}, false, err
+	}
+	return a, created, nil
+}
+
+func (r *RedisStore) UpdateArtifactWithChecksums(ctx context.Context, userID, artifactID string, header *string, expectedHeaderVersion *int, body *string, expectedBodyVersion *int, sums ArtifactChecksums, nowMillis int64) (ArtifactUpdateResult, error) {
+	if userID == "" {
+		return ArtifactUpdateResult{}, errors.New("missing user id")
+	}
+	if artifactID == "" {
+		return ArtifactUpdateResult{}, errors.New("missing artifact id")
+	}
+	var headerChecksum, bodyChecksum string
+	if header != nil {
+		sum, err := verifyChecksum(*header, sums.Header)
+		if err != nil {
+			return ArtifactUpdateResult{}, err
+		}
+		headerChecksum = sum
+	}
+	if body != nil {
+		sum, err := verifyChecksum(*body, sums.Body)
+		if err != nil {
+			return ArtifactUpdateResult{}, err
+		}
+		bodyChecksum = sum
+	}
+	seq, err := r.nextArtifactSeq(ctx)
+	if err != nil {
+		return ArtifactUpdateResult{}, err
+	}
+
+	var res ArtifactUpdateResult
+	found, err := updateJSON(ctx, r, r.artifactKey(userID, artifactID), func(a *model.Artifact) bool {
+		if a.Deleted {
+			return false
+		}
+		mismatch := func() ArtifactUpdateResult {
+			chv, cbv, ch, cb := a.HeaderVersion, a.BodyVersion, a.Header, a.Body
+			return ArtifactUpdateResult{
+				CurrentHeaderVersion: &chv,
+				CurrentBodyVersion:   &cbv,
+				CurrentHeader:        &ch,
+				CurrentBody:          &cb,
+			}
+		}
+		if header != nil && (expectedHeaderVersion == nil || *expectedHeaderVersion != a.HeaderVersion) {
+			res = mismatch()
+			return false
+		}
+		if body != nil && (expectedBodyVersion == nil || *expectedBodyVersion != a.BodyVersion) {
+			res = mismatch()
+			return false
+		}
+		res = ArtifactUpdateResult{Success: true}
+		if header != nil {
+			a.Header = *header
+			a.HeaderChecksum = headerChecksum
+			a.HeaderVersion++
+			hv := a.HeaderVersion
+			res.HeaderVersion = &hv
+		}
+		if body != nil {
+			a.Body = *body
+			a.BodyChecksum = bodyChecksum
+			a.BodyVersion++
+			bv := a.BodyVersion
+			res.BodyVersion = &bv
+		}
+		a.Seq = seq
+		a.UpdatedAt = nowMillis
+		return true
+	})
+	if err != nil {
+		return ArtifactUpdateResult{}, err
+	}
+	if !found || (!res.Success && res.CurrentHeaderVersion == nil) {
+		return ArtifactUpdateResult{}, errors.New("artifact not found")
+	}
+	return res, nil
+}
+
+func (r *RedisStore) DeleteArtifact(ctx context.Context, userID, artifactID string) bool {
+	if userID == "" || artifactID == "" {
+		return false
+	}
+	deleted := false
+	_, err := updateJSON(ctx, r, r.artifactKey(userID, artifactID), func(a *model.Artifact) bool {
+		deleted = !a.Deleted
+		a.Deleted = true
+		a.UpdatedAt = clock.Now(r.clock).UnixMilli()
+		return deleted
+	})
+	if err != nil {
+		r.logError("delete artifact", err)
+		return false
+	}
+	return deleted
+}
+
+// Purge applies the same rules as Store.Purge. Deleted sessions are removed
+// outright by DeleteSession, so only artifacts and tombstones are left.
+func (r *RedisStore) Purge(ctx context.Context, nowMillis int64) (PurgeStats, error) {
+	var stats PurgeStats
+	cutoff := purgeCutoff(r.purgeGrace, nowMillis)
+	keys, err := r.scanKeys(ctx, redisGlobEscape(r.prefix)+"artifact:*")
+	if err != nil {
+		return stats, err
+	}
+	for _, key := range keys {
+		purged := false
+		err := r.client.watch(ctx, []string{key}, func(tx *redisTx) error {
+			var a model.Artifact
+			ok, err := getJSON(tx.do, key, &a)
+			purged = ok && a.Deleted && a.UpdatedAt < cutoff
+			if err != nil || !purged {
+				return err
+			}
+			tx.queue("DEL", key)
+			tx.queue("SREM", r.userSetKey(a.UserID, "artifacts"), a.ID)
+			return nil
+		})
+		if err != nil {
+			return stats, err
+		}
+		if purged {
+			stats.Artifacts++
+		}
+	}
+
+	keys, err = r.scanKeys(ctx, redisGlobEscape(r.prefix)+"user:*:tombstones")
+	if err != nil {
+		return stats, err
+	}
+	max := "(" + strconv.FormatInt(r.TombstoneCutoff(nowMillis), 10)
+	for _, key := range keys {
+		reply, err := r.client.do(ctx, "ZREMRANGEBYSCORE", key, "-inf", max)
+		if err != nil {
+			return stats, err
+		}
+		n, _ := reply.(int64)
+		stats.Tombstones += int(n)
+	}
+	return stats, nil
+}
+
+// Tombstones.
+
+func (r *RedisStore) TombstoneCutoff(nowMillis int64) int64 {
+	return nowMillis - r.tombstoneRetention.Milliseconds()
+}
+
+func (r *RedisStore) ListTombstones(ctx context.Context, userID string, since int64, nowMillis int64) []model.Tombstone {
+	key := r.tombstonesKey(userID)
+	if _, err := r.client.do(ctx, "ZREMRANGEBYSCORE", key, "-inf", "("+strconv.FormatInt(r.TombstoneCutoff(nowMillis), 10)); err != nil {
+		r.logError("prune tombstones", err)
+	}
+	reply, err := r.client.do(ctx, "ZRANGEBYSCORE", key, "("+strconv.FormatInt(since, 10), "+inf", "WITHSCORES")
+	if err != nil {
+		r.logError("list tombstones", err)
+		return []model.Tombstone{}
+	}
+	items := redisStrings(reply)
+	result := make([]model.Tombstone, 0, len(items)/2)
+	for i := 0; i+1 < len(items); i += 2 {
+		kind, id, ok := strings.Cut(items[i], ":")
+		if !ok {
+			continue
+		}
+		deletedAt, err := strconv.ParseFloat(items[i+1], 64)
+		if err != nil {
+			r.logError("scan tombstone", err)
+			continue
+		}
+		result = append(result, model.Tombstone{Kind: kind, ID: id, UserID: userID, DeletedAt: int64(deletedAt)})
+	}
+	return result
+}
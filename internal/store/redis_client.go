@@ -0,0 +1,392 @@
+package store
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	redisDialTimeout = 5 * time.Second
+	redisIOTimeout   = 10 * time.Second
+	redisMaxIdle     = 16
+	// redisTxAttempts bounds how often a WATCH transaction is retried after
+	// another client touched one of its keys.
+	redisTxAttempts = 20
+)
+
+// redisError is an error reply from the server.
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+var errRedisConflict = errors.New("redis: transaction conflict")
+
+// redisClient speaks just enough RESP2 for RedisStore over a small pool of
+// connections. Replies decode to string (simple and bulk strings), int64,
+// []any, or nil for null bulk strings and arrays.
+type redisClient struct {
+	addr       string
+	serverName string
+	useTLS     bool
+	username   string
+	password   string
+	db         int
+
+	mu     sync.Mutex
+	idle   []*redisConn
+	closed bool
+}
+
+type redisConn struct {
+	net.Conn
+	r *bufio.Reader
+	w *bufio.Writer
+	// ctx, set by bind, cuts round trips short when it is done.
+	ctx context.Context
+}
+
+// newRedisClient parses redis://[user:password@]host[:port][/db]; rediss://
+// connects over TLS.
+func newRedisClient(rawURL string) (*redisClient, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid redis url: %w", err)
+	}
+	if u.Scheme != "redis" && u.Scheme != "rediss" {
+		return nil, fmt.Errorf("invalid redis url scheme %q", u.Scheme)
+	}
+	c := &redisClient{addr: u.Host, serverName: u.Hostname(), useTLS: u.Scheme == "rediss"}
+	if u.Port() == "" {
+		c.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		c.username = u.User.Username()
+		c.password, _ = u.User.Password()
+	}
+	if db := strings.TrimPrefix(u.Path, "/"); db != "" {
+		n, err := strconv.Atoi(db)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid redis database %q", db)
+		}
+		c.db = n
+	}
+	return c, nil
+}
+
+func (c *redisClient) dial(ctx context.Context) (*redisConn, error) {
+	dialer := &net.Dialer{Timeout: redisDialTimeout}
+	var nc net.Conn
+	var err error
+	if c.useTLS {
+		tlsDialer := &tls.Dialer{NetDialer: dialer, Config: &tls.Config{ServerName: c.serverName}}
+		nc, err = tlsDialer.DialContext(ctx, "tcp", c.addr)
+	} else {
+		nc, err = dialer.DialContext(ctx, "tcp", c.addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	cn := &redisConn{Conn: nc, r: bufio.NewReader(nc), w: bufio.NewWriter(nc)}
+	if c.password != "" {
+		args := []any{"AUTH", c.password}
+		if c.username != "" {
+			args = []any{"AUTH", c.username, c.password}
+		}
+		if _, err := cn.do(args...); err != nil {
+			_ = nc.Close()
+			return nil, err
+		}
+	}
+	if c.db != 0 {
+		if _, err := cn.do("SELECT", c.db); err != nil {
+			_ = nc.Close()
+			return nil, err
+		}
+	}
+	return cn, nil
+}
+
+func (c *redisClient) get(ctx context.Context) (*redisConn, error) {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil, errors.New("redis: client closed")
+	}
+	if n := len(c.idle); n > 0 {
+		cn := c.idle[n-1]
+		c.idle = c.idle[:n-1]
+		c.mu.Unlock()
+		return cn, nil
+	}
+	c.mu.Unlock()
+	return c.dial(ctx)
+}
+
+// put returns cn to the pool unless the last round trip failed at the
+// connection level, which may have left a reply unread.
+func (c *redisClient) put(cn *redisConn, err error) {
+	var replyErr redisError
+	if err != nil && !errors.As(err, &replyErr) && !errors.Is(err, errRedisConflict) {
+		_ = cn.Close()
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed || len(c.idle) >= redisMaxIdle {
+		_ = cn.Close()
+		return
+	}
+	c.idle = append(c.idle, cn)
+}
+
+func (c *redisClient) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	for _, cn := range c.idle {
+		_ = cn.Close()
+	}
+	c.idle = nil
+	return nil
+}
+
+func (c *redisClient) do(ctx context.Context, args ...any) (any, error) {
+	cn, err := c.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	unbind := cn.bind(ctx)
+	reply, err := cn.do(args...)
+	unbind()
+	c.put(cn, err)
+	return reply, err
+}
+
+// doFunc is do bound to ctx, for helpers that take either a client or a
+// transaction.
+func (c *redisClient) doFunc(ctx context.Context) func(args ...any) (any, error) {
+	return func(args ...any) (any, error) { return c.do(ctx, args...) }
+}
+
+// redisTx is a connection pinned for one WATCH transaction. Reads go straight
+// to the server; writes are queued and sent inside MULTI/EXEC.
+type redisTx struct {
+	cn     *redisConn
+	queued [][]any
+}
+
+func (tx *redisTx) watch(keys ...string) error {
+	args := make([]any, 0, len(keys)+1)
+	args = append(args, "WATCH")
+	for _, k := range keys {
+		args = append(args, k)
+	}
+	_, err := tx.cn.do(args...)
+	return err
+}
+
+func (tx *redisTx) do(args ...any) (any, error) {
+	return tx.cn.do(args...)
+}
+
+func (tx *redisTx) queue(args ...any) {
+	tx.queued = append(tx.queued, args)
+}
+
+// watch runs fn on a pinned connection after watching keys, then commits the
+// writes fn queued. It retries fn from scratch when another client changed a
+// watched key before EXEC.
+func (c *redisClient) watch(ctx context.Context, keys []string, fn func(tx *redisTx) error) error {
+	for attempt := 0; attempt < redisTxAttempts; attempt++ {
+		if attempt > 0 {
+			// Jitter so contending writers stop colliding in lockstep.
+			time.Sleep(time.Duration(rand.Int63n(int64(attempt) * int64(time.Millisecond))))
+		}
+		cn, err := c.get(ctx)
+		if err != nil {
+			return err
+		}
+		unbind := cn.bind(ctx)
+		err = c.runTx(cn, keys, fn)
+		unbind()
+		c.put(cn, err)
+		if !errors.Is(err, errRedisConflict) {
+			return err
+		}
+	}
+	return errRedisConflict
+}
+
+func (c *redisClient) runTx(cn *redisConn, keys []string, fn func(tx *redisTx) error) error {
+	tx := &redisTx{cn: cn}
+	if err := tx.watch(keys...); err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil || len(tx.queued) == 0 {
+		if _, uerr := cn.do("UNWATCH"); uerr != nil && err == nil {
+			err = uerr
+		}
+		return err
+	}
+	if _, err := cn.do("MULTI"); err != nil {
+		return err
+	}
+	for _, args := range tx.queued {
+		if _, err := cn.do(args...); err != nil {
+			_, _ = cn.do("DISCARD")
+			return err
+		}
+	}
+	reply, err := cn.do("EXEC")
+	if err != nil {
+		return err
+	}
+	if reply == nil {
+		return errRedisConflict
+	}
+	for _, r := range reply.([]any) {
+		if rerr, ok := r.(redisError); ok {
+			return rerr
+		}
+	}
+	return nil
+}
+
+// bind makes round trips on cn give up once ctx is done, interrupting one
+// in flight. The returned func undoes it.
+func (cn *redisConn) bind(ctx context.Context) (unbind func()) {
+	cn.ctx = ctx
+	stop := context.AfterFunc(ctx, func() { _ = cn.SetDeadline(time.Unix(1, 0)) })
+	return func() {
+		stop()
+		cn.ctx = nil
+	}
+}
+
+func (cn *redisConn) do(args ...any) (any, error) {
+	deadline := time.Now().Add(redisIOTimeout)
+	if cn.ctx != nil {
+		if d, ok := cn.ctx.Deadline(); ok && d.Before(deadline) {
+			deadline = d
+		}
+	}
+	_ = cn.SetDeadline(deadline)
+	// Checked after setting the deadline so a cancellation racing with it
+	// is not lost.
+	if err := cn.ctxErr(); err != nil {
+		return nil, err
+	}
+	if err := writeRedisCommand(cn.w, args); err != nil {
+		return nil, cn.wrapErr(err)
+	}
+	if err := cn.w.Flush(); err != nil {
+		return nil, cn.wrapErr(err)
+	}
+	reply, err := readRedisReply(cn.r)
+	if err != nil {
+		return nil, cn.wrapErr(err)
+	}
+	if rerr, ok := reply.(redisError); ok {
+		return nil, rerr
+	}
+	return reply, nil
+}
+
+func (cn *redisConn) ctxErr() error {
+	if cn.ctx == nil {
+		return nil
+	}
+	return cn.ctx.Err()
+}
+
+// wrapErr reports a round trip interrupted by bind as the context's error
+// rather than the i/o timeout it surfaced as.
+func (cn *redisConn) wrapErr(err error) error {
+	if ctxErr := cn.ctxErr(); ctxErr != nil {
+		return ctxErr
+	}
+	return err
+}
+
+func writeRedisCommand(w *bufio.Writer, args []any) error {
+	fmt.Fprintf(w, "*%d\r\n", len(args))
+	for _, a := range args {
+		var s string
+		switch v := a.(type) {
+		case string:
+			s = v
+		case []byte:
+			s = string(v)
+		case int:
+			s = strconv.Itoa(v)
+		case int64:
+			s = strconv.FormatInt(v, 10)
+		default:
+			return fmt.Errorf("redis: unsupported argument type %T", a)
+		}
+		fmt.Fprintf(w, "$%d\r\n%s\r\n", len(s), s)
+	}
+	return nil
+}
+
+// readRedisReply decodes one reply. Error replies nested in arrays (EXEC
+// results) are returned as redisError values rather than errors.
+func readRedisReply(r *bufio.Reader) (any, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("redis: malformed reply %q", line)
+	}
+	kind, body := line[0], line[1:len(line)-2]
+	switch kind {
+	case '+':
+		return body, nil
+	case '-':
+		return redisError(body), nil
+	case ':':
+		return strconv.ParseInt(body, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, fmt.Errorf("redis: malformed bulk length %q", body)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, fmt.Errorf("redis: malformed array length %q", body)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		items := make([]any, n)
+		for i := range items {
+			if items[i], err = readRedisReply(r); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	default:
+		return nil, fmt.Errorf("redis: unexpected reply type %q", kind)
+	}
+}
@@ -0,0 +1,376 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"sort"
+
+	"happy-server-lite/internal/model"
+)
+
+var (
+	// ErrRefreshTokenInvalid is returned for refresh tokens that are
+	// unknown, expired or revoked.
+	ErrRefreshTokenInvalid = errors.New("invalid refresh token")
+	// ErrRefreshTokenReused is returned when a refresh token is presented
+	// again after it was rotated. One of its holders stole it, so the grant
+	// is revoked for both.
+	ErrRefreshTokenReused = errors.New("refresh token reused")
+)
+
+// sortRefreshTokens orders tokens oldest grant first.
+func sortRefreshTokens(tokens []model.RefreshToken) {
+	sort.Slice(tokens, func(i, j int) bool {
+		if tokens[i].CreatedAt != tokens[j].CreatedAt {
+			return tokens[i].CreatedAt < tokens[j].CreatedAt
+		}
+		return tokens[i].ID < tokens[j].ID
+	})
+}
+
+// rotateRefreshToken checks secretHash against rt and, when it is current,
+// moves rt on to newSecretHash. drop reports that the grant is spent and
+// must be removed.
+func rotateRefreshToken(rt *model.RefreshToken, secretHash, newSecretHash string, expiresAt, nowMillis int64) (drop bool, err error) {
+	switch {
+	case rt.ExpiresAt <= nowMillis:
+		return true, ErrRefreshTokenInvalid
+	case secretHash == rt.PreviousHash:
+		return true, ErrRefreshTokenReused
+	case secretHash != rt.SecretHash:
+		return false, ErrRefreshTokenInvalid
+	}
+	rt.PreviousHash = rt.SecretHash
+	rt.SecretHash = newSecretHash
+	rt.LastUsedAt = nowMillis
+	rt.ExpiresAt = expiresAt
+	return false, nil
+}
+
+// CreateRefreshToken grants device deviceID of userID new access tokens
+// until expiresAt, for the secret hashing to secretHash. Expired grants of
+// the user are dropped on the way.
+func (s *Store) CreateRefreshToken(ctx context.Context, userID, deviceID string, device *model.AuthRequestDevice, secretHash string, expiresAt, nowMillis int64) model.RefreshToken {
+	rt := model.RefreshToken{
+		ID:         s.newID(),
+		UserID:     userID,
+		DeviceID:   deviceID,
+		Device:     device,
+		SecretHash: secretHash,
+		CreatedAt:  nowMillis,
+		LastUsedAt: nowMillis,
+		ExpiresAt:  expiresAt,
+	}
+
+	s.mu.Lock()
+	for id, old := range s.refreshTokens {
+		if old.UserID == userID && old.ExpiresAt <= nowMillis {
+			delete(s.refreshTokens, id)
+			s.unpersist(recordRefreshToken, id)
+		}
+	}
+	s.refreshTokens[rt.ID] = rt
+	s.persist(recordRefreshToken, rt.ID, rt)
+	s.mu.Unlock()
+	s.saveAccounts()
+	return rt
+}
+
+// RotateRefreshToken exchanges the secret hashing to secretHash of grant id
+// for one hashing to newSecretHash, valid until expiresAt.
+func (s *Store) RotateRefreshToken(ctx context.Context, id, secretHash, newSecretHash string, expiresAt, nowMillis int64) (model.RefreshToken, error) {
+	s.mu.Lock()
+	rt, ok := s.refreshTokens[id]
+	if !ok {
+		s.mu.Unlock()
+		return model.RefreshToken{}, ErrRefreshTokenInvalid
+	}
+	drop, err := rotateRefreshToken(&rt, secretHash, newSecretHash, expiresAt, nowMillis)
+	switch {
+	case drop:
+		delete(s.refreshTokens, id)
+		s.unpersist(recordRefreshToken, id)
+	case err == nil:
+		s.refreshTokens[id] = rt
+		s.persist(recordRefreshToken, id, rt)
+	}
+	s.mu.Unlock()
+	if drop || err == nil {
+		s.saveAccounts()
+	}
+	return rt, err
+}
+
+// ListRefreshTokens returns the user's grants that have not expired.
+func (s *Store) ListRefreshTokens(ctx context.Context, userID string, nowMillis int64) []model.RefreshToken {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	result := make([]model.RefreshToken, 0)
+	for _, rt := range s.refreshTokens {
+		if rt.UserID == userID && rt.ExpiresAt > nowMillis {
+			result = append(result, rt)
+		}
+	}
+	sortRefreshTokens(result)
+	return result
+}
+
+func (s *Store) DeleteRefreshToken(ctx context.Context, userID, id string) bool {
+	s.mu.Lock()
+	rt, ok := s.refreshTokens[id]
+	if !ok || rt.UserID != userID {
+		s.mu.Unlock()
+		return false
+	}
+	delete(s.refreshTokens, id)
+	s.unpersist(recordRefreshToken, id)
+	s.mu.Unlock()
+	s.saveAccounts()
+	return true
+}
+
+// DeleteRefreshTokens revokes every grant of the user and returns how many
+// there were.
+func (s *Store) DeleteRefreshTokens(ctx context.Context, userID string) int {
+	s.mu.Lock()
+	n := s.deleteRefreshTokensLocked(userID)
+	s.mu.Unlock()
+	if n > 0 {
+		s.saveAccounts()
+	}
+	return n
+}
+
+func (s *Store) deleteRefreshTokensLocked(userID string) int {
+	n := 0
+	for id, rt := range s.refreshTokens {
+		if rt.UserID == userID {
+			delete(s.refreshTokens, id)
+			s.unpersist(recordRefreshToken, id)
+			n++
+		}
+	}
+	return n
+}
+
+const refreshTokenColumns = `id, user_id, device, secret_hash, previous_hash, created_at, last_used_at, expires_at, device_id`
+
+func scanRefreshToken(row rowScanner) (model.RefreshToken, error) {
+	var rt model.RefreshToken
+	var device *string
+	err := row.Scan(&rt.ID, &rt.UserID, &device, &rt.SecretHash, &rt.PreviousHash, &rt.CreatedAt, &rt.LastUsedAt, &rt.ExpiresAt, &rt.DeviceID)
+	if err == nil && device != nil {
+		rt.Device = &model.AuthRequestDevice{}
+		err = json.Unmarshal([]byte(*device), rt.Device)
+	}
+	return rt, err
+}
+
+func (p *PostgresStore) CreateRefreshToken(ctx context.Context, userID, deviceID string, device *model.AuthRequestDevice, secretHash string, expiresAt, nowMillis int64) model.RefreshToken {
+	rt := model.RefreshToken{
+		ID:         p.newID(),
+		UserID:     userID,
+		DeviceID:   deviceID,
+		Device:     device,
+		SecretHash: secretHash,
+		CreatedAt:  nowMillis,
+		LastUsedAt: nowMillis,
+		ExpiresAt:  expiresAt,
+	}
+	err := p.withTx(ctx, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, `DELETE FROM refresh_tokens WHERE user_id = $1 AND expires_at <= $2`, userID, nowMillis); err != nil {
+			return err
+		}
+		_, err := tx.ExecContext(ctx, `INSERT INTO refresh_tokens (`+refreshTokenColumns+`) VALUES ($1, $2, $3, $4, '', $5, $5, $6, $7)`,
+			rt.ID, userID, authRequestDeviceJSON(device), secretHash, nowMillis, expiresAt, deviceID)
+		return err
+	})
+	if err != nil {
+		p.logError("create refresh token", err)
+	}
+	return rt
+}
+
+func (p *PostgresStore) RotateRefreshToken(ctx context.Context, id, secretHash, newSecretHash string, expiresAt, nowMillis int64) (model.RefreshToken, error) {
+	var rt model.RefreshToken
+	var result error
+	err := p.withTx(ctx, func(tx *sql.Tx) error {
+		var err error
+		rt, err = scanRefreshToken(tx.QueryRowContext(ctx, `SELECT `+refreshTokenColumns+` FROM refresh_tokens WHERE id = $1 FOR UPDATE`, id))
+		if errors.Is(err, sql.ErrNoRows) {
+			result = ErrRefreshTokenInvalid
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		drop, rotateErr := rotateRefreshToken(&rt, secretHash, newSecretHash, expiresAt, nowMillis)
+		result = rotateErr
+		switch {
+		case drop:
+			_, err = tx.ExecContext(ctx, `DELETE FROM refresh_tokens WHERE id = $1`, id)
+		case rotateErr == nil:
+			_, err = tx.ExecContext(ctx, `UPDATE refresh_tokens SET secret_hash = $2, previous_hash = $3, last_used_at = $4, expires_at = $5 WHERE id = $1`,
+				id, rt.SecretHash, rt.PreviousHash, rt.LastUsedAt, rt.ExpiresAt)
+		}
+		return err
+	})
+	if err != nil {
+		p.logError("rotate refresh token", err)
+		return model.RefreshToken{}, ErrRefreshTokenInvalid
+	}
+	return rt, result
+}
+
+func (p *PostgresStore) ListRefreshTokens(ctx context.Context, userID string, nowMillis int64) []model.RefreshToken {
+	rows, err := p.db.QueryContext(ctx, `SELECT `+refreshTokenColumns+` FROM refresh_tokens
+		WHERE user_id = $1 AND expires_at > $2 ORDER BY created_at, id`, userID, nowMillis)
+	if err != nil {
+		p.logError("list refresh tokens", err)
+		return []model.RefreshToken{}
+	}
+	defer rows.Close()
+
+	result := make([]model.RefreshToken, 0)
+	for rows.Next() {
+		rt, err := scanRefreshToken(rows)
+		if err != nil {
+			p.logError("scan refresh token", err)
+			break
+		}
+		result = append(result, rt)
+	}
+	return result
+}
+
+func (p *PostgresStore) DeleteRefreshToken(ctx context.Context, userID, id string) bool {
+	res, err := p.db.ExecContext(ctx, `DELETE FROM refresh_tokens WHERE user_id = $1 AND id = $2`, userID, id)
+	if err != nil {
+		p.logError("delete refresh token", err)
+		return false
+	}
+	n, _ := res.RowsAffected()
+	return n > 0
+}
+
+func (p *PostgresStore) DeleteRefreshTokens(ctx context.Context, userID string) int {
+	res, err := p.db.ExecContext(ctx, `DELETE FROM refresh_tokens WHERE user_id = $1`, userID)
+	if err != nil {
+		p.logError("delete refresh tokens", err)
+		return 0
+	}
+	n, _ := res.RowsAffected()
+	return int(n)
+}
+
+// CreateRefreshToken leaves expired grants in place: RotateRefreshToken
+// removes one when it is presented, and ListRefreshTokens skips them.
+func (r *RedisStore) CreateRefreshToken(ctx context.Context, userID, deviceID string, device *model.AuthRequestDevice, secretHash string, expiresAt, nowMillis int64) model.RefreshToken {
+	rt := model.RefreshToken{
+		ID:         r.newID(),
+		UserID:     userID,
+		DeviceID:   deviceID,
+		Device:     device,
+		SecretHash: secretHash,
+		CreatedAt:  nowMillis,
+		LastUsedAt: nowMillis,
+		ExpiresAt:  expiresAt,
+	}
+	err := r.client.watch(ctx, []string{r.refreshTokenKey(rt.ID)}, func(tx *redisTx) error {
+		tx.queue("SET", r.refreshTokenKey(rt.ID), redisJSON(rt))
+		tx.queue("SADD", r.userSetKey(userID, "refresh-tokens"), rt.ID)
+		return nil
+	})
+	if err != nil {
+		r.logError("create refresh token", err)
+	}
+	return rt
+}
+
+func (r *RedisStore) RotateRefreshToken(ctx context.Context, id, secretHash, newSecretHash string, expiresAt, nowMillis int64) (model.RefreshToken, error) {
+	key := r.refreshTokenKey(id)
+	var rt model.RefreshToken
+	var result error
+	err := r.client.watch(ctx, []string{key}, func(tx *redisTx) error {
+		rt = model.RefreshToken{}
+		found, err := getJSON(tx.do, key, &rt)
+		if err != nil {
+			return err
+		}
+		if !found {
+			result = ErrRefreshTokenInvalid
+			return nil
+		}
+		drop, rotateErr := rotateRefreshToken(&rt, secretHash, newSecretHash, expiresAt, nowMillis)
+		result = rotateErr
+		switch {
+		case drop:
+			tx.queue("DEL", key)
+			tx.queue("SREM", r.userSetKey(rt.UserID, "refresh-tokens"), id)
+		case rotateErr == nil:
+			tx.queue("SET", key, redisJSON(rt))
+		}
+		return nil
+	})
+	if err != nil {
+		r.logError("rotate refresh token", err)
+		return model.RefreshToken{}, ErrRefreshTokenInvalid
+	}
+	return rt, result
+}
+
+func (r *RedisStore) ListRefreshTokens(ctx context.Context, userID string, nowMillis int64) []model.RefreshToken {
+	tokens, err := mgetJSON[model.RefreshToken](ctx, r, r.userSetKey(userID, "refresh-tokens"), r.refreshTokenKey)
+	if err != nil {
+		r.logError("list refresh tokens", err)
+		return []model.RefreshToken{}
+	}
+	result := tokens[:0]
+	for _, rt := range tokens {
+		if rt.ExpiresAt > nowMillis {
+			result = append(result, rt)
+		}
+	}
+	sortRefreshTokens(result)
+	return result
+}
+
+func (r *RedisStore) DeleteRefreshToken(ctx context.Context, userID, id string) bool {
+	var rt model.RefreshToken
+	if ok, err := getJSON(r.client.doFunc(ctx), r.refreshTokenKey(id), &rt); err != nil || !ok || rt.UserID != userID {
+		if err != nil {
+			r.logError("delete refresh token", err)
+		}
+		return false
+	}
+	if _, err := r.client.do(ctx, "DEL", r.refreshTokenKey(id)); err != nil {
+		r.logError("delete refresh token", err)
+		return false
+	}
+	if _, err := r.client.do(ctx, "SREM", r.userSetKey(userID, "refresh-tokens"), id); err != nil {
+		r.logError("delete refresh token", err)
+	}
+	return true
+}
+
+func (r *RedisStore) DeleteRefreshTokens(ctx context.Context, userID string) int {
+	setKey := r.userSetKey(userID, "refresh-tokens")
+	reply, err := r.client.do(ctx, "SMEMBERS", setKey)
+	if err != nil {
+		r.logError("delete refresh tokens", err)
+		return 0
+	}
+	ids := redisStrings(reply)
+	args := []any{"DEL", setKey}
+	for _, id := range ids {
+		args = append(args, r.refreshTokenKey(id))
+	}
+	if _, err := r.client.do(ctx, args...); err != nil {
+		r.logError("delete refresh tokens", err)
+		return 0
+	}
+	return len(ids)
+}
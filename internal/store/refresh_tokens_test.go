@@ -0,0 +1,66 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"happy-server-lite/internal/model"
+)
+
+func TestStore_RefreshTokens_Rotate(t *testing.T) {
+	ctx := context.Background()
+	s := New()
+	device := &model.AuthRequestDevice{Hostname: "laptop"}
+	rt := s.CreateRefreshToken(ctx, "user-1", "", device, "h1", 5000, 1000)
+
+	rotated, err := s.RotateRefreshToken(ctx, rt.ID, "h1", "h2", 6000, 2000)
+	if err != nil || rotated.SecretHash != "h2" || rotated.LastUsedAt != 2000 || rotated.ExpiresAt != 6000 {
+		t.Fatalf("unexpected rotation: %+v %v", rotated, err)
+	}
+	if _, err := s.RotateRefreshToken(ctx, rt.ID, "wrong", "h3", 7000, 2100); !errors.Is(err, ErrRefreshTokenInvalid) {
+		t.Fatalf("expected an unknown secret to be rejected, got %v", err)
+	}
+	if tokens := s.ListRefreshTokens(ctx, "user-1", 2100); len(tokens) != 1 || tokens[0].Device.Hostname != "laptop" {
+		t.Fatalf("expected a wrong secret to leave the grant alone: %+v", tokens)
+	}
+	if _, err := s.RotateRefreshToken(ctx, rt.ID, "h1", "h3", 7000, 2200); !errors.Is(err, ErrRefreshTokenReused) {
+		t.Fatalf("expected reuse to be detected, got %v", err)
+	}
+	if _, err := s.RotateRefreshToken(ctx, rt.ID, "h2", "h3", 7000, 2300); !errors.Is(err, ErrRefreshTokenInvalid) {
+		t.Fatalf("expected reuse to revoke the grant, got %v", err)
+	}
+
+	expiring := s.CreateRefreshToken(ctx, "user-1", "", nil, "e1", 3000, 2000)
+	if _, err := s.RotateRefreshToken(ctx, expiring.ID, "e1", "e2", 9000, 3000); !errors.Is(err, ErrRefreshTokenInvalid) {
+		t.Fatalf("expected an expired token to be rejected, got %v", err)
+	}
+
+	s.CreateRefreshToken(ctx, "user-1", "", nil, "a", 9000, 3000)
+	s.CreateRefreshToken(ctx, "user-1", "", nil, "b", 9000, 3001)
+	other := s.CreateRefreshToken(ctx, "user-2", "", nil, "c", 9000, 3002)
+	if s.DeleteRefreshToken(ctx, "user-1", other.ID) {
+		t.Fatalf("expected a user not to delete another user's token")
+	}
+	if n := s.DeleteRefreshTokens(ctx, "user-1"); n != 2 {
+		t.Fatalf("expected 2 tokens deleted, got %d", n)
+	}
+	if tokens := s.ListRefreshTokens(ctx, "user-2", 3003); len(tokens) != 1 {
+		t.Fatalf("expected user-2's token to stay: %+v", tokens)
+	}
+}
+
+func TestStore_RefreshTokens_Persist(t *testing.T) {
+	ctx := context.Background()
+	opts := Options{AccountsStateFile: filepath.Join(t.TempDir(), "accounts-state.json")}
+
+	s1 := NewWithOptions(opts)
+	rt := s1.CreateRefreshToken(ctx, "user-1", "", &model.AuthRequestDevice{Platform: "linux"}, "h1", 9000, 1000)
+	s1.RotateRefreshToken(ctx, rt.ID, "h1", "h2", 9000, 2000)
+
+	s2 := NewWithOptions(opts)
+	if _, err := s2.RotateRefreshToken(ctx, rt.ID, "h1", "h3", 9000, 3000); !errors.Is(err, ErrRefreshTokenReused) {
+		t.Fatalf("expected the rotation to survive a reload, got %v", err)
+	}
+}
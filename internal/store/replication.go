@@ -0,0 +1,375 @@
+package store
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ErrReplicationGap is returned by ReplicationLog.Since when the changes
+// after the requested LSN are no longer all held, so the standby asking has
+// to start over from a snapshot.
+var ErrReplicationGap = errors.New("replication log no longer holds the requested changes")
+
+// Change operations, mirroring the Backend methods they were made through.
+const (
+	ChangePut          = "put"
+	ChangeDelete       = "delete"
+	ChangeDeletePrefix = "delete-prefix"
+)
+
+// Change is one write the store made through its Backend, numbered by the
+// log it was recorded in. Every change replaces or removes whole records, so
+// applying one more than once leaves the same state.
+type Change struct {
+	LSN  int64           `json:"lsn"`
+	Op   string          `json:"op"`
+	Kind string          `json:"kind"`
+	Key  string          `json:"key"`
+	Data json.RawMessage `json:"data,omitempty"`
+}
+
+// ReplicationLog is a Backend that numbers every write the store makes and
+// keeps the newest ones for standbys to tail, before passing it on to the
+// backend it wraps, if any. The log lives in memory only: its ID changes
+// with every process, and a standby that sees a new ID starts over from a
+// snapshot.
+type ReplicationLog struct {
+	inner Backend
+	id    string
+
+	mu sync.Mutex
+	// ring holds the newest changes, the oldest at head once full.
+	ring   []Change
+	head   int
+	held   int
+	lsn    int64
+	notify chan struct{}
+}
+
+// ReplicationLogStatus describes a ReplicationLog for the admin API.
+type ReplicationLogStatus struct {
+	LogID     string `json:"logId"`
+	LSN       int64  `json:"lsn"`
+	OldestLSN int64  `json:"oldestLsn"`
+	Capacity  int    `json:"capacity"`
+}
+
+var _ Backend = (*ReplicationLog)(nil)
+
+// NewReplicationLog returns a log keeping the newest capacity changes in
+// front of inner, which may be nil for a store kept in state files only.
+func NewReplicationLog(inner Backend, capacity int) *ReplicationLog {
+	if capacity <= 0 {
+		capacity = 1
+	}
+	var b [16]byte
+	_, _ = rand.Read(b[:])
+	return &ReplicationLog{
+		inner:  inner,
+		id:     hex.EncodeToString(b[:]),
+		ring:   make([]Change, capacity),
+		notify: make(chan struct{}),
+	}
+}
+
+// ID names this run of the log; LSNs are only comparable under one ID.
+func (l *ReplicationLog) ID() string {
+	return l.id
+}
+
+// LSN returns the number of the newest change, zero before the first.
+func (l *ReplicationLog) LSN() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.lsn
+}
+
+func (l *ReplicationLog) Status() ReplicationLogStatus {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return ReplicationLogStatus{LogID: l.id, LSN: l.lsn, OldestLSN: l.lsn - int64(l.held) + 1, Capacity: len(l.ring)}
+}
+
+// Since returns up to max changes after the LSN after, oldest first, or
+// ErrReplicationGap when some of them were already dropped.
+func (l *ReplicationLog) Since(after int64, max int) ([]Change, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	oldest := l.lsn - int64(l.held) + 1
+	if after < oldest-1 || after > l.lsn {
+		return nil, ErrReplicationGap
+	}
+	n := int(l.lsn - after)
+	if max > 0 && n > max {
+		n = max
+	}
+	changes := make([]Change, n)
+	first := l.head + int(after+1-oldest)
+	for i := range changes {
+		changes[i] = l.ring[(first+i)%len(l.ring)]
+	}
+	return changes, nil
+}
+
+// Wait blocks until a change after the LSN after is recorded or ctx ends.
+func (l *ReplicationLog) Wait(ctx context.Context, after int64) {
+	l.mu.Lock()
+	if l.lsn > after {
+		l.mu.Unlock()
+		return
+	}
+	notify := l.notify
+	l.mu.Unlock()
+
+	select {
+	case <-notify:
+	case <-ctx.Done():
+	}
+}
+
+func (l *ReplicationLog) record(c Change) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.lsn++
+	c.LSN = l.lsn
+	if l.held < len(l.ring) {
+		l.ring[(l.head+l.held)%len(l.ring)] = c
+		l.held++
+	} else {
+		l.ring[l.head] = c
+		l.head = (l.head + 1) % len(l.ring)
+	}
+	close(l.notify)
+	l.notify = make(chan struct{})
+}
+
+func (l *ReplicationLog) Load() ([]Record, error) {
+	if l.inner == nil {
+		return nil, nil
+	}
+	return l.inner.Load()
+}
+
+// Put, Delete and DeletePrefix record the change even when the wrapped
+// backend fails: the store has already made it in memory, and standbys
+// follow memory rather than disk.
+func (l *ReplicationLog) Put(r Record) error {
+	l.record(Change{Op: ChangePut, Kind: r.Kind, Key: r.Key, Data: r.Data})
+	if l.inner == nil {
+		return nil
+	}
+	return l.inner.Put(r)
+}
+
+func (l *ReplicationLog) Delete(kind, key string) error {
+	l.record(Change{Op: ChangeDelete, Kind: kind, Key: key})
+	if l.inner == nil {
+		return nil
+	}
+	return l.inner.Delete(kind, key)
+}
+
+func (l *ReplicationLog) DeletePrefix(kind, prefix string) error {
+	l.record(Change{Op: ChangeDeletePrefix, Kind: kind, Key: prefix})
+	if l.inner == nil {
+		return nil
+	}
+	return l.inner.DeletePrefix(kind, prefix)
+}
+
+// Replica is implemented by stores that can run as a warm standby, kept in
+// step with a primary's ReplicationLog until promoted.
+type Replica interface {
+	// ApplySnapshot makes the store hold exactly the records of a backup
+	// written by Export.
+	ApplySnapshot(r io.Reader) error
+	// ApplyChanges applies changes in order, all under one lock, and writes
+	// them through to the store's own backend and state files.
+	ApplyChanges(changes []Change) error
+	// Promote readies the store to take writes of its own.
+	Promote()
+}
+
+var _ Replica = (*Store)(nil)
+
+func (s *Store) ApplySnapshot(r io.Reader) error {
+	records, err := readBackup(r)
+	if err != nil {
+		return err
+	}
+	current, err := s.snapshotRecords()
+	if err != nil {
+		return err
+	}
+
+	type recordID struct{ kind, key string }
+	keep := make(map[recordID]bool, len(records))
+	for _, rec := range records {
+		keep[recordID{rec.Kind, rec.Key}] = true
+	}
+	changes := make([]Change, 0, len(records))
+	for _, rec := range current {
+		if !keep[recordID{rec.Kind, rec.Key}] {
+			changes = append(changes, Change{Op: ChangeDelete, Kind: rec.Kind, Key: rec.Key})
+		}
+	}
+	for _, rec := range records {
+		changes = append(changes, Change{Op: ChangePut, Kind: rec.Kind, Key: rec.Key, Data: rec.Data})
+	}
+	return s.ApplyChanges(changes)
+}
+
+func (s *Store) ApplyChanges(changes []Change) error {
+	if len(changes) == 0 {
+		return nil
+	}
+	kinds := make(map[string]bool)
+	messageSessions := make(map[string]bool)
+
+	s.lockAll()
+	var err error
+	for _, c := range changes {
+		if err = s.applyChangeLocked(c); err != nil {
+			err = fmt.Errorf("change %d: %s %s %s: %w", c.LSN, c.Op, c.Kind, c.Key, err)
+			break
+		}
+		kinds[c.Kind] = true
+		if c.Kind == recordMessage {
+			sessionID, _, _ := strings.Cut(c.Key, "|")
+			messageSessions[sessionID] = true
+		}
+	}
+	s.unlockAll()
+
+	if kinds[recordAccount] || kinds[recordSettings] || kinds[recordDisabled] || kinds[recordGitHub] {
+		s.saveAccounts()
+	}
+	if kinds[recordMachine] {
+		s.machinesChanged()
+	}
+	if kinds[recordArtifact] {
+		s.saveArtifacts()
+	}
+	if kinds[recordSession] || (kinds[recordMessage] && s.journal == nil) {
+		s.saveSessions()
+	}
+	if s.journal != nil {
+		for sessionID := range messageSessions {
+			s.journal.mu.Lock()
+			if err := s.persistStats.journal.record(s.journal.rewrite(sessionID, s.messages.forSession(sessionID))); err != nil {
+				log.Printf("message journal: rewrite %s failed: %v", sessionID, err)
+			}
+			s.journal.mu.Unlock()
+		}
+	}
+	return err
+}
+
+// applyChangeLocked applies c to memory and the store's backend; the caller
+// holds every lock.
+func (s *Store) applyChangeLocked(c Change) error {
+	switch c.Op {
+	case ChangePut:
+		r := Record{Kind: c.Kind, Key: c.Key, Data: c.Data}
+		if c.Kind == recordSession || c.Kind == recordMachine {
+			r.Owner = recordUser(r)
+		}
+		if err := s.loadRecordLocked(r); err != nil {
+			return err
+		}
+		if s.backend != nil {
+			if err := s.persistStats.backend.record(s.backend.Put(r)); err != nil {
+				log.Printf("store persistence: put %s %s failed: %v", r.Kind, r.Key, err)
+			}
+		}
+	case ChangeDelete:
+		if err := s.unloadRecordLocked(c.Kind, c.Key); err != nil {
+			return err
+		}
+		s.unpersist(c.Kind, c.Key)
+	case ChangeDeletePrefix:
+		sessionID, ok := strings.CutSuffix(c.Key, "|")
+		if c.Kind != recordMessage || !ok {
+			return errors.New("unsupported prefix")
+		}
+		s.messages.deleteSession(sessionID)
+		s.unpersistMessages(sessionID)
+	default:
+		return errors.New("unknown operation")
+	}
+	return nil
+}
+
+// unloadRecordLocked drops the record of kind under key from memory, the
+// reverse of loadRecordLocked; the caller holds every lock.
+func (s *Store) unloadRecordLocked(kind, key string) error {
+	switch kind {
+	case recordAccount:
+		delete(s.accountsByPublicKey, key)
+	case recordAuthRequest:
+		delete(s.authRequestsByKey, key)
+	case recordSession:
+		for i := range s.users {
+			for _, u := range s.users[i].users {
+				sess, ok := u.sessions[key]
+				if !ok {
+					continue
+				}
+				delete(u.sessions, key)
+				if u.sessionByTag[sess.Tag] == key {
+					delete(u.sessionByTag, sess.Tag)
+				}
+			}
+		}
+	case recordMessage:
+		sessionID, rawSeq, _ := strings.Cut(key, "|")
+		seq, err := strconv.ParseInt(rawSeq, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid message key: %w", err)
+		}
+		s.messages.remove(sessionID, seq)
+	case recordMachine:
+		userID, machineID, _ := strings.Cut(key, "|")
+		if u := s.shard(userID).records(userID); u != nil {
+			delete(u.machines, machineID)
+		}
+	case recordArtifact:
+		delete(s.artifactsByKey, key)
+	case recordSettings:
+		delete(s.accountSettingsByUserID, key)
+	case recordDisabled:
+		delete(s.disabledAccounts, key)
+	case recordGitHub:
+		delete(s.githubByUserID, key)
+	case recordTombstone:
+		delete(s.tombstones, key)
+	case recordPushToken:
+		delete(s.pushTokens, key)
+	case recordRefreshToken:
+		delete(s.refreshTokens, key)
+	case recordAPIKey:
+		delete(s.apiKeys, key)
+	case recordDevice:
+		delete(s.devices, key)
+	case recordMetrics:
+		return s.unloadMetricsRecord(key)
+	}
+	return nil
+}
+
+// Promote brings the seq counters up to the sessions applied, whose Seq can
+// run ahead of the messages still held once old ones were pruned.
+func (s *Store) Promote() {
+	s.reconcileSessionSeqs()
+}
@@ -0,0 +1,108 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+)
+
+// requireSameRecords fails unless both stores hold the same records.
+func requireSameRecords(t *testing.T, want, got *Store) {
+	t.Helper()
+	a, err := want.snapshotRecords()
+	if err != nil {
+		t.Fatalf("snapshotRecords: %v", err)
+	}
+	b, err := got.snapshotRecords()
+	if err != nil {
+		t.Fatalf("snapshotRecords: %v", err)
+	}
+	sortRecords(a)
+	sortRecords(b)
+	if len(a) != len(b) {
+		t.Fatalf("expected %d records, got %d", len(a), len(b))
+	}
+	for i := range a {
+		if a[i].Kind != b[i].Kind || a[i].Key != b[i].Key || !bytes.Equal(a[i].Data, b[i].Data) {
+			t.Fatalf("record %d differs: %s %s %s vs %s %s %s", i, a[i].Kind, a[i].Key, a[i].Data, b[i].Kind, b[i].Key, b[i].Data)
+		}
+	}
+}
+
+func TestStore_ReplicaFollowsLog(t *testing.T) {
+	ctx := context.Background()
+	log := NewReplicationLog(nil, 100)
+	primary := NewWithOptions(Options{Backend: log})
+	now := int64(1000)
+	primary.GetOrCreateAccount(ctx, "pk", now)
+	sess, _, _ := primary.GetOrCreateSession(ctx, "user-1", "tag", "meta", nil, nil, now)
+	primary.AppendMessageFrom(ctx, OriginREST, "user-1", sess.ID, "m1", "", now)
+	primary.UpsertMachine(ctx, "user-1", "m1", "meta", nil, nil, now)
+
+	// The snapshot is taken after some of the changes replayed below, as
+	// the primary keeps writing while it is exported.
+	start := log.LSN()
+	primary.AppendMessageFrom(ctx, OriginREST, "user-1", sess.ID, "m2", "", now+1)
+	var snapshot bytes.Buffer
+	if err := primary.Export(&snapshot); err != nil {
+		t.Fatalf("Export: %v", err)
+	}
+
+	standby := NewWithOptions(Options{Backend: newMemBackend()})
+	standby.UpsertMachine(ctx, "user-2", "stale", "meta", nil, nil, now)
+	if err := standby.ApplySnapshot(&snapshot); err != nil {
+		t.Fatalf("ApplySnapshot: %v", err)
+	}
+	requireSameRecords(t, primary, standby)
+
+	m3, _ := primary.AppendMessageFrom(ctx, OriginREST, "user-1", sess.ID, "m3", "", now+2)
+	primary.UpdateMessageFrom(ctx, OriginREST, "user-1", sess.ID, m3.ID, "m3-edited", "", now+3)
+	primary.DeleteMachine(ctx, "user-1", "m1", now+3)
+	other, _, _ := primary.GetOrCreateSession(ctx, "user-1", "other", "meta", nil, nil, now)
+	primary.AppendMessageFrom(ctx, OriginREST, "user-1", other.ID, "x", "", now)
+	primary.DeleteSession(ctx, "user-1", other.ID, now+4)
+	if _, err := primary.Purge(ctx, now+4+int64(defaultPurgeGrace.Milliseconds())+1); err != nil {
+		t.Fatalf("Purge: %v", err)
+	}
+
+	changes, err := log.Since(start, 0)
+	if err != nil {
+		t.Fatalf("Since: %v", err)
+	}
+	// Applying a batch again leaves the same state.
+	for i := 0; i < 2; i++ {
+		if err := standby.ApplyChanges(changes); err != nil {
+			t.Fatalf("ApplyChanges: %v", err)
+		}
+	}
+	requireSameRecords(t, primary, standby)
+
+	standby.Promote()
+	if next, err := standby.AppendMessageFrom(ctx, OriginREST, "user-1", sess.ID, "m4", "", now+5); err != nil || next.Seq != 4 {
+		t.Fatalf("expected the promoted standby to continue at seq 4, got %+v %v", next, err)
+	}
+}
+
+func TestReplicationLog_Since(t *testing.T) {
+	log := NewReplicationLog(nil, 3)
+	for _, key := range []string{"a", "b", "c", "d"} {
+		log.Put(Record{Kind: recordSettings, Key: key, Data: []byte(`{}`)})
+	}
+
+	changes, err := log.Since(2, 0)
+	if err != nil || len(changes) != 2 || changes[0].LSN != 3 || changes[1].Key != "d" {
+		t.Fatalf("unexpected changes: %+v %v", changes, err)
+	}
+	if changes, err := log.Since(1, 1); err != nil || len(changes) != 1 || changes[0].Key != "b" {
+		t.Fatalf("expected the max to cap the batch, got %+v %v", changes, err)
+	}
+	if changes, err := log.Since(4, 0); err != nil || len(changes) != 0 {
+		t.Fatalf("expected no changes after the newest, got %+v %v", changes, err)
+	}
+	for _, after := range []int64{0, 5} {
+		if _, err := log.Since(after, 0); !errors.Is(err, ErrReplicationGap) {
+			t.Fatalf("expected a gap after %d, got %v", after, err)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package store
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"happy-server-lite/internal/model"
+)
+
+// MessagePruner is implemented by stores that can apply the message retention
+// limits in Options.
+type MessagePruner interface {
+	// PruneMessages drops messages past the retention limits as of nowMillis
+	// and returns how many it removed.
+	PruneMessages(ctx context.Context, nowMillis int64) (int, error)
+}
+
+var (
+	_ MessagePruner = (*Store)(nil)
+	_ MessagePruner = (*PostgresStore)(nil)
+	_ MessagePruner = (*RedisStore)(nil)
+)
+
+// PrunedRange is a run of a session's oldest messages that retention is
+// about to drop.
+type PrunedRange struct {
+	SessionID string
+	UserID    string
+	Messages  []model.SessionMessage
+}
+
+// PruneHook is handed each range before it is dropped, for example to keep a
+// summary of it. An error keeps the range until the next run, for up to
+// MaxPruneHookFailures runs in a row; after that the range is dropped anyway
+// so a summarizer that keeps failing cannot hold messages past retention
+// forever.
+type PruneHook func(ctx context.Context, r PrunedRange) error
+
+// MaxPruneHookFailures is how many runs in a row a session's range is kept
+// for a failing PruneHook.
+const MaxPruneHookFailures = 5
+
+// MessageCompactor is implemented by stores that can run a PruneHook while
+// applying the retention limits.
+type MessageCompactor interface {
+	// CompactMessages is PruneMessages with hook run on each session's
+	// range first, as PruneHook describes; a nil hook prunes as
+	// PruneMessages does.
+	CompactMessages(ctx context.Context, nowMillis int64, hook PruneHook) (int, error)
+}
+
+var _ MessageCompactor = (*Store)(nil)
+
+// messageCutoff is the oldest creation time kept under retention, or zero
+// when messages never expire.
+func messageCutoff(retention time.Duration, nowMillis int64) int64 {
+	if retention <= 0 {
+		return 0
+	}
+	return nowMillis - retention.Milliseconds()
+}
+
+// PruneMessages drops messages older than Options.MessageRetention and all
+// but the newest Options.MaxMessagesPerSession of each session. The newest
+// message of a session is always kept, since seqs resume from it after a
+// restart.
+func (s *Store) PruneMessages(ctx context.Context, nowMillis int64) (int, error) {
+	return s.CompactMessages(ctx, nowMillis, nil)
+}
+
+// CompactMessages is PruneMessages with hook run on each session's range
+// before it is dropped. A range the hook fails on is kept for the next run,
+// until it has failed MaxPruneHookFailures runs in a row, when it is dropped
+// without it. It returns how many messages it removed.
+func (s *Store) CompactMessages(ctx context.Context, nowMillis int64, hook PruneHook) (int, error) {
+	if s.messageRetention <= 0 && s.maxMessagesPerSession <= 0 {
+		return 0, nil
+	}
+	candidates := s.messages.pruneCandidates(messageCutoff(s.messageRetention, nowMillis), s.maxMessagesPerSession)
+	if len(candidates) == 0 {
+		return 0, nil
+	}
+	var owners map[string]string
+	var failures map[string]int
+	if hook != nil {
+		owners = make(map[string]string)
+		s.eachSession(func(sess model.Session) { owners[sess.ID] = sess.UserID })
+		// Only sessions that still have a range carry their count over.
+		s.hookFailuresMu.Lock()
+		defer s.hookFailuresMu.Unlock()
+		failures = make(map[string]int)
+		for sessionID := range candidates {
+			if count, ok := s.hookFailures[sessionID]; ok {
+				failures[sessionID] = count
+			}
+		}
+		s.hookFailures = failures
+	}
+
+	n := 0
+	for sessionID, msgs := range candidates {
+		if hook != nil {
+			if err := ctx.Err(); err != nil {
+				break
+			}
+			if err := hook(ctx, PrunedRange{SessionID: sessionID, UserID: owners[sessionID], Messages: msgs}); err != nil {
+				failures[sessionID]++
+				if failures[sessionID] < MaxPruneHookFailures {
+					log.Printf("message retention: keeping %d messages of session %s: %v", len(msgs), sessionID, err)
+					continue
+				}
+				log.Printf("message retention: dropping %d messages of session %s after %d failed attempts: %v", len(msgs), sessionID, failures[sessionID], err)
+			}
+			delete(failures, sessionID)
+		}
+		seqs := s.messages.dropThrough(sessionID, msgs[len(msgs)-1].Seq)
+		for _, seq := range seqs {
+			s.unpersist(recordMessage, messageKey(sessionID, seq))
+		}
+		n += len(seqs)
+	}
+	if n == 0 {
+		return 0, nil
+	}
+	if s.journal != nil {
+		// Pruned journals no longer match memory, so compaction rewrites them.
+		s.CompactJournals()
+	} else {
+		s.saveSessions()
+	}
+	return n, nil
+}
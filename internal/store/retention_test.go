@@ -0,0 +1,129 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStore_PruneMessages(t *testing.T) {
+	ctx := context.Background()
+	const hour = int64(time.Hour / time.Millisecond)
+	dir := t.TempDir()
+	opts := Options{
+		SessionsStateFile:     filepath.Join(dir, "sessions-state.json"),
+		MessageJournalDir:     filepath.Join(dir, "journal"),
+		MessageRetention:      time.Hour,
+		MaxMessagesPerSession: 3,
+	}
+
+	s1 := NewWithOptions(opts)
+	busy, _, _ := s1.GetOrCreateSession(ctx, "u1", "busy", "meta", nil, nil, 0)
+	idle, _, _ := s1.GetOrCreateSession(ctx, "u1", "idle", "meta", nil, nil, 0)
+	for i := 0; i < 5; i++ {
+		if _, err := s1.AppendMessage(ctx, "u1", busy.ID, fmt.Sprintf("busy-%d", i), 3*hour); err != nil {
+			t.Fatalf("AppendMessage: %v", err)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := s1.AppendMessage(ctx, "u1", idle.ID, fmt.Sprintf("idle-%d", i), 0); err != nil {
+			t.Fatalf("AppendMessage: %v", err)
+		}
+	}
+
+	// busy loses two to the cap; idle keeps only its newest expired message.
+	n, err := s1.PruneMessages(ctx, 3*hour)
+	if err != nil || n != 3 {
+		t.Fatalf("PruneMessages = %d, %v; want 3", n, err)
+	}
+	if n, _ := s1.PruneMessages(ctx, 3*hour); n != 0 {
+		t.Fatalf("expected second prune to be a no-op, removed %d", n)
+	}
+
+	s2 := NewWithOptions(opts)
+	msgs, _ := s2.ListMessages(ctx, "u1", busy.ID, 0, 10)
+	if len(msgs) != 3 || msgs[0].Content != "busy-2" {
+		t.Fatalf("unexpected busy messages after reload: %+v", msgs)
+	}
+	msgs, _ = s2.ListMessages(ctx, "u1", idle.ID, 0, 10)
+	if len(msgs) != 1 || msgs[0].Content != "idle-1" {
+		t.Fatalf("unexpected idle messages after reload: %+v", msgs)
+	}
+	next, err := s2.AppendMessage(ctx, "u1", idle.ID, "idle-2", 3*hour)
+	if err != nil || next.Seq != 3 {
+		t.Fatalf("expected seq 3, got %d (%v)", next.Seq, err)
+	}
+}
+
+func TestStore_PruneMessagesWithoutLimits(t *testing.T) {
+	ctx := context.Background()
+	s := New()
+	sess, _, _ := s.GetOrCreateSession(ctx, "u1", "tag", "meta", nil, nil, 0)
+	if _, err := s.AppendMessage(ctx, "u1", sess.ID, "old", 0); err != nil {
+		t.Fatalf("AppendMessage: %v", err)
+	}
+	if n, err := s.PruneMessages(ctx, time.Now().UnixMilli()); n != 0 || err != nil {
+		t.Fatalf("PruneMessages = %d, %v; want no-op", n, err)
+	}
+}
+
+func TestStore_CompactMessages_Hook(t *testing.T) {
+	ctx := context.Background()
+	s := NewWithOptions(Options{MaxMessagesPerSession: 2})
+	kept, _, _ := s.GetOrCreateSession(ctx, "u1", "kept", "meta", nil, nil, 0)
+	summarized, _, _ := s.GetOrCreateSession(ctx, "u1", "summarized", "meta", nil, nil, 0)
+	for i := 0; i < 4; i++ {
+		s.AppendMessage(ctx, "u1", kept.ID, fmt.Sprintf("kept-%d", i), 0)
+		s.AppendMessage(ctx, "u1", summarized.ID, fmt.Sprintf("summarized-%d", i), 0)
+	}
+
+	var ranges []PrunedRange
+	hook := func(ctx context.Context, r PrunedRange) error {
+		if r.SessionID == kept.ID {
+			return errors.New("summarizer down")
+		}
+		ranges = append(ranges, r)
+		return nil
+	}
+	n, err := s.CompactMessages(ctx, 0, hook)
+	if err != nil || n != 2 {
+		t.Fatalf("CompactMessages = %d, %v; want 2", n, err)
+	}
+	if len(ranges) != 1 || ranges[0].UserID != "u1" || len(ranges[0].Messages) != 2 || ranges[0].Messages[0].Content != "summarized-0" {
+		t.Fatalf("unexpected ranges: %+v", ranges)
+	}
+	if msgs, _ := s.ListMessages(ctx, "u1", kept.ID, 0, 10); len(msgs) != 4 {
+		t.Fatalf("expected a failed hook to keep the messages, got %d", len(msgs))
+	}
+	if msgs, _ := s.ListMessages(ctx, "u1", summarized.ID, 0, 10); len(msgs) != 2 {
+		t.Fatalf("expected the summarized range to be dropped, got %d", len(msgs))
+	}
+}
+
+func TestStore_CompactMessages_DropsAfterRepeatedHookFailures(t *testing.T) {
+	ctx := context.Background()
+	s := NewWithOptions(Options{MaxMessagesPerSession: 2})
+	sess, _, _ := s.GetOrCreateSession(ctx, "u1", "tag", "meta", nil, nil, 0)
+	for i := 0; i < 4; i++ {
+		s.AppendMessage(ctx, "u1", sess.ID, fmt.Sprintf("m-%d", i), 0)
+	}
+
+	failing := func(ctx context.Context, r PrunedRange) error { return errors.New("summarizer down") }
+	for run := 1; run < MaxPruneHookFailures; run++ {
+		if n, err := s.CompactMessages(ctx, 0, failing); n != 0 || err != nil {
+			t.Fatalf("run %d: CompactMessages = %d, %v; want the range kept", run, n, err)
+		}
+	}
+	if n, err := s.CompactMessages(ctx, 0, failing); n != 2 || err != nil {
+		t.Fatalf("CompactMessages = %d, %v; want the range dropped after %d failures", n, err, MaxPruneHookFailures)
+	}
+	if msgs, _ := s.ListMessages(ctx, "u1", sess.ID, 0, 10); len(msgs) != 2 {
+		t.Fatalf("expected the newest 2 messages to remain, got %d", len(msgs))
+	}
+	if len(s.hookFailures) != 0 {
+		t.Fatalf("expected the failure count to be reset, got %v", s.hookFailures)
+	}
+}
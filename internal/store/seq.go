@@ -17,3 +17,40 @@ func (g *seqGenerator) nextForSession(sessionID string) int64 {
 	g.perSession[sessionID]++
 	return g.perSession[sessionID]
 }
+
+func (g *seqGenerator) reset(sessionID string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.perSession, sessionID)
+}
+
+// reconcileSessionSeqs runs after loading and brings each session's Seq and
+// its message counter up to the larger of the two: journals may hold
+// messages newer than the sessions state file, and once old messages are
+// pruned Session.Seq is the only record of the seqs already handed out.
+func (s *Store) reconcileSessionSeqs() {
+	s.lockUsers()
+	defer s.unlockUsers()
+	s.seq.mu.Lock()
+	defer s.seq.mu.Unlock()
+	for i := range s.users {
+		for _, u := range s.users[i].users {
+			for sid, sess := range u.sessions {
+				if sess.Deleted {
+					continue
+				}
+				last := s.seq.perSession[sid]
+				switch {
+				case sess.Seq > last:
+					s.seq.perSession[sid] = sess.Seq
+				case sess.Seq < last:
+					sess.Seq = last
+					if msgs := s.messages.forSession(sid); len(msgs) > 0 && msgs[len(msgs)-1].CreatedAt > sess.UpdatedAt {
+						sess.UpdatedAt = msgs[len(msgs)-1].CreatedAt
+					}
+					u.sessions[sid] = sess
+				}
+			}
+		}
+	}
+}
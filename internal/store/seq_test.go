@@ -0,0 +1,72 @@
+package store
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+)
+
+func testSessionSeq(t *testing.T, s Storage) {
+	t.Helper()
+	ctx := context.Background()
+	sess, _, err := s.GetOrCreateSession(ctx, "u1", "tag", "meta", nil, nil, 1000)
+	if err != nil {
+		t.Fatalf("GetOrCreateSession: %v", err)
+	}
+	if sess.Seq != 0 {
+		t.Fatalf("expected a new session to start at seq 0, got %d", sess.Seq)
+	}
+	s.AppendMessageFrom(ctx, "", "u1", sess.ID, "one", "", 2000)
+	s.AppendMessageOnce(ctx, "", "u1", sess.ID, "two", "", "l2", 3000)
+	s.AppendMessageOnce(ctx, "", "u1", sess.ID, "two", "", "l2", 4000)
+
+	got, ok := s.GetSession(ctx, "u1", sess.ID)
+	if !ok || got.Seq != 2 || got.UpdatedAt != 3000 {
+		t.Fatalf("expected seq 2 updated at 3000 without the replay, got %+v", got)
+	}
+	if list := s.ListSessions(ctx, "u1"); len(list) != 1 || list[0].Seq != 2 {
+		t.Fatalf("unexpected session list: %+v", list)
+	}
+}
+
+func TestStore_SessionSeq(t *testing.T) {
+	testSessionSeq(t, New())
+}
+
+func TestRedisStore_SessionSeq(t *testing.T) {
+	testSessionSeq(t, openFakeRedisStore(t, 0))
+}
+
+func TestStore_SessionSeqCatchesUpFromJournal(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	opts := Options{SessionsStateFile: filepath.Join(dir, "sessions-state.json"), MessageJournalDir: filepath.Join(dir, "journal")}
+	s1 := NewWithOptions(opts)
+	sess, _, _ := s1.GetOrCreateSession(ctx, "u1", "tag", "meta", nil, nil, 1000)
+	s1.AppendMessageFrom(ctx, "", "u1", sess.ID, "one", "", 2000)
+	s1.AppendMessageFrom(ctx, "", "u1", sess.ID, "two", "", 3000)
+
+	s2 := NewWithOptions(opts)
+	got, ok := s2.GetSession(ctx, "u1", sess.ID)
+	if !ok || got.Seq != 2 || got.UpdatedAt != 3000 {
+		t.Fatalf("expected the journal to bring the session to seq 2, got %+v", got)
+	}
+}
+
+func TestStore_SessionSeqOutlivesPrunedMessages(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "sessions-state.json")
+	s1 := NewWithOptions(Options{SessionsStateFile: path})
+	sess, _, _ := s1.GetOrCreateSession(ctx, "u1", "tag", "meta", nil, nil, 1000)
+	for i := 0; i < 3; i++ {
+		s1.AppendMessageFrom(ctx, "", "u1", sess.ID, "c", "", 2000)
+	}
+	s1.messages.deleteSession(sess.ID)
+	s1.saveSessions()
+
+	s2 := NewWithOptions(Options{SessionsStateFile: path})
+	msg, err := s2.AppendMessageFrom(ctx, "", "u1", sess.ID, "c", "", 3000)
+	if err != nil || msg.Seq != 4 {
+		t.Fatalf("expected seqs to continue after the session's seq, got %d (%v)", msg.Seq, err)
+	}
+}
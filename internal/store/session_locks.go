@@ -0,0 +1,371 @@
+package store
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"sort"
+	"time"
+
+	"happy-server-lite/internal/model"
+)
+
+// Session locks are advisory: the server keeps who holds which name and
+// until when, and tools working on the same session agree to ask first. A
+// lock nobody renews lapses at its ExpiresAt, so a crashed holder does not
+// keep the others out for long.
+const (
+	MaxSessionLockNameBytes   = 128
+	MaxSessionLockHolderBytes = 256
+	MaxSessionLocksPerSession = 32
+	DefaultSessionLockTTL     = 30 * time.Second
+	MaxSessionLockTTL         = 10 * time.Minute
+)
+
+var (
+	// ErrSessionLockHeld is returned with the current lock when someone
+	// else holds the name.
+	ErrSessionLockHeld = errors.New("session lock held")
+	// ErrSessionLockNotHeld is returned when the token does not hold the
+	// name, because it was released, lapsed or taken by someone else since.
+	ErrSessionLockNotHeld  = errors.New("session lock not held")
+	ErrInvalidSessionLock  = errors.New("invalid session lock")
+	ErrTooManySessionLocks = errors.New("too many session locks")
+)
+
+// sessionLocks are the locks of one session by name.
+type sessionLocks map[string]model.SessionLock
+
+// dropExpired removes the locks that lapsed by nowMillis.
+func (l sessionLocks) dropExpired(nowMillis int64) {
+	for name, lock := range l {
+		if lock.ExpiresAt <= nowMillis {
+			delete(l, name)
+		}
+	}
+}
+
+// acquire takes lock.Name for lock unless a live lock holds it.
+func (l sessionLocks) acquire(lock model.SessionLock) (model.SessionLock, error) {
+	if lock.Name == "" || len(lock.Name) > MaxSessionLockNameBytes || len(lock.Holder) > MaxSessionLockHolderBytes {
+		return model.SessionLock{}, ErrInvalidSessionLock
+	}
+	l.dropExpired(lock.AcquiredAt)
+	if current, ok := l[lock.Name]; ok {
+		current.Token = ""
+		return current, ErrSessionLockHeld
+	}
+	if len(l) >= MaxSessionLocksPerSession {
+		return model.SessionLock{}, ErrTooManySessionLocks
+	}
+	l[lock.Name] = lock
+	return lock, nil
+}
+
+// renew moves the expiry of name to expiresAt if token holds it.
+func (l sessionLocks) renew(name, token string, expiresAt, nowMillis int64) (model.SessionLock, error) {
+	l.dropExpired(nowMillis)
+	lock, ok := l[name]
+	if !ok || lock.Token != token {
+		return model.SessionLock{}, ErrSessionLockNotHeld
+	}
+	lock.ExpiresAt = expiresAt
+	l[name] = lock
+	return lock, nil
+}
+
+// release removes name if token holds it.
+func (l sessionLocks) release(name, token string, nowMillis int64) (model.SessionLock, error) {
+	l.dropExpired(nowMillis)
+	lock, ok := l[name]
+	if !ok || lock.Token != token {
+		return model.SessionLock{}, ErrSessionLockNotHeld
+	}
+	delete(l, name)
+	return lock, nil
+}
+
+// list returns the live locks, by name.
+func (l sessionLocks) list(nowMillis int64) []model.SessionLock {
+	l.dropExpired(nowMillis)
+	locks := make([]model.SessionLock, 0, len(l))
+	for _, lock := range l {
+		locks = append(locks, lock)
+	}
+	sort.Slice(locks, func(i, j int) bool { return locks[i].Name < locks[j].Name })
+	return locks
+}
+
+// newSessionLockToken returns a random token: holding it is all it takes to
+// renew or release a lock, so it must not be guessable from the ids.
+func newSessionLockToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func newSessionLock(sessionID, name, holder, token string, expiresAt, nowMillis int64) model.SessionLock {
+	return model.SessionLock{SessionID: sessionID, Name: name, Holder: holder, Token: token, AcquiredAt: nowMillis, ExpiresAt: expiresAt}
+}
+
+// lockEvent is the event published after lock changed; the token stays
+// with its holder.
+func lockEvent(eventType, origin, userID string, lock model.SessionLock, nowMillis int64) Event {
+	lock.Token = ""
+	return Event{Type: eventType, Origin: origin, UserID: userID, SessionID: lock.SessionID, Lock: &lock, At: nowMillis}
+}
+
+// AcquireSessionLock takes the lock name on a session of userID until
+// expiresAt, returning it with the token that renews and releases it. When
+// a live lock holds the name already it fails with ErrSessionLockHeld and
+// that lock, without its token.
+func (s *Store) AcquireSessionLock(ctx context.Context, origin, userID, sessionID, name, holder string, expiresAt, nowMillis int64) (model.SessionLock, error) {
+	token, err := newSessionLockToken()
+	if err != nil {
+		return model.SessionLock{}, err
+	}
+	return s.changeSessionLock(ctx, origin, userID, sessionID, EventSessionLocked, nowMillis, func(l sessionLocks) (model.SessionLock, error) {
+		return l.acquire(newSessionLock(sessionID, name, holder, token, expiresAt, nowMillis))
+	})
+}
+
+// RenewSessionLock moves the expiry of the lock name to expiresAt if token
+// still holds it, and fails with ErrSessionLockNotHeld otherwise.
+func (s *Store) RenewSessionLock(ctx context.Context, origin, userID, sessionID, name, token string, expiresAt, nowMillis int64) (model.SessionLock, error) {
+	return s.changeSessionLock(ctx, origin, userID, sessionID, EventSessionLocked, nowMillis, func(l sessionLocks) (model.SessionLock, error) {
+		return l.renew(name, token, expiresAt, nowMillis)
+	})
+}
+
+// ReleaseSessionLock frees the lock name if token holds it, and fails with
+// ErrSessionLockNotHeld otherwise.
+func (s *Store) ReleaseSessionLock(ctx context.Context, origin, userID, sessionID, name, token string, nowMillis int64) (model.SessionLock, error) {
+	return s.changeSessionLock(ctx, origin, userID, sessionID, EventSessionUnlocked, nowMillis, func(l sessionLocks) (model.SessionLock, error) {
+		return l.release(name, token, nowMillis)
+	})
+}
+
+func (s *Store) changeSessionLock(ctx context.Context, origin, userID, sessionID, eventType string, nowMillis int64, change func(sessionLocks) (model.SessionLock, error)) (model.SessionLock, error) {
+	if _, ok := s.GetSession(ctx, userID, sessionID); !ok {
+		return model.SessionLock{}, ErrSessionNotFound
+	}
+	s.locksMu.Lock()
+	l := s.sessionLocks[sessionID]
+	if l == nil {
+		l = make(sessionLocks)
+	}
+	lock, err := change(l)
+	if len(l) == 0 {
+		delete(s.sessionLocks, sessionID)
+	} else {
+		s.sessionLocks[sessionID] = l
+	}
+	s.locksMu.Unlock()
+	if err != nil {
+		return lock, err
+	}
+	s.publish(lockEvent(eventType, origin, userID, lock, nowMillis))
+	return lock, nil
+}
+
+// ListSessionLocks returns the live locks on a session of userID, by name
+// and without their tokens.
+func (s *Store) ListSessionLocks(ctx context.Context, userID, sessionID string, nowMillis int64) ([]model.SessionLock, error) {
+	if _, ok := s.GetSession(ctx, userID, sessionID); !ok {
+		return nil, ErrSessionNotFound
+	}
+	s.locksMu.Lock()
+	defer s.locksMu.Unlock()
+	return withoutTokens(s.sessionLocks[sessionID].list(nowMillis)), nil
+}
+
+// dropSessionLocks forgets the locks of a deleted session.
+func (s *Store) dropSessionLocks(sessionID string) {
+	s.locksMu.Lock()
+	delete(s.sessionLocks, sessionID)
+	s.locksMu.Unlock()
+}
+
+func withoutTokens(locks []model.SessionLock) []model.SessionLock {
+	for i := range locks {
+		locks[i].Token = ""
+	}
+	return locks
+}
+
+// The shared stores keep each session's locks in one place and drop the
+// lapsed ones whenever they are changed.
+
+func (p *PostgresStore) AcquireSessionLock(ctx context.Context, origin, userID, sessionID, name, holder string, expiresAt, nowMillis int64) (model.SessionLock, error) {
+	token, err := newSessionLockToken()
+	if err != nil {
+		return model.SessionLock{}, err
+	}
+	return p.changeSessionLock(ctx, origin, userID, sessionID, EventSessionLocked, nowMillis, func(l sessionLocks) (model.SessionLock, error) {
+		return l.acquire(newSessionLock(sessionID, name, holder, token, expiresAt, nowMillis))
+	})
+}
+
+func (p *PostgresStore) RenewSessionLock(ctx context.Context, origin, userID, sessionID, name, token string, expiresAt, nowMillis int64) (model.SessionLock, error) {
+	return p.changeSessionLock(ctx, origin, userID, sessionID, EventSessionLocked, nowMillis, func(l sessionLocks) (model.SessionLock, error) {
+		return l.renew(name, token, expiresAt, nowMillis)
+	})
+}
+
+func (p *PostgresStore) ReleaseSessionLock(ctx context.Context, origin, userID, sessionID, name, token string, nowMillis int64) (model.SessionLock, error) {
+	return p.changeSessionLock(ctx, origin, userID, sessionID, EventSessionUnlocked, nowMillis, func(l sessionLocks) (model.SessionLock, error) {
+		return l.release(name, token, nowMillis)
+	})
+}
+
+// changeSessionLock locks the session row, so changes to its locks from
+// every instance take turns, and rewrites the locks change leaves.
+func (p *PostgresStore) changeSessionLock(ctx context.Context, origin, userID, sessionID, eventType string, nowMillis int64, change func(sessionLocks) (model.SessionLock, error)) (model.SessionLock, error) {
+	var lock model.SessionLock
+	err := p.withTx(ctx, func(tx *sql.Tx) error {
+		var id string
+		err := tx.QueryRowContext(ctx, `SELECT id FROM sessions WHERE id = $1 AND user_id = $2 AND NOT deleted FOR UPDATE`, sessionID, userID).Scan(&id)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrSessionNotFound
+		}
+		if err != nil {
+			return err
+		}
+		l, err := querySessionLocks(ctx, tx, sessionID)
+		if err != nil {
+			return err
+		}
+		if lock, err = change(l); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, `DELETE FROM session_locks WHERE session_id = $1`, sessionID); err != nil {
+			return err
+		}
+		for _, kept := range l {
+			if _, err := tx.ExecContext(ctx, `INSERT INTO session_locks (session_id, name, holder, token, acquired_at, expires_at)
+				VALUES ($1, $2, $3, $4, $5, $6)`, sessionID, kept.Name, kept.Holder, kept.Token, kept.AcquiredAt, kept.ExpiresAt); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return lock, err
+	}
+	p.publish(lockEvent(eventType, origin, userID, lock, nowMillis))
+	return lock, nil
+}
+
+func (p *PostgresStore) ListSessionLocks(ctx context.Context, userID, sessionID string, nowMillis int64) ([]model.SessionLock, error) {
+	if _, ok := p.GetSession(ctx, userID, sessionID); !ok {
+		return nil, ErrSessionNotFound
+	}
+	l, err := querySessionLocks(ctx, p.db, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	return withoutTokens(l.list(nowMillis)), nil
+}
+
+type rowQuerier interface {
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+}
+
+func querySessionLocks(ctx context.Context, q rowQuerier, sessionID string) (sessionLocks, error) {
+	rows, err := q.QueryContext(ctx, `SELECT name, holder, token, acquired_at, expires_at FROM session_locks WHERE session_id = $1`, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	l := make(sessionLocks)
+	for rows.Next() {
+		lock := model.SessionLock{SessionID: sessionID}
+		if err := rows.Scan(&lock.Name, &lock.Holder, &lock.Token, &lock.AcquiredAt, &lock.ExpiresAt); err != nil {
+			return nil, err
+		}
+		l[lock.Name] = lock
+	}
+	return l, rows.Err()
+}
+
+func (r *RedisStore) AcquireSessionLock(ctx context.Context, origin, userID, sessionID, name, holder string, expiresAt, nowMillis int64) (model.SessionLock, error) {
+	token, err := newSessionLockToken()
+	if err != nil {
+		return model.SessionLock{}, err
+	}
+	return r.changeSessionLock(ctx, origin, userID, sessionID, EventSessionLocked, nowMillis, func(l sessionLocks) (model.SessionLock, error) {
+		return l.acquire(newSessionLock(sessionID, name, holder, token, expiresAt, nowMillis))
+	})
+}
+
+func (r *RedisStore) RenewSessionLock(ctx context.Context, origin, userID, sessionID, name, token string, expiresAt, nowMillis int64) (model.SessionLock, error) {
+	return r.changeSessionLock(ctx, origin, userID, sessionID, EventSessionLocked, nowMillis, func(l sessionLocks) (model.SessionLock, error) {
+		return l.renew(name, token, expiresAt, nowMillis)
+	})
+}
+
+func (r *RedisStore) ReleaseSessionLock(ctx context.Context, origin, userID, sessionID, name, token string, nowMillis int64) (model.SessionLock, error) {
+	return r.changeSessionLock(ctx, origin, userID, sessionID, EventSessionUnlocked, nowMillis, func(l sessionLocks) (model.SessionLock, error) {
+		return l.release(name, token, nowMillis)
+	})
+}
+
+// changeSessionLock watches the session's lock key, so a change that raced
+// another instance's is retried against the locks it left.
+func (r *RedisStore) changeSessionLock(ctx context.Context, origin, userID, sessionID, eventType string, nowMillis int64, change func(sessionLocks) (model.SessionLock, error)) (model.SessionLock, error) {
+	if _, ok := r.GetSession(ctx, userID, sessionID); !ok {
+		return model.SessionLock{}, ErrSessionNotFound
+	}
+	key := r.sessionLocksKey(sessionID)
+	var lock model.SessionLock
+	err := r.client.watch(ctx, []string{key}, func(tx *redisTx) error {
+		l := make(sessionLocks)
+		if _, err := getJSON(tx.do, key, &l); err != nil {
+			return err
+		}
+		var err error
+		if lock, err = change(l); err != nil {
+			return err
+		}
+		if len(l) == 0 {
+			tx.queue("DEL", key)
+		} else {
+			tx.queue("SET", key, redisJSON(l))
+		}
+		return nil
+	})
+	if err != nil {
+		return lock, err
+	}
+	r.publish(lockEvent(eventType, origin, userID, lock, nowMillis))
+	return lock, nil
+}
+
+func (r *RedisStore) ListSessionLocks(ctx context.Context, userID, sessionID string, nowMillis int64) ([]model.SessionLock, error) {
+	if _, ok := r.GetSession(ctx, userID, sessionID); !ok {
+		return nil, ErrSessionNotFound
+	}
+	l := make(sessionLocks)
+	if _, err := getJSON(r.client.doFunc(ctx), r.sessionLocksKey(sessionID), &l); err != nil {
+		return nil, err
+	}
+	return withoutTokens(l.list(nowMillis)), nil
+}
+
+// SessionLockExpiresAt is when a lock taken or renewed at nowMillis for
+// ttlSeconds lapses; zero picks DefaultSessionLockTTL. It reports false for
+// a TTL that is negative or above MaxSessionLockTTL.
+func SessionLockExpiresAt(ttlSeconds int, nowMillis int64) (int64, bool) {
+	ttl := time.Duration(ttlSeconds) * time.Second
+	if ttlSeconds == 0 {
+		ttl = DefaultSessionLockTTL
+	}
+	if ttl <= 0 || ttl > MaxSessionLockTTL {
+		return 0, false
+	}
+	return nowMillis + ttl.Milliseconds(), true
+}
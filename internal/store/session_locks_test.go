@@ -0,0 +1,115 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func testSessionLocks(t *testing.T, s Storage) {
+	t.Helper()
+	ctx := context.Background()
+	sess, _, err := s.GetOrCreateSession(ctx, "u1", "tag", "meta", nil, nil, 1000)
+	if err != nil {
+		t.Fatalf("GetOrCreateSession: %v", err)
+	}
+
+	var published []Event
+	s.Subscribe(func(ev Event) { published = append(published, ev) })
+
+	lock, err := s.AcquireSessionLock(ctx, OriginREST, "u1", sess.ID, "metadata", "cli", 5000, 1000)
+	if err != nil || lock.Token == "" || lock.Holder != "cli" || lock.ExpiresAt != 5000 {
+		t.Fatalf("unexpected lock: %+v (%v)", lock, err)
+	}
+	current, err := s.AcquireSessionLock(ctx, OriginREST, "u1", sess.ID, "metadata", "app", 6000, 2000)
+	if !errors.Is(err, ErrSessionLockHeld) || current.Holder != "cli" || current.Token != "" {
+		t.Fatalf("expected the lock held by cli without its token, got %+v (%v)", current, err)
+	}
+	if _, err := s.RenewSessionLock(ctx, OriginREST, "u1", sess.ID, "metadata", "wrong", 9000, 2000); !errors.Is(err, ErrSessionLockNotHeld) {
+		t.Fatalf("expected renewing with another token to fail, got %v", err)
+	}
+	renewed, err := s.RenewSessionLock(ctx, OriginREST, "u1", sess.ID, "metadata", lock.Token, 9000, 2000)
+	if err != nil || renewed.ExpiresAt != 9000 || renewed.AcquiredAt != 1000 {
+		t.Fatalf("unexpected renewed lock: %+v (%v)", renewed, err)
+	}
+
+	locks, err := s.ListSessionLocks(ctx, "u1", sess.ID, 3000)
+	if err != nil || len(locks) != 1 || locks[0].Name != "metadata" || locks[0].Token != "" {
+		t.Fatalf("unexpected locks: %+v (%v)", locks, err)
+	}
+	if _, err := s.ListSessionLocks(ctx, "u2", sess.ID, 3000); !errors.Is(err, ErrSessionNotFound) {
+		t.Fatalf("expected other users' sessions to be hidden, got %v", err)
+	}
+
+	// A lock nobody renews lapses and can be taken by someone else.
+	if locks, _ := s.ListSessionLocks(ctx, "u1", sess.ID, 9000); len(locks) != 0 {
+		t.Fatalf("expected the lock to have lapsed: %+v", locks)
+	}
+	taken, err := s.AcquireSessionLock(ctx, OriginREST, "u1", sess.ID, "metadata", "app", 20000, 9000)
+	if err != nil || taken.Holder != "app" {
+		t.Fatalf("expected the lapsed lock to be taken: %+v (%v)", taken, err)
+	}
+	if _, err := s.ReleaseSessionLock(ctx, OriginREST, "u1", sess.ID, "metadata", lock.Token, 9500); !errors.Is(err, ErrSessionLockNotHeld) {
+		t.Fatalf("expected the old token to no longer release it, got %v", err)
+	}
+	if _, err := s.ReleaseSessionLock(ctx, OriginREST, "u1", sess.ID, "metadata", taken.Token, 9500); err != nil {
+		t.Fatalf("ReleaseSessionLock: %v", err)
+	}
+
+	if _, err := s.AcquireSessionLock(ctx, OriginREST, "u1", sess.ID, "", "cli", 20000, 9500); !errors.Is(err, ErrInvalidSessionLock) {
+		t.Fatalf("expected an empty name to be refused, got %v", err)
+	}
+	if len(published) != 4 || published[0].Type != EventSessionLocked || published[3].Type != EventSessionUnlocked {
+		t.Fatalf("unexpected events: %+v", published)
+	}
+	for _, ev := range published {
+		if ev.Lock == nil || ev.Lock.Token != "" || ev.SessionID != sess.ID {
+			t.Fatalf("expected events to carry the lock without its token: %+v", ev)
+		}
+	}
+
+	s.AcquireSessionLock(ctx, OriginREST, "u1", sess.ID, "metadata", "cli", 20000, 10000)
+	s.DeleteSession(ctx, "u1", sess.ID, 10000)
+	if _, err := s.AcquireSessionLock(ctx, OriginREST, "u1", sess.ID, "other", "cli", 20000, 10000); !errors.Is(err, ErrSessionNotFound) {
+		t.Fatalf("expected deleted sessions to refuse locks, got %v", err)
+	}
+}
+
+func TestStore_SessionLocks(t *testing.T) {
+	testSessionLocks(t, New())
+}
+
+func TestRedisStore_SessionLocks(t *testing.T) {
+	testSessionLocks(t, openFakeRedisStore(t, 0))
+}
+
+func TestStore_SessionLockLimit(t *testing.T) {
+	ctx := context.Background()
+	s := New()
+	sess, _, _ := s.GetOrCreateSession(ctx, "u1", "tag", "meta", nil, nil, 1000)
+	for i := 0; i < MaxSessionLocksPerSession; i++ {
+		if _, err := s.AcquireSessionLock(ctx, "", "u1", sess.ID, string(rune('a'+i)), "", 5000, 1000); err != nil {
+			t.Fatalf("AcquireSessionLock: %v", err)
+		}
+	}
+	if _, err := s.AcquireSessionLock(ctx, "", "u1", sess.ID, "one-more", "", 5000, 1000); !errors.Is(err, ErrTooManySessionLocks) {
+		t.Fatalf("expected too many locks, got %v", err)
+	}
+	if _, err := s.AcquireSessionLock(ctx, "", "u1", sess.ID, "one-more", "", 6000, 5000); err != nil {
+		t.Fatalf("expected lapsed locks to make room: %v", err)
+	}
+}
+
+func TestSessionLockExpiresAt(t *testing.T) {
+	if at, ok := SessionLockExpiresAt(0, 1000); !ok || at != 1000+DefaultSessionLockTTL.Milliseconds() {
+		t.Fatalf("expected the default TTL, got %d %v", at, ok)
+	}
+	if at, ok := SessionLockExpiresAt(5, 1000); !ok || at != 6000 {
+		t.Fatalf("expected 5s, got %d %v", at, ok)
+	}
+	for _, ttl := range []int{-1, int(MaxSessionLockTTL.Seconds()) + 1} {
+		if _, ok := SessionLockExpiresAt(ttl, 1000); ok {
+			t.Fatalf("expected ttl %d to be refused", ttl)
+		}
+	}
+}
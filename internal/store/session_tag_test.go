@@ -0,0 +1,36 @@
+package store
+
+import (
+	"context"
+	"testing"
+)
+
+func testGetSessionByTag(t *testing.T, s Storage) {
+	t.Helper()
+	ctx := context.Background()
+	sess, _, err := s.GetOrCreateSession(ctx, "u1", "tag", "meta", nil, nil, 1000)
+	if err != nil {
+		t.Fatalf("GetOrCreateSession: %v", err)
+	}
+	if got, ok := s.GetSessionByTag(ctx, "u1", "tag"); !ok || got.ID != sess.ID {
+		t.Fatalf("unexpected lookup: %+v %v", got, ok)
+	}
+	if _, ok := s.GetSessionByTag(ctx, "u2", "tag"); ok {
+		t.Fatalf("expected other users' tags to be hidden")
+	}
+	if _, ok := s.GetSessionByTag(ctx, "u1", "missing"); ok {
+		t.Fatalf("expected an unknown tag to be missing")
+	}
+	s.DeleteSession(ctx, "u1", sess.ID, 2000)
+	if _, ok := s.GetSessionByTag(ctx, "u1", "tag"); ok {
+		t.Fatalf("expected a deleted session to be missing")
+	}
+}
+
+func TestStore_GetSessionByTag(t *testing.T) {
+	testGetSessionByTag(t, New())
+}
+
+func TestRedisStore_GetSessionByTag(t *testing.T) {
+	testGetSessionByTag(t, openFakeRedisStore(t, 0))
+}
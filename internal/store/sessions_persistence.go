@@ -0,0 +1,97 @@
+package store
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"happy-server-lite/internal/model"
+)
+
+type persistedSessionsFile struct {
+	Version  int                    `json:"version"`
+	Sessions []model.Session        `json:"sessions"`
+	Messages []model.SessionMessage `json:"messages,omitempty"`
+	SavedAt  int64                  `json:"savedAt"`
+}
+
+// loadSessionsFromFile reports whether the file was in an older format.
+func (s *Store) loadSessionsFromFile(path string) (bool, error) {
+	var file persistedSessionsFile
+	found, migrated, err := readStateFile(path, stateSessions, &file)
+	if err != nil || !found {
+		return false, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lockUsers()
+	for _, sess := range file.Sessions {
+		if sess.ID == "" || sess.UserID == "" {
+			continue
+		}
+		sess, err := decompressSession(sess)
+		if err != nil {
+			s.unlockUsers()
+			return false, fmt.Errorf("session %s: %w", sess.ID, err)
+		}
+		s.putSessionLocked(sess)
+	}
+	s.unlockUsers()
+	known := s.sessionIDs()
+	for _, msg := range file.Messages {
+		if !known[msg.SessionID] {
+			continue
+		}
+		s.messages.append(msg.SessionID, msg)
+		if msg.Seq > s.seq.perSession[msg.SessionID] {
+			s.seq.perSession[msg.SessionID] = msg.Seq
+		}
+	}
+	return migrated, nil
+}
+
+// unlockAndSaveSessions releases sh and, if *changed is set, rewrites the
+// sessions state file.
+func (s *Store) unlockAndSaveSessions(sh *userShard, changed *bool) {
+	sh.mu.Unlock()
+	if *changed {
+		s.saveSessions()
+	}
+}
+
+// saveSessions snapshots sessions and messages while holding
+// sessionsPersistMu, so the last writer always writes the newest state.
+func (s *Store) saveSessions() {
+	if s.partitions != nil {
+		s.savePartitions()
+		return
+	}
+	path := s.sessionsStateFile
+	if path == "" {
+		return
+	}
+
+	s.sessionsPersistMu.Lock()
+	defer s.sessionsPersistMu.Unlock()
+
+	sessions := make([]model.Session, 0)
+	s.eachSession(func(sess model.Session) { sessions = append(sessions, sess) })
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].ID < sessions[j].ID })
+	for i := range sessions {
+		sessions[i] = s.compressSession(sessions[i])
+	}
+
+	file := persistedSessionsFile{
+		Version:  stateVersions[stateSessions],
+		Sessions: sessions,
+		SavedAt:  time.Now().UnixMilli(),
+	}
+	if s.journal == nil {
+		file.Messages = s.messages.snapshot()
+	}
+	if err := s.persistStats.sessionsFile.record(writeStateFile(path, file)); err != nil {
+		log.Printf("sessions persistence: %v", err)
+	}
+}
@@ -0,0 +1,62 @@
+package store
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStore_SessionsPersistence_RoundTrip(t *testing.T) {
+	ctx := context.Background()
+	stateFile := filepath.Join(t.TempDir(), "sessions-state.json")
+
+	s1 := NewWithOptions(Options{SessionsStateFile: stateFile})
+	now := int64(1000)
+	sess, _, err := s1.GetOrCreateSession(ctx, "u1", "tag", "meta", nil, nil, now)
+	if err != nil {
+		t.Fatalf("GetOrCreateSession: %v", err)
+	}
+	for _, content := range []string{"one", "two"} {
+		if _, err := s1.AppendMessage(ctx, "u1", sess.ID, content, now); err != nil {
+			t.Fatalf("AppendMessage: %v", err)
+		}
+	}
+	gone, _, _ := s1.GetOrCreateSession(ctx, "u1", "gone", "meta", nil, nil, now)
+	if _, err := s1.AppendMessage(ctx, "u1", gone.ID, "bye", now); err != nil {
+		t.Fatalf("AppendMessage: %v", err)
+	}
+	if !s1.DeleteSession(ctx, "u1", gone.ID, now+1) {
+		t.Fatalf("expected session deleted")
+	}
+
+	info, err := os.Stat(stateFile)
+	if err != nil {
+		t.Fatalf("expected state file written: %v", err)
+	}
+	if info.Mode().Perm() != 0o600 {
+		t.Fatalf("expected state file mode 0600, got %o", info.Mode().Perm())
+	}
+
+	s2 := NewWithOptions(Options{SessionsStateFile: stateFile})
+	sessions := s2.ListSessions(ctx, "u1")
+	if len(sessions) != 1 || sessions[0].ID != sess.ID || sessions[0].Metadata != "meta" {
+		t.Fatalf("unexpected sessions loaded: %+v", sessions)
+	}
+	again, created, err := s2.GetOrCreateSession(ctx, "u1", "tag", "", nil, nil, now+2)
+	if err != nil || created || again.ID != sess.ID {
+		t.Fatalf("expected existing session by tag, got %+v created=%v err=%v", again, created, err)
+	}
+
+	msgs, err := s2.ListMessages(ctx, "u1", sess.ID, 0, 10)
+	if err != nil || len(msgs) != 2 || msgs[0].Content != "one" || msgs[1].Seq != 2 {
+		t.Fatalf("unexpected messages loaded: %+v (%v)", msgs, err)
+	}
+	next, err := s2.AppendMessage(ctx, "u1", sess.ID, "three", now+3)
+	if err != nil || next.Seq != 3 {
+		t.Fatalf("expected seq to continue at 3, got %d (%v)", next.Seq, err)
+	}
+	if _, err := s2.ListMessages(ctx, "u1", gone.ID, 0, 10); err == nil {
+		t.Fatalf("expected deleted session to stay deleted")
+	}
+}
@@ -0,0 +1,106 @@
+package store
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// SQLBackend keeps store records in a single table of a database/sql
+// database. The statements target SQLite; the driver is linked by building
+// with -tags sqlite (see pkg/happyserver). Records are indexed by owner, so
+// it is a UserBackend.
+type SQLBackend struct {
+	db *sql.DB
+}
+
+var _ UserBackend = (*SQLBackend)(nil)
+
+const sqlBackendSchema = `CREATE TABLE IF NOT EXISTS records (
+	kind  TEXT NOT NULL,
+	key   TEXT NOT NULL,
+	data  BLOB NOT NULL,
+	owner TEXT NOT NULL DEFAULT '',
+	PRIMARY KEY (kind, key)
+)`
+
+// OpenSQLBackend opens dsn with driverName and creates the records table if
+// needed.
+func OpenSQLBackend(driverName, dsn string) (*SQLBackend, error) {
+	db, err := sql.Open(driverName, dsn)
+	if err != nil {
+		return nil, err
+	}
+	// SQLite serialises writers; a single connection avoids "database is
+	// locked" errors under concurrent writes.
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(sqlBackendSchema); err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("create schema: %w", err)
+	}
+	// Tables created before records had owners gain the column; their rows
+	// are given owners by the store when it first loads users lazily.
+	if _, err := db.Exec(`SELECT owner FROM records LIMIT 0`); err != nil {
+		if _, err := db.Exec(`ALTER TABLE records ADD COLUMN owner TEXT NOT NULL DEFAULT ''`); err != nil {
+			_ = db.Close()
+			return nil, fmt.Errorf("add owner column: %w", err)
+		}
+	}
+	if _, err := db.Exec(`CREATE INDEX IF NOT EXISTS records_owner ON records (owner)`); err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("create owner index: %w", err)
+	}
+	return &SQLBackend{db: db}, nil
+}
+
+func (b *SQLBackend) Load() ([]Record, error) {
+	return b.query(`SELECT kind, key, data, owner FROM records`)
+}
+
+func (b *SQLBackend) LoadShared() ([]Record, error) {
+	return b.query(`SELECT kind, key, data, owner FROM records WHERE owner = ''`)
+}
+
+func (b *SQLBackend) LoadUser(userID string) ([]Record, error) {
+	return b.query(`SELECT kind, key, data, owner FROM records WHERE owner = ?`, userID)
+}
+
+func (b *SQLBackend) query(query string, args ...any) ([]Record, error) {
+	rows, err := b.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var records []Record
+	for rows.Next() {
+		var r Record
+		if err := rows.Scan(&r.Kind, &r.Key, &r.Data, &r.Owner); err != nil {
+			return nil, err
+		}
+		records = append(records, r)
+	}
+	return records, rows.Err()
+}
+
+// Put keeps the owner a record already has when r comes without one, as
+// records replayed from a standby's primary do.
+func (b *SQLBackend) Put(r Record) error {
+	_, err := b.db.Exec(`INSERT INTO records (kind, key, data, owner) VALUES (?, ?, ?, ?)
+		ON CONFLICT (kind, key) DO UPDATE SET data = excluded.data,
+		owner = CASE WHEN excluded.owner = '' THEN records.owner ELSE excluded.owner END`, r.Kind, r.Key, r.Data, r.Owner)
+	return err
+}
+
+func (b *SQLBackend) Delete(kind, key string) error {
+	_, err := b.db.Exec(`DELETE FROM records WHERE kind = ? AND key = ?`, kind, key)
+	return err
+}
+
+func (b *SQLBackend) DeletePrefix(kind, prefix string) error {
+	_, err := b.db.Exec(`DELETE FROM records WHERE kind = ? AND substr(key, 1, ?) = ?`, kind, len(prefix), prefix)
+	return err
+}
+
+func (b *SQLBackend) Close() error {
+	return b.db.Close()
+}
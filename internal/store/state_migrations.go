@@ -0,0 +1,107 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// State files are named by kind in migrations and errors.
+const (
+	stateMachines  = "machines"
+	stateSessions  = "sessions"
+	stateArtifacts = "artifacts"
+	stateAccounts  = "accounts"
+)
+
+// stateVersions is the format version each state file is written in.
+var stateVersions = map[string]int{
+	stateMachines:  1,
+	stateSessions:  1,
+	stateArtifacts: 1,
+	stateAccounts:  1,
+}
+
+// stateMigration upgrades the top-level fields of a state file by one
+// version, in place. The version field itself is set by readStateFile.
+type stateMigration func(fields map[string]json.RawMessage) error
+
+// stateMigrations holds, per kind, the migration from each old version to
+// the next.
+var stateMigrations = map[string]map[int]stateMigration{}
+
+// registerStateMigration adds the migration of kind from version from to
+// from+1. Bumping a kind's entry in stateVersions needs one for the version
+// it replaces, or files written by older releases stop loading.
+func registerStateMigration(kind string, from int, fn stateMigration) {
+	if stateMigrations[kind] == nil {
+		stateMigrations[kind] = make(map[int]stateMigration)
+	}
+	if _, ok := stateMigrations[kind][from]; ok {
+		panic(fmt.Sprintf("store: duplicate %s state migration from version %d", kind, from))
+	}
+	stateMigrations[kind][from] = fn
+}
+
+// readStateFile decodes the state file of kind at path into v, first
+// running the migrations that take it from the version it was written in
+// to the current one. A missing or empty file leaves v alone and reports
+// found false; migrated reports that the file is in an older format and
+// should be rewritten.
+func readStateFile(path, kind string, v any) (found, migrated bool, err error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, false, nil
+		}
+		return false, false, err
+	}
+	if len(data) == 0 {
+		return false, false, nil
+	}
+
+	fields, migrated, err := migrateState(kind, data)
+	if err != nil {
+		return false, false, err
+	}
+	if migrated {
+		if data, err = json.Marshal(fields); err != nil {
+			return false, false, err
+		}
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return false, false, err
+	}
+	return true, migrated, nil
+}
+
+func migrateState(kind string, data []byte) (map[string]json.RawMessage, bool, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, false, err
+	}
+	var version int
+	if raw, ok := fields["version"]; ok {
+		if err := json.Unmarshal(raw, &version); err != nil {
+			return nil, false, fmt.Errorf("%s state version: %w", kind, err)
+		}
+	}
+	current := stateVersions[kind]
+	if version < 1 || version > current {
+		return nil, false, fmt.Errorf("unsupported %s state version %d", kind, version)
+	}
+	if version == current {
+		return fields, false, nil
+	}
+	for ; version < current; version++ {
+		migrate, ok := stateMigrations[kind][version]
+		if !ok {
+			return nil, false, fmt.Errorf("no %s state migration from version %d", kind, version)
+		}
+		if err := migrate(fields); err != nil {
+			return nil, false, fmt.Errorf("migrate %s state from version %d: %w", kind, version, err)
+		}
+	}
+	fields["version"], _ = json.Marshal(current)
+	return fields, true, nil
+}
@@ -0,0 +1,101 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// withStateVersion pretends kind's current format is version, with the
+// given migrations registered, for the rest of the test.
+func withStateVersion(t *testing.T, kind string, version int, migrations map[int]stateMigration) {
+	t.Helper()
+	oldVersion, oldMigrations := stateVersions[kind], stateMigrations[kind]
+	stateVersions[kind] = version
+	stateMigrations[kind] = nil
+	for from, fn := range migrations {
+		registerStateMigration(kind, from, fn)
+	}
+	t.Cleanup(func() {
+		stateVersions[kind] = oldVersion
+		stateMigrations[kind] = oldMigrations
+	})
+}
+
+func TestMigrateStateRunsEachStep(t *testing.T) {
+	var steps []int
+	step := func(from int) stateMigration {
+		return func(fields map[string]json.RawMessage) error {
+			steps = append(steps, from)
+			fields["steps"], _ = json.Marshal(steps)
+			return nil
+		}
+	}
+	withStateVersion(t, "test", 3, map[int]stateMigration{1: step(1), 2: step(2)})
+
+	fields, migrated, err := migrateState("test", []byte(`{"version":1}`))
+	if err != nil || !migrated {
+		t.Fatalf("migrateState: %v %v", migrated, err)
+	}
+	if string(fields["version"]) != "3" || string(fields["steps"]) != "[1,2]" {
+		t.Fatalf("unexpected migrated fields: %s %s", fields["version"], fields["steps"])
+	}
+	if _, migrated, err := migrateState("test", []byte(`{"version":3}`)); err != nil || migrated {
+		t.Fatalf("expected the current version untouched, got %v %v", migrated, err)
+	}
+	for _, data := range []string{`{"version":4}`, `{}`} {
+		if _, _, err := migrateState("test", []byte(data)); err == nil || !strings.Contains(err.Error(), "unsupported test state version") {
+			t.Fatalf("expected %s to be refused, got %v", data, err)
+		}
+	}
+
+	withStateVersion(t, "gap", 3, map[int]stateMigration{2: step(2)})
+	if _, _, err := migrateState("gap", []byte(`{"version":1}`)); err == nil || !strings.Contains(err.Error(), "no gap state migration from version 1") {
+		t.Fatalf("expected a missing step to fail, got %v", err)
+	}
+}
+
+func TestStore_MigratesMachinesStateFileInPlace(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "machines.json")
+	s := NewWithOptions(Options{MachinesStateFile: path})
+	if _, _, err := s.UpsertMachine(ctx, "u1", "m1", "meta", nil, nil, 1000); err != nil {
+		t.Fatalf("UpsertMachine: %v", err)
+	}
+
+	// A made-up version 2 that changed how metadata is stored.
+	withStateVersion(t, stateMachines, 2, map[int]stateMigration{
+		1: func(fields map[string]json.RawMessage) error {
+			var machines []map[string]any
+			if err := json.Unmarshal(fields["machines"], &machines); err != nil {
+				return err
+			}
+			for _, m := range machines {
+				m["Metadata"] = m["Metadata"].(string) + "-v2"
+			}
+			var err error
+			fields["machines"], err = json.Marshal(machines)
+			return err
+		},
+	})
+	reloaded := NewWithOptions(Options{MachinesStateFile: path})
+	if m, ok := reloaded.GetMachine(ctx, "u1", "m1"); !ok || m.Metadata != "meta-v2" {
+		t.Fatalf("expected the migrated machine, got %+v %v", m, ok)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	var file persistedMachinesFile
+	if err := json.Unmarshal(data, &file); err != nil || file.Version != 2 || len(file.Machines) != 1 || file.Machines[0].Metadata != "meta-v2" {
+		t.Fatalf("expected the file rewritten as version 2, got %+v %v", file, err)
+	}
+	// The rewritten file loads without migrating again.
+	if _, migrated, err := readStateFile(path, stateMachines, &persistedMachinesFile{}); err != nil || migrated {
+		t.Fatalf("expected the rewritten file current, got %v %v", migrated, err)
+	}
+}
@@ -0,0 +1,157 @@
+package store
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Stats is a snapshot of what a store holds and how its persistence is
+// doing, for metrics endpoints and embedders.
+type Stats struct {
+	Accounts         int `json:"accounts"`
+	DisabledAccounts int `json:"disabledAccounts"`
+	AuthRequests     int `json:"authRequests"`
+	// Sessions counts live sessions, ActiveSessions those of them whose
+	// agent is running; DeletedSessions are awaiting purge.
+	Sessions        int `json:"sessions"`
+	ActiveSessions  int `json:"activeSessions"`
+	DeletedSessions int `json:"deletedSessions"`
+	Machines        int `json:"machines"`
+	Artifacts       int `json:"artifacts"`
+	PushTokens      int `json:"pushTokens"`
+	Tombstones      int `json:"tombstones"`
+	// HydratedUsers counts the users in memory when they are loaded on
+	// first access (Options.HydratedUsers); the session and machine counts
+	// then cover only them.
+	HydratedUsers int `json:"hydratedUsers,omitempty"`
+
+	Memory      MemoryStats      `json:"memory"`
+	Persistence PersistenceStats `json:"persistence"`
+}
+
+// PersistenceStats reports each place the store writes to. Targets the
+// store was not configured with are left out.
+type PersistenceStats struct {
+	MachinesFile  *PersistenceTarget `json:"machinesFile,omitempty"`
+	SessionsFile  *PersistenceTarget `json:"sessionsFile,omitempty"`
+	ArtifactsFile *PersistenceTarget `json:"artifactsFile,omitempty"`
+	AccountsFile  *PersistenceTarget `json:"accountsFile,omitempty"`
+	Partitions    *PersistenceTarget `json:"partitions,omitempty"`
+	Journal       *PersistenceTarget `json:"journal,omitempty"`
+	Backend       *PersistenceTarget `json:"backend,omitempty"`
+}
+
+// PersistenceTarget reports when writes to a target last succeeded and
+// failed, in Unix milliseconds (zero for never), and how many have failed
+// since start.
+type PersistenceTarget struct {
+	LastSuccessAt int64 `json:"lastSuccessAt"`
+	LastFailureAt int64 `json:"lastFailureAt"`
+	Failures      int64 `json:"failures"`
+}
+
+// StatsReporter is implemented by stores that can summarise themselves
+// without a query per call.
+type StatsReporter interface {
+	Stats() Stats
+}
+
+var _ StatsReporter = (*Store)(nil)
+
+// persistCounter tracks the outcome of writes to one persistence target.
+type persistCounter struct {
+	lastSuccess atomic.Int64
+	lastFailure atomic.Int64
+	failures    atomic.Int64
+}
+
+// record notes the outcome of a write and returns err.
+func (c *persistCounter) record(err error) error {
+	now := time.Now().UnixMilli()
+	if err != nil {
+		c.lastFailure.Store(now)
+		c.failures.Add(1)
+		return err
+	}
+	c.lastSuccess.Store(now)
+	return nil
+}
+
+func (c *persistCounter) snapshot() *PersistenceTarget {
+	return &PersistenceTarget{
+		LastSuccessAt: c.lastSuccess.Load(),
+		LastFailureAt: c.lastFailure.Load(),
+		Failures:      c.failures.Load(),
+	}
+}
+
+type persistCounters struct {
+	machinesFile  persistCounter
+	sessionsFile  persistCounter
+	artifactsFile persistCounter
+	accountsFile  persistCounter
+	partitions    persistCounter
+	journal       persistCounter
+	backend       persistCounter
+}
+
+func (s *Store) Stats() Stats {
+	s.mu.RLock()
+	stats := Stats{
+		Accounts:         len(s.accountsByPublicKey),
+		DisabledAccounts: len(s.disabledAccounts),
+		AuthRequests:     len(s.authRequestsByKey),
+		PushTokens:       len(s.pushTokens),
+	}
+	for _, a := range s.artifactsByKey {
+		if !a.Deleted {
+			stats.Artifacts++
+		}
+	}
+	s.mu.RUnlock()
+
+	s.eachUser(func(_ string, u *userRecords) {
+		stats.Machines += len(u.machines)
+		for _, sess := range u.sessions {
+			switch {
+			case sess.Deleted:
+				stats.DeletedSessions++
+			case sess.Active:
+				stats.Sessions++
+				stats.ActiveSessions++
+			default:
+				stats.Sessions++
+			}
+		}
+	})
+	s.tombstonesMu.Lock()
+	stats.Tombstones = len(s.tombstones)
+	s.tombstonesMu.Unlock()
+	if s.hydration != nil {
+		stats.HydratedUsers = s.hydration.hydratedUsers()
+	}
+
+	stats.Memory = s.MemoryStats()
+	if s.machinesStateFile != "" {
+		stats.Persistence.MachinesFile = s.persistStats.machinesFile.snapshot()
+	}
+	if s.sessionsStateFile != "" {
+		stats.Persistence.SessionsFile = s.persistStats.sessionsFile.snapshot()
+	}
+	if s.artifactsStateFile != "" {
+		stats.Persistence.ArtifactsFile = s.persistStats.artifactsFile.snapshot()
+	}
+	if s.accountsStateFile != "" {
+		stats.Persistence.AccountsFile = s.persistStats.accountsFile.snapshot()
+	}
+	if s.partitions != nil {
+		stats.Persistence.Partitions = s.persistStats.partitions.snapshot()
+	}
+	if s.journal != nil {
+		stats.Persistence.Journal = s.persistStats.journal.snapshot()
+	}
+	if s.backend != nil {
+		stats.Persistence.Backend = s.persistStats.backend.snapshot()
+	}
+	return stats
+}
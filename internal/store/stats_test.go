@@ -0,0 +1,49 @@
+package store
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStore_Stats(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	blocker := filepath.Join(dir, "blocker")
+	s := NewWithOptions(Options{
+		SessionsStateFile: filepath.Join(dir, "sessions-state.json"),
+		MachinesStateFile: filepath.Join(blocker, "machines-state.json"),
+	})
+	// A file where the machines state file's directory should be makes
+	// every machines write fail.
+	if err := os.WriteFile(blocker, nil, 0o600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	now := int64(1000)
+	acc, _ := s.GetOrCreateAccount(ctx, "pk", now)
+	live, _, _ := s.GetOrCreateSession(ctx, acc.ID, "live", "meta", nil, nil, now)
+	s.SetSessionActive(ctx, acc.ID, live.ID, true, now, now)
+	gone, _, _ := s.GetOrCreateSession(ctx, acc.ID, "gone", "meta", nil, nil, now)
+	s.DeleteSession(ctx, acc.ID, gone.ID, now)
+	s.AppendMessageFrom(ctx, "", acc.ID, live.ID, "c", "", now)
+	s.UpsertMachine(ctx, acc.ID, "m1", "meta", nil, nil, now)
+	s.AddPushToken(ctx, acc.ID, "t1", "", now)
+
+	stats := s.Stats()
+	if stats.Accounts != 1 || stats.Sessions != 1 || stats.ActiveSessions != 1 || stats.DeletedSessions != 1 ||
+		stats.Machines != 1 || stats.PushTokens != 1 || stats.Memory.Messages != 1 {
+		t.Fatalf("unexpected counts: %+v", stats)
+	}
+	p := stats.Persistence
+	if p.Journal != nil || p.Backend != nil {
+		t.Fatalf("expected unconfigured targets left out, got %+v", p)
+	}
+	if p.SessionsFile == nil || p.SessionsFile.LastSuccessAt == 0 || p.SessionsFile.Failures != 0 {
+		t.Fatalf("unexpected sessions file stats: %+v", p.SessionsFile)
+	}
+	if p.MachinesFile == nil || p.MachinesFile.Failures == 0 || p.MachinesFile.LastFailureAt == 0 || p.MachinesFile.LastSuccessAt != 0 {
+		t.Fatalf("unexpected machines file stats: %+v", p.MachinesFile)
+	}
+}
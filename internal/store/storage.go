@@ -0,0 +1,99 @@
+package store
+
+import (
+	"context"
+	"io"
+
+	"happy-server-lite/internal/model"
+)
+
+// Storage is what handlers and the realtime server need from a store. *Store
+// keeps everything in process; PostgresStore and RedisStore share state
+// between instances.
+//
+// Methods that read or write state take the context of the request or
+// connection they serve. The shared stores abandon a query once it is done;
+// the in-process store finishes its (short) work regardless.
+type Storage interface {
+	Subscribe(fn func(Event))
+	SubscribeTypes(fn func(Event), types ...string)
+
+	GetOrCreateAccount(ctx context.Context, publicKey string, nowMillis int64) (model.Account, bool)
+	GetAccount(ctx context.Context, publicKey string) (model.Account, bool)
+	GetAuthRequest(ctx context.Context, publicKey string) (model.AuthRequest, bool)
+	UpsertAuthRequest(ctx context.Context, publicKey string, supportsV2 bool, device *model.AuthRequestDevice, nowMillis int64) model.AuthRequest
+	AuthorizeAuthRequest(ctx context.Context, publicKey, response, responseAccountID, token string, nowMillis int64) (model.AuthRequest, bool)
+	RejectAuthRequest(ctx context.Context, publicKey string, nowMillis int64) (model.AuthRequest, bool)
+	ClaimAuthRequest(ctx context.Context, publicKey string) (model.AuthRequest, bool)
+	IssueAuthChallenge(ctx context.Context, nonce string, expiresAt int64)
+	UseAuthChallenge(ctx context.Context, nonce string, nowMillis int64) bool
+	SetAccountDisabled(ctx context.Context, userID string, disabled bool) bool
+	IsAccountDisabled(ctx context.Context, userID string) bool
+	GetAccountSettings(ctx context.Context, userID string) (*string, int)
+	UpdateAccountSettings(ctx context.Context, userID string, expectedVersion int, settings string, nowMillis int64) (status string, currentVersion int, currentSettings *string)
+	AddPushToken(ctx context.Context, userID, token, locale string, nowMillis int64) model.PushToken
+	ListPushTokens(ctx context.Context, userID string) []model.PushToken
+	DeletePushToken(ctx context.Context, userID, token string) bool
+	CreateRefreshToken(ctx context.Context, userID, deviceID string, device *model.AuthRequestDevice, secretHash string, expiresAt, nowMillis int64) model.RefreshToken
+	RotateRefreshToken(ctx context.Context, id, secretHash, newSecretHash string, expiresAt, nowMillis int64) (model.RefreshToken, error)
+	ListRefreshTokens(ctx context.Context, userID string, nowMillis int64) []model.RefreshToken
+	DeleteRefreshToken(ctx context.Context, userID, id string) bool
+	DeleteRefreshTokens(ctx context.Context, userID string) int
+	CreateAPIKey(ctx context.Context, userID, name, secretHash string, nowMillis int64) model.APIKey
+	UseAPIKey(ctx context.Context, id, secretHash string, nowMillis int64) (model.APIKey, bool)
+	ListAPIKeys(ctx context.Context, userID string) []model.APIKey
+	DeleteAPIKey(ctx context.Context, userID, id string) bool
+	DeleteAPIKeys(ctx context.Context, userID string) int
+	CreateDevice(ctx context.Context, userID string, device *model.AuthRequestDevice, ip string, expiresAt, nowMillis int64) model.Device
+	TouchDevice(ctx context.Context, userID, id, ip string, nowMillis int64) bool
+	RenewDevice(ctx context.Context, userID, id string, expiresAt, nowMillis int64) bool
+	ListDevices(ctx context.Context, userID string, nowMillis int64) []model.Device
+	DeleteDevice(ctx context.Context, userID, id string) bool
+	DeleteDevices(ctx context.Context, userID string) int
+	SetGitHubIdentity(ctx context.Context, userID string, identity model.GitHubIdentity) bool
+	GetGitHubIdentity(ctx context.Context, userID string) (model.GitHubIdentity, bool)
+	DeleteGitHubIdentity(ctx context.Context, userID string) bool
+
+	GetOrCreateSession(ctx context.Context, userID, tag, metadata string, agentState *string, dataEncryptionKey *string, nowMillis int64) (model.Session, bool, error)
+	ListSessions(ctx context.Context, userID string) []model.Session
+	GetSession(ctx context.Context, userID, sessionID string) (model.Session, bool)
+	GetSessionByTag(ctx context.Context, userID, tag string) (model.Session, bool)
+	UpdateSessionMetadata(ctx context.Context, userID, sessionID string, expectedVersion int, metadata string, nowMillis int64) (status string, version int, currentValue string)
+	UpdateSessionAgentState(ctx context.Context, userID, sessionID string, expectedVersion int, agentState *string, nowMillis int64) (status string, version int, currentValue *string)
+	SetSessionActive(ctx context.Context, userID, sessionID string, active bool, activeAt int64, nowMillis int64) bool
+	DeleteSession(ctx context.Context, userID, sessionID string, nowMillis int64) bool
+
+	AcquireSessionLock(ctx context.Context, origin, userID, sessionID, name, holder string, expiresAt, nowMillis int64) (model.SessionLock, error)
+	RenewSessionLock(ctx context.Context, origin, userID, sessionID, name, token string, expiresAt, nowMillis int64) (model.SessionLock, error)
+	ReleaseSessionLock(ctx context.Context, origin, userID, sessionID, name, token string, nowMillis int64) (model.SessionLock, error)
+	ListSessionLocks(ctx context.Context, userID, sessionID string, nowMillis int64) ([]model.SessionLock, error)
+
+	AppendMessageFrom(ctx context.Context, origin, userID, sessionID, content, checksum string, nowMillis int64) (model.SessionMessage, error)
+	AppendMessageOnce(ctx context.Context, origin, userID, sessionID, content, checksum, localID string, nowMillis int64) (model.SessionMessage, bool, error)
+	UpdateMessageFrom(ctx context.Context, origin, userID, sessionID, messageID, content, checksum string, nowMillis int64) (model.SessionMessage, error)
+	DeleteMessageFrom(ctx context.Context, origin, userID, sessionID, messageID string, nowMillis int64) (model.SessionMessage, error)
+	AnnotateMessageFrom(ctx context.Context, origin, userID, sessionID, messageID, key string, expectedVersion int, value *string, nowMillis int64) (model.SessionMessage, error)
+	ListMessages(ctx context.Context, userID, sessionID string, after int64, limit int) ([]model.SessionMessage, error)
+	QueryMessages(ctx context.Context, userID, sessionID string, q MessageQuery) ([]model.SessionMessage, error)
+
+	UpsertMachine(ctx context.Context, userID, machineID, metadata string, daemonState *string, dataEncryptionKey *string, nowMillis int64) (model.Machine, bool, error)
+	GetMachine(ctx context.Context, userID, machineID string) (model.Machine, bool)
+	ListMachines(ctx context.Context, userID string) []model.Machine
+	UpdateMachineMetadata(ctx context.Context, userID, machineID string, expectedVersion int, metadata string, nowMillis int64) (status string, version int, currentValue string)
+	UpdateMachineDaemonState(ctx context.Context, userID, machineID string, expectedVersion int, daemonState *string, nowMillis int64) (status string, version int, currentValue *string)
+	DeleteMachine(ctx context.Context, userID, machineID string, nowMillis int64) bool
+
+	ListArtifacts(ctx context.Context, userID string) []model.Artifact
+	GetArtifact(ctx context.Context, userID, artifactID string) (model.Artifact, bool)
+	CreateArtifactWithChecksums(ctx context.Context, userID, artifactID, header, body, dataEncryptionKey string, sums ArtifactChecksums, nowMillis int64) (model.Artifact, bool, error)
+	UpdateArtifactWithChecksums(ctx context.Context, userID, artifactID string, header *string, expectedHeaderVersion *int, body *string, expectedBodyVersion *int, sums ArtifactChecksums, nowMillis int64) (ArtifactUpdateResult, error)
+	DeleteArtifact(ctx context.Context, userID, artifactID string) bool
+
+	TombstoneCutoff(nowMillis int64) int64
+	ListTombstones(ctx context.Context, userID string, since int64, nowMillis int64) []model.Tombstone
+
+	ExportUser(ctx context.Context, userID string, w io.Writer, format ExportFormat) error
+	DeleteAccount(ctx context.Context, publicKey string) (AccountDeletion, bool)
+}
+
+var _ Storage = (*Store)(nil)
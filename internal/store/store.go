@@ -1,8 +1,10 @@
 package store
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"log"
 	"os"
 	"path/filepath"
@@ -10,30 +12,94 @@ import (
 	"sync"
 	"time"
 
-	"github.com/google/uuid"
+	"happy-server-lite/internal/clock"
+	"happy-server-lite/internal/ids"
 	"happy-server-lite/internal/model"
 )
 
 type Store struct {
 	mu sync.RWMutex
 
-	machinesStateFile string
-	persistMu         sync.Mutex
+	machinesStateFile  string
+	sessionsStateFile  string
+	artifactsStateFile string
+	accountsStateFile  string
+	persistMu          sync.Mutex
+	machinesFlush      machinesFlusher
+	sessionsPersistMu  sync.Mutex
+	artifactsPersistMu sync.Mutex
+	accountsPersistMu  sync.Mutex
+	journal            *messageJournal
+	backend            Backend
+	// hydration is nil unless users are loaded from the backend on first
+	// access rather than on start.
+	hydration *hydration
+	// partitions is nil unless state is kept in per-account partitions in
+	// place of the state files.
+	partitions *statePartitions
+
+	// localIDMu makes the replay check and the append of a message sent
+	// with a local id one step.
+	localIDMu sync.Mutex
+
+	codec            Codec
+	compressMinBytes int
+
+	newID ids.Generator
+	clock clock.Clock
+
+	limits Limits
 
 	accountsByPublicKey map[string]model.Account
+	disabledAccounts    map[string]bool // userID
 	authRequestsByKey   map[string]model.AuthRequest
+	authRequestTTL      time.Duration
+	// authChallenges maps outstanding /v1/auth nonces to when they expire.
+	// They live minutes, so they are not persisted: a restart only makes
+	// clients fetch a new one.
+	authChallenges map[string]int64
+	// sessionLocks holds the advisory locks of sessions by session id. Like
+	// challenges they are short-lived and not persisted.
+	locksMu      sync.Mutex
+	sessionLocks map[string]sessionLocks
+	// metrics holds the metrics history by resolution, each oldest first.
+	metricsMu sync.Mutex
+	metrics   map[string][]metricsBucket
+
+	// users holds sessions and machines under a lock per shard of users
+	// rather than mu, so one busy user does not hold up everyone else.
+	users [userShardCount]userShard
 
-	sessionsByID       map[string]model.Session
-	sessionIDByUserTag map[string]string // userID + "|" + tag -> sessionID
-
-	machinesByID   map[string]model.Machine
 	artifactsByKey map[string]model.Artifact
 	artifactSeq    int64
 
 	accountSettingsByUserID map[string]accountSettings
+	pushTokens              map[string]model.PushToken // userID + "|" + token
+	refreshTokens           map[string]model.RefreshToken
+	apiKeys                 map[string]model.APIKey
+	devices                 map[string]model.Device
+	githubByUserID          map[string]model.GitHubIdentity
+
+	tombstonesMu       sync.Mutex
+	tombstones         map[string]model.Tombstone // tombstoneKey
+	tombstoneRetention time.Duration
+
+	messageRetention      time.Duration
+	maxMessagesPerSession int
+	purgeGrace            time.Duration
+	// hookFailures counts the compaction runs in a row whose PruneHook
+	// failed for each session.
+	hookFailuresMu sync.Mutex
+	hookFailures   map[string]int
+
+	memoryBudget MemoryBudget
+	evictions    evictionCounters
+	persistStats persistCounters
 
 	messages *messageStore
 	seq      *seqGenerator
+
+	eventBus
 }
 
 type accountSettings struct {
@@ -47,29 +113,213 @@ func New() *Store {
 
 type Options struct {
 	MachinesStateFile string
+	// MachinesFlushInterval, when set, writes MachinesStateFile at most once
+	// per interval in the background instead of after every change; Flush
+	// writes what is pending.
+	MachinesFlushInterval time.Duration
+	// SessionsStateFile, when set, keeps sessions and their messages in a
+	// JSON file rewritten after every change.
+	SessionsStateFile string
+	// MessageJournalDir moves messages out of SessionsStateFile into
+	// append-only per-session journals under the directory. It needs
+	// SessionsStateFile, since journals of unknown sessions are dropped.
+	MessageJournalDir string
+	// ArtifactsStateFile, when set, keeps artifacts in a JSON file rewritten
+	// after every change.
+	ArtifactsStateFile string
+	// AccountsStateFile, when set, keeps accounts, their settings and
+	// suspensions in a JSON file rewritten after every change, so user ids,
+	// and the tokens issued for them, survive restarts.
+	AccountsStateFile string
+	// StatePartitionDir, when set with StatePartitionKey, keeps what the
+	// four state files would hold in one file per account under the
+	// directory instead, encrypted with a key derived from
+	// StatePartitionKey for that account. The state file options are then
+	// ignored.
+	StatePartitionDir string
+	StatePartitionKey []byte
+	Limits            Limits
+	// TombstoneRetention is how long deletions stay visible to sync; zero
+	// picks 30 days.
+	TombstoneRetention time.Duration
+	// AuthRequestTTL is how long an auth request is kept after it was last
+	// polled or answered when ExpireAuthRequests runs; zero picks ten
+	// minutes.
+	AuthRequestTTL time.Duration
+	// MessageRetention and MaxMessagesPerSession bound how long and how many
+	// messages each session keeps when PruneMessages runs; zero disables
+	// either limit.
+	MessageRetention      time.Duration
+	MaxMessagesPerSession int
+	// PurgeGrace is how long deleted sessions and artifacts are kept before
+	// Purge removes them for good; zero picks 30 days.
+	PurgeGrace time.Duration
+	// MemoryBudget, when set, evicts old messages as soon as the store holds
+	// more than it allows.
+	MemoryBudget MemoryBudget
+	// Backend, when set, persists every record and is loaded on start.
+	Backend Backend
+	// HydratedUsers, when set with a Backend that is a UserBackend, loads a
+	// user's sessions, machines and messages on first access instead of
+	// loading everything on start, and keeps at most that many users in
+	// memory. It is ignored while state files, partitions or journals are
+	// kept. Sweeps over every user, such as PruneMessages, Purge and the
+	// session counts of Stats, reach only the users in memory.
+	HydratedUsers int
+	// Compression names a registered Codec applied at rest to state strings
+	// of at least CompressMinBytes (zero picks 4 KiB). Empty disables it.
+	Compression      string
+	CompressMinBytes int
+	// NewID generates the ids of accounts, sessions, messages and auth
+	// requests; nil picks random UUIDs. ids.NewULID makes them sort by
+	// creation time.
+	NewID ids.Generator
+	// Clock stamps changes the store makes without a caller-supplied time,
+	// such as artifact deletions and export headers; nil reads the wall
+	// clock.
+	Clock clock.Clock
+}
+
+func (o Options) idGenerator() ids.Generator {
+	if o.NewID == nil {
+		return ids.UUID
+	}
+	return o.NewID
 }
 
+// NewWithOptions is Open for callers that cannot go on without the store;
+// it panics when persisted state fails to load.
 func NewWithOptions(opts Options) *Store {
+	s, err := Open(opts)
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+// Open builds a store and loads what opts persist. It fails when any of it
+// cannot be loaded, rather than starting without it and overwriting it on
+// the next save.
+func Open(opts Options) (*Store, error) {
 	s := &Store{
 		accountsByPublicKey:     make(map[string]model.Account),
+		disabledAccounts:        make(map[string]bool),
 		authRequestsByKey:       make(map[string]model.AuthRequest),
-		sessionsByID:            make(map[string]model.Session),
-		sessionIDByUserTag:      make(map[string]string),
-		machinesByID:            make(map[string]model.Machine),
+		authChallenges:          make(map[string]int64),
+		sessionLocks:            make(map[string]sessionLocks),
+		metrics:                 make(map[string][]metricsBucket),
 		artifactsByKey:          make(map[string]model.Artifact),
 		accountSettingsByUserID: make(map[string]accountSettings),
+		pushTokens:              make(map[string]model.PushToken),
+		refreshTokens:           make(map[string]model.RefreshToken),
+		apiKeys:                 make(map[string]model.APIKey),
+		devices:                 make(map[string]model.Device),
+		githubByUserID:          make(map[string]model.GitHubIdentity),
 		messages:                newMessageStore(),
 		seq:                     newSeqGenerator(),
 		machinesStateFile:       opts.MachinesStateFile,
+		artifactsStateFile:      opts.ArtifactsStateFile,
+		accountsStateFile:       opts.AccountsStateFile,
+		machinesFlush:           machinesFlusher{interval: opts.MachinesFlushInterval},
+		sessionsStateFile:       opts.SessionsStateFile,
+		limits:                  opts.Limits.withDefaults(),
+		tombstones:              make(map[string]model.Tombstone),
+		tombstoneRetention:      opts.TombstoneRetention,
+		authRequestTTL:          opts.AuthRequestTTL,
+		messageRetention:        opts.MessageRetention,
+		maxMessagesPerSession:   opts.MaxMessagesPerSession,
+		purgeGrace:              opts.PurgeGrace,
+		memoryBudget:            opts.MemoryBudget,
+		backend:                 opts.Backend,
+		compressMinBytes:        opts.CompressMinBytes,
+		newID:                   opts.idGenerator(),
+		clock:                   opts.Clock,
+	}
+	if s.tombstoneRetention <= 0 {
+		s.tombstoneRetention = defaultTombstoneRetention
+	}
+	if opts.Compression != "" {
+		codec, ok := LookupCodec(opts.Compression)
+		if !ok {
+			log.Printf("store compression: unknown codec %q, storing uncompressed", opts.Compression)
+		}
+		s.codec = codec
+	}
+	if s.compressMinBytes <= 0 {
+		s.compressMinBytes = defaultCompressMinBytes
+	}
+	if opts.StatePartitionDir != "" {
+		if len(opts.StatePartitionKey) == 0 {
+			log.Printf("state partitions: ignored without a key")
+		} else {
+			s.partitions = newStatePartitions(opts.StatePartitionDir, opts.StatePartitionKey)
+			s.machinesStateFile, s.sessionsStateFile, s.artifactsStateFile, s.accountsStateFile = "", "", "", ""
+		}
 	}
 
+	// State files in an older format are rewritten once everything is
+	// loaded, so a sessions file is not given messages a journal holds.
+	var upgrade []func()
+	s.hydration = newHydration(opts)
+	if s.backend != nil {
+		if err := s.loadBackend(); err != nil {
+			return nil, fmt.Errorf("store persistence: load failed: %w", err)
+		}
+	}
+	if s.partitions != nil {
+		if err := s.loadPartitions(); err != nil {
+			return nil, fmt.Errorf("state partitions: load failed (%s): %w", s.partitions.dir, err)
+		}
+	}
 	if s.machinesStateFile != "" {
-		if err := s.loadMachinesFromFile(s.machinesStateFile); err != nil {
-			log.Printf("machines persistence: load failed (%s): %v", s.machinesStateFile, err)
+		if migrated, err := s.loadMachinesFromFile(s.machinesStateFile); err != nil {
+			return nil, fmt.Errorf("machines persistence: load failed (%s): %w", s.machinesStateFile, err)
+		} else if migrated {
+			upgrade = append(upgrade, s.saveMachines)
+		}
+	}
+	if s.sessionsStateFile != "" {
+		if migrated, err := s.loadSessionsFromFile(s.sessionsStateFile); err != nil {
+			return nil, fmt.Errorf("sessions persistence: load failed (%s): %w", s.sessionsStateFile, err)
+		} else if migrated {
+			upgrade = append(upgrade, s.saveSessions)
+		}
+	}
+	if s.accountsStateFile != "" {
+		if migrated, err := s.loadAccountsFromFile(s.accountsStateFile); err != nil {
+			return nil, fmt.Errorf("accounts persistence: load failed (%s): %w", s.accountsStateFile, err)
+		} else if migrated {
+			upgrade = append(upgrade, s.saveAccounts)
+		}
+	}
+	if s.artifactsStateFile != "" {
+		if migrated, err := s.loadArtifactsFromFile(s.artifactsStateFile); err != nil {
+			return nil, fmt.Errorf("artifacts persistence: load failed (%s): %w", s.artifactsStateFile, err)
+		} else if migrated {
+			upgrade = append(upgrade, s.saveArtifacts)
+		}
+	}
+	if opts.MessageJournalDir != "" {
+		if s.sessionsStateFile == "" && s.partitions == nil {
+			log.Printf("message journal: ignored without a sessions state file")
+		} else {
+			s.journal = newMessageJournal(opts.MessageJournalDir)
+			s.mu.Lock()
+			err := s.loadJournalLocked()
+			s.mu.Unlock()
+			if err != nil {
+				return nil, fmt.Errorf("message journal: load failed (%s): %w", opts.MessageJournalDir, err)
+			}
+			s.CompactJournals()
 		}
 	}
+	s.reconcileSessionSeqs()
+	s.enforceMemoryBudget()
+	for _, save := range upgrade {
+		save()
+	}
 
-	return s
+	return s, nil
 }
 
 type persistedMachinesFile struct {
@@ -78,103 +328,113 @@ type persistedMachinesFile struct {
 	SavedAt  int64           `json:"savedAt"`
 }
 
-func (s *Store) loadMachinesFromFile(path string) error {
-	data, err := os.ReadFile(path)
-	if err != nil {
-		if os.IsNotExist(err) {
-			return nil
-		}
-		return err
-	}
-	if len(data) == 0 {
-		return nil
-	}
-
+// loadMachinesFromFile reports whether the file was in an older format.
+func (s *Store) loadMachinesFromFile(path string) (bool, error) {
 	var file persistedMachinesFile
-	if err := json.Unmarshal(data, &file); err != nil {
-		return err
-	}
-	if file.Version != 1 {
-		return errors.New("unsupported machines state version")
+	found, migrated, err := readStateFile(path, stateMachines, &file)
+	if err != nil || !found {
+		return false, err
 	}
 
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	s.lockUsers()
+	defer s.unlockUsers()
 	for _, m := range file.Machines {
 		if m.ID == "" || m.UserID == "" {
 			continue
 		}
-		s.machinesByID[m.ID] = m
+		m, err := decompressMachine(m)
+		if err != nil {
+			return false, fmt.Errorf("machine %s: %w", m.ID, err)
+		}
+		s.putMachineLocked(m)
 	}
-	return nil
+	return migrated, nil
 }
 
-func (s *Store) snapshotMachinesLocked() []model.Machine {
-	result := make([]model.Machine, 0, len(s.machinesByID))
-	for _, m := range s.machinesByID {
-		result = append(result, m)
-	}
-	sort.Slice(result, func(i, j int) bool { return result[i].ID < result[j].ID })
+func (s *Store) snapshotMachines() []model.Machine {
+	result := make([]model.Machine, 0)
+	s.eachMachine(func(m model.Machine) { result = append(result, m) })
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].ID != result[j].ID {
+			return result[i].ID < result[j].ID
+		}
+		return result[i].UserID < result[j].UserID
+	})
 	return result
 }
 
-func (s *Store) persistMachinesSnapshot(machines []model.Machine) {
-	path := s.machinesStateFile
-	if path == "" {
+// saveMachines rewrites the machines state file.
+func (s *Store) saveMachines() {
+	if s.partitions != nil {
+		s.savePartitions()
+		return
+	}
+	if s.machinesStateFile == "" {
 		return
 	}
-
 	s.persistMu.Lock()
 	defer s.persistMu.Unlock()
+	s.writeMachinesLocked()
+}
 
-	dir := filepath.Dir(path)
-	if err := os.MkdirAll(dir, 0o700); err != nil {
-		log.Printf("machines persistence: mkdir failed (%s): %v", dir, err)
-		return
+// writeMachinesLocked snapshots machines and writes them while the caller
+// holds persistMu, so the last writer always writes the newest state.
+func (s *Store) writeMachinesLocked() {
+	machines := s.snapshotMachines()
+	for i := range machines {
+		machines[i] = s.compressMachine(machines[i])
+	}
+	file := persistedMachinesFile{Version: stateVersions[stateMachines], Machines: machines, SavedAt: time.Now().UnixMilli()}
+	if err := s.persistStats.machinesFile.record(writeStateFile(s.machinesStateFile, file)); err != nil {
+		log.Printf("machines persistence: %v", err)
 	}
+}
 
-	file := persistedMachinesFile{Version: 1, Machines: machines, SavedAt: time.Now().UnixMilli()}
-	data, err := json.MarshalIndent(file, "", "  ")
+// writeStateFile replaces path with v as indented JSON by writing a 0600 temp
+// file next to it and renaming it into place.
+func writeStateFile(path string, v any) error {
+	data, err := json.MarshalIndent(v, "", "  ")
 	if err != nil {
-		log.Printf("machines persistence: marshal failed: %v", err)
-		return
+		return fmt.Errorf("marshal failed: %w", err)
+	}
+	return writeFileAtomic(path, append(data, '\n'))
+}
+
+func writeFileAtomic(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return fmt.Errorf("mkdir failed (%s): %w", dir, err)
 	}
-	data = append(data, '\n')
 
 	tmp, err := os.CreateTemp(dir, filepath.Base(path)+".tmp-*")
 	if err != nil {
-		log.Printf("machines persistence: create temp failed: %v", err)
-		return
+		return fmt.Errorf("create temp failed: %w", err)
 	}
 	tmpName := tmp.Name()
 	defer func() { _ = os.Remove(tmpName) }()
 
 	if err := tmp.Chmod(0o600); err != nil {
 		_ = tmp.Close()
-		log.Printf("machines persistence: chmod temp failed: %v", err)
-		return
+		return fmt.Errorf("chmod temp failed: %w", err)
 	}
 	if _, err := tmp.Write(data); err != nil {
 		_ = tmp.Close()
-		log.Printf("machines persistence: write temp failed: %v", err)
-		return
+		return fmt.Errorf("write temp failed: %w", err)
 	}
 	if err := tmp.Sync(); err != nil {
 		_ = tmp.Close()
-		log.Printf("machines persistence: sync temp failed: %v", err)
-		return
+		return fmt.Errorf("sync temp failed: %w", err)
 	}
 	if err := tmp.Close(); err != nil {
-		log.Printf("machines persistence: close temp failed: %v", err)
-		return
+		return fmt.Errorf("close temp failed: %w", err)
 	}
 	if err := os.Rename(tmpName, path); err != nil {
-		log.Printf("machines persistence: rename failed: %v", err)
-		return
+		return fmt.Errorf("rename failed: %w", err)
 	}
+	return nil
 }
 
-func (s *Store) GetAccountSettings(userID string) (*string, int) {
+func (s *Store) GetAccountSettings(ctx context.Context, userID string) (*string, int) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
@@ -185,15 +445,19 @@ func (s *Store) GetAccountSettings(userID string) (*string, int) {
 	return st.Settings, st.Version
 }
 
-func (s *Store) UpdateAccountSettings(userID string, expectedVersion int, settings string, nowMillis int64) (status string, currentVersion int, currentSettings *string) {
+func (s *Store) UpdateAccountSettings(ctx context.Context, userID string, expectedVersion int, settings string, nowMillis int64) (status string, currentVersion int, currentSettings *string) {
 	if userID == "" {
 		return "error", 0, nil
 	}
 
 	s.mu.Lock()
-	defer s.mu.Unlock()
+	changed := false
+	defer s.unlockAndSaveAccounts(&changed)
 
 	st := s.accountSettingsByUserID[userID]
+	if checkSize("settings", settings, s.limits.MaxSettingsBytes) != nil {
+		return "too-large", st.Version, st.Settings
+	}
 	if expectedVersion != st.Version {
 		return "version-mismatch", st.Version, st.Settings
 	}
@@ -201,27 +465,59 @@ func (s *Store) UpdateAccountSettings(userID string, expectedVersion int, settin
 	st.Version++
 	st.Settings = &settings
 	s.accountSettingsByUserID[userID] = st
+	s.persist(recordSettings, userID, st)
+	changed = true
 	return "success", st.Version, st.Settings
 }
 
-func (s *Store) GetOrCreateAccount(publicKey string, nowMillis int64) (model.Account, bool) {
+func (s *Store) GetOrCreateAccount(ctx context.Context, publicKey string, nowMillis int64) (model.Account, bool) {
 	s.mu.Lock()
-	defer s.mu.Unlock()
+	changed := false
+	defer s.unlockAndSaveAccounts(&changed)
 
 	if existing, ok := s.accountsByPublicKey[publicKey]; ok {
 		return existing, false
 	}
 
 	acc := model.Account{
-		ID:        uuid.NewString(),
+		ID:        s.newID(),
 		PublicKey: publicKey,
 		CreatedAt: nowMillis,
 	}
 	s.accountsByPublicKey[publicKey] = acc
+	s.persist(recordAccount, publicKey, acc)
+	changed = true
 	return acc, true
 }
 
-func (s *Store) GetAuthRequest(publicKey string) (model.AuthRequest, bool) {
+// SetAccountDisabled suspends or reinstates userID and reports whether the
+// flag changed.
+func (s *Store) SetAccountDisabled(ctx context.Context, userID string, disabled bool) bool {
+	s.mu.Lock()
+	changed := false
+	defer s.unlockAndSaveAccounts(&changed)
+
+	if s.disabledAccounts[userID] == disabled {
+		return false
+	}
+	changed = true
+	if disabled {
+		s.disabledAccounts[userID] = true
+		s.persist(recordDisabled, userID, true)
+	} else {
+		delete(s.disabledAccounts, userID)
+		s.unpersist(recordDisabled, userID)
+	}
+	return true
+}
+
+func (s *Store) IsAccountDisabled(ctx context.Context, userID string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.disabledAccounts[userID]
+}
+
+func (s *Store) GetAuthRequest(ctx context.Context, publicKey string) (model.AuthRequest, bool) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
@@ -229,29 +525,39 @@ func (s *Store) GetAuthRequest(publicKey string) (model.AuthRequest, bool) {
 	return req, ok
 }
 
-func (s *Store) UpsertAuthRequest(publicKey string, supportsV2 bool, nowMillis int64) model.AuthRequest {
+// UpsertAuthRequest creates the auth request for publicKey or refreshes it.
+// A non-nil device replaces the one recorded.
+func (s *Store) UpsertAuthRequest(ctx context.Context, publicKey string, supportsV2 bool, device *model.AuthRequestDevice, nowMillis int64) model.AuthRequest {
 	s.mu.Lock()
-	defer s.mu.Unlock()
-
 	if existing, ok := s.authRequestsByKey[publicKey]; ok {
 		existing.SupportsV2 = existing.SupportsV2 || supportsV2
+		if device != nil {
+			existing.Device = device
+		}
 		existing.UpdatedAt = nowMillis
 		s.authRequestsByKey[publicKey] = existing
+		s.persist(recordAuthRequest, publicKey, existing)
+		s.mu.Unlock()
 		return existing
 	}
 
 	req := model.AuthRequest{
-		ID:         uuid.NewString(),
+		ID:         s.newID(),
 		PublicKey:  publicKey,
 		SupportsV2: supportsV2,
+		Device:     device,
 		CreatedAt:  nowMillis,
 		UpdatedAt:  nowMillis,
 	}
 	s.authRequestsByKey[publicKey] = req
+	s.persist(recordAuthRequest, publicKey, req)
+	s.mu.Unlock()
+
+	s.publish(Event{Type: EventAuthRequested, PublicKey: publicKey, At: nowMillis})
 	return req
 }
 
-func (s *Store) AuthorizeAuthRequest(publicKey, response, responseAccountID, token string, nowMillis int64) (model.AuthRequest, bool) {
+func (s *Store) AuthorizeAuthRequest(ctx context.Context, publicKey, response, responseAccountID, token string, nowMillis int64) (model.AuthRequest, bool) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
@@ -262,32 +568,62 @@ func (s *Store) AuthorizeAuthRequest(publicKey, response, responseAccountID, tok
 	req.Response = response
 	req.ResponseAccountID = responseAccountID
 	req.Token = token
+	req.Rejected = false
 	req.UpdatedAt = nowMillis
 	s.authRequestsByKey[publicKey] = req
+	s.persist(recordAuthRequest, publicKey, req)
 	return req, true
 }
 
-func userTagKey(userID, tag string) string {
-	return userID + "|" + tag
+// RejectAuthRequest marks the pending auth request for publicKey as declined.
+// An already authorized request is returned unchanged.
+func (s *Store) RejectAuthRequest(ctx context.Context, publicKey string, nowMillis int64) (model.AuthRequest, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	req, ok := s.authRequestsByKey[publicKey]
+	if !ok {
+		return model.AuthRequest{}, false
+	}
+	if req.Token != "" || req.Rejected {
+		return req, true
+	}
+	req.Rejected = true
+	req.UpdatedAt = nowMillis
+	s.authRequestsByKey[publicKey] = req
+	s.persist(recordAuthRequest, publicKey, req)
+	return req, true
 }
 
-func (s *Store) GetOrCreateSession(userID, tag, metadata string, agentState *string, dataEncryptionKey *string, nowMillis int64) (model.Session, bool, error) {
+func (s *Store) GetOrCreateSession(ctx context.Context, userID, tag, metadata string, agentState *string, dataEncryptionKey *string, nowMillis int64) (model.Session, bool, error) {
 	if userID == "" {
 		return model.Session{}, false, errors.New("missing userID")
 	}
 	if tag == "" {
 		return model.Session{}, false, errors.New("missing tag")
 	}
+	if err := checkSize("metadata", metadata, s.limits.MaxMetadataBytes); err != nil {
+		return model.Session{}, false, err
+	}
+	if err := checkOptionalSize("agentState", agentState, s.limits.MaxAgentStateBytes); err != nil {
+		return model.Session{}, false, err
+	}
 
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	key := userTagKey(userID, tag)
-	if sid, ok := s.sessionIDByUserTag[key]; ok {
-		sess := s.sessionsByID[sid]
+	sh, unpin, err := s.userShard(userID)
+	if err != nil {
+		return model.Session{}, false, err
+	}
+	defer unpin()
+	sh.mu.Lock()
+	dirty := false
+	defer s.unlockAndSaveSessions(sh, &dirty)
+
+	u := sh.recordsForWrite(userID)
+	if sid, ok := u.sessionByTag[tag]; ok {
+		sess := u.sessions[sid]
 		if sess.Deleted {
 			// Treat deleted as new
-			delete(s.sessionIDByUserTag, key)
+			delete(u.sessionByTag, tag)
 		} else {
 			changed := false
 			if metadata != "" && metadata != sess.Metadata {
@@ -308,7 +644,9 @@ func (s *Store) GetOrCreateSession(userID, tag, metadata string, agentState *str
 			}
 			if changed {
 				sess.UpdatedAt = nowMillis
-				s.sessionsByID[sid] = sess
+				u.sessions[sid] = sess
+				s.persist(recordSession, sid, sess)
+				dirty = true
 			}
 			return sess, false, nil
 		}
@@ -323,7 +661,7 @@ func (s *Store) GetOrCreateSession(userID, tag, metadata string, agentState *str
 		agentStateVersion = 1
 	}
 
-	sid := uuid.NewString()
+	sid := s.newID()
 	sess := model.Session{
 		ID:                sid,
 		UserID:            userID,
@@ -339,69 +677,109 @@ func (s *Store) GetOrCreateSession(userID, tag, metadata string, agentState *str
 		CreatedAt:         nowMillis,
 		UpdatedAt:         nowMillis,
 	}
-	s.sessionsByID[sid] = sess
-	s.sessionIDByUserTag[key] = sid
+	u.sessions[sid] = sess
+	u.sessionByTag[tag] = sid
+	s.persist(recordSession, sid, sess)
+	dirty = true
 	return sess, true, nil
 }
 
-func (s *Store) ListSessions(userID string) []model.Session {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+func (s *Store) ListSessions(ctx context.Context, userID string) []model.Session {
+	sh, unpin, err := s.userShard(userID)
+	if err != nil {
+		return []model.Session{}
+	}
+	defer unpin()
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
 
 	result := make([]model.Session, 0)
-	for _, sess := range s.sessionsByID {
-		if sess.UserID == userID && !sess.Deleted {
-			result = append(result, sess)
+	if u := sh.records(userID); u != nil {
+		for _, sess := range u.sessions {
+			if !sess.Deleted {
+				result = append(result, sess)
+			}
 		}
 	}
 	sort.Slice(result, func(i, j int) bool { return result[i].UpdatedAt > result[j].UpdatedAt })
 	return result
 }
 
-func (s *Store) UpdateSessionMetadata(userID, sessionID string, expectedVersion int, metadata string, nowMillis int64) (status string, version int, currentValue string) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	sess, ok := s.sessionsByID[sessionID]
-	if !ok || sess.UserID != userID || sess.Deleted {
+func (s *Store) UpdateSessionMetadata(ctx context.Context, userID, sessionID string, expectedVersion int, metadata string, nowMillis int64) (status string, version int, currentValue string) {
+	sh, unpin, err := s.userShard(userID)
+	if err != nil {
+		return "error", 0, ""
+	}
+	defer unpin()
+	sh.mu.Lock()
+	changed := false
+	defer s.unlockAndSaveSessions(sh, &changed)
+
+	u := sh.records(userID)
+	sess, ok := u.session(sessionID)
+	if !ok || sess.Deleted {
 		return "not-found", 0, ""
 	}
 	if expectedVersion != sess.MetadataVersion {
 		return "version-mismatch", sess.MetadataVersion, sess.Metadata
 	}
+	if checkSize("metadata", metadata, s.limits.MaxMetadataBytes) != nil {
+		return "too-large", sess.MetadataVersion, sess.Metadata
+	}
 
 	sess.Metadata = metadata
 	sess.MetadataVersion++
 	sess.UpdatedAt = nowMillis
-	s.sessionsByID[sessionID] = sess
+	u.sessions[sessionID] = sess
+	s.persist(recordSession, sessionID, sess)
+	changed = true
 	return "success", sess.MetadataVersion, sess.Metadata
 }
 
-func (s *Store) UpdateSessionAgentState(userID, sessionID string, expectedVersion int, agentState *string, nowMillis int64) (status string, version int, currentValue *string) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	sess, ok := s.sessionsByID[sessionID]
-	if !ok || sess.UserID != userID || sess.Deleted {
+func (s *Store) UpdateSessionAgentState(ctx context.Context, userID, sessionID string, expectedVersion int, agentState *string, nowMillis int64) (status string, version int, currentValue *string) {
+	sh, unpin, err := s.userShard(userID)
+	if err != nil {
+		return "error", 0, nil
+	}
+	defer unpin()
+	sh.mu.Lock()
+	changed := false
+	defer s.unlockAndSaveSessions(sh, &changed)
+
+	u := sh.records(userID)
+	sess, ok := u.session(sessionID)
+	if !ok || sess.Deleted {
 		return "not-found", 0, nil
 	}
 	if expectedVersion != sess.AgentStateVersion {
 		return "version-mismatch", sess.AgentStateVersion, sess.AgentState
 	}
+	if checkOptionalSize("agentState", agentState, s.limits.MaxAgentStateBytes) != nil {
+		return "too-large", sess.AgentStateVersion, sess.AgentState
+	}
 
 	sess.AgentState = agentState
 	sess.AgentStateVersion++
 	sess.UpdatedAt = nowMillis
-	s.sessionsByID[sessionID] = sess
+	u.sessions[sessionID] = sess
+	s.persist(recordSession, sessionID, sess)
+	changed = true
 	return "success", sess.AgentStateVersion, sess.AgentState
 }
 
-func (s *Store) SetSessionActive(userID, sessionID string, active bool, activeAt int64, nowMillis int64) bool {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	sess, ok := s.sessionsByID[sessionID]
-	if !ok || sess.UserID != userID || sess.Deleted {
+func (s *Store) SetSessionActive(ctx context.Context, userID, sessionID string, active bool, activeAt int64, nowMillis int64) bool {
+	sh, unpin, err := s.userShard(userID)
+	if err != nil {
+		return false
+	}
+	defer unpin()
+	sh.mu.Lock()
+	changed := false
+	defer s.unlockAndSaveSessions(sh, &changed)
+
+	u := sh.records(userID)
+	sess, ok := u.session(sessionID)
+	if !ok || sess.Deleted {
 		return false
 	}
 	sess.Active = active
@@ -409,64 +787,197 @@ func (s *Store) SetSessionActive(userID, sessionID string, active bool, activeAt
 		sess.ActiveAt = activeAt
 	}
 	sess.UpdatedAt = nowMillis
-	s.sessionsByID[sessionID] = sess
+	u.sessions[sessionID] = sess
+	s.persist(recordSession, sessionID, sess)
+	changed = true
 	return true
 }
 
-func (s *Store) GetSession(userID, sessionID string) (model.Session, bool) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+func (s *Store) GetSession(ctx context.Context, userID, sessionID string) (model.Session, bool) {
+	sh, unpin, err := s.userShard(userID)
+	if err != nil {
+		return model.Session{}, false
+	}
+	defer unpin()
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
 
-	sess, ok := s.sessionsByID[sessionID]
-	if !ok || sess.UserID != userID || sess.Deleted {
+	sess, ok := sh.records(userID).session(sessionID)
+	if !ok || sess.Deleted {
 		return model.Session{}, false
 	}
 	return sess, true
 }
 
-func (s *Store) DeleteSession(userID, sessionID string, nowMillis int64) bool {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+// GetSessionByTag returns userID's live session with tag, found through the
+// tag index rather than a scan.
+func (s *Store) GetSessionByTag(ctx context.Context, userID, tag string) (model.Session, bool) {
+	sh, unpin, err := s.userShard(userID)
+	if err != nil {
+		return model.Session{}, false
+	}
+	defer unpin()
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+
+	u := sh.records(userID)
+	if u == nil {
+		return model.Session{}, false
+	}
+	sess, ok := u.session(u.sessionByTag[tag])
+	if !ok || sess.Deleted {
+		return model.Session{}, false
+	}
+	return sess, true
+}
+
+func (s *Store) DeleteSession(ctx context.Context, userID, sessionID string, nowMillis int64) bool {
+	if !s.deleteSession(userID, sessionID, nowMillis) {
+		return false
+	}
+	s.dropSessionLocks(sessionID)
+	s.publish(Event{Type: EventSessionDeleted, Origin: OriginREST, UserID: userID, SessionID: sessionID, At: nowMillis})
+	return true
+}
 
-	sess, ok := s.sessionsByID[sessionID]
-	if !ok || sess.UserID != userID || sess.Deleted {
+func (s *Store) deleteSession(userID, sessionID string, nowMillis int64) bool {
+	sh, unpin, err := s.userShard(userID)
+	if err != nil {
+		return false
+	}
+	defer unpin()
+	sh.mu.Lock()
+	changed := false
+	defer s.unlockAndSaveSessions(sh, &changed)
+
+	u := sh.records(userID)
+	sess, ok := u.session(sessionID)
+	if !ok || sess.Deleted {
 		return false
 	}
 	sess.Deleted = true
 	sess.UpdatedAt = nowMillis
-	s.sessionsByID[sessionID] = sess
+	u.sessions[sessionID] = sess
 
 	// best-effort index cleanup
-	key := userTagKey(userID, sess.Tag)
-	if s.sessionIDByUserTag[key] == sessionID {
-		delete(s.sessionIDByUserTag, key)
+	if u.sessionByTag[sess.Tag] == sessionID {
+		delete(u.sessionByTag, sess.Tag)
 	}
 
+	s.persist(recordSession, sessionID, sess)
 	s.messages.deleteSession(sessionID)
+	s.unpersistMessages(sessionID)
+	if s.journal != nil {
+		s.journal.remove(sessionID)
+	}
+	s.recordTombstone(TombstoneSession, userID, sessionID, nowMillis)
+	changed = true
 	return true
 }
 
-func (s *Store) AppendMessage(userID, sessionID, content string, nowMillis int64) (model.SessionMessage, error) {
-	_, ok := s.GetSession(userID, sessionID)
+func (s *Store) AppendMessage(ctx context.Context, userID, sessionID, content string, nowMillis int64) (model.SessionMessage, error) {
+	return s.AppendMessageWithChecksum(ctx, userID, sessionID, content, "", nowMillis)
+}
+
+// AppendMessageWithChecksum is AppendMessage with an optional hex SHA-256 of
+// content that is verified, stored and returned on reads.
+func (s *Store) AppendMessageWithChecksum(ctx context.Context, userID, sessionID, content, checksum string, nowMillis int64) (model.SessionMessage, error) {
+	return s.AppendMessageFrom(ctx, OriginREST, userID, sessionID, content, checksum, nowMillis)
+}
+
+// AppendMessageFrom is AppendMessageWithChecksum recording which API the
+// message arrived through on the published event.
+func (s *Store) AppendMessageFrom(ctx context.Context, origin, userID, sessionID, content, checksum string, nowMillis int64) (model.SessionMessage, error) {
+	msg, _, err := s.AppendMessageOnce(ctx, origin, userID, sessionID, content, checksum, "", nowMillis)
+	return msg, err
+}
+
+// AppendMessageOnce is AppendMessageFrom with the client's local id for the
+// message. A localID the session already holds a message for is a replay of
+// that send: the existing message is returned, nothing is appended or
+// published, and created is false. An empty localID never matches.
+func (s *Store) AppendMessageOnce(ctx context.Context, origin, userID, sessionID, content, checksum, localID string, nowMillis int64) (model.SessionMessage, bool, error) {
+	unpin, err := s.pinUser(userID)
+	if err != nil {
+		return model.SessionMessage{}, false, err
+	}
+	defer unpin()
+
+	_, ok := s.GetSession(ctx, userID, sessionID)
 	if !ok {
-		return model.SessionMessage{}, errors.New("session not found")
+		return model.SessionMessage{}, false, errors.New("session not found")
+	}
+	checksum, err = verifyChecksum(content, checksum)
+	if err != nil {
+		return model.SessionMessage{}, false, err
+	}
+	if localID != "" {
+		s.localIDMu.Lock()
+		if existing, ok := s.messages.byLocalID(sessionID, localID); ok {
+			s.localIDMu.Unlock()
+			return existing, false, nil
+		}
 	}
 
 	seq := s.seq.nextForSession(sessionID)
 	msg := model.SessionMessage{
-		ID:        uuid.NewString(),
+		ID:        s.newID(),
 		SessionID: sessionID,
 		Seq:       seq,
 		Content:   content,
+		Checksum:  checksum,
+		LocalID:   localID,
 		CreatedAt: nowMillis,
 		UpdatedAt: nowMillis,
 	}
 	s.messages.append(sessionID, msg)
-	return msg, nil
+	if localID != "" {
+		s.localIDMu.Unlock()
+	}
+	s.persistMessage(userID, msg)
+	s.bumpSessionSeq(userID, sessionID, seq, nowMillis)
+	if s.journal != nil {
+		if err := s.persistStats.journal.record(s.journal.append(msg)); err != nil {
+			log.Printf("message journal: append to %s failed: %v", sessionID, err)
+		}
+	} else {
+		s.saveSessions()
+	}
+	s.publish(Event{Type: EventMessageAppended, Origin: origin, UserID: userID, SessionID: sessionID, Message: &msg, At: nowMillis})
+	s.enforceMemoryBudget()
+	return msg, true, nil
+}
+
+// bumpSessionSeq records seq as the session's newest message. The sessions
+// state file is written by the caller along with the message; journaled
+// stores leave it behind and catch up in reconcileSessionSeqs on load.
+func (s *Store) bumpSessionSeq(userID, sessionID string, seq, nowMillis int64) {
+	sh, unpin, err := s.userShard(userID)
+	if err != nil {
+		return
+	}
+	defer unpin()
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	u := sh.records(userID)
+	sess, ok := u.session(sessionID)
+	if !ok || sess.Deleted || seq <= sess.Seq {
+		return
+	}
+	sess.Seq = seq
+	sess.UpdatedAt = nowMillis
+	u.sessions[sessionID] = sess
+	s.persist(recordSession, sessionID, sess)
 }
 
-func (s *Store) ListMessages(userID, sessionID string, after int64, limit int) ([]model.SessionMessage, error) {
-	_, ok := s.GetSession(userID, sessionID)
+func (s *Store) ListMessages(ctx context.Context, userID, sessionID string, after int64, limit int) ([]model.SessionMessage, error) {
+	unpin, err := s.pinUser(userID)
+	if err != nil {
+		return nil, err
+	}
+	defer unpin()
+
+	_, ok := s.GetSession(ctx, userID, sessionID)
 	if !ok {
 		return nil, errors.New("session not found")
 	}
@@ -476,19 +987,32 @@ func (s *Store) ListMessages(userID, sessionID string, after int64, limit int) (
 	return s.messages.getAfter(sessionID, after, limit), nil
 }
 
-func (s *Store) UpsertMachine(userID, machineID, metadata string, daemonState *string, dataEncryptionKey *string, nowMillis int64) (model.Machine, bool, error) {
+// machineKey namespaces a machine id by its owner. Daemons derive machine
+// ids themselves, so two users' machines may share one.
+func machineKey(userID, machineID string) string {
+	return userID + "|" + machineID
+}
+
+func (s *Store) UpsertMachine(ctx context.Context, userID, machineID, metadata string, daemonState *string, dataEncryptionKey *string, nowMillis int64) (model.Machine, bool, error) {
 	if machineID == "" {
 		return model.Machine{}, false, errors.New("missing machine id")
 	}
+	if err := checkSize("metadata", metadata, s.limits.MaxMetadataBytes); err != nil {
+		return model.Machine{}, false, err
+	}
+	if err := checkOptionalSize("daemonState", daemonState, s.limits.MaxDaemonStateBytes); err != nil {
+		return model.Machine{}, false, err
+	}
 
-	s.mu.Lock()
-
-	if existing, ok := s.machinesByID[machineID]; ok {
-		if existing.UserID != userID {
-			s.mu.Unlock()
-			return model.Machine{}, false, errors.New("machine belongs to another user")
-		}
+	sh, unpin, err := s.userShard(userID)
+	if err != nil {
+		return model.Machine{}, false, err
+	}
+	defer unpin()
+	sh.mu.Lock()
 
+	u := sh.recordsForWrite(userID)
+	if existing, ok := u.machines[machineID]; ok {
 		changed := false
 		if metadata != "" && metadata != existing.Metadata {
 			existing.Metadata = metadata
@@ -506,17 +1030,14 @@ func (s *Store) UpsertMachine(userID, machineID, metadata string, daemonState *s
 			existing.DataEncryptionKey = dataEncryptionKey
 			changed = true
 		}
-		var snapshot []model.Machine
 		if changed {
 			existing.UpdatedAt = nowMillis
-			s.machinesByID[machineID] = existing
-			if s.machinesStateFile != "" {
-				snapshot = s.snapshotMachinesLocked()
-			}
+			u.machines[machineID] = existing
+			s.persist(recordMachine, machineKey(userID, machineID), existing)
 		}
-		s.mu.Unlock()
-		if snapshot != nil {
-			s.persistMachinesSnapshot(snapshot)
+		sh.mu.Unlock()
+		if changed {
+			s.machinesChanged()
 		}
 		return existing, false, nil
 	}
@@ -530,6 +1051,7 @@ func (s *Store) UpsertMachine(userID, machineID, metadata string, daemonState *s
 		daemonStateVersion = 1
 	}
 
+	s.dropTombstone(model.Tombstone{Kind: TombstoneMachine, UserID: userID, ID: machineID})
 	m := model.Machine{
 		ID:                 machineID,
 		UserID:             userID,
@@ -541,94 +1063,124 @@ func (s *Store) UpsertMachine(userID, machineID, metadata string, daemonState *s
 		CreatedAt:          nowMillis,
 		UpdatedAt:          nowMillis,
 	}
-	s.machinesByID[machineID] = m
-	var snapshot []model.Machine
-	if s.machinesStateFile != "" {
-		snapshot = s.snapshotMachinesLocked()
-	}
-	s.mu.Unlock()
-	if snapshot != nil {
-		s.persistMachinesSnapshot(snapshot)
-	}
+	u.machines[machineID] = m
+	s.persist(recordMachine, machineKey(userID, machineID), m)
+	sh.mu.Unlock()
+	s.machinesChanged()
 	return m, true, nil
 }
 
-func (s *Store) GetMachine(userID, machineID string) (model.Machine, bool) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-
-	m, ok := s.machinesByID[machineID]
-	if !ok || m.UserID != userID {
+func (s *Store) GetMachine(ctx context.Context, userID, machineID string) (model.Machine, bool) {
+	sh, unpin, err := s.userShard(userID)
+	if err != nil {
 		return model.Machine{}, false
 	}
-	return m, true
+	defer unpin()
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+
+	return sh.records(userID).machine(machineID)
 }
 
-func (s *Store) UpdateMachineMetadata(userID, machineID string, expectedVersion int, metadata string, nowMillis int64) (status string, version int, currentValue string) {
-	s.mu.Lock()
+func (s *Store) UpdateMachineMetadata(ctx context.Context, userID, machineID string, expectedVersion int, metadata string, nowMillis int64) (status string, version int, currentValue string) {
+	sh, unpin, err := s.userShard(userID)
+	if err != nil {
+		return "error", 0, ""
+	}
+	defer unpin()
+	sh.mu.Lock()
 
-	m, ok := s.machinesByID[machineID]
-	if !ok || m.UserID != userID {
-		s.mu.Unlock()
+	u := sh.records(userID)
+	m, ok := u.machine(machineID)
+	if !ok {
+		sh.mu.Unlock()
 		return "not-found", 0, ""
 	}
 	if expectedVersion != m.MetadataVersion {
-		s.mu.Unlock()
+		sh.mu.Unlock()
 		return "version-mismatch", m.MetadataVersion, m.Metadata
 	}
+	if checkSize("metadata", metadata, s.limits.MaxMetadataBytes) != nil {
+		sh.mu.Unlock()
+		return "too-large", m.MetadataVersion, m.Metadata
+	}
 
 	m.Metadata = metadata
 	m.MetadataVersion++
 	m.UpdatedAt = nowMillis
-	s.machinesByID[machineID] = m
-
-	var snapshot []model.Machine
-	if s.machinesStateFile != "" {
-		snapshot = s.snapshotMachinesLocked()
-	}
-	s.mu.Unlock()
-	if snapshot != nil {
-		s.persistMachinesSnapshot(snapshot)
-	}
+	u.machines[machineID] = m
+	s.persist(recordMachine, machineKey(userID, machineID), m)
+	sh.mu.Unlock()
+	s.machinesChanged()
 	return "success", m.MetadataVersion, m.Metadata
 }
 
-func (s *Store) UpdateMachineDaemonState(userID, machineID string, expectedVersion int, daemonState *string, nowMillis int64) (status string, version int, currentValue *string) {
-	s.mu.Lock()
+func (s *Store) UpdateMachineDaemonState(ctx context.Context, userID, machineID string, expectedVersion int, daemonState *string, nowMillis int64) (status string, version int, currentValue *string) {
+	sh, unpin, err := s.userShard(userID)
+	if err != nil {
+		return "error", 0, nil
+	}
+	defer unpin()
+	sh.mu.Lock()
 
-	m, ok := s.machinesByID[machineID]
-	if !ok || m.UserID != userID {
-		s.mu.Unlock()
+	u := sh.records(userID)
+	m, ok := u.machine(machineID)
+	if !ok {
+		sh.mu.Unlock()
 		return "not-found", 0, nil
 	}
 	if expectedVersion != m.DaemonStateVersion {
-		s.mu.Unlock()
+		sh.mu.Unlock()
 		return "version-mismatch", m.DaemonStateVersion, m.DaemonState
 	}
+	if checkOptionalSize("daemonState", daemonState, s.limits.MaxDaemonStateBytes) != nil {
+		sh.mu.Unlock()
+		return "too-large", m.DaemonStateVersion, m.DaemonState
+	}
 
 	m.DaemonState = daemonState
 	m.DaemonStateVersion++
 	m.UpdatedAt = nowMillis
-	s.machinesByID[machineID] = m
+	u.machines[machineID] = m
+	s.persist(recordMachine, machineKey(userID, machineID), m)
+	sh.mu.Unlock()
+	s.machinesChanged()
+	return "success", m.DaemonStateVersion, m.DaemonState
+}
 
-	var snapshot []model.Machine
-	if s.machinesStateFile != "" {
-		snapshot = s.snapshotMachinesLocked()
+func (s *Store) DeleteMachine(ctx context.Context, userID, machineID string, nowMillis int64) bool {
+	sh, unpin, err := s.userShard(userID)
+	if err != nil {
+		return false
 	}
-	s.mu.Unlock()
-	if snapshot != nil {
-		s.persistMachinesSnapshot(snapshot)
+	defer unpin()
+	sh.mu.Lock()
+	u := sh.records(userID)
+	if _, ok := u.machine(machineID); !ok {
+		sh.mu.Unlock()
+		return false
 	}
-	return "success", m.DaemonStateVersion, m.DaemonState
+	delete(u.machines, machineID)
+	s.unpersist(recordMachine, machineKey(userID, machineID))
+	s.recordTombstone(TombstoneMachine, userID, machineID, nowMillis)
+	sh.mu.Unlock()
+	s.machinesChanged()
+	s.publish(Event{Type: EventMachineDeleted, Origin: OriginREST, UserID: userID, MachineID: machineID, At: nowMillis})
+	return true
 }
 
-func (s *Store) ListMachines(userID string) []model.Machine {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+func (s *Store) ListMachines(ctx context.Context, userID string) []model.Machine {
+	sh, unpin, err := s.userShard(userID)
+	if err != nil {
+		return []model.Machine{}
+	}
+	defer unpin()
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
 
 	result := make([]model.Machine, 0)
-	for _, m := range s.machinesByID {
-		if m.UserID == userID {
+	if u := sh.records(userID); u != nil {
+		for _, m := range u.machines {
 			result = append(result, m)
 		}
 	}
@@ -636,6 +1188,6 @@ func (s *Store) ListMachines(userID string) []model.Machine {
 	return result
 }
 
-func nowMillis() int64 {
-	return time.Now().UnixMilli()
+func (s *Store) nowMillis() int64 {
+	return clock.Now(s.clock).UnixMilli()
 }
@@ -1,12 +1,19 @@
 package store
 
-import "testing"
+import (
+	"context"
+	"testing"
+	"time"
+
+	"happy-server-lite/internal/clock"
+)
 
 func TestStore_SessionCRUD(t *testing.T) {
+	ctx := context.Background()
 	s := New()
 	now := int64(1000)
 
-	sess, created, err := s.GetOrCreateSession("u1", "tag1", "m1", nil, nil, now)
+	sess, created, err := s.GetOrCreateSession(ctx, "u1", "tag1", "m1", nil, nil, now)
 	if err != nil {
 		t.Fatalf("GetOrCreateSession: %v", err)
 	}
@@ -17,33 +24,34 @@ func TestStore_SessionCRUD(t *testing.T) {
 		t.Fatalf("expected tag1, got %q", sess.Tag)
 	}
 
-	list := s.ListSessions("u1")
+	list := s.ListSessions(ctx, "u1")
 	if len(list) != 1 {
 		t.Fatalf("expected 1 session, got %d", len(list))
 	}
 
-	if !s.DeleteSession("u1", sess.ID, now+1) {
+	if !s.DeleteSession(ctx, "u1", sess.ID, now+1) {
 		t.Fatalf("expected delete true")
 	}
-	list = s.ListSessions("u1")
+	list = s.ListSessions(ctx, "u1")
 	if len(list) != 0 {
 		t.Fatalf("expected 0 sessions, got %d", len(list))
 	}
 }
 
 func TestStore_Messages(t *testing.T) {
+	ctx := context.Background()
 	s := New()
 	now := int64(1000)
-	sess, _, err := s.GetOrCreateSession("u1", "tag1", "m1", nil, nil, now)
+	sess, _, err := s.GetOrCreateSession(ctx, "u1", "tag1", "m1", nil, nil, now)
 	if err != nil {
 		t.Fatalf("GetOrCreateSession: %v", err)
 	}
 
-	msg1, err := s.AppendMessage("u1", sess.ID, "c1", now)
+	msg1, err := s.AppendMessage(ctx, "u1", sess.ID, "c1", now)
 	if err != nil {
 		t.Fatalf("AppendMessage: %v", err)
 	}
-	msg2, err := s.AppendMessage("u1", sess.ID, "c2", now)
+	msg2, err := s.AppendMessage(ctx, "u1", sess.ID, "c2", now)
 	if err != nil {
 		t.Fatalf("AppendMessage: %v", err)
 	}
@@ -51,7 +59,7 @@ func TestStore_Messages(t *testing.T) {
 		t.Fatalf("expected seq to increase")
 	}
 
-	msgs, err := s.ListMessages("u1", sess.ID, msg1.Seq, 100)
+	msgs, err := s.ListMessages(ctx, "u1", sess.ID, msg1.Seq, 100)
 	if err != nil {
 		t.Fatalf("ListMessages: %v", err)
 	}
@@ -61,32 +69,79 @@ func TestStore_Messages(t *testing.T) {
 }
 
 func TestStore_AuthRequestAuthorize(t *testing.T) {
+	ctx := context.Background()
 	s := New()
 	now := int64(1000)
-	s.UpsertAuthRequest("pk", true, now)
-	_, ok := s.GetAuthRequest("pk")
+	s.UpsertAuthRequest(ctx, "pk", true, nil, now)
+	_, ok := s.GetAuthRequest(ctx, "pk")
 	if !ok {
 		t.Fatalf("expected auth request")
 	}
-	_, ok = s.AuthorizeAuthRequest("pk", "resp", "acct", "tok", now+1)
+	_, ok = s.AuthorizeAuthRequest(ctx, "pk", "resp", "acct", "tok", now+1)
 	if !ok {
 		t.Fatalf("expected authorize ok")
 	}
-	req, _ := s.GetAuthRequest("pk")
+	req, _ := s.GetAuthRequest(ctx, "pk")
 	if req.Response != "resp" || req.Token != "tok" {
 		t.Fatalf("unexpected request state")
 	}
 }
 
 func TestStore_MachineOwnership(t *testing.T) {
+	ctx := context.Background()
 	s := New()
 	now := int64(1000)
-	_, _, err := s.UpsertMachine("u1", "m1", "meta", nil, nil, now)
+	_, _, err := s.UpsertMachine(ctx, "u1", "m1", "meta", nil, nil, now)
 	if err != nil {
 		t.Fatalf("UpsertMachine: %v", err)
 	}
-	_, _, err = s.UpsertMachine("u2", "m1", "meta", nil, nil, now)
-	if err == nil {
-		t.Fatalf("expected error")
+	// Another user's daemon with the same id gets a machine of its own.
+	m, created, err := s.UpsertMachine(ctx, "u2", "m1", "meta-2", nil, nil, now)
+	if err != nil || !created || m.UserID != "u2" {
+		t.Fatalf("unexpected upsert: %+v %v %v", m, created, err)
+	}
+	if m, _ := s.GetMachine(ctx, "u1", "m1"); m.Metadata != "meta" {
+		t.Fatalf("expected u1's machine untouched, got %+v", m)
+	}
+}
+
+func TestSubscribeReceivesCommittedMutations(t *testing.T) {
+	ctx := context.Background()
+	s := New()
+	now := int64(1000)
+	var events []Event
+	s.Subscribe(func(ev Event) { events = append(events, ev) })
+
+	sess, _, err := s.GetOrCreateSession(ctx, "u1", "tag", "m", nil, nil, now)
+	if err != nil {
+		t.Fatalf("GetOrCreateSession: %v", err)
+	}
+	if _, err := s.AppendMessageFrom(ctx, OriginWebSocket, "u1", sess.ID, "c1", "", now); err != nil {
+		t.Fatalf("AppendMessageFrom: %v", err)
+	}
+	if _, err := s.AppendMessage(ctx, "u2", sess.ID, "c2", now); err == nil {
+		t.Fatalf("expected append to a foreign session to fail")
+	}
+	s.DeleteSession(ctx, "u1", sess.ID, now)
+
+	if len(events) != 2 {
+		t.Fatalf("expected 2 events, got %+v", events)
+	}
+	if ev := events[0]; ev.Type != EventMessageAppended || ev.Origin != OriginWebSocket || ev.Message == nil || ev.Message.Content != "c1" {
+		t.Fatalf("unexpected message event: %+v", ev)
+	}
+	if ev := events[1]; ev.Type != EventSessionDeleted || ev.SessionID != sess.ID || ev.UserID != "u1" {
+		t.Fatalf("unexpected delete event: %+v", ev)
+	}
+}
+
+func TestStore_ClockStampsArtifactDeletes(t *testing.T) {
+	ctx := context.Background()
+	clk := clock.NewFake(time.UnixMilli(5000))
+	s := NewWithOptions(Options{Clock: clk})
+	s.CreateArtifact(ctx, "u1", "a1", "h", "b", "key", 1000)
+	s.DeleteArtifact(ctx, "u1", "a1")
+	if a := s.artifactsByKey[artifactKey("u1", "a1")]; !a.Deleted || a.UpdatedAt != 5000 {
+		t.Fatalf("expected the deletion stamped by the clock, got %+v", a)
 	}
 }
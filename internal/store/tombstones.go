@@ -0,0 +1,75 @@
+package store
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"happy-server-lite/internal/model"
+)
+
+const (
+	TombstoneSession = "session"
+	TombstoneMachine = "machine"
+
+	defaultTombstoneRetention = 30 * 24 * time.Hour
+)
+
+// tombstoneKey keys t by kind and id. Machine ids are chosen by clients and
+// only unique per user, so machine tombstones are keyed by their owner too.
+func tombstoneKey(t model.Tombstone) string {
+	if t.Kind == TombstoneMachine {
+		return t.Kind + "|" + machineKey(t.UserID, t.ID)
+	}
+	return t.Kind + "|" + t.ID
+}
+
+// recordTombstone and dropTombstone take tombstonesMu, so they can be called
+// with a user shard locked.
+func (s *Store) recordTombstone(kind, userID, id string, nowMillis int64) {
+	t := model.Tombstone{Kind: kind, ID: id, UserID: userID, DeletedAt: nowMillis}
+	s.tombstonesMu.Lock()
+	defer s.tombstonesMu.Unlock()
+	s.tombstones[tombstoneKey(t)] = t
+	s.persist(recordTombstone, tombstoneKey(t), t)
+}
+
+// dropTombstone forgets the deletion of a record that was created again.
+func (s *Store) dropTombstone(t model.Tombstone) {
+	key := tombstoneKey(t)
+	s.tombstonesMu.Lock()
+	defer s.tombstonesMu.Unlock()
+	if _, ok := s.tombstones[key]; ok {
+		delete(s.tombstones, key)
+		s.unpersist(recordTombstone, key)
+	}
+}
+
+// TombstoneCutoff is the oldest deletion time still retained at nowMillis.
+// Clients whose last sync predates it may have missed deletions.
+func (s *Store) TombstoneCutoff(nowMillis int64) int64 {
+	return nowMillis - s.tombstoneRetention.Milliseconds()
+}
+
+// ListTombstones returns userID's deletions after since, oldest first, and
+// drops those past the retention period.
+func (s *Store) ListTombstones(ctx context.Context, userID string, since int64, nowMillis int64) []model.Tombstone {
+	cutoff := s.TombstoneCutoff(nowMillis)
+
+	s.tombstonesMu.Lock()
+	defer s.tombstonesMu.Unlock()
+
+	result := make([]model.Tombstone, 0)
+	for key, t := range s.tombstones {
+		if t.DeletedAt < cutoff {
+			delete(s.tombstones, key)
+			s.unpersist(recordTombstone, key)
+			continue
+		}
+		if t.UserID == userID && t.DeletedAt > since {
+			result = append(result, t)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].DeletedAt < result[j].DeletedAt })
+	return result
+}
@@ -0,0 +1,55 @@
+package store
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestStore_TombstonesForDeletedSessionsAndMachines(t *testing.T) {
+	ctx := context.Background()
+	s := NewWithOptions(Options{TombstoneRetention: time.Hour})
+	now := int64(1000)
+
+	sess, _, err := s.GetOrCreateSession(ctx, "u1", "tag1", "m1", nil, nil, now)
+	if err != nil {
+		t.Fatalf("GetOrCreateSession: %v", err)
+	}
+	if _, _, err := s.UpsertMachine(ctx, "u1", "machine-1", "m", nil, nil, now); err != nil {
+		t.Fatalf("UpsertMachine: %v", err)
+	}
+
+	if s.DeleteMachine(ctx, "u2", "machine-1", now+1) {
+		t.Fatalf("expected other user delete to fail")
+	}
+	s.DeleteSession(ctx, "u1", sess.ID, now+1)
+	if !s.DeleteMachine(ctx, "u1", "machine-1", now+2) {
+		t.Fatalf("expected machine delete")
+	}
+	if _, ok := s.GetMachine(ctx, "u1", "machine-1"); ok {
+		t.Fatalf("expected machine to be gone")
+	}
+
+	got := s.ListTombstones(ctx, "u1", 0, now+3)
+	if len(got) != 2 || got[0].Kind != TombstoneSession || got[0].ID != sess.ID || got[1].Kind != TombstoneMachine {
+		t.Fatalf("unexpected tombstones: %+v", got)
+	}
+	if got := s.ListTombstones(ctx, "u1", now+1, now+3); len(got) != 1 || got[0].ID != "machine-1" {
+		t.Fatalf("expected only machine tombstone after since, got %+v", got)
+	}
+	if got := s.ListTombstones(ctx, "u2", 0, now+3); len(got) != 0 {
+		t.Fatalf("expected no tombstones for other user, got %+v", got)
+	}
+
+	if _, _, err := s.UpsertMachine(ctx, "u1", "machine-1", "m", nil, nil, now+4); err != nil {
+		t.Fatalf("UpsertMachine: %v", err)
+	}
+	if got := s.ListTombstones(ctx, "u1", now+1, now+5); len(got) != 0 {
+		t.Fatalf("expected re-created machine to clear its tombstone, got %+v", got)
+	}
+
+	expired := now + time.Hour.Milliseconds() + 10
+	if got := s.ListTombstones(ctx, "u1", 0, expired); len(got) != 0 {
+		t.Fatalf("expected tombstones to expire, got %+v", got)
+	}
+}
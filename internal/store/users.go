@@ -0,0 +1,164 @@
+package store
+
+import (
+	"hash/fnv"
+	"sync"
+
+	"happy-server-lite/internal/model"
+)
+
+// userShardCount is how many locks sessions and machines are spread over.
+const userShardCount = 64
+
+// userShard holds the sessions and machines of the users that hash to it.
+// Its lock is taken after s.mu and before tombstonesMu; code that needs
+// several shards takes them in index order.
+type userShard struct {
+	mu    sync.RWMutex
+	users map[string]*userRecords
+}
+
+// userRecords indexes one user's sessions, deleted ones included, and
+// machines.
+type userRecords struct {
+	sessions     map[string]model.Session // sessionID
+	sessionByTag map[string]string        // tag -> live sessionID
+	machines     map[string]model.Machine // machineID
+}
+
+func (s *Store) shard(userID string) *userShard {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(userID))
+	return &s.users[h.Sum32()%userShardCount]
+}
+
+// records returns userID's records, or nil when the shard holds none.
+func (sh *userShard) records(userID string) *userRecords {
+	return sh.users[userID]
+}
+
+// recordsForWrite returns userID's records, adding them if needed; the
+// caller holds the shard's write lock.
+func (sh *userShard) recordsForWrite(userID string) *userRecords {
+	if sh.users == nil {
+		sh.users = make(map[string]*userRecords)
+	}
+	u, ok := sh.users[userID]
+	if !ok {
+		u = &userRecords{
+			sessions:     make(map[string]model.Session),
+			sessionByTag: make(map[string]string),
+			machines:     make(map[string]model.Machine),
+		}
+		sh.users[userID] = u
+	}
+	return u
+}
+
+func (u *userRecords) session(sessionID string) (model.Session, bool) {
+	if u == nil {
+		return model.Session{}, false
+	}
+	sess, ok := u.sessions[sessionID]
+	return sess, ok
+}
+
+func (u *userRecords) machine(machineID string) (model.Machine, bool) {
+	if u == nil {
+		return model.Machine{}, false
+	}
+	m, ok := u.machines[machineID]
+	return m, ok
+}
+
+// putSessionLocked stores sess and indexes its tag while live; the caller
+// holds the owner's shard lock.
+func (s *Store) putSessionLocked(sess model.Session) {
+	u := s.shard(sess.UserID).recordsForWrite(sess.UserID)
+	u.sessions[sess.ID] = sess
+	if !sess.Deleted {
+		u.sessionByTag[sess.Tag] = sess.ID
+	}
+}
+
+func (s *Store) putMachineLocked(m model.Machine) {
+	s.shard(m.UserID).recordsForWrite(m.UserID).machines[m.ID] = m
+}
+
+// lockAll takes mu, every shard and tombstonesMu, for loads and imports
+// that fill the whole store; functions named ...Locked that touch sessions,
+// machines or tombstones expect it held.
+func (s *Store) lockAll() {
+	s.mu.Lock()
+	s.lockUsers()
+	s.tombstonesMu.Lock()
+}
+
+func (s *Store) unlockAll() {
+	s.tombstonesMu.Unlock()
+	s.unlockUsers()
+	s.mu.Unlock()
+}
+
+// lockUsers takes every shard's write lock in index order.
+func (s *Store) lockUsers() {
+	for i := range s.users {
+		s.users[i].mu.Lock()
+	}
+}
+
+func (s *Store) unlockUsers() {
+	for i := range s.users {
+		s.users[i].mu.Unlock()
+	}
+}
+
+// eachUser calls fn with every user's records, holding each shard's read
+// lock in turn; fn must not keep them.
+func (s *Store) eachUser(fn func(userID string, u *userRecords)) {
+	for i := range s.users {
+		sh := &s.users[i]
+		sh.mu.RLock()
+		for userID, u := range sh.users {
+			fn(userID, u)
+		}
+		sh.mu.RUnlock()
+	}
+}
+
+// eachSession calls fn with every session, deleted ones included.
+func (s *Store) eachSession(fn func(model.Session)) {
+	s.eachUser(func(_ string, u *userRecords) {
+		for _, sess := range u.sessions {
+			fn(sess)
+		}
+	})
+}
+
+// sessionIDs returns the ids of every session, deleted ones included.
+func (s *Store) sessionIDs() map[string]bool {
+	ids := make(map[string]bool)
+	s.eachSession(func(sess model.Session) { ids[sess.ID] = true })
+	return ids
+}
+
+func (s *Store) eachMachine(fn func(model.Machine)) {
+	s.eachUser(func(_ string, u *userRecords) {
+		for _, m := range u.machines {
+			fn(m)
+		}
+	})
+}
+
+// usersEmptyLocked reports whether no shard holds a session or machine; the
+// caller holds every shard lock.
+func (s *Store) usersEmptyLocked() bool {
+	for i := range s.users {
+		for _, u := range s.users[i].users {
+			if len(u.sessions) > 0 || len(u.machines) > 0 {
+				return false
+			}
+		}
+	}
+	return true
+}
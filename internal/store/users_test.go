@@ -0,0 +1,162 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"happy-server-lite/internal/model"
+)
+
+func TestStore_UserShardDoesNotBlockOthers(t *testing.T) {
+	ctx := context.Background()
+	s := New()
+	busy, other := "u-busy", ""
+	for i := 0; other == ""; i++ {
+		if id := fmt.Sprintf("u-%d", i); s.shard(id) != s.shard(busy) {
+			other = id
+		}
+	}
+	sess, _, err := s.GetOrCreateSession(ctx, other, "tag", "meta", nil, nil, 1000)
+	if err != nil {
+		t.Fatalf("GetOrCreateSession: %v", err)
+	}
+
+	sh := s.shard(busy)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.SetSessionActive(ctx, other, sess.ID, true, 1001, 1001)
+		s.UpsertMachine(ctx, other, "m1", "meta", nil, nil, 1001)
+		s.ListSessions(ctx, other)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected another user's calls not to wait on a locked shard")
+	}
+}
+
+func TestStore_ConcurrentUsers(t *testing.T) {
+	ctx := context.Background()
+	s := New()
+	const users, perUser = 8, 20
+
+	var wg sync.WaitGroup
+	for u := 0; u < users; u++ {
+		userID := fmt.Sprintf("user-%d", u)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < perUser; i++ {
+				sess, _, err := s.GetOrCreateSession(ctx, userID, fmt.Sprintf("tag-%d", i), "meta", nil, nil, 1000)
+				if err != nil {
+					t.Errorf("GetOrCreateSession: %v", err)
+					return
+				}
+				if _, err := s.AppendMessage(ctx, userID, sess.ID, "hello", 1001); err != nil {
+					t.Errorf("AppendMessage: %v", err)
+				}
+				s.UpsertMachine(ctx, userID, fmt.Sprintf("m-%d", i%4), "meta", nil, nil, 1001)
+				_ = s.Stats()
+			}
+		}()
+	}
+	wg.Wait()
+
+	for u := 0; u < users; u++ {
+		userID := fmt.Sprintf("user-%d", u)
+		sessions := s.ListSessions(ctx, userID)
+		if len(sessions) != perUser {
+			t.Fatalf("expected %d sessions for %s, got %d", perUser, userID, len(sessions))
+		}
+		for _, sess := range sessions {
+			if sess.UserID != userID || sess.Seq != 1 {
+				t.Fatalf("unexpected session for %s: %+v", userID, sess)
+			}
+		}
+		if got := s.ListMachines(ctx, userID); len(got) != 4 {
+			t.Fatalf("expected 4 machines for %s, got %d", userID, len(got))
+		}
+	}
+	if stats := s.Stats(); stats.Sessions != users*perUser || stats.Machines != users*4 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+}
+
+// benchmarkUsers fills a store with 100k sessions and 10k machines spread
+// over 1000 users.
+func benchmarkUsers(b *testing.B) *Store {
+	ctx := context.Background()
+	b.Helper()
+	s := New()
+	for u := 0; u < 1000; u++ {
+		userID := fmt.Sprintf("user-%d", u)
+		for i := 0; i < 100; i++ {
+			if _, _, err := s.GetOrCreateSession(ctx, userID, fmt.Sprintf("tag-%d", i), "meta", nil, nil, 1000); err != nil {
+				b.Fatalf("GetOrCreateSession: %v", err)
+			}
+		}
+		for i := 0; i < 10; i++ {
+			s.UpsertMachine(ctx, userID, fmt.Sprintf("m-%d", i), "meta", nil, nil, 1000)
+		}
+	}
+	return s
+}
+
+// The scan cases filter every session or machine by owner, as listing did
+// before records were indexed per user, for comparison.
+func BenchmarkStore_ListSessions(b *testing.B) {
+	ctx := context.Background()
+	s := benchmarkUsers(b)
+	b.Run("indexed", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if got := s.ListSessions(ctx, "user-500"); len(got) != 100 {
+				b.Fatalf("expected 100 sessions, got %d", len(got))
+			}
+		}
+	})
+	b.Run("scan", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			n := 0
+			s.eachSession(func(sess model.Session) {
+				if sess.UserID == "user-500" && !sess.Deleted {
+					n++
+				}
+			})
+			if n != 100 {
+				b.Fatalf("expected 100 sessions, got %d", n)
+			}
+		}
+	})
+}
+
+func BenchmarkStore_ListMachines(b *testing.B) {
+	ctx := context.Background()
+	s := benchmarkUsers(b)
+	b.Run("indexed", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if got := s.ListMachines(ctx, "user-500"); len(got) != 10 {
+				b.Fatalf("expected 10 machines, got %d", len(got))
+			}
+		}
+	})
+	b.Run("scan", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			n := 0
+			s.eachMachine(func(m model.Machine) {
+				if m.UserID == "user-500" {
+					n++
+				}
+			})
+			if n != 10 {
+				b.Fatalf("expected 10 machines, got %d", n)
+			}
+		}
+	})
+}
@@ -0,0 +1,40 @@
+//go:build zstd
+
+package store
+
+import "github.com/klauspost/compress/zstd"
+
+// zstdCodec is linked by building with -tags zstd.
+type zstdCodec struct {
+	enc *zstd.Encoder
+	dec *zstd.Decoder
+}
+
+func init() {
+	enc, err := zstd.NewWriter(nil)
+	if err != nil {
+		panic(err)
+	}
+	dec, err := zstd.NewReader(nil, zstd.WithDecoderMaxMemory(maxDecompressedBytes))
+	if err != nil {
+		panic(err)
+	}
+	RegisterCodec(zstdCodec{enc: enc, dec: dec})
+}
+
+func (zstdCodec) Name() string { return "zstd" }
+
+func (c zstdCodec) Compress(data []byte) ([]byte, error) {
+	return c.enc.EncodeAll(data, nil), nil
+}
+
+func (c zstdCodec) Decompress(data []byte) ([]byte, error) {
+	plain, err := c.dec.DecodeAll(data, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(plain) > maxDecompressedBytes {
+		return nil, errDecompressedTooLarge
+	}
+	return plain, nil
+}
@@ -0,0 +1,98 @@
+// Package summarize asks an external service to condense the messages that
+// retention is about to drop into an artifact, so agents resuming a session
+// keep its context after old history is trimmed.
+package summarize
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// Message is one of the messages being summarized. Content is passed on as
+// stored, so it is still encrypted when clients encrypt it.
+type Message struct {
+	Seq       int64  `json:"seq"`
+	Content   string `json:"content"`
+	CreatedAt int64  `json:"createdAt"`
+}
+
+// Request is posted to the summarizer for each range of one session.
+type Request struct {
+	SessionID string    `json:"sessionId"`
+	FromSeq   int64     `json:"fromSeq"`
+	ToSeq     int64     `json:"toSeq"`
+	Messages  []Message `json:"messages"`
+}
+
+// Summary is the artifact the summarizer returns, in the same form clients
+// send to POST /v1/artifacts.
+type Summary struct {
+	Header            string `json:"header"`
+	Body              string `json:"body"`
+	DataEncryptionKey string `json:"dataEncryptionKey"`
+}
+
+// maxResponseBytes bounds how much of a summarizer's answer is read.
+const maxResponseBytes = 16 << 20
+
+type Config struct {
+	URL string
+	// Token, when set, is sent as a bearer token.
+	Token      string
+	HTTPClient *http.Client
+}
+
+// Client posts ranges to the summarizer at Config.URL.
+type Client struct {
+	cfg    Config
+	client *http.Client
+}
+
+func NewClient(cfg Config) *Client {
+	client := cfg.HTTPClient
+	if client == nil {
+		client = &http.Client{Timeout: time.Minute}
+	}
+	return &Client{cfg: cfg, client: client}
+}
+
+// Summarize returns the summarizer's artifact for req. Any error leaves the
+// messages in place, so they are offered again on the next run.
+func (c *Client) Summarize(ctx context.Context, req Request) (Summary, error) {
+	payload, err := json.Marshal(req)
+	if err != nil {
+		return Summary{}, err
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, c.cfg.URL, bytes.NewReader(payload))
+	if err != nil {
+		return Summary{}, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("Accept", "application/json")
+	if c.cfg.Token != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+c.cfg.Token)
+	}
+	resp, err := c.client.Do(httpReq)
+	if err != nil {
+		return Summary{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return Summary{}, fmt.Errorf("summarizer: %s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+	var summary Summary
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxResponseBytes)).Decode(&summary); err != nil {
+		return Summary{}, fmt.Errorf("summarizer: %w", err)
+	}
+	if summary.Header == "" || summary.Body == "" || summary.DataEncryptionKey == "" {
+		return Summary{}, errors.New("summarizer: missing artifact fields")
+	}
+	return summary, nil
+}
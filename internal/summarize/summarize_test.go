@@ -0,0 +1,49 @@
+package summarize
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClient_Summarize(t *testing.T) {
+	var got Request
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer s3cret" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		_ = json.NewDecoder(r.Body).Decode(&got)
+		_ = json.NewEncoder(w).Encode(Summary{Header: "h", Body: "b", DataEncryptionKey: "k"})
+	}))
+	defer srv.Close()
+
+	req := Request{SessionID: "s1", FromSeq: 1, ToSeq: 2, Messages: []Message{{Seq: 1, Content: "a"}, {Seq: 2, Content: "b"}}}
+	summary, err := NewClient(Config{URL: srv.URL, Token: "s3cret"}).Summarize(context.Background(), req)
+	if err != nil {
+		t.Fatalf("Summarize: %v", err)
+	}
+	if summary != (Summary{Header: "h", Body: "b", DataEncryptionKey: "k"}) {
+		t.Fatalf("unexpected summary: %+v", summary)
+	}
+	if got.SessionID != "s1" || len(got.Messages) != 2 || got.Messages[1].Content != "b" {
+		t.Fatalf("unexpected request: %+v", got)
+	}
+
+	if _, err := NewClient(Config{URL: srv.URL}).Summarize(context.Background(), req); err == nil {
+		t.Fatalf("expected an error for a rejected request")
+	}
+}
+
+func TestClient_SummarizeRejectsIncompleteSummary(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"header":"h"}`))
+	}))
+	defer srv.Close()
+
+	if _, err := NewClient(Config{URL: srv.URL}).Summarize(context.Background(), Request{SessionID: "s1"}); err == nil {
+		t.Fatalf("expected an error for a summary without a body")
+	}
+}
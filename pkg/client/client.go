@@ -0,0 +1,866 @@
+// Package client is a Go SDK for happy-server-lite. It wraps the REST API and
+// speaks the Engine.IO v4 / Socket.IO v5 subset the server implements, so
+// daemons and integration tests don't have to hand-roll frame strings.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+type Client struct {
+	baseURL    string
+	token      string
+	apiKey     string
+	httpClient *http.Client
+}
+
+type Option func(*Client)
+
+func WithToken(token string) Option {
+	return func(c *Client) { c.token = token }
+}
+
+// WithAPIKey authenticates with an API key from CreateAPIKey instead of a
+// token, for automation that cannot sign in interactively. A token, when
+// set, takes precedence.
+func WithAPIKey(key string) Option {
+	return func(c *Client) { c.apiKey = key }
+}
+
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) { c.httpClient = hc }
+}
+
+func New(baseURL string, opts ...Option) *Client {
+	c := &Client{
+		baseURL:    strings.TrimRight(baseURL, "/"),
+		httpClient: http.DefaultClient,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+func (c *Client) Token() string {
+	return c.token
+}
+
+// SetToken replaces the bearer token used for subsequent requests, e.g. after
+// Auth or an approved auth request.
+func (c *Client) SetToken(token string) {
+	c.token = token
+}
+
+// APIError is returned for any non-2xx response.
+type APIError struct {
+	StatusCode int
+	Code       string
+	Message    string
+	Body       []byte
+}
+
+func (e *APIError) Error() string {
+	if e.Message != "" {
+		return fmt.Sprintf("happy-server: %d: %s", e.StatusCode, e.Message)
+	}
+	return fmt.Sprintf("happy-server: %d", e.StatusCode)
+}
+
+func (c *Client) do(ctx context.Context, method, path string, query url.Values, in any, out any) error {
+	resp, err := c.send(ctx, method, path, query, in)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return parseAPIError(resp.StatusCode, data)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(data, out)
+}
+
+// send issues a request and returns the response unread.
+func (c *Client) send(ctx context.Context, method, path string, query url.Values, in any) (*http.Response, error) {
+	u := c.baseURL + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return nil, err
+		}
+		body = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	} else if c.apiKey != "" {
+		req.Header.Set("Authorization", "ApiKey "+c.apiKey)
+	}
+	return c.httpClient.Do(req)
+}
+
+// parseAPIError understands both the legacy {"error": "...", "code": "..."}
+// body and the {"error": {"code": "...", "message": "..."}} envelope.
+func parseAPIError(status int, data []byte) *APIError {
+	apiErr := &APIError{StatusCode: status, Body: data}
+	var raw struct {
+		Error json.RawMessage `json:"error"`
+		Code  string          `json:"code"`
+	}
+	if json.Unmarshal(data, &raw) != nil {
+		return apiErr
+	}
+	apiErr.Code = raw.Code
+	var envelope struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	}
+	if json.Unmarshal(raw.Error, &apiErr.Message) != nil && json.Unmarshal(raw.Error, &envelope) == nil {
+		apiErr.Code = envelope.Code
+		apiErr.Message = envelope.Message
+	}
+	return apiErr
+}
+
+type Session struct {
+	ID                string  `json:"id"`
+	Tag               string  `json:"tag"`
+	Seq               int64   `json:"seq"`
+	CreatedAt         int64   `json:"createdAt"`
+	UpdatedAt         int64   `json:"updatedAt"`
+	Metadata          string  `json:"metadata"`
+	MetadataVersion   int     `json:"metadataVersion"`
+	AgentState        *string `json:"agentState"`
+	AgentStateVersion int     `json:"agentStateVersion"`
+	DataEncryptionKey *string `json:"dataEncryptionKey"`
+	Active            bool    `json:"active"`
+	ActiveAt          int64   `json:"activeAt"`
+}
+
+type CreateSessionRequest struct {
+	Tag               string  `json:"tag"`
+	Metadata          string  `json:"metadata"`
+	AgentState        *string `json:"agentState,omitempty"`
+	DataEncryptionKey *string `json:"dataEncryptionKey,omitempty"`
+}
+
+type MessageContent struct {
+	T string `json:"t"`
+	C string `json:"c"`
+}
+
+type Message struct {
+	ID        string         `json:"id"`
+	Seq       int64          `json:"seq"`
+	LocalID   string         `json:"localId,omitempty"`
+	CreatedAt int64          `json:"createdAt"`
+	UpdatedAt int64          `json:"updatedAt"`
+	Content   MessageContent `json:"content"`
+	Checksum  string         `json:"checksum,omitempty"`
+	// Deleted marks a tombstone left by DeleteMessage; its content is empty.
+	Deleted bool `json:"deleted,omitempty"`
+	// Annotations are the values set with AnnotateMessage, by key.
+	Annotations map[string]Annotation `json:"annotations,omitempty"`
+}
+
+type Annotation struct {
+	Version   int    `json:"version"`
+	Value     string `json:"value"`
+	UpdatedAt int64  `json:"updatedAt"`
+}
+
+type Machine struct {
+	ID                 string  `json:"id"`
+	CreatedAt          int64   `json:"createdAt"`
+	UpdatedAt          int64   `json:"updatedAt"`
+	Active             bool    `json:"active"`
+	ActiveAt           int64   `json:"activeAt"`
+	Metadata           string  `json:"metadata"`
+	MetadataVersion    int     `json:"metadataVersion"`
+	DaemonState        *string `json:"daemonState"`
+	DaemonStateVersion int     `json:"daemonStateVersion"`
+	DataEncryptionKey  *string `json:"dataEncryptionKey"`
+}
+
+type UpsertMachineRequest struct {
+	ID                string  `json:"id"`
+	Metadata          string  `json:"metadata"`
+	DaemonState       *string `json:"daemonState,omitempty"`
+	DataEncryptionKey *string `json:"dataEncryptionKey,omitempty"`
+}
+
+type Artifact struct {
+	ID                string `json:"id"`
+	Header            string `json:"header"`
+	HeaderVersion     int    `json:"headerVersion"`
+	Body              string `json:"body,omitempty"`
+	BodyVersion       int    `json:"bodyVersion,omitempty"`
+	DataEncryptionKey string `json:"dataEncryptionKey"`
+	HeaderChecksum    string `json:"headerChecksum,omitempty"`
+	BodyChecksum      string `json:"bodyChecksum,omitempty"`
+	Seq               int64  `json:"seq"`
+	CreatedAt         int64  `json:"createdAt"`
+	UpdatedAt         int64  `json:"updatedAt"`
+}
+
+// CreateArtifactRequest may carry hex SHA-256 checksums of Header and Body,
+// which the server verifies and echoes back on reads.
+type CreateArtifactRequest struct {
+	ID                string `json:"id"`
+	Header            string `json:"header"`
+	Body              string `json:"body"`
+	DataEncryptionKey string `json:"dataEncryptionKey"`
+	HeaderChecksum    string `json:"headerChecksum,omitempty"`
+	BodyChecksum      string `json:"bodyChecksum,omitempty"`
+}
+
+type AuthRequestState struct {
+	State      string `json:"state"`
+	Token      string `json:"token"`
+	Response   string `json:"response"`
+	SupportsV2 bool   `json:"supportsV2"`
+}
+
+type SettingsResult struct {
+	Success         bool    `json:"success"`
+	Error           string  `json:"error,omitempty"`
+	CurrentVersion  int     `json:"currentVersion,omitempty"`
+	CurrentSettings *string `json:"currentSettings,omitempty"`
+}
+
+// AnnotationResult is the outcome of AnnotateMessage. On a version mismatch
+// Success is false and the current annotation is reported instead.
+type AnnotationResult struct {
+	Success        bool    `json:"success"`
+	Error          string  `json:"error,omitempty"`
+	CurrentVersion int     `json:"currentVersion,omitempty"`
+	CurrentValue   *string `json:"currentValue,omitempty"`
+	Message        Message `json:"message"`
+}
+
+// Lock is an advisory session lock. Token is only set for the holder, as
+// returned by AcquireSessionLock.
+type Lock struct {
+	Name       string `json:"name"`
+	Holder     string `json:"holder"`
+	Token      string `json:"token,omitempty"`
+	AcquiredAt int64  `json:"acquiredAt"`
+	ExpiresAt  int64  `json:"expiresAt"`
+}
+
+// Tombstone marks a session or machine deleted at DeletedAt.
+type Tombstone struct {
+	Kind      string `json:"kind"`
+	ID        string `json:"id"`
+	DeletedAt int64  `json:"deletedAt"`
+}
+
+type SyncResult struct {
+	Sessions   []Session   `json:"sessions"`
+	Machines   []Machine   `json:"machines"`
+	Tombstones []Tombstone `json:"tombstones"`
+	// Resync means since was older than the server's tombstone retention and
+	// the lists are a full snapshot.
+	Resync bool  `json:"resync"`
+	Now    int64 `json:"now"`
+}
+
+type Profile struct {
+	ID string `json:"id"`
+	// GitHub is the GitHub user linked to the account, if any.
+	GitHub            *GitHubUser `json:"github"`
+	ConnectedServices []string    `json:"connectedServices"`
+	Devices           Devices     `json:"devices"`
+}
+
+type GitHubUser struct {
+	ID        int64  `json:"id"`
+	Login     string `json:"login"`
+	Name      string `json:"name"`
+	AvatarURL string `json:"avatar_url"`
+	LinkedAt  int64  `json:"linkedAt"`
+}
+
+type Devices struct {
+	Machines       int `json:"machines"`
+	ActiveSessions int `json:"activeSessions"`
+	Connections    int `json:"connections"`
+}
+
+// Connection is one live socket reported by the presence API.
+type Connection struct {
+	ID          string `json:"id"`
+	ClientType  string `json:"clientType"`
+	SessionID   string `json:"sessionId,omitempty"`
+	MachineID   string `json:"machineId,omitempty"`
+	ConnectedAt int64  `json:"connectedAt"`
+	IP          string `json:"ip"`
+}
+
+// ServerInfo identifies the server a client is talking to. Contact is
+// empty when the operator set none.
+type ServerInfo struct {
+	Name    string `json:"name"`
+	Contact string `json:"contact"`
+	Welcome string `json:"welcome"`
+}
+
+func (c *Client) ServerInfo(ctx context.Context) (ServerInfo, error) {
+	var resp ServerInfo
+	err := c.do(ctx, http.MethodGet, "/v1/server-info", nil, nil, &resp)
+	return resp, err
+}
+
+// AuthChallenge is a single-use nonce to sign for Auth, base64 encoded.
+type AuthChallenge struct {
+	Challenge string `json:"challenge"`
+	ExpiresAt int64  `json:"expiresAt"`
+}
+
+// AuthChallenge fetches a challenge to sign. Servers reject Auth with any
+// other unless they allow client challenges for compatibility.
+func (c *Client) AuthChallenge(ctx context.Context) (AuthChallenge, error) {
+	var resp AuthChallenge
+	err := c.do(ctx, http.MethodGet, "/v1/auth/challenge", nil, nil, &resp)
+	return resp, err
+}
+
+// Auth exchanges a signed challenge for a token and stores it on the client.
+func (c *Client) Auth(ctx context.Context, publicKey, challenge, signature string) (string, error) {
+	var resp struct {
+		Token string `json:"token"`
+	}
+	in := map[string]string{"publicKey": publicKey, "challenge": challenge, "signature": signature}
+	if err := c.do(ctx, http.MethodPost, "/v1/auth", nil, in, &resp); err != nil {
+		return "", err
+	}
+	c.token = resp.Token
+	return resp.Token, nil
+}
+
+func (c *Client) RequestAuth(ctx context.Context, publicKey string, supportsV2 bool) (AuthRequestState, error) {
+	var resp AuthRequestState
+	in := map[string]any{"publicKey": publicKey, "supportsV2": supportsV2}
+	err := c.do(ctx, http.MethodPost, "/v1/auth/request", nil, in, &resp)
+	return resp, err
+}
+
+func (c *Client) ApproveAuthRequest(ctx context.Context, publicKey, response string) error {
+	in := map[string]string{"publicKey": publicKey, "response": response}
+	return c.do(ctx, http.MethodPost, "/v1/auth/response", nil, in, nil)
+}
+
+// RejectAuthRequest declines the pending auth request for publicKey; its
+// next poll reports the state "rejected".
+func (c *Client) RejectAuthRequest(ctx context.Context, publicKey string) error {
+	in := map[string]string{"publicKey": publicKey}
+	return c.do(ctx, http.MethodPost, "/v1/auth/reject", nil, in, nil)
+}
+
+// TokenScope names the one session or machine a scoped token reaches.
+type TokenScope struct {
+	SessionID string `json:"sessionId,omitempty"`
+	MachineID string `json:"machineId,omitempty"`
+}
+
+// ScopedToken mints a token confined to scope, for the daemon running that
+// session or machine. The client keeps its own token.
+func (c *Client) ScopedToken(ctx context.Context, scope TokenScope) (string, error) {
+	var resp struct {
+		Token string `json:"token"`
+	}
+	if err := c.do(ctx, http.MethodPost, "/v1/auth/token/scoped", nil, scope, &resp); err != nil {
+		return "", err
+	}
+	return resp.Token, nil
+}
+
+// RenewToken exchanges the client's token, while it is still valid, for a
+// fresh one with the same scope and switches the client over to it.
+func (c *Client) RenewToken(ctx context.Context) (string, error) {
+	var resp struct {
+		Token string `json:"token"`
+	}
+	if err := c.do(ctx, http.MethodPost, "/v1/auth/renew", nil, nil, &resp); err != nil {
+		return "", err
+	}
+	c.SetToken(resp.Token)
+	return resp.Token, nil
+}
+
+// APIKey describes an API key; its secret is only returned on creation.
+type APIKey struct {
+	ID         string `json:"id"`
+	Name       string `json:"name"`
+	CreatedAt  int64  `json:"createdAt"`
+	LastUsedAt int64  `json:"lastUsedAt"`
+}
+
+// CreateAPIKey issues a named API key and returns it with the key to pass
+// to WithAPIKey, which cannot be read back later.
+func (c *Client) CreateAPIKey(ctx context.Context, name string) (APIKey, string, error) {
+	var resp struct {
+		APIKey APIKey `json:"apiKey"`
+		Key    string `json:"key"`
+	}
+	err := c.do(ctx, http.MethodPost, "/v1/account/api-keys", nil, map[string]string{"name": name}, &resp)
+	return resp.APIKey, resp.Key, err
+}
+
+func (c *Client) ListAPIKeys(ctx context.Context) ([]APIKey, error) {
+	var resp struct {
+		APIKeys []APIKey `json:"apiKeys"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/v1/account/api-keys", nil, nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp.APIKeys, nil
+}
+
+func (c *Client) DeleteAPIKey(ctx context.Context, id string) error {
+	return c.do(ctx, http.MethodDelete, "/v1/account/api-keys/"+url.PathEscape(id), nil, nil, nil)
+}
+
+// DeviceInfo is what a device said about itself when it signed in.
+type DeviceInfo struct {
+	Platform   string `json:"platform"`
+	Hostname   string `json:"hostname"`
+	AppVersion string `json:"appVersion"`
+}
+
+// Device is a device signed in to the account. Current marks the one the
+// client's own token was issued to.
+type Device struct {
+	ID         string      `json:"id"`
+	Device     *DeviceInfo `json:"device,omitempty"`
+	CreatedAt  int64       `json:"createdAt"`
+	LastSeenAt int64       `json:"lastSeenAt"`
+	LastSeenIP string      `json:"lastSeenIp,omitempty"`
+	ExpiresAt  int64       `json:"expiresAt"`
+	Current    bool        `json:"current"`
+}
+
+func (c *Client) ListDevices(ctx context.Context) ([]Device, error) {
+	var resp struct {
+		Devices []Device `json:"devices"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/v1/account/devices", nil, nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Devices, nil
+}
+
+// DeleteDevice signs a device out, revoking its tokens and closing its
+// connections.
+func (c *Client) DeleteDevice(ctx context.Context, id string) error {
+	return c.do(ctx, http.MethodDelete, "/v1/account/devices/"+url.PathEscape(id), nil, nil, nil)
+}
+
+func (c *Client) Profile(ctx context.Context) (Profile, error) {
+	var resp Profile
+	err := c.do(ctx, http.MethodGet, "/v1/account/profile", nil, nil, &resp)
+	return resp, err
+}
+
+// GitHubConnectURL returns the GitHub page where the user approves linking
+// the account; GitHub then sends the browser back to the server.
+func (c *Client) GitHubConnectURL(ctx context.Context) (string, error) {
+	var resp struct {
+		URL string `json:"url"`
+	}
+	err := c.do(ctx, http.MethodGet, "/v1/connect/github/params", nil, nil, &resp)
+	return resp.URL, err
+}
+
+func (c *Client) DisconnectGitHub(ctx context.Context) error {
+	return c.do(ctx, http.MethodDelete, "/v1/connect/github", nil, nil, nil)
+}
+
+func (c *Client) ListConnections(ctx context.Context) ([]Connection, error) {
+	var resp struct {
+		Connections []Connection `json:"connections"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/v1/account/connections", nil, nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Connections, nil
+}
+
+// Disconnect force-closes one of the caller's connections by its socket id.
+func (c *Client) Disconnect(ctx context.Context, connectionID string) error {
+	return c.do(ctx, http.MethodDelete, "/v1/account/connections/"+url.PathEscape(connectionID), nil, nil, nil)
+}
+
+func (c *Client) ListSessions(ctx context.Context) ([]Session, error) {
+	var resp struct {
+		Sessions []Session `json:"sessions"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/v1/sessions", nil, nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Sessions, nil
+}
+
+func (c *Client) CreateSession(ctx context.Context, req CreateSessionRequest) (Session, error) {
+	var resp struct {
+		Session Session `json:"session"`
+	}
+	if err := c.do(ctx, http.MethodPost, "/v1/sessions", nil, req, &resp); err != nil {
+		return Session{}, err
+	}
+	return resp.Session, nil
+}
+
+// SessionByTag returns the caller's session with tag; a missing one is a
+// 404 APIError.
+func (c *Client) SessionByTag(ctx context.Context, tag string) (Session, error) {
+	var resp struct {
+		Session Session `json:"session"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/v1/sessions/by-tag/"+url.PathEscape(tag), nil, nil, &resp); err != nil {
+		return Session{}, err
+	}
+	return resp.Session, nil
+}
+
+func (c *Client) DeleteSession(ctx context.Context, sessionID string) error {
+	return c.do(ctx, http.MethodDelete, "/v1/sessions/"+url.PathEscape(sessionID), nil, nil, nil)
+}
+
+func (c *Client) ListMessages(ctx context.Context, sessionID string, after int64, limit int) ([]Message, error) {
+	q := url.Values{}
+	if after > 0 {
+		q.Set("after", strconv.FormatInt(after, 10))
+	}
+	if limit > 0 {
+		q.Set("limit", strconv.Itoa(limit))
+	}
+	var resp struct {
+		Messages []Message `json:"messages"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/v1/sessions/"+url.PathEscape(sessionID)+"/messages", q, nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Messages, nil
+}
+
+// MessagePageOptions selects a page of a session's messages by seq. Zero
+// After and Before leave that side unbounded.
+type MessagePageOptions struct {
+	After  int64
+	Before int64
+	// Desc pages from the newest message backwards.
+	Desc  bool
+	Limit int
+}
+
+// MessagePage is one page of messages. NextCursor, set when HasMore is, is
+// the seq to pass as After (ascending) or Before (descending) next.
+type MessagePage struct {
+	Messages   []Message `json:"messages"`
+	HasMore    bool      `json:"hasMore"`
+	NextCursor *int64    `json:"nextCursor"`
+}
+
+func (c *Client) ListMessagesPage(ctx context.Context, sessionID string, opts MessagePageOptions) (MessagePage, error) {
+	q := url.Values{}
+	if opts.After > 0 {
+		q.Set("after", strconv.FormatInt(opts.After, 10))
+	}
+	if opts.Before > 0 {
+		q.Set("before", strconv.FormatInt(opts.Before, 10))
+	}
+	if opts.Desc {
+		q.Set("order", "desc")
+	}
+	if opts.Limit > 0 {
+		q.Set("limit", strconv.Itoa(opts.Limit))
+	}
+	var page MessagePage
+	err := c.do(ctx, http.MethodGet, "/v1/sessions/"+url.PathEscape(sessionID)+"/messages", q, nil, &page)
+	return page, err
+}
+
+// StreamMessages reads a session's messages from the streaming endpoint and
+// calls fn with each as it arrives, so long histories are never held in
+// memory at once. opts selects them as for ListMessagesPage, except that a
+// zero Limit reads them all. It stops at the first error from fn.
+func (c *Client) StreamMessages(ctx context.Context, sessionID string, opts MessagePageOptions, fn func(Message) error) error {
+	q := url.Values{}
+	if opts.After > 0 {
+		q.Set("after", strconv.FormatInt(opts.After, 10))
+	}
+	if opts.Before > 0 {
+		q.Set("before", strconv.FormatInt(opts.Before, 10))
+	}
+	if opts.Desc {
+		q.Set("order", "desc")
+	}
+	if opts.Limit > 0 {
+		q.Set("limit", strconv.Itoa(opts.Limit))
+	}
+	resp, err := c.send(ctx, http.MethodGet, "/v1/sessions/"+url.PathEscape(sessionID)+"/messages/stream", q, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		data, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return err
+		}
+		return parseAPIError(resp.StatusCode, data)
+	}
+
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var line json.RawMessage
+		if err := dec.Decode(&line); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		// The server ends a stream that fails part way with an error body.
+		var probe struct {
+			Error json.RawMessage `json:"error"`
+		}
+		if json.Unmarshal(line, &probe) == nil && probe.Error != nil {
+			return parseAPIError(http.StatusInternalServerError, line)
+		}
+		var m Message
+		if err := json.Unmarshal(line, &m); err != nil {
+			return err
+		}
+		if err := fn(m); err != nil {
+			return err
+		}
+	}
+}
+
+// ExportSession writes an archive of the session to w: "tar" (a bundle of
+// session.json and an index.html viewer), "json" or "html". Empty picks
+// "tar".
+func (c *Client) ExportSession(ctx context.Context, sessionID, format string, w io.Writer) error {
+	q := url.Values{}
+	if format != "" {
+		q.Set("format", format)
+	}
+	resp, err := c.send(ctx, http.MethodGet, "/v1/sessions/"+url.PathEscape(sessionID)+"/export", q, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		data, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return err
+		}
+		return parseAPIError(resp.StatusCode, data)
+	}
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+// PostMessage appends an encrypted message to a session over REST. checksum
+// is an optional hex SHA-256 of content.
+func (c *Client) PostMessage(ctx context.Context, sessionID, content, checksum string) (Message, error) {
+	return c.PostMessageOnce(ctx, sessionID, content, checksum, "")
+}
+
+// PostMessageOnce is PostMessage with a client-chosen localID. Retrying with
+// the same localID returns the message the first attempt created instead of
+// appending another.
+func (c *Client) PostMessageOnce(ctx context.Context, sessionID, content, checksum, localID string) (Message, error) {
+	in := map[string]string{"message": content}
+	if checksum != "" {
+		in["checksum"] = checksum
+	}
+	if localID != "" {
+		in["localId"] = localID
+	}
+	var resp struct {
+		Message Message `json:"message"`
+	}
+	err := c.do(ctx, http.MethodPost, "/v1/sessions/"+url.PathEscape(sessionID)+"/messages", nil, in, &resp)
+	return resp.Message, err
+}
+
+// UpdateMessage replaces the content of a message.
+func (c *Client) UpdateMessage(ctx context.Context, sessionID, messageID, content, checksum string) (Message, error) {
+	in := map[string]string{"message": content}
+	if checksum != "" {
+		in["checksum"] = checksum
+	}
+	var resp struct {
+		Message Message `json:"message"`
+	}
+	err := c.do(ctx, http.MethodPut, messagePath(sessionID, messageID), nil, in, &resp)
+	return resp.Message, err
+}
+
+// DeleteMessage deletes a message and returns the tombstone left in its
+// place.
+func (c *Client) DeleteMessage(ctx context.Context, sessionID, messageID string) (Message, error) {
+	var resp struct {
+		Message Message `json:"message"`
+	}
+	err := c.do(ctx, http.MethodDelete, messagePath(sessionID, messageID), nil, nil, &resp)
+	return resp.Message, err
+}
+
+// AnnotateMessage sets the annotation key of a message to value, or removes
+// it when value is nil, if it is at expectedVersion; 0 expects none.
+func (c *Client) AnnotateMessage(ctx context.Context, sessionID, messageID, key string, value *string, expectedVersion int) (AnnotationResult, error) {
+	var resp AnnotationResult
+	in := map[string]any{"value": value, "expectedVersion": expectedVersion}
+	err := c.do(ctx, http.MethodPut, messagePath(sessionID, messageID)+"/annotations/"+url.PathEscape(key), nil, in, &resp)
+	return resp, err
+}
+
+// ListSessionLocks returns the live advisory locks of a session.
+func (c *Client) ListSessionLocks(ctx context.Context, sessionID string) ([]Lock, error) {
+	var resp struct {
+		Locks []Lock `json:"locks"`
+	}
+	err := c.do(ctx, http.MethodGet, "/v1/sessions/"+url.PathEscape(sessionID)+"/locks", nil, nil, &resp)
+	return resp.Locks, err
+}
+
+// AcquireSessionLock takes the advisory lock name on a session for
+// ttlSeconds, the server's default when 0. When someone else holds it the
+// error is a 409 APIError and the lock returned is theirs, without a token.
+func (c *Client) AcquireSessionLock(ctx context.Context, sessionID, name, holder string, ttlSeconds int) (Lock, error) {
+	var resp struct {
+		Lock Lock `json:"lock"`
+	}
+	err := c.do(ctx, http.MethodPost, lockPath(sessionID, name), nil, map[string]any{"holder": holder, "ttlSeconds": ttlSeconds}, &resp)
+	var apiErr *APIError
+	if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusConflict {
+		_ = json.Unmarshal(apiErr.Body, &resp)
+	}
+	return resp.Lock, err
+}
+
+// RenewSessionLock extends a lock token holds by ttlSeconds from now. A
+// lock that lapsed or was released fails with a 409 APIError.
+func (c *Client) RenewSessionLock(ctx context.Context, sessionID, name, token string, ttlSeconds int) (Lock, error) {
+	var resp struct {
+		Lock Lock `json:"lock"`
+	}
+	err := c.do(ctx, http.MethodPut, lockPath(sessionID, name), nil, map[string]any{"token": token, "ttlSeconds": ttlSeconds}, &resp)
+	return resp.Lock, err
+}
+
+// ReleaseSessionLock frees a lock token holds.
+func (c *Client) ReleaseSessionLock(ctx context.Context, sessionID, name, token string) error {
+	return c.do(ctx, http.MethodDelete, lockPath(sessionID, name), nil, map[string]any{"token": token}, nil)
+}
+
+func lockPath(sessionID, name string) string {
+	return "/v1/sessions/" + url.PathEscape(sessionID) + "/locks/" + url.PathEscape(name)
+}
+
+func messagePath(sessionID, messageID string) string {
+	return "/v1/sessions/" + url.PathEscape(sessionID) + "/messages/" + url.PathEscape(messageID)
+}
+
+func (c *Client) ListMachines(ctx context.Context) ([]Machine, error) {
+	var resp []Machine
+	if err := c.do(ctx, http.MethodGet, "/v1/machines", nil, nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (c *Client) UpsertMachine(ctx context.Context, req UpsertMachineRequest) (Machine, error) {
+	var resp struct {
+		Machine Machine `json:"machine"`
+	}
+	if err := c.do(ctx, http.MethodPost, "/v1/machines", nil, req, &resp); err != nil {
+		return Machine{}, err
+	}
+	return resp.Machine, nil
+}
+
+func (c *Client) DeleteMachine(ctx context.Context, machineID string) error {
+	return c.do(ctx, http.MethodDelete, "/v1/machines/"+url.PathEscape(machineID), nil, nil, nil)
+}
+
+// Sync returns what changed after since; pass the previous result's Now.
+func (c *Client) Sync(ctx context.Context, since int64) (SyncResult, error) {
+	q := url.Values{}
+	q.Set("since", strconv.FormatInt(since, 10))
+	var resp SyncResult
+	err := c.do(ctx, http.MethodGet, "/v1/sync", q, nil, &resp)
+	return resp, err
+}
+
+func (c *Client) GetSettings(ctx context.Context) (*string, int, error) {
+	var resp struct {
+		Settings        *string `json:"settings"`
+		SettingsVersion int     `json:"settingsVersion"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/v1/account/settings", nil, nil, &resp); err != nil {
+		return nil, 0, err
+	}
+	return resp.Settings, resp.SettingsVersion, nil
+}
+
+func (c *Client) UpdateSettings(ctx context.Context, settings string, expectedVersion int) (SettingsResult, error) {
+	var resp SettingsResult
+	in := map[string]any{"settings": settings, "expectedVersion": expectedVersion}
+	err := c.do(ctx, http.MethodPost, "/v1/account/settings", nil, in, &resp)
+	return resp, err
+}
+
+func (c *Client) ListArtifacts(ctx context.Context) ([]Artifact, error) {
+	var resp []Artifact
+	if err := c.do(ctx, http.MethodGet, "/v1/artifacts", nil, nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (c *Client) GetArtifact(ctx context.Context, artifactID string) (Artifact, error) {
+	var resp Artifact
+	err := c.do(ctx, http.MethodGet, "/v1/artifacts/"+url.PathEscape(artifactID), nil, nil, &resp)
+	return resp, err
+}
+
+func (c *Client) CreateArtifact(ctx context.Context, req CreateArtifactRequest) (Artifact, error) {
+	var resp Artifact
+	err := c.do(ctx, http.MethodPost, "/v1/artifacts", nil, req, &resp)
+	return resp, err
+}
+
+func (c *Client) DeleteArtifact(ctx context.Context, artifactID string) error {
+	return c.do(ctx, http.MethodDelete, "/v1/artifacts/"+url.PathEscape(artifactID), nil, nil, nil)
+}
@@ -0,0 +1,162 @@
+package client
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"happy-server-lite/internal/auth"
+	"happy-server-lite/internal/server"
+	"happy-server-lite/internal/store"
+)
+
+func newTestServer(t *testing.T) (*httptest.Server, auth.TokenConfig) {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	tokenCfg := auth.TokenConfig{Secret: "secret", Expiry: time.Hour, Issuer: "test"}
+	srv := httptest.NewServer(server.NewRouter(server.Deps{Store: store.New(), TokenConfig: tokenCfg}))
+	t.Cleanup(srv.Close)
+	return srv, tokenCfg
+}
+
+func TestClient_SessionsAndMessages(t *testing.T) {
+	srv, tokenCfg := newTestServer(t)
+	tok, err := auth.CreateToken("user-1", tokenCfg)
+	if err != nil {
+		t.Fatalf("CreateToken: %v", err)
+	}
+	c := New(srv.URL, WithToken(tok))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	sess, err := c.CreateSession(ctx, CreateSessionRequest{Tag: "t1", Metadata: "m1"})
+	if err != nil {
+		t.Fatalf("CreateSession: %v", err)
+	}
+	if sess.ID == "" || sess.MetadataVersion != 1 {
+		t.Fatalf("unexpected session: %+v", sess)
+	}
+
+	list, err := c.ListSessions(ctx)
+	if err != nil {
+		t.Fatalf("ListSessions: %v", err)
+	}
+	if len(list) != 1 || list[0].ID != sess.ID {
+		t.Fatalf("unexpected sessions: %+v", list)
+	}
+	if byTag, err := c.SessionByTag(ctx, "t1"); err != nil || byTag.ID != sess.ID {
+		t.Fatalf("SessionByTag: %+v %v", byTag, err)
+	}
+
+	if _, err := c.ListMessages(ctx, "missing", 0, 0); err == nil {
+		t.Fatalf("expected error for missing session")
+	} else if apiErr, ok := err.(*APIError); !ok || apiErr.StatusCode != 404 {
+		t.Fatalf("expected 404 APIError, got %v", err)
+	}
+
+	userSock, err := c.ConnectSocket(ctx, SocketOptions{ClientType: ClientTypeUser})
+	if err != nil {
+		t.Fatalf("ConnectSocket(user): %v", err)
+	}
+	defer userSock.Close()
+	sessSock, err := c.ConnectSocket(ctx, SocketOptions{ClientType: ClientTypeSession, SessionID: sess.ID})
+	if err != nil {
+		t.Fatalf("ConnectSocket(session): %v", err)
+	}
+	defer sessSock.Close()
+
+	if err := sessSock.Emit("message", map[string]string{"sid": sess.ID, "message": "enc"}); err != nil {
+		t.Fatalf("Emit: %v", err)
+	}
+
+	select {
+	case ev := <-userSock.Events():
+		var update struct {
+			Body struct {
+				T       string  `json:"t"`
+				SID     string  `json:"sid"`
+				Message Message `json:"message"`
+			} `json:"body"`
+		}
+		if ev.Name != "update" || ev.Decode(&update) != nil {
+			t.Fatalf("unexpected event: %+v", ev)
+		}
+		if update.Body.T != "new-message" || update.Body.Message.Content.C != "enc" {
+			t.Fatalf("unexpected update: %+v", update)
+		}
+	case <-ctx.Done():
+		t.Fatalf("timeout waiting for update")
+	}
+
+	msgs, err := c.ListMessages(ctx, sess.ID, 0, 10)
+	if err != nil {
+		t.Fatalf("ListMessages: %v", err)
+	}
+	if len(msgs) != 1 || msgs[0].Content.C != "enc" {
+		t.Fatalf("unexpected messages: %+v", msgs)
+	}
+	var streamed []Message
+	if err := c.StreamMessages(ctx, sess.ID, MessagePageOptions{}, func(m Message) error {
+		streamed = append(streamed, m)
+		return nil
+	}); err != nil || len(streamed) != 1 || streamed[0].ID != msgs[0].ID {
+		t.Fatalf("StreamMessages: %+v %v", streamed, err)
+	}
+	if err := c.StreamMessages(ctx, "missing", MessagePageOptions{}, func(Message) error { return nil }); err == nil {
+		t.Fatalf("expected error streaming a missing session")
+	}
+}
+
+func TestClient_ConnectRejectsUnknownSession(t *testing.T) {
+	srv, tokenCfg := newTestServer(t)
+	tok, _ := auth.CreateToken("user-1", tokenCfg)
+	c := New(srv.URL, WithToken(tok))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := c.ConnectSocket(ctx, SocketOptions{ClientType: ClientTypeSession, SessionID: "nope"})
+	if err == nil {
+		t.Fatalf("expected connect to be rejected")
+	}
+}
+
+func TestClient_RPCRoundTrip(t *testing.T) {
+	srv, tokenCfg := newTestServer(t)
+	tok, _ := auth.CreateToken("user-1", tokenCfg)
+	c := New(srv.URL, WithToken(tok))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	daemon, err := c.ConnectSocket(ctx, SocketOptions{})
+	if err != nil {
+		t.Fatalf("ConnectSocket(daemon): %v", err)
+	}
+	defer daemon.Close()
+	go func() {
+		for range daemon.Events() {
+		}
+	}()
+	if err := daemon.RegisterRPC(ctx, "echo", func(params string) string { return "echo:" + params }); err != nil {
+		t.Fatalf("RegisterRPC: %v", err)
+	}
+
+	caller, err := c.ConnectSocket(ctx, SocketOptions{})
+	if err != nil {
+		t.Fatalf("ConnectSocket(caller): %v", err)
+	}
+	defer caller.Close()
+
+	result, err := caller.CallRPC(ctx, "echo", "hi")
+	if err != nil {
+		t.Fatalf("CallRPC: %v", err)
+	}
+	if result != "echo:hi" {
+		t.Fatalf("unexpected result: %q", result)
+	}
+
+	if _, err := caller.CallRPC(ctx, "missing", ""); err == nil {
+		t.Fatalf("expected error for unknown method")
+	}
+}
@@ -0,0 +1,601 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	ClientTypeUser    = "user-scoped"
+	ClientTypeSession = "session-scoped"
+	ClientTypeMachine = "machine-scoped"
+
+	PathUpdates       = "/v1/updates"
+	PathMachineDaemon = "/v1/user-machine-daemon"
+
+	updatesBufferSize = 256
+)
+
+// UpdateSchemaVersion is the newest "update"/"ephemeral" body version this
+// package decodes; it is declared to the server on connect.
+const UpdateSchemaVersion = 1
+
+var ErrSocketClosed = errors.New("socket closed")
+
+type SocketOptions struct {
+	// Path is the Socket.IO endpoint; defaults to PathUpdates.
+	Path       string
+	ClientType string
+	SessionID  string
+	MachineID  string
+	// Takeover replaces the connection already attached to SessionID instead
+	// of failing with a conflict.
+	Takeover bool
+	// SuppressEcho asks the server not to send back updates caused by this
+	// socket's own events.
+	SuppressEcho bool
+}
+
+// Event is a server-emitted Socket.IO event such as "update" or "ephemeral".
+type Event struct {
+	Name string
+	Args []json.RawMessage
+}
+
+// Decode unmarshals the first event argument into v.
+func (e Event) Decode(v any) error {
+	if len(e.Args) == 0 {
+		return errors.New("event has no arguments")
+	}
+	return json.Unmarshal(e.Args[0], v)
+}
+
+// RPCHandler answers an "rpc-request" for a registered method. The returned
+// string is relayed verbatim to the caller.
+type RPCHandler func(params string) string
+
+// MachineCommand is a "machine-command" an operator sent this machine's
+// daemon, such as "re-sync", "rotate-token" (with the new token in
+// Args["token"]) or "shutdown".
+type MachineCommand struct {
+	ID      string          `json:"id"`
+	Command string          `json:"command"`
+	Args    json.RawMessage `json:"args"`
+	SentAt  int64           `json:"sentAt"`
+}
+
+// MachineCommandHandler answers a MachineCommand; the returned value is
+// sent back as the ack the operator sees.
+type MachineCommandHandler func(cmd MachineCommand) any
+
+type Socket struct {
+	ws           *websocket.Conn
+	sid          string
+	updateSchema int
+
+	writeMu sync.Mutex
+
+	events chan Event
+	done   chan struct{}
+	once   sync.Once
+	err    error
+
+	mu         sync.Mutex
+	nextAckID  int
+	pendingAck map[int]chan []json.RawMessage
+	rpc        map[string]RPCHandler
+	registered map[string]chan struct{}
+	commands   MachineCommandHandler
+}
+
+// ConnectSocket dials the Socket.IO endpoint, performs the Engine.IO open and
+// Socket.IO connect handshake, and returns once the server has accepted auth.
+func (c *Client) ConnectSocket(ctx context.Context, opts SocketOptions) (*Socket, error) {
+	if c.token == "" {
+		return nil, errors.New("missing token")
+	}
+	if opts.ClientType == "" {
+		opts.ClientType = ClientTypeUser
+	}
+	path := opts.Path
+	if path == "" {
+		path = PathUpdates
+	}
+
+	u, err := url.Parse(c.baseURL)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "https":
+		u.Scheme = "wss"
+	default:
+		u.Scheme = "ws"
+	}
+	u.Path = strings.TrimRight(u.Path, "/") + path + "/"
+	u.RawQuery = "EIO=4&transport=websocket"
+
+	// The token also goes in the upgrade request so servers that check it
+	// before upgrading accept the connection.
+	header := http.Header{"Authorization": {"Bearer " + c.token}}
+	ws, _, err := websocket.DefaultDialer.DialContext(ctx, u.String(), header)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Socket{
+		ws:         ws,
+		events:     make(chan Event, updatesBufferSize),
+		done:       make(chan struct{}),
+		pendingAck: make(map[int]chan []json.RawMessage),
+		rpc:        make(map[string]RPCHandler),
+		registered: make(map[string]chan struct{}),
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = ws.SetReadDeadline(deadline)
+	}
+	if err := s.handshake(opts, c.token); err != nil {
+		_ = ws.Close()
+		return nil, err
+	}
+	_ = ws.SetReadDeadline(time.Time{})
+
+	go s.readLoop()
+	return s, nil
+}
+
+func (s *Socket) handshake(opts SocketOptions, token string) error {
+	for {
+		msg, err := s.readText()
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(msg, "0") {
+			break
+		}
+	}
+
+	authPayload, err := json.Marshal(map[string]any{
+		"token":        token,
+		"clientType":   opts.ClientType,
+		"sessionId":    opts.SessionID,
+		"machineId":    opts.MachineID,
+		"takeover":     opts.Takeover,
+		"suppressEcho": opts.SuppressEcho,
+		"updateSchema": UpdateSchemaVersion,
+	})
+	if err != nil {
+		return err
+	}
+	if err := s.writeText("40" + string(authPayload)); err != nil {
+		return err
+	}
+
+	for {
+		msg, err := s.readText()
+		if err != nil {
+			return err
+		}
+		switch {
+		case msg == "2":
+			if err := s.writeText("3"); err != nil {
+				return err
+			}
+		case strings.HasPrefix(msg, "40"):
+			var ack struct {
+				SID          string `json:"sid"`
+				UpdateSchema int    `json:"updateSchema"`
+			}
+			_ = json.Unmarshal([]byte(msg[2:]), &ack)
+			s.sid = ack.SID
+			s.updateSchema = ack.UpdateSchema
+			return nil
+		case strings.HasPrefix(msg, "42"):
+			name, _, args, err := parseEvent(msg[2:])
+			if err == nil && name == "error" && len(args) > 0 {
+				var e struct {
+					Message string `json:"message"`
+				}
+				_ = json.Unmarshal(args[0], &e)
+				return errors.New(e.Message)
+			}
+		}
+	}
+}
+
+// SID returns the Socket.IO session id assigned by the server.
+func (s *Socket) SID() string {
+	return s.sid
+}
+
+// UpdateSchema returns the update body version negotiated with the server.
+func (s *Socket) UpdateSchema() int {
+	return s.updateSchema
+}
+
+// Events delivers every server event that isn't consumed internally (acks,
+// rpc-request for registered methods). Callers must drain it; a full channel
+// stalls the read loop.
+func (s *Socket) Events() <-chan Event {
+	return s.events
+}
+
+// Done is closed once the connection is gone; Err then reports why.
+func (s *Socket) Done() <-chan struct{} {
+	return s.done
+}
+
+func (s *Socket) Err() error {
+	select {
+	case <-s.done:
+		return s.err
+	default:
+		return nil
+	}
+}
+
+func (s *Socket) Close() error {
+	s.shutdown(ErrSocketClosed)
+	return nil
+}
+
+func (s *Socket) shutdown(err error) {
+	s.once.Do(func() {
+		s.err = err
+		close(s.done)
+		_ = s.ws.Close()
+	})
+}
+
+// Emit sends a fire-and-forget event.
+func (s *Socket) Emit(event string, args ...any) error {
+	pkt, err := buildEvent(nil, event, args...)
+	if err != nil {
+		return err
+	}
+	return s.writeText("4" + pkt)
+}
+
+// EmitWithAck sends an event and waits for the server's ack arguments.
+func (s *Socket) EmitWithAck(ctx context.Context, event string, args ...any) ([]json.RawMessage, error) {
+	s.mu.Lock()
+	s.nextAckID++
+	id := s.nextAckID
+	ch := make(chan []json.RawMessage, 1)
+	s.pendingAck[id] = ch
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.pendingAck, id)
+		s.mu.Unlock()
+	}()
+
+	pkt, err := buildEvent(&id, event, args...)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.writeText("4" + pkt); err != nil {
+		return nil, err
+	}
+
+	select {
+	case resp := <-ch:
+		return resp, nil
+	case <-s.done:
+		return nil, ErrSocketClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// OnMachineCommand acks operator commands sent to this machine connection
+// with handler's answer. Commands still appear on Events.
+func (s *Socket) OnMachineCommand(handler MachineCommandHandler) {
+	s.mu.Lock()
+	s.commands = handler
+	s.mu.Unlock()
+}
+
+// RegisterRPC registers handler for method and waits for the server to
+// confirm with "rpc-registered".
+func (s *Socket) RegisterRPC(ctx context.Context, method string, handler RPCHandler) error {
+	confirmed := make(chan struct{})
+	s.mu.Lock()
+	s.rpc[method] = handler
+	s.registered[method] = confirmed
+	s.mu.Unlock()
+
+	if err := s.Emit("rpc-register", map[string]string{"method": method}); err != nil {
+		return err
+	}
+	select {
+	case <-confirmed:
+		return nil
+	case <-s.done:
+		return ErrSocketClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *Socket) UnregisterRPC(method string) error {
+	s.mu.Lock()
+	delete(s.rpc, method)
+	s.mu.Unlock()
+	return s.Emit("rpc-unregister", map[string]string{"method": method})
+}
+
+type RPCError struct {
+	Message string
+}
+
+func (e *RPCError) Error() string {
+	return "rpc: " + e.Message
+}
+
+// CallRPC invokes method on whichever connection registered it.
+func (s *Socket) CallRPC(ctx context.Context, method, params string) (string, error) {
+	resp, err := s.EmitWithAck(ctx, "rpc-call", map[string]string{"method": method, "params": params})
+	if err != nil {
+		return "", err
+	}
+	if len(resp) < 1 {
+		return "", errors.New("empty rpc response")
+	}
+	var result struct {
+		OK     bool   `json:"ok"`
+		Result string `json:"result"`
+		Error  string `json:"error"`
+	}
+	if err := json.Unmarshal(resp[0], &result); err != nil {
+		return "", err
+	}
+	if !result.OK {
+		return "", &RPCError{Message: result.Error}
+	}
+	return result.Result, nil
+}
+
+// SendMachineEvent relays event and payload from this machine connection to
+// the daemon of machineID, another machine of the same user. It returns how
+// many of that machine's connections received it.
+func (s *Socket) SendMachineEvent(ctx context.Context, machineID, event string, payload any) (int, error) {
+	resp, err := s.EmitWithAck(ctx, "machine-event", map[string]any{"machineId": machineID, "event": event, "payload": payload})
+	if err != nil {
+		return 0, err
+	}
+	if len(resp) < 1 {
+		return 0, errors.New("empty machine-event response")
+	}
+	var result struct {
+		OK        bool   `json:"ok"`
+		Delivered int    `json:"delivered"`
+		Error     string `json:"error"`
+	}
+	if err := json.Unmarshal(resp[0], &result); err != nil {
+		return 0, err
+	}
+	if !result.OK {
+		return 0, &MachineEventError{Message: result.Error}
+	}
+	return result.Delivered, nil
+}
+
+type MachineEventError struct {
+	Message string
+}
+
+func (e *MachineEventError) Error() string {
+	return "machine-event: " + e.Message
+}
+
+func (s *Socket) readLoop() {
+	for {
+		msg, err := s.readText()
+		if err != nil {
+			s.shutdown(err)
+			return
+		}
+		s.handleFrame(msg)
+	}
+}
+
+func (s *Socket) handleFrame(msg string) {
+	if msg == "" {
+		return
+	}
+	switch msg[0] {
+	case '1':
+		s.shutdown(ErrSocketClosed)
+	case '2':
+		_ = s.writeText("3" + msg[1:])
+	case '4':
+		s.handleSocketPacket(msg[1:])
+	}
+}
+
+func (s *Socket) handleSocketPacket(payload string) {
+	if payload == "" {
+		return
+	}
+	switch payload[0] {
+	case '2':
+		name, id, args, err := parseEvent(payload[1:])
+		if err != nil {
+			return
+		}
+		s.handleEvent(name, id, args)
+	case '3':
+		id, args, err := parseAck(payload[1:])
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		ch := s.pendingAck[id]
+		s.mu.Unlock()
+		if ch != nil {
+			select {
+			case ch <- args:
+			default:
+			}
+		}
+	}
+}
+
+func (s *Socket) handleEvent(name string, id *int, args []json.RawMessage) {
+	switch name {
+	case "rpc-request":
+		var req struct {
+			Method string `json:"method"`
+			Params string `json:"params"`
+		}
+		if id != nil && len(args) > 0 && json.Unmarshal(args[0], &req) == nil {
+			s.mu.Lock()
+			h := s.rpc[req.Method]
+			s.mu.Unlock()
+			if h != nil {
+				ackID := *id
+				go func() {
+					pkt, err := buildAck(ackID, h(req.Params))
+					if err == nil {
+						_ = s.writeText("4" + pkt)
+					}
+				}()
+				return
+			}
+		}
+	case "machine-command":
+		var cmd MachineCommand
+		s.mu.Lock()
+		h := s.commands
+		s.mu.Unlock()
+		if h != nil && id != nil && len(args) > 0 && json.Unmarshal(args[0], &cmd) == nil {
+			ackID := *id
+			go func() {
+				pkt, err := buildAck(ackID, h(cmd))
+				if err == nil {
+					_ = s.writeText("4" + pkt)
+				}
+			}()
+		}
+	case "rpc-registered":
+		var body struct {
+			Method string `json:"method"`
+		}
+		if len(args) > 0 && json.Unmarshal(args[0], &body) == nil {
+			s.mu.Lock()
+			ch := s.registered[body.Method]
+			delete(s.registered, body.Method)
+			s.mu.Unlock()
+			if ch != nil {
+				close(ch)
+			}
+		}
+	}
+
+	select {
+	case s.events <- Event{Name: name, Args: args}:
+	case <-s.done:
+	}
+}
+
+func (s *Socket) readText() (string, error) {
+	_, data, err := s.ws.ReadMessage()
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+func (s *Socket) writeText(msg string) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	return s.ws.WriteMessage(websocket.TextMessage, []byte(msg))
+}
+
+// stripNamespace drops an optional "/nsp," prefix; the server only uses "/".
+func stripNamespace(s string) string {
+	if !strings.HasPrefix(s, "/") {
+		return s
+	}
+	if comma := strings.IndexByte(s, ','); comma != -1 {
+		return s[comma+1:]
+	}
+	return s
+}
+
+func splitID(s string) (*int, string) {
+	i := 0
+	for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+		i++
+	}
+	if i == 0 {
+		return nil, s
+	}
+	v, err := strconv.Atoi(s[:i])
+	if err != nil {
+		return nil, s
+	}
+	return &v, s[i:]
+}
+
+func parseEvent(s string) (string, *int, []json.RawMessage, error) {
+	id, rest := splitID(stripNamespace(s))
+	var arr []json.RawMessage
+	if err := json.Unmarshal([]byte(rest), &arr); err != nil {
+		return "", nil, nil, err
+	}
+	if len(arr) == 0 {
+		return "", nil, nil, errors.New("missing event name")
+	}
+	var name string
+	if err := json.Unmarshal(arr[0], &name); err != nil {
+		return "", nil, nil, err
+	}
+	return name, id, arr[1:], nil
+}
+
+func parseAck(s string) (int, []json.RawMessage, error) {
+	id, rest := splitID(stripNamespace(s))
+	if id == nil {
+		return 0, nil, errors.New("missing ack id")
+	}
+	var arr []json.RawMessage
+	if err := json.Unmarshal([]byte(rest), &arr); err != nil {
+		return 0, nil, err
+	}
+	return *id, arr, nil
+}
+
+func buildEvent(id *int, event string, args ...any) (string, error) {
+	arr := append([]any{event}, args...)
+	data, err := json.Marshal(arr)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	b.WriteByte('2')
+	if id != nil {
+		b.WriteString(strconv.Itoa(*id))
+	}
+	b.Write(data)
+	return b.String(), nil
+}
+
+func buildAck(id int, args ...any) (string, error) {
+	data, err := json.Marshal(args)
+	if err != nil {
+		return "", err
+	}
+	return "3" + strconv.Itoa(id) + string(data), nil
+}
@@ -0,0 +1,1277 @@
+// Package happyserver exposes the lite server as a library so it can be
+// embedded in another binary or started from tests in other repositories.
+package happyserver
+
+import (
+	"context"
+	"crypto"
+	"crypto/tls"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"happy-server-lite/internal/apierror"
+	"happy-server-lite/internal/auth"
+	"happy-server-lite/internal/blobstore"
+	"happy-server-lite/internal/clock"
+	"happy-server-lite/internal/config"
+	"happy-server-lite/internal/github"
+	"happy-server-lite/internal/handler"
+	"happy-server-lite/internal/ids"
+	"happy-server-lite/internal/middleware"
+	"happy-server-lite/internal/purge"
+	"happy-server-lite/internal/push"
+	"happy-server-lite/internal/replication"
+	"happy-server-lite/internal/selfcheck"
+	"happy-server-lite/internal/server"
+	"happy-server-lite/internal/socketio"
+	"happy-server-lite/internal/store"
+	"happy-server-lite/internal/summarize"
+)
+
+const defaultIssuer = "happy-server-lite"
+
+// sqliteDriver is the database/sql driver name registered by
+// github.com/mattn/go-sqlite3.
+const sqliteDriver = "sqlite3"
+
+// postgresDriver is the database/sql driver name registered by
+// github.com/jackc/pgx/v5/stdlib.
+const postgresDriver = "pgx"
+
+type Option func(*options)
+
+type options struct {
+	cfg    config.Config
+	issuer string
+	// newID overrides the generator picked by cfg.IDStrategy.
+	newID func() string
+	clock clock.Clock
+	// signingKey overrides cfg.TokenSigningKeyFile.
+	signingKey     crypto.Signer
+	previousPublic []auth.SigningKey
+	// pushTemplates override cfg.PushTemplatesFile, by event type and
+	// locale.
+	pushTemplates map[string]map[string]push.Template
+	// githubEndpoints override GitHub's OAuth and API URLs.
+	githubEndpoints github.Config
+}
+
+func WithMasterSecret(secret string) Option {
+	return func(o *options) { o.cfg.MasterSecret = secret }
+}
+
+// WithMasterSecretKID names the master secret in the kid header of the tokens
+// it signs, so it can later be rotated out with WithPreviousSecret.
+func WithMasterSecretKID(kid string) Option {
+	return func(o *options) { o.cfg.MasterSecretKID = kid }
+}
+
+// WithPreviousSecret keeps accepting tokens signed by a secret rotated out of
+// signing, named by the kid it signed them with, until they expire. It needs
+// WithMasterSecretKID.
+func WithPreviousSecret(kid, secret string) Option {
+	return func(o *options) {
+		o.cfg.PreviousSecrets = append(o.cfg.PreviousSecrets, config.SigningKey{ID: kid, Secret: secret})
+	}
+}
+
+// WithTokenSigningKey signs tokens with an ed25519.PrivateKey (EdDSA) or an
+// *rsa.PrivateKey of at least 2048 bits (RS256) instead of the master secret,
+// which becomes optional and only verifies the tokens it signed before. The
+// public key is served at /.well-known/jwks.json.
+func WithTokenSigningKey(key crypto.Signer) Option {
+	return func(o *options) { o.signingKey = key }
+}
+
+// WithPreviousPublicKey keeps accepting tokens signed by a private key rotated
+// out of signing, named by the kid it signed them with, until they expire. It
+// needs WithMasterSecretKID.
+func WithPreviousPublicKey(kid string, key crypto.PublicKey) Option {
+	return func(o *options) {
+		o.previousPublic = append(o.previousPublic, auth.SigningKey{ID: kid, PublicKey: key})
+	}
+}
+
+func WithPort(port int) Option {
+	return func(o *options) { o.cfg.Port = port }
+}
+
+func WithTLS(certFile, keyFile string) Option {
+	return func(o *options) {
+		o.cfg.TLSCertFile = certFile
+		o.cfg.TLSKeyFile = keyFile
+	}
+}
+
+// WithMachineClientCerts verifies client certificates issued by the CAs in
+// the PEM bundle at caFile and binds each to the machine id in its common
+// name. Daemons may still connect with their token alone unless required.
+// It needs WithTLS.
+func WithMachineClientCerts(caFile string, required bool) Option {
+	return func(o *options) {
+		o.cfg.TLSClientCAFile = caFile
+		o.cfg.RequireMachineCert = required
+	}
+}
+
+func WithTokenExpiry(expiry time.Duration) Option {
+	return func(o *options) { o.cfg.TokenExpiry = expiry }
+}
+
+// WithRefreshTokens hands out a refresh token with each access token, valid
+// for expiry unused, and serves POST /v1/auth/refresh. Zero turns them off.
+func WithRefreshTokens(expiry time.Duration) Option {
+	return func(o *options) { o.cfg.RefreshTokenExpiry = expiry }
+}
+
+// WithTokenIssuer names the server in the iss of the tokens it signs, and
+// refuses tokens from any other issuer.
+func WithTokenIssuer(issuer string) Option {
+	return func(o *options) { o.issuer = issuer }
+}
+
+// WithTokenAudience signs tokens for audience and refuses tokens for any
+// other, so servers sharing a signing key do not accept each other's
+// tokens. Tokens signed without it stop verifying.
+func WithTokenAudience(audience string) Option {
+	return func(o *options) { o.cfg.TokenAudience = audience }
+}
+
+func WithMachinesStateFile(path string) Option {
+	return func(o *options) { o.cfg.MachinesStateFile = path }
+}
+
+// WithMachinesFlushInterval writes the machines state file at most once per
+// interval, and on Shutdown, instead of after every change. Zero writes after
+// every change.
+func WithMachinesFlushInterval(interval time.Duration) Option {
+	return func(o *options) { o.cfg.MachinesFlushInterval = interval }
+}
+
+// WithMessageJournal keeps messages in append-only per-session journals under
+// dir, compacted every interval (zero picks one hour). It needs
+// WithSessionsStateFile or WithStatePartitions.
+func WithMessageJournal(dir string, interval time.Duration) Option {
+	return func(o *options) {
+		o.cfg.MessageJournalDir = dir
+		o.cfg.JournalCompactInterval = interval
+	}
+}
+
+// WithStatePartitions keeps what the state files would hold in one file per
+// account under dir instead, each encrypted with a key derived from key for
+// that account. It replaces the WithXStateFile options.
+func WithStatePartitions(dir, key string) Option {
+	return func(o *options) {
+		o.cfg.StatePartitionDir = dir
+		o.cfg.StatePartitionKey = key
+	}
+}
+
+// WithSessionsStateFile keeps sessions and their messages in a JSON file at
+// path so they survive restarts.
+func WithSessionsStateFile(path string) Option {
+	return func(o *options) { o.cfg.SessionsStateFile = path }
+}
+
+// WithArtifactsStateFile keeps artifacts in a JSON file at path so they,
+// and the data encryption keys they carry, survive restarts.
+func WithArtifactsStateFile(path string) Option {
+	return func(o *options) { o.cfg.ArtifactsStateFile = path }
+}
+
+// WithAccountsStateFile keeps accounts and their settings in a JSON file at
+// path, so users keep their ids, and issued tokens keep working, across
+// restarts.
+func WithAccountsStateFile(path string) Option {
+	return func(o *options) { o.cfg.AccountsStateFile = path }
+}
+
+// WithGinMode sets gin's process-wide mode when the server is constructed.
+// An empty mode leaves the current gin mode untouched.
+func WithGinMode(mode string) Option {
+	return func(o *options) { o.cfg.GinMode = mode }
+}
+
+// WithErrorFormat selects "legacy" or "envelope" error bodies by default;
+// clients can still opt in per request with the X-Error-Format header.
+func WithErrorFormat(format string) Option {
+	return func(o *options) { o.cfg.ErrorFormat = format }
+}
+
+// WithHTTPRateLimit limits how many requests one client IP may make to a
+// route group ("auth", "read", "write" or "socket-upgrade") per window. The
+// first call replaces the built-in limits.
+func WithHTTPRateLimit(group string, limit int, window time.Duration) Option {
+	return func(o *options) {
+		if o.cfg.HTTPRateLimits == nil {
+			o.cfg.HTTPRateLimits = make(map[string]config.RateLimit)
+		}
+		o.cfg.HTTPRateLimits[group] = config.RateLimit{Limit: limit, Window: window}
+	}
+}
+
+// WithoutHTTPRateLimits turns off the built-in per-IP request limits.
+func WithoutHTTPRateLimits() Option {
+	return func(o *options) { o.cfg.HTTPRateLimits = map[string]config.RateLimit{} }
+}
+
+// WithSocketEventRateLimit limits how often one connection may send event;
+// use "*" for the fallback applied to events without their own limit.
+func WithSocketEventRateLimit(event string, limit int, window time.Duration) Option {
+	return func(o *options) {
+		if o.cfg.SocketEventRateLimits == nil {
+			o.cfg.SocketEventRateLimits = make(map[string]config.RateLimit)
+		}
+		o.cfg.SocketEventRateLimits[event] = config.RateLimit{Limit: limit, Window: window}
+	}
+}
+
+// WithoutSocketEventRateLimits turns off the built-in per-event limits.
+func WithoutSocketEventRateLimits() Option {
+	return func(o *options) { o.cfg.SocketEventRateLimits = map[string]config.RateLimit{} }
+}
+
+// WithMaxBlobBytes caps the size of metadata, daemon state, agent state and
+// account settings blobs. Zero keeps the default, negative disables the cap.
+func WithMaxBlobBytes(metadata, daemonState, agentState, settings int) Option {
+	return func(o *options) {
+		o.cfg.MaxMetadataBytes = metadata
+		o.cfg.MaxDaemonStateBytes = daemonState
+		o.cfg.MaxAgentStateBytes = agentState
+		o.cfg.MaxSettingsBytes = settings
+	}
+}
+
+// WithSocketHandshakeTimeout closes Socket.IO connections that have not sent
+// their connect packet within d.
+func WithSocketHandshakeTimeout(d time.Duration) Option {
+	return func(o *options) { o.cfg.SocketHandshakeTimeout = d }
+}
+
+// WithSessionStallTimeout sets how long a connected daemon may go without
+// session-alive before its session is reported stalled; zero disables it.
+func WithSessionStallTimeout(d time.Duration) Option {
+	return func(o *options) { o.cfg.SessionStallTimeout = d }
+}
+
+// WithRequiredSocketHandshakeToken refuses Socket.IO upgrades that do not
+// carry a valid token in the token query parameter or an Authorization
+// header, instead of waiting for the connect packet.
+func WithRequiredSocketHandshakeToken() Option {
+	return func(o *options) { o.cfg.SocketRequireHandshakeToken = true }
+}
+
+// WithClientAuthChallenges makes /v1/auth accept any challenge the client
+// signs, as well as the single-use ones issued by /v1/auth/challenge. It is
+// for clients that predate the challenge endpoint; such signatures can be
+// replayed.
+func WithClientAuthChallenges() Option {
+	return func(o *options) { o.cfg.AuthAllowClientChallenge = true }
+}
+
+// WithAuthLockout locks client addresses out of /v1/auth, and turns away
+// further bad signatures for a public key, after that many bad signatures in
+// a row, for lockout at first and twice as long with each failure after, up
+// to max. Zero after disables the lockout, which is on after 5 failures by
+// default; zero durations keep the defaults of a minute and an hour.
+func WithAuthLockout(after int, lockout, max time.Duration) Option {
+	return func(o *options) {
+		o.cfg.AuthLockoutAfter = after
+		o.cfg.AuthLockout = lockout
+		o.cfg.AuthLockoutMax = max
+	}
+}
+
+// WithSocketMaxPendingPerIP caps how many sockets one IP may hold open before
+// they complete the Socket.IO connect; negative removes the cap.
+func WithSocketMaxPendingPerIP(n int) Option {
+	return func(o *options) { o.cfg.SocketMaxPendingPerIP = n }
+}
+
+// WithRPCRelayLimits bounds concurrent rpc-call relays and how many may queue
+// before callers are told the server is busy. Zero keeps the default.
+func WithRPCRelayLimits(workers, queueDepth int) Option {
+	return func(o *options) {
+		o.cfg.SocketRPCWorkers = workers
+		o.cfg.SocketRPCQueueDepth = queueDepth
+	}
+}
+
+// WithWebSocketLimits tunes the raw /ws transport: the maximum inbound
+// message size and the pong and write deadlines. Zero keeps the default.
+func WithWebSocketLimits(readLimitBytes int64, pongWait, writeWait time.Duration) Option {
+	return func(o *options) {
+		o.cfg.WSReadLimitBytes = readLimitBytes
+		o.cfg.WSPongWait = pongWait
+		o.cfg.WSWriteWait = writeWait
+	}
+}
+
+// WithTombstoneRetention sets how long deleted session and machine ids are
+// reported by /v1/sync.
+func WithTombstoneRetention(d time.Duration) Option {
+	return func(o *options) { o.cfg.TombstoneRetention = d }
+}
+
+// WithAuthRequestTTL drops auth requests nobody polled or answered for ttl,
+// checking every interval. Zero keeps the defaults of ten minutes and one
+// minute.
+func WithAuthRequestTTL(ttl, interval time.Duration) Option {
+	return func(o *options) {
+		o.cfg.AuthRequestTTL = ttl
+		o.cfg.AuthRequestCleanupInterval = interval
+	}
+}
+
+// WithMessageRetention drops messages older than maxAge and all but the
+// newest maxPerSession of each session, checking every interval (zero picks
+// ten minutes). A zero maxAge or maxPerSession disables that limit.
+func WithMessageRetention(maxAge time.Duration, maxPerSession int, interval time.Duration) Option {
+	return func(o *options) {
+		o.cfg.MessageRetention = maxAge
+		o.cfg.MaxMessagesPerSession = maxPerSession
+		o.cfg.MessagePruneInterval = interval
+	}
+}
+
+// WithPurge sets how long deleted sessions and artifacts are kept before the
+// purge job removes them, and how often it runs. Zero keeps the defaults of
+// 30 days and one hour.
+func WithPurge(grace, interval time.Duration) Option {
+	return func(o *options) {
+		o.cfg.PurgeGrace = grace
+		o.cfg.PurgeInterval = interval
+	}
+}
+
+// WithMetricsHistoryInterval sets how often metrics are sampled into the
+// history served at /v1/admin/metrics/history. Zero keeps the default of
+// one minute.
+func WithMetricsHistoryInterval(interval time.Duration) Option {
+	return func(o *options) {
+		o.cfg.MetricsHistoryInterval = interval
+	}
+}
+
+// WithMemoryBudget caps the messages the in-memory store holds, in
+// approximate bytes and in count, evicting the oldest once either is
+// exceeded. Zero disables that limit.
+func WithMemoryBudget(maxBytes int64, maxMessages int) Option {
+	return func(o *options) {
+		o.cfg.MemoryBudgetBytes = maxBytes
+		o.cfg.MemoryBudgetMessages = maxMessages
+	}
+}
+
+// WithSummarizer posts each session's messages to url before message
+// retention drops them and keeps the summary it answers with as an artifact
+// of the session's owner. Messages it fails on stay until the next prune.
+// token, when set, is sent as a bearer token. It needs the memory, sqlite or
+// bolt store.
+func WithSummarizer(url, token string) Option {
+	return func(o *options) {
+		o.cfg.SummarizerURL = url
+		o.cfg.SummarizerToken = token
+	}
+}
+
+// WithLoadShedding answers 503 to the feed, user search and account export
+// while the live heap exceeds maxHeapBytes or more than maxGoroutines are
+// running, leaving the memory to sign-ins, sync and messages. Zero disables
+// that limit.
+func WithLoadShedding(maxHeapBytes uint64, maxGoroutines int) Option {
+	return func(o *options) {
+		o.cfg.LoadShedHeapBytes = maxHeapBytes
+		o.cfg.LoadShedGoroutines = maxGoroutines
+	}
+}
+
+// WithLocalBlobStore keeps binary payloads as files under dir.
+func WithLocalBlobStore(dir string) Option {
+	return func(o *options) {
+		o.cfg.BlobStore = "local"
+		o.cfg.BlobDir = dir
+	}
+}
+
+// WithBoltStore persists the whole store in an embedded bbolt database
+// under dir. The binary must be built with -tags bolt.
+func WithBoltStore(dir string) Option {
+	return func(o *options) {
+		o.cfg.StoreBackend = "bolt"
+		o.cfg.DataDir = dir
+	}
+}
+
+// WithSQLiteStore persists the whole store in the SQLite database at path.
+// The binary must be built with -tags sqlite.
+func WithSQLiteStore(path string) Option {
+	return func(o *options) {
+		o.cfg.StoreBackend = "sqlite"
+		o.cfg.SQLitePath = path
+	}
+}
+
+// WithHydratedUsers makes the sqlite store load a user's sessions, machines
+// and messages on first access instead of on start, keeping at most n users
+// in memory so boot time and memory stay flat as data grows.
+func WithHydratedUsers(n int) Option {
+	return func(o *options) {
+		o.cfg.HydratedUsers = n
+	}
+}
+
+// WithPostgresStore keeps all state in the PostgreSQL database at dsn, which
+// several instances may share. The binary must be built with -tags postgres.
+func WithPostgresStore(dsn string) Option {
+	return func(o *options) {
+		o.cfg.StoreBackend = "postgres"
+		o.cfg.DatabaseURL = dsn
+	}
+}
+
+// WithRedisStore keeps all state in the Redis server at url
+// (redis://[user:password@]host[:port][/db]), which several instances may
+// share.
+func WithRedisStore(url string) Option {
+	return func(o *options) {
+		o.cfg.StoreBackend = "redis"
+		o.cfg.RedisURL = url
+	}
+}
+
+// WithStateCompression compresses metadata, agent state and daemon state of
+// at least minBytes (zero picks 4 KiB) in state files and store records.
+// codec is "gzip" or, in binaries built with -tags zstd, "zstd".
+func WithStateCompression(codec string, minBytes int) Option {
+	return func(o *options) {
+		o.cfg.StateCompression = codec
+		o.cfg.StateCompressionMinBytes = minBytes
+	}
+}
+
+// WithIDStrategy picks how session, message and update ids are generated:
+// "uuid" (the default) or "ulid", whose ids sort by creation time.
+func WithIDStrategy(strategy string) Option {
+	return func(o *options) { o.cfg.IDStrategy = strategy }
+}
+
+// WithIDGenerator generates session, message and update ids with gen, for
+// tests that need predictable ids. gen must be safe for concurrent use and
+// never repeat an id.
+func WithIDGenerator(gen func() string) Option {
+	return func(o *options) { o.newID = gen }
+}
+
+// Clock reports the current time to the server; see WithClock.
+type Clock = clock.Clock
+
+// WithClock makes the server read the time from c when it stamps records,
+// updates and tokens, expires tokens and runs the retention and purge jobs,
+// so tests can move time instead of sleeping. The jobs are still scheduled
+// by the wall clock.
+func WithClock(c Clock) Option {
+	return func(o *options) { o.clock = c }
+}
+
+// WithExpoPush sends device notifications, such as new sign-in requests,
+// through the Expo push API at url (empty picks Expo's). accessToken is
+// needed only when the Expo project enforces push security.
+func WithExpoPush(url, accessToken string) Option {
+	return func(o *options) {
+		o.cfg.PushProvider = "expo"
+		o.cfg.ExpoPushURL = url
+		o.cfg.ExpoAccessToken = accessToken
+	}
+}
+
+// WithGitHub lets accounts link their GitHub user through the OAuth app of
+// clientID. redirectURL is the callback registered with the app, the
+// server's /v1/connect/github/callback; returnURL, when set, is where the
+// browser goes once it is done.
+func WithGitHub(clientID, clientSecret, redirectURL, returnURL string) Option {
+	return func(o *options) {
+		o.cfg.GitHubClientID = clientID
+		o.cfg.GitHubClientSecret = clientSecret
+		o.cfg.GitHubRedirectURL = redirectURL
+		o.cfg.GitHubReturnURL = returnURL
+	}
+}
+
+// WithGitHubEndpoints points WithGitHub at another GitHub, such as a GitHub
+// Enterprise Server: authorizeURL and tokenURL are its OAuth endpoints and
+// apiURL its REST API root. Empty values keep github.com's.
+func WithGitHubEndpoints(authorizeURL, tokenURL, apiURL string) Option {
+	return func(o *options) {
+		o.githubEndpoints = github.Config{AuthorizeURL: authorizeURL, TokenURL: tokenURL, APIURL: apiURL}
+	}
+}
+
+// WithPushTemplate words the notifications for event, such as
+// "auth-request", to devices in locale, such as "de" or "pt-BR". title and
+// body are text/template sources; the event's data, such as {{.publicKey}},
+// is available to them.
+func WithPushTemplate(event, locale, title, body string) Option {
+	return func(o *options) {
+		if o.pushTemplates == nil {
+			o.pushTemplates = make(map[string]map[string]push.Template)
+		}
+		if o.pushTemplates[event] == nil {
+			o.pushTemplates[event] = make(map[string]push.Template)
+		}
+		o.pushTemplates[event][locale] = push.Template{Title: title, Body: body}
+	}
+}
+
+// WithAdminToken enables the /v1/admin API for requests bearing token.
+func WithAdminToken(token string) Option {
+	return func(o *options) { o.cfg.AdminToken = token }
+}
+
+// WithServerInfo sets the name, contact and welcome text reported at / and
+// /v1/server-info. Empty values keep the defaults.
+func WithServerInfo(name, contact, welcome string) Option {
+	return func(o *options) {
+		o.cfg.ServerName = name
+		o.cfg.ServerContact = contact
+		o.cfg.WelcomeText = welcome
+	}
+}
+
+// WithReplicationLog keeps the newest size changes to the store for warm
+// standbys, which tail them from /v1/admin/replication with the admin token.
+// It needs the memory, sqlite or bolt store.
+func WithReplicationLog(size int) Option {
+	return func(o *options) { o.cfg.ReplicationLogSize = size }
+}
+
+// WithStandby starts the server as a warm standby of the primary at
+// primaryURL, which it follows with the primary's admin token. Until promoted
+// through POST /v1/admin/replication/promote it serves only the admin API,
+// so it needs WithAdminToken too, and the memory, sqlite or bolt store.
+func WithStandby(primaryURL, token string) Option {
+	return func(o *options) {
+		o.cfg.ReplicateFrom = primaryURL
+		o.cfg.ReplicationToken = token
+	}
+}
+
+// StoreStats is the snapshot Server.Stats returns.
+type StoreStats = store.Stats
+
+// SelfCheckReport is the outcome of the startup checks Server.SelfCheck
+// returns.
+type SelfCheckReport = selfcheck.Report
+
+type Server struct {
+	cfg     config.Config
+	handler http.Handler
+	backend io.Closer
+	// flusher writes out changes the store holds back for a debounced write.
+	flusher store.Flusher
+	// stats is nil when the store backend keeps no stats.
+	stats store.StatsReporter
+	// stopBackground ends the journal compaction, message pruning, auth
+	// request expiry and purge loops.
+	stopBackground context.CancelFunc
+	// ctx is the parent of every request's and connection's context;
+	// cancel abandons what is still running once shutdown gives up waiting.
+	ctx    context.Context
+	cancel context.CancelFunc
+	// standby is nil unless the server started as a standby.
+	standby *replication.Follower
+	// selfCheck is the outcome of the checks run on startup.
+	selfCheck selfcheck.Report
+	// tlsConfig verifies machine daemons' client certificates; nil when no
+	// client CA bundle is configured.
+	tlsConfig *tls.Config
+	// tokenCfg signs the tokens IssueToken hands out.
+	tokenCfg auth.TokenConfig
+
+	mu      sync.Mutex
+	httpSrv *http.Server
+}
+
+func New(opts ...Option) (*Server, error) {
+	o := options{
+		cfg: config.Config{
+			Port:        3000,
+			TokenExpiry: 7 * 24 * time.Hour,
+
+			MachinesFlushInterval:          250 * time.Millisecond,
+			SocketRateLimitDisconnectAfter: 100,
+			SessionStallTimeout:            5 * time.Minute,
+			AuthLockoutAfter:               5,
+		},
+		issuer: defaultIssuer,
+	}
+	return newServer(o, opts)
+}
+
+// NewFromEnv loads the same environment variables as the standalone binary
+// and then applies opts on top of them.
+func NewFromEnv(opts ...Option) (*Server, error) {
+	cfg, err := config.LoadConfig()
+	if err != nil {
+		return nil, err
+	}
+	issuer := defaultIssuer
+	if cfg.TokenIssuer != "" {
+		issuer = cfg.TokenIssuer
+	}
+	return newServer(options{cfg: cfg, issuer: issuer}, opts)
+}
+
+func newServer(o options, opts []Option) (*Server, error) {
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.signingKey == nil && o.cfg.TokenSigningKeyFile != "" {
+		data, err := os.ReadFile(o.cfg.TokenSigningKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("read token signing key: %w", err)
+		}
+		if o.signingKey, err = auth.ParsePrivateKeyPEM(data); err != nil {
+			return nil, fmt.Errorf("parse token signing key: %w", err)
+		}
+	}
+	if o.cfg.MasterSecret == "" && o.signingKey == nil {
+		return nil, errors.New("master secret is required")
+	}
+	if o.cfg.TokenExpiry <= 0 {
+		return nil, errors.New("invalid token expiry")
+	}
+	var tlsConfig *tls.Config
+	if o.cfg.TLSClientCAFile != "" {
+		if o.cfg.TLSCertFile == "" || o.cfg.TLSKeyFile == "" {
+			return nil, errors.New("client certificates need TLS")
+		}
+		var err error
+		if tlsConfig, err = server.ClientCertTLSConfig(o.cfg.TLSClientCAFile); err != nil {
+			return nil, err
+		}
+	} else if o.cfg.RequireMachineCert {
+		return nil, errors.New("requiring machine certificates needs a client CA bundle")
+	}
+	previousKeys := make([]auth.SigningKey, 0, len(o.cfg.PreviousSecrets)+len(o.previousPublic))
+	for _, k := range o.cfg.PreviousSecrets {
+		previousKeys = append(previousKeys, auth.SigningKey{ID: k.ID, Secret: k.Secret})
+	}
+	previousKeys = append(previousKeys, o.previousPublic...)
+	tokenCfg := auth.TokenConfig{
+		Secret:       o.cfg.MasterSecret,
+		Expiry:       o.cfg.TokenExpiry,
+		Issuer:       o.issuer,
+		Audience:     o.cfg.TokenAudience,
+		PrivateKey:   o.signingKey,
+		KeyID:        o.cfg.MasterSecretKID,
+		PreviousKeys: previousKeys,
+		Clock:        o.clock,
+	}
+	if err := tokenCfg.CheckKeys(); err != nil {
+		return nil, err
+	}
+
+	errorFormat := apierror.FormatLegacy
+	if o.cfg.ErrorFormat != "" {
+		f, ok := apierror.ParseFormat(o.cfg.ErrorFormat)
+		if !ok {
+			return nil, errors.New("invalid error format")
+		}
+		errorFormat = f
+	}
+
+	pushTemplates, err := newPushTemplates(o)
+	if err != nil {
+		return nil, err
+	}
+
+	if o.cfg.GinMode != "" {
+		gin.SetMode(o.cfg.GinMode)
+	}
+	if o.cfg.StateCompression != "" {
+		if _, ok := store.LookupCodec(o.cfg.StateCompression); !ok {
+			return nil, fmt.Errorf("%s compression is not compiled in; rebuild with -tags %s", o.cfg.StateCompression, o.cfg.StateCompression)
+		}
+	}
+	newID, ok := ids.ForStrategy(o.cfg.IDStrategy)
+	if !ok {
+		return nil, errors.New("invalid id strategy")
+	}
+	if o.newID != nil {
+		newID = o.newID
+	}
+	replicating := o.cfg.ReplicationLogSize > 0 || o.cfg.ReplicateFrom != ""
+	if replicating && (o.cfg.StoreBackend == "postgres" || o.cfg.StoreBackend == "redis") {
+		return nil, errors.New("replication needs the memory, sqlite or bolt store backend")
+	}
+	if o.cfg.SummarizerURL != "" && (o.cfg.StoreBackend == "postgres" || o.cfg.StoreBackend == "redis") {
+		return nil, errors.New("the summarizer needs the memory, sqlite or bolt store backend")
+	}
+	if o.cfg.StatePartitionDir != "" && o.cfg.StatePartitionKey == "" {
+		return nil, errors.New("state partitions need a key")
+	}
+	if o.cfg.ReplicateFrom != "" && o.cfg.AdminToken == "" {
+		return nil, errors.New("a standby needs an admin token to be promoted")
+	}
+	var backend io.Closer
+	var st store.Storage
+	// withReplicationLog puts the replication log, when enabled, in front
+	// of the store's backend.
+	var replicationLog *store.ReplicationLog
+	withReplicationLog := func(b store.Backend) store.Backend {
+		if o.cfg.ReplicationLogSize <= 0 {
+			return b
+		}
+		replicationLog = store.NewReplicationLog(b, o.cfg.ReplicationLogSize)
+		return replicationLog
+	}
+	storeOpts := store.Options{
+		MachinesStateFile:     o.cfg.MachinesStateFile,
+		MachinesFlushInterval: o.cfg.MachinesFlushInterval,
+		SessionsStateFile:     o.cfg.SessionsStateFile,
+		ArtifactsStateFile:    o.cfg.ArtifactsStateFile,
+		AccountsStateFile:     o.cfg.AccountsStateFile,
+		MessageJournalDir:     o.cfg.MessageJournalDir,
+		StatePartitionDir:     o.cfg.StatePartitionDir,
+		StatePartitionKey:     []byte(o.cfg.StatePartitionKey),
+		TombstoneRetention:    o.cfg.TombstoneRetention,
+		AuthRequestTTL:        o.cfg.AuthRequestTTL,
+		Compression:           o.cfg.StateCompression,
+		CompressMinBytes:      o.cfg.StateCompressionMinBytes,
+		HydratedUsers:         o.cfg.HydratedUsers,
+
+		MessageRetention:      o.cfg.MessageRetention,
+		MaxMessagesPerSession: o.cfg.MaxMessagesPerSession,
+		PurgeGrace:            o.cfg.PurgeGrace,
+		NewID:                 newID,
+		Clock:                 o.clock,
+		MemoryBudget: store.MemoryBudget{
+			MaxBytes:    o.cfg.MemoryBudgetBytes,
+			MaxMessages: o.cfg.MemoryBudgetMessages,
+		},
+		Limits: store.Limits{
+			MaxMetadataBytes:    o.cfg.MaxMetadataBytes,
+			MaxDaemonStateBytes: o.cfg.MaxDaemonStateBytes,
+			MaxAgentStateBytes:  o.cfg.MaxAgentStateBytes,
+			MaxSettingsBytes:    o.cfg.MaxSettingsBytes,
+		},
+	}
+	// journals is set when the in-memory store keeps message journals to
+	// compact.
+	var journals *store.Store
+	switch o.cfg.StoreBackend {
+	case "":
+		storeOpts.Backend = withReplicationLog(nil)
+		mem, err := store.Open(storeOpts)
+		if err != nil {
+			return nil, err
+		}
+		if o.cfg.MessageJournalDir != "" {
+			journals = mem
+		}
+		st = mem
+	case "sqlite":
+		b, err := openSQLite(o.cfg.SQLitePath)
+		if err != nil {
+			return nil, err
+		}
+		backend = b
+		storeOpts.Backend = withReplicationLog(b)
+		if st, err = store.Open(storeOpts); err != nil {
+			b.Close()
+			return nil, err
+		}
+	case "bolt":
+		b, err := store.OpenBoltBackend(o.cfg.DataDir)
+		if err != nil {
+			return nil, fmt.Errorf("open bolt store: %w", err)
+		}
+		backend = b
+		storeOpts.Backend = withReplicationLog(b)
+		if st, err = store.Open(storeOpts); err != nil {
+			b.Close()
+			return nil, err
+		}
+	case "postgres":
+		pg, err := openPostgres(o.cfg.DatabaseURL, storeOpts)
+		if err != nil {
+			return nil, err
+		}
+		backend = pg
+		st = pg
+	case "redis":
+		rs, err := store.OpenRedis(store.RedisOptions{
+			URL:                o.cfg.RedisURL,
+			KeyPrefix:          o.cfg.RedisKeyPrefix,
+			MaxSessionMessages: o.cfg.RedisMaxSessionMessages,
+		}, storeOpts)
+		if err != nil {
+			return nil, fmt.Errorf("open redis store: %w", err)
+		}
+		backend = rs
+		st = rs
+	default:
+		return nil, errors.New("invalid store backend")
+	}
+	blobs, err := newBlobStore(o.cfg)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	background, stopBackground := context.WithCancel(ctx)
+	if journals != nil {
+		go compactJournals(background, journals, o.cfg.JournalCompactInterval)
+	}
+	var purger *purge.Runner
+	if p, ok := st.(store.Purger); ok {
+		purger = purge.NewWithClock(p, o.clock)
+	}
+	// The jobs that change the store wait for a standby's promotion: until
+	// then the primary's jobs make those changes for it.
+	startJobs := func() {
+		if o.cfg.MessageRetention > 0 || o.cfg.MaxMessagesPerSession > 0 {
+			if p, ok := st.(store.MessagePruner); ok {
+				prune := p.PruneMessages
+				compactor, ok := st.(store.MessageCompactor)
+				if hook := summaryHook(o.cfg, st, o.clock); hook != nil && ok {
+					prune = func(ctx context.Context, nowMillis int64) (int, error) {
+						return compactor.CompactMessages(ctx, nowMillis, hook)
+					}
+				}
+				go pruneMessages(background, prune, o.clock, o.cfg.MessagePruneInterval)
+			}
+		}
+		if e, ok := st.(store.AuthRequestExpirer); ok {
+			go expireAuthRequests(background, e, o.clock, o.cfg.AuthRequestCleanupInterval)
+		}
+		if purger != nil {
+			go purger.Run(background, o.cfg.PurgeInterval)
+		}
+	}
+	var standby *replication.Follower
+	if o.cfg.ReplicateFrom != "" {
+		standby = replication.NewFollower(st.(store.Replica), replication.Config{
+			PrimaryURL: o.cfg.ReplicateFrom,
+			Token:      o.cfg.ReplicationToken,
+			Clock:      o.clock,
+			OnPromote:  startJobs,
+		})
+		standby.Start()
+	} else {
+		startJobs()
+	}
+	startedAt := clock.Now(o.clock).UnixMilli()
+	report := selfcheck.Run(startedAt, selfChecks(o.cfg, tokenCfg))
+	logSelfCheck(report)
+
+	flusher, _ := st.(store.Flusher)
+	stats, _ := st.(store.StatsReporter)
+	return &Server{
+		cfg:            o.cfg,
+		backend:        backend,
+		flusher:        flusher,
+		stats:          stats,
+		stopBackground: stopBackground,
+		ctx:            ctx,
+		cancel:         cancel,
+		standby:        standby,
+		selfCheck:      report,
+		tlsConfig:      tlsConfig,
+		tokenCfg:       tokenCfg,
+		handler: server.NewRouter(server.Deps{
+			Store:        st,
+			TokenConfig:  tokenCfg,
+			ErrorFormat:  errorFormat,
+			SocketLimits: socketLimits(o.cfg),
+			WSLimits: handler.WebSocketLimits{
+				ReadLimit: o.cfg.WSReadLimitBytes,
+				PongWait:  o.cfg.WSPongWait,
+				WriteWait: o.cfg.WSWriteWait,
+			},
+			Blobs:                    blobs,
+			AdminToken:               o.cfg.AdminToken,
+			DebugTapCapacity:         o.cfg.DebugTapCapacity,
+			AuthAuditCapacity:        o.cfg.AuthAuditCapacity,
+			Purge:                    purger,
+			Push:                     newPushSender(o.cfg),
+			PushTemplates:            pushTemplates,
+			GitHub:                   newGitHub(o),
+			GitHubReturnURL:          o.cfg.GitHubReturnURL,
+			AllowClientAuthChallenge: o.cfg.AuthAllowClientChallenge,
+			AuthLockout: middleware.FailureLimit{
+				After:      o.cfg.AuthLockoutAfter,
+				Lockout:    o.cfg.AuthLockout,
+				MaxLockout: o.cfg.AuthLockoutMax,
+			},
+			RateLimits:             httpRateLimits(o.cfg),
+			LoadShedder:            newLoadShedder(o.cfg),
+			NewID:                  newID,
+			Clock:                  o.clock,
+			ReplicationLog:         replicationLog,
+			Standby:                standby,
+			SelfCheck:              &report,
+			StartedAt:              startedAt,
+			RefreshTokenExpiry:     o.cfg.RefreshTokenExpiry,
+			ServerName:             o.cfg.ServerName,
+			ServerContact:          o.cfg.ServerContact,
+			WelcomeText:            o.cfg.WelcomeText,
+			RequireMachineCert:     o.cfg.RequireMachineCert,
+			MetricsHistoryInterval: o.cfg.MetricsHistoryInterval,
+			Context:                ctx,
+		}),
+	}, nil
+}
+
+// selfChecks lists the checks run on startup: that the directories the
+// store and blobs are kept in take writes, that the wall clock is sane, and
+// that tokens signed with the configured secret verify.
+func selfChecks(cfg config.Config, tokenCfg auth.TokenConfig) []selfcheck.Check {
+	var dirs []string
+	for _, path := range []string{cfg.MachinesStateFile, cfg.SessionsStateFile, cfg.ArtifactsStateFile, cfg.AccountsStateFile} {
+		if path != "" {
+			dirs = append(dirs, filepath.Dir(path))
+		}
+	}
+	for _, dir := range []string{cfg.StatePartitionDir, cfg.MessageJournalDir} {
+		if dir != "" {
+			dirs = append(dirs, dir)
+		}
+	}
+	switch cfg.StoreBackend {
+	case "sqlite":
+		dirs = append(dirs, filepath.Dir(cfg.SQLitePath))
+	case "bolt":
+		dirs = append(dirs, cfg.DataDir)
+	}
+	if cfg.BlobStore == "local" {
+		dirs = append(dirs, cfg.BlobDir)
+	}
+
+	var checks []selfcheck.Check
+	if len(dirs) > 0 {
+		checks = append(checks, selfcheck.Check{Name: "persistence", Run: func() error { return selfcheck.WritableDirs(dirs) }})
+	}
+	// The clock check reads the wall clock even when a clock is injected:
+	// it is the host's clock that has to be sane.
+	checks = append(checks,
+		selfcheck.Check{Name: "clock", Run: func() error { return selfcheck.Clock(time.Now) }},
+		selfcheck.Check{Name: "token-signing", Run: func() error { return selfcheck.TokenRoundTrip(tokenCfg) }},
+	)
+	return checks
+}
+
+func logSelfCheck(report selfcheck.Report) {
+	passed := 0
+	for _, r := range report.Checks {
+		if r.OK {
+			passed++
+			continue
+		}
+		log.Printf("self-check %s failed: %s", r.Name, r.Error)
+	}
+	log.Printf("self-check: %d/%d passed", passed, len(report.Checks))
+}
+
+func newBlobStore(cfg config.Config) (blobstore.BlobStore, error) {
+	switch cfg.BlobStore {
+	case "":
+		return nil, nil
+	case "local":
+		return blobstore.NewLocal(cfg.BlobDir)
+	case "s3":
+		return blobstore.NewS3(blobstore.S3Config{
+			Endpoint:        cfg.S3Endpoint,
+			Region:          cfg.S3Region,
+			Bucket:          cfg.S3Bucket,
+			Prefix:          cfg.S3Prefix,
+			AccessKeyID:     cfg.S3AccessKeyID,
+			SecretAccessKey: cfg.S3SecretAccessKey,
+		})
+	default:
+		return nil, errors.New("invalid blob store")
+	}
+}
+
+func newPushSender(cfg config.Config) push.Sender {
+	if cfg.PushProvider != "expo" {
+		return nil
+	}
+	return push.NewExpo(push.ExpoConfig{URL: cfg.ExpoPushURL, AccessToken: cfg.ExpoAccessToken})
+}
+
+func newGitHub(o options) *github.OAuth {
+	if o.cfg.GitHubClientID == "" {
+		return nil
+	}
+	cfg := o.githubEndpoints
+	cfg.ClientID = o.cfg.GitHubClientID
+	cfg.ClientSecret = o.cfg.GitHubClientSecret
+	cfg.RedirectURL = o.cfg.GitHubRedirectURL
+	return github.New(cfg)
+}
+
+// newPushTemplates compiles the notification text of cfg.PushTemplatesFile
+// with the WithPushTemplate overrides on top.
+func newPushTemplates(o options) (*push.Templates, error) {
+	templates := make(map[string]map[string]push.Template)
+	if o.cfg.PushTemplatesFile != "" {
+		data, err := os.ReadFile(o.cfg.PushTemplatesFile)
+		if err != nil {
+			return nil, fmt.Errorf("read push templates: %w", err)
+		}
+		if err := json.Unmarshal(data, &templates); err != nil {
+			return nil, fmt.Errorf("parse push templates: %w", err)
+		}
+	}
+	for event, locales := range o.pushTemplates {
+		if templates[event] == nil {
+			templates[event] = make(map[string]push.Template)
+		}
+		for locale, tmpl := range locales {
+			templates[event][locale] = tmpl
+		}
+	}
+	return push.NewTemplates(templates)
+}
+
+// summaryHook returns nil without a summarizer. Each range becomes an
+// artifact of the session's owner whose id names the session and seqs, so a
+// range retried after a failed prune does not get a second one.
+func summaryHook(cfg config.Config, st store.Storage, c clock.Clock) store.PruneHook {
+	if cfg.SummarizerURL == "" {
+		return nil
+	}
+	client := summarize.NewClient(summarize.Config{URL: cfg.SummarizerURL, Token: cfg.SummarizerToken})
+	return func(ctx context.Context, r store.PrunedRange) error {
+		if r.UserID == "" {
+			return nil
+		}
+		req := summarize.Request{SessionID: r.SessionID, FromSeq: r.Messages[0].Seq, ToSeq: r.Messages[len(r.Messages)-1].Seq}
+		for _, msg := range r.Messages {
+			if !msg.Deleted {
+				req.Messages = append(req.Messages, summarize.Message{Seq: msg.Seq, Content: msg.Content, CreatedAt: msg.CreatedAt})
+			}
+		}
+		if len(req.Messages) == 0 {
+			return nil
+		}
+		summary, err := client.Summarize(ctx, req)
+		if err != nil {
+			return err
+		}
+		id := fmt.Sprintf("summary-%s-%d-%d", r.SessionID, req.FromSeq, req.ToSeq)
+		_, _, err = st.CreateArtifactWithChecksums(ctx, r.UserID, id, summary.Header, summary.Body, summary.DataEncryptionKey, store.ArtifactChecksums{}, clock.Now(c).UnixMilli())
+		return err
+	}
+}
+
+// newLoadShedder returns nil unless a load shedding limit is set.
+func newLoadShedder(cfg config.Config) *middleware.LoadShedder {
+	if cfg.LoadShedHeapBytes == 0 && cfg.LoadShedGoroutines == 0 {
+		return nil
+	}
+	return middleware.NewLoadShedder(middleware.LoadShedLimits{MaxHeapBytes: cfg.LoadShedHeapBytes, MaxGoroutines: cfg.LoadShedGoroutines})
+}
+
+func httpRateLimits(cfg config.Config) map[string]middleware.RateLimit {
+	if cfg.HTTPRateLimits == nil {
+		return middleware.DefaultRateLimits()
+	}
+	limits := make(map[string]middleware.RateLimit, len(cfg.HTTPRateLimits))
+	for group, rl := range cfg.HTTPRateLimits {
+		limits[group] = middleware.RateLimit{Limit: rl.Limit, Window: rl.Window}
+	}
+	return limits
+}
+
+func socketLimits(cfg config.Config) socketio.Limits {
+	limits := socketio.DefaultLimits()
+	limits.MaxRateViolations = cfg.SocketRateLimitDisconnectAfter
+	if cfg.SocketHandshakeTimeout > 0 {
+		limits.HandshakeTimeout = cfg.SocketHandshakeTimeout
+	}
+	limits.SessionStallTimeout = cfg.SessionStallTimeout
+	limits.RPCWorkers = cfg.SocketRPCWorkers
+	limits.RPCQueueDepth = cfg.SocketRPCQueueDepth
+	limits.RequireHandshakeToken = cfg.SocketRequireHandshakeToken
+	if cfg.SocketMaxPendingPerIP != 0 {
+		limits.MaxPendingPerIP = cfg.SocketMaxPendingPerIP
+	}
+	if cfg.SocketEventRateLimits != nil {
+		limits.EventRates = make(map[string]socketio.EventRateLimit, len(cfg.SocketEventRateLimits))
+		for event, rl := range cfg.SocketEventRateLimits {
+			limits.EventRates[event] = socketio.EventRateLimit{Limit: rl.Limit, Window: rl.Window}
+		}
+	}
+	return limits
+}
+
+// Handler returns the fully wired router so callers can mount it on their own
+// mux or wrap it with httptest.NewServer.
+func (s *Server) Handler() http.Handler {
+	return s.handler
+}
+
+// Stats returns the store's record counts, memory use and persistence
+// health, or false for the postgres and redis backends, which keep none.
+func (s *Server) Stats() (StoreStats, bool) {
+	if s.stats == nil {
+		return StoreStats{}, false
+	}
+	return s.stats.Stats(), true
+}
+
+// SelfCheck returns the outcome of the checks run when the server was
+// created, also served at /health/ready.
+func (s *Server) SelfCheck() SelfCheckReport {
+	return s.selfCheck
+}
+
+// IssueToken mints a bearer token for userID as /v1/auth would, for tools
+// and tests that sign users in out of band.
+func (s *Server) IssueToken(userID string) (string, error) {
+	return auth.CreateToken(userID, s.tokenCfg)
+}
+
+func (s *Server) Port() int {
+	return s.cfg.Port
+}
+
+func (s *Server) ListenAndServe() error {
+	s.mu.Lock()
+	if s.httpSrv != nil {
+		s.mu.Unlock()
+		return errors.New("server already started")
+	}
+	srv := server.NewHTTPServer(s.cfg, s.handler)
+	srv.TLSConfig = s.tlsConfig
+	srv.BaseContext = func(net.Listener) context.Context { return s.ctx }
+	s.httpSrv = srv
+	s.mu.Unlock()
+
+	if s.cfg.TLSCertFile != "" && s.cfg.TLSKeyFile != "" {
+		return srv.ListenAndServeTLS(s.cfg.TLSCertFile, s.cfg.TLSKeyFile)
+	}
+	return srv.ListenAndServe()
+}
+
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	srv := s.httpSrv
+	s.stopBackground()
+	s.mu.Unlock()
+	var err error
+	if srv != nil {
+		err = srv.Shutdown(ctx)
+	}
+	// Whatever is still running once ctx expired, or was never tracked by
+	// srv like the socket connections, is cut short.
+	s.cancel()
+	if s.standby != nil {
+		s.standby.Stop()
+	}
+	if s.flusher != nil {
+		s.flusher.Flush()
+	}
+	if s.backend != nil {
+		if cerr := s.backend.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+func compactJournals(ctx context.Context, st *store.Store, interval time.Duration) {
+	if interval <= 0 {
+		interval = time.Hour
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			st.CompactJournals()
+		}
+	}
+}
+
+func pruneMessages(ctx context.Context, prune func(ctx context.Context, nowMillis int64) (int, error), c clock.Clock, interval time.Duration) {
+	if interval <= 0 {
+		interval = 10 * time.Minute
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		n, err := prune(ctx, clock.Now(c).UnixMilli())
+		if err != nil {
+			log.Printf("message retention: prune failed: %v", err)
+		} else if n > 0 {
+			log.Printf("message retention: pruned %d messages", n)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func expireAuthRequests(ctx context.Context, e store.AuthRequestExpirer, c clock.Clock, interval time.Duration) {
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := e.ExpireAuthRequests(ctx, clock.Now(c).UnixMilli()); err != nil {
+				log.Printf("auth requests: expire failed: %v", err)
+			}
+		}
+	}
+}
+
+// openSQLite opens the SQLite store backend. The driver is registered by
+// binaries built with -tags sqlite.
+func openSQLite(path string) (*store.SQLBackend, error) {
+	if !slices.Contains(sql.Drivers(), sqliteDriver) {
+		return nil, errors.New("sqlite store backend is not compiled in; rebuild with -tags sqlite")
+	}
+	b, err := store.OpenSQLBackend(sqliteDriver, path)
+	if err != nil {
+		return nil, fmt.Errorf("open sqlite store: %w", err)
+	}
+	return b, nil
+}
+
+// openPostgres opens the PostgreSQL store. The driver is registered by
+// binaries built with -tags postgres.
+func openPostgres(dsn string, opts store.Options) (*store.PostgresStore, error) {
+	if !slices.Contains(sql.Drivers(), postgresDriver) {
+		return nil, errors.New("postgres store backend is not compiled in; rebuild with -tags postgres")
+	}
+	pg, err := store.OpenPostgres(postgresDriver, dsn, opts)
+	if err != nil {
+		return nil, fmt.Errorf("open postgres store: %w", err)
+	}
+	return pg, nil
+}
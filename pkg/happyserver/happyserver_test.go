@@ -0,0 +1,314 @@
+package happyserver
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"happy-server-lite/internal/auth"
+	"happy-server-lite/internal/config"
+	"happy-server-lite/internal/store"
+	"happy-server-lite/pkg/client"
+)
+
+func TestNew_RequiresSecret(t *testing.T) {
+	if _, err := New(); err == nil {
+		t.Fatalf("expected error without master secret")
+	}
+}
+
+func TestNew_ServesHealth(t *testing.T) {
+	srv, err := New(WithMasterSecret("secret"), WithGinMode(gin.TestMode), WithPort(4321))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if srv.Port() != 4321 {
+		t.Fatalf("expected port 4321, got %d", srv.Port())
+	}
+
+	ts := httptest.NewServer(srv.Handler())
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/health")
+	if err != nil {
+		t.Fatalf("GET /health: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	var body map[string]any
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if body["ok"] != true {
+		t.Fatalf("unexpected health body: %v", body)
+	}
+
+	if report := srv.SelfCheck(); !report.OK || len(report.Checks) != 2 {
+		t.Fatalf("unexpected self-check report: %+v", report)
+	}
+	ready, err := http.Get(ts.URL + "/health/ready")
+	if err != nil {
+		t.Fatalf("GET /health/ready: %v", err)
+	}
+	ready.Body.Close()
+	if ready.StatusCode != http.StatusOK {
+		t.Fatalf("expected ready, got %d", ready.StatusCode)
+	}
+}
+
+func TestNew_WithServerInfo(t *testing.T) {
+	srv, err := New(WithMasterSecret("secret"), WithGinMode(gin.TestMode), WithServerInfo("team", "ops@example.com", ""))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	ts := httptest.NewServer(srv.Handler())
+	defer ts.Close()
+
+	info, err := client.New(ts.URL).ServerInfo(context.Background())
+	if err != nil {
+		t.Fatalf("ServerInfo: %v", err)
+	}
+	if info != (client.ServerInfo{Name: "team", Contact: "ops@example.com", Welcome: "Welcome to Happy Server!"}) {
+		t.Fatalf("unexpected server info: %+v", info)
+	}
+}
+
+func TestNew_AcceptsTokensOfPreviousSecrets(t *testing.T) {
+	if _, err := New(WithMasterSecret("new"), WithPreviousSecret("k1", "old")); err == nil {
+		t.Fatalf("expected previous secrets without a key id to be rejected")
+	}
+	srv, err := New(WithMasterSecret("new"), WithMasterSecretKID("k2"), WithPreviousSecret("k1", "old"), WithGinMode(gin.TestMode))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	ts := httptest.NewServer(srv.Handler())
+	defer ts.Close()
+
+	oldToken, err := auth.CreateToken("user-1", auth.TokenConfig{Secret: "old", KeyID: "k1", Expiry: time.Hour, Issuer: defaultIssuer})
+	if err != nil {
+		t.Fatalf("CreateToken: %v", err)
+	}
+	if _, err := client.New(ts.URL, client.WithToken(oldToken)).Profile(context.Background()); err != nil {
+		t.Fatalf("expected a token of the previous secret to work: %v", err)
+	}
+}
+
+func TestNew_WithTokenSigningKey(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "token-key.pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	srv, err := newServer(options{cfg: config.Config{TokenExpiry: time.Hour, TokenSigningKeyFile: path}, issuer: defaultIssuer}, []Option{WithMasterSecretKID("k1"), WithGinMode(gin.TestMode)})
+	if err != nil {
+		t.Fatalf("newServer: %v", err)
+	}
+	ts := httptest.NewServer(srv.Handler())
+	defer ts.Close()
+
+	token, err := auth.CreateToken("user-1", auth.TokenConfig{PrivateKey: key, KeyID: "k1", Expiry: time.Hour, Issuer: defaultIssuer})
+	if err != nil {
+		t.Fatalf("CreateToken: %v", err)
+	}
+	if _, err := client.New(ts.URL, client.WithToken(token)).Profile(context.Background()); err != nil {
+		t.Fatalf("expected a token of the signing key to work: %v", err)
+	}
+
+	res, err := http.Get(ts.URL + "/.well-known/jwks.json")
+	if err != nil {
+		t.Fatalf("GET jwks: %v", err)
+	}
+	defer res.Body.Close()
+	var body struct {
+		Keys []auth.JWK `json:"keys"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		t.Fatalf("decode jwks: %v", err)
+	}
+	want := base64.RawURLEncoding.EncodeToString(key.Public().(ed25519.PublicKey))
+	if len(body.Keys) != 1 || body.Keys[0].KeyID != "k1" || body.Keys[0].X != want {
+		t.Fatalf("unexpected jwks: %+v", body.Keys)
+	}
+}
+
+func TestNew_RejectsInvalidPushTemplates(t *testing.T) {
+	if _, err := New(WithMasterSecret("secret"), WithPushTemplate("auth-request", "de", "Neues Gerät", "")); err == nil {
+		t.Fatalf("expected an error for a template without a body")
+	}
+	if _, err := New(WithMasterSecret("secret"), WithGinMode(gin.TestMode), WithPushTemplate("auth-request", "de", "Neues Gerät", "Anmeldung von {{.publicKey}}")); err != nil {
+		t.Fatalf("New: %v", err)
+	}
+}
+
+func TestSummaryHook_KeepsSummaryArtifact(t *testing.T) {
+	ctx := context.Background()
+	var calls int
+	summarizer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		_ = json.NewEncoder(w).Encode(map[string]string{"header": "aA==", "body": "Yg==", "dataEncryptionKey": "aw=="})
+	}))
+	defer summarizer.Close()
+
+	if _, err := New(WithMasterSecret("secret"), WithRedisStore("redis://localhost"), WithSummarizer(summarizer.URL, "")); err == nil {
+		t.Fatalf("expected the summarizer to need a store that can run the hook")
+	}
+
+	st := store.NewWithOptions(store.Options{MaxMessagesPerSession: 1})
+	sess, _, _ := st.GetOrCreateSession(ctx, "user-1", "tag", "meta", nil, nil, 0)
+	for _, content := range []string{"a", "b", "c"} {
+		st.AppendMessage(ctx, "user-1", sess.ID, content, 0)
+	}
+	hook := summaryHook(config.Config{SummarizerURL: summarizer.URL}, st, nil)
+	for i := 0; i < 2; i++ {
+		if _, err := st.CompactMessages(ctx, 0, hook); err != nil {
+			t.Fatalf("CompactMessages: %v", err)
+		}
+	}
+	artifacts := st.ListArtifacts(ctx, "user-1")
+	if calls != 1 || len(artifacts) != 1 || artifacts[0].ID != "summary-"+sess.ID+"-1-2" {
+		t.Fatalf("expected one summary artifact, got %d calls and %+v", calls, artifacts)
+	}
+}
+
+func TestServer_Stats(t *testing.T) {
+	srv, err := New(WithMasterSecret("secret"), WithGinMode(gin.TestMode))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	stats, ok := srv.Stats()
+	if !ok {
+		t.Fatalf("expected the in-memory store to report stats")
+	}
+	if stats.Sessions != 0 || stats.Persistence.SessionsFile != nil {
+		t.Fatalf("unexpected stats for an empty store: %+v", stats)
+	}
+}
+
+func TestNew_RejectsUnknownIDStrategy(t *testing.T) {
+	if _, err := New(WithMasterSecret("secret"), WithIDStrategy("snowflake")); err == nil {
+		t.Fatalf("expected error for an unknown id strategy")
+	}
+	if _, err := New(WithMasterSecret("secret"), WithGinMode(gin.TestMode), WithIDStrategy("ulid")); err != nil {
+		t.Fatalf("New: %v", err)
+	}
+}
+
+// adminRequest sends an admin API request and decodes the JSON response.
+func adminRequest(t *testing.T, method, url, token string) (int, map[string]any) {
+	t.Helper()
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		t.Fatalf("NewRequest: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, url, err)
+	}
+	defer resp.Body.Close()
+	var body map[string]any
+	_ = json.NewDecoder(resp.Body).Decode(&body)
+	return resp.StatusCode, body
+}
+
+func TestServer_StandbyFollowsAndPromotes(t *testing.T) {
+	ctx := context.Background()
+	primary, err := New(WithMasterSecret("secret"), WithGinMode(gin.TestMode), WithAdminToken("primary-admin"), WithReplicationLog(100))
+	if err != nil {
+		t.Fatalf("New primary: %v", err)
+	}
+	pts := httptest.NewServer(primary.Handler())
+	defer pts.Close()
+	defer primary.Shutdown(ctx)
+
+	token, err := auth.CreateToken("user-1", auth.TokenConfig{Secret: "secret", Expiry: time.Hour, Issuer: defaultIssuer})
+	if err != nil {
+		t.Fatalf("CreateToken: %v", err)
+	}
+	pc := client.New(pts.URL, client.WithToken(token))
+	sess, err := pc.CreateSession(ctx, client.CreateSessionRequest{Tag: "tag", Metadata: "meta"})
+	if err != nil {
+		t.Fatalf("CreateSession: %v", err)
+	}
+	if _, err := pc.PostMessage(ctx, sess.ID, "before", ""); err != nil {
+		t.Fatalf("PostMessage: %v", err)
+	}
+
+	standby, err := New(WithMasterSecret("secret"), WithGinMode(gin.TestMode), WithAdminToken("standby-admin"), WithStandby(pts.URL, "primary-admin"))
+	if err != nil {
+		t.Fatalf("New standby: %v", err)
+	}
+	sts := httptest.NewServer(standby.Handler())
+	defer sts.Close()
+	defer standby.Shutdown(ctx)
+
+	sc := client.New(sts.URL, client.WithToken(token))
+	var apiErr *client.APIError
+	if _, err := sc.ListSessions(ctx); !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected a standby to refuse user requests, got %v", err)
+	}
+	if resp, err := http.Get(sts.URL + "/health"); err != nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected a standby to report unhealthy, got %v %v", resp, err)
+	}
+
+	if _, err := pc.PostMessage(ctx, sess.ID, "after", ""); err != nil {
+		t.Fatalf("PostMessage: %v", err)
+	}
+	_, status := adminRequest(t, http.MethodGet, pts.URL+"/v1/admin/replication", "primary-admin")
+	want := status["log"].(map[string]any)["lsn"]
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, status := adminRequest(t, http.MethodGet, sts.URL+"/v1/admin/replication", "standby-admin")
+		if status["follower"].(map[string]any)["appliedLsn"] == want {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("standby did not catch up to lsn %v: %v", want, status)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if code, body := adminRequest(t, http.MethodPost, sts.URL+"/v1/admin/replication/promote", "standby-admin"); code != http.StatusOK || body["role"] != "primary" {
+		t.Fatalf("promote: %d %v", code, body)
+	}
+	msgs, err := sc.ListMessages(ctx, sess.ID, 0, 10)
+	if err != nil || len(msgs) != 2 {
+		t.Fatalf("expected both messages on the promoted standby, got %+v %v", msgs, err)
+	}
+	if next, err := sc.PostMessage(ctx, sess.ID, "promoted", ""); err != nil || next.Seq != 3 {
+		t.Fatalf("expected the promoted standby to take writes at seq 3, got %+v %v", next, err)
+	}
+	if code, _ := adminRequest(t, http.MethodPost, sts.URL+"/v1/admin/replication/promote", "standby-admin"); code != http.StatusConflict {
+		t.Fatalf("expected a second promote to conflict, got %d", code)
+	}
+}
+
+func TestNew_RejectsReplicationWithSharedStores(t *testing.T) {
+	if _, err := New(WithMasterSecret("secret"), WithRedisStore("redis://localhost"), WithReplicationLog(10)); err == nil {
+		t.Fatalf("expected error for replication with the redis store")
+	}
+	if _, err := New(WithMasterSecret("secret"), WithStandby("http://primary", "t")); err == nil {
+		t.Fatalf("expected error for a standby without an admin token")
+	}
+}
@@ -0,0 +1,17 @@
+//go:build !bolt
+
+package happyserver
+
+import (
+	"errors"
+	"testing"
+
+	"happy-server-lite/internal/store"
+)
+
+func TestNew_BoltStoreRequiresBuildTag(t *testing.T) {
+	_, err := New(WithMasterSecret("secret"), WithBoltStore(t.TempDir()))
+	if !errors.Is(err, store.ErrBoltNotCompiled) {
+		t.Fatalf("expected ErrBoltNotCompiled, got %v", err)
+	}
+}
@@ -0,0 +1,12 @@
+//go:build !postgres
+
+package happyserver
+
+import "testing"
+
+func TestNew_PostgresStoreRequiresBuildTag(t *testing.T) {
+	_, err := New(WithMasterSecret("secret"), WithPostgresStore("postgres://localhost/happy"))
+	if err == nil {
+		t.Fatalf("expected error without the postgres driver")
+	}
+}
@@ -0,0 +1,15 @@
+//go:build !sqlite
+
+package happyserver
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestNew_SQLiteStoreRequiresBuildTag(t *testing.T) {
+	_, err := New(WithMasterSecret("secret"), WithSQLiteStore(filepath.Join(t.TempDir(), "happy.db")))
+	if err == nil {
+		t.Fatalf("expected error without the sqlite driver")
+	}
+}
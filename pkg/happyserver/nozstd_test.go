@@ -0,0 +1,14 @@
+//go:build !zstd
+
+package happyserver
+
+import "testing"
+
+func TestNew_ZstdCompressionRequiresBuildTag(t *testing.T) {
+	if _, err := New(WithMasterSecret("secret"), WithStateCompression("zstd", 0)); err == nil {
+		t.Fatalf("expected error without the zstd codec")
+	}
+	if _, err := New(WithMasterSecret("secret"), WithStateCompression("gzip", 0)); err != nil {
+		t.Fatalf("expected gzip to be built in: %v", err)
+	}
+}
@@ -0,0 +1,5 @@
+//go:build postgres
+
+package happyserver
+
+import _ "github.com/jackc/pgx/v5/stdlib"
@@ -0,0 +1,5 @@
+//go:build sqlite
+
+package happyserver
+
+import _ "github.com/mattn/go-sqlite3"
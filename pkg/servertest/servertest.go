@@ -0,0 +1,223 @@
+// Package servertest spins up a complete in-memory happy-server-lite for
+// tests, in the spirit of net/http/httptest. Every helper fails the test on
+// error, so call sites stay free of plumbing.
+package servertest
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"happy-server-lite/pkg/client"
+	"happy-server-lite/pkg/happyserver"
+)
+
+const DefaultTimeout = 2 * time.Second
+
+type Server struct {
+	URL string
+
+	t  testing.TB
+	hs *happyserver.Server
+}
+
+// New starts a server and registers its shutdown with t.Cleanup. Options are
+// passed through to happyserver.New; the master secret is always generated by
+// the harness.
+func New(t testing.TB, opts ...happyserver.Option) *Server {
+	t.Helper()
+
+	secretBytes := make([]byte, 32)
+	if _, err := rand.Read(secretBytes); err != nil {
+		t.Fatalf("servertest: generate secret: %v", err)
+	}
+	secret := hex.EncodeToString(secretBytes)
+
+	all := append([]happyserver.Option{happyserver.WithGinMode(gin.TestMode)}, opts...)
+	all = append(all, happyserver.WithMasterSecret(secret))
+	hs, err := happyserver.New(all...)
+	if err != nil {
+		t.Fatalf("servertest: new server: %v", err)
+	}
+
+	httpSrv := httptest.NewServer(hs.Handler())
+	t.Cleanup(httpSrv.Close)
+
+	return &Server{
+		URL: httpSrv.URL,
+		t:   t,
+		hs:  hs,
+	}
+}
+
+// Token mints a bearer token for userID without going through /v1/auth.
+func (s *Server) Token(userID string) string {
+	s.t.Helper()
+	tok, err := s.hs.IssueToken(userID)
+	if err != nil {
+		s.t.Fatalf("servertest: create token: %v", err)
+	}
+	return tok
+}
+
+func (s *Server) Client(userID string) *client.Client {
+	return client.New(s.URL, client.WithToken(s.Token(userID)))
+}
+
+func (s *Server) context() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), DefaultTimeout)
+}
+
+func (s *Server) CreateSession(userID, tag string) client.Session {
+	s.t.Helper()
+	ctx, cancel := s.context()
+	defer cancel()
+	sess, err := s.Client(userID).CreateSession(ctx, client.CreateSessionRequest{Tag: tag, Metadata: "metadata-" + tag})
+	if err != nil {
+		s.t.Fatalf("servertest: create session: %v", err)
+	}
+	return sess
+}
+
+func (s *Server) CreateMachine(userID, machineID string) client.Machine {
+	s.t.Helper()
+	ctx, cancel := s.context()
+	defer cancel()
+	m, err := s.Client(userID).UpsertMachine(ctx, client.UpsertMachineRequest{ID: machineID, Metadata: "metadata-" + machineID})
+	if err != nil {
+		s.t.Fatalf("servertest: create machine: %v", err)
+	}
+	return m
+}
+
+// ConnectUser opens a user-scoped socket, the kind the mobile app holds.
+func (s *Server) ConnectUser(userID string) *Socket {
+	s.t.Helper()
+	return s.Connect(userID, client.SocketOptions{ClientType: client.ClientTypeUser})
+}
+
+func (s *Server) ConnectSession(userID, sessionID string) *Socket {
+	s.t.Helper()
+	return s.Connect(userID, client.SocketOptions{ClientType: client.ClientTypeSession, SessionID: sessionID})
+}
+
+func (s *Server) ConnectMachine(userID, machineID string) *Socket {
+	s.t.Helper()
+	return s.Connect(userID, client.SocketOptions{
+		Path:       client.PathMachineDaemon,
+		ClientType: client.ClientTypeMachine,
+		MachineID:  machineID,
+	})
+}
+
+func (s *Server) Connect(userID string, opts client.SocketOptions) *Socket {
+	s.t.Helper()
+	ctx, cancel := s.context()
+	defer cancel()
+	sock, err := s.Client(userID).ConnectSocket(ctx, opts)
+	if err != nil {
+		s.t.Fatalf("servertest: connect %s: %v", opts.ClientType, err)
+	}
+	s.t.Cleanup(func() { _ = sock.Close() })
+	return &Socket{Socket: sock, t: s.t}
+}
+
+type Socket struct {
+	*client.Socket
+	t testing.TB
+}
+
+// Update is the decoded argument of an "update" event.
+type Update struct {
+	ID        string         `json:"id"`
+	Seq       int64          `json:"seq"`
+	CreatedAt int64          `json:"createdAt"`
+	Body      map[string]any `json:"body"`
+	Schema    int            `json:"v"`
+}
+
+func (u Update) Type() string {
+	t, _ := u.Body["t"].(string)
+	return t
+}
+
+func (s *Socket) Emit(event string, args ...any) {
+	s.t.Helper()
+	if err := s.Socket.Emit(event, args...); err != nil {
+		s.t.Fatalf("servertest: emit %s: %v", event, err)
+	}
+}
+
+// WaitEvent returns the next event called name, discarding any others.
+func (s *Socket) WaitEvent(name string) client.Event {
+	s.t.Helper()
+	return s.WaitEventMatching(name, func(client.Event) bool { return true })
+}
+
+func (s *Socket) WaitEventMatching(name string, match func(client.Event) bool) client.Event {
+	s.t.Helper()
+	timer := time.NewTimer(DefaultTimeout)
+	defer timer.Stop()
+	for {
+		select {
+		case ev := <-s.Events():
+			if ev.Name == name && match(ev) {
+				return ev
+			}
+		case <-s.Done():
+			// Events read before the close are still buffered.
+			for {
+				select {
+				case ev := <-s.Events():
+					if ev.Name == name && match(ev) {
+						return ev
+					}
+					continue
+				default:
+				}
+				break
+			}
+			s.t.Fatalf("servertest: socket closed waiting for %q: %v", name, s.Err())
+		case <-timer.C:
+			s.t.Fatalf("servertest: timeout waiting for %q", name)
+		}
+	}
+}
+
+// WaitUpdate returns the next "update" event whose body type is t.
+func (s *Socket) WaitUpdate(t string) Update {
+	s.t.Helper()
+	var u Update
+	s.WaitEventMatching("update", func(ev client.Event) bool {
+		var candidate Update
+		if ev.Decode(&candidate) != nil || candidate.Type() != t {
+			return false
+		}
+		u = candidate
+		return true
+	})
+	return u
+}
+
+// ExpectNoEvent fails if an event called name arrives within d.
+func (s *Socket) ExpectNoEvent(name string, d time.Duration) {
+	s.t.Helper()
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	for {
+		select {
+		case ev := <-s.Events():
+			if ev.Name == name {
+				s.t.Fatalf("servertest: unexpected %q event", name)
+			}
+		case <-s.Done():
+			return
+		case <-timer.C:
+			return
+		}
+	}
+}
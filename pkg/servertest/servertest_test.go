@@ -0,0 +1,67 @@
+package servertest
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHarness_MessageFanOut(t *testing.T) {
+	srv := New(t)
+	sess := srv.CreateSession("user-1", "tag")
+
+	user := srv.ConnectUser("user-1")
+	daemon := srv.ConnectSession("user-1", sess.ID)
+	other := srv.ConnectUser("user-2")
+
+	daemon.Emit("message", map[string]string{"sid": sess.ID, "message": "enc"})
+
+	update := user.WaitUpdate("new-message")
+	if update.Body["sid"] != sess.ID {
+		t.Fatalf("unexpected update body: %v", update.Body)
+	}
+	other.ExpectNoEvent("update", 200*time.Millisecond)
+}
+
+func TestHarness_MachineAlive(t *testing.T) {
+	srv := New(t)
+	srv.CreateMachine("user-1", "m1")
+
+	user := srv.ConnectUser("user-1")
+	user.WaitEvent("ephemeral") // server-restarted
+	machine := srv.ConnectMachine("user-1", "m1")
+
+	machine.Emit("machine-alive", map[string]any{"machineId": "m1", "time": 123})
+
+	var activity struct {
+		Type     string `json:"type"`
+		ID       string `json:"id"`
+		ActiveAt int64  `json:"activeAt"`
+	}
+	ev := user.WaitEvent("ephemeral")
+	if err := ev.Decode(&activity); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if activity.Type != "machine-activity" || activity.ID != "m1" || activity.ActiveAt != 123 {
+		t.Fatalf("unexpected activity: %+v", activity)
+	}
+}
+
+func TestHarness_ServerRestartedOnFirstConnect(t *testing.T) {
+	srv := New(t)
+
+	first := srv.ConnectUser("user-1")
+	var restart struct {
+		Type      string `json:"type"`
+		StartedAt int64  `json:"startedAt"`
+	}
+	if err := first.WaitEvent("ephemeral").Decode(&restart); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if restart.Type != "server-restarted" || restart.StartedAt == 0 {
+		t.Fatalf("unexpected restart event: %+v", restart)
+	}
+
+	// Only the user's first connection after boot is told.
+	second := srv.ConnectUser("user-1")
+	second.ExpectNoEvent("ephemeral", 200*time.Millisecond)
+}